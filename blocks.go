@@ -3,42 +3,337 @@
 package blocks
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"errors"
 	"fmt"
+	gohash "hash"
+	"io"
+	"io/ioutil"
 
 	hash "github.com/ipfs/go-blocks/hash"
 	key "github.com/ipfs/go-blocks/key"
 
 	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+	sha3 "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/crypto/sha3"
 )
 
 // Block is a singular block of data in ipfs
 type Block struct {
 	Multihash mh.Multihash
 	Data      []byte
+	// Codec is the format of Data. Blocks without one are keyed by their
+	// bare Multihash, a version 0 key.Cid; typed blocks by a version 1
+	// key.Cid.
+	Codec key.Codec
+
+	// lazy, if set, is where the data of a block made by NewLazyBlock is
+	// read from.
+	lazy *lazyData
+	// pool, if set, is where Release returns Data to.
+	pool *BufferPool
+}
+
+type lazyData struct {
+	size int64
+	open func() (io.ReadCloser, error)
 }
 
+// DefaultMaxBlockSize is the initial MaxBlockSize.
+const DefaultMaxBlockSize = 1 << 20 // 1 MiB
+
+// MaxBlockSize is the largest block, in bytes, that NewSizedBlock,
+// NewVerifiedBlock and the chunk splitters create, and that a BlockService
+// stores by default. Zero or less means no limit. It must be set before any
+// blocks are made.
+var MaxBlockSize = DefaultMaxBlockSize
+
+// ErrBlockTooLarge is returned for blocks larger than MaxBlockSize.
+var ErrBlockTooLarge = errors.New("blocks: block exceeds the maximum size")
+
 // NewBlock creates a Block object from opaque data. It will hash the data.
+//
+// It does not check MaxBlockSize, having no error to return it with: code
+// making blocks of data it did not choose uses NewSizedBlock, or
+// BlockService.NewBlock, and a BlockService refuses to store oversized
+// blocks however they were made.
 func NewBlock(data []byte) *Block {
 	return &Block{Data: data, Multihash: hash.Hash(data)}
 }
 
+// NewSizedBlock is NewBlock, but returns ErrBlockTooLarge if |data| is
+// larger than MaxBlockSize.
+func NewSizedBlock(data []byte) (*Block, error) {
+	if MaxBlockSize > 0 && len(data) > MaxBlockSize {
+		return nil, ErrBlockTooLarge
+	}
+	return NewBlock(data), nil
+}
+
+// MaxInlineSize is the most data an identity multihash, and so an inline
+// block, can hold.
+const MaxInlineSize = 127
+
+// ErrInlineTooLarge is returned by NewInlineBlock for data larger than
+// MaxInlineSize.
+var ErrInlineTooLarge = errors.New("blocks: data too large to inline in a key")
+
+// NewInlineBlock creates a Block whose key holds |data|, in an identity
+// multihash, so that it can be read back from the key alone; see
+// key.Key.InlineData.
+func NewInlineBlock(data []byte) (*Block, error) {
+	if len(data) > MaxInlineSize {
+		return nil, ErrInlineTooLarge
+	}
+	h, err := mh.Encode(data, key.Identity)
+	if err != nil {
+		return nil, err
+	}
+	return &Block{Data: data, Multihash: h}, nil
+}
+
+// ErrHashMismatch is returned for data that does not hash to the multihash
+// it was given with.
+var ErrHashMismatch = errors.New("blocks: data does not match its hash")
+
 // NewBlockWithHash creates a new block when the hash of the data
 // is already known, this is used to save time in situations where
-// we are able to be confident that the data is correct
+// we are able to be confident that the data is correct. |h| must be a well
+// formed multihash, or the *key.DecodeError of key.DecodeMultihash is
+// returned. The data is only hashed again in hash.Debug mode; see
+// NewVerifiedBlock.
 func NewBlockWithHash(data []byte, h mh.Multihash) (*Block, error) {
+	if _, err := key.DecodeMultihash(h); err != nil {
+		return nil, err
+	}
 	if hash.Debug {
-		chk := hash.Hash(data)
-		if string(chk) != string(h) {
-			return nil, errors.New("Data did not match given hash!")
+		if err := checkHash(data, h); err != nil {
+			return nil, err
+		}
+	}
+	return &Block{Data: data, Multihash: h}, nil
+}
+
+// NewVerifiedBlock is NewBlockWithHash for data and hashes from untrusted
+// sources, such as the network: the data is always hashed again, with the
+// function |h| names, and ErrHashMismatch returned if it does not match.
+// Data larger than MaxBlockSize fails with ErrBlockTooLarge before it is
+// hashed.
+func NewVerifiedBlock(data []byte, h mh.Multihash) (*Block, error) {
+	if _, err := key.DecodeMultihash(h); err != nil {
+		return nil, err
+	}
+	if MaxBlockSize > 0 && len(data) > MaxBlockSize {
+		return nil, ErrBlockTooLarge
+	}
+	if err := checkHash(data, h); err != nil {
+		return nil, err
+	}
+	return &Block{Data: data, Multihash: h}, nil
+}
+
+// checkHash returns ErrHashMismatch unless |data| hashes to |h|, with the
+// function |h| names, which need not be the default.
+func checkHash(data []byte, h mh.Multihash) error {
+	dec, err := mh.Decode(h)
+	if err != nil {
+		return err
+	}
+	if dec.Code == key.Identity {
+		if string(dec.Digest) != string(data) {
+			return ErrHashMismatch
 		}
+		return nil
+	}
+	chk, err := mh.Sum(data, dec.Code, dec.Length)
+	if err != nil {
+		return err
+	}
+	if string(chk) != string(h) {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// NewBlockWithHashType creates a Block keyed by the multihash of |data| with
+// the hash function |code|, such as mh.SHA3, truncated to |length| bytes. A
+// |length| of -1 keeps the function's whole digest. It returns an error for
+// functions the multihash package cannot compute.
+func NewBlockWithHashType(data []byte, code, length int) (*Block, error) {
+	if err := CheckHashType(code, length); err != nil {
+		return nil, err
+	}
+	h, err := mh.Sum(data, code, length)
+	if err != nil {
+		return nil, err
 	}
 	return &Block{Data: data, Multihash: h}, nil
 }
 
-// Key returns the block's Multihash as a Key value.
+// CheckHashType returns the error NewBlockWithHashType would for |code| and
+// |length|, without hashing anything.
+func CheckHashType(code, length int) error {
+	max, ok := mh.DefaultLengths[code]
+	if !ok {
+		return fmt.Errorf("blocks: unknown multihash function %d", code)
+	}
+	if length == 0 || length < -1 || length > max {
+		return fmt.Errorf("blocks: invalid digest length %d for %s", length, mh.Codes[code])
+	}
+	if _, err := mh.Sum(nil, code, length); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NewBlockWithCodec is NewBlock for data in |codec|.
+func NewBlockWithCodec(data []byte, codec key.Codec) *Block {
+	return &Block{Data: data, Multihash: hash.Hash(data), Codec: codec}
+}
+
+// NewBlockWithKey is NewBlockWithHash for a block known by |k|, which may be
+// any key.Cid.
+func NewBlockWithKey(data []byte, k key.Key) (*Block, error) {
+	c, err := k.Cid()
+	if err != nil {
+		return nil, err
+	}
+	b, err := NewBlockWithHash(data, c.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if c.Version > 0 {
+		b.Codec = c.Codec
+	}
+	return b, nil
+}
+
+// Key returns the block's Cid as a Key value: its Multihash, if it has no
+// Codec.
 func (b *Block) Key() key.Key {
-	return key.Key(b.Multihash)
+	return b.Cid().Key()
+}
+
+// Cid returns the identifier of the block.
+func (b *Block) Cid() key.Cid {
+	if b.Codec == 0 {
+		return key.NewCidV0(b.Multihash)
+	}
+	return key.NewCidV1(b.Codec, b.Multihash)
+}
+
+// ErrLazyBlock is returned for attempts to store a block made by
+// NewLazyBlock, whose Data is not in memory.
+var ErrLazyBlock = errors.New("blocks: cannot store a lazily read block")
+
+// NewLazyBlock returns a block known by |k| whose data is not in memory but
+// read from the reader |open| returns, anew for each call of Reader, so that
+// large blocks can be streamed without a copy in memory. Its Data is nil,
+// so it is for reading only: blockstores and BlockServices refuse to store
+// it with ErrLazyBlock. |size| is the length of the data, or -1 if it is not
+// known. The data is verified against |k| as it is read; see Reader.
+func NewLazyBlock(k key.Key, size int64, open func() (io.ReadCloser, error)) (*Block, error) {
+	c, err := k.Cid()
+	if err != nil {
+		return nil, err
+	}
+	b := &Block{Multihash: c.Hash, lazy: &lazyData{size: size, open: open}}
+	if c.Version > 0 {
+		b.Codec = c.Codec
+	}
+	return b, nil
+}
+
+// Reader returns a reader of the block's data, from its source if it was
+// made by NewLazyBlock. Such a reader hashes the data as it goes, and ends
+// with ErrHashMismatch in place of io.EOF if it did not match the block's
+// multihash.
+func (b *Block) Reader() (io.ReadCloser, error) {
+	if b.lazy == nil {
+		return ioutil.NopCloser(bytes.NewReader(b.Data)), nil
+	}
+	dec, err := mh.Decode(b.Multihash)
+	if err != nil {
+		return nil, err
+	}
+	h, err := newHasher(dec.Code)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.lazy.open()
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{ReadCloser: rc, h: h, code: dec.Code, digest: dec.Digest}, nil
+}
+
+// Lazy reports whether the block was made by NewLazyBlock, and so has no
+// Data to store.
+func (b *Block) Lazy() bool {
+	return b.lazy != nil
+}
+
+// verifyingReader reads the data of a lazy block, checking at its end that
+// it hashed to |digest| with the function |code|.
+type verifyingReader struct {
+	io.ReadCloser
+	h      gohash.Hash
+	code   int
+	digest []byte
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF {
+		sum := r.h.Sum(nil)
+		if r.code != key.Identity && len(sum) > len(r.digest) {
+			sum = sum[:len(r.digest)] // a truncated digest.
+		}
+		if !bytes.Equal(sum, r.digest) {
+			err = ErrHashMismatch
+		}
+	}
+	return n, err
+}
+
+// newHasher returns a hash of the function |code|, whose sums are the
+// digests mh.Sum makes before truncating them.
+func newHasher(code int) (gohash.Hash, error) {
+	switch code {
+	case key.Identity:
+		return &identityHasher{}, nil
+	case mh.SHA1:
+		return sha1.New(), nil
+	case mh.SHA2_256:
+		return sha256.New(), nil
+	case mh.SHA2_512:
+		return sha512.New(), nil
+	case mh.SHA3:
+		return sha3.New512(), nil
+	}
+	return nil, fmt.Errorf("blocks: unknown multihash function %d", code)
+}
+
+// identityHasher is the identity function as a hash: its sum is the data
+// written to it.
+type identityHasher struct {
+	bytes.Buffer
+}
+
+func (h *identityHasher) Sum(b []byte) []byte { return append(b, h.Bytes()...) }
+func (h *identityHasher) Size() int           { return h.Len() }
+func (h *identityHasher) BlockSize() int      { return 1 }
+
+// Size returns the length of the block's data, or -1 if the block was made
+// by NewLazyBlock without one.
+func (b *Block) Size() int64 {
+	if b.lazy != nil {
+		return b.lazy.size
+	}
+	return int64(len(b.Data))
 }
 
 func (b *Block) String() string {
@@ -1,6 +1,17 @@
 package blocks
 
-import "testing"
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	hash "github.com/ipfs/go-blocks/hash"
+	key "github.com/ipfs/go-blocks/key"
+
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+)
 
 func TestBlocksBasic(t *testing.T) {
 
@@ -14,3 +25,172 @@ func TestBlocksBasic(t *testing.T) {
 	// Test some data
 	NewBlock([]byte("Hello world!"))
 }
+
+func TestNewSizedBlock(t *testing.T) {
+	defer func(old int) { MaxBlockSize = old }(MaxBlockSize)
+	MaxBlockSize = 4
+
+	if _, err := NewSizedBlock([]byte("four")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSizedBlock([]byte("five!")); err != ErrBlockTooLarge {
+		t.Fatalf("expected ErrBlockTooLarge, got %v", err)
+	}
+	MaxBlockSize = 0
+	if _, err := NewSizedBlock([]byte("no limit")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewBlockWithHashType(t *testing.T) {
+	data := []byte("Hello world!")
+	b, err := NewBlockWithHashType(data, mh.SHA2_512, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := mh.Decode(b.Multihash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.Code != mh.SHA2_512 || dec.Length != 32 {
+		t.Fatalf("expected a 32 byte sha2-512 key, got %d bytes of %s", dec.Length, dec.Name)
+	}
+	if b.Key() == NewBlock(data).Key() {
+		t.Fatal("hash function was ignored")
+	}
+
+	for _, c := range []struct{ code, length int }{
+		{mh.SHA2_256, 33},
+		{mh.SHA2_256, 0},
+		{0x99, -1},
+		{mh.BLAKE2B, -1}, // known, but not implemented.
+	} {
+		if _, err := NewBlockWithHashType(data, c.code, c.length); err == nil {
+			t.Errorf("expected an error for function %d, length %d", c.code, c.length)
+		}
+	}
+}
+
+func TestNewBlockWithHashDebugHonorsHashType(t *testing.T) {
+	defer func(old bool) { hash.Debug = old }(hash.Debug)
+	hash.Debug = true
+
+	data := []byte("Hello world!")
+	b, err := NewBlockWithHashType(data, mh.SHA3, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBlockWithHash(data, b.Multihash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBlockWithHash([]byte("other"), b.Multihash); err == nil {
+		t.Fatal("expected mismatched data to be rejected")
+	}
+}
+
+func TestTypedBlockKey(t *testing.T) {
+	data := []byte("Hello world!")
+	plain := NewBlock(data)
+	typed := NewBlockWithCodec(data, key.Raw)
+	if plain.Key() != key.Key(plain.Multihash) {
+		t.Fatal("untyped blocks must keep their multihash key")
+	}
+	if typed.Key() == plain.Key() {
+		t.Fatal("typed block keyed like an untyped one")
+	}
+
+	b, err := NewBlockWithKey(data, typed.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Codec != key.Raw || b.Key() != typed.Key() {
+		t.Fatalf("block rebuilt from its key as %v, codec %x", b, b.Codec)
+	}
+	if b, err := NewBlockWithKey(data, plain.Key()); err != nil || b.Codec != 0 {
+		t.Fatalf("untyped block rebuilt as %v, %v", b, err)
+	}
+}
+
+func TestInlineBlock(t *testing.T) {
+	data := []byte("inline me")
+	b, err := NewInlineBlock(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := b.Key().InlineData()
+	if !ok || string(got) != string(data) {
+		t.Fatalf("inline key holds %q, %v", got, ok)
+	}
+	if _, ok := NewBlock(data).Key().InlineData(); ok {
+		t.Fatal("hashed key reported inline data")
+	}
+	if _, err := NewBlockWithKey(data, b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewInlineBlock(make([]byte, MaxInlineSize+1)); err != ErrInlineTooLarge {
+		t.Fatalf("expected ErrInlineTooLarge, got %v", err)
+	}
+}
+
+func TestLazyBlock(t *testing.T) {
+	data := []byte("read me lazily")
+	k := NewBlock(data).Key()
+	opened := 0
+	b, err := NewLazyBlock(k, int64(len(data)), func() (io.ReadCloser, error) {
+		opened++
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Key() != k || b.Data != nil || b.Size() != int64(len(data)) || opened != 0 {
+		t.Fatalf("lazy block made as %v, size %d, opened %d times", b, b.Size(), opened)
+	}
+	r, err := b.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, data) || opened != 1 {
+		t.Fatalf("read %q, %v after %d opens", got, err, opened)
+	}
+
+	r, _ = NewBlock(data).Reader()
+	if got, _ := ioutil.ReadAll(r); !bytes.Equal(got, data) {
+		t.Fatalf("in-memory block read as %q", got)
+	}
+	if !b.Lazy() || NewBlock(data).Lazy() {
+		t.Fatal("expected only the lazy block reported lazy")
+	}
+
+	wrong, _ := NewLazyBlock(k, int64(len(data)), func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("read me wrongly")), nil
+	})
+	r, _ = wrong.Reader()
+	if _, err := ioutil.ReadAll(r); err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch reading other data, got %v", err)
+	}
+}
+
+func TestNewVerifiedBlock(t *testing.T) {
+	data := []byte("Hello world!")
+	b := NewBlock(data)
+	if _, err := NewVerifiedBlock(data, b.Multihash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVerifiedBlock([]byte("other"), b.Multihash); err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+	truncated := b.Multihash[:len(b.Multihash)-1]
+	for _, f := range []func([]byte, mh.Multihash) (*Block, error){NewVerifiedBlock, NewBlockWithHash} {
+		_, err := f(data, truncated)
+		if de, ok := err.(*key.DecodeError); !ok || de.Err != key.ErrInvalidMultihash {
+			t.Fatalf("expected a malformed multihash rejected, got %v", err)
+		}
+	}
+
+	defer func(old int) { MaxBlockSize = old }(MaxBlockSize)
+	MaxBlockSize = 4
+	if _, err := NewVerifiedBlock(data, b.Multihash); err != ErrBlockTooLarge {
+		t.Fatalf("expected ErrBlockTooLarge, got %v", err)
+	}
+}
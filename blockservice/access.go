@@ -0,0 +1,229 @@
+package blockservice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// readsKind is the metadata kind holding per-block read counts, stored as
+// by encodeCount.
+const readsKind = "reads"
+
+// BlockInfo describes a stored block.
+type BlockInfo struct {
+	Key key.Key
+	// Reads counts the times GetBlock or GetBlocks found the block in the
+	// blockstore while access counting was enabled.
+	Reads uint64
+	// Refs counts the adds of the block not yet matched by a delete, while
+	// reference counting was enabled.
+	Refs uint64
+}
+
+// EnableAccessCounting makes the service count reads of each block, for use
+// by popularity-based pinning or eviction. Counts are kept in memory and
+// added to the blockstore's metadata every |flushInterval|, and on Close, so
+// reads never wait on a write. It returns ErrNotSupported if the blockstore
+// does not implement blockstore.MetadataStore. It must be called before the
+// service is used; calling it again flushes and replaces the first counter.
+func (s *BlockService) EnableAccessCounting(flushInterval time.Duration) error {
+	if flushInterval <= 0 {
+		return fmt.Errorf("blockservice: access count flush interval must be positive, got %s", flushInterval)
+	}
+	ms, ok := s.Blockstore.(blockstore.MetadataStore)
+	if !ok {
+		return ErrNotSupported
+	}
+	if s.access != nil {
+		s.access.Close()
+	}
+	s.access = newAccessCounter(ms, flushInterval)
+	return nil
+}
+
+// countRead records a read of |k| if access counting is enabled.
+func (s *BlockService) countRead(k key.Key) {
+	if s.access != nil {
+		s.access.add(k)
+	}
+}
+
+// GetBlockInfo returns what is known about the stored block |k|, or
+// ErrNotFound if it is not in the blockstore.
+func (s *BlockService) GetBlockInfo(k key.Key) (BlockInfo, error) {
+	has, err := s.Blockstore.Has(k)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	if !has {
+		return BlockInfo{}, ErrNotFound
+	}
+	info := BlockInfo{Key: k}
+	if s.access != nil {
+		if info.Reads, err = s.access.count(k); err != nil {
+			return BlockInfo{}, err
+		}
+	}
+	if s.refs != nil {
+		if info.Refs, err = s.refs.count(k); err != nil {
+			return BlockInfo{}, err
+		}
+	}
+	return info, nil
+}
+
+// TopReads returns up to |n| blocks with the most reads, most read first,
+// and none if |n| is not positive. It returns ErrNotSupported unless access
+// counting is enabled.
+func (s *BlockService) TopReads(ctx context.Context, n int) ([]BlockInfo, error) {
+	if s.access == nil {
+		return nil, ErrNotSupported
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	if err := s.access.flush(); err != nil {
+		return nil, err
+	}
+	var infos []BlockInfo
+	err := s.access.store.ForEachMetadata(ctx, readsKind, func(k key.Key, v []byte) bool {
+		infos = append(infos, BlockInfo{Key: k, Reads: decodeCount(v)})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byReads(infos))
+	if len(infos) > n {
+		infos = infos[:n]
+	}
+	return infos, nil
+}
+
+type byReads []BlockInfo
+
+func (b byReads) Len() int           { return len(b) }
+func (b byReads) Less(i, j int) bool { return b[i].Reads > b[j].Reads }
+func (b byReads) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// decodeCount decodes a count stored as metadata, a big-endian uint64.
+func decodeCount(v []byte) uint64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func encodeCount(n uint64) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, n)
+	return v
+}
+
+// accessCounter batches read counts in memory and periodically adds them to
+// the counts stored in the metadata namespace.
+type accessCounter struct {
+	store blockstore.MetadataStore
+
+	mu      sync.Mutex
+	pending map[key.Key]uint64
+
+	// flushing serializes flushes, which read-modify-write stored counts.
+	flushing sync.Mutex
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newAccessCounter(ms blockstore.MetadataStore, interval time.Duration) *accessCounter {
+	a := &accessCounter{
+		store:   ms,
+		pending: make(map[key.Key]uint64),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go func() {
+		defer close(a.closed)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				a.flush()
+			case <-a.closing:
+				return
+			}
+		}
+	}()
+	return a
+}
+
+func (a *accessCounter) add(k key.Key) {
+	a.mu.Lock()
+	a.pending[k]++
+	a.mu.Unlock()
+}
+
+// count returns the stored count of |k| plus any reads not yet flushed.
+func (a *accessCounter) count(k key.Key) (uint64, error) {
+	a.flushing.Lock()
+	defer a.flushing.Unlock()
+	v, err := a.store.GetMetadata(readsKind, k)
+	if err != nil && !errors.Is(err, blockstore.ErrNotFound) {
+		return 0, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return decodeCount(v) + a.pending[k], nil
+}
+
+// flush adds the pending counts to the stored ones. Counts that could not be
+// written stay pending for the next flush.
+func (a *accessCounter) flush() error {
+	a.flushing.Lock()
+	defer a.flushing.Unlock()
+
+	a.mu.Lock()
+	batch := a.pending
+	a.pending = make(map[key.Key]uint64)
+	a.mu.Unlock()
+
+	var firstErr error
+	for k, n := range batch {
+		err := a.addStored(k, n)
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		a.mu.Lock()
+		a.pending[k] += n
+		a.mu.Unlock()
+	}
+	return firstErr
+}
+
+func (a *accessCounter) addStored(k key.Key, n uint64) error {
+	v, err := a.store.GetMetadata(readsKind, k)
+	if err != nil && !errors.Is(err, blockstore.ErrNotFound) {
+		return err
+	}
+	return a.store.PutMetadata(readsKind, k, encodeCount(decodeCount(v)+n))
+}
+
+// Close stops the periodic flush and writes out the remaining counts.
+func (a *accessCounter) Close() error {
+	close(a.closing)
+	<-a.closed
+	return a.flush()
+}
@@ -0,0 +1,92 @@
+package blockservice
+
+import (
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrAccessDenied is returned for the calls an Authorizer refuses.
+var ErrAccessDenied = errors.New("blockservice: access denied")
+
+type callerKey struct{}
+
+// WithCaller returns |ctx| carrying |caller|, the identity Authorize checks
+// the calls made with it for, such as the tenant a request came from.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFrom returns the caller |ctx| carries, if any.
+func CallerFrom(ctx context.Context) (string, bool) {
+	caller, ok := ctx.Value(callerKey{}).(string)
+	return caller, ok
+}
+
+// Authorizer decides whether |caller| may do |op| to the block |k|: read it
+// with OpGetBlock or OpGetBlocks, add it with OpAddBlock, or delete it with
+// OpDeleteBlock. |caller| is the one WithCaller gave |ctx|, or "" if none
+// was given.
+type Authorizer interface {
+	Authorize(ctx context.Context, caller string, op Operation, k key.Key) bool
+}
+
+// AuthorizerFunc adapts a function to an Authorizer.
+type AuthorizerFunc func(ctx context.Context, caller string, op Operation, k key.Key) bool
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, caller string, op Operation, k key.Key) bool {
+	return f(ctx, caller, op, k)
+}
+
+// Authorize returns a Middleware asking |a| about every call before it is
+// made. Refused calls fail with ErrAccessDenied, and GetBlocks leaves out
+// the blocks refused, as it does those not found.
+func Authorize(a Authorizer) Middleware {
+	return func(next Service) Service {
+		return &authorized{Service: next, a: a}
+	}
+}
+
+type authorized struct {
+	Service
+	a Authorizer
+}
+
+func (z *authorized) allowed(ctx context.Context, op Operation, k key.Key) bool {
+	caller, _ := CallerFrom(ctx)
+	return z.a.Authorize(ctx, caller, op, k)
+}
+
+func (z *authorized) GetBlock(ctx context.Context, k key.Key, opts ...GetOption) (*blocks.Block, error) {
+	if !z.allowed(ctx, OpGetBlock, k) {
+		return nil, ErrAccessDenied
+	}
+	return z.Service.GetBlock(ctx, k, opts...)
+}
+
+func (z *authorized) GetBlocks(ctx context.Context, ks []key.Key) <-chan *blocks.Block {
+	allowed := make([]key.Key, 0, len(ks))
+	for _, k := range ks {
+		if z.allowed(ctx, OpGetBlocks, k) {
+			allowed = append(allowed, k)
+		}
+	}
+	return z.Service.GetBlocks(ctx, allowed)
+}
+
+func (z *authorized) AddBlockCtx(ctx context.Context, b *blocks.Block) (key.Key, error) {
+	if !z.allowed(ctx, OpAddBlock, b.Key()) {
+		return b.Key(), ErrAccessDenied
+	}
+	return z.Service.AddBlockCtx(ctx, b)
+}
+
+func (z *authorized) DeleteBlockCtx(ctx context.Context, k key.Key) error {
+	if !z.allowed(ctx, OpDeleteBlock, k) {
+		return ErrAccessDenied
+	}
+	return z.Service.DeleteBlockCtx(ctx, k)
+}
@@ -0,0 +1,36 @@
+package blockservice
+
+import (
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func benchmarkGetBlocksKnownRemote(b *testing.B, opts GetBlocksOptions) {
+	var remote []*blocks.Block
+	var ks []key.Key
+	for i := 0; i < 1000; i++ {
+		blk := blocks.NewBlock([]byte(fmt.Sprintf("remote %d", i)))
+		remote = append(remote, blk)
+		ks = append(ks, blk.Key())
+	}
+	bs, _ := newServingService(b, remote...)
+	defer bs.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		drain(bs.GetBlocksWith(context.Background(), ks, opts))
+	}
+}
+
+func BenchmarkGetBlocksKnownRemote(b *testing.B) {
+	benchmarkGetBlocksKnownRemote(b, GetBlocksOptions{})
+}
+
+func BenchmarkGetBlocksKnownRemoteSkipLocal(b *testing.B) {
+	benchmarkGetBlocksKnownRemote(b, GetBlocksOptions{SkipLocal: true})
+}
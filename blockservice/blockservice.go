@@ -6,6 +6,9 @@ package blockservice
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	blocks "github.com/ipfs/go-blocks"
 	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
@@ -13,15 +16,17 @@ import (
 	blockstore "github.com/ipfs/go-blocks/blockstore"
 	key "github.com/ipfs/go-blocks/key"
 
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
 	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
+// wc is the default worker configuration, adjusted by the Options to New.
 var wc = worker.Config{
-	// When running on a single core, NumWorkers has a harsh negative effect on
-	// throughput. (-80% when < 25)
-	// Running a lot more workers appears to have very little effect on both
-	// single and multicore configurations.
-	NumWorkers: 25,
+	// How many announcements pay to run at once depends on the machine and
+	// on the exchange, so the worker finds out: it starts at GOMAXPROCS and
+	// grows while blocks wait for a worker. See worker.Config.Adaptive.
+	Adaptive: true,
 
 	// These have no effect on when running on multiple cores, but harsh
 	// negative effect on throughput when running on a single core
@@ -31,9 +36,22 @@ var wc = worker.Config{
 	// effects on throughput.
 	ClientBufferSize: 0,
 	WorkerBufferSize: 0,
+
+	// Keep offering blocks to the exchange through transient failures, so
+	// that stored blocks are eventually announced.
+	RetryBackoff:    time.Second,
+	MaxRetryBackoff: time.Minute,
 }
 
-var ErrNotFound = errors.New("blockservice: key not found")
+// ErrNotFound is returned for blocks neither the blockstore nor the exchange
+// has. It wraps blockstore.ErrNotFound, which blockstores and exchanges
+// report misses with, so that errors.Is(err, blockstore.ErrNotFound) holds
+// for a miss whichever of them reported it.
+var ErrNotFound = fmt.Errorf("blockservice: key not found: %w", blockstore.ErrNotFound)
+
+// ErrNotSupported is returned when the exchange or blockstore does not
+// implement an optional capability an operation relies on.
+var ErrNotSupported = errors.New("blockservice: operation not supported")
 
 // BlockService is a hybrid block datastore. It stores data in a local
 // datastore and may retrieve data from a remote Exchange.
@@ -43,98 +61,1427 @@ type BlockService struct {
 	Blockstore blockstore.Blockstore
 	Exchange   exchange.Interface
 
-	worker *worker.Worker
+	worker  *worker.Worker
+	pending *missQueue
+	stats   *counters
+
+	// offline, if non-zero, keeps reads away from the exchange. See
+	// SetOnline. It is accessed atomically.
+	offline int32
+	// failFastOffline skips the exchange on local misses while it reports
+	// being offline. See SetFailFastOffline.
+	failFastOffline bool
+	// readRepair stores blocks fetched from the exchange in the blockstore.
+	readRepair bool
+	// corrupt, if set, has corrupt local blocks refetched. See
+	// SetCorruptionRepair.
+	corrupt *corruptKeys
+	// adding tracks blocks being stored by AddBlock and friends.
+	adding *inflightAdds
+	// storing and fetching coalesce the concurrent writes of a block, and
+	// the concurrent fetches of a key.
+	storing  *flightGroup
+	fetching *flightGroup
+	// disk guards the blockstore. It is nil unless WithDiskBreaker is given.
+	disk *breaker
+	// panics, if set, has backend panics recovered. See WithPanicRecovery.
+	panics *PanicPolicy
+	// verify checks blocks received from the exchange.
+	verify BlockVerifier
+	// verifyMode says whether local reads are verified. See WithVerifyMode.
+	verifyMode VerifyMode
+	// readStrategy decides whether local hits are cross-checked against the
+	// exchange. nil means LocalFirst.
+	readStrategy ReadStrategy
+	// access counts reads per block. It is nil unless EnableAccessCounting
+	// was called.
+	access *accessCounter
+	// refs counts references per block. It is nil unless EnableRefCounting
+	// was called.
+	refs *refCounter
+	// expiry tracks the blocks added with a TTL. It is nil unless
+	// EnableExpiry was called.
+	expiry *expirer
+	// reprovider announces stored blocks again periodically. It is nil
+	// unless EnableReprovider was called.
+	reprovider *reprovider
+	// metrics, if set, receives a measurement of every operation.
+	metrics Metrics
+	// logger, if set, is given the messages at logLevel or above. See
+	// WithLogger.
+	logger   Logger
+	logLevel LogLevel
+	// tracer, if set, traces reads. See WithTracer.
+	tracer Tracer
+	// readOnly rejects adds and deletes. See WithReadOnly.
+	readOnly bool
+	// maxBlockSize, if positive, is the largest block adds accept.
+	maxBlockSize int
+	// hashCode and hashLength are the multihash NewBlock keys blocks by.
+	hashCode, hashLength int
+	// inlineSize is the most data NewBlock inlines. See WithInlining.
+	inlineSize int
+	// pool, if set, holds the data of blocks read locally. See
+	// WithBufferPool.
+	pool *blocks.BufferPool
+	// localReads is how many blocks GetBlocks reads at once, or 0 to read
+	// them one at a time before asking the exchange for the misses. See
+	// WithParallelLocalReads.
+	localReads int
+	// fetchTimeout, if positive, bounds exchange fetches without a
+	// deadline. See WithFetchTimeout.
+	fetchTimeout time.Duration
+	// notFound remembers the keys found missing. It is nil unless
+	// WithNotFoundCache was given.
+	notFound *notFoundCache
+	// fetches and wants limit exchange requests. They are nil if
+	// unlimited; see WithMaxConcurrentFetches and WithMaxOutstandingWants.
+	fetches, wants *semaphore
+	// provide decides which added blocks are announced. nil means
+	// ProvideAll.
+	provide ProvideStrategy
+	// retry says how failed exchange fetches are retried. See
+	// WithRetryPolicy.
+	retry RetryPolicy
+	// interactive counts the exchange fetches of reads in progress, which
+	// prefetch runs queued behind.
+	interactive *activity
+	prefetch    *prefetcher
+	// pipeline writes the blocks of AddBlockAsync.
+	pipeline *pipeline
+	// events has the subscribers of Subscribe.
+	events *eventHub
+	// wantlist tracks the keys waited on from the exchange. See Wantlist.
+	wantlist *wantlist
+	// provided holds the AddBlockOptions.OnProvided callbacks waiting on
+	// the worker.
+	provided *provideWatchers
+
+	// state is the State, done is closed once Close is done, and
+	// closeDropped and closeErr are what it returned. See shutdown.
+	state        int32
+	closeOnce    sync.Once
+	done         chan struct{}
+	closeDropped int
+	closeErr     error
 }
 
 // NewBlockService creates a BlockService with given datastore instance.
-func New(bs blockstore.Blockstore, rem exchange.Interface) (*BlockService, error) {
+// |opts| adjust its defaults; see Option.
+func New(bs blockstore.Blockstore, rem exchange.Interface, opts ...Option) (*BlockService, error) {
 	if bs == nil {
 		return nil, fmt.Errorf("BlockService requires valid blockstore")
 	}
+	o := options{
+		worker:       wc,
+		maxBlockSize: blocks.MaxBlockSize,
+		hashCode:     mh.SHA2_256,
+		hashLength:   -1,
+
+		pipelineBatch:    defaultPipelineBatch,
+		pipelineInterval: defaultPipelineInterval,
+		pipelineBytes:    defaultPipelineBytes,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	if o.readOnly {
+		bs = blockstore.ReadOnly(bs)
+	}
+
+	stats := newCounters()
+	provided := newProvideWatchers()
+	o.worker.OnProvided = func(k key.Key, latency time.Duration) {
+		stats.provideLatency.observe(latency)
+		provided.fire(k, latency)
+	}
+	if o.worker.RetryBackoff <= 0 {
+		onError := o.worker.OnProvideError
+		o.worker.OnProvideError = func(k key.Key, err error) {
+			if onError != nil {
+				onError(k, err)
+			}
+			// without retries, a failed announcement is given up.
+			provided.drop(k)
+		}
+	}
+	s := &BlockService{
+		Blockstore:   bs,
+		Exchange:     rem,
+		worker:       worker.NewWorker(rem, o.worker),
+		pending:      newMissQueue(),
+		stats:        stats,
+		provided:     provided,
+		events:       newEventHub(&stats.droppedEvents),
+		adding:       newInflightAdds(),
+		storing:      newFlightGroup(),
+		fetching:     newFlightGroup(),
+		disk:         newBreaker(o.diskBreaker),
+		panics:       o.panics,
+		verify:       VerifyHash,
+		verifyMode:   o.verifyMode,
+		tracer:       o.tracer,
+		logger:       o.logger,
+		logLevel:     o.logLevel,
+		readOnly:     blockstore.IsReadOnly(bs),
+		maxBlockSize: o.maxBlockSize,
+		hashCode:     o.hashCode,
+		hashLength:   o.hashLength,
+		inlineSize:   o.inlineSize,
+		pool:         o.pool,
+		localReads:   o.localReads,
+		fetchTimeout: o.fetchTimeout,
+		notFound:     newNotFoundCache(o.notFoundTTL, o.notFoundSize),
+		fetches:      newSemaphore(o.maxFetches),
+		wants:        newSemaphore(o.maxWants),
+		provide:      o.provide,
+		retry:        o.retry,
+		interactive:  &activity{},
+		wantlist:     newWantlist(),
+		done:         make(chan struct{}),
+	}
+	s.prefetch = newPrefetcher(s.interactive, s.prefetchBlocks, o.prefetches)
+	s.pipeline = newPipeline(s.writeBatch, o.pipelineBatch, o.pipelineInterval, o.pipelineBytes)
+	return s, nil
+}
+
+// SetFailFastOffline controls what GetBlock and GetBlocks do on a local miss
+// while the exchange reports (through exchange.Onliner) that it is offline.
+// When enabled they give up immediately, GetBlock returning ErrNotFound,
+// rather than waiting on a fetch that cannot succeed. When disabled (the
+// default) the exchange is asked anyway, e.g. so it can queue the want until
+// it is back online. It must be set before the service is used.
+func (s *BlockService) SetFailFastOffline(enabled bool) {
+	s.failFastOffline = enabled
+}
+
+// SetOnline switches the service between using the exchange (the default)
+// and serving only blocks in the blockstore. While offline, GetBlock and the
+// other reads return ErrNotFound on a local miss at once, without asking the
+// exchange, and GetBlockFromPeer fails with exchange.ErrOffline. Added
+// blocks are still queued for announcement. Unlike the other settings, it
+// may be changed at any time.
+func (s *BlockService) SetOnline(online bool) {
+	var v int32
+	if !online {
+		v = 1
+	}
+	atomic.StoreInt32(&s.offline, v)
+}
+
+// Online reports whether the service uses the exchange. See SetOnline.
+func (s *BlockService) Online() bool {
+	return atomic.LoadInt32(&s.offline) == 0
+}
+
+// SetReadRepair controls whether blocks fetched from the exchange are written
+// back to the blockstore, so that the next read is served locally.
+func (s *BlockService) SetReadRepair(enabled bool) {
+	s.readRepair = enabled
+}
+
+// repair stores |b| locally if read repair is enabled, or if it replaces a
+// corrupt copy; see SetCorruptionRepair. Failures only count
+// towards Stats.Errors; the block was fetched and is still returned.
+func (s *BlockService) repair(b *blocks.Block) {
+	corrupt := s.corrupt != nil && s.corrupt.take(b.Key())
+	if !(s.readRepair || corrupt) || s.readOnly {
+		return
+	}
+	if err := s.Blockstore.Put(b); err != nil {
+		atomic.AddUint64(&s.stats.errors, 1)
+	} else if corrupt {
+		atomic.AddUint64(&s.stats.repaired, 1)
+	}
+}
+
+// exchangeUsable reports whether local misses should be sent to the exchange.
+func (s *BlockService) exchangeUsable() bool {
+	if s.Exchange == nil || !s.Online() {
+		return false
+	}
+	if !s.failFastOffline {
+		return true
+	}
+	o, ok := s.Exchange.(exchange.Onliner)
+	return !ok || o.Online()
+}
+
+// NewBlock creates a block from |data|, keyed by the multihash function the
+// service was configured with (see WithHashType), or inline if it is small
+// enough (see WithInlining). It returns blocks.ErrBlockTooLarge if the
+// service would not accept it.
+func (s *BlockService) NewBlock(data []byte) (*blocks.Block, error) {
+	if s.maxBlockSize > 0 && len(data) > s.maxBlockSize {
+		return nil, blocks.ErrBlockTooLarge
+	}
+	if s.inlineSize > 0 && len(data) <= s.inlineSize {
+		return blocks.NewInlineBlock(data)
+	}
+	return blocks.NewBlockWithHashType(data, s.hashCode, s.hashLength)
+}
 
-	return &BlockService{
-		Blockstore: bs,
-		Exchange:   rem,
-		worker:     worker.NewWorker(rem, wc),
-	}, nil
+// MaxBlockSize returns the size, in bytes, of the largest block the service
+// stores, or zero or less if there is no limit. See WithMaxBlockSize.
+func (s *BlockService) MaxBlockSize() int {
+	return s.maxBlockSize
 }
 
 // AddBlock adds a particular block to the service, Putting it into the datastore.
 // TODO pass a context into this if the remote.HasBlock is going to remain here.
 func (s *BlockService) AddBlock(b *blocks.Block) (key.Key, error) {
+	return s.AddBlockWith(b, AddBlockOptions{})
+}
+
+// AddBlockOptions adjusts how AddBlockWith announces a block. The zero value
+// behaves like AddBlock.
+type AddBlockOptions struct {
+	// RoutingHints are passed to the exchange when the block is announced,
+	// if it implements exchange.HintedAnnouncer, and ignored otherwise. The
+	// blockservice does not interpret them; they might name the peers or
+	// regions likely to want the block.
+	RoutingHints []string
+
+	// Root marks the block as the root of a DAG being added, for the
+	// ProvideStrategy; see ProvideRoots.
+	Root bool
+
+	// TTL, if positive, makes the block expire that long after it is added;
+	// see EnableExpiry, without which AddBlockWith fails with
+	// ErrNotSupported. Adding a block again, with or without a TTL,
+	// replaces the expiry it had.
+	TTL time.Duration
+
+	// Priority orders the block's announcement among those queued, so that
+	// blocks a user waits on, such as the root of a DAG being published,
+	// need not queue behind a large import. The default is
+	// worker.PriorityNormal.
+	Priority worker.Priority
+
+	// OnProvided, if set, is called once the exchange has taken the block,
+	// with how long after it was queued for announcement, so that a
+	// publisher can tell when the block can be found rather than just
+	// queued: right away, with the time since the call, if it was announced
+	// just before, and never if the announcement is given up, or the
+	// ProvideStrategy does not make one.
+	OnProvided func(latency time.Duration)
+}
+
+// AddBlockWithPriority is AddBlock, announcing |b| with |prio|. See
+// AddBlockOptions.Priority.
+func (s *BlockService) AddBlockWithPriority(b *blocks.Block, prio worker.Priority) (key.Key, error) {
+	return s.AddBlockWith(b, AddBlockOptions{Priority: prio})
+}
+
+// AddBlockWith is AddBlock with options.
+func (s *BlockService) AddBlockWith(b *blocks.Block, opts AddBlockOptions) (key.Key, error) {
+	start := time.Now()
 	k := b.Key()
-	err := s.Blockstore.Put(b)
+	if err := s.checkOpen(); err != nil {
+		return k, err
+	}
+	if opts.TTL > 0 && s.expiry == nil {
+		return k, ErrNotSupported
+	}
+	if err := s.put(b); err != nil {
+		return k, err
+	}
+	if opts.TTL > 0 {
+		if err := s.expiry.set(k, time.Now().Add(opts.TTL)); err != nil {
+			return k, err
+		}
+	}
+	if !s.shouldProvide(b, opts.Root) {
+		return k, nil
+	}
+	var pw *provideWatcher
+	if opts.OnProvided != nil {
+		pw = s.provided.watch(k, opts.OnProvided)
+	}
+	// with no context to give up by, it does not wait for room in the queue.
+	if err := s.worker.TryHasBlock(b, opts.RoutingHints, opts.Priority); err != nil {
+		if pw != nil {
+			s.provided.take(k, pw)
+		}
+		if errors.Is(err, worker.ErrQueueFull) {
+			return k, &NotAnnouncedError{Key: k, Err: err}
+		}
+		return "", ErrClosed
+	}
+	// not queued, as announced within the dedup window, or provided already.
+	if pw != nil && !s.worker.Pending(k) && s.provided.take(k, pw) {
+		opts.OnProvided(time.Since(start))
+	}
+	return k, nil
+}
+
+// put stores |b|, registering the add for the duration so that GetBlock can
+// wait for it instead of going to the exchange. Concurrent puts of |b| share
+// one write. It takes a reference to |b| if reference counting is enabled;
+// puts are then made one at a time.
+func (s *BlockService) put(b *blocks.Block) (err error) {
+	if isInline(b) {
+		return nil
+	}
+	start := time.Now()
+	defer func() { s.observe(OpAddBlock, writeOutcome(err), start, b.Key(), len(b.Data), err) }()
+	if s.readOnly {
+		return blockstore.ErrReadOnly
+	}
+	if err := s.checkSize(b); err != nil {
+		return err
+	}
+	done := s.adding.begin(b.Key())
+	defer done()
+	if s.expiry != nil {
+		s.expiry.writes.RLock()
+		defer s.expiry.writes.RUnlock()
+	}
+	if s.refs != nil {
+		s.refs.mu.Lock()
+		defer s.refs.mu.Unlock()
+	}
+	_, _, err = s.storing.do(context.Background(), b.Key(), func() (interface{}, error) {
+		return nil, s.guardWrite(func() error { return s.Blockstore.Put(b) })
+	})
 	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.stats.added, 1)
+	s.notFound.forget([]key.Key{b.Key()})
+	s.publish(EventAdded, b.Key())
+	if s.expiry != nil {
+		if err := s.expiry.clear(b.Key()); err != nil {
+			return err
+		}
+	}
+	if s.refs != nil {
+		return s.refs.take(b.Key())
+	}
+	return nil
+}
+
+// checkSize returns blocks.ErrBlockTooLarge if |b| is larger than the
+// service accepts, and blocks.ErrLazyBlock if it has no Data to store.
+func (s *BlockService) checkSize(b *blocks.Block) error {
+	if b.Lazy() {
+		return blocks.ErrLazyBlock
+	}
+	if s.maxBlockSize > 0 && len(b.Data) > s.maxBlockSize {
+		return blocks.ErrBlockTooLarge
+	}
+	return nil
+}
+
+// NotAnnouncedError is returned by AddBlockCtx when the block was stored but
+// its context was done before it could be queued for announcement, and by
+// AddBlock when the announcement queue is full; see
+// WithMaxQueuedAnnouncements. The block stays stored; callers may announce it
+// later by adding it again.
+type NotAnnouncedError struct {
+	Key key.Key
+	Err error // the context's error, or worker.ErrQueueFull
+}
+
+func (e *NotAnnouncedError) Error() string {
+	return fmt.Sprintf("blockservice: block %s stored but not announced: %s", e.Key, e.Err)
+}
+
+// Unwrap returns the context's error, or worker.ErrQueueFull.
+func (e *NotAnnouncedError) Unwrap() error { return e.Err }
+
+// testHookAfterPut, if set, runs between storing a block and announcing it in
+// AddBlockCtx.
+var testHookAfterPut func()
+
+// AddBlockCtx is like AddBlock, but gives up if |ctx| is done. If it is done
+// before the block is stored, nothing is stored and ctx.Err() is returned.
+// A Put, once started, is not rolled back: if |ctx| is done after it, the key
+// is returned with a *NotAnnouncedError wrapping ctx.Err(). The background
+// announcement is also abandoned if |ctx| is done before it completes.
+func (s *BlockService) AddBlockCtx(ctx context.Context, b *blocks.Block) (key.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := s.checkOpen(); err != nil {
+		return "", err
+	}
+	k := b.Key()
+	if err := s.put(b); err != nil {
 		return k, err
 	}
-	if err := s.worker.HasBlock(b); err != nil {
-		return "", errors.New("blockservice is closed")
+	if testHookAfterPut != nil {
+		testHookAfterPut()
+	}
+	if !s.shouldProvide(b, false) {
+		return k, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return k, &NotAnnouncedError{Key: k, Err: err}
+	}
+	if err := s.worker.HasBlockCtx(ctx, b, nil); err != nil {
+		if ctx.Err() != nil {
+			return k, &NotAnnouncedError{Key: k, Err: err}
+		}
+		return "", ErrClosed
 	}
 	return k, nil
 }
 
+// AddBlocks adds |bs| to the service, storing them with a single
+// Blockstore.ApplyBatch rather than a Put each, and returns their keys in
+// order. If the batch fails, none of the blocks are announced. If |ctx| is
+// done after the batch was written, the blocks stay stored but are not all
+// announced, and ctx.Err() is returned with the keys. Announcements still
+// queued when |ctx| is done are abandoned, as for AddBlockCtx.
+func (s *BlockService) AddBlocks(ctx context.Context, bs []*blocks.Block) ([]key.Key, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	return s.addBlocks(ctx, bs)
+}
+
+// addBlocks is AddBlocks, for the write pipeline too, which is flushed
+// while the service is closing.
+func (s *BlockService) addBlocks(ctx context.Context, bs []*blocks.Block) ([]key.Key, error) {
+	ks := make([]key.Key, len(bs))
+	for i, b := range bs {
+		ks[i] = b.Key()
+		done := s.adding.begin(ks[i])
+		defer done()
+	}
+	if err := s.applyAdds(ctx, bs, ks); err != nil {
+		return nil, err
+	}
+
+	for _, b := range bs {
+		if !s.shouldProvide(b, false) {
+			continue
+		}
+		if err := s.worker.HasBlockCtx(ctx, b, nil); err != nil {
+			if ctx.Err() != nil {
+				return ks, err
+			}
+			return nil, ErrClosed
+		}
+	}
+	return ks, nil
+}
+
+// applyAdds stores |bs|, whose keys are |ks|, in one batch, and takes a
+// reference to each if reference counting is enabled.
+func (s *BlockService) applyAdds(ctx context.Context, bs []*blocks.Block, ks []key.Key) (err error) {
+	bs, ks = withoutInline(bs)
+	if len(bs) == 0 {
+		return nil
+	}
+	start := time.Now()
+	defer func() { s.observe(OpAddBlocks, writeOutcome(err), start, "", -1, err) }()
+	if s.readOnly {
+		return blockstore.ErrReadOnly
+	}
+	for _, b := range bs {
+		if err := s.checkSize(b); err != nil {
+			return err
+		}
+	}
+	if s.expiry != nil {
+		s.expiry.writes.RLock()
+		defer s.expiry.writes.RUnlock()
+	}
+	if s.refs != nil {
+		s.refs.mu.Lock()
+		defer s.refs.mu.Unlock()
+	}
+	if err := s.guardWrite(func() error { return s.Blockstore.ApplyBatch(ctx, bs, nil) }); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.stats.added, uint64(len(bs)))
+	s.notFound.forget(ks)
+	for _, k := range ks {
+		s.publish(EventAdded, k)
+	}
+	if s.expiry != nil {
+		for _, k := range ks {
+			if err := s.expiry.clear(k); err != nil {
+				return err
+			}
+		}
+	}
+	if s.refs == nil {
+		return nil
+	}
+	for _, k := range ks {
+		if err := s.refs.take(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddBlockSync is like AddBlock, but instead of queueing the block to be
+// provided in the background, it waits for the exchange's HasBlock to finish
+// and returns its error. If |ctx| is done first, the block remains stored and
+// ctx.Err() is returned. A block the ProvideStrategy rejects is only stored.
+func (s *BlockService) AddBlockSync(ctx context.Context, b *blocks.Block) (key.Key, error) {
+	k := b.Key()
+	if err := s.checkOpen(); err != nil {
+		return k, err
+	}
+	if err := s.put(b); err != nil {
+		return k, err
+	}
+	if s.Exchange == nil || !s.shouldProvide(b, false) {
+		return k, nil
+	}
+
+	// don't trust the exchange to honor the deadline.
+	done := make(chan error, 1)
+	go func() {
+		done <- s.recovered("exchange HasBlock", func() error { return s.Exchange.HasBlock(ctx, b) })
+	}()
+	select {
+	case err := <-done:
+		return k, err
+	case <-ctx.Done():
+		return k, ctx.Err()
+	}
+}
+
 // GetBlock retrieves a particular block from the service,
-// Getting it from the datastore using the key (hash).
-func (s *BlockService) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
-	block, err := s.Blockstore.Get(k)
+// Getting it from the datastore using the key (hash). |opts| change where it
+// looks, and what it accepts; see GetOption.
+func (s *BlockService) GetBlock(ctx context.Context, k key.Key, opts ...GetOption) (*blocks.Block, error) {
+	o, err := newGetOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return s.getBlock(ctx, k, s.Exchange, o)
+}
+
+// getBlock is GetBlock with |o|, fetching local misses from |f|.
+func (s *BlockService) getBlock(ctx context.Context, k key.Key, f exchange.Fetcher, o getOptions) (got *blocks.Block, err error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	outcome := OutcomeMiss
+	defer func() {
+		size := -1
+		if got != nil {
+			size = len(got.Data)
+		}
+		s.observe(OpGetBlock, outcome, start, k, size, err)
+	}()
+	ctx, span := s.startSpan(ctx, "blockservice.GetBlock")
+	span.SetTag("key", k.B58String())
+	defer func() { span.Finish(err) }()
+
+	if b, ok := inlineBlock(k); ok {
+		outcome = OutcomeLocalHit
+		o.setSource(SourceInline)
+		return b, o.fits(b)
+	}
+	if len(s.withoutKnownMissing([]key.Key{k})) == 0 {
+		return nil, ErrNotFound
+	}
+	var block *blocks.Block
+	err = blockstore.ErrNotFound
+	if !o.remoteOnly {
+		_, lspan := s.startSpan(ctx, "blockstore.Get")
+		block, err = s.getStored(k, o.allowStale)
+		if errors.Is(err, blockstore.ErrNotFound) && s.adding.wait(ctx, k) {
+			// it was being added; it's probably here now.
+			block, err = s.getStored(k, o.allowStale)
+		}
+		finishLocal(lspan, err)
+	}
 	if err == nil {
+		outcome = OutcomeLocalHit
+		o.setSource(SourceLocal)
+		if err := o.fits(block); err != nil {
+			return nil, err
+		}
+		if s.readStrategy != nil {
+			return s.checkLocal(ctx, block)
+		}
 		return block, nil
-		// TODO be careful checking ErrNotFound. If the underlying
-		// implementation changes, this will break.
-	} else if err == blockstore.ErrNotFound && s.Exchange != nil {
-		blk, err := s.Exchange.GetBlock(ctx, k)
+	} else if errors.Is(err, blockstore.ErrNotFound) && !o.localOnly && s.exchangeUsable() {
+		xctx, xspan := s.startSpan(ctx, "exchange.GetBlock")
+		res, err := s.fetchShared(xctx, f, k, o.priority)
+		xspan.Finish(err)
 		if err != nil {
+			atomic.AddUint64(&s.stats.misses, 1)
+			if reportsMissing(err) {
+				s.notFound.add([]key.Key{k})
+			}
+			return nil, err
+		}
+		atomic.AddUint64(&s.stats.exchangeHits, 1)
+		outcome = OutcomeExchangeHit
+		o.setSource(SourceExchange)
+		o.setProvenance(res.prov)
+		if err := o.fits(res.b); err != nil {
 			return nil, err
 		}
-		return blk, nil
+		res.repair.Do(func() { s.repair(res.b) })
+		return res.b.Unpooled(), nil
 	} else {
+		var pe *BackendPanicError
+		switch {
+		case errors.Is(err, blockstore.ErrNotFound):
+			atomic.AddUint64(&s.stats.misses, 1)
+		case errors.Is(err, ErrDiskUnhealthy), errors.As(err, &pe):
+			outcome = OutcomeError
+			return nil, err
+		default:
+			outcome = OutcomeError
+		}
 		return nil, ErrNotFound
 	}
 }
 
+// getLocal reads |k| from the blockstore, recording the outcome in Stats.
+// Local misses are left for the caller to count, since the exchange may
+// still find the block.
+func (s *BlockService) getLocal(k key.Key) (*blocks.Block, error) {
+	return s.getStored(k, false)
+}
+
+// getStored is getLocal, returning a block past its TTL if |stale|.
+func (s *BlockService) getStored(k key.Key, stale bool) (*blocks.Block, error) {
+	if b, ok := inlineBlock(k); ok {
+		return b, nil
+	}
+	if !stale && s.expired(k) {
+		return nil, blockstore.ErrNotFound
+	}
+	var b *blocks.Block
+	err := s.guardRead(func() (err error) {
+		if s.pool != nil {
+			b, err = blockstore.GetPooled(s.Blockstore, k, s.pool)
+		} else {
+			b, err = s.Blockstore.Get(k)
+		}
+		return err
+	})
+	if errors.Is(err, ErrDiskUnhealthy) {
+		return nil, err
+	}
+	if err == nil && (s.checkCorrupt(b) || s.corrupt == nil && s.rejectLocal(b)) {
+		b, err = nil, blockstore.ErrNotFound
+	}
+	switch {
+	case err == nil:
+		atomic.AddUint64(&s.stats.localHits, 1)
+		s.countRead(k)
+	case errors.Is(err, blockstore.ErrNotFound):
+	default:
+		atomic.AddUint64(&s.stats.errors, 1)
+	}
+	return b, err
+}
+
+// GetBlockRange returns up to |length| bytes of the data of the block |k|
+// from |offset|, as blockstore.GetRange does. A stored block is read through
+// blockstore.GetRange, so that blockstores able to read a range read only
+// that; the data is then not verified, whatever SetCorruptionRepair says. A
+// block not stored is read whole with GetBlock.
+func (s *BlockService) GetBlockRange(ctx context.Context, k key.Key, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, blockstore.ErrInvalidRange
+	}
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if _, ok := k.InlineData(); !ok && !s.expired(k) {
+		var data []byte
+		err := s.guardRead(func() (err error) {
+			data, err = blockstore.GetRange(s.Blockstore, k, offset, length)
+			return err
+		})
+		if !errors.Is(err, blockstore.ErrNotFound) {
+			if err == nil {
+				atomic.AddUint64(&s.stats.localHits, 1)
+			}
+			return data, err
+		}
+	}
+	b, err := s.GetBlock(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= int64(len(b.Data)) {
+		return []byte{}, nil
+	}
+	data := b.Data[offset:]
+	if length < int64(len(data)) {
+		data = data[:length]
+	}
+	return data, nil
+}
+
+// GetBlockStream returns the block |k| as GetBlock does, but a stored block
+// is read through blockstore.GetStream, so that blockstores able to stream
+// it return a block whose data is read with Block.Reader, not held in
+// memory. That data is checked against |k| only as it is read, the reader
+// ending with blocks.ErrHashMismatch if it did not match, and is not
+// repaired whatever SetCorruptionRepair says. It cannot be stored again.
+func (s *BlockService) GetBlockStream(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if _, ok := k.InlineData(); !ok && !s.expired(k) {
+		var b *blocks.Block
+		err := s.guardRead(func() (err error) {
+			b, err = blockstore.GetStream(s.Blockstore, k)
+			return err
+		})
+		if !errors.Is(err, blockstore.ErrNotFound) {
+			if err == nil {
+				atomic.AddUint64(&s.stats.localHits, 1)
+			}
+			return b, err
+		}
+	}
+	return s.GetBlock(ctx, k)
+}
+
+// GetBlockFromPeer retrieves a particular block from |peer| through the
+// exchange, bypassing both the local datastore and the exchange's default
+// routing. It returns ErrNotSupported if the exchange cannot target peers.
+func (s *BlockService) GetBlockFromPeer(ctx context.Context, k key.Key, peer string) (*blocks.Block, error) {
+	pt, ok := s.Exchange.(exchange.PeerTargeted)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	if !s.Online() {
+		return nil, exchange.ErrOffline
+	}
+	b, err := pt.GetBlockFromPeer(ctx, k, peer)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verifyRemote(k, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 // GetBlocks gets a list of blocks asynchronously and returns through
 // the returned channel.
 // NB: No guarantees are made about order.
+// Zero-value keys are ignored, and an empty request never reaches the exchange.
+// A key listed more than once is looked up once, locally and through the
+// exchange, and its block is sent once per listing.
 func (s *BlockService) GetBlocks(ctx context.Context, ks []key.Key) <-chan *blocks.Block {
-	out := make(chan *blocks.Block, 0)
+	return s.GetBlocksWith(ctx, ks, GetBlocksOptions{})
+}
+
+// GetBlocksOptions adjusts how GetBlocksWith looks up blocks. The zero value
+// behaves like GetBlocks.
+type GetBlocksOptions struct {
+	// SkipLocal sends every key straight to the exchange without checking
+	// the blockstore first, for callers that already know none of them are
+	// stored locally.
+	SkipLocal bool
+
+	// SpillBlocks and SpillBytes bound a buffer holding blocks that the
+	// exchange has delivered but the caller has not yet received, to absorb
+	// bursts from the exchange while the caller catches up. Once either limit
+	// is reached, the exchange waits. SpillBytes may be exceeded by the last
+	// block taken in. With both zero, one block is held at a time.
+	SpillBlocks int
+	SpillBytes  int
+
+	// Buffer is the capacity of the returned channel, so that blocks do not
+	// wait for a caller that takes them in bursts. Zero or less leaves it
+	// unbuffered.
+	Buffer int
+	// SendTimeout, if positive, is how long a block may wait for the caller
+	// to take it, the channel being full, before it is left out, so that a
+	// stalled caller cannot hold up the lookups and the exchange. A block
+	// left out that was fetched is stored, unless the service is
+	// read-only, and each is counted in Stats.Undelivered. Stalled, if
+	// set, is called the first time one is.
+	SendTimeout time.Duration
+	Stalled     func()
+
+	// Unique sends each block once, however many times its key is listed.
+	Unique bool
+
+	// Misses says what to do with the keys not in the blockstore, and
+	// MissBatch how many to ask the exchange for at once with
+	// MissesChunked, or at first with MissesAdaptive, at least 1.
+	Misses    MissPolicy
+	MissBatch int
+
+	// Progress, if set, is called as each block is found, locally or
+	// through the exchange, and once more when the call ends, with how far
+	// it has got. Calls are made one at a time, and should return quickly:
+	// the lookups wait on them.
+	Progress func(GetBlocksProgress)
+}
+
+// MissPolicy says what GetBlocksWith does with the keys it does not find in
+// the blockstore.
+type MissPolicy int
+
+const (
+	// MissesBatched asks the exchange for the misses together once the
+	// blockstore has been read, or, with WithParallelLocalReads, for those
+	// found since the last request whenever no read has just finished. It
+	// is the default.
+	MissesBatched MissPolicy = iota
+	// MissesStreamed asks the exchange for each miss, alone, as soon as it
+	// is found, so that fetches start as early as possible.
+	MissesStreamed
+	// MissesChunked asks the exchange for the misses GetBlocksOptions.
+	// MissBatch at a time as they are found, and for the rest once the
+	// blockstore has been read, to bound the size of each request.
+	MissesChunked
+	// MissesLocalOnly leaves the misses out, without asking the exchange.
+	MissesLocalOnly
+	// MissesFailFast ends the call at the first miss, without asking the
+	// exchange: no more blocks are sent, and the channel is closed, for
+	// callers that need all of the blocks stored locally or none.
+	MissesFailFast
+	// MissesAdaptive asks the exchange for the misses as they are found,
+	// but keeps only a window of them asked for and not yet taken by the
+	// caller, starting at GetBlocksOptions.MissBatch: it widens while the
+	// caller takes the blocks as soon as they arrive, and narrows to what
+	// the caller takes over the time a fetch takes once they wait for it,
+	// so that a slow caller does not hold the exchange to wants it will
+	// not get to for a while.
+	MissesAdaptive
+)
+
+// GetBlocksProgress is how far a GetBlocksWith call has got. Keys listed
+// more than once count once.
+type GetBlocksProgress struct {
+	// Local and Remote count the blocks found in the blockstore and
+	// fetched through the exchange, and Remaining the keys not yet found;
+	// in the last report, those that were not.
+	Local, Remote, Remaining int
+	// Bytes is the data of the blocks found so far.
+	Bytes uint64
+	// Done is set in the last report.
+	Done bool
+}
+
+// progress tracks a GetBlocksWith call for GetBlocksOptions.Progress.
+type progress struct {
+	report func(GetBlocksProgress)
+
+	mu sync.Mutex
+	p  GetBlocksProgress
+}
+
+// found counts |b|, from the exchange if |remote|, and reports.
+func (p *progress) found(b *blocks.Block, remote bool) {
+	if p.report == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if remote {
+		p.p.Remote++
+	} else {
+		p.p.Local++
+	}
+	p.p.Remaining--
+	p.p.Bytes += uint64(len(b.Data))
+	p.report(p.p)
+}
+
+func (p *progress) done() {
+	if p.report == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.p.Done = true
+	p.report(p.p)
+}
+
+// GetBlocksWith is GetBlocks with options.
+func (s *BlockService) GetBlocksWith(ctx context.Context, ks []key.Key, opts GetBlocksOptions) <-chan *blocks.Block {
+	return s.getBlocks(ctx, ks, opts, s.Exchange)
+}
+
+// getBlocks is GetBlocksWith, fetching local misses from |f|.
+func (s *BlockService) getBlocks(ctx context.Context, ks []key.Key, opts GetBlocksOptions, f exchange.Fetcher) <-chan *blocks.Block {
+	if opts.Buffer < 0 {
+		opts.Buffer = 0
+	}
+	out := make(chan *blocks.Block, opts.Buffer)
+	ks = withoutEmptyKeys(ks)
+	if s.checkOpen() != nil {
+		ks = nil
+	}
+	if len(ks) == 0 {
+		if opts.Progress != nil {
+			opts.Progress(GetBlocksProgress{Done: true})
+		}
+		close(out)
+		return out
+	}
+	// look each key up once, but answer every listing of it.
+	listings := make(map[key.Key]int, len(ks))
+	var uniq []key.Key
+	for _, k := range ks {
+		if listings[k] == 0 {
+			uniq = append(uniq, k)
+		}
+		listings[k]++
+	}
+	uniq = s.withoutKnownMissing(uniq)
+	copies := func(k key.Key) int {
+		if opts.Unique {
+			return 1
+		}
+		return listings[k]
+	}
+
 	go func() {
 		defer close(out)
+		start := time.Now()
+		// stop ends the call early, for MissesFailFast.
+		ctx, stop := context.WithCancel(ctx)
+		defer stop()
+		ctx, span := s.startSpan(ctx, "blockservice.GetBlocks")
+		span.SetTag("keys", len(uniq))
+		defer span.Finish(nil)
+		prog := &progress{report: opts.Progress, p: GetBlocksProgress{Remaining: len(uniq)}}
+		defer prog.done()
+		guard := &stallGuard{s: s, timeout: opts.SendTimeout, stalled: opts.Stalled}
+
+		// mu guards what the local reads and the exchange stream share:
+		// failed holds the keys whose local read failed with an error other
+		// than a miss, for Metrics, and wanted the misses, true until
+		// received.
+		var mu sync.Mutex
+		failed := make(map[key.Key]bool)
+		wanted := make(map[key.Key]bool)
 		var misses []key.Key
-		for _, k := range ks {
-			hit, err := s.Blockstore.Get(k)
-			if err != nil {
-				misses = append(misses, k)
-				continue
+		var received uint64
+		usable := s.exchangeUsable() && opts.Misses != MissesLocalOnly && opts.Misses != MissesFailFast
+
+		// batches carries the misses to ask the exchange for, in the order
+		// they are found.
+		batches := make(chan []key.Key)
+		want := func(batch []key.Key) {
+			if len(batch) == 0 {
+				return
+			}
+			mu.Lock()
+			misses = append(misses, batch...)
+			for _, k := range batch {
+				wanted[k] = true
+			}
+			mu.Unlock()
+			if !usable {
+				return
 			}
 			select {
-			case out <- hit:
+			case batches <- batch:
 			case <-ctx.Done():
-				return
 			}
 		}
+		found := func(k key.Key, hit *blocks.Block) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			s.observe(OpGetBlocks, OutcomeLocalHit, start, k, len(hit.Data), nil)
+			prog.found(hit, false)
+			for i := copies(k); i > 0; i-- {
+				if !guard.send(ctx, out, hit) {
+					return false
+				}
+			}
+			return true
+		}
+		fail := func(k key.Key) {
+			mu.Lock()
+			failed[k] = true
+			mu.Unlock()
+		}
+		// ask is |want| as the miss policy has it, and flush passes on what
+		// it holds back.
+		ask, flush := want, func() {}
+		eager := opts.Misses != MissesBatched && opts.Misses != MissesLocalOnly
+		switch opts.Misses {
+		case MissesChunked:
+			c := &chunker{n: opts.MissBatch, want: want}
+			if c.n < 1 {
+				c.n = 1
+			}
+			ask, flush = c.add, c.flush
+		case MissesFailFast:
+			ask = func(batch []key.Key) {
+				want(batch)
+				if len(batch) > 0 {
+					stop()
+				}
+			}
+		}
+		// with MissesAdaptive, |window| tracks the wants open.
+		var window *wantWindow
+		if opts.Misses == MissesAdaptive && usable {
+			window = newWantWindow(opts.MissBatch, want)
+			ask, flush = window.add, func() { window.flush(ctx) }
+		}
+		var local sync.WaitGroup
+		local.Add(1)
+		go func() {
+			defer local.Done()
+			defer close(batches)
+			switch {
+			case opts.SkipLocal:
+				ask(uniq)
+			case s.localReads > 0:
+				s.readLocalParallel(ctx, uniq, eager, ask, found, fail)
+			default:
+				s.readLocal(ctx, uniq, eager, ask, found, fail)
+			}
+			flush()
+		}()
 
-		rblocks, err := s.Exchange.GetBlocks(ctx, misses)
-		if err != nil {
-			// blocks not found are ignored. this is an optimistic call.
-			return
+		// requested is closed once every batch has been asked for; the
+		// streams may go on, for an exchange that ignores cancellation.
+		remote := make(chan *blocks.Block)
+		requested := make(chan struct{})
+		var xspan Span = noopSpan{}
+		var asked int
+		go func() {
+			var streams sync.WaitGroup
+			xctx := ctx
+			for batch := range batches {
+				if asked == 0 {
+					xctx, xspan = s.startSpan(ctx, "exchange.GetBlocks")
+				}
+				asked += len(batch)
+				streams.Add(1)
+				done := streams.Done
+				if window != nil {
+					batch := batch
+					done = func() {
+						window.ended(batch)
+						streams.Done()
+					}
+				}
+				if err := s.fetchBlocksTo(xctx, f, batch, remote, done); err != nil {
+					// blocks not found are ignored. this is an optimistic call.
+					done()
+				}
+			}
+			close(requested)
+			streams.Wait()
+			close(remote)
+		}()
+
+		accept := func(b *blocks.Block) int {
+			mu.Lock()
+			got, ok := wanted[b.Key()]
+			mu.Unlock()
+			if !ok {
+				atomic.AddUint64(&s.stats.rejected, 1)
+				return 0
+			}
+			if !got {
+				return 0 // the exchange sent it twice.
+			}
+			if s.verifyRemote(b.Key(), b) != nil {
+				return 0
+			}
+			mu.Lock()
+			wanted[b.Key()] = false
+			mu.Unlock()
+			received++
+			if window != nil {
+				window.received(b.Key())
+			}
+			s.observe(OpGetBlocks, OutcomeExchangeHit, start, b.Key(), len(b.Data), nil)
+			prog.found(b, true)
+			s.repair(b)
+			return copies(b.Key())
+		}
+		buf := spillBuffer{
+			maxBlocks: opts.SpillBlocks,
+			maxBytes:  opts.SpillBytes,
+			timeout:   opts.SendTimeout,
+			drop:      func(b *blocks.Block) { guard.giveUp(b, true) },
+		}
+		if window != nil {
+			buf.sent = func(b *blocks.Block, waited bool) { window.taken(b.Key(), waited) }
+			// a block left out is not taken, but no longer wanted either.
+			buf.drop = func(b *blocks.Block) {
+				guard.giveUp(b, true)
+				window.taken(b.Key(), true)
+			}
 		}
+		buf.forward(ctx, remote, out, accept)
+		local.Wait()
+		<-requested
+		xspan.SetTag("keys", asked)
+		xspan.SetTag("received", received)
+		xspan.Finish(nil)
 
-		for b := range rblocks {
-			select {
-			case out <- b:
-			case <-ctx.Done():
-				return
+		atomic.AddUint64(&s.stats.exchangeHits, received)
+		if wanted := uint64(len(misses)); received < wanted {
+			atomic.AddUint64(&s.stats.misses, wanted-received)
+		}
+		var outstanding []key.Key
+		for _, k := range misses {
+			if !wanted[k] {
+				continue
+			}
+			outstanding = append(outstanding, k)
+			outcome := OutcomeMiss
+			if failed[k] {
+				outcome = OutcomeError
 			}
+			s.observe(OpGetBlocks, outcome, start, k, -1, nil)
+		}
+		// the streams may also have ended at the fetch timeout.
+		timedOut := s.fetchTimeout > 0 && time.Since(start) >= s.fetchTimeout
+		if (ctx.Err() != nil || timedOut) && usable {
+			s.cancelWants(outstanding)
 		}
 	}()
 	return out
 }
 
-// DeleteBlock deletes a block in the blockservice from the datastore
-func (s *BlockService) DeleteBlock(k key.Key) error {
-	return s.Blockstore.DeleteBlock(k)
+// cancelWants tells the exchange that |ks| are no longer wanted. It does not
+// wait for the exchange, as Cancel is only a hint.
+func (s *BlockService) cancelWants(ks []key.Key) {
+	if len(ks) == 0 || s.Exchange == nil {
+		return
+	}
+	go s.Exchange.Cancel(context.Background(), ks)
+}
+
+// GetBlocksFiltered is like GetBlocks, but only keys for which |filter|
+// returns true are looked up, locally or through the exchange. The rest are
+// skipped silently. A nil |filter| looks up every key.
+func (s *BlockService) GetBlocksFiltered(ctx context.Context, ks []key.Key, filter func(key.Key) bool) <-chan *blocks.Block {
+	if filter == nil {
+		return s.GetBlocks(ctx, ks)
+	}
+	var wanted []key.Key
+	for _, k := range ks {
+		if filter(k) {
+			wanted = append(wanted, k)
+		}
+	}
+	return s.GetBlocks(ctx, wanted)
 }
 
+// GetBlocksBySource looks up |ks| like GetBlocks, but partitions the results
+// by where they came from: |local| holds blocks found in the blockstore,
+// |remote| those fetched through the exchange, and |missing| the keys found
+// in neither, in request order. All local misses are requested from the
+// exchange in a single batch, unless WithMaxOutstandingWants splits it.
+// If |ctx| is done first, the results so far are returned along with its
+// error, and if the exchange fails to take the request, the local results
+// along with the exchange's error.
+func (s *BlockService) GetBlocksBySource(ctx context.Context, ks []key.Key) (local, remote map[key.Key]*blocks.Block, missing []key.Key, err error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, nil, nil, err
+	}
+	local = make(map[key.Key]*blocks.Block)
+	remote = make(map[key.Key]*blocks.Block)
+
+	var misses []key.Key
+	seen := make(map[key.Key]struct{})
+	for _, k := range withoutEmptyKeys(ks) {
+		if _, dup := seen[k]; dup {
+			continue
+		}
+		seen[k] = struct{}{}
+		if b, err := s.getLocal(k); err == nil {
+			local[k] = b
+		} else {
+			misses = append(misses, k)
+		}
+	}
+
+	var fetchErr error
+	if len(misses) > 0 && s.exchangeUsable() {
+		rblocks, err := s.fetchBlocks(ctx, s.Exchange, misses)
+		fetchErr = err
+		if err == nil {
+		recv:
+			for {
+				select {
+				case b, ok := <-rblocks:
+					if !ok {
+						break recv
+					}
+					if _, wanted := seen[b.Key()]; !wanted {
+						atomic.AddUint64(&s.stats.rejected, 1)
+						continue
+					}
+					if s.verifyRemote(b.Key(), b) == nil {
+						remote[b.Key()] = b
+						s.repair(b)
+					}
+				case <-ctx.Done():
+					break recv
+				}
+			}
+		}
+	}
+	atomic.AddUint64(&s.stats.exchangeHits, uint64(len(remote)))
+
+	for _, k := range misses {
+		if _, ok := remote[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	if ctx.Err() != nil {
+		s.cancelWants(missing)
+	}
+	atomic.AddUint64(&s.stats.misses, uint64(len(missing)))
+	if fetchErr != nil {
+		return local, remote, missing, fetchErr
+	}
+	return local, remote, missing, ctx.Err()
+}
+
+// withoutEmptyKeys returns |ks| minus any zero-value keys, which can never
+// name a block.
+func withoutEmptyKeys(ks []key.Key) []key.Key {
+	var out []key.Key
+	for _, k := range ks {
+		if k != "" {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// DeleteBlockCtx is like DeleteBlock, but returns ctx.Err() without deleting
+// anything if |ctx| is already done. The datastore offers no way to
+// interrupt a delete once started.
+func (s *BlockService) DeleteBlockCtx(ctx context.Context, k key.Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DeleteBlock(k)
+}
+
+// DeleteBlock deletes a block in the blockservice from the datastore. If
+// reference counting is enabled, it only releases a reference, and the block
+// is deleted with the last one.
+func (s *BlockService) DeleteBlock(k key.Key) (err error) {
+	start := time.Now()
+	defer func() {
+		outcome := writeOutcome(err)
+		if errors.Is(err, ds.ErrNotFound) || errors.Is(err, blockstore.ErrNotFound) {
+			outcome = OutcomeMiss
+		}
+		s.observe(OpDeleteBlock, outcome, start, k, -1, err)
+	}()
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if s.readOnly {
+		return blockstore.ErrReadOnly
+	}
+	if s.refs != nil {
+		s.refs.mu.Lock()
+		defer s.refs.mu.Unlock()
+		last, err := s.refs.release(k)
+		if err != nil || !last {
+			return err
+		}
+	}
+	if err := s.guardWrite(func() error { return s.Blockstore.DeleteBlock(k) }); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.stats.deleted, 1)
+	s.publish(EventDeleted, k)
+	if s.refs != nil {
+		return s.refs.forget(k)
+	}
+	return nil
+}
+
+// Close stops the service's background work, after which its reads and
+// writes fail with ErrClosed. It may be called more than once, and from
+// several goroutines: the calls after the first wait for it, and return its
+// error. See Done.
 func (s *BlockService) Close() error {
-	return s.worker.Close()
+	_, err := s.shutdown(func() (int, error) {
+		s.stopBackground()
+		return 0, s.worker.Close()
+	})
+	return err
+}
+
+// CloseWithContext is Close, but first stops queueing added blocks for
+// announcement and waits until the queued ones have been announced or |ctx|
+// is done. It returns how many announcements were dropped, and ctx.Err() if
+// the wait was cut short. See worker.Worker.CloseWithContext. Once the
+// service is closed, by either, it returns what the first close did.
+func (s *BlockService) CloseWithContext(ctx context.Context) (int, error) {
+	return s.shutdown(func() (int, error) {
+		s.stopBackground()
+		return s.worker.CloseWithContext(ctx)
+	})
+}
+
+// stopBackground stops the background work but the worker's.
+func (s *BlockService) stopBackground() {
+	// before the worker, so that the blocks written are announced.
+	s.pipeline.Close()
+	s.pending.Close()
+	s.prefetch.Close()
+	if s.access != nil {
+		s.access.Close()
+	}
+	if s.expiry != nil {
+		s.expiry.Close()
+	}
+	if s.reprovider != nil {
+		s.reprovider.Close()
+	}
+	s.events.Close()
+}
+
+// Quarantine removes the block stored under |k| from the blockstore, setting
+// the stored value aside for later inspection rather than deleting it. It
+// returns ErrNotSupported if the blockstore has no quarantine.
+func (s *BlockService) Quarantine(k key.Key) error {
+	q, ok := s.Blockstore.(blockstore.Quarantiner)
+	if !ok {
+		return ErrNotSupported
+	}
+	return q.Quarantine(k)
+}
+
+// ListQuarantined returns the values set aside by Quarantine.
+func (s *BlockService) ListQuarantined() ([]blockstore.QuarantinedBlock, error) {
+	q, ok := s.Blockstore.(blockstore.Quarantiner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return q.ListQuarantined()
+}
+
+// PurgeQuarantine permanently discards values quarantined before |before|,
+// returning how many were removed.
+func (s *BlockService) PurgeQuarantine(before time.Time) (int, error) {
+	q, ok := s.Blockstore.(blockstore.Quarantiner)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	return q.PurgeQuarantine(before)
 }
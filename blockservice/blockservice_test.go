@@ -0,0 +1,4534 @@
+package blockservice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+	mock "github.com/ipfs/go-blocks/blockservice/exchange/mock"
+	offline "github.com/ipfs/go-blocks/blockservice/exchange/offline"
+	worker "github.com/ipfs/go-blocks/blockservice/worker"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	flatfs "github.com/ipfs/go-blocks/blockstore/flatfs"
+	mem "github.com/ipfs/go-blocks/blockstore/mem"
+	pin "github.com/ipfs/go-blocks/blockstore/pin"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func newTestService(t *testing.T) *BlockService {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs, err := New(bstore, offline.Exchange(bstore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestGetBlockAsyncDedupsMisses(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+
+	hit := blocks.NewBlock([]byte("present"))
+	if _, err := bs.AddBlock(hit); err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := bs.GetBlockAsync(hit.Key()); !ok || b.Key() != hit.Key() {
+		t.Fatal("expected a local hit")
+	}
+
+	missing := key.Key("missing")
+	for i := 0; i < 3; i++ {
+		if _, ok := bs.GetBlockAsync(missing); ok {
+			t.Fatal("expected a miss")
+		}
+	}
+
+	select {
+	case k := <-bs.PendingMisses():
+		if k != missing {
+			t.Fatalf("got unexpected pending key %s", k)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("miss was never emitted")
+	}
+	select {
+	case k := <-bs.PendingMisses():
+		t.Fatalf("miss %s was emitted twice", k)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestGetBlockAsyncReadsAsGetBlock(t *testing.T) {
+	bs := newExpiringService(t, blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), time.Hour)
+	defer bs.Close()
+
+	inline, err := blocks.NewInlineBlock([]byte("inline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := bs.GetBlockAsync(inline.Key()); !ok || string(b.Data) != "inline" {
+		t.Fatal("expected an inline key decoded")
+	}
+	short := blocks.NewBlock([]byte("short lived"))
+	if _, err := bs.PutWithTTL(short, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := bs.GetBlockAsync(short.Key()); ok {
+		t.Fatal("expected an expired block missed")
+	}
+
+	kept := blocks.NewBlock([]byte("kept"))
+	if _, err := bs.AddBlock(kept); err != nil {
+		t.Fatal(err)
+	}
+	bs.Close()
+	if _, ok := bs.GetBlockAsync(kept.Key()); ok {
+		t.Fatal("expected no reads after Close")
+	}
+}
+
+// recordingExchange is a stub exchange.Interface that remembers what it was
+// asked for and never finds anything.
+type recordingExchange struct {
+	mu       sync.Mutex
+	requests [][]key.Key
+	cancels  [][]key.Key
+}
+
+func (e *recordingExchange) GetBlock(_ context.Context, k key.Key) (*blocks.Block, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests = append(e.requests, []key.Key{k})
+	return nil, ErrNotFound
+}
+
+func (e *recordingExchange) GetBlocks(_ context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests = append(e.requests, ks)
+	out := make(chan *blocks.Block)
+	close(out)
+	return out, nil
+}
+
+func (e *recordingExchange) HasBlock(context.Context, *blocks.Block) error { return nil }
+
+func (e *recordingExchange) Cancel(_ context.Context, ks []key.Key) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cancels = append(e.cancels, ks)
+	return nil
+}
+
+func (e *recordingExchange) Close() error { return nil }
+
+func (e *recordingExchange) Requests() [][]key.Key {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.requests
+}
+
+func (e *recordingExchange) Cancels() [][]key.Key {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cancels
+}
+
+func newRecordingService(t *testing.T) (*BlockService, *recordingExchange) {
+	rem := &recordingExchange{}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs, rem
+}
+
+func drain(ch <-chan *blocks.Block) []*blocks.Block {
+	var out []*blocks.Block
+	for b := range ch {
+		out = append(out, b)
+	}
+	return out
+}
+
+func TestGetBlocksEmpty(t *testing.T) {
+	bs, rem := newRecordingService(t)
+	defer bs.Close()
+
+	if got := drain(bs.GetBlocks(context.Background(), nil)); len(got) != 0 {
+		t.Fatalf("expected no blocks, got %d", len(got))
+	}
+	if got := drain(bs.GetBlocks(context.Background(), []key.Key{})); len(got) != 0 {
+		t.Fatalf("expected no blocks, got %d", len(got))
+	}
+	if reqs := rem.Requests(); len(reqs) != 0 {
+		t.Fatalf("exchange was consulted for an empty request: %v", reqs)
+	}
+}
+
+func TestGetBlocksIgnoresZeroValueKeys(t *testing.T) {
+	bs, rem := newRecordingService(t)
+	defer bs.Close()
+
+	if got := drain(bs.GetBlocks(context.Background(), []key.Key{"", ""})); len(got) != 0 {
+		t.Fatalf("expected no blocks, got %d", len(got))
+	}
+	if reqs := rem.Requests(); len(reqs) != 0 {
+		t.Fatalf("exchange was consulted for zero-value keys: %v", reqs)
+	}
+
+	present := blocks.NewBlock([]byte("present"))
+	if _, err := bs.AddBlock(present); err != nil {
+		t.Fatal(err)
+	}
+	got := drain(bs.GetBlocks(context.Background(), []key.Key{"", present.Key(), "missing"}))
+	if len(got) != 1 || got[0].Key() != present.Key() {
+		t.Fatalf("expected only the present block, got %v", got)
+	}
+	reqs := rem.Requests()
+	if len(reqs) != 1 || len(reqs[0]) != 1 || reqs[0][0] != key.Key("missing") {
+		t.Fatalf("expected only the missing key to reach the exchange, got %v", reqs)
+	}
+}
+
+// peerExchange is a recordingExchange that can also target peers.
+type peerExchange struct {
+	recordingExchange
+	peers []string
+}
+
+func (e *peerExchange) GetBlockFromPeer(_ context.Context, k key.Key, peer string) (*blocks.Block, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.peers = append(e.peers, peer)
+	return blocks.NewBlock([]byte("from " + peer)), nil
+}
+
+func TestGetBlockFromPeer(t *testing.T) {
+	rem := &peerExchange{}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	want := blocks.NewBlock([]byte("from QmPeer")).Key()
+	b, err := bs.GetBlockFromPeer(context.Background(), want, "QmPeer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Data) != "from QmPeer" {
+		t.Fatalf("unexpected block data %q", b.Data)
+	}
+	if len(rem.peers) != 1 || rem.peers[0] != "QmPeer" {
+		t.Fatalf("exchange saw the wrong peers: %v", rem.peers)
+	}
+}
+
+func TestGetBlockFromPeerNotSupported(t *testing.T) {
+	bs, _ := newRecordingService(t)
+	defer bs.Close()
+
+	if _, err := bs.GetBlockFromPeer(context.Background(), key.Key("foo"), "QmPeer"); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+// wrappingBlockstore wraps the errors of Get, as blockstores adding context
+// to them do.
+type wrappingBlockstore struct {
+	blockstore.Blockstore
+}
+
+func (w wrappingBlockstore) Get(k key.Key) (*blocks.Block, error) {
+	b, err := w.Blockstore.Get(k)
+	if err != nil {
+		return nil, fmt.Errorf("wrapped: %w", err)
+	}
+	return b, nil
+}
+
+func TestErrorsMatchWrapped(t *testing.T) {
+	rem := &peerExchange{}
+	bs, err := New(wrappingBlockstore{blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}, rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	k := blocks.NewBlock([]byte("missing")).Key()
+	if _, err := bs.GetBlock(context.Background(), k); !errors.Is(err, blockstore.ErrNotFound) {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+	if len(rem.requests) != 1 {
+		t.Fatal("expected a wrapped local miss to ask the exchange")
+	}
+	bs.SetOnline(false)
+	if _, err := bs.GetBlockFromPeer(context.Background(), k, "QmPeer"); err != exchange.ErrOffline || !errors.Is(err, blockstore.ErrNotFound) {
+		t.Fatalf("expected ErrOffline, got %v", err)
+	}
+}
+
+func TestGetBlocksFilteredNeverFetchesFilteredKeys(t *testing.T) {
+	bs, rem := newRecordingService(t)
+	defer bs.Close()
+
+	denied := key.Key("denied")
+	allowed := key.Key("allowed")
+	drain(bs.GetBlocksFiltered(context.Background(), []key.Key{denied, allowed, denied}, func(k key.Key) bool {
+		return k != denied
+	}))
+
+	reqs := rem.Requests()
+	if len(reqs) != 1 || len(reqs[0]) != 1 || reqs[0][0] != allowed {
+		t.Fatalf("expected only the allowed key to reach the exchange, got %v", reqs)
+	}
+}
+
+func TestGetBlocksFilteredNilFilter(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	b := blocks.NewBlock([]byte("unfiltered"))
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for got := range bs.GetBlocksFiltered(context.Background(), []key.Key{b.Key()}, nil) {
+		if got.Key() != b.Key() {
+			t.Fatalf("unexpected block %s", got.Key())
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected a nil filter to keep every key, got %d blocks", n)
+	}
+}
+
+// announceExchange is a recordingExchange whose HasBlock waits on |release|
+// and records the blocks it was told about.
+type announceExchange struct {
+	recordingExchange
+	release   chan error
+	announced []key.Key
+}
+
+func (e *announceExchange) HasBlock(ctx context.Context, b *blocks.Block) error {
+	select {
+	case err := <-e.release:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.announced = append(e.announced, b.Key())
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *announceExchange) Announced() []key.Key {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.announced
+}
+
+func TestAddBlockSyncWaitsForAnnouncement(t *testing.T) {
+	rem := &announceExchange{release: make(chan error, 1)}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	b := blocks.NewBlock([]byte("announce me"))
+	rem.release <- nil
+	k, err := bs.AddBlockSync(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := rem.Announced(); len(a) != 1 || a[0] != k {
+		t.Fatalf("AddBlockSync returned before the block was announced: %v", a)
+	}
+
+	announceErr := errors.New("exchange unavailable")
+	rem.release <- announceErr
+	if _, err := bs.AddBlockSync(context.Background(), blocks.NewBlock([]byte("fails"))); err != announceErr {
+		t.Fatalf("expected the exchange error, got %v", err)
+	}
+}
+
+func TestAddBlockSyncHonorsDeadline(t *testing.T) {
+	rem := &announceExchange{release: make(chan error)}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	b := blocks.NewBlock([]byte("never announced"))
+	if _, err := bs.AddBlockSync(ctx, b); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if has, _ := bs.Blockstore.Has(b.Key()); !has {
+		t.Fatal("block should stay stored when the announcement times out")
+	}
+}
+
+func TestProvideLatency(t *testing.T) {
+	rem := &announceExchange{release: make(chan error)}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithAnnounceDedup(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	b := blocks.NewBlock([]byte("discoverable"))
+	provided := make(chan time.Duration, 2)
+	onProvided := func(latency time.Duration) { provided <- latency }
+	if _, err := bs.AddBlockWith(b, AddBlockOptions{OnProvided: onProvided}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-provided:
+		t.Fatal("OnProvided called before the exchange took the block")
+	default:
+	}
+	rem.release <- nil
+	if latency := <-provided; latency < 20*time.Millisecond {
+		t.Fatalf("expected the latency to span the wait, got %v", latency)
+	}
+
+	// a block announced just before is reported right away.
+	if _, err := bs.AddBlockWith(b, AddBlockOptions{OnProvided: onProvided}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-provided:
+	case <-time.After(time.Second):
+		t.Fatal("OnProvided not called for a block announced just before")
+	}
+
+	h := bs.Stats().ProvideLatency
+	if h.Count != 1 || h.Quantile(0.5) < 20*time.Millisecond {
+		t.Fatalf("expected one announcement of at least 20ms, got %+v", h)
+	}
+}
+
+func TestStatsCountsSources(t *testing.T) {
+	bs, _ := newRecordingService(t)
+	defer bs.Close()
+
+	b := blocks.NewBlock([]byte("counted"))
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.GetBlock(context.Background(), b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	bs.GetBlock(context.Background(), key.Key("missing"))
+	drain(bs.GetBlocks(context.Background(), []key.Key{b.Key(), "also missing"}))
+
+	st := bs.Stats()
+	if st.Added != 1 || st.LocalHits != 2 || st.Misses != 2 || st.ExchangeHits != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if st.BlockstoreLatency.Count != 4 || st.ExchangeLatency.Count != 1 {
+		t.Fatalf("unexpected latency observations: %+v", st)
+	}
+}
+
+// offlineExchange is a recordingExchange that reports being offline.
+type offlineExchange struct {
+	recordingExchange
+}
+
+func (e *offlineExchange) Online() bool { return false }
+
+func TestFailFastOffline(t *testing.T) {
+	rem := &offlineExchange{}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// by default the exchange is still consulted.
+	bs.GetBlock(context.Background(), key.Key("missing"))
+	if n := len(rem.Requests()); n != 1 {
+		t.Fatalf("expected the exchange to be asked once, got %d", n)
+	}
+
+	bs.SetFailFastOffline(true)
+	if _, err := bs.GetBlock(context.Background(), key.Key("missing")); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	drain(bs.GetBlocks(context.Background(), []key.Key{"missing"}))
+	if n := len(rem.Requests()); n != 1 {
+		t.Fatalf("an offline exchange was consulted: %d requests", n)
+	}
+}
+
+// servingExchange is a recordingExchange that serves the blocks it holds.
+type servingExchange struct {
+	recordingExchange
+	blocks map[key.Key]*blocks.Block
+}
+
+func (e *servingExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	e.recordingExchange.GetBlock(ctx, k)
+	if b, ok := e.blocks[k]; ok {
+		return b, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (e *servingExchange) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	e.recordingExchange.GetBlocks(ctx, ks)
+	out := make(chan *blocks.Block, len(ks))
+	for _, k := range ks {
+		if b, ok := e.blocks[k]; ok {
+			out <- b
+		}
+	}
+	close(out)
+	return out, nil
+}
+
+func newServingService(t testing.TB, bs ...*blocks.Block) (*BlockService, *servingExchange) {
+	rem := &servingExchange{blocks: make(map[key.Key]*blocks.Block)}
+	for _, b := range bs {
+		rem.blocks[b.Key()] = b
+	}
+	serv, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serv, rem
+}
+
+func TestLazyBlockFetchesOnce(t *testing.T) {
+	remote := blocks.NewBlock([]byte("remote data"))
+	bs, rem := newServingService(t, remote)
+	defer bs.Close()
+
+	lb := bs.LazyBlock(context.Background(), remote.Key())
+	if lb.Key() != remote.Key() {
+		t.Fatal("wrong key")
+	}
+	if n := len(rem.Requests()); n != 0 {
+		t.Fatalf("creating a lazy block fetched it %d times", n)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := lb.Data()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(data) != "remote data" {
+				t.Errorf("unexpected data %q", data)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(rem.Requests()); n != 1 {
+		t.Fatalf("expected exactly one fetch, got %d", n)
+	}
+}
+
+func TestGetBlocksSkipLocal(t *testing.T) {
+	local := blocks.NewBlock([]byte("local"))
+	remote := blocks.NewBlock([]byte("remote"))
+	bs, rem := newServingService(t, remote)
+	defer bs.Close()
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := GetBlocksOptions{SkipLocal: true}
+	drain(bs.GetBlocksWith(context.Background(), []key.Key{local.Key(), remote.Key()}, opts))
+
+	reqs := rem.Requests()
+	if len(reqs) != 1 || len(reqs[0]) != 2 {
+		t.Fatalf("expected both keys sent to the exchange, got %v", reqs)
+	}
+	if st := bs.Stats(); st.LocalHits != 0 {
+		t.Fatalf("blockstore consulted %d times", st.LocalHits)
+	}
+}
+
+func TestReadRepairStoresFetchedBlocks(t *testing.T) {
+	remote := blocks.NewBlock([]byte("remote"))
+	bs, _ := newServingService(t, remote)
+	defer bs.Close()
+	bs.SetReadRepair(true)
+
+	opts := GetBlocksOptions{SkipLocal: true}
+	if got := drain(bs.GetBlocksWith(context.Background(), []key.Key{remote.Key()}, opts)); len(got) != 1 {
+		t.Fatalf("expected the remote block, got %d blocks", len(got))
+	}
+	has, err := bs.Blockstore.Has(remote.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Fatal("fetched block was not stored locally")
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	d := ds.NewMapDatastore()
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(d)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	if err := bs.SelfTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, d); n != 0 {
+		t.Fatalf("self-test left %d keys behind", n)
+	}
+}
+
+func countKeys(t *testing.T, d ds.Datastore) int {
+	res, err := d.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// corruptingDatastore flips the first byte of every value it returns.
+type corruptingDatastore struct {
+	*ds.MapDatastore
+}
+
+func (d corruptingDatastore) Get(k ds.Key) (interface{}, error) {
+	v, err := d.MapDatastore.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte(nil), v.([]byte)...)
+	data[0] ^= 0xff
+	return data, nil
+}
+
+func TestSelfTestCleansUpOnFailure(t *testing.T) {
+	d := ds.NewMapDatastore()
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(corruptingDatastore{d})), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	if err := bs.SelfTest(context.Background()); err == nil {
+		t.Fatal("expected corrupted reads to fail the self-test")
+	}
+	if n := countKeys(t, d); n != 0 {
+		t.Fatalf("self-test left %d keys behind", n)
+	}
+}
+
+// hintingExchange records the routing hints given with each announced block.
+type hintingExchange struct {
+	recordingExchange
+	announced chan key.Key
+
+	hmu   sync.Mutex
+	hints map[key.Key][]string
+}
+
+func (e *hintingExchange) HasBlockWithHints(_ context.Context, b *blocks.Block, hints []string) error {
+	e.hmu.Lock()
+	e.hints[b.Key()] = hints
+	e.hmu.Unlock()
+	e.announced <- b.Key()
+	return nil
+}
+
+func (e *hintingExchange) Hints(k key.Key) []string {
+	e.hmu.Lock()
+	defer e.hmu.Unlock()
+	return e.hints[k]
+}
+
+func TestAddBlockRoutingHints(t *testing.T) {
+	rem := &hintingExchange{
+		announced: make(chan key.Key, 2),
+		hints:     make(map[key.Key][]string),
+	}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	hinted := blocks.NewBlock([]byte("hinted"))
+	plain := blocks.NewBlock([]byte("plain"))
+	if _, err := bs.AddBlockWith(hinted, AddBlockOptions{RoutingHints: []string{"peerA", "eu-west"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.AddBlock(plain); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-rem.announced:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for announcements")
+		}
+	}
+	if h := rem.Hints(hinted.Key()); len(h) != 2 || h[0] != "peerA" || h[1] != "eu-west" {
+		t.Fatalf("unexpected hints for hinted block: %v", h)
+	}
+	if h := rem.Hints(plain.Key()); len(h) != 0 {
+		t.Fatalf("unexpected hints for plain block: %v", h)
+	}
+}
+
+// burstyExchange delivers every requested block as fast as GetBlocks' caller
+// takes them, counting how many it has handed over.
+type burstyExchange struct {
+	recordingExchange
+	blocks map[key.Key]*blocks.Block
+	sent   int32
+}
+
+func (e *burstyExchange) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			select {
+			case out <- e.blocks[k]:
+				atomic.AddInt32(&e.sent, 1)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func TestGetBlocksSpillBufferBounded(t *testing.T) {
+	cases := []struct {
+		opts  GetBlocksOptions
+		limit int // blocks
+	}{
+		{GetBlocksOptions{SpillBlocks: 4}, 4},
+		{GetBlocksOptions{SpillBytes: 3 * 10}, 3},
+		{GetBlocksOptions{}, 1},
+	}
+	for _, c := range cases {
+		rem := &burstyExchange{blocks: make(map[key.Key]*blocks.Block)}
+		var ks []key.Key
+		for i := 0; i < 50; i++ {
+			b := blocks.NewBlock([]byte(fmt.Sprintf("block %04d", i))) // 10 bytes
+			rem.blocks[b.Key()] = b
+			ks = append(ks, b.Key())
+		}
+		bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.opts.SkipLocal = true
+		var consumed int32
+		for range bs.GetBlocksWith(context.Background(), ks, c.opts) {
+			consumed++
+			time.Sleep(time.Millisecond) // let the exchange run ahead
+			// the block being handed over may sit outside the buffer.
+			if ahead := atomic.LoadInt32(&rem.sent) - consumed; int(ahead) > c.limit+1 {
+				t.Fatalf("%+v: exchange ran %d blocks ahead of the consumer", c.opts, ahead)
+			}
+		}
+		if consumed != 50 {
+			t.Fatalf("%+v: received %d of 50 blocks", c.opts, consumed)
+		}
+		bs.Close()
+	}
+}
+
+func TestAccessCounting(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	if err := bs.EnableAccessCounting(0); err == nil {
+		t.Fatal("expected a flush interval that is not positive refused")
+	}
+	// enabling it again replaces the first flusher.
+	for i := 0; i < 2; i++ {
+		if err := bs.EnableAccessCounting(time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ks []key.Key
+	for i := 0; i < 3; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		if _, err := bs.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Key())
+	}
+	for i, k := range ks {
+		for j := 0; j <= i; j++ {
+			if _, err := bs.GetBlock(context.Background(), k); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// unflushed reads are already reported.
+	info, err := bs.GetBlockInfo(ks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Reads != 2 {
+		t.Fatalf("expected 2 reads, got %d", info.Reads)
+	}
+
+	top, err := bs.TopReads(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].Key != ks[2] || top[0].Reads != 3 || top[1].Key != ks[1] {
+		t.Fatalf("unexpected top reads %v", top)
+	}
+	if top, err := bs.TopReads(context.Background(), -1); err != nil || len(top) != 0 {
+		t.Fatalf("expected no top reads for a negative count, got %v, %v", top, err)
+	}
+
+	// counts accumulate across flushes.
+	if _, err := bs.GetBlock(context.Background(), ks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := bs.GetBlockInfo(ks[0]); info.Reads != 2 {
+		t.Fatalf("expected 2 reads after flush, got %d", info.Reads)
+	}
+}
+
+func TestTopReadsRequiresAccessCounting(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	if _, err := bs.TopReads(context.Background(), 1); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestAddBlockCtxCancelledAfterPut(t *testing.T) {
+	rem := &hintingExchange{
+		announced: make(chan key.Key, 1),
+		hints:     make(map[key.Key][]string),
+	}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	testHookAfterPut = cancel
+	defer func() { testHookAfterPut = nil }()
+
+	b := blocks.NewBlock([]byte("cancelled mid-add"))
+	k, err := bs.AddBlockCtx(ctx, b)
+	if k != b.Key() {
+		t.Fatalf("expected the key to be returned, got %q", k)
+	}
+	nae, ok := err.(*NotAnnouncedError)
+	if !ok {
+		t.Fatalf("expected a *NotAnnouncedError, got %v", err)
+	}
+	if nae.Err != context.Canceled || !errors.Is(err, context.Canceled) {
+		t.Fatalf("error does not wrap context.Canceled: %v", err)
+	}
+	if has, _ := bs.Blockstore.Has(k); !has {
+		t.Fatal("the block should stay stored")
+	}
+	bs.Close() // waits for the worker
+	select {
+	case k := <-rem.announced:
+		t.Fatalf("block %s was announced after cancellation", k)
+	default:
+	}
+}
+
+func TestAddBlockCtxCancelledBeforePut(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := blocks.NewBlock([]byte("never stored"))
+	if _, err := bs.AddBlockCtx(ctx, b); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if has, _ := bs.Blockstore.Has(b.Key()); has {
+		t.Fatal("the block should not have been stored")
+	}
+}
+
+func TestMaxQueuedAnnouncements(t *testing.T) {
+	rem := &announceExchange{release: make(chan error, 4)}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithNumWorkers(1), WithMaxQueuedAnnouncements(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	if _, err := bs.AddBlock(blocks.NewBlock([]byte("queued"))); err != nil {
+		t.Fatal(err)
+	}
+	full := blocks.NewBlock([]byte("turned away"))
+	k, err := bs.AddBlock(full)
+	nae, ok := err.(*NotAnnouncedError)
+	if !ok || nae.Err != worker.ErrQueueFull || k != full.Key() {
+		t.Fatalf("expected a full queue, got %v", err)
+	}
+	if has, _ := bs.Blockstore.Has(full.Key()); !has {
+		t.Fatal("block not stored")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := bs.AddBlockCtx(ctx, full); err == nil {
+		t.Fatal("expected AddBlockCtx to give up waiting for room")
+	}
+
+	// room is made once the queued block is announced.
+	rem.release <- nil
+	if _, err := bs.AddBlockCtx(context.Background(), full); err != nil {
+		t.Fatal(err)
+	}
+	if a := rem.Announced(); len(a) != 1 {
+		t.Fatalf("expected 1 block announced, got %v", a)
+	}
+}
+
+func TestReadStrategies(t *testing.T) {
+	good := blocks.NewBlock([]byte("the real data"))
+	intact := blocks.NewBlock([]byte("intact"))
+
+	cases := []struct {
+		strategy ReadStrategy
+		fetches  int // exchange requests for the corrupt and the intact block
+		repaired bool
+	}{
+		{LocalFirst, 0, false},
+		{CrossCheckOnSuspicion, 1, true},
+		{AlwaysCrossCheck, 2, true},
+		{SampledCrossCheck(0), 1, true},
+	}
+	for i, c := range cases {
+		d := ds.NewMapDatastore()
+		rem := &servingExchange{blocks: map[key.Key]*blocks.Block{good.Key(): good, intact.Key(): intact}}
+		bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(d)), rem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs.SetReadStrategy(c.strategy)
+
+		// store a corrupt copy of |good| and an intact one of |intact|.
+		if err := d.Put(blockstore.BlockPrefix.Child(good.Key().DsKey()), []byte("garbage")); err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.Blockstore.Put(intact); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := bs.GetBlock(context.Background(), good.Key())
+		if c.repaired {
+			if err != nil || string(got.Data) != "the real data" {
+				t.Fatalf("case %d: expected the exchange's copy, got %v", i, err)
+			}
+			stored, err := bs.Blockstore.Get(good.Key())
+			if err != nil || string(stored.Data) != "the real data" {
+				t.Fatalf("case %d: corrupt local copy was not replaced", i)
+			}
+		} else if err != nil || string(got.Data) != "garbage" {
+			t.Fatalf("case %d: expected the local copy, got %v", i, err)
+		}
+		if _, err := bs.GetBlock(context.Background(), intact.Key()); err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if n := len(rem.Requests()); n != c.fetches {
+			t.Fatalf("case %d: expected %d exchange requests, got %d", i, c.fetches, n)
+		}
+		bs.Close()
+	}
+}
+
+func TestReadStrategyReadOnly(t *testing.T) {
+	good := blocks.NewBlock([]byte("the real data"))
+	d := dssync.MutexWrap(ds.NewMapDatastore())
+	if err := d.Put(blockstore.BlockPrefix.Child(good.Key().DsKey()), []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	rem := &servingExchange{blocks: map[key.Key]*blocks.Block{good.Key(): good}}
+	bs, err := New(blockstore.NewBlockstore(d), rem, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	bs.SetReadStrategy(CrossCheckOnSuspicion)
+
+	if got, err := bs.GetBlock(context.Background(), good.Key()); err != nil || string(got.Data) != "the real data" {
+		t.Fatalf("expected the exchange's copy, got %v", err)
+	}
+	if v, err := d.Get(blockstore.BlockPrefix.Child(good.Key().DsKey())); err != nil || string(v.([]byte)) != "garbage" {
+		t.Fatalf("expected a read-only service to leave the local copy, got %v", err)
+	}
+}
+
+func TestReadStrategyReplacementPublished(t *testing.T) {
+	good := blocks.NewBlock([]byte("the real data"))
+	d := dssync.MutexWrap(ds.NewMapDatastore())
+	if err := d.Put(blockstore.BlockPrefix.Child(good.Key().DsKey()), []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	rem := &servingExchange{blocks: map[key.Key]*blocks.Block{good.Key(): good}}
+	bs, err := New(blockstore.NewBlockstore(d), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	bs.SetReadStrategy(CrossCheckOnSuspicion)
+	added := bs.Subscribe(context.Background(), EventAdded)
+
+	if _, err := bs.GetBlock(context.Background(), good.Key()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-added:
+		if e.Key != good.Key() {
+			t.Fatalf("expected an add of %s, got %+v", good.Key(), e)
+		}
+	default:
+		t.Fatal("expected the replacement stored through the service")
+	}
+}
+
+func TestGetBlocksBySource(t *testing.T) {
+	local := blocks.NewBlock([]byte("local"))
+	remote := blocks.NewBlock([]byte("remote"))
+	absent := blocks.NewBlock([]byte("absent"))
+	bs, rem := newServingService(t, remote)
+	defer bs.Close()
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+
+	ks := []key.Key{absent.Key(), local.Key(), remote.Key(), local.Key()}
+	l, r, missing, err := bs.GetBlocksBySource(context.Background(), ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[local.Key()] == nil {
+		t.Fatalf("unexpected local results %v", l)
+	}
+	if len(r) != 1 || r[remote.Key()] == nil {
+		t.Fatalf("unexpected remote results %v", r)
+	}
+	if len(missing) != 1 || missing[0] != absent.Key() {
+		t.Fatalf("unexpected missing keys %v", missing)
+	}
+	if reqs := rem.Requests(); len(reqs) != 1 || len(reqs[0]) != 2 {
+		t.Fatalf("expected one exchange request for both misses, got %v", reqs)
+	}
+}
+
+func TestGetBlocksBySourceExchangeError(t *testing.T) {
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), &disconnectedExchange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	local := blocks.NewBlock([]byte("local"))
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+	absent := blocks.NewBlock([]byte("absent")).Key()
+
+	l, _, missing, err := bs.GetBlocksBySource(context.Background(), []key.Key{local.Key(), absent})
+	if err != exchange.ErrOffline {
+		t.Fatalf("expected ErrOffline, got %v", err)
+	}
+	if len(l) != 1 || len(missing) != 1 || missing[0] != absent {
+		t.Fatalf("expected the local block and the miss, got %v and %v", l, missing)
+	}
+}
+
+// gatedDatastore signals |started| when a Put begins and holds it until
+// |release| is closed.
+type gatedDatastore struct {
+	*ds.MapDatastore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d gatedDatastore) Put(k ds.Key, v interface{}) error {
+	d.started <- struct{}{}
+	<-d.release
+	return d.MapDatastore.Put(k, v)
+}
+
+func TestGetBlockWaitsForInflightAdd(t *testing.T) {
+	d := gatedDatastore{ds.NewMapDatastore(), make(chan struct{}, 1), make(chan struct{})}
+	rem := &recordingExchange{}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(d)), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	b := blocks.NewBlock([]byte("being added"))
+	added := make(chan error, 1)
+	go func() {
+		_, err := bs.AddBlock(b)
+		added <- err
+	}()
+	<-d.started
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := bs.GetBlock(context.Background(), b.Key())
+		got <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // let GetBlock miss and start waiting
+	close(d.release)
+
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-got; err != nil {
+		t.Fatalf("GetBlock did not find the block being added: %s", err)
+	}
+	if n := len(rem.Requests()); n != 0 {
+		t.Fatalf("GetBlock went to the exchange %d times", n)
+	}
+}
+
+// countingBlockstore counts the calls that write blocks, and the Gets.
+type countingBlockstore struct {
+	blockstore.Blockstore
+	puts, batches, gets int32
+}
+
+func (bs *countingBlockstore) Get(k key.Key) (*blocks.Block, error) {
+	atomic.AddInt32(&bs.gets, 1)
+	return bs.Blockstore.Get(k)
+}
+
+func (bs *countingBlockstore) Put(b *blocks.Block) error {
+	atomic.AddInt32(&bs.puts, 1)
+	return bs.Blockstore.Put(b)
+}
+
+func (bs *countingBlockstore) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	atomic.AddInt32(&bs.batches, 1)
+	return bs.Blockstore.ApplyBatch(ctx, puts, deletes)
+}
+
+func TestAddBlocksWritesOneBatch(t *testing.T) {
+	cbs := &countingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	bs, err := New(cbs, &recordingExchange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	var in []*blocks.Block
+	for i := 0; i < 100; i++ {
+		in = append(in, blocks.NewBlock([]byte(fmt.Sprintf("block %d", i))))
+	}
+	ks, err := bs.AddBlocks(context.Background(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks) != len(in) {
+		t.Fatalf("expected %d keys, got %d", len(in), len(ks))
+	}
+	for i, k := range ks {
+		if k != in[i].Key() {
+			t.Fatalf("key %d out of order", i)
+		}
+		if has, _ := bs.Blockstore.Has(k); !has {
+			t.Fatalf("block %d not stored", i)
+		}
+	}
+	if puts, batches := atomic.LoadInt32(&cbs.puts), atomic.LoadInt32(&cbs.batches); puts != 0 || batches != 1 {
+		t.Fatalf("expected a single batch and no puts, got %d batches and %d puts", batches, puts)
+	}
+	if st := bs.Stats(); st.Added != 100 {
+		t.Fatalf("expected 100 blocks added, got %d", st.Added)
+	}
+}
+
+func TestDeleteBlockCtxCancelled(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	b := blocks.NewBlock([]byte("keep me"))
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := bs.DeleteBlockCtx(ctx, b.Key()); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if has, _ := bs.Blockstore.Has(b.Key()); !has {
+		t.Fatal("block deleted despite the cancelled context")
+	}
+	if err := bs.DeleteBlockCtx(context.Background(), b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Blockstore.Has(b.Key()); has {
+		t.Fatal("block not deleted")
+	}
+}
+
+func TestDeleteBlocks(t *testing.T) {
+	cbs := &countingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	bs, err := New(cbs, &recordingExchange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	var in []*blocks.Block
+	for i := 0; i < 100; i++ {
+		in = append(in, blocks.NewBlock([]byte(fmt.Sprintf("block %d", i))))
+	}
+	ks, err := bs.AddBlocks(context.Background(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := blocks.NewBlock([]byte("never stored")).Key()
+	atomic.StoreInt32(&cbs.batches, 0)
+
+	results := make(map[key.Key]error)
+	for r := range bs.DeleteBlocks(context.Background(), append(ks, ks[0], gone), DeleteBatchSize(30)) {
+		if _, dup := results[r.Key]; dup {
+			t.Fatalf("%s reported twice", r.Key)
+		}
+		results[r.Key] = r.Err
+	}
+	if len(results) != 101 || results[gone] != ErrNotFound {
+		t.Fatalf("expected 101 results, %s not found, got %d and %v", gone, len(results), results[gone])
+	}
+	for _, k := range ks {
+		if err := results[k]; err != nil {
+			t.Fatalf("deleting %s: %v", k, err)
+		}
+		if has, _ := bs.Blockstore.Has(k); has {
+			t.Fatalf("%s not deleted", k)
+		}
+	}
+	if n := atomic.LoadInt32(&cbs.batches); n != 4 {
+		t.Fatalf("expected 4 batches of at most 30, got %d", n)
+	}
+	if st := bs.Stats(); st.Deleted != 100 {
+		t.Fatalf("expected 100 blocks deleted, got %d", st.Deleted)
+	}
+}
+
+// hasFailingBlockstore fails Has for one key.
+type hasFailingBlockstore struct {
+	blockstore.Blockstore
+	failing key.Key
+}
+
+func (bs *hasFailingBlockstore) Has(k key.Key) (bool, error) {
+	if k == bs.failing {
+		return false, errDisk
+	}
+	return bs.Blockstore.Has(k)
+}
+
+func TestDeleteBlocksAllOrNothing(t *testing.T) {
+	fbs := &hasFailingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	bs, err := New(fbs, &recordingExchange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	var ks []key.Key
+	for i := 0; i < 10; i++ {
+		k, err := bs.AddBlock(blocks.NewBlock([]byte(fmt.Sprintf("block %d", i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, k)
+	}
+	fbs.failing = ks[5]
+
+	for r := range bs.DeleteBlocks(context.Background(), ks, AllOrNothing(), DeleteBatchSize(2)) {
+		want := ErrDeleteAborted
+		if r.Key == ks[5] {
+			want = errDisk
+		}
+		if r.Err != want {
+			t.Fatalf("expected %v for %s, got %v", want, r.Key, r.Err)
+		}
+	}
+	for _, k := range ks {
+		if has, _ := fbs.Blockstore.Has(k); !has {
+			t.Fatalf("%s deleted despite the failure", k)
+		}
+	}
+
+	// best effort, only the failing key is left.
+	for r := range bs.DeleteBlocks(context.Background(), ks, DeleteBatchSize(2)) {
+		if (r.Err != nil) != (r.Key == ks[5]) {
+			t.Fatalf("unexpected result %v for %s", r.Err, r.Key)
+		}
+	}
+	if has, _ := fbs.Blockstore.Has(ks[5]); !has {
+		t.Fatal("expected the failing key left stored")
+	}
+}
+
+// sessionExchange is a servingExchange that counts the sessions started and
+// the fetches made through them.
+type sessionExchange struct {
+	servingExchange
+	sessions int
+	fetches  int32
+}
+
+func (e *sessionExchange) NewSession(context.Context) exchange.Fetcher {
+	e.sessions++
+	return sessionFetcher{e}
+}
+
+type sessionFetcher struct{ e *sessionExchange }
+
+func (f sessionFetcher) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	atomic.AddInt32(&f.e.fetches, 1)
+	return f.e.GetBlock(ctx, k)
+}
+
+func (f sessionFetcher) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	atomic.AddInt32(&f.e.fetches, 1)
+	return f.e.GetBlocks(ctx, ks)
+}
+
+func TestSession(t *testing.T) {
+	a := blocks.NewBlock([]byte("a"))
+	b := blocks.NewBlock([]byte("b"))
+	rem := &sessionExchange{servingExchange: servingExchange{blocks: map[key.Key]*blocks.Block{a.Key(): a, b.Key(): b}}}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ctx := context.Background()
+	ss := bs.NewSession(ctx)
+	if rem.sessions != 1 {
+		t.Fatalf("expected one exchange session, got %d", rem.sessions)
+	}
+	if _, err := ss.GetBlock(ctx, a.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if got := drain(ss.GetBlocks(ctx, []key.Key{a.Key(), b.Key()})); len(got) != 2 {
+		t.Fatalf("expected both blocks, got %d", len(got))
+	}
+	// |a| was cached by the first fetch, and now |b| is too.
+	if reqs := rem.Requests(); len(reqs) != 2 || len(reqs[1]) != 1 || reqs[1][0] != b.Key() {
+		t.Fatalf("unexpected exchange requests %v", reqs)
+	}
+	if _, err := ss.GetBlock(ctx, b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&rem.fetches); n != 2 {
+		t.Fatalf("expected 2 fetches through the session, got %d", n)
+	}
+}
+
+func TestRefCountedDelete(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	if err := bs.EnableRefCounting(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := blocks.NewBlock([]byte("shared block"))
+	for i := 0; i < 2; i++ {
+		if _, err := bs.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bs.AddBlocks(context.Background(), []*blocks.Block{b}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := bs.GetBlockInfo(b.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Refs != 3 {
+		t.Fatalf("expected 3 references, got %d", info.Refs)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := bs.DeleteBlock(b.Key()); err != nil {
+			t.Fatal(err)
+		}
+		if has, _ := bs.Blockstore.Has(b.Key()); !has {
+			t.Fatalf("block deleted with %d references left", 2-i)
+		}
+	}
+	if err := bs.DeleteBlock(b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Blockstore.Has(b.Key()); has {
+		t.Fatal("block kept after its last reference was released")
+	}
+	if st := bs.Stats(); st.Deleted != 1 {
+		t.Fatalf("expected 1 block deleted, got %d", st.Deleted)
+	}
+
+	// a re-added block starts counting afresh.
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := bs.GetBlockInfo(b.Key()); info.Refs != 1 {
+		t.Fatalf("expected 1 reference after re-adding, got %d", info.Refs)
+	}
+}
+
+func TestRefCountedDeleteUncountedBlock(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+
+	b := blocks.NewBlock([]byte("added before counting"))
+	if err := bs.Blockstore.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.EnableRefCounting(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteBlock(b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Blockstore.Has(b.Key()); has {
+		t.Fatal("block without references was not deleted")
+	}
+}
+
+func TestExchangeBlocksAreVerified(t *testing.T) {
+	good := blocks.NewBlock([]byte("good block"))
+	wanted := blocks.NewBlock([]byte("wanted block")).Key()
+	forged := &blocks.Block{Multihash: mh.Multihash(wanted), Data: []byte("forged data")}
+	otherKey := blocks.NewBlock([]byte("asked for this")).Key()
+
+	bs, rem := newServingService(t, good, forged)
+	defer bs.Close()
+	rem.blocks[otherKey] = good // a real block, but not the one asked for.
+
+	if _, err := bs.GetBlock(context.Background(), wanted); err != blockstore.ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch for forged data, got %v", err)
+	}
+	if _, err := bs.GetBlock(context.Background(), otherKey); err != blockstore.ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch for the wrong block, got %v", err)
+	}
+	if has, _ := bs.Blockstore.Has(wanted); has {
+		t.Fatal("forged block was stored")
+	}
+
+	got := drain(bs.GetBlocks(context.Background(), []key.Key{good.Key(), wanted}))
+	if len(got) != 1 || got[0].Key() != good.Key() {
+		t.Fatalf("expected only the good block, got %v", got)
+	}
+	if st := bs.Stats(); st.Rejected != 3 {
+		t.Fatalf("expected 3 rejected blocks, got %d", st.Rejected)
+	}
+
+	bs.SetBlockVerifier(TrustExchange)
+	b, err := bs.GetBlock(context.Background(), wanted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Data) != "forged data" {
+		t.Fatalf("unexpected block data %q", b.Data)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	rem := &hintingExchange{announced: make(chan key.Key), hints: make(map[key.Key][]string)}
+	bs, err := New(bstore, rem, WithNumWorkers(2), WithClientBuffer(8), WithWorkerBuffer(4), WithRetryBackoff(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// nothing is taken from |announced| until all blocks are added.
+	for i := 0; i < 8; i++ {
+		if _, err := bs.AddBlock(blocks.NewBlock([]byte(fmt.Sprintf("option block %d", i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case <-rem.announced:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of 8 blocks announced", i)
+		}
+	}
+
+	for _, opt := range []Option{WithNumWorkers(0), WithClientBuffer(-1), WithWorkerBuffer(-1), WithRetryBackoff(-time.Second, 0), WithAnnounceDedup(-time.Second), WithMaxQueuedAnnouncements(-1), WithAdaptiveWorkers(4, 2), WithFetchTimeout(-time.Second), WithNotFoundCache(time.Minute, 0), WithVerifyMode(VerifyMode(7)), WithDiskBreaker(DiskBreaker{Window: 2, MaxBad: 3})} {
+		if _, err := New(bstore, rem, opt); err == nil {
+			t.Fatal("expected an invalid option to be rejected")
+		}
+	}
+}
+
+func TestGetBlocksMissPolicies(t *testing.T) {
+	a, b := blocks.NewBlock([]byte("stored a")), blocks.NewBlock([]byte("stored b"))
+	var remote []*blocks.Block
+	for i := 0; i < 3; i++ {
+		remote = append(remote, blocks.NewBlock([]byte(fmt.Sprintf("fetched %d", i))))
+	}
+	ks := []key.Key{a.Key(), remote[0].Key(), b.Key(), remote[1].Key(), remote[2].Key()}
+
+	for _, c := range []struct {
+		opts     GetBlocksOptions
+		got      int
+		requests []int
+	}{
+		{GetBlocksOptions{}, 5, []int{3}},
+		{GetBlocksOptions{Misses: MissesStreamed}, 5, []int{1, 1, 1}},
+		{GetBlocksOptions{Misses: MissesChunked, MissBatch: 2}, 5, []int{2, 1}},
+		{GetBlocksOptions{Misses: MissesLocalOnly}, 2, nil},
+		{GetBlocksOptions{Misses: MissesFailFast}, 1, nil},
+	} {
+		bs, rem := newServingService(t, remote...)
+		for _, blk := range []*blocks.Block{a, b} {
+			if _, err := bs.AddBlock(blk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := drain(bs.GetBlocksWith(context.Background(), ks, c.opts))
+		if len(got) != c.got {
+			t.Fatalf("policy %d: expected %d blocks, got %d", c.opts.Misses, c.got, len(got))
+		}
+		var sizes []int
+		for _, req := range rem.Requests() {
+			sizes = append(sizes, len(req))
+		}
+		if fmt.Sprint(sizes) != fmt.Sprint(c.requests) {
+			t.Fatalf("policy %d: expected requests of %v keys, got %v", c.opts.Misses, c.requests, sizes)
+		}
+		bs.Close()
+	}
+}
+
+func TestGetBlocksDeduplicatesKeys(t *testing.T) {
+	local := blocks.NewBlock([]byte("local block"))
+	remote := blocks.NewBlock([]byte("remote block"))
+	ks := []key.Key{local.Key(), remote.Key(), local.Key(), remote.Key(), remote.Key()}
+
+	for _, unique := range []bool{false, true} {
+		bs, rem := newServingService(t, remote)
+		if _, err := bs.AddBlock(local); err != nil {
+			t.Fatal(err)
+		}
+
+		counts := make(map[key.Key]int)
+		for _, b := range drain(bs.GetBlocksWith(context.Background(), ks, GetBlocksOptions{Unique: unique})) {
+			counts[b.Key()]++
+		}
+		wantLocal, wantRemote := 2, 3
+		if unique {
+			wantLocal, wantRemote = 1, 1
+		}
+		if counts[local.Key()] != wantLocal || counts[remote.Key()] != wantRemote {
+			t.Fatalf("unique=%v: got %d local and %d remote copies", unique, counts[local.Key()], counts[remote.Key()])
+		}
+
+		if st := bs.Stats(); st.LocalHits != 1 || st.ExchangeHits != 1 {
+			t.Fatalf("unique=%v: expected one read of each block, got %+v", unique, st)
+		}
+		reqs := rem.Requests()
+		if len(reqs) != 1 || len(reqs[0]) != 1 || reqs[0][0] != remote.Key() {
+			t.Fatalf("unique=%v: expected a single want for the remote block, got %v", unique, reqs)
+		}
+		bs.Close()
+	}
+}
+
+// stallingExchange accepts every request and never answers it, or fails it
+// with |err| if set.
+type stallingExchange struct {
+	recordingExchange
+	err error
+}
+
+func (e *stallingExchange) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	e.recordingExchange.GetBlocks(ctx, ks)
+	if e.err != nil {
+		return nil, e.err
+	}
+	return make(chan *blocks.Block), nil
+}
+
+func collectResults(ch <-chan BlockResult) map[key.Key]BlockResult {
+	res := make(map[key.Key]BlockResult)
+	for r := range ch {
+		res[r.Key] = r
+	}
+	return res
+}
+
+func TestGetBlocksWithErrors(t *testing.T) {
+	local := blocks.NewBlock([]byte("local block"))
+	remote := blocks.NewBlock([]byte("remote block"))
+	wanted := blocks.NewBlock([]byte("wanted block")).Key()
+	forged := &blocks.Block{Multihash: mh.Multihash(wanted), Data: []byte("forged data")}
+	missing := blocks.NewBlock([]byte("missing block")).Key()
+
+	bs, _ := newServingService(t, remote, forged)
+	defer bs.Close()
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	res := make(map[key.Key]BlockResult)
+	for r := range bs.GetBlocksWithErrors(context.Background(), []key.Key{local.Key(), remote.Key(), wanted, missing, local.Key()}) {
+		res[r.Key] = r
+		n++
+	}
+	if n != 4 {
+		t.Fatalf("expected one result per key, got %d", n)
+	}
+	if r := res[local.Key()]; r.Err != nil || r.Block == nil {
+		t.Fatalf("local block: %+v", r)
+	}
+	if r := res[remote.Key()]; r.Err != nil || r.Block == nil {
+		t.Fatalf("remote block: %+v", r)
+	}
+	if r := res[wanted]; r.Err != blockstore.ErrHashMismatch || r.Block != nil {
+		t.Fatalf("expected ErrHashMismatch for the forged block, got %+v", r)
+	}
+	if r := res[missing]; r.Err != ErrNotFound || r.Block != nil {
+		t.Fatalf("expected ErrNotFound for the missing block, got %+v", r)
+	}
+}
+
+func TestGetBlocksWithErrorsExchangeFailure(t *testing.T) {
+	failure := errors.New("exchange unavailable")
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), &stallingExchange{err: failure})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	k := blocks.NewBlock([]byte("unreachable")).Key()
+	if r := collectResults(bs.GetBlocksWithErrors(context.Background(), []key.Key{k}))[k]; r.Err != failure {
+		t.Fatalf("expected the exchange's error, got %+v", r)
+	}
+}
+
+func TestGetBlocksWithErrorsContextDone(t *testing.T) {
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), &stallingExchange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	k := blocks.NewBlock([]byte("slow")).Key()
+	// the result may be left out once the context is done, but not be any
+	// other error.
+	if r, ok := collectResults(bs.GetBlocksWithErrors(ctx, []key.Key{k}))[k]; ok && r.Err != context.DeadlineExceeded {
+		t.Fatalf("expected the context's error, got %+v", r)
+	}
+	if _, err := bs.GetBlocksOrdered(ctx, []key.Key{k}); err != context.DeadlineExceeded {
+		t.Fatalf("expected the context's error, got %v", err)
+	}
+}
+
+func TestGetBlocksWithErrorsEmptyKey(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	rs := collectResults(bs.GetBlocksWithErrors(context.Background(), []key.Key{"", ""}))
+	if r, ok := rs[""]; !ok || r.Err != ErrNotFound || len(rs) != 1 {
+		t.Fatalf("expected one ErrNotFound for the empty key, got %+v", rs)
+	}
+}
+
+func TestSetOnline(t *testing.T) {
+	remote := blocks.NewBlock([]byte("remote block"))
+	bs, rem := newServingService(t, remote)
+	defer bs.Close()
+
+	bs.SetOnline(false)
+	if bs.Online() {
+		t.Fatal("service still reports being online")
+	}
+	if _, err := bs.GetBlock(context.Background(), remote.Key()); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound while offline, got %v", err)
+	}
+	if got := drain(bs.GetBlocks(context.Background(), []key.Key{remote.Key()})); len(got) != 0 {
+		t.Fatalf("expected no blocks while offline, got %v", got)
+	}
+	if reqs := rem.Requests(); len(reqs) != 0 {
+		t.Fatalf("exchange was consulted while offline: %v", reqs)
+	}
+
+	bs.SetOnline(true)
+	if _, err := bs.GetBlock(context.Background(), remote.Key()); err != nil {
+		t.Fatalf("expected the block once back online, got %v", err)
+	}
+}
+
+func TestGetBlocksCancelsOutstandingWants(t *testing.T) {
+	rem := &stallingExchange{}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ks := []key.Key{blocks.NewBlock([]byte("a")).Key(), blocks.NewBlock([]byte("b")).Key()}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	drain(bs.GetBlocks(ctx, ks))
+
+	deadline := time.Now().Add(time.Second)
+	for len(rem.Cancels()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("outstanding wants were never cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c := rem.Cancels(); len(c) != 1 || len(c[0]) != 2 {
+		t.Fatalf("expected both keys cancelled at once, got %v", c)
+	}
+}
+
+func TestGetBlocksCompletedFetchCancelsNothing(t *testing.T) {
+	remote := blocks.NewBlock([]byte("remote block"))
+	bs, rem := newServingService(t, remote)
+	defer bs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	drain(bs.GetBlocks(ctx, []key.Key{remote.Key()}))
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if c := rem.Cancels(); len(c) != 0 {
+		t.Fatalf("wants cancelled after the fetch completed: %v", c)
+	}
+}
+
+type recordingMetrics struct {
+	mu  sync.Mutex
+	got map[string]int
+}
+
+func (m *recordingMetrics) Observe(op Operation, outcome Outcome, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.got == nil {
+		m.got = make(map[string]int)
+	}
+	m.got[string(op)+"/"+string(outcome)]++
+}
+
+func (m *recordingMetrics) Count(op Operation, outcome Outcome) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.got[string(op)+"/"+string(outcome)]
+}
+
+func TestMetrics(t *testing.T) {
+	local := blocks.NewBlock([]byte("local"))
+	remote := blocks.NewBlock([]byte("remote"))
+	missing := blocks.NewBlock([]byte("missing"))
+	bs, _ := newServingService(t, remote)
+	defer bs.Close()
+	m := &recordingMetrics{}
+	bs.SetMetrics(m)
+
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []key.Key{local.Key(), remote.Key(), missing.Key()} {
+		bs.GetBlock(context.Background(), k)
+	}
+	drain(bs.GetBlocks(context.Background(), []key.Key{local.Key(), remote.Key(), missing.Key(), missing.Key()}))
+	if err := bs.DeleteBlock(local.Key()); err != nil {
+		t.Fatal(err)
+	}
+	bs.DeleteBlock(missing.Key())
+
+	expect := []struct {
+		op      Operation
+		outcome Outcome
+		n       int
+	}{
+		{OpAddBlock, OutcomeOK, 1},
+		{OpGetBlock, OutcomeLocalHit, 1},
+		{OpGetBlock, OutcomeExchangeHit, 1},
+		{OpGetBlock, OutcomeMiss, 1},
+		{OpGetBlocks, OutcomeLocalHit, 1},
+		{OpGetBlocks, OutcomeExchangeHit, 1},
+		{OpGetBlocks, OutcomeMiss, 1},
+		{OpDeleteBlock, OutcomeOK, 1},
+		{OpDeleteBlock, OutcomeMiss, 1},
+	}
+	for _, e := range expect {
+		if n := m.Count(e.op, e.outcome); n != e.n {
+			t.Errorf("%s/%s: expected %d observations, got %d", e.op, e.outcome, e.n, n)
+		}
+	}
+}
+
+type spanKey struct{}
+
+// recordingTracer records each span as "parent>name", its parent being the
+// span in the context it was started from.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+type recordedSpan struct{}
+
+func (recordedSpan) SetTag(string, interface{}) {}
+func (recordedSpan) Finish(error)               {}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, operation string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(string)
+	t.mu.Lock()
+	t.spans = append(t.spans, parent+">"+operation)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, operation), recordedSpan{}
+}
+
+func (t *recordingTracer) Spans() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.spans...)
+}
+
+func TestTracing(t *testing.T) {
+	remote := blocks.NewBlock([]byte("remote"))
+	rem := &servingExchange{blocks: map[key.Key]*blocks.Block{remote.Key(): remote}}
+	tr := &recordingTracer{}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithTracer(tr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ctx := context.WithValue(context.Background(), spanKey{}, "caller")
+	if _, err := bs.GetBlock(ctx, remote.Key()); err != nil {
+		t.Fatal(err)
+	}
+	drain(bs.GetBlocks(ctx, []key.Key{remote.Key()}))
+	if _, err := bs.AddBlockCtx(ctx, blocks.NewBlock([]byte("added"))); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"caller>blockservice.GetBlock",
+		"blockservice.GetBlock>blockstore.Get",
+		"blockservice.GetBlock>exchange.GetBlock",
+		"caller>blockservice.GetBlocks",
+		"blockservice.GetBlocks>blockstore.Get",
+		"blockservice.GetBlocks>exchange.GetBlocks",
+		"caller>exchange.HasBlock",
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(tr.Spans()) < len(expect) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := tr.Spans(); fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatalf("expected spans %v, got %v", expect, got)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	stored := blocks.NewBlock([]byte("stored"))
+	remote := blocks.NewBlock([]byte("remote"))
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	if err := bstore.Put(stored); err != nil {
+		t.Fatal(err)
+	}
+	rem := &servingExchange{blocks: map[key.Key]*blocks.Block{remote.Key(): remote}}
+	bs, err := New(bstore, rem, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	bs.SetReadRepair(true)
+
+	if _, err := bs.GetBlock(context.Background(), stored.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.GetBlock(context.Background(), remote.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bstore.Has(remote.Key()); has {
+		t.Fatal("read repair wrote to a read-only service's blockstore")
+	}
+
+	if _, err := bs.AddBlock(blocks.NewBlock([]byte("new"))); err != blockstore.ErrReadOnly {
+		t.Fatalf("AddBlock: expected ErrReadOnly, got %v", err)
+	}
+	if _, err := bs.AddBlocks(context.Background(), []*blocks.Block{remote}); err != blockstore.ErrReadOnly {
+		t.Fatalf("AddBlocks: expected ErrReadOnly, got %v", err)
+	}
+	if err := bs.DeleteBlock(stored.Key()); err != blockstore.ErrReadOnly {
+		t.Fatalf("DeleteBlock: expected ErrReadOnly, got %v", err)
+	}
+	if has, _ := bstore.Has(stored.Key()); !has {
+		t.Fatal("block deleted from a read-only service")
+	}
+	if st := bs.Stats(); st.Errors != 0 {
+		t.Fatalf("read-only rejections counted as %d blockstore errors", st.Errors)
+	}
+}
+
+func TestMaxBlockSize(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs, err := New(bstore, offline.Exchange(bstore), WithMaxBlockSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	small := blocks.NewBlock([]byte("four"))
+	large := blocks.NewBlock([]byte("five!"))
+	if _, err := bs.AddBlock(small); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.AddBlock(large); err != blocks.ErrBlockTooLarge {
+		t.Fatalf("AddBlock: expected ErrBlockTooLarge, got %v", err)
+	}
+	other := blocks.NewBlock([]byte("ok"))
+	if _, err := bs.AddBlocks(context.Background(), []*blocks.Block{other, large}); err != blocks.ErrBlockTooLarge {
+		t.Fatalf("AddBlocks: expected ErrBlockTooLarge, got %v", err)
+	}
+	for _, b := range []*blocks.Block{large, other} {
+		if has, _ := bstore.Has(b.Key()); has {
+			t.Fatalf("%s stored despite the size limit", b)
+		}
+	}
+
+	unlimited, err := New(bstore, offline.Exchange(bstore), WithMaxBlockSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlimited.Close()
+	if _, err := unlimited.AddBlock(blocks.NewBlock(make([]byte, blocks.DefaultMaxBlockSize+1))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewBlockHashType(t *testing.T) {
+	remote, err := blocks.NewBlockWithHashType([]byte("remote"), mh.SHA2_512, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rem := &servingExchange{blocks: map[key.Key]*blocks.Block{remote.Key(): remote}}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs, err := New(bstore, rem, WithHashType(mh.SHA2_512, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	b, err := bs.NewBlock([]byte("local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, _ := mh.Decode(b.Multihash); dec == nil || dec.Code != mh.SHA2_512 {
+		t.Fatalf("block not keyed by sha2-512: %v", b.Multihash)
+	}
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []key.Key{b.Key(), remote.Key()} {
+		if _, err := bs.GetBlock(context.Background(), k); err != nil {
+			t.Fatalf("getting %s: %s", k, err)
+		}
+	}
+
+	if _, err := New(bstore, rem, WithHashType(mh.SHA2_256, 64)); err == nil {
+		t.Fatal("expected an error for an overlong digest")
+	}
+}
+
+func TestTypedBlocks(t *testing.T) {
+	remote := blocks.NewBlockWithCodec([]byte("remote"), key.DagCBOR)
+	bs, _ := newServingService(t, remote)
+	defer bs.Close()
+
+	local := blocks.NewBlockWithCodec([]byte("local"), key.Raw)
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []*blocks.Block{local, remote} {
+		got, err := bs.GetBlock(context.Background(), want.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Codec != want.Codec || got.Key() != want.Key() {
+			t.Fatalf("expected %v with codec %x, got %v with codec %x", want, want.Codec, got, got.Codec)
+		}
+	}
+	ch, err := bs.Blockstore.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected the typed block to be listed, got %d keys", n)
+	}
+}
+
+func TestMaxOutstandingWantsBatches(t *testing.T) {
+	var bs []*blocks.Block
+	var ks []key.Key
+	for i := 0; i < 10; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		bs = append(bs, b)
+		ks = append(ks, b.Key())
+	}
+	rem := &servingExchange{blocks: make(map[key.Key]*blocks.Block)}
+	for _, b := range bs {
+		rem.blocks[b.Key()] = b
+	}
+	serv, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithMaxOutstandingWants(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serv.Close()
+
+	if got := drain(serv.GetBlocks(context.Background(), ks)); len(got) != len(ks) {
+		t.Fatalf("expected %d blocks, got %d", len(ks), len(got))
+	}
+	reqs := rem.Requests()
+	if len(reqs) != 4 {
+		t.Fatalf("expected 4 batches, got %d", len(reqs))
+	}
+	for _, r := range reqs {
+		if len(r) > 3 {
+			t.Fatalf("batch of %d keys exceeds the limit", len(r))
+		}
+	}
+	if serv.wants.used != 0 {
+		t.Fatalf("%d wants still held after the fetch", serv.wants.used)
+	}
+}
+
+// concurrencyExchange serves every block after a delay, recording how many
+// GetBlock calls it served at once.
+type concurrencyExchange struct {
+	recordingExchange
+	active, peak int32
+}
+
+func (e *concurrencyExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	n := atomic.AddInt32(&e.active, 1)
+	defer atomic.AddInt32(&e.active, -1)
+	for {
+		peak := atomic.LoadInt32(&e.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&e.peak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return nil, ErrNotFound
+}
+
+func TestMaxConcurrentFetches(t *testing.T) {
+	rem := &concurrencyExchange{}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithMaxConcurrentFetches(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bs.GetBlock(context.Background(), blocks.NewBlock([]byte(fmt.Sprint(i))).Key())
+		}(i)
+	}
+	wg.Wait()
+	if peak := atomic.LoadInt32(&rem.peak); peak != 2 {
+		t.Fatalf("expected at most 2 fetches at once, and that many, got %d", peak)
+	}
+
+	// a queued fetch gives up with its context.
+	bs.fetches.acquire(context.Background(), 2)
+	defer bs.fetches.release(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := bs.GetBlock(ctx, blocks.NewBlock([]byte("queued")).Key()); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline error, got %v", err)
+	}
+}
+
+func TestProvideRoots(t *testing.T) {
+	rem := &hintingExchange{
+		announced: make(chan key.Key, 4),
+		hints:     make(map[key.Key][]string),
+	}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs, err := New(bstore, rem, WithProvideStrategy(ProvideRoots))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	leaves := []*blocks.Block{blocks.NewBlock([]byte("leaf 1")), blocks.NewBlock([]byte("leaf 2"))}
+	if _, err := bs.AddBlocks(context.Background(), leaves); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.AddBlock(blocks.NewBlock([]byte("leaf 3"))); err != nil {
+		t.Fatal(err)
+	}
+	root := blocks.NewBlock([]byte("root"))
+	if _, err := bs.AddBlockWith(root, AddBlockOptions{Root: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case k := <-rem.announced:
+		if k != root.Key() {
+			t.Fatalf("announced a leaf: %s", k)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the root's announcement")
+	}
+	select {
+	case k := <-rem.announced:
+		t.Fatalf("announced a leaf: %s", k)
+	case <-time.After(10 * time.Millisecond):
+	}
+	for _, b := range leaves {
+		if has, _ := bstore.Has(b.Key()); !has {
+			t.Fatalf("unannounced block %s was not stored", b)
+		}
+	}
+}
+
+func TestCloseWithContext(t *testing.T) {
+	rem := &announceExchange{release: make(chan error)}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	announced := blocks.NewBlock([]byte("announced"))
+	if _, err := bs.AddBlock(announced); err != nil {
+		t.Fatal(err)
+	}
+	go func() { rem.release <- nil }()
+
+	dropped, err := bs.CloseWithContext(context.Background())
+	if err != nil || dropped != 0 {
+		t.Fatalf("expected a clean drain, got %d dropped, %v", dropped, err)
+	}
+	if a := rem.Announced(); len(a) != 1 || a[0] != announced.Key() {
+		t.Fatalf("expected the block to be announced before closing, got %v", a)
+	}
+	if _, err := bs.AddBlock(blocks.NewBlock([]byte("late"))); err == nil {
+		t.Fatal("closing service queued a block")
+	}
+}
+
+// flakyExchange fails the first |failures| fetches of each key, then serves.
+type flakyExchange struct {
+	servingExchange
+	failures int
+
+	mu    sync.Mutex
+	tries map[key.Key]int
+}
+
+func (e *flakyExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	e.mu.Lock()
+	e.tries[k]++
+	n := e.tries[k]
+	e.mu.Unlock()
+	if n <= e.failures {
+		return nil, errors.New("transient failure")
+	}
+	return e.servingExchange.GetBlock(ctx, k)
+}
+
+func newFlakyService(t *testing.T, failures int, p RetryPolicy, bs ...*blocks.Block) (*BlockService, *flakyExchange) {
+	rem := &flakyExchange{
+		servingExchange: servingExchange{blocks: make(map[key.Key]*blocks.Block)},
+		failures:        failures,
+		tries:           make(map[key.Key]int),
+	}
+	for _, b := range bs {
+		rem.blocks[b.Key()] = b
+	}
+	serv, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithRetryPolicy(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serv, rem
+}
+
+func TestRetryPolicy(t *testing.T) {
+	b := blocks.NewBlock([]byte("eventually served"))
+	p := RetryPolicy{Attempts: 3, Backoff: time.Millisecond, Jitter: 0.5}
+
+	bs, rem := newFlakyService(t, 2, p, b)
+	defer bs.Close()
+	got, err := bs.GetBlock(context.Background(), b.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Key() != b.Key() {
+		t.Fatal("got the wrong block")
+	}
+	if n := rem.tries[b.Key()]; n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+
+	bs, rem = newFlakyService(t, 3, p, b)
+	defer bs.Close()
+	if _, err := bs.GetBlock(context.Background(), b.Key()); err == nil {
+		t.Fatal("expected the last attempt's error")
+	}
+	if n := rem.tries[b.Key()]; n != 3 {
+		t.Fatalf("expected to give up after 3 attempts, got %d", n)
+	}
+
+	p.Retryable = func(error) bool { return false }
+	bs, rem = newFlakyService(t, 1, p, b)
+	defer bs.Close()
+	if _, err := bs.GetBlock(context.Background(), b.Key()); err == nil {
+		t.Fatal("expected a failure Retryable rejects to be returned")
+	}
+	if n := rem.tries[b.Key()]; n != 1 {
+		t.Fatalf("expected a single attempt, got %d", n)
+	}
+}
+
+func TestRetryPolicyStopsWithContext(t *testing.T) {
+	b := blocks.NewBlock([]byte("never served"))
+	bs, rem := newFlakyService(t, 100, RetryPolicy{Attempts: 100, Backoff: time.Hour}, b)
+	defer bs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := bs.GetBlock(ctx, b.Key()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := rem.tries[b.Key()]; n != 1 {
+		t.Fatalf("expected no retry once the context was done, got %d attempts", n)
+	}
+}
+
+// hangingExchange records GetBlock calls and answers none of them.
+type hangingExchange struct {
+	recordingExchange
+}
+
+func (e *hangingExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	e.recordingExchange.GetBlock(ctx, k)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRetryPolicyAttemptTimeout(t *testing.T) {
+	rem := &hangingExchange{}
+	p := RetryPolicy{Attempts: 3, AttemptTimeout: 5 * time.Millisecond}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithRetryPolicy(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	k := blocks.NewBlock([]byte("stalled")).Key()
+	if _, err := bs.GetBlock(context.Background(), k); err == nil {
+		t.Fatal("expected every attempt to time out")
+	}
+	if n := len(rem.Requests()); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestRetryPolicyValidation(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	for _, p := range []RetryPolicy{
+		{Attempts: -1},
+		{Backoff: -time.Second},
+		{Jitter: 2},
+	} {
+		if _, err := New(bstore, nil, WithRetryPolicy(p)); err == nil {
+			t.Fatalf("expected %+v to be rejected", p)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	local := blocks.NewBlock([]byte("already here"))
+	remote := blocks.NewBlock([]byte("prefetched"))
+	bs, rem := newServingService(t, remote)
+	defer bs.Close()
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	added := bs.Subscribe(ctx, EventAdded)
+	bs.Prefetch(context.Background(), []key.Key{local.Key(), remote.Key()})
+	waitUntil(t, "block prefetched", func() bool { return bs.Stats().Prefetched == 1 })
+	if has, _ := bs.Blockstore.Has(remote.Key()); !has {
+		t.Fatal("prefetched block was not stored")
+	}
+	select {
+	case e := <-added:
+		if e.Key != remote.Key() {
+			t.Fatalf("expected the prefetched block added, got %s", e.Key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the prefetched block stored as an add")
+	}
+	reqs := rem.Requests()
+	if len(reqs) != 1 || len(reqs[0]) != 1 || reqs[0][0] != remote.Key() {
+		t.Fatalf("expected only the missing key to be fetched, got %v", reqs)
+	}
+	if _, err := bs.GetBlock(context.Background(), remote.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if st := bs.Stats(); st.ExchangeHits != 0 {
+		t.Fatal("prefetched block was not read locally")
+	}
+}
+
+func TestPrefetchAfterClose(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	p := newPrefetcher(&activity{}, func(context.Context, []key.Key) {}, store)
+	p.Close()
+	p.push(context.Background(), []key.Key{blocks.NewBlock([]byte("late")).Key()})
+	if _, _, ok := p.next(); ok {
+		t.Fatal("expected a push after Close dropped")
+	}
+	if ks := p.load(); len(ks) != 0 {
+		t.Fatalf("expected a push after Close not kept, got %v", ks)
+	}
+}
+
+// slowGetExchange holds GetBlock calls until |release| is closed, and serves
+// GetBlocks at once.
+type slowGetExchange struct {
+	servingExchange
+	release chan struct{}
+}
+
+func (e *slowGetExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	e.recordingExchange.GetBlock(ctx, k)
+	<-e.release
+	return e.blocks[k], nil
+}
+
+func TestPrefetchYieldsToReads(t *testing.T) {
+	wanted := blocks.NewBlock([]byte("read"))
+	ahead := blocks.NewBlock([]byte("read later"))
+	rem := &slowGetExchange{
+		servingExchange: servingExchange{blocks: map[key.Key]*blocks.Block{
+			wanted.Key(): wanted,
+			ahead.Key():  ahead,
+		}},
+		release: make(chan struct{}),
+	}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	got := make(chan error)
+	go func() {
+		_, err := bs.GetBlock(context.Background(), wanted.Key())
+		got <- err
+	}()
+	waitUntil(t, "read requested", func() bool { return len(rem.Requests()) == 1 })
+
+	bs.Prefetch(context.Background(), []key.Key{ahead.Key()})
+	time.Sleep(20 * time.Millisecond)
+	if n := len(rem.Requests()); n != 1 {
+		t.Fatal("prefetch reached the exchange while a read was waiting on it")
+	}
+
+	close(rem.release)
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "block prefetched", func() bool { return bs.Stats().Prefetched == 1 })
+}
+
+// waitUntil fails |t| if |cond| does not hold within a second.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPersistencePrefetches(t *testing.T) {
+	queues := dssync.MutexWrap(ds.NewMapDatastore())
+	wanted := blocks.NewBlock([]byte("read"))
+	ahead := blocks.NewBlock([]byte("read after the restart"))
+	rem := &slowGetExchange{
+		servingExchange: servingExchange{blocks: map[key.Key]*blocks.Block{wanted.Key(): wanted}},
+		release:         make(chan struct{}),
+	}
+	defer close(rem.release)
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithPersistence(queues))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a read waiting on the exchange holds the prefetch back until Close.
+	go bs.GetBlock(context.Background(), wanted.Key())
+	waitUntil(t, "read requested", func() bool { return len(rem.Requests()) == 1 })
+	bs.Prefetch(context.Background(), []key.Key{ahead.Key()})
+	bs.Close()
+
+	bs2, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		&servingExchange{blocks: map[key.Key]*blocks.Block{ahead.Key(): ahead}},
+		WithPersistence(queues))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs2.Close()
+	waitUntil(t, "persisted prefetch resumed", func() bool { return bs2.Stats().Prefetched == 1 })
+	if has, _ := bs2.Blockstore.Has(ahead.Key()); !has {
+		t.Fatal("resumed prefetch did not store its block")
+	}
+	waitUntil(t, "prefetch queue emptied", func() bool {
+		res, err := queues.Query(dsq.Query{Prefix: "/prefetch", KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		left, _ := res.Rest()
+		return len(left) == 0
+	})
+}
+
+func newExpiringService(t *testing.T, bstore blockstore.Blockstore, sweep time.Duration) *BlockService {
+	bs, err := New(bstore, offline.Null())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.EnableExpiry(sweep); err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestExpiryOnRead(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs := newExpiringService(t, bstore, time.Hour)
+	defer bs.Close()
+
+	short, long := blocks.NewBlock([]byte("short lived")), blocks.NewBlock([]byte("long lived"))
+	if _, err := bs.PutWithTTL(short, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.PutWithTTL(long, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := bs.GetBlock(context.Background(), short.Key()); err == nil {
+		t.Fatal("expected an expired block to be missing")
+	}
+	if has, _ := bstore.Has(short.Key()); has {
+		t.Fatal("expected reading an expired block to remove it")
+	}
+	if _, err := bs.GetBlock(context.Background(), long.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if n := bs.Stats().Expired; n != 1 {
+		t.Fatalf("expected 1 expired block, got %d", n)
+	}
+}
+
+func TestExpirySweep(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs := newExpiringService(t, bstore, time.Millisecond)
+	defer bs.Close()
+
+	b := blocks.NewBlock([]byte("swept"))
+	if _, err := bs.PutWithTTL(b, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the sweep to remove the block", func() bool {
+		has, _ := bstore.Has(b.Key())
+		return !has
+	})
+	ms := bstore.(blockstore.MetadataStore)
+	if _, err := ms.GetMetadata(expiresKind, b.Key()); err != blockstore.ErrNotFound {
+		t.Fatalf("expected the expiry removed with the block, got %v", err)
+	}
+}
+
+func TestExpirySweepKeepsReAdded(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs := newExpiringService(t, bstore, time.Hour)
+	defer bs.Close()
+	b := blocks.NewBlock([]byte("added again mid-sweep"))
+	if _, err := bs.PutWithTTL(b, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// the sweep finds the block expired, but it is added again before the
+	// sweep gets to it.
+	due := bs.expiry.due(time.Now())
+	if len(due) != 1 {
+		t.Fatalf("expected the block due, got %v", due)
+	}
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range due {
+		bs.expire(k)
+	}
+	if has, _ := bstore.Has(b.Key()); !has {
+		t.Fatal("expected the block added again kept")
+	}
+
+	if err := bs.EnableExpiry(0); err == nil {
+		t.Fatal("expected a zero sweep interval rejected")
+	}
+}
+
+func TestExpiryPersistsAndReAddClears(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs := newExpiringService(t, bstore, time.Hour)
+	kept, dropped := blocks.NewBlock([]byte("re-added")), blocks.NewBlock([]byte("dropped"))
+	for _, b := range []*blocks.Block{kept, dropped} {
+		if _, err := bs.PutWithTTL(b, 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// adding it again without a TTL makes it permanent.
+	if _, err := bs.AddBlock(kept); err != nil {
+		t.Fatal(err)
+	}
+	bs.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	bs = newExpiringService(t, bstore, time.Hour)
+	defer bs.Close()
+	if _, err := bs.GetBlock(context.Background(), dropped.Key()); err == nil {
+		t.Fatal("expected the expiry to survive a restart")
+	}
+	if _, err := bs.GetBlock(context.Background(), kept.Key()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutWithTTLNeedsExpiry(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	if _, err := bs.PutWithTTL(blocks.NewBlock([]byte("x")), time.Hour); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestInlineBlocks(t *testing.T) {
+	store := mem.New()
+	rem := &recordingExchange{}
+	bs, err := New(store, rem, WithInlining(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	small, err := bs.NewBlock([]byte("tiny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := small.Key().InlineData(); !ok {
+		t.Fatal("expected small data to be inlined")
+	}
+	large, err := bs.NewBlock(make([]byte, 33))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := large.Key().InlineData(); ok {
+		t.Fatal("expected data over the inline size to be hashed")
+	}
+
+	if _, err := bs.AddBlock(small); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.AddBlocks(context.Background(), []*blocks.Block{small}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := bs.GetBlock(context.Background(), small.Key())
+	if err != nil || string(b.Data) != "tiny" {
+		t.Fatalf("inline block read as %v, %v", b, err)
+	}
+	for _, op := range []mem.Op{mem.OpGet, mem.OpHas, mem.OpPut} {
+		if n := store.Calls(op); n != 0 {
+			t.Fatalf("inline block reached the blockstore: %d calls of %v", n, op)
+		}
+	}
+	if len(rem.Requests()) != 0 {
+		t.Fatal("inline block was fetched from the exchange")
+	}
+
+	if _, err := New(store, rem, WithInlining(blocks.MaxInlineSize+1)); err == nil {
+		t.Fatal("expected an inline size over blocks.MaxInlineSize to be rejected")
+	}
+
+	plain, err := New(store, rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	empty, err := plain.NewBlock(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := empty.Key().InlineData(); ok {
+		t.Fatal("expected nothing inlined by default, not even empty data")
+	}
+}
+
+func TestAddBlockAsyncBatches(t *testing.T) {
+	store := mem.New()
+	bs, err := New(store, offline.Null(), WithWritePipeline(4, time.Hour, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	var errcs []<-chan error
+	var blks []*blocks.Block
+	for i := 0; i < 4; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("async %d", i)))
+		blks = append(blks, b)
+		errcs = append(errcs, bs.AddBlockAsync(b))
+	}
+	// a full batch is written at once, long before the flush interval.
+	for _, errc := range errcs {
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("full batch was not written")
+		}
+	}
+	for _, b := range blks {
+		if has, _ := store.Has(b.Key()); !has {
+			t.Fatalf("block %s not stored", b.Key())
+		}
+	}
+}
+
+func TestAddBlockAsyncFlushesOnClose(t *testing.T) {
+	store := mem.New()
+	bs, err := New(store, offline.Null(), WithWritePipeline(100, time.Hour, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock([]byte("queued"))
+	errc := bs.AddBlockAsync(b)
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := store.Has(b.Key()); !has {
+		t.Fatal("queued block was not written on close")
+	}
+	if err := <-bs.AddBlockAsync(blocks.NewBlock([]byte("late"))); err == nil {
+		t.Fatal("expected adds after close to fail")
+	}
+}
+
+func TestAddBlockAsyncLimitsInFlightBytes(t *testing.T) {
+	store := mem.New()
+	store.SetLatency(mem.OpPut, 20*time.Millisecond)
+	bs, err := New(store, offline.Null(), WithWritePipeline(1, time.Millisecond, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	first := bs.AddBlockAsync(blocks.NewBlock([]byte("12345678")))
+	start := time.Now()
+	second := bs.AddBlockAsync(blocks.NewBlock([]byte("abcdefgh")))
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatal("expected the second add to wait for the first to be written")
+	}
+	for _, errc := range []<-chan error{first, second} {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAddBlockAsyncRejectsAtOnce(t *testing.T) {
+	bs, err := New(mem.New(), offline.Null(), WithMaxBlockSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	if err := <-bs.AddBlockAsync(blocks.NewBlock([]byte("too large"))); err != blocks.ErrBlockTooLarge {
+		t.Fatalf("expected ErrBlockTooLarge, got %v", err)
+	}
+	if _, err := New(mem.New(), offline.Null(), WithWritePipeline(0, time.Second, 1)); err == nil {
+		t.Fatal("expected an empty batch size to be rejected")
+	}
+}
+
+func TestCorruptionRepair(t *testing.T) {
+	d := dssync.MutexWrap(ds.NewMapDatastore())
+	good := blocks.NewBlock([]byte("good data"))
+	if err := d.Put(blockstore.BlockPrefix.Child(good.Key().DsKey()), []byte("bit rot")); err != nil {
+		t.Fatal(err)
+	}
+	bstore := blockstore.NewBlockstore(d)
+	rem := mock.New(mock.Config{})
+	bs, err := New(bstore, rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	bs.SetCorruptionRepair(true)
+
+	// with nothing to repair it from, the corrupt copy is still not served.
+	if b, err := bs.GetBlock(context.Background(), good.Key()); err == nil {
+		t.Fatalf("corrupt block served as %q", b.Data)
+	}
+	if qs, err := bstore.(blockstore.Quarantiner).ListQuarantined(); err != nil || len(qs) != 1 {
+		t.Fatalf("expected the corrupt copy to be quarantined, got %v, %v", qs, err)
+	}
+
+	rem.Add(good)
+	b, err := bs.GetBlock(context.Background(), good.Key())
+	if err != nil || string(b.Data) != "good data" {
+		t.Fatalf("expected the exchange's copy, got %v, %v", b, err)
+	}
+	local, err := bstore.Get(good.Key())
+	if err != nil || string(local.Data) != "good data" {
+		t.Fatalf("local copy not repaired: %v, %v", local, err)
+	}
+	if st := bs.Stats(); st.Repaired != 1 {
+		t.Fatalf("expected 1 repair, got %d", st.Repaired)
+	}
+}
+
+func TestCorruptionRepairReadOnly(t *testing.T) {
+	d := dssync.MutexWrap(ds.NewMapDatastore())
+	good := blocks.NewBlock([]byte("good data"))
+	if err := d.Put(blockstore.BlockPrefix.Child(good.Key().DsKey()), []byte("bit rot")); err != nil {
+		t.Fatal(err)
+	}
+	bstore := blockstore.NewBlockstore(d)
+	rem := mock.New(mock.Config{})
+	rem.Add(good)
+	bs, err := New(bstore, rem, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	bs.SetCorruptionRepair(true)
+
+	b, err := bs.GetBlock(context.Background(), good.Key())
+	if err != nil || string(b.Data) != "good data" {
+		t.Fatalf("expected the exchange's copy, got %v, %v", b, err)
+	}
+	if qs, _ := bstore.(blockstore.Quarantiner).ListQuarantined(); len(qs) != 0 {
+		t.Fatalf("expected a read-only service to quarantine nothing, got %v", qs)
+	}
+	if has, _ := bstore.Has(good.Key()); !has {
+		t.Fatal("expected a read-only service to leave the local copy")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	all := bs.Subscribe(ctx)
+	deletes := bs.Subscribe(context.Background(), EventDeleted)
+
+	b := blocks.NewBlock([]byte("watched"))
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteBlock(b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []EventType{EventAdded, EventDeleted} {
+		e := <-all
+		if e.Type != want || e.Key != b.Key() {
+			t.Fatalf("expected %v of %s, got %+v", want, b.Key(), e)
+		}
+	}
+	if e := <-deletes; e.Type != EventDeleted {
+		t.Fatalf("expected only deletes, got %+v", e)
+	}
+
+	cancel()
+	for range all {
+	}
+	bs.Close()
+	if _, ok := <-deletes; ok {
+		t.Fatal("expected Close to end subscriptions")
+	}
+	if _, ok := <-bs.Subscribe(context.Background()); ok {
+		t.Fatal("expected subscriptions after Close to be closed")
+	}
+}
+
+func TestWatchDropsNone(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	var mu sync.Mutex
+	added := 0
+	bs.Watch(context.Background(), func(e BlockEvent) {
+		mu.Lock()
+		added++
+		mu.Unlock()
+	}, EventAdded)
+
+	n := 2 * subscriberBuffer
+	for i := 0; i < n; i++ {
+		if _, err := bs.AddBlock(blocks.NewBlock([]byte(fmt.Sprintf("burst %d", i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if added != n {
+		t.Fatalf("expected %d events, got %d", n, added)
+	}
+}
+
+func TestGetBlocksOrdered(t *testing.T) {
+	local := blocks.NewBlock([]byte("first, local"))
+	remote := blocks.NewBlock([]byte("second, remote"))
+	missing := blocks.NewBlock([]byte("missing block")).Key()
+
+	bs, _ := newServingService(t, remote)
+	defer bs.Close()
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+
+	// the local block is found first, but the remote one is asked for first.
+	ks := []key.Key{remote.Key(), local.Key(), missing, remote.Key()}
+	var got []BlockResult
+	for r := range bs.GetBlocksWithErrorsOrdered(context.Background(), ks) {
+		got = append(got, r)
+	}
+	if len(got) != len(ks) {
+		t.Fatalf("expected %d results, got %d", len(ks), len(got))
+	}
+	for i, r := range got {
+		if r.Key != ks[i] {
+			t.Fatalf("result %d is for %s, expected %s", i, r.Key, ks[i])
+		}
+	}
+	if got[2].Err != ErrNotFound || got[3].Block == nil {
+		t.Fatalf("unexpected results %+v", got)
+	}
+
+	blks, err := bs.GetBlocksOrdered(context.Background(), []key.Key{remote.Key(), local.Key()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blks) != 2 || blks[0].Key() != remote.Key() || blks[1].Key() != local.Key() {
+		t.Fatalf("blocks out of order: %v", blks)
+	}
+	if _, err := bs.GetBlocksOrdered(context.Background(), ks); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestGetBlockRange(t *testing.T) {
+	local := blocks.NewBlock([]byte("local block data"))
+	remote := blocks.NewBlock([]byte("remote block data"))
+	bs, _ := newServingService(t, remote)
+	defer bs.Close()
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := bs.GetBlockRange(context.Background(), local.Key(), 6, 5); err != nil || string(got) != "block" {
+		t.Fatalf("local range read as %q, %v", got, err)
+	}
+	if got, err := bs.GetBlockRange(context.Background(), remote.Key(), 13, 10); err != nil || string(got) != "data" {
+		t.Fatalf("remote range read as %q, %v", got, err)
+	}
+	if _, err := bs.GetBlockRange(context.Background(), local.Key(), 0, -1); err != blockstore.ErrInvalidRange {
+		t.Fatalf("expected ErrInvalidRange, got %v", err)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockservice-pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bstore, err := flatfs.NewBlockstore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := blocks.NewBufferPool()
+	bs, err := New(bstore, offline.Null(), WithBufferPool(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	b := blocks.NewBlock([]byte("read into a pooled buffer"))
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := bs.GetBlock(context.Background(), b.Key())
+	if err != nil || !bytes.Equal(got.Data, b.Data) {
+		t.Fatalf("pooled read got %v, %v", got, err)
+	}
+	got.Release()
+	if got.Data != nil {
+		t.Fatal("expected the block to be pooled, and released")
+	}
+	if got, err := bs.GetBlock(context.Background(), b.Key()); err != nil || !bytes.Equal(got.Data, b.Data) {
+		t.Fatalf("read into a reused buffer got %v, %v", got, err)
+	}
+}
+
+func TestParallelLocalReads(t *testing.T) {
+	store := mem.New()
+	store.SetLatency(mem.OpGet, 20*time.Millisecond)
+	remote := blocks.NewBlock([]byte("remote"))
+	rem := &servingExchange{blocks: map[key.Key]*blocks.Block{remote.Key(): remote}}
+	bs, err := New(store, rem, WithParallelLocalReads(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ks := []key.Key{remote.Key()}
+	for i := 0; i < 16; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("local %d", i)))
+		if _, err := bs.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Key())
+	}
+
+	start := time.Now()
+	got := drain(bs.GetBlocks(context.Background(), ks))
+	if len(got) != len(ks) {
+		t.Fatalf("expected %d blocks, got %d", len(ks), len(got))
+	}
+	// three rounds of eight reads, not seventeen reads one after another.
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatalf("reads took %s; expected them to run at once", d)
+	}
+	if reqs := rem.Requests(); len(reqs) != 1 || len(reqs[0]) != 1 || reqs[0][0] != remote.Key() {
+		t.Fatalf("expected only the miss to reach the exchange, got %v", reqs)
+	}
+
+	if _, err := New(store, rem, WithParallelLocalReads(-1)); err == nil {
+		t.Fatal("expected a negative parallelism to be rejected")
+	}
+}
+
+func TestParallelLocalReadsStop(t *testing.T) {
+	cbs := &countingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	bs, err := New(cbs, offline.Null(), WithParallelLocalReads(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	var ks []key.Key
+	for i := 0; i < 100; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("local %d", i)))
+		if _, err := bs.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Key())
+	}
+
+	wanted := false
+	bs.readLocalParallel(context.Background(), ks, false, func([]key.Key) { wanted = true },
+		func(key.Key, *blocks.Block) bool { return false }, func(key.Key) {})
+	if n := atomic.LoadInt32(&cbs.gets); n > 10 {
+		t.Fatalf("expected the reads called off once told to stop, got %d reads", n)
+	}
+	if wanted {
+		t.Fatal("expected no misses asked for once told to stop")
+	}
+}
+
+func TestGetBlocksProgress(t *testing.T) {
+	remote := blocks.NewBlock([]byte("remote"))
+	bs, _ := newServingService(t, remote)
+	defer bs.Close()
+	local := blocks.NewBlock([]byte("local"))
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []GetBlocksProgress
+	ks := []key.Key{local.Key(), remote.Key(), local.Key(), key.Key("missing")}
+	drain(bs.GetBlocksWith(context.Background(), ks, GetBlocksOptions{
+		Progress: func(p GetBlocksProgress) { reports = append(reports, p) },
+	}))
+	want := []GetBlocksProgress{
+		{Local: 1, Remaining: 2, Bytes: 5},
+		{Local: 1, Remote: 1, Remaining: 1, Bytes: 11},
+		{Local: 1, Remote: 1, Remaining: 1, Bytes: 11, Done: true},
+	}
+	if fmt.Sprint(reports) != fmt.Sprint(want) {
+		t.Fatalf("expected reports %v, got %v", want, reports)
+	}
+}
+
+// gatedExchange serves its blocks once |serve| is closed, ending requests
+// early when their context is done.
+type gatedExchange struct {
+	recordingExchange
+	blocks map[key.Key]*blocks.Block
+	serve  chan struct{}
+}
+
+func (e *gatedExchange) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	e.recordingExchange.GetBlocks(ctx, ks)
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		select {
+		case <-e.serve:
+		case <-ctx.Done():
+			return
+		}
+		for _, k := range ks {
+			if b, ok := e.blocks[k]; ok {
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (e *gatedExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	e.recordingExchange.GetBlock(ctx, k)
+	select {
+	case <-e.serve:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if b, ok := e.blocks[k]; ok {
+		return b, nil
+	}
+	return nil, ErrNotFound
+}
+
+func TestFetchTimeout(t *testing.T) {
+	ex := &gatedExchange{serve: make(chan struct{})}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), ex, WithFetchTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	k := blocks.NewBlock([]byte("nowhere")).Key()
+
+	if _, err := bs.GetBlock(context.Background(), k); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if r := collectResults(bs.GetBlocksWithErrors(context.Background(), []key.Key{k}))[k]; r.Err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %+v", r)
+	}
+	if got := drain(bs.GetBlocks(context.Background(), []key.Key{k})); len(got) != 0 {
+		t.Fatalf("expected no blocks, got %d", len(got))
+	}
+
+	// the caller's own deadline takes the timeout's place.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := bs.GetBlock(ctx, k); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestFetchBudget(t *testing.T) {
+	var bs []*blocks.Block
+	var ks []key.Key
+	for i := 0; i < 6; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("budgeted %d", i)))
+		bs = append(bs, b)
+		ks = append(ks, b.Key())
+	}
+	serv, _ := newServingService(t, bs...)
+	defer serv.Close()
+
+	ctx := WithFetchBudget(context.Background(), FetchBudget{Blocks: 2})
+	for _, k := range ks[:2] {
+		if _, err := serv.GetBlock(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := serv.GetBlock(ctx, ks[2]); err != ErrBudgetExceeded {
+		t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+	}
+	// blocks stored locally cost nothing.
+	if err := serv.Blockstore.Put(bs[3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serv.GetBlock(ctx, ks[3]); err != nil {
+		t.Fatal(err)
+	}
+	if spent, _ := FetchBudgetSpent(ctx); spent.Blocks != 2 {
+		t.Fatalf("expected 2 blocks spent, got %+v", spent)
+	}
+
+	// a batch is cut down to what is left, and the rest reported.
+	ctx = WithFetchBudget(context.Background(), FetchBudget{Blocks: 2})
+	rs := collectResults(serv.GetBlocksWithErrors(ctx, ks[:3]))
+	found := 0
+	for _, k := range ks[:3] {
+		switch r := rs[k]; r.Err {
+		case nil:
+			found++
+		case ErrBudgetExceeded:
+		default:
+			t.Fatalf("expected ErrBudgetExceeded, got %+v", r)
+		}
+	}
+	if found != 2 {
+		t.Fatalf("expected 2 blocks within the budget, got %d", found)
+	}
+
+	// a budget within another is held to both.
+	outer := WithFetchBudget(context.Background(), FetchBudget{Bytes: 1})
+	inner := WithFetchBudget(outer, FetchBudget{Blocks: 10})
+	if _, err := serv.GetBlock(inner, ks[4]); err != nil {
+		t.Fatal(err)
+	}
+	if got := drain(serv.GetBlocks(inner, ks[5:])); len(got) != 0 {
+		t.Fatalf("expected no blocks past the budget, got %d", len(got))
+	}
+
+	// the budget's time bounds how long fetches go on.
+	ex := &gatedExchange{serve: make(chan struct{})}
+	gated, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), ex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gated.Close()
+	ctx = WithFetchBudget(context.Background(), FetchBudget{Time: 20 * time.Millisecond})
+	if _, err := gated.GetBlock(ctx, ks[0]); err != ErrBudgetExceeded {
+		t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+	}
+	if r := collectResults(gated.GetBlocksWithErrors(ctx, ks[1:2]))[ks[1]]; r.Err != ErrBudgetExceeded {
+		t.Fatalf("expected ErrBudgetExceeded, got %+v", r)
+	}
+}
+
+func TestWantlist(t *testing.T) {
+	read := blocks.NewBlock([]byte("read"))
+	sessionRead := blocks.NewBlock([]byte("session read"))
+	ex := &gatedExchange{
+		blocks: map[key.Key]*blocks.Block{read.Key(): read, sessionRead.Key(): sessionRead},
+		serve:  make(chan struct{}),
+	}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), ex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ctx, other := TrackWants(context.Background()), TrackWants(context.Background())
+	reads := bs.GetBlocks(ctx, []key.Key{read.Key()})
+	ss := bs.NewSession(context.Background())
+	sessionReads := ss.GetBlocks(context.Background(), []key.Key{sessionRead.Key()})
+	waitUntil(t, "both wants", func() bool { return len(bs.Wantlist()) == 2 })
+
+	if got := bs.WantlistForContext(ctx); len(got) != 1 || got[0] != read.Key() {
+		t.Fatalf("expected the context's want, got %v", got)
+	}
+	if got := ss.Wantlist(); len(got) != 1 || got[0] != sessionRead.Key() {
+		t.Fatalf("expected the session's want, got %v", got)
+	}
+	if got := bs.WantlistForContext(other); len(got) != 0 {
+		t.Fatalf("expected no wants for another context, got %v", got)
+	}
+	if got := bs.WantlistForContext(context.Background()); got != nil {
+		t.Fatalf("expected nil for an untracked context, got %v", got)
+	}
+
+	close(ex.serve)
+	if n := len(drain(reads)) + len(drain(sessionReads)); n != 2 {
+		t.Fatalf("expected both blocks, got %d", n)
+	}
+	if got := bs.Wantlist(); len(got) != 0 {
+		t.Fatalf("expected the wants to end with the reads, got %v", got)
+	}
+	if got := ss.Wantlist(); len(got) != 0 {
+		t.Fatalf("expected the session's wants to end, got %v", got)
+	}
+}
+
+func TestNotFoundCache(t *testing.T) {
+	ex := &recordingExchange{}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), ex, WithNotFoundCache(time.Hour, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	b := blocks.NewBlock([]byte("optional link"))
+
+	for i := 0; i < 3; i++ {
+		if _, err := bs.GetBlock(context.Background(), b.Key()); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	if r := collectResults(bs.GetBlocksWithErrors(context.Background(), []key.Key{b.Key()}))[b.Key()]; r.Err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %+v", r)
+	}
+	if got := drain(bs.GetBlocks(context.Background(), []key.Key{b.Key()})); len(got) != 0 {
+		t.Fatalf("expected no blocks, got %d", len(got))
+	}
+	if n := len(ex.Requests()); n != 1 {
+		t.Fatalf("expected the exchange to be asked once, got %d", n)
+	}
+	if st := bs.Stats(); st.NotFoundHits != 4 || st.Misses != 5 {
+		t.Fatalf("expected 4 of 5 misses from the cache, got %+v", st)
+	}
+
+	// adding the block forgets the miss.
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.GetBlock(context.Background(), b.Key()); err != nil {
+		t.Fatalf("expected the added block, got %v", err)
+	}
+
+	// as does ForgetNotFound, for blocks stored behind the service's back.
+	other := blocks.NewBlock([]byte("stored directly"))
+	if _, err := bs.GetBlock(context.Background(), other.Key()); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := bs.Blockstore.Put(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.GetBlock(context.Background(), other.Key()); err != ErrNotFound {
+		t.Fatalf("expected the remembered miss, got %v", err)
+	}
+	bs.ForgetNotFound(other.Key())
+	if _, err := bs.GetBlock(context.Background(), other.Key()); err != nil {
+		t.Fatalf("expected the stored block, got %v", err)
+	}
+}
+
+// disconnectedExchange is a recordingExchange that fails every fetch with
+// exchange.ErrOffline.
+type disconnectedExchange struct {
+	recordingExchange
+}
+
+func (e *disconnectedExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	e.recordingExchange.GetBlock(ctx, k)
+	return nil, exchange.ErrOffline
+}
+
+func (e *disconnectedExchange) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	e.recordingExchange.GetBlocks(ctx, ks)
+	return nil, exchange.ErrOffline
+}
+
+func TestNotFoundCacheSkipsOffline(t *testing.T) {
+	ex := &disconnectedExchange{}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), ex, WithNotFoundCache(time.Hour, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	k := blocks.NewBlock([]byte("unreachable")).Key()
+
+	for i := 0; i < 2; i++ {
+		if _, err := bs.GetBlock(context.Background(), k); err != exchange.ErrOffline {
+			t.Fatalf("expected ErrOffline, got %v", err)
+		}
+	}
+	if n := len(ex.Requests()); n != 2 {
+		t.Fatalf("expected an offline miss not remembered, got %d requests", n)
+	}
+	if st := bs.Stats(); st.NotFoundHits != 0 {
+		t.Fatalf("expected no hits from the cache, got %+v", st)
+	}
+}
+
+func TestNotFoundCacheExpires(t *testing.T) {
+	ex := &recordingExchange{}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), ex, WithNotFoundCache(10*time.Millisecond, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	k := blocks.NewBlock([]byte("missing")).Key()
+
+	bs.GetBlock(context.Background(), k)
+	time.Sleep(20 * time.Millisecond)
+	bs.GetBlock(context.Background(), k)
+	if n := len(ex.Requests()); n != 2 {
+		t.Fatalf("expected the exchange to be asked again after the TTL, got %d requests", n)
+	}
+}
+
+// tracing records the calls it sees, as |name|, to |calls|.
+func tracing(name string, calls *[]string) Middleware {
+	return func(next Service) Service {
+		return &tracedService{Service: next, name: name, calls: calls}
+	}
+}
+
+type tracedService struct {
+	Service
+	name  string
+	calls *[]string
+}
+
+func (t *tracedService) GetBlock(ctx context.Context, k key.Key, opts ...GetOption) (*blocks.Block, error) {
+	*t.calls = append(*t.calls, t.name+" get")
+	return t.Service.GetBlock(ctx, k, opts...)
+}
+
+func (t *tracedService) AddBlockCtx(ctx context.Context, b *blocks.Block) (key.Key, error) {
+	*t.calls = append(*t.calls, t.name+" add")
+	return t.Service.AddBlockCtx(ctx, b)
+}
+
+var errForbidden = errors.New("forbidden")
+
+// denyDeletes refuses every delete.
+func denyDeletes(next Service) Service { return noDeletes{next} }
+
+type noDeletes struct{ Service }
+
+func (noDeletes) DeleteBlockCtx(context.Context, key.Key) error { return errForbidden }
+
+func TestWrapBlockService(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	var calls []string
+	svc := WrapBlockService(bs, tracing("outer", &calls), denyDeletes, tracing("inner", &calls))
+
+	b := blocks.NewBlock([]byte("intercepted"))
+	if _, err := svc.AddBlockCtx(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.GetBlock(context.Background(), b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if got := drain(svc.GetBlocks(context.Background(), []key.Key{b.Key()})); len(got) != 1 {
+		t.Fatalf("expected the block through GetBlocks, got %d", len(got))
+	}
+	want := []string{"outer add", "inner add", "outer get", "inner get"}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("expected calls %v, got %v", want, calls)
+	}
+
+	if err := svc.DeleteBlockCtx(context.Background(), b.Key()); err != errForbidden {
+		t.Fatalf("expected the middleware's error, got %v", err)
+	}
+	if has, _ := bs.Blockstore.Has(b.Key()); !has {
+		t.Fatal("expected the refused delete not to reach the service")
+	}
+	if svc := WrapBlockService(bs); svc != Service(bs) {
+		t.Fatal("expected the service itself without middleware")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	shared := blocks.NewBlock([]byte("shared"))
+	private := blocks.NewBlock([]byte("alice's"))
+	for _, b := range []*blocks.Block{shared, private} {
+		if _, err := bs.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// everyone reads the shared block, alice reads hers, and only alice
+	// writes.
+	svc := WrapBlockService(bs, Authorize(AuthorizerFunc(func(_ context.Context, caller string, op Operation, k key.Key) bool {
+		switch op {
+		case OpGetBlock, OpGetBlocks:
+			return k == shared.Key() || caller == "alice"
+		}
+		return caller == "alice"
+	})))
+	alice := WithCaller(context.Background(), "alice")
+	bob := WithCaller(context.Background(), "bob")
+
+	if caller, ok := CallerFrom(alice); !ok || caller != "alice" {
+		t.Fatalf("expected alice, got %q, %v", caller, ok)
+	}
+	if _, err := svc.GetBlock(bob, shared.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.GetBlock(bob, private.Key()); err != ErrAccessDenied {
+		t.Fatalf("expected ErrAccessDenied, got %v", err)
+	}
+	if _, err := svc.GetBlock(alice, private.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if got := drain(svc.GetBlocks(bob, []key.Key{shared.Key(), private.Key()})); len(got) != 1 || got[0].Key() != shared.Key() {
+		t.Fatalf("expected only the shared block, got %d", len(got))
+	}
+	if _, err := svc.AddBlockCtx(context.Background(), blocks.NewBlock([]byte("anonymous"))); err != ErrAccessDenied {
+		t.Fatalf("expected ErrAccessDenied without a caller, got %v", err)
+	}
+	if err := svc.DeleteBlockCtx(bob, shared.Key()); err != ErrAccessDenied {
+		t.Fatalf("expected ErrAccessDenied, got %v", err)
+	}
+	if err := svc.DeleteBlockCtx(alice, shared.Key()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyLocal(t *testing.T) {
+	d := dssync.MutexWrap(ds.NewMapDatastore())
+	good := blocks.NewBlock([]byte("good data"))
+	if err := d.Put(blockstore.BlockPrefix.Child(good.Key().DsKey()), []byte("bit rot")); err != nil {
+		t.Fatal(err)
+	}
+	bstore := blockstore.NewBlockstore(d)
+	rem := mock.New(mock.Config{})
+
+	// trusted, the corrupt copy is served as stored.
+	fast, err := New(bstore, rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	if b, err := fast.GetBlock(context.Background(), good.Key()); err != nil || string(b.Data) != "bit rot" {
+		t.Fatalf("expected the stored copy, got %v, %v", b, err)
+	}
+
+	paranoid, err := New(bstore, rem, WithVerifyMode(VerifyLocal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer paranoid.Close()
+	// a verifier that would take anything is not trusted either.
+	paranoid.SetBlockVerifier(TrustExchange)
+	if b, err := paranoid.GetBlock(context.Background(), good.Key()); err == nil {
+		t.Fatalf("corrupt block served as %q", b.Data)
+	}
+	if _, ok := paranoid.GetBlockAsync(good.Key()); ok {
+		t.Fatal("corrupt block served by GetBlockAsync")
+	}
+	forged, err := blocks.NewBlockWithKey([]byte("forged"), good.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rem.Add(forged)
+	if b, err := paranoid.GetBlock(context.Background(), good.Key()); err == nil {
+		t.Fatalf("forged block served as %q", b.Data)
+	}
+
+	rem.Add(good)
+	if b, err := paranoid.GetBlock(context.Background(), good.Key()); err != nil || string(b.Data) != "good data" {
+		t.Fatalf("expected the exchange's copy, got %v, %v", b, err)
+	}
+	if st := paranoid.Stats(); st.Rejected != 5 {
+		t.Fatalf("expected 5 rejected blocks, got %d", st.Rejected)
+	}
+	// the local copy is left, unlike with SetCorruptionRepair.
+	if local, err := bstore.Get(good.Key()); err != nil || string(local.Data) != "bit rot" {
+		t.Fatalf("expected the local copy left, got %v, %v", local, err)
+	}
+}
+
+// ledgerExchange is a recordingExchange accounting for one peer.
+type ledgerExchange struct {
+	*recordingExchange
+	l exchange.Ledger
+}
+
+func (x *ledgerExchange) Ledger(peer string) (exchange.Ledger, bool) {
+	return x.l, peer == x.l.Peer
+}
+
+func (x *ledgerExchange) Ledgers() []exchange.Ledger { return []exchange.Ledger{x.l} }
+
+func TestLedgers(t *testing.T) {
+	plain, _ := newRecordingService(t)
+	defer plain.Close()
+	if _, err := plain.Ledger("QmPeer"); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+	if _, err := plain.Ledgers(); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+
+	want := exchange.Ledger{Peer: "QmPeer", BytesSent: 100, BlocksSent: 2}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), &ledgerExchange{&recordingExchange{}, want})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	if l, err := bs.Ledger("QmPeer"); err != nil || l != want {
+		t.Fatalf("expected %+v, got %+v, %v", want, l, err)
+	}
+	if l, err := bs.Ledger("QmOther"); err != nil || l != (exchange.Ledger{Peer: "QmOther"}) {
+		t.Fatalf("expected an empty ledger, got %+v, %v", l, err)
+	}
+	if ls, err := bs.Ledgers(); err != nil || len(ls) != 1 || ls[0] != want {
+		t.Fatalf("expected the peer's ledger, got %+v, %v", ls, err)
+	}
+}
+
+func TestReprovider(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	var stored []*blocks.Block
+	for _, s := range []string{"stale a", "stale b", "stale c"} {
+		b := blocks.NewBlock([]byte(s))
+		if err := bstore.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, b)
+	}
+	pinner, err := pin.New(context.Background(), dssync.MutexWrap(ds.NewMapDatastore()), bstore, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pinner.Pin(context.Background(), stored[1].Key(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	rem := &announceExchange{release: make(chan error)}
+	close(rem.release)
+	bs, err := New(bstore, rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	if _, err := bs.Reprovide(context.Background()); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported before EnableReprovider, got %v", err)
+	}
+	if err := bs.EnableReprovider(0, ReprovideAll); err == nil {
+		t.Fatal("expected a zero interval to be refused")
+	}
+	if err := bs.EnableReprovider(time.Hour, ReprovidePinned(pinner)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bs.Reprovide(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected the pinned block reprovided, got %d, %v", n, err)
+	}
+	waitUntil(t, "the pinned block to be announced", func() bool {
+		a := rem.Announced()
+		return len(a) == 1 && a[0] == stored[1].Key()
+	})
+
+	all := &announceExchange{release: make(chan error)}
+	close(all.release)
+	sweeping, err := New(bstore, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sweeping.Close()
+	if err := sweeping.EnableReprovider(time.Millisecond, ReprovideAll); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "every block to be reprovided", func() bool {
+		seen := make(map[key.Key]bool)
+		for _, k := range all.Announced() {
+			seen[k] = true
+		}
+		return len(seen) == len(stored) && sweeping.Stats().Reprovided >= uint64(len(stored))
+	})
+}
+
+func TestLifecycle(t *testing.T) {
+	bs, _ := newRecordingService(t)
+	if st := bs.State(); st != StateNew {
+		t.Fatalf("expected a new service, got %s", st)
+	}
+	b := blocks.NewBlock([]byte("alive"))
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if st := bs.State(); st != StateRunning {
+		t.Fatalf("expected a running service, got %s", st)
+	}
+	select {
+	case <-bs.Done():
+		t.Fatal("Done closed before Close")
+	default:
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- bs.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := bs.CloseWithContext(context.Background()); n != 0 || err != nil {
+		t.Fatalf("expected closing again to do nothing, got %d, %v", n, err)
+	}
+	if st := bs.State(); st != StateClosed {
+		t.Fatalf("expected a closed service, got %s", st)
+	}
+	select {
+	case <-bs.Done():
+	default:
+		t.Fatal("Done not closed after Close")
+	}
+
+	ctx := context.Background()
+	if _, err := bs.GetBlock(ctx, b.Key()); err != ErrClosed {
+		t.Fatalf("GetBlock: expected ErrClosed, got %v", err)
+	}
+	if got := drain(bs.GetBlocks(ctx, []key.Key{b.Key()})); len(got) != 0 {
+		t.Fatalf("GetBlocks: expected no blocks, got %d", len(got))
+	}
+	if _, err := bs.AddBlock(blocks.NewBlock([]byte("late"))); err != ErrClosed {
+		t.Fatalf("AddBlock: expected ErrClosed, got %v", err)
+	}
+	if err := <-bs.AddBlockAsync(blocks.NewBlock([]byte("late"))); err != ErrClosed {
+		t.Fatalf("AddBlockAsync: expected ErrClosed, got %v", err)
+	}
+	if err := bs.DeleteBlock(b.Key()); err != ErrClosed {
+		t.Fatalf("DeleteBlock: expected ErrClosed, got %v", err)
+	}
+}
+
+func TestWarmupTopReads(t *testing.T) {
+	bs := newTestService(t)
+	defer bs.Close()
+	if _, err := bs.WarmupTopReads(context.Background(), 1); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+	if err := bs.EnableAccessCounting(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock([]byte("popular"))
+	if _, err := bs.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.GetBlock(context.Background(), b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bs.WarmupTopReads(context.Background(), 10); err != nil || n != 1 {
+		t.Fatalf("expected the read block warmed, got %d, %v", n, err)
+	}
+	missing := blocks.NewBlock([]byte("never stored")).Key()
+	if n, err := bs.Warmup(context.Background(), []key.Key{b.Key(), missing}); err != nil || n != 1 {
+		t.Fatalf("expected one stored block, got %d, %v", n, err)
+	}
+}
+
+func TestGetBlockOptions(t *testing.T) {
+	local := blocks.NewBlock([]byte("stored"))
+	remote := blocks.NewBlock([]byte("fetched, and rather long"))
+	bs, rem := newServingService(t, local, remote)
+	defer bs.Close()
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := bs.GetBlock(ctx, remote.Key(), LocalOnly()); err != ErrNotFound {
+		t.Fatalf("LocalOnly: expected ErrNotFound, got %v", err)
+	}
+	if n := len(rem.Requests()); n != 0 {
+		t.Fatalf("LocalOnly: expected the exchange not to be asked, got %d requests", n)
+	}
+	if _, err := bs.GetBlock(ctx, local.Key(), RemoteOnly()); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := rem.Requests(); len(reqs) != 1 || reqs[0][0] != local.Key() {
+		t.Fatalf("RemoteOnly: expected the exchange to be asked for the stored block, got %v", reqs)
+	}
+	if _, err := bs.GetBlock(ctx, local.Key(), LocalOnly(), RemoteOnly()); err != ErrConflictingOptions {
+		t.Fatalf("expected ErrConflictingOptions, got %v", err)
+	}
+
+	if _, err := bs.GetBlock(ctx, local.Key(), MaxSize(len(local.Data)-1)); err != blocks.ErrBlockTooLarge {
+		t.Fatalf("MaxSize: expected ErrBlockTooLarge for a stored block, got %v", err)
+	}
+	if _, err := bs.GetBlock(ctx, local.Key(), MaxSize(len(local.Data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.GetBlock(ctx, remote.Key(), MaxSize(len(local.Data))); err != blocks.ErrBlockTooLarge {
+		t.Fatalf("MaxSize: expected ErrBlockTooLarge for a fetched block, got %v", err)
+	}
+	if has, _ := bs.Blockstore.Has(remote.Key()); has {
+		t.Fatal("expected a fetched block over MaxSize not to be stored")
+	}
+}
+
+func TestGetBlockAllowStale(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs := newExpiringService(t, bstore, time.Hour)
+	defer bs.Close()
+
+	b := blocks.NewBlock([]byte("stale"))
+	if _, err := bs.PutWithTTL(b, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := bs.GetBlock(context.Background(), b.Key(), AllowStale()); err != nil {
+		t.Fatalf("expected the expired block to be served, got %v", err)
+	}
+	if _, err := bs.GetBlock(context.Background(), b.Key()); err == nil {
+		t.Fatal("expected the expired block to be missing without AllowStale")
+	}
+}
+
+func TestGetBlockPriority(t *testing.T) {
+	normal, high := blocks.NewBlock([]byte("normal")), blocks.NewBlock([]byte("high"))
+	rem := &servingExchange{blocks: map[key.Key]*blocks.Block{normal.Key(): normal, high.Key(): high}}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithMaxConcurrentFetches(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	waiting := func() int {
+		bs.fetches.mu.Lock()
+		defer bs.fetches.mu.Unlock()
+		return bs.fetches.waiters.Len()
+	}
+
+	bs.fetches.acquire(context.Background(), 1)
+	var wg sync.WaitGroup
+	get := func(k key.Key, opts ...GetOption) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := bs.GetBlock(context.Background(), k, opts...); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	get(normal.Key())
+	waitUntil(t, "the first fetch to queue", func() bool { return waiting() == 1 })
+	get(high.Key(), Priority(worker.PriorityHigh))
+	waitUntil(t, "the second fetch to queue", func() bool { return waiting() == 2 })
+	bs.fetches.release(1)
+	wg.Wait()
+	if reqs := rem.Requests(); len(reqs) != 2 || reqs[0][0] != high.Key() {
+		t.Fatalf("expected the high priority fetch to go first, got %v", reqs)
+	}
+
+	// a low priority fetch waits for the others, as a prefetch does.
+	low := blocks.NewBlock([]byte("low"))
+	rem.blocks[low.Key()] = low
+	bs.interactive.begin()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := bs.GetBlock(ctx, low.Key(), Priority(worker.PriorityLow)); err != context.DeadlineExceeded {
+		t.Fatalf("expected the low priority fetch to wait, got %v", err)
+	}
+	bs.interactive.end()
+	if _, err := bs.GetBlock(context.Background(), low.Key(), Priority(worker.PriorityLow)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reportingExchange is a servingExchange reporting |peer| as the provenance
+// of every block it serves.
+type reportingExchange struct {
+	servingExchange
+	peer string
+}
+
+func (e *reportingExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	b, err := e.servingExchange.GetBlock(ctx, k)
+	if err == nil {
+		exchange.ReportProvenance(ctx, k, exchange.Provenance{Exchange: "test", Peer: e.peer})
+	}
+	return b, err
+}
+
+func TestGetBlockWithMeta(t *testing.T) {
+	local, remote := blocks.NewBlock([]byte("stored")), blocks.NewBlock([]byte("fetched"))
+	rem := &reportingExchange{servingExchange{blocks: map[key.Key]*blocks.Block{remote.Key(): remote}}, "peer-a"}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	if _, err := bs.AddBlock(local); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	m, err := bs.GetBlockWithMeta(ctx, local.Key())
+	if err != nil || m.Source != SourceLocal || m.Key() != local.Key() {
+		t.Fatalf("expected a local block, got %v, %v", m.Source, err)
+	}
+	m, err = bs.GetBlockWithMeta(ctx, remote.Key(), RemoteOnly())
+	if err != nil || m.Source != SourceExchange || m.Key() != remote.Key() {
+		t.Fatalf("expected a fetched block, got %v, %v", m.Source, err)
+	}
+	if want := (exchange.Provenance{Exchange: "test", Peer: "peer-a"}); m.Provenance != want {
+		t.Fatalf("expected provenance %v, got %v", want, m.Provenance)
+	}
+
+	ss := bs.NewSession(ctx)
+	if m, err = ss.GetBlockWithMeta(ctx, local.Key()); err != nil || m.Source != SourceLocal {
+		t.Fatalf("expected a local block, got %v, %v", m.Source, err)
+	}
+	if m, err = ss.GetBlockWithMeta(ctx, local.Key()); err != nil || m.Source != SourceSession {
+		t.Fatalf("expected the session's copy, got %v, %v", m.Source, err)
+	}
+}
+
+// gatedPutBlockstore counts its Puts, each of which waits for |gate|.
+type gatedPutBlockstore struct {
+	blockstore.Blockstore
+	gate chan struct{}
+	puts int32
+}
+
+func (g *gatedPutBlockstore) Put(b *blocks.Block) error {
+	atomic.AddInt32(&g.puts, 1)
+	<-g.gate
+	return g.Blockstore.Put(b)
+}
+
+func TestConcurrentAddsCoalesce(t *testing.T) {
+	bstore := &gatedPutBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), gate: make(chan struct{})}
+	rem := &announceExchange{release: make(chan error, 8)}
+	bs, err := New(bstore, rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	b := blocks.NewBlock([]byte("added at once"))
+	var wg sync.WaitGroup
+	add := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := bs.AddBlock(b); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	add()
+	waitUntil(t, "the first put", func() bool { return atomic.LoadInt32(&bstore.puts) == 1 })
+	for i := 0; i < 4; i++ {
+		add()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(bstore.gate)
+	wg.Wait()
+	if n := atomic.LoadInt32(&bstore.puts); n != 1 {
+		t.Fatalf("expected one write, got %d", n)
+	}
+
+	for i := 0; i < cap(rem.release); i++ {
+		rem.release <- nil
+	}
+	waitUntil(t, "the announcement", func() bool { return len(rem.Announced()) > 0 })
+	time.Sleep(20 * time.Millisecond)
+	if n := len(rem.Announced()); n != 1 {
+		t.Fatalf("expected one announcement, got %d", n)
+	}
+}
+
+// releasedExchange is a servingExchange whose GetBlock calls wait for
+// |release|, or their context.
+type releasedExchange struct {
+	servingExchange
+	release chan struct{}
+	// aborted, if set, is returned instead of the error of a done context,
+	// as by exchanges that report requests ended early their own way.
+	aborted error
+}
+
+func (e *releasedExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	e.recordingExchange.GetBlock(ctx, k)
+	select {
+	case <-e.release:
+		return e.blocks[k], nil
+	case <-ctx.Done():
+		if e.aborted != nil {
+			return nil, e.aborted
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func TestCoalescedGetsOutliveTheFirst(t *testing.T) {
+	b := blocks.NewBlock([]byte("wanted at once"))
+	rem := &releasedExchange{
+		servingExchange: servingExchange{blocks: map[key.Key]*blocks.Block{b.Key(): b}},
+		release:         make(chan struct{}),
+		aborted:         errors.New("request aborted"),
+	}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go bs.GetBlock(ctx, b.Key())
+	waitUntil(t, "the first fetch", func() bool { return len(rem.Requests()) == 1 })
+	second := make(chan error)
+	go func() {
+		_, err := bs.GetBlock(context.Background(), b.Key())
+		second <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	waitUntil(t, "the fetch again", func() bool { return len(rem.Requests()) == 2 })
+	close(rem.release)
+	if err := <-second; err != nil {
+		t.Fatalf("expected the read left waiting to get the block, got %v", err)
+	}
+}
+
+func TestConcurrentGetsCoalesce(t *testing.T) {
+	b := blocks.NewBlock([]byte("wanted at once"))
+	rem := &releasedExchange{
+		servingExchange: servingExchange{blocks: map[key.Key]*blocks.Block{b.Key(): b}},
+		release:         make(chan struct{}),
+	}
+	bs, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// the first read gives up; those waiting on it fetch again.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := bs.GetBlock(ctx, b.Key())
+		first <- err
+	}()
+	waitUntil(t, "the first fetch", func() bool { return len(rem.Requests()) == 1 })
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := bs.GetBlock(context.Background(), b.Key()); err != nil || got.Key() != b.Key() {
+				t.Errorf("expected the block, got %v", err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(rem.Requests()); n != 1 {
+		t.Fatalf("expected one want for concurrent reads, got %d", n)
+	}
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("expected the first read to be cancelled, got %v", err)
+	}
+	waitUntil(t, "the fetch again", func() bool { return len(rem.Requests()) == 2 })
+	close(rem.release)
+	wg.Wait()
+	if n := len(rem.Requests()); n != 2 {
+		t.Fatalf("expected the reads left waiting to fetch once more, got %d wants", n)
+	}
+}
+
+var errDisk = errors.New("disk failing")
+
+// failingBlockstore fails its Gets with errDisk while |failing| is set.
+type failingBlockstore struct {
+	blockstore.Blockstore
+	failing int32
+	gets    int32
+}
+
+func (f *failingBlockstore) Get(k key.Key) (*blocks.Block, error) {
+	atomic.AddInt32(&f.gets, 1)
+	if atomic.LoadInt32(&f.failing) != 0 {
+		return nil, errDisk
+	}
+	return f.Blockstore.Get(k)
+}
+
+func TestDiskBreaker(t *testing.T) {
+	stored, remote := blocks.NewBlock([]byte("on a failing disk")), blocks.NewBlock([]byte("on the network"))
+	bstore := &failingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	if err := bstore.Put(stored); err != nil {
+		t.Fatal(err)
+	}
+	rem := &servingExchange{blocks: map[key.Key]*blocks.Block{remote.Key(): remote}}
+	bs, err := New(bstore, rem, WithDiskBreaker(DiskBreaker{Window: 4, MaxBad: 2, Cooldown: 20 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ctx := context.Background()
+
+	atomic.StoreInt32(&bstore.failing, 1)
+	for i := 0; i < 2; i++ {
+		bs.GetBlock(ctx, stored.Key())
+	}
+	if st := bs.Stats(); st.DiskBreaker != BreakerOpen || st.DiskBreakerTrips != 1 {
+		t.Fatalf("expected the breaker open after 2 failures, got %s, %d trips", st.DiskBreaker, st.DiskBreakerTrips)
+	}
+	gets := atomic.LoadInt32(&bstore.gets)
+	if _, err := bs.GetBlock(ctx, stored.Key()); err != ErrDiskUnhealthy {
+		t.Fatalf("expected ErrDiskUnhealthy, got %v", err)
+	}
+	if _, err := bs.AddBlock(blocks.NewBlock([]byte("not written"))); err != ErrDiskUnhealthy {
+		t.Fatalf("expected writes to fail fast, got %v", err)
+	}
+	if n := atomic.LoadInt32(&bstore.gets); n != gets {
+		t.Fatal("expected the open breaker to keep reads off the blockstore")
+	}
+
+	// after the cooldown, one good read closes it.
+	atomic.StoreInt32(&bstore.failing, 0)
+	time.Sleep(30 * time.Millisecond)
+	if _, err := bs.GetBlock(ctx, stored.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if st := bs.Stats(); st.DiskBreaker != BreakerClosed {
+		t.Fatalf("expected the breaker closed again, got %s", st.DiskBreaker)
+	}
+}
+
+func TestDiskBreakerPrefersExchange(t *testing.T) {
+	b := blocks.NewBlock([]byte("stored and served"))
+	bstore := &failingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), failing: 1}
+	if err := bstore.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	rem := &servingExchange{blocks: map[key.Key]*blocks.Block{b.Key(): b}}
+	bs, err := New(bstore, rem, WithDiskBreaker(DiskBreaker{Window: 1, MaxBad: 1, Cooldown: time.Hour, PreferExchange: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	bs.GetBlock(context.Background(), b.Key())
+	if got, err := bs.GetBlock(context.Background(), b.Key()); err != nil || got.Key() != b.Key() {
+		t.Fatalf("expected the exchange's copy while the breaker is open, got %v", err)
+	}
+	if n := len(rem.Requests()); n != 1 {
+		t.Fatalf("expected 1 exchange request, got %d", n)
+	}
+}
+
+type panickingBlockstore struct {
+	blockstore.Blockstore
+}
+
+func (p *panickingBlockstore) Get(k key.Key) (*blocks.Block, error) { panic("disk on fire") }
+func (p *panickingBlockstore) Put(b *blocks.Block) error            { panic("disk on fire") }
+
+type panickingExchange struct {
+	servingExchange
+}
+
+func (e *panickingExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	panic("network on fire")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	b := blocks.NewBlock([]byte("on a burning disk"))
+	bstore := &panickingBlockstore{blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	if err := bstore.Blockstore.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := New(bstore, &panickingExchange{},
+		WithPanicRecovery(PanicPolicy{TripBreaker: true}),
+		WithDiskBreaker(DiskBreaker{Window: 10, Cooldown: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	_, err = bs.GetBlock(context.Background(), b.Key())
+	var pe *BackendPanicError
+	if !errors.As(err, &pe) || !errors.Is(err, ErrBackendPanic) {
+		t.Fatalf("expected a BackendPanicError, got %v", err)
+	}
+	if pe.Op != "blockstore read" || pe.Value != "disk on fire" || !bytes.Contains(pe.Stack, []byte("panickingBlockstore")) {
+		t.Fatalf("unexpected panic error %q, stack:\n%s", pe, pe.Stack)
+	}
+	// one panic is enough to open the breaker.
+	if st := bs.Stats(); st.DiskBreaker != BreakerOpen || st.DiskBreakerTrips != 1 || st.Panics != 1 {
+		t.Fatalf("expected the breaker tripped by the panic, got %s, %d trips, %d panics", st.DiskBreaker, st.DiskBreakerTrips, st.Panics)
+	}
+	if _, err := bs.AddBlock(blocks.NewBlock([]byte("not written"))); err != ErrDiskUnhealthy {
+		t.Fatalf("expected ErrDiskUnhealthy, got %v", err)
+	}
+
+	// exchange panics are recovered too.
+	_, err = bs.GetBlock(context.Background(), b.Key(), RemoteOnly())
+	if !errors.As(err, &pe) || pe.Op != "exchange GetBlock" {
+		t.Fatalf("expected the exchange's panic, got %v", err)
+	}
+	if n := bs.Stats().Panics; n != 2 {
+		t.Fatalf("expected 2 panics, got %d", n)
+	}
+}
+
+func TestPanicRecoveryWrites(t *testing.T) {
+	bstore := &panickingBlockstore{blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	bs, err := New(bstore, nil, WithPanicRecovery(PanicPolicy{}), WithDiskBreaker(DiskBreaker{Window: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	_, err = bs.AddBlock(blocks.NewBlock([]byte("on a burning disk")))
+	var pe *BackendPanicError
+	if !errors.As(err, &pe) || pe.Op != "blockstore write" {
+		t.Fatalf("expected the write's panic, got %v", err)
+	}
+	// without TripBreaker, it is one bad operation of the window.
+	if st := bs.Stats(); st.DiskBreaker != BreakerClosed || st.Panics != 1 {
+		t.Fatalf("expected the breaker closed and 1 panic, got %s and %d", st.DiskBreaker, st.Panics)
+	}
+}
+
+func TestSync(t *testing.T) {
+	stored := blocks.NewBlock([]byte("already here"))
+	remote := blocks.NewBlock([]byte("on the exchange"))
+	gone := blocks.NewBlock([]byte("nowhere")).Key()
+	serv, rem := newServingService(t, remote)
+	if _, err := serv.AddBlock(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := serv.Sync(context.Background(), []key.Key{stored.Key(), remote.Key(), gone, remote.Key()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Present != 1 || rep.Fetched != 1 || rep.FetchedBytes != uint64(len(remote.Data)) {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if len(rep.Failed) != 1 || rep.Failed[gone] != ErrNotFound {
+		t.Fatalf("expected %s to fail with ErrNotFound, got %v", gone, rep.Failed)
+	}
+	if has, _ := serv.Blockstore.Has(remote.Key()); !has {
+		t.Fatal("fetched block not stored")
+	}
+	// only the missing keys reach the exchange.
+	for _, req := range rem.Requests() {
+		for _, k := range req {
+			if k == stored.Key() {
+				t.Fatal("stored block requested from the exchange")
+			}
+		}
+	}
+
+	rep, err = serv.Sync(context.Background(), []key.Key{remote.Key()})
+	if err != nil || rep.Present != 1 || rep.Fetched != 0 {
+		t.Fatalf("expected the synced block present, got %+v, %v", rep, err)
+	}
+}
+
+type logEntry struct {
+	level  LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, fields ...Field) {
+	e := logEntry{level: level, msg: msg, fields: make(map[string]interface{})}
+	for _, f := range fields {
+		e.fields[f.Key] = f.Value
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, e)
+}
+
+func (l *recordingLogger) Entries() []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]logEntry(nil), l.entries...)
+}
+
+func TestLogger(t *testing.T) {
+	stored := blocks.NewBlock([]byte("logged locally"))
+	remote := blocks.NewBlock([]byte("logged from the exchange"))
+	rem := &servingExchange{blocks: map[key.Key]*blocks.Block{remote.Key(): remote}}
+	logger := &recordingLogger{}
+	serv, err := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithLogger(logger, LevelDebug))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serv.Close()
+	if _, err := serv.AddBlock(stored); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []key.Key{stored.Key(), remote.Key()} {
+		if _, err := serv.GetBlock(context.Background(), k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries := logger.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", entries)
+	}
+	for i, want := range []struct {
+		op     Operation
+		k      key.Key
+		size   int
+		source interface{}
+	}{
+		{OpAddBlock, stored.Key(), len(stored.Data), nil},
+		{OpGetBlock, stored.Key(), len(stored.Data), "local"},
+		{OpGetBlock, remote.Key(), len(remote.Data), "exchange"},
+	} {
+		e := entries[i]
+		if e.level != LevelDebug || e.fields["op"] != want.op || e.fields["key"] != want.k ||
+			e.fields["size"] != want.size || e.fields["source"] != want.source {
+			t.Fatalf("unexpected entry %d: %+v", i, e)
+		}
+		if _, ok := e.fields["duration"].(time.Duration); !ok {
+			t.Fatalf("entry %d has no duration: %+v", i, e)
+		}
+	}
+
+	// above debug, operations are not logged.
+	quiet := &recordingLogger{}
+	serv, err = New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), rem, WithLogger(quiet, LevelWarn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serv.Close()
+	if _, err := serv.GetBlock(context.Background(), remote.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(quiet.Entries()); n != 0 {
+		t.Fatalf("expected nothing logged, got %v", quiet.Entries())
+	}
+}
+
+// pingExchange is a recordingExchange whose Ping returns |err|.
+type pingExchange struct {
+	recordingExchange
+	err error
+}
+
+func (e *pingExchange) Ping(context.Context) error { return e.err }
+
+func TestHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	rem := &pingExchange{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	serv, err := New(bstore, rem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serv.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bstore.AllKeys(ctx, dsq.Query{}); err != nil {
+		t.Fatal(err)
+	} else if _, ok := <-n; ok {
+		t.Fatal("the probe block was left in the blockstore")
+	}
+
+	rem.err = errors.New("unreachable")
+	if err := serv.HealthCheck(ctx); err == nil {
+		t.Fatal("healthy with the exchange failing")
+	}
+	// an offline service does not need the exchange.
+	serv.SetOnline(false)
+	if err := serv.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	serv.Close()
+	if err := serv.HealthCheck(ctx); err != ErrClosed {
+		t.Fatalf("closed service: %v", err)
+	}
+
+	ro, err := New(bstore, rem, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	ro.SetOnline(false)
+	if err := ro.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	parts := []string{"hello ", "", "block ", "world"}
+	var bs []*blocks.Block
+	var ks []key.Key
+	for _, p := range parts {
+		b := blocks.NewBlock([]byte(p))
+		bs = append(bs, b)
+		ks = append(ks, b.Key())
+	}
+	serv, _ := newServingService(t, bs...)
+	defer serv.Close()
+
+	r := serv.NewReader(context.Background(), ks, ReaderOptions{Readahead: 1})
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello block world" {
+		t.Fatalf("read %q", data)
+	}
+
+	for _, c := range []struct {
+		offset int64
+		whence int
+		want   string
+	}{
+		{6, io.SeekStart, "block world"},
+		{-5, io.SeekEnd, "world"},
+		{-13, io.SeekCurrent, "o block world"},
+		{100, io.SeekStart, ""},
+	} {
+		if _, err := r.Seek(c.offset, c.whence); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != c.want {
+			t.Fatalf("seek %d, %d: read %q", c.offset, c.whence, data)
+		}
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err != ErrSeek {
+		t.Fatalf("seeking before the start: %v", err)
+	}
+}
+
+func TestReaderSizes(t *testing.T) {
+	a, b := blocks.NewBlock([]byte("aaaa")), blocks.NewBlock([]byte("bbbb"))
+	serv, rem := newServingService(t, a, b)
+	defer serv.Close()
+
+	// with the sizes known, seeking into |b| needs nothing of |a|.
+	r := serv.NewReader(context.Background(), []key.Key{a.Key(), b.Key()}, ReaderOptions{Readahead: -1, Sizes: []int64{4, 4}})
+	defer r.Close()
+	if _, err := r.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil || string(data) != "bb" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	for _, req := range rem.Requests() {
+		for _, k := range req {
+			if k == a.Key() {
+				t.Fatal("fetched a block it skipped")
+			}
+		}
+	}
+
+	r = serv.NewReader(context.Background(), []key.Key{a.Key()}, ReaderOptions{Sizes: []int64{3}})
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err != ErrBlockSize {
+		t.Fatalf("reading a block of the wrong size: %v", err)
+	}
+
+	missing := blocks.NewBlock([]byte("missing"))
+	r = serv.NewReader(context.Background(), []key.Key{a.Key(), missing.Key()}, ReaderOptions{})
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("read a missing block")
+	}
+}
+
+func TestGetBlocksSlowConsumer(t *testing.T) {
+	local, remote := blocks.NewBlock([]byte("local")), blocks.NewBlock([]byte("remote"))
+	bs, _ := newServingService(t, remote)
+	defer bs.Close()
+	if err := bs.Blockstore.Put(local); err != nil {
+		t.Fatal(err)
+	}
+	ks := []key.Key{local.Key(), remote.Key()}
+
+	// a buffered channel takes both without the caller.
+	ch := bs.GetBlocksWith(context.Background(), ks, GetBlocksOptions{Buffer: 2})
+	deadline := time.Now().Add(time.Second)
+	for len(ch) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("blocks never buffered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := drain(ch); len(got) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", len(got))
+	}
+	// a negative buffer is none.
+	if got := drain(bs.GetBlocksWith(context.Background(), ks, GetBlocksOptions{Buffer: -1})); len(got) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", len(got))
+	}
+
+	var stalls int32
+	ch = bs.GetBlocksWith(context.Background(), ks, GetBlocksOptions{
+		SendTimeout: 5 * time.Millisecond,
+		Stalled:     func() { atomic.AddInt32(&stalls, 1) },
+	})
+	deadline = time.Now().Add(time.Second)
+	for bs.Stats().Undelivered < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("blocks never given up on")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := drain(ch); len(got) != 0 {
+		t.Fatalf("expected the blocks left out, got %d", len(got))
+	}
+	if n := atomic.LoadInt32(&stalls); n != 1 {
+		t.Fatalf("expected one stall reported, got %d", n)
+	}
+	if has, err := bs.Blockstore.Has(remote.Key()); err != nil || !has {
+		t.Fatal("the fetched block left out was not stored")
+	}
+}
+
+func TestGetBlocksAdaptiveWindow(t *testing.T) {
+	var bs []*blocks.Block
+	var ks []key.Key
+	for i := 0; i < 50; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("adaptive %d", i)))
+		bs = append(bs, b)
+		ks = append(ks, b.Key())
+	}
+	serv, rem := newServingService(t, bs...)
+	defer serv.Close()
+
+	asked := func() int {
+		n := 0
+		for _, req := range rem.Requests() {
+			n += len(req)
+		}
+		return n
+	}
+	ch := serv.GetBlocksWith(context.Background(), ks, GetBlocksOptions{Misses: MissesAdaptive, MissBatch: 4})
+	taken := 0
+	for range ch {
+		taken++
+		// a caller slower than the exchange keeps few wants open.
+		if open := asked() - taken; open > 8 {
+			t.Fatalf("%d wants open after %d blocks taken", open, taken)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if taken != len(ks) {
+		t.Fatalf("expected %d blocks, got %d", len(ks), taken)
+	}
+}
+
+func TestWantWindow(t *testing.T) {
+	var asked []key.Key
+	w := newWantWindow(2, func(ks []key.Key) { asked = append(asked, ks...) })
+	var ks []key.Key
+	for i := 0; i < 10; i++ {
+		ks = append(ks, blocks.NewBlock([]byte(fmt.Sprint(i))).Key())
+	}
+	w.add(ks)
+	if len(asked) != 2 {
+		t.Fatalf("expected 2 keys asked for, got %d", len(asked))
+	}
+	// taken at once: the window widens.
+	w.received(ks[0])
+	w.taken(ks[0], false)
+	w.release()
+	if len(asked) != 4 {
+		t.Fatalf("expected 4 keys asked for, got %d", len(asked))
+	}
+	// a stream ending without a block closes its want.
+	w.ended(ks[1:2])
+	w.release()
+	if len(asked) != 5 {
+		t.Fatalf("expected 5 keys asked for, got %d", len(asked))
+	}
+	// a caller slower than the exchange narrows it.
+	w.latency = time.Millisecond
+	w.lastTaken = time.Now().Add(-time.Second)
+	for _, k := range asked[2:] {
+		w.received(k)
+	}
+	w.taken(asked[2], true)
+	if w.size != 1 {
+		t.Fatalf("expected the window narrowed to 1, got %d", w.size)
+	}
+}
@@ -0,0 +1,199 @@
+package blockservice
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrBudgetExceeded is returned by reads whose remote fetches the
+// FetchBudget of their context cut short. See WithFetchBudget.
+var ErrBudgetExceeded = errors.New("blockservice: fetch budget exceeded")
+
+// FetchBudget bounds the remote fetching done for a context. A zero field
+// is no bound.
+type FetchBudget struct {
+	// Blocks is how many blocks may be asked of the exchange.
+	Blocks int
+	// Bytes is how much block data may be received from it. Fetches under
+	// way when it runs out may take it past.
+	Bytes int64
+	// Time is how long after the first remote fetch they may go on.
+	Time time.Duration
+}
+
+type budgetKey struct{}
+
+// fetchBudget is the FetchBudget of a context, and what was spent of it.
+type fetchBudget struct {
+	limit FetchBudget
+	// parent is the budget of the context this one was given to, which is
+	// charged too.
+	parent *fetchBudget
+
+	mu       sync.Mutex
+	blocks   int
+	bytes    int64
+	started  time.Time
+	exceeded bool
+}
+
+// WithFetchBudget returns |ctx| carrying |b|, shared by every read made with
+// it or a context derived from it, so that a request can only make the
+// service fetch so much, however many blocks it asks for. Blocks stored
+// locally cost nothing. Once it runs out, GetBlock returns
+// ErrBudgetExceeded, GetBlocksWithErrors reports it for the keys not found
+// yet, and GetBlocks leaves them out. A budget |ctx| carries already keeps
+// applying.
+func WithFetchBudget(ctx context.Context, b FetchBudget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, &fetchBudget{limit: b, parent: budgetOf(ctx)})
+}
+
+// FetchBudgetSpent returns what the reads made with |ctx| spent of the
+// budget WithFetchBudget gave it, Time being since the first remote fetch,
+// or false if it has none.
+func FetchBudgetSpent(ctx context.Context) (FetchBudget, bool) {
+	b := budgetOf(ctx)
+	if b == nil {
+		return FetchBudget{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	spent := FetchBudget{Blocks: b.blocks, Bytes: b.bytes}
+	if !b.started.IsZero() {
+		spent.Time = time.Since(b.started)
+	}
+	return spent, true
+}
+
+func budgetOf(ctx context.Context) *fetchBudget {
+	b, _ := ctx.Value(budgetKey{}).(*fetchBudget)
+	return b
+}
+
+// lock locks |b| and the budgets above it, and returns them.
+func (b *fetchBudget) lock() []*fetchBudget {
+	var chain []*fetchBudget
+	for ; b != nil; b = b.parent {
+		b.mu.Lock()
+		chain = append(chain, b)
+	}
+	return chain
+}
+
+func unlock(chain []*fetchBudget) {
+	for _, b := range chain {
+		b.mu.Unlock()
+	}
+}
+
+// reserve charges up to |n| fetches to |b| and the budgets above it, and
+// returns how many, with the time left for them, or -1 if unbounded.
+func (b *fetchBudget) reserve(n int, now time.Time) (int, time.Duration) {
+	chain := b.lock()
+	defer unlock(chain)
+	asked := n
+	for _, c := range chain {
+		if c.limit.Blocks > 0 && c.blocks+n > c.limit.Blocks {
+			n = c.limit.Blocks - c.blocks
+		}
+		if c.limit.Bytes > 0 && c.bytes >= c.limit.Bytes {
+			n = 0
+		}
+		if c.limit.Time > 0 && !c.started.IsZero() && now.Sub(c.started) >= c.limit.Time {
+			n = 0
+		}
+	}
+	if n < asked {
+		chain[0].exceeded = true
+	}
+	if n <= 0 {
+		return 0, 0
+	}
+	left := time.Duration(-1)
+	for _, c := range chain {
+		c.blocks += n
+		if c.started.IsZero() {
+			c.started = now
+		}
+		if c.limit.Time > 0 {
+			if l := c.started.Add(c.limit.Time).Sub(now); left < 0 || l < left {
+				left = l
+			}
+		}
+	}
+	return n, left
+}
+
+// spend charges the data of |blk| to |b| and the budgets above it, and
+// reports whether that ran one out.
+func (b *fetchBudget) spend(blk *blocks.Block) bool {
+	if b == nil {
+		return false
+	}
+	chain := b.lock()
+	defer unlock(chain)
+	over := false
+	for _, c := range chain {
+		c.bytes += int64(len(blk.Data))
+		if c.limit.Bytes > 0 && c.bytes >= c.limit.Bytes {
+			over = true
+		}
+	}
+	return over
+}
+
+// exceed records that |b| cut a fetch short.
+func (b *fetchBudget) exceed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.exceeded = true
+}
+
+// wasExceeded reports whether |b| cut a fetch short or refused one.
+func (b *fetchBudget) wasExceeded() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exceeded
+}
+
+// budgeted charges |n| remote fetches to the budget of |ctx|, if it has one,
+// and returns how many may be made, with a context cancelled once the
+// budget's time runs out, which overBudget tells from other cancellations.
+// It returns ErrBudgetExceeded if none may be made.
+func budgeted(ctx context.Context, n int) (context.Context, int, context.CancelFunc, error) {
+	b := budgetOf(ctx)
+	if b == nil {
+		return ctx, n, func() {}, nil
+	}
+	got, left := b.reserve(n, time.Now())
+	if got == 0 && n > 0 {
+		return ctx, 0, func() {}, ErrBudgetExceeded
+	}
+	bctx, cancel := context.WithCancel(ctx)
+	if left < 0 {
+		return bctx, got, cancel, nil
+	}
+	t := time.AfterFunc(left, cancel)
+	return bctx, got, func() {
+		t.Stop()
+		cancel()
+	}, nil
+}
+
+// overBudget returns ErrBudgetExceeded in place of |err| if the budget's time
+// ended |bctx|, made from |ctx| by budgeted, and |err| otherwise.
+func overBudget(ctx, bctx context.Context, err error) error {
+	if err != nil && bctx.Err() != nil && ctx.Err() == nil {
+		budgetOf(ctx).exceed()
+		return ErrBudgetExceeded
+	}
+	return err
+}
@@ -0,0 +1,400 @@
+package car
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// IndexSuffix is added to the path of an archive to name its index, as
+// WriteIndex writes it.
+const IndexSuffix = ".index"
+
+const indexMagic = "carindex\x01"
+
+// Archives serves the blocks of archive files, as Export writes them, in
+// place, through a read-only blockstore: huge archival datasets need not be
+// imported into a datastore to be served.
+//
+// Finding a block takes an index of where each block of an archive is,
+// kept in memory. It is read from the archive's index file, if WriteIndex
+// wrote one and the archive has not changed since, and otherwise built by
+// reading the archive through, when a block is first looked up in it.
+// Blocks are checked against their Cid as they are read, a block that does
+// not match failing with blockstore.ErrHashMismatch.
+type Archives struct {
+	archives []*archive
+}
+
+// OpenArchives opens the archives at |paths|. A block in several of them is
+// read from the first. The archives must not change while open.
+func OpenArchives(paths ...string) (*Archives, error) {
+	a := &Archives{}
+	for _, p := range paths {
+		ar, err := openArchive(p)
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		a.archives = append(a.archives, ar)
+	}
+	return a, nil
+}
+
+// Blockstore returns a blockstore serving the blocks of the archives.
+// Its writes fail with blockstore.ErrReadOnly.
+func (a *Archives) Blockstore() blockstore.Blockstore {
+	return blockstore.ReadOnly(archiveStore{a})
+}
+
+// Close closes the archive files.
+func (a *Archives) Close() error {
+	var first error
+	for _, ar := range a.archives {
+		if err := ar.f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// find returns the archive holding |k|, and where.
+func (a *Archives) find(k key.Key) (*archive, location, error) {
+	for _, ar := range a.archives {
+		idx, err := ar.index()
+		if err != nil {
+			return nil, location{}, err
+		}
+		if loc, ok := idx[k]; ok {
+			return ar, loc, nil
+		}
+	}
+	return nil, location{}, blockstore.ErrNotFound
+}
+
+// WriteIndex indexes the archive at |path| and writes the index next to it,
+// at |path| + IndexSuffix, so that Archives need not read it through. An
+// index that is invalid, or was written for an archive of another size, is
+// ignored.
+func WriteIndex(path string) error {
+	ar, err := openArchive(path)
+	if err != nil {
+		return err
+	}
+	defer ar.f.Close()
+	idx, err := ar.scan()
+	if err != nil {
+		return err
+	}
+	ks := make([]key.Key, 0, len(idx))
+	for k := range idx {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool { return ks[i] < ks[j] })
+
+	buf := append([]byte(indexMagic), uvarint(uint64(ar.size))...)
+	buf = append(buf, uvarint(uint64(len(ks)))...)
+	for _, k := range ks {
+		loc := idx[k]
+		buf = append(buf, uvarint(uint64(len(k)))...)
+		buf = append(buf, k...)
+		buf = append(buf, uvarint(uint64(loc.off))...)
+		buf = append(buf, uvarint(uint64(loc.n))...)
+	}
+	// written aside and renamed, so that no reader sees part of it.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".index-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path+IndexSuffix)
+}
+
+func uvarint(v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return buf[:binary.PutUvarint(buf[:], v)]
+}
+
+// location is where the data of a block is in its archive.
+type location struct {
+	off int64
+	n   int
+}
+
+type archive struct {
+	path string
+	f    *os.File
+	size int64
+
+	once sync.Once
+	idx  map[key.Key]location
+	err  error
+}
+
+// openArchive opens the archive at |path|, checking its header.
+func openArchive(path string) (*archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		var header []byte
+		header, err = readSection(bufio.NewReader(f))
+		if err == io.EOF {
+			err = ErrInvalidArchive
+		}
+		if err == nil {
+			_, err = decodeHeader(header)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &archive{path: path, f: f, size: fi.Size()}, nil
+}
+
+// index returns the index of the archive, reading or building it the first
+// time.
+func (ar *archive) index() (map[key.Key]location, error) {
+	ar.once.Do(func() {
+		if ar.idx = ar.readIndex(); ar.idx == nil {
+			ar.idx, ar.err = ar.scan()
+		}
+	})
+	return ar.idx, ar.err
+}
+
+// readIndex returns the index in the archive's index file, or nil if there
+// is none, or it is invalid or stale.
+func (ar *archive) readIndex() map[key.Key]location {
+	data, err := ioutil.ReadFile(ar.path + IndexSuffix)
+	if err != nil || !strings.HasPrefix(string(data), indexMagic) {
+		return nil
+	}
+	data = data[len(indexMagic):]
+	next := func() (uint64, bool) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, false
+		}
+		data = data[n:]
+		return v, true
+	}
+	if size, ok := next(); !ok || int64(size) != ar.size {
+		return nil
+	}
+	count, ok := next()
+	if !ok {
+		return nil
+	}
+	idx := make(map[key.Key]location)
+	for ; count > 0; count-- {
+		n, ok := next()
+		if !ok || n > uint64(len(data)) {
+			return nil
+		}
+		k := key.Key(data[:n])
+		data = data[n:]
+		off, ok := next()
+		if !ok {
+			return nil
+		}
+		size, ok := next()
+		if !ok || off+size > uint64(ar.size) {
+			return nil
+		}
+		idx[k] = location{off: int64(off), n: int(size)}
+	}
+	if len(data) > 0 {
+		return nil
+	}
+	return idx
+}
+
+// scan indexes the archive by reading it through, the data of each block
+// skipped rather than read.
+func (ar *archive) scan() (map[key.Key]location, error) {
+	r := bufio.NewReader(io.NewSectionReader(ar.f, 0, ar.size))
+	var off int64
+	section := func() (uint64, error) {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, ErrInvalidArchive
+		}
+		if n > MaxSectionSize {
+			return 0, ErrSectionTooLarge
+		}
+		off += int64(len(uvarint(n)))
+		return n, nil
+	}
+	n, err := section()
+	if err != nil {
+		return nil, ErrInvalidArchive
+	}
+	if _, err := r.Discard(int(n)); err != nil {
+		return nil, ErrInvalidArchive
+	}
+	off += int64(n)
+
+	idx := make(map[key.Key]location)
+	for {
+		n, err := section()
+		if err == io.EOF {
+			return idx, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		peek := int(n)
+		if peek > key.MaxKeySize {
+			peek = key.MaxKeySize
+		}
+		head, err := r.Peek(peek)
+		if err != nil {
+			return nil, ErrInvalidArchive
+		}
+		c, err := cidLen(head)
+		if err != nil {
+			return nil, err
+		}
+		k := key.Key(head[:c])
+		if _, dup := idx[k]; !dup {
+			idx[k] = location{off: off + int64(c), n: int(n) - c}
+		}
+		if _, err := r.Discard(int(n)); err != nil {
+			return nil, ErrInvalidArchive
+		}
+		off += int64(n)
+	}
+}
+
+// archiveStore is the blockstore of Archives, made read-only by
+// blockstore.ReadOnly.
+type archiveStore struct {
+	a *Archives
+}
+
+func (s archiveStore) Has(k key.Key) (bool, error) {
+	_, _, err := s.a.find(k)
+	if errors.Is(err, blockstore.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s archiveStore) Get(k key.Key) (*blocks.Block, error) {
+	ar, loc, err := s.a.find(k)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, loc.n)
+	if _, err := ar.f.ReadAt(data, loc.off); err != nil {
+		return nil, err
+	}
+	if err := blockstore.Verify(k, data); err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithKey(data, k)
+}
+
+func (s archiveStore) GetChan(ks []key.Key) <-chan *blocks.Block {
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			if b, err := s.Get(k); err == nil {
+				out <- b
+			}
+		}
+	}()
+	return out
+}
+
+func (s archiveStore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return s.AllKeys(ctx, dsq.Query{})
+}
+
+// AllKeys applies |q| to the keys of every archive, as blockstore.AllKeys
+// does, each key once. The archives are all indexed first.
+func (s archiveStore) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	seen := make(map[key.Key]struct{})
+	var ks []key.Key
+	for _, ar := range s.a.archives {
+		idx, err := ar.index()
+		if err != nil {
+			return nil, err
+		}
+		for k := range idx {
+			if _, dup := seen[k]; dup {
+				continue
+			}
+			seen[k] = struct{}{}
+			if blockstore.MatchesQuery(q, k) {
+				ks = append(ks, k)
+			}
+		}
+	}
+	get := func() (key.Key, bool) {
+		if len(ks) == 0 {
+			return "", false
+		}
+		k := ks[0]
+		ks = ks[1:]
+		return k, true
+	}
+
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		blockstore.QueryKeys(ctx, out, q, get)
+	}()
+	return out, nil
+}
+
+func (archiveStore) FindOrphanedMetadata(context.Context) (<-chan key.Key, error) {
+	out := make(chan key.Key)
+	close(out)
+	return out, nil
+}
+
+func (archiveStore) DeleteBlock(key.Key) error     { return blockstore.ErrReadOnly }
+func (archiveStore) Put(*blocks.Block) error       { return blockstore.ErrReadOnly }
+func (archiveStore) PutMany([]*blocks.Block) error { return blockstore.ErrReadOnly }
+
+func (archiveStore) ReplaceAll(context.Context, <-chan *blocks.Block) error {
+	return blockstore.ErrReadOnly
+}
+
+func (archiveStore) ApplyBatch(context.Context, []*blocks.Block, []key.Key) error {
+	return blockstore.ErrReadOnly
+}
+
+func (archiveStore) PurgeOrphanedMetadata(context.Context) (int, error) {
+	return 0, blockstore.ErrReadOnly
+}
@@ -0,0 +1,150 @@
+package car
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	offline "github.com/ipfs/go-blocks/blockservice/exchange/offline"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// writeArchive exports |bs| to an archive in |dir| and returns its path.
+func writeArchive(t *testing.T, dir, name string, bs ...*blocks.Block) string {
+	src := newService(t)
+	defer src.Close()
+	if _, err := src.AddBlocks(context.Background(), bs); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Export(context.Background(), src, nil, &buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestArchives(t *testing.T) {
+	dir := t.TempDir()
+	a := blocks.NewBlock([]byte("first archive"))
+	shared := blocks.NewBlock([]byte("in both archives"))
+	b := blocks.NewBlockWithCodec([]byte("second archive"), key.Raw)
+	first := writeArchive(t, dir, "first.car", a, shared)
+	second := writeArchive(t, dir, "second.car", shared, b)
+	if err := WriteIndex(second); err != nil {
+		t.Fatal(err)
+	}
+
+	archives, err := OpenArchives(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archives.Close()
+	bstore := archives.Blockstore()
+	s, err := blockservice.New(bstore, offline.Exchange(bstore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, want := range []*blocks.Block{a, shared, b} {
+		got, err := s.GetBlock(context.Background(), want.Key())
+		if err != nil {
+			t.Fatalf("%s: %s", want.Data, err)
+		}
+		if !bytes.Equal(got.Data, want.Data) {
+			t.Fatalf("%s: read as %q", want.Data, got.Data)
+		}
+	}
+	missing := blocks.NewBlock([]byte("in neither"))
+	if has, err := bstore.Has(missing.Key()); has || err != nil {
+		t.Fatalf("expected no block, got %v, %v", has, err)
+	}
+	if _, err := s.AddBlock(missing); err != blockstore.ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	ks, err := bstore.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range ks {
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 keys, got %d", n)
+	}
+}
+
+func TestArchiveIndex(t *testing.T) {
+	dir := t.TempDir()
+	blk := blocks.NewBlock([]byte("indexed"))
+	path := writeArchive(t, dir, "a.car", blk)
+	if err := WriteIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	ar, err := openArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := ar.readIndex()
+	ar.f.Close()
+	if _, ok := idx[blk.Key()]; !ok || len(idx) != 1 {
+		t.Fatalf("expected the index of the archive, got %v", idx)
+	}
+
+	// an index of another archive is not used.
+	other := writeArchive(t, dir, "b.car", blk, blocks.NewBlock([]byte("more")))
+	if err := os.Rename(path+IndexSuffix, other+IndexSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if ar, err = openArchive(other); err != nil {
+		t.Fatal(err)
+	}
+	defer ar.f.Close()
+	if idx := ar.readIndex(); idx != nil {
+		t.Fatalf("stale index read: %v", idx)
+	}
+	if idx, err := ar.index(); err != nil || len(idx) != 2 {
+		t.Fatalf("expected the archive scanned, got %v, %v", idx, err)
+	}
+}
+
+func TestArchiveCorruptBlock(t *testing.T) {
+	dir := t.TempDir()
+	blk := blocks.NewBlock([]byte("will be corrupted"))
+	path := writeArchive(t, dir, "a.car", blk)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	archives, err := OpenArchives(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archives.Close()
+	if _, err := archives.Blockstore().Get(blk.Key()); err != blockstore.ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not an archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenArchives(path); err == nil {
+		t.Fatal("expected an invalid archive to fail")
+	}
+}
@@ -0,0 +1,228 @@
+// package car backs up and restores the blocks of a BlockService as CAR
+// (content-addressed archive) files, version 1: a header naming the root
+// blocks, then every block, each as its Cid followed by its data.
+//
+// Blocks carry no links, so there is no DAG to select from: an archive holds
+// every stored block, and its roots are only recorded, for the reader.
+//
+// Archives can also be served in place, without importing them; see
+// OpenArchives.
+package car
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// MaxSectionSize is the largest header or block section Import reads; a
+// longer one fails it with ErrSectionTooLarge rather than being buffered.
+const MaxSectionSize = 32 << 20
+
+var (
+	ErrInvalidArchive  = errors.New("car: invalid archive")
+	ErrSectionTooLarge = errors.New("car: section exceeds MaxSectionSize")
+)
+
+// importBatchBytes is about how much block data Import stores per AddBlocks.
+const importBatchBytes = 4 << 20
+
+// Export writes an archive of every block stored in |s| to |w|, with
+// |roots| in its header. The blocks are read from the blockstore only, never
+// fetched through the exchange, and the roots need not be stored. Blocks
+// deleted while the export runs are left out, but a listing of the
+// blockstore cut short by an error fails the export, rather than ending
+// the archive early.
+func Export(ctx context.Context, s *blockservice.BlockService, roots []key.Key, w io.Writer) error {
+	for _, r := range roots {
+		if _, err := r.Cid(); err != nil {
+			return fmt.Errorf("car: root %s: %w", r, err)
+		}
+	}
+	bw := bufio.NewWriter(w)
+	if err := writeSection(bw, encodeHeader(roots)); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ks, listed, err := blockstore.ListKeys(ctx, s.Blockstore, dsq.Query{})
+	if err != nil {
+		return err
+	}
+	for k := range ks {
+		b, err := s.Blockstore.Get(k)
+		if errors.Is(err, blockstore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeSection(bw, []byte(k), b.Data); err != nil {
+			return err
+		}
+	}
+	if err := listed(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func writeSection(w *bufio.Writer, parts ...[]byte) error {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := w.Write(buf[:binary.PutUvarint(buf[:], uint64(n))]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import adds every block of the archive read from |r| to |s|, as AddBlocks
+// does, so they are announced like any other, and returns the roots in its
+// header. Each block is checked against its Cid first; a block that does not
+// match fails the import with blockstore.ErrHashMismatch. Blocks are stored
+// in batches as they are read, so an import that fails part way leaves
+// those before it stored.
+func Import(ctx context.Context, s *blockservice.BlockService, r io.Reader) ([]key.Key, error) {
+	br := bufio.NewReader(r)
+	header, err := readSection(br)
+	if err == io.EOF {
+		return nil, ErrInvalidArchive
+	}
+	if err != nil {
+		return nil, err
+	}
+	roots, err := decodeHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch []*blocks.Block
+	size := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := s.AddBlocks(ctx, batch)
+		batch, size = nil, 0
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		section, err := readSection(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := parseBlock(section)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, b)
+		if size += len(b.Data); size >= importBatchBytes {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// readSection reads a length-prefixed section, returning io.EOF only if the
+// archive ends before it.
+func readSection(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, ErrInvalidArchive
+	}
+	if n > MaxSectionSize {
+		return nil, ErrSectionTooLarge
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidArchive
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// parseBlock splits a block section into its Cid and data, and checks that
+// they match.
+func parseBlock(section []byte) (*blocks.Block, error) {
+	n, err := cidLen(section)
+	if err != nil {
+		return nil, err
+	}
+	k := key.Key(section[:n])
+	data := section[n:]
+	if err := blockstore.Verify(k, data); err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithKey(data, k)
+}
+
+// cidLen returns the length of the binary Cid |section| starts with. Version
+// 0 Cids are bare multihashes, with any hash function, as in package key.
+func cidLen(section []byte) (int, error) {
+	off := 0
+	uvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(section[off:])
+		if n <= 0 {
+			return 0, false
+		}
+		off += n
+		return v, true
+	}
+	version, ok := uvarint()
+	if !ok {
+		return 0, ErrInvalidArchive
+	}
+	// otherwise |version| was the hash function of a version 0 Cid.
+	if version == 1 {
+		if _, ok := uvarint(); !ok { // codec
+			return 0, ErrInvalidArchive
+		}
+		if _, ok := uvarint(); !ok { // hash function
+			return 0, ErrInvalidArchive
+		}
+	}
+	length, ok := uvarint()
+	if !ok || length > uint64(len(section)-off) {
+		return 0, ErrInvalidArchive
+	}
+	n := off + int(length)
+	if _, err := key.CidFromBytes(section[:n]); err != nil {
+		return 0, ErrInvalidArchive
+	}
+	return n, nil
+}
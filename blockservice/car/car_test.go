@@ -0,0 +1,182 @@
+package car
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	offline "github.com/ipfs/go-blocks/blockservice/exchange/offline"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func newService(t *testing.T) *blockservice.BlockService {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	s, err := blockservice.New(bstore, offline.Exchange(bstore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := newService(t)
+	sha3, err := blocks.NewBlockWithHashType([]byte("sha3 block"), mh.SHA3, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := []*blocks.Block{
+		blocks.NewBlock([]byte("plain block")),
+		blocks.NewBlockWithCodec([]byte("raw block"), key.Raw),
+		sha3,
+	}
+	if _, err := src.AddBlocks(ctx, bs); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	roots := []key.Key{bs[0].Key(), bs[1].Key()}
+	if err := Export(ctx, src, roots, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newService(t)
+	got, err := Import(ctx, dst, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != roots[0] || got[1] != roots[1] {
+		t.Fatalf("expected roots %v, got %v", roots, got)
+	}
+	for _, b := range bs {
+		out, err := dst.Blockstore.Get(b.Key())
+		if err != nil {
+			t.Fatalf("%s: %s", b.Data, err)
+		}
+		if !bytes.Equal(out.Data, b.Data) || out.Key() != b.Key() {
+			t.Fatalf("%s: imported as %s", b.Data, out)
+		}
+	}
+}
+
+// brokenListing is a datastore whose queries fail part way through.
+type brokenListing struct {
+	ds.ThreadSafeDatastore
+}
+
+func (d brokenListing) Query(q dsq.Query) (dsq.Results, error) {
+	ch := make(chan dsq.Result, 1)
+	ch <- dsq.Result{Error: errors.New("disk on fire")}
+	close(ch)
+	return dsq.ResultsWithChan(q, ch), nil
+}
+
+func TestExportFailsOnBrokenListing(t *testing.T) {
+	bstore := blockstore.NewBlockstore(brokenListing{dssync.MutexWrap(ds.NewMapDatastore())})
+	s, err := blockservice.New(bstore, offline.Exchange(bstore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddBlock(blocks.NewBlock([]byte("unlisted"))); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Export(context.Background(), s, nil, &buf); err == nil {
+		t.Fatal("expected a cut short listing to fail the export")
+	}
+}
+
+func TestHeaderEncoding(t *testing.T) {
+	root := blocks.NewBlock([]byte("root")).Key()
+	want := "a2" + "65" + hex.EncodeToString([]byte("roots")) +
+		"81" + "d82a" + "5823" + "00" + hex.EncodeToString([]byte(root)) +
+		"67" + hex.EncodeToString([]byte("version")) + "01"
+	if got := hex.EncodeToString(encodeHeader([]key.Key{root})); got != want {
+		t.Fatalf("expected header %s, got %s", want, got)
+	}
+
+	roots, err := decodeHeader(encodeHeader([]key.Key{root}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0] != root {
+		t.Fatalf("expected root %s, got %v", root, roots)
+	}
+}
+
+func TestDecodeHeaderSkipsUnknownKeys(t *testing.T) {
+	var h []byte
+	h = appendHead(h, cborMap, 3)
+	h = appendText(h, "note")
+	h = appendHead(h, cborArray, 1)
+	h = appendText(h, "ignored")
+	h = appendText(h, "roots")
+	h = appendHead(h, cborArray, 0)
+	h = appendText(h, "version")
+	h = appendHead(h, cborUint, 1)
+	roots, err := decodeHeader(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 0 {
+		t.Fatalf("expected no roots, got %v", roots)
+	}
+}
+
+func TestImportRejects(t *testing.T) {
+	ctx := context.Background()
+	b := blocks.NewBlock([]byte("a block"))
+	archive := func(header []byte, sections ...[]byte) *bytes.Buffer {
+		var buf bytes.Buffer
+		var sec []byte
+		sec = appendUvarint(sec, len(header))
+		buf.Write(append(sec, header...))
+		for _, s := range sections {
+			buf.Write(append(appendUvarint(nil, len(s)), s...))
+		}
+		return &buf
+	}
+	header := encodeHeader(nil)
+	good := append([]byte(b.Key()), b.Data...)
+	bad := append([]byte(b.Key()), "not the data"...)
+
+	v2 := append([]byte(nil), header...)
+	v2[len(v2)-1] = 2
+
+	cases := []struct {
+		name string
+		r    *bytes.Buffer
+		err  error
+	}{
+		{"empty", &bytes.Buffer{}, ErrInvalidArchive},
+		{"hash mismatch", archive(header, bad), blockstore.ErrHashMismatch},
+		{"truncated", bytes.NewBuffer(archive(header, good).Bytes()[:len(header)+5]), ErrInvalidArchive},
+		{"bad cid", archive(header, []byte{0x01, 0x55}), ErrInvalidArchive},
+		{"huge section", bytes.NewBuffer(appendUvarint(nil, MaxSectionSize+1)), ErrSectionTooLarge},
+		{"version 2", archive(v2), nil},
+	}
+	for _, c := range cases {
+		_, err := Import(ctx, newService(t), c.r)
+		if err == nil || (c.err != nil && err != c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func appendUvarint(buf []byte, n int) []byte {
+	for n >= 0x80 {
+		buf = append(buf, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(buf, byte(n))
+}
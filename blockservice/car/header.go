@@ -0,0 +1,257 @@
+package car
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// The header is the DAG-CBOR map {"roots": [cid...], "version": 1}, each
+// Cid a byte string, behind a zero byte, under tag 42. Only as much CBOR as
+// that takes is handled here: decodeHeader skips keys it does not know, but
+// fails on floats and indefinite lengths, which DAG-CBOR does not allow.
+
+const (
+	cborUint   = 0
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+
+	cidTag = 42
+)
+
+// encodeHeader returns the header naming |roots|, its keys in canonical
+// order.
+func encodeHeader(roots []key.Key) []byte {
+	var buf []byte
+	buf = appendHead(buf, cborMap, 2)
+	buf = appendText(buf, "roots")
+	buf = appendHead(buf, cborArray, uint64(len(roots)))
+	for _, r := range roots {
+		buf = appendHead(buf, cborTag, cidTag)
+		buf = appendHead(buf, cborBytes, uint64(len(r)+1))
+		buf = append(buf, 0)
+		buf = append(buf, r...)
+	}
+	buf = appendText(buf, "version")
+	return appendHead(buf, cborUint, 1)
+}
+
+func appendText(buf []byte, s string) []byte {
+	return append(appendHead(buf, cborText, uint64(len(s))), s...)
+}
+
+// appendHead appends a CBOR item head for |major| with argument |v|, in the
+// shortest form.
+func appendHead(buf []byte, major byte, v uint64) []byte {
+	m := major << 5
+	switch {
+	case v < 24:
+		return append(buf, m|byte(v))
+	case v <= 0xff:
+		return append(buf, m|24, byte(v))
+	case v <= 0xffff:
+		var b [2]byte
+		binary.BigEndian.PutUint16(b[:], uint16(v))
+		return append(append(buf, m|25), b[:]...)
+	case v <= 0xffffffff:
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(v))
+		return append(append(buf, m|26), b[:]...)
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(append(buf, m|27), b[:]...)
+}
+
+// decodeHeader returns the roots of |data|, failing if it is not a version
+// 1 header.
+func decodeHeader(data []byte) ([]key.Key, error) {
+	d := &cborReader{data: data}
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != cborMap {
+		return nil, ErrInvalidArchive
+	}
+	var roots []key.Key
+	version, haveRoots := uint64(0), false
+	for i := uint64(0); i < n; i++ {
+		name, err := d.text()
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "version":
+			major, v, err := d.head()
+			if err != nil {
+				return nil, err
+			}
+			if major != cborUint {
+				return nil, ErrInvalidArchive
+			}
+			version = v
+		case "roots":
+			if roots, err = d.roots(); err != nil {
+				return nil, err
+			}
+			haveRoots = true
+		default:
+			if err := d.skip(0); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("car: unsupported version %d", version)
+	}
+	if !haveRoots || d.off != len(d.data) {
+		return nil, ErrInvalidArchive
+	}
+	return roots, nil
+}
+
+type cborReader struct {
+	data []byte
+	off  int
+}
+
+// head reads an item head, returning its major type and argument: the
+// value, length or count the item has.
+func (d *cborReader) head() (byte, uint64, error) {
+	if d.off >= len(d.data) {
+		return 0, 0, ErrInvalidArchive
+	}
+	b := d.data[d.off]
+	d.off++
+	major, info := b>>5, b&0x1f
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	size := 0
+	switch info {
+	case 24:
+		size = 1
+	case 25:
+		size = 2
+	case 26:
+		size = 4
+	case 27:
+		size = 8
+	default:
+		return 0, 0, ErrInvalidArchive
+	}
+	if len(d.data)-d.off < size {
+		return 0, 0, ErrInvalidArchive
+	}
+	var v uint64
+	for _, c := range d.data[d.off : d.off+size] {
+		v = v<<8 | uint64(c)
+	}
+	d.off += size
+	return major, v, nil
+}
+
+// payload returns the next |n| bytes.
+func (d *cborReader) payload(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.off) {
+		return nil, ErrInvalidArchive
+	}
+	p := d.data[d.off : d.off+int(n)]
+	d.off += int(n)
+	return p, nil
+}
+
+func (d *cborReader) text() (string, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return "", err
+	}
+	if major != cborText {
+		return "", ErrInvalidArchive
+	}
+	p, err := d.payload(n)
+	return string(p), err
+}
+
+func (d *cborReader) roots() ([]key.Key, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != cborArray {
+		return nil, ErrInvalidArchive
+	}
+	var roots []key.Key
+	for i := uint64(0); i < n; i++ {
+		if major, tag, err := d.head(); err != nil {
+			return nil, err
+		} else if major != cborTag || tag != cidTag {
+			return nil, ErrInvalidArchive
+		}
+		major, size, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if major != cborBytes {
+			return nil, ErrInvalidArchive
+		}
+		p, err := d.payload(size)
+		if err != nil {
+			return nil, err
+		}
+		if len(p) < 2 || p[0] != 0 {
+			return nil, ErrInvalidArchive
+		}
+		k := key.Key(p[1:])
+		if _, err := k.Cid(); err != nil {
+			return nil, ErrInvalidArchive
+		}
+		roots = append(roots, k)
+	}
+	return roots, nil
+}
+
+// maxDepth is how deeply skip follows nested items.
+const maxDepth = 16
+
+// skip reads past the next item, whatever it is, |depth| items deep.
+func (d *cborReader) skip(depth int) error {
+	if depth > maxDepth {
+		return ErrInvalidArchive
+	}
+	major, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case cborBytes, cborText:
+		_, err = d.payload(n)
+		return err
+	case cborArray, cborMap:
+		per := 1
+		if major == cborMap {
+			per = 2
+		}
+		for i := uint64(0); i < n; i++ {
+			for j := 0; j < per; j++ {
+				if err := d.skip(depth + 1); err != nil {
+					return err
+				}
+			}
+		}
+	case cborTag:
+		return d.skip(depth + 1)
+	case cborSimple:
+		if n > 23 {
+			// floats; DAG-CBOR headers have none.
+			return ErrInvalidArchive
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package blockservice
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// stallGuard gives up on sending the GetBlocksWith caller a block it does
+// not take within |timeout|, if positive, calling |stalled| the first time.
+type stallGuard struct {
+	s       *BlockService
+	timeout time.Duration
+	stalled func()
+	once    sync.Once
+}
+
+// send sends |b|, a local hit, to |out|, or gives up on it, and reports
+// whether |ctx| is still running.
+func (g *stallGuard) send(ctx context.Context, out chan<- *blocks.Block, b *blocks.Block) bool {
+	if g.timeout <= 0 {
+		select {
+		case out <- b:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	t := time.NewTimer(g.timeout)
+	defer t.Stop()
+	select {
+	case out <- b:
+	case <-t.C:
+		g.giveUp(b, false)
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+// giveUp counts |b| as undelivered and, if it was fetched through the
+// exchange, stores it, so that it is read locally when asked for again.
+func (g *stallGuard) giveUp(b *blocks.Block, remote bool) {
+	g.once.Do(func() {
+		if g.stalled != nil {
+			g.stalled()
+		}
+	})
+	atomic.AddUint64(&g.s.stats.undelivered, 1)
+	if !remote || g.s.readOnly {
+		return
+	}
+	if err := g.s.Blockstore.Put(b); err != nil {
+		atomic.AddUint64(&g.s.stats.errors, 1)
+	}
+}
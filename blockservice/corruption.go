@@ -0,0 +1,86 @@
+package blockservice
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	lru "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/hashicorp/golang-lru"
+)
+
+// maxCorruptKeys bounds how many corrupt keys awaiting the exchange's copy
+// are remembered, those removed longest ago being forgotten first: their
+// copy is then stored only if SetReadRepair is enabled.
+const maxCorruptKeys = 1024
+
+// SetCorruptionRepair controls whether local blocks are verified as they
+// are read. When enabled, a local block whose data does not match its key is
+// removed from the blockstore, quarantined if it supports that, and read
+// from the exchange instead, as if it had been missing, so that corrupt data
+// is never returned. The exchange's copy is stored in its place, whatever
+// SetReadRepair says, and counted in Stats.Repaired. A read-only service
+// removes nothing, but still reads such blocks from the exchange. It must be
+// set before the service is used.
+func (s *BlockService) SetCorruptionRepair(enabled bool) {
+	if enabled {
+		keys, err := lru.New(maxCorruptKeys)
+		if err != nil {
+			panic(err) // maxCorruptKeys is positive.
+		}
+		s.corrupt = &corruptKeys{keys: keys}
+	} else {
+		s.corrupt = nil
+	}
+}
+
+// corruptKeys are the keys whose corrupt local copies were removed, and
+// that the exchange's copy has not replaced yet.
+type corruptKeys struct {
+	mu   sync.Mutex
+	keys *lru.Cache // key.Key -> struct{}
+}
+
+func (c *corruptKeys) add(k key.Key) {
+	c.mu.Lock()
+	c.keys.Add(k, struct{}{})
+	c.mu.Unlock()
+}
+
+// take reports whether |k| was removed as corrupt, forgetting it.
+func (c *corruptKeys) take(k key.Key) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.keys.Get(k)
+	c.keys.Remove(k)
+	return ok
+}
+
+// checkCorrupt verifies |b|, read locally, if corruption repair is enabled,
+// removing it if it is corrupt and the service is not read-only. It reports
+// whether it was.
+func (s *BlockService) checkCorrupt(b *blocks.Block) bool {
+	if s.corrupt == nil || !errors.Is(blockstore.Verify(b.Key(), b.Data), blockstore.ErrHashMismatch) {
+		return false
+	}
+	if s.readOnly {
+		return true
+	}
+	if err := s.removeLocal(b.Key()); err != nil {
+		atomic.AddUint64(&s.stats.errors, 1)
+	}
+	s.corrupt.add(b.Key())
+	return true
+}
+
+// removeLocal removes the corrupt local copy of |k|, quarantining it if the
+// blockstore supports it.
+func (s *BlockService) removeLocal(k key.Key) error {
+	if q, ok := s.Blockstore.(blockstore.Quarantiner); ok {
+		return q.Quarantine(k)
+	}
+	return s.Blockstore.DeleteBlock(k)
+}
@@ -0,0 +1,342 @@
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var (
+	// ErrClosed is returned by the calls of a closed Client.
+	// It wraps blockservice.ErrClosed.
+	ErrClosed = fmt.Errorf("daemon: client: %w", blockservice.ErrClosed)
+	// ErrUnsupported is returned by the Client's Blockstore methods that
+	// the protocol does not offer, such as listing the blocks.
+	ErrUnsupported = errors.New("daemon: not supported by the protocol")
+)
+
+// maxIdleConns is how many connections a Client keeps open between calls.
+const maxIdleConns = 4
+
+// Client uses a BlockService served by a Server. As a blockstore.Blockstore
+// it reads and writes the blocks the service stores: Get fetches through
+// the service's exchange if needed, and Has only sees blocks stored. As an
+// exchange.Interface it lets another BlockService read through the shared
+// one, HasBlock adding the block to it. Misses are reported with
+// blockstore.ErrNotFound.
+//
+// Calls run on connections of their own, so a Client may be used by many
+// goroutines; it keeps a few open between calls. Blockstore methods without
+// a context run with context.Background(), and ApplyBatch is not atomic: it
+// puts and deletes one block at a time.
+type Client struct {
+	network, addr string
+
+	mu     sync.Mutex
+	idle   []*clientConn
+	closed bool
+}
+
+var (
+	_ blockstore.Blockstore = (*Client)(nil)
+	_ exchange.Interface    = (*Client)(nil)
+)
+
+// Dial returns a Client of the Server listening on the unix domain socket
+// at |path|, checking that it can connect.
+func Dial(path string) (*Client, error) {
+	return DialNetwork("unix", path)
+}
+
+// DialNetwork is Dial for a Server listening at |addr| on |network|, as
+// net.Dial takes them.
+func DialNetwork(network, addr string) (*Client, error) {
+	c := &Client{network: network, addr: addr}
+	cc, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.release(cc)
+	return c, nil
+}
+
+type clientConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (c *Client) dial() (*clientConn, error) {
+	conn, err := net.Dial(c.network, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &clientConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+// acquire returns an idle connection, or a new one.
+func (c *Client) acquire() (*clientConn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cc, nil
+	}
+	c.mu.Unlock()
+	return c.dial()
+}
+
+// release keeps |cc|, ready for another call, or closes it if enough are
+// kept.
+func (c *Client) release(cc *clientConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= maxIdleConns {
+		cc.Close()
+		return
+	}
+	c.idle = append(c.idle, cc)
+}
+
+// aLongTimeAgo is a deadline in the past, which unblocks a connection's
+// reads and writes.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// call sends the request |typ| with |fields|, and hands each response frame
+// to |recv| until it returns false. An Error frame ends the call with its
+// error instead. The connection is reused unless it failed, or |ctx| was
+// done before the response was read whole.
+func (c *Client) call(ctx context.Context, recv func(frame) (bool, error), typ byte, fields ...[]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cc, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			cc.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	rerr, err := cc.roundTrip(recv, typ, fields)
+	close(stop)
+	<-watched
+	if ctx.Err() != nil {
+		cc.Close()
+		return ctx.Err()
+	}
+	if err != nil {
+		cc.Close()
+		return err
+	}
+	c.release(cc)
+	return rerr
+}
+
+// roundTrip does a call on |cc|, returning the error the server answered
+// with, or the error that made |cc| unusable.
+func (cc *clientConn) roundTrip(recv func(frame) (bool, error), typ byte, fields [][]byte) (remote, err error) {
+	if err := writeFrame(cc.w, typ, fields...); err != nil {
+		// nothing was written: the connection is still good.
+		return err, nil
+	}
+	if err := cc.w.Flush(); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := readFrame(cc.r)
+		if err != nil {
+			return nil, err
+		}
+		if f.typ == msgError {
+			if err := remoteError(f); err != errMalformed {
+				return err, nil
+			}
+			return nil, errMalformed
+		}
+		more, err := recv(f)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return nil, nil
+		}
+	}
+}
+
+// one returns a recv for a call answered with a single frame of type |typ|
+// with |n| fields, which it stores in |*out|.
+func one(typ byte, n int, out *frame) func(frame) (bool, error) {
+	return func(f frame) (bool, error) {
+		if err := f.expect(typ, n); err != nil {
+			return false, err
+		}
+		*out = f
+		return false, nil
+	}
+}
+
+func (c *Client) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	var f frame
+	if err := c.call(ctx, one(msgBlock, 2, &f), opGet, []byte(k)); err != nil {
+		return nil, err
+	}
+	if key.Key(f.fields[0]) != k {
+		return nil, blockstore.ErrHashMismatch
+	}
+	return toBlock(k, f.fields[1])
+}
+
+// GetBlocks streams the blocks of |ks| that the service finds. Blocks whose
+// data does not match their key are left out.
+func (c *Client) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	fields := make([][]byte, len(ks))
+	for i, k := range ks {
+		fields[i] = []byte(k)
+	}
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		c.call(ctx, func(f frame) (bool, error) {
+			if f.typ == msgEnd {
+				return false, nil
+			}
+			if err := f.expect(msgBlock, 2); err != nil {
+				return false, err
+			}
+			b, err := toBlock(key.Key(f.fields[0]), f.fields[1])
+			if err != nil {
+				return true, nil
+			}
+			select {
+			case out <- b:
+				return true, nil
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+		}, opGetMany, fields...)
+	}()
+	return out, nil
+}
+
+// HasBlock adds |b| to the service, which announces it.
+func (c *Client) HasBlock(ctx context.Context, b *blocks.Block) error {
+	return c.put(ctx, b)
+}
+
+// Cancel does nothing: a read's wants end with its context.
+func (c *Client) Cancel(context.Context, []key.Key) error { return nil }
+
+// Close closes the connections kept open. Calls in progress go on; those
+// made later fail with ErrClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cc := range c.idle {
+		cc.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *Client) put(ctx context.Context, b *blocks.Block) error {
+	var f frame
+	return c.call(ctx, one(msgKey, 1, &f), opPut, []byte(b.Key()), b.Data)
+}
+
+func (c *Client) del(ctx context.Context, k key.Key) error {
+	var f frame
+	return c.call(ctx, one(msgOK, 0, &f), opDelete, []byte(k))
+}
+
+func (c *Client) Get(k key.Key) (*blocks.Block, error) {
+	return c.GetBlock(context.Background(), k)
+}
+
+func (c *Client) Has(k key.Key) (bool, error) {
+	var f frame
+	if err := c.call(context.Background(), one(msgHas, 1, &f), opHas, []byte(k)); err != nil {
+		return false, err
+	}
+	return len(f.fields[0]) == 1 && f.fields[0][0] == 1, nil
+}
+
+func (c *Client) Put(b *blocks.Block) error {
+	return c.put(context.Background(), b)
+}
+
+func (c *Client) PutMany(bs []*blocks.Block) error {
+	for _, b := range bs {
+		if err := c.Put(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) DeleteBlock(k key.Key) error {
+	return c.del(context.Background(), k)
+}
+
+func (c *Client) GetChan(ks []key.Key) <-chan *blocks.Block {
+	out, _ := c.GetBlocks(context.Background(), ks)
+	return out
+}
+
+func (c *Client) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	for _, b := range puts {
+		if err := c.put(ctx, b); err != nil {
+			return err
+		}
+	}
+	for _, k := range deletes {
+		if err := c.del(ctx, k); err != nil && !errors.Is(err, blockstore.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) AllKeysChan(context.Context) (<-chan key.Key, error) {
+	return nil, ErrUnsupported
+}
+
+func (c *Client) AllKeys(context.Context, dsq.Query) (<-chan key.Key, error) {
+	return nil, ErrUnsupported
+}
+
+func (c *Client) ReplaceAll(context.Context, <-chan *blocks.Block) error {
+	return ErrUnsupported
+}
+
+func (c *Client) FindOrphanedMetadata(context.Context) (<-chan key.Key, error) {
+	return nil, ErrUnsupported
+}
+
+func (c *Client) PurgeOrphanedMetadata(context.Context) (int, error) {
+	return 0, ErrUnsupported
+}
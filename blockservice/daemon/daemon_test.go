@@ -0,0 +1,208 @@
+package daemon
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	offline "github.com/ipfs/go-blocks/blockservice/exchange/offline"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// serve serves |s| on a unix socket, returning a Client of it and a func
+// stopping both.
+func serve(t *testing.T, s *blockservice.BlockService) (*Client, func()) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "blocks.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(s)
+	go srv.Serve(l)
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		srv.Close()
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// newDaemon serves a BlockService with an offline exchange, given |opts|.
+func newDaemon(t *testing.T, opts ...blockservice.Option) (*blockservice.BlockService, *Client, func()) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	s, err := blockservice.New(bstore, offline.Exchange(bstore), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, done := serve(t, s)
+	return s, c, done
+}
+
+func TestClientBlockstore(t *testing.T) {
+	s, c, done := newDaemon(t)
+	defer done()
+	b := blocks.NewBlock([]byte("over the socket"))
+
+	if err := c.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := s.Blockstore.Has(b.Key()); err != nil || !has {
+		t.Fatalf("expected the block stored by the service, got %v, %v", has, err)
+	}
+	if has, err := c.Has(b.Key()); err != nil || !has {
+		t.Fatalf("expected Has, got %v, %v", has, err)
+	}
+	got, err := c.Get(b.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Data) != string(b.Data) {
+		t.Fatalf("expected %q, got %q", b.Data, got.Data)
+	}
+
+	if err := c.DeleteBlock(b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(b.Key()); err != blockstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if has, err := c.Has(b.Key()); err != nil || has {
+		t.Fatalf("expected no block, got %v, %v", has, err)
+	}
+
+	// a block whose data does not match its key is refused.
+	bad, err := blocks.NewBlockWithKey([]byte("not it"), b.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(bad); err != blockstore.ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+	if _, err := c.AllKeysChan(context.Background()); err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	_, c, done := newDaemon(t, blockservice.WithReadOnly())
+	defer done()
+	if err := c.Put(blocks.NewBlock([]byte("refused"))); err != blockstore.ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	// the connection survives errors.
+	if _, err := c.Get(blocks.NewBlock([]byte("missing")).Key()); err != blockstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	c.Close()
+	if _, err := c.Has(blocks.NewBlock([]byte("x")).Key()); err != ErrClosed || !errors.Is(err, blockservice.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestClientExchange(t *testing.T) {
+	shared, c, done := newDaemon(t)
+	defer done()
+	var want []*blocks.Block
+	var ks []key.Key
+	for _, data := range []string{"one", "two", "three"} {
+		b := blocks.NewBlock([]byte(data))
+		if _, err := shared.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, b)
+		ks = append(ks, b.Key())
+	}
+	missing := blocks.NewBlock([]byte("missing")).Key()
+
+	// a tool's own service, reading through the daemon's.
+	local, err := blockservice.New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	got := make(map[key.Key]bool)
+	for b := range local.GetBlocks(context.Background(), append(ks, missing)) {
+		got[b.Key()] = true
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d blocks, got %d", len(want), len(got))
+	}
+	for _, b := range want {
+		if !got[b.Key()] {
+			t.Fatalf("block %s not received", b.Key())
+		}
+	}
+	if _, err := local.GetBlock(context.Background(), missing); err != blockstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// blocks added locally reach the daemon.
+	added := blocks.NewBlock([]byte("added locally"))
+	if _, err := local.AddBlockSync(context.Background(), added); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := shared.Blockstore.Has(added.Key()); !has {
+		t.Fatal("expected the daemon to store the announced block")
+	}
+}
+
+// stallingExchange never finds a block, waiting for the context instead.
+type stallingExchange struct{}
+
+func (stallingExchange) GetBlock(ctx context.Context, _ key.Key) (*blocks.Block, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (stallingExchange) GetBlocks(ctx context.Context, _ []key.Key) (<-chan *blocks.Block, error) {
+	out := make(chan *blocks.Block)
+	go func() {
+		<-ctx.Done()
+		close(out)
+	}()
+	return out, nil
+}
+
+func (stallingExchange) HasBlock(context.Context, *blocks.Block) error { return nil }
+func (stallingExchange) Cancel(context.Context, []key.Key) error       { return nil }
+func (stallingExchange) Close() error                                  { return nil }
+
+func TestClientContext(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	s, err := blockservice.New(bstore, stallingExchange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, done := serve(t, s)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetBlock(ctx, blocks.NewBlock([]byte("nowhere")).Key()); err != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	// the abandoned connection is not reused.
+	if has, err := c.Has(blocks.NewBlock([]byte("nowhere")).Key()); err != nil || has {
+		t.Fatalf("expected no block, got %v, %v", has, err)
+	}
+}
@@ -0,0 +1,179 @@
+// package daemon shares one BlockService with the other processes of a
+// machine over a unix domain socket, so that short-lived tools, such as
+// those of a CLI, reuse the daemon's warm cache and exchange connections
+// instead of each opening the datastore: a Server serves the BlockService,
+// and a Client is both a blockstore.Blockstore and an exchange.Interface
+// using it.
+//
+// The protocol is meant to be cheap rather than general; see package
+// blockservice/grpc for one reachable over the network. Every message is a
+// frame: a 4 byte big-endian length, then that many bytes, a type byte
+// followed by fields, each a uvarint length and that many bytes. A
+// connection carries one request at a time. The client sends a request
+// frame, and the server answers with one frame or, for GetMany, with a
+// block frame per block found and then an end frame:
+//
+//	Get(key)         -> Block(key, data)
+//	GetMany(key...)  -> Block(key, data)... End()
+//	Put(key, data)   -> Key(key)
+//	Has(key)         -> Has(0 or 1)
+//	Delete(key)      -> OK()
+//
+// Any request may be answered with Error(code, message) instead. Put takes
+// an empty key to have the block keyed as the service keys new blocks.
+package daemon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+)
+
+// MaxFrameSize is the size of the largest frame either side accepts, and so
+// bounds the blocks, and the number of keys of a GetMany, that go through.
+const MaxFrameSize = 64 << 20
+
+// ErrFrameTooLarge is returned for frames larger than MaxFrameSize.
+var ErrFrameTooLarge = errors.New("daemon: frame too large")
+
+// The types of request frames.
+const (
+	opGet byte = iota + 1
+	opGetMany
+	opPut
+	opHas
+	opDelete
+)
+
+// The types of response frames.
+const (
+	msgBlock byte = iota + 0x81
+	msgEnd
+	msgKey
+	msgHas
+	msgOK
+	msgError
+)
+
+type frame struct {
+	typ    byte
+	fields [][]byte
+}
+
+func writeFrame(w *bufio.Writer, typ byte, fields ...[]byte) error {
+	size := 1
+	for _, f := range fields {
+		size += uvarintLen(uint64(len(f))) + len(f)
+	}
+	if size > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	var buf [binary.MaxVarintLen64]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(size))
+	w.Write(buf[:4])
+	w.WriteByte(typ)
+	for _, f := range fields {
+		w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(f)))])
+		w.Write(f)
+	}
+	// bufio.Writer keeps the first error, for Flush to return.
+	return nil
+}
+
+func readFrame(r *bufio.Reader) (frame, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frame{}, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > MaxFrameSize {
+		return frame{}, ErrFrameTooLarge
+	}
+	if size == 0 {
+		return frame{}, errMalformed
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return frame{}, err
+	}
+	f := frame{typ: body[0]}
+	for rest := body[1:]; len(rest) > 0; {
+		n, m := binary.Uvarint(rest)
+		if m <= 0 || n > uint64(len(rest)-m) {
+			return frame{}, errMalformed
+		}
+		rest = rest[m:]
+		f.fields = append(f.fields, rest[:n:n])
+		rest = rest[n:]
+	}
+	return f, nil
+}
+
+var errMalformed = errors.New("daemon: malformed frame")
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// expect returns errMalformed unless |f| is of type |typ| with |n| fields.
+func (f frame) expect(typ byte, n int) error {
+	if f.typ != typ || len(f.fields) != n {
+		return errMalformed
+	}
+	return nil
+}
+
+// errorCodes are the errors that keep their identity over the socket, by
+// the code they are sent with. Other errors are sent with code 0, and only
+// their message.
+var errorCodes = []error{
+	1: blockstore.ErrNotFound,
+	2: blockstore.ErrReadOnly,
+	3: blockstore.ErrHashMismatch,
+	4: blocks.ErrBlockTooLarge,
+	5: blockservice.ErrTimeout,
+	6: ErrFrameTooLarge,
+	7: errMalformed,
+	8: blockservice.ErrClosed,
+}
+
+// writeError answers a request with |err|. Not found errors are sent as
+// blockstore.ErrNotFound, which exchanges report misses with.
+func writeError(w *bufio.Writer, err error) error {
+	if errors.Is(err, blockstore.ErrNotFound) || errors.Is(err, ds.ErrNotFound) {
+		err = blockstore.ErrNotFound
+	}
+	code := 0
+	for i, e := range errorCodes {
+		if e != nil && errors.Is(err, e) {
+			code = i
+		}
+	}
+	return writeFrame(w, msgError, []byte{byte(code)}, []byte(err.Error()))
+}
+
+// remoteError returns the error an Error frame carries.
+func remoteError(f frame) error {
+	if err := f.expect(msgError, 2); err != nil || len(f.fields[0]) != 1 {
+		return errMalformed
+	}
+	if code := int(f.fields[0][0]); code > 0 && code < len(errorCodes) {
+		return errorCodes[code]
+	}
+	return fmt.Errorf("daemon: %s", f.fields[1])
+}
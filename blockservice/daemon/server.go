@@ -0,0 +1,270 @@
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrServerClosed is returned by Serve once the Server is closed.
+var ErrServerClosed = errors.New("daemon: server closed")
+
+// Server serves a BlockService over the connections of listeners, such as
+// one made with net.Listen("unix", path). Reads go through s.GetBlock and
+// s.GetBlocks, and so the exchange; Has only asks the blockstore, as the
+// HEAD of package blockservice/http does.
+type Server struct {
+	s      *blockservice.BlockService
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a Server of |s|.
+func NewServer(s *blockservice.BlockService) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		s:         s,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve serves the connections |l| accepts until it fails, returning its
+// error, or until the Server is closed, returning ErrServerClosed. It
+// closes |l|.
+func (sv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if !sv.addListener(l) {
+		return ErrServerClosed
+	}
+	defer sv.removeListener(l)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if sv.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !sv.addConn(c) {
+			c.Close()
+			return ErrServerClosed
+		}
+		go sv.serveConn(c)
+	}
+}
+
+// Close stops the Server: it closes its listeners and connections, gives up
+// the reads in progress, and waits for their handlers to return.
+func (sv *Server) Close() error {
+	sv.mu.Lock()
+	if sv.closed {
+		sv.mu.Unlock()
+		return nil
+	}
+	sv.closed = true
+	for l := range sv.listeners {
+		l.Close()
+	}
+	for c := range sv.conns {
+		c.Close()
+	}
+	sv.mu.Unlock()
+	sv.cancel()
+	sv.wg.Wait()
+	return nil
+}
+
+func (sv *Server) isClosed() bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.closed
+}
+
+// addListener and addConn track |l| and |c|, for Close, unless the Server
+// is closed. The handler of a tracked connection is waited for by Close.
+func (sv *Server) addListener(l net.Listener) bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.closed {
+		return false
+	}
+	sv.listeners[l] = struct{}{}
+	return true
+}
+
+func (sv *Server) addConn(c net.Conn) bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.closed {
+		return false
+	}
+	sv.conns[c] = struct{}{}
+	sv.wg.Add(1)
+	return true
+}
+
+func (sv *Server) removeListener(l net.Listener) {
+	sv.mu.Lock()
+	delete(sv.listeners, l)
+	sv.mu.Unlock()
+}
+
+func (sv *Server) removeConn(c net.Conn) {
+	sv.mu.Lock()
+	delete(sv.conns, c)
+	sv.mu.Unlock()
+}
+
+func (sv *Server) serveConn(c net.Conn) {
+	defer sv.wg.Done()
+	defer sv.removeConn(c)
+	defer c.Close()
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+	for {
+		req, err := readFrame(r)
+		if err != nil {
+			if err != errMalformed && !errors.Is(err, ErrFrameTooLarge) {
+				return
+			}
+			// the rest of the stream can't be trusted: answer and hang up.
+			writeError(w, err)
+			w.Flush()
+			return
+		}
+		if err := sv.handle(w, req); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers |req|, returning an error only if the connection failed.
+func (sv *Server) handle(w *bufio.Writer, req frame) error {
+	ctx := sv.ctx
+	switch req.typ {
+	case opGet:
+		if len(req.fields) != 1 {
+			break
+		}
+		b, err := sv.s.GetBlock(ctx, key.Key(req.fields[0]))
+		if err != nil {
+			return writeError(w, err)
+		}
+		if err := writeFrame(w, msgBlock, []byte(b.Key()), b.Data); !errors.Is(err, ErrFrameTooLarge) {
+			return err
+		}
+		return writeError(w, ErrFrameTooLarge)
+	case opGetMany:
+		return sv.getMany(w, req.fields)
+	case opPut:
+		if len(req.fields) != 2 {
+			break
+		}
+		k, err := sv.put(ctx, key.Key(req.fields[0]), req.fields[1])
+		if err != nil {
+			return writeError(w, err)
+		}
+		return writeFrame(w, msgKey, []byte(k))
+	case opHas:
+		if len(req.fields) != 1 {
+			break
+		}
+		has, err := sv.s.Blockstore.Has(key.Key(req.fields[0]))
+		if err != nil {
+			return writeError(w, err)
+		}
+		v := []byte{0}
+		if has {
+			v[0] = 1
+		}
+		return writeFrame(w, msgHas, v)
+	case opDelete:
+		if len(req.fields) != 1 {
+			break
+		}
+		if err := sv.s.DeleteBlockCtx(ctx, key.Key(req.fields[0])); err != nil {
+			return writeError(w, err)
+		}
+		return writeFrame(w, msgOK)
+	}
+	return writeError(w, errMalformed)
+}
+
+func (sv *Server) getMany(w *bufio.Writer, fields [][]byte) error {
+	ks := make([]key.Key, len(fields))
+	for i, f := range fields {
+		ks[i] = key.Key(f)
+	}
+	ctx, cancel := context.WithCancel(sv.ctx)
+	defer cancel()
+	var werr error
+	for b := range sv.s.GetBlocks(ctx, ks) {
+		if werr != nil {
+			continue // drain the blocks already on their way.
+		}
+		switch werr = writeFrame(w, msgBlock, []byte(b.Key()), b.Data); {
+		case werr == nil:
+			werr = w.Flush()
+		case errors.Is(werr, ErrFrameTooLarge):
+			werr = nil // left out, as blocks not found are.
+			continue
+		}
+		if werr != nil {
+			cancel()
+		}
+	}
+	if werr != nil {
+		return werr
+	}
+	return writeFrame(w, msgEnd)
+}
+
+// put stores |data| under |k|, which must match it, or keyed as the
+// service keys new blocks if |k| is empty.
+func (sv *Server) put(ctx context.Context, k key.Key, data []byte) (key.Key, error) {
+	var b *blocks.Block
+	var err error
+	if k == "" {
+		b, err = sv.s.NewBlock(data)
+	} else {
+		b, err = toBlock(k, data)
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = sv.s.AddBlockCtx(ctx, b)
+	// a block stored but not announced is still stored.
+	var nae *blockservice.NotAnnouncedError
+	if err != nil && !errors.As(err, &nae) {
+		return "", err
+	}
+	return b.Key(), nil
+}
+
+// toBlock returns the block of |data| known by |k|, checking that they
+// match.
+func toBlock(k key.Key, data []byte) (*blocks.Block, error) {
+	if err := blockstore.Verify(k, data); err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithKey(data, k)
+}
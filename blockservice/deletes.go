@@ -0,0 +1,222 @@
+package blockservice
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// DefaultDeleteBatch is the number of blocks DeleteBlocks removes with each
+// Blockstore.ApplyBatch, unless DeleteBatchSize says otherwise.
+const DefaultDeleteBatch = 256
+
+// ErrDeleteAborted is reported by an AllOrNothing DeleteBlocks for the keys
+// left stored because another one failed.
+var ErrDeleteAborted = errors.New("blockservice: delete aborted")
+
+// DeleteResult is the outcome of deleting one key with DeleteBlocks: nil, or
+// the Err saying why it was not deleted.
+type DeleteResult struct {
+	Key key.Key
+	Err error
+}
+
+// DeleteOption changes how DeleteBlocks deletes its blocks.
+type DeleteOption func(*deleteOptions)
+
+type deleteOptions struct {
+	allOrNothing bool
+	batch        int
+}
+
+// AllOrNothing makes DeleteBlocks delete every block in a single
+// Blockstore.ApplyBatch, once it knows each of them may be, so that a
+// failure leaves them all stored: the key that failed is reported with its
+// error, and the others with ErrDeleteAborted. The batch is only atomic if
+// the blockstore's is; see blockstore.ApplyBatch.
+func AllOrNothing() DeleteOption {
+	return func(o *deleteOptions) { o.allOrNothing = true }
+}
+
+// DeleteBatchSize makes DeleteBlocks remove |n| blocks with each
+// Blockstore.ApplyBatch, DefaultDeleteBatch if not positive. AllOrNothing
+// overrides it.
+func DeleteBatchSize(n int) DeleteOption {
+	return func(o *deleteOptions) { o.batch = n }
+}
+
+// DeleteBlocks deletes the blocks |ks|, such as those of a DAG no longer
+// pinned, a batch of them at a time rather than a DeleteBlock each, and
+// sends one result for each distinct key as its batch is done. By default
+// it does what it can: a failed batch is reported for its keys, and the
+// next one is tried. A key not stored is reported with ErrNotFound, and
+// left out of the batches. With reference
+// counting, a key with references left has one released, as by DeleteBlock,
+// and is reported as deleted.
+//
+// Results keep coming after |ctx| is done, reporting ctx.Err() for the keys
+// not deleted yet, so the channel must be drained.
+func (s *BlockService) DeleteBlocks(ctx context.Context, ks []key.Key, opts ...DeleteOption) <-chan DeleteResult {
+	o := deleteOptions{batch: DefaultDeleteBatch}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.batch <= 0 {
+		o.batch = DefaultDeleteBatch
+	}
+	out := make(chan DeleteResult)
+	go func() {
+		defer close(out)
+		ks := distinctKeys(withoutEmptyKeys(ks))
+		fail := func(ks []key.Key, err error) {
+			for _, k := range ks {
+				out <- DeleteResult{Key: k, Err: err}
+			}
+		}
+		if err := s.checkOpen(); err != nil {
+			fail(ks, err)
+			return
+		}
+		if s.readOnly {
+			fail(ks, blockstore.ErrReadOnly)
+			return
+		}
+		if o.allOrNothing {
+			o.batch = len(ks)
+		}
+		for len(ks) > 0 {
+			n := o.batch
+			if n > len(ks) {
+				n = len(ks)
+			}
+			batch := ks[:n]
+			ks = ks[n:]
+			if err := ctx.Err(); err != nil {
+				fail(batch, err)
+				fail(ks, err)
+				return
+			}
+			for _, r := range s.deleteBatch(ctx, batch, o.allOrNothing) {
+				out <- r
+			}
+		}
+	}()
+	return out
+}
+
+func distinctKeys(ks []key.Key) []key.Key {
+	seen := make(map[key.Key]struct{}, len(ks))
+	var out []key.Key
+	for _, k := range ks {
+		if _, dup := seen[k]; !dup {
+			seen[k] = struct{}{}
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// deleteBatch deletes |ks| with one Blockstore.ApplyBatch, and returns their
+// results. If |strict|, a key that cannot be deleted aborts the others.
+func (s *BlockService) deleteBatch(ctx context.Context, ks []key.Key, strict bool) (results []DeleteResult) {
+	start := time.Now()
+	defer func() {
+		var err error
+		for _, r := range results {
+			if r.Err != nil && !errors.Is(r.Err, ErrNotFound) {
+				err = r.Err
+				break
+			}
+		}
+		s.observe(OpDeleteBlocks, writeOutcome(err), start, "", -1, err)
+	}()
+	if s.refs != nil {
+		s.refs.mu.Lock()
+		defer s.refs.mu.Unlock()
+	}
+
+	// which of |ks| to remove, and, with reference counting, the counts of
+	// the others to lower instead.
+	var dels []key.Key
+	released := make(map[key.Key]uint64)
+	for _, k := range ks {
+		err := s.checkDelete(k, &dels, released)
+		if err == nil {
+			continue
+		}
+		if strict && !errors.Is(err, ErrNotFound) {
+			return abortDeletes(ks, k, err)
+		}
+		results = append(results, DeleteResult{Key: k, Err: err})
+	}
+
+	if len(dels) > 0 {
+		err := s.guardWrite(func() error { return s.Blockstore.ApplyBatch(ctx, nil, dels) })
+		if err != nil {
+			if strict {
+				return abortDeletes(ks, "", err)
+			}
+			for _, k := range dels {
+				results = append(results, DeleteResult{Key: k, Err: err})
+			}
+			dels = nil
+		}
+	}
+	atomic.AddUint64(&s.stats.deleted, uint64(len(dels)))
+	for _, k := range dels {
+		s.publish(EventDeleted, k)
+		var err error
+		if s.refs != nil {
+			err = s.refs.forget(k)
+		}
+		results = append(results, DeleteResult{Key: k, Err: err})
+	}
+	for k, n := range released {
+		err := s.refs.store.PutMetadata(refsKind, k, encodeCount(n-1))
+		results = append(results, DeleteResult{Key: k, Err: err})
+	}
+	return results
+}
+
+// checkDelete adds |k| to |dels| if it is to be removed, or to |released|,
+// with its count, if only a reference is to be released. It returns
+// ErrNotFound if |k| is not stored.
+func (s *BlockService) checkDelete(k key.Key, dels *[]key.Key, released map[key.Key]uint64) error {
+	has, err := s.Blockstore.Has(k)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return ErrNotFound
+	}
+	if s.refs != nil {
+		n, err := s.refs.count(k)
+		if err != nil {
+			return err
+		}
+		if n > 1 {
+			released[k] = n
+			return nil
+		}
+	}
+	*dels = append(*dels, k)
+	return nil
+}
+
+// abortDeletes reports |err| for |failed|, if any, and ErrDeleteAborted for
+// the rest of |ks|.
+func abortDeletes(ks []key.Key, failed key.Key, err error) []DeleteResult {
+	results := make([]DeleteResult, len(ks))
+	for i, k := range ks {
+		results[i] = DeleteResult{Key: k, Err: ErrDeleteAborted}
+		if k == failed || failed == "" {
+			results[i].Err = err
+		}
+	}
+	return results
+}
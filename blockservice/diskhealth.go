@@ -0,0 +1,264 @@
+package blockservice
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+)
+
+// ErrDiskUnhealthy is returned by the reads and writes the disk breaker
+// turns away while it is open. See WithDiskBreaker.
+var ErrDiskUnhealthy = errors.New("blockservice: blockstore unhealthy")
+
+// BreakerState is the state of the disk breaker, as Stats reports it.
+type BreakerState int32
+
+const (
+	// BreakerClosed lets every operation through to the blockstore. It is
+	// the state of a service without a breaker.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen turns operations away, the blockstore having been too
+	// slow, or failed, too often.
+	BreakerOpen
+	// BreakerHalfOpen lets one operation through, to find out whether the
+	// blockstore has recovered.
+	BreakerHalfOpen
+)
+
+func (st BreakerState) String() string {
+	switch st {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// DiskBreaker configures the circuit breaker WithDiskBreaker puts in front
+// of the blockstore, so that a dying disk fails its callers fast instead of
+// stalling every one of them.
+//
+// The breaker watches the latest Window reads and writes of blocks. An
+// operation is bad if it took longer than SlowThreshold, or failed other
+// than with blockstore.ErrNotFound. Once MaxBad of the operations watched are
+// bad, the breaker opens: reads and writes fail at once with
+// ErrDiskUnhealthy, or, for reads with PreferExchange, are sent to the
+// exchange as misses. After Cooldown, one operation is let through: if it
+// is good the breaker closes, and otherwise it opens for another Cooldown.
+type DiskBreaker struct {
+	// SlowThreshold is the latency above which an operation is bad. Zero
+	// counts only failures.
+	SlowThreshold time.Duration
+	// Window is the number of latest operations watched, 20 if zero.
+	Window int
+	// MaxBad is the number of bad operations in the Window that opens the
+	// breaker, at most Window; half of Window if zero.
+	MaxBad int
+	// Cooldown is how long the breaker stays open, 10 seconds if zero.
+	Cooldown time.Duration
+	// PreferExchange makes reads fetch from the exchange while the breaker
+	// is open, instead of failing. Writes fail either way.
+	PreferExchange bool
+}
+
+// WithDiskBreaker puts the circuit breaker |b| describes in front of the
+// blockstore. See DiskBreaker. By default there is none.
+func WithDiskBreaker(b DiskBreaker) Option {
+	return func(o *options) { o.diskBreaker = &b }
+}
+
+func (b DiskBreaker) validate() error {
+	switch {
+	case b.SlowThreshold < 0 || b.Cooldown < 0:
+		return fmt.Errorf("blockservice: disk breaker durations must not be negative")
+	case b.Window < 0 || b.MaxBad < 0:
+		return fmt.Errorf("blockservice: disk breaker window must not be negative")
+	case b.Window > 0 && b.MaxBad > b.Window:
+		return fmt.Errorf("blockservice: disk breaker MaxBad must be at most the window, got %d of %d", b.MaxBad, b.Window)
+	}
+	return nil
+}
+
+// breaker implements DiskBreaker. A nil *breaker lets everything through.
+type breaker struct {
+	cfg DiskBreaker
+
+	mu       sync.Mutex
+	state    BreakerState
+	outcomes []bool // ring of the latest operations, true for bad ones
+	next     int
+	bad      int
+	openedAt time.Time
+	trips    uint64
+}
+
+func newBreaker(cfg *DiskBreaker) *breaker {
+	if cfg == nil {
+		return nil
+	}
+	c := *cfg
+	if c.Window == 0 {
+		c.Window = 20
+	}
+	if c.MaxBad == 0 {
+		c.MaxBad = (c.Window + 1) / 2
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = 10 * time.Second
+	}
+	return &breaker{cfg: c, outcomes: make([]bool, c.Window)}
+}
+
+// begin reports whether an operation may go to the blockstore, and returns
+// the func to call with its error once it is done, which reports whether the
+// breaker opened.
+func (b *breaker) begin() (finish func(error) bool, ok bool) {
+	if b == nil {
+		return func(error) bool { return false }, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := false
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cfg.Cooldown {
+			return nil, false
+		}
+		b.state = BreakerHalfOpen
+		probe = true
+	case BreakerHalfOpen:
+		return nil, false
+	}
+	start := time.Now()
+	return func(err error) bool { return b.record(probe, time.Since(start), err) }, true
+}
+
+func (b *breaker) record(probe bool, d time.Duration, err error) (opened bool) {
+	bad := err != nil && !errors.Is(err, blockstore.ErrNotFound) || b.cfg.SlowThreshold > 0 && d > b.cfg.SlowThreshold
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		if bad {
+			b.open()
+			return true
+		}
+		b.state = BreakerClosed
+		for i := range b.outcomes {
+			b.outcomes[i] = false
+		}
+		b.bad = 0
+		return false
+	}
+	if b.state != BreakerClosed {
+		// begun before the breaker opened; the probe decides.
+		return false
+	}
+	if b.outcomes[b.next] {
+		b.bad--
+	}
+	b.outcomes[b.next] = bad
+	b.next = (b.next + 1) % len(b.outcomes)
+	if bad {
+		if b.bad++; b.bad >= b.cfg.MaxBad {
+			b.open()
+			b.trips++
+			return true
+		}
+	}
+	return false
+}
+
+// open opens the breaker. b.mu must be held.
+func (b *breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+}
+
+// trip opens the breaker, and reports whether it was not open already.
+func (b *breaker) trip() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		return false
+	}
+	b.open()
+	b.trips++
+	return true
+}
+
+// State returns the breaker's state, and how many times it opened.
+func (b *breaker) State() (BreakerState, uint64) {
+	if b == nil {
+		return BreakerClosed, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state, b.trips
+}
+
+// guardRead makes the blockstore read |op| through the disk breaker,
+// recording its latency. A read the breaker turns away fails with
+// ErrDiskUnhealthy, or with blockstore.ErrNotFound, for the exchange to
+// answer, if the breaker prefers it.
+func (s *BlockService) guardRead(op func() error) error {
+	finish, ok := s.disk.begin()
+	if !ok {
+		if s.disk.cfg.PreferExchange {
+			return blockstore.ErrNotFound
+		}
+		return ErrDiskUnhealthy
+	}
+	start := time.Now()
+	err := s.recovered("blockstore read", op)
+	s.stats.blockstoreLatency.observe(time.Since(start))
+	if s.finishGuarded(finish, err) {
+		s.logBreakerOpened(err)
+	}
+	return err
+}
+
+// guardWrite is guardRead for the blockstore write |op|, which fails with
+// ErrDiskUnhealthy if turned away.
+func (s *BlockService) guardWrite(op func() error) error {
+	finish, ok := s.disk.begin()
+	if !ok {
+		return ErrDiskUnhealthy
+	}
+	start := time.Now()
+	err := s.recovered("blockstore write", op)
+	s.stats.blockstoreWriteLatency.observe(time.Since(start))
+	if s.finishGuarded(finish, err) {
+		s.logBreakerOpened(err)
+	}
+	return err
+}
+
+// finishGuarded records the outcome |err| of a guarded operation with
+// |finish|, opening the breaker on a panic if the PanicPolicy says to, and
+// reports whether it opened.
+func (s *BlockService) finishGuarded(finish func(error) bool, err error) bool {
+	opened := finish(err)
+	if !opened && s.tripsOnPanic(err) {
+		opened = s.disk.trip()
+	}
+	return opened
+}
+
+// logBreakerOpened logs that the disk breaker opened on an operation that
+// failed with |err|, or was slow if nil.
+func (s *BlockService) logBreakerOpened(err error) {
+	fields := []Field{{"cooldown", s.disk.cfg.Cooldown}}
+	if err != nil {
+		fields = append(fields, Field{"error", err})
+	}
+	s.log(LevelWarn, "blockservice disk breaker opened", fields...)
+}
@@ -0,0 +1,166 @@
+package blockservice
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind by
+// before further ones are dropped for it.
+const subscriberBuffer = 256
+
+// EventType is a kind of BlockEvent.
+type EventType int
+
+const (
+	// EventAdded is published for each block stored by an add.
+	EventAdded EventType = iota
+	// EventFetched is published for each block received from the
+	// exchange that passed verification, whether or not it was stored.
+	EventFetched
+	// EventDeleted is published for each block removed by DeleteBlock.
+	EventDeleted
+	// EventEvicted is published for each block the service removed of its
+	// own accord, such as when its TTL ran out; see EnableExpiry.
+	EventEvicted
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAdded:
+		return "added"
+	case EventFetched:
+		return "fetched"
+	case EventDeleted:
+		return "deleted"
+	case EventEvicted:
+		return "evicted"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// BlockEvent is something that happened to a block of the service.
+type BlockEvent struct {
+	Type EventType
+	Key  key.Key
+	Time time.Time
+}
+
+// Subscribe returns a channel receiving the events of the given types, or
+// of every type if none are given, from now until |ctx| is done or the
+// service is closed, when it is closed. Events are published without
+// waiting on subscribers: those a subscriber isn't keeping up with are
+// dropped for it, and counted in Stats.DroppedEvents.
+func (s *BlockService) Subscribe(ctx context.Context, events ...EventType) <-chan BlockEvent {
+	return s.events.subscribe(ctx, events, nil)
+}
+
+// Watch calls |fn| with every event of the given types, or of every type if
+// none are given, from now until |ctx| is done or the service is closed.
+// Unlike Subscribe it drops none: |fn| is called by whatever published the
+// event, before it returns, so it must be quick, and must not block or call
+// back into the service.
+func (s *BlockService) Watch(ctx context.Context, fn func(BlockEvent), events ...EventType) {
+	s.events.subscribe(ctx, events, fn)
+}
+
+// publish sends an event of type |t| for |k| to its subscribers.
+func (s *BlockService) publish(t EventType, k key.Key) {
+	s.events.publish(BlockEvent{Type: t, Key: k, Time: time.Now()})
+}
+
+// eventHub keeps the subscribers of Subscribe.
+type eventHub struct {
+	dropped *uint64 // atomic
+
+	mu     sync.RWMutex
+	subs   map[*subscriber]struct{}
+	closed bool
+	done   chan struct{}
+}
+
+type subscriber struct {
+	types uint // bit set of EventTypes
+	ch    chan BlockEvent
+	fn    func(BlockEvent) // instead of ch, for Watch
+}
+
+func newEventHub(dropped *uint64) *eventHub {
+	return &eventHub{
+		dropped: dropped,
+		subs:    make(map[*subscriber]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (h *eventHub) subscribe(ctx context.Context, events []EventType, fn func(BlockEvent)) <-chan BlockEvent {
+	sub := &subscriber{ch: make(chan BlockEvent, subscriberBuffer), fn: fn}
+	if len(events) == 0 {
+		sub.types = ^uint(0)
+	}
+	for _, t := range events {
+		sub.types |= 1 << uint(t)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(sub.ch)
+		return sub.ch
+	}
+	h.subs[sub] = struct{}{}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-h.done:
+			return // Close closed it.
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[sub]; ok {
+			delete(h.subs, sub)
+			close(sub.ch)
+		}
+	}()
+	return sub.ch
+}
+
+func (h *eventHub) publish(e BlockEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subs {
+		if sub.types&(1<<uint(e.Type)) == 0 {
+			continue
+		}
+		if sub.fn != nil {
+			sub.fn(e)
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			atomic.AddUint64(h.dropped, 1)
+		}
+	}
+}
+
+// Close closes the channels of every subscriber.
+func (h *eventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for sub := range h.subs {
+		close(sub.ch)
+	}
+	h.subs = nil
+	close(h.done)
+}
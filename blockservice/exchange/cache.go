@@ -0,0 +1,293 @@
+package exchange
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// DefaultCacheEntries is how many keys Cached remembers, unless
+// CacheOptions.Entries says otherwise.
+const DefaultCacheEntries = 4096
+
+// CacheOptions configures Cached.
+type CacheOptions struct {
+	// Found is how long a fetched block is kept, to be returned to the next
+	// callers wanting it without asking the exchange. Zero keeps none.
+	Found time.Duration
+	// Missing is how long a failure to fetch a key is remembered, the
+	// callers wanting it until then failing at once with the same error.
+	// Zero remembers none.
+	Missing time.Duration
+	// Entries bounds how many keys are remembered, the least recently used
+	// being forgotten first. DefaultCacheEntries if not positive.
+	Entries int
+}
+
+// Cached returns an exchange that fetches from |ex|, remembering for a while
+// which keys it recently returned or failed to, as |o| says, so that many
+// callers hammering a key the network lacks cost one request rather than
+// one each. Concurrent GetBlock calls for a key share a single request to
+// |ex|, which is withdrawn once none of them waits for it, and which sees
+// the values, such as a provenance recorder, of the first caller's context
+// only. Only failures of requests that ended by themselves are remembered:
+// an exchange that waits until its caller gives up never fails for Cached.
+// Keys a GetBlocks stream leaves out are remembered as missing, with
+// blockstore.ErrNotFound.
+//
+// Announcing a block makes Cached forget that it was missing. Announcements,
+// Cancel and Close go to |ex|, and the exchange is an Onliner, a
+// HintedAnnouncer and an Accountant as Tiered is, with |ex| as its one tier.
+func Cached(ex Interface, o CacheOptions) Interface {
+	if o.Entries <= 0 {
+		o.Entries = DefaultCacheEntries
+	}
+	return &cached{
+		group:   group{ex},
+		ex:      ex,
+		opts:    o,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[key.Key]*list.Element),
+		flights: make(map[key.Key]*flight),
+	}
+}
+
+type cached struct {
+	group
+	ex   Interface
+	opts CacheOptions
+	now  func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, the most recently used first.
+	entries map[key.Key]*list.Element
+	flights map[key.Key]*flight
+}
+
+type cacheEntry struct {
+	k       key.Key
+	b       *blocks.Block
+	err     error
+	expires time.Time
+}
+
+// flight is a GetBlock request shared by the callers wanting its key.
+type flight struct {
+	done    chan struct{}
+	b       *blocks.Block
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func (c *cached) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	c.mu.Lock()
+	if e, ok := c.lookup(k); ok {
+		c.mu.Unlock()
+		return e.b, e.err
+	}
+	f, ok := c.flights[k]
+	if !ok {
+		fctx, cancel := context.WithCancel(detached{ctx})
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		c.flights[k] = f
+		go c.fetch(fctx, k, f)
+	}
+	f.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.b, f.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		if f.waiters--; f.waiters == 0 {
+			// later callers start a request of their own.
+			if c.flights[k] == f {
+				delete(c.flights, k)
+			}
+			f.cancel()
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// fetch makes the request of |f|, remembering its outcome unless every
+// caller gave up on it.
+func (c *cached) fetch(ctx context.Context, k key.Key, f *flight) {
+	b, err := c.ex.GetBlock(ctx, k)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.b, f.err = b, err
+	if c.flights[k] == f {
+		delete(c.flights, k)
+	}
+	if ctx.Err() == nil {
+		c.remember(k, b, err)
+	}
+	f.cancel()
+	close(f.done)
+}
+
+// GetBlocks sends the blocks Cached keeps of |ks|, leaves out those it
+// remembers missing, and asks |ex| for the others.
+func (c *cached) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	var hits []*blocks.Block
+	var rest []key.Key
+	c.mu.Lock()
+	for _, k := range ks {
+		e, ok := c.lookup(k)
+		switch {
+		case !ok:
+			rest = append(rest, k)
+		case e.err == nil:
+			hits = append(hits, e.b)
+		}
+	}
+	c.mu.Unlock()
+
+	var in <-chan *blocks.Block
+	if len(rest) > 0 {
+		var err error
+		if in, err = c.ex.GetBlocks(ctx, rest); err != nil {
+			return nil, err
+		}
+	}
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		for _, b := range hits {
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if in == nil {
+			return
+		}
+		missing := make(map[key.Key]struct{}, len(rest))
+		for _, k := range rest {
+			missing[k] = struct{}{}
+		}
+		for b := range in {
+			delete(missing, b.Key())
+			c.mu.Lock()
+			c.remember(b.Key(), b, nil)
+			c.mu.Unlock()
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		c.mu.Lock()
+		for k := range missing {
+			c.remember(k, nil, blockstore.ErrNotFound)
+		}
+		c.mu.Unlock()
+	}()
+	return out, nil
+}
+
+func (c *cached) HasBlock(ctx context.Context, b *blocks.Block) error {
+	return c.HasBlockWithHints(ctx, b, nil)
+}
+
+func (c *cached) HasBlockWithHints(ctx context.Context, b *blocks.Block, hints []string) error {
+	c.mu.Lock()
+	if elem, ok := c.entries[b.Key()]; ok && elem.Value.(*cacheEntry).err != nil {
+		c.forget(elem)
+	}
+	c.mu.Unlock()
+	return c.group.HasBlockWithHints(ctx, b, hints)
+}
+
+// Cancel withdraws the wants of |ks| but those of shared GetBlock requests,
+// which are withdrawn when their last caller gives up.
+func (c *cached) Cancel(ctx context.Context, ks []key.Key) error {
+	var rest []key.Key
+	c.mu.Lock()
+	for _, k := range ks {
+		if _, ok := c.flights[k]; !ok {
+			rest = append(rest, k)
+		}
+	}
+	c.mu.Unlock()
+	if len(rest) == 0 {
+		return nil
+	}
+	return c.ex.Cancel(ctx, rest)
+}
+
+func (c *cached) Close() error {
+	c.mu.Lock()
+	c.lru.Init()
+	c.entries = make(map[key.Key]*list.Element)
+	c.mu.Unlock()
+	return c.ex.Close()
+}
+
+// lookup returns what is remembered of |k|, if it has not expired. c.mu must
+// be held.
+func (c *cached) lookup(k key.Key) (*cacheEntry, bool) {
+	elem, ok := c.entries[k]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.forget(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return e, true
+}
+
+// remember records that fetching |k| returned |b| or |err|, for as long as
+// the options say. c.mu must be held.
+func (c *cached) remember(k key.Key, b *blocks.Block, err error) {
+	ttl := c.opts.Found
+	if err != nil {
+		ttl = c.opts.Missing
+	}
+	if ttl <= 0 {
+		return
+	}
+	e := &cacheEntry{k: k, b: b, err: err, expires: c.now().Add(ttl)}
+	if elem, ok := c.entries[k]; ok {
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[k] = c.lru.PushFront(e)
+	for c.lru.Len() > c.opts.Entries {
+		c.forget(c.lru.Back())
+	}
+}
+
+func (c *cached) forget(elem *list.Element) {
+	delete(c.entries, elem.Value.(*cacheEntry).k)
+	c.lru.Remove(elem)
+}
+
+// detached carries the values of a context, but not its deadline or
+// cancellation.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
@@ -0,0 +1,134 @@
+package exchange
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestCachedSharesAndRemembers(t *testing.T) {
+	ctx := context.Background()
+	found, lost := blocks.NewBlock([]byte("found")), blocks.NewBlock([]byte("lost"))
+	f := newFake(20*time.Millisecond, found)
+	ex := Cached(f, CacheOptions{Found: time.Minute, Missing: time.Second})
+	now := time.Now()
+	ex.(*cached).now = func() time.Time { return now }
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = ex.GetBlock(ctx, lost.Key())
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != errMissing {
+			t.Fatalf("expected errMissing, got %v", err)
+		}
+	}
+	if n := f.askedFor(); n != 1 {
+		t.Fatalf("expected 1 request for concurrent callers, got %d", n)
+	}
+	if _, err := ex.GetBlock(ctx, lost.Key()); err != errMissing || f.askedFor() != 1 {
+		t.Fatalf("expected the failure remembered, got %v after %d requests", err, f.askedFor())
+	}
+	now = now.Add(time.Second)
+	if _, err := ex.GetBlock(ctx, lost.Key()); err != errMissing || f.askedFor() != 2 {
+		t.Fatalf("expected the failure forgotten, got %v after %d requests", err, f.askedFor())
+	}
+	if err := ex.HasBlock(ctx, lost); err != nil {
+		t.Fatal(err)
+	}
+	if ex.GetBlock(ctx, lost.Key()); f.askedFor() != 3 {
+		t.Fatal("expected an announced block no longer remembered missing")
+	}
+
+	for i := 0; i < 2; i++ {
+		if b, err := ex.GetBlock(ctx, found.Key()); err != nil || b != found {
+			t.Fatalf("expected the block, got %v", err)
+		}
+	}
+	if n := f.askedFor(); n != 4 {
+		t.Fatalf("expected the block kept, got %d requests", n)
+	}
+
+	// a stream serves what is kept, and remembers what it left out.
+	none := blocks.NewBlock([]byte("none"))
+	out, err := ex.GetBlocks(ctx, []key.Key{found.Key(), none.Key()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range out {
+		n++
+	}
+	if n != 1 || f.askedFor() != 5 {
+		t.Fatalf("expected 1 block and 5 requests, got %d and %d", n, f.askedFor())
+	}
+	if _, err := ex.GetBlock(ctx, none.Key()); err != blockstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCachedWithdrawsAbandonedRequests(t *testing.T) {
+	k := blocks.NewBlock([]byte("slow")).Key()
+	f := newFake(time.Hour)
+	ex := Cached(f, CacheOptions{Missing: time.Minute})
+
+	patient, cancelPatient := context.WithCancel(context.Background())
+	impatient, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	errs := make(chan error, 2)
+	go func() {
+		_, err := ex.GetBlock(patient, k)
+		errs <- err
+	}()
+	c := ex.(*cached)
+	for waiting := false; !waiting; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		waiting = c.flights[k] != nil
+		c.mu.Unlock()
+	}
+	if _, err := ex.GetBlock(impatient, k); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline exceeded, got %v", err)
+	}
+	f.mu.Lock()
+	cancelled := f.cancelled
+	f.mu.Unlock()
+	if cancelled {
+		t.Fatal("expected the request kept for the caller still waiting")
+	}
+
+	cancelPatient()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected the request cancelled, got %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mu.Lock()
+		cancelled = f.cancelled
+		f.mu.Unlock()
+		if cancelled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the request withdrawn once no caller waits")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.lookup(k); ok {
+		t.Fatal("expected an abandoned request not remembered")
+	}
+}
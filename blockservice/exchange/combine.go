@@ -0,0 +1,283 @@
+package exchange
+
+import (
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Tiered returns an exchange that fetches from |tiers| in order, asking each
+// only for the blocks the ones before it failed to return, such as a LAN
+// exchange before a wider network one. A tier's GetBlocks must close its
+// channel before the next tier is asked, so those that wait for blocks to
+// turn up belong last.
+//
+// Blocks are announced to, wants cancelled on and Close called for every
+// tier, the first error being returned. The exchange is an Onliner, online
+// while any tier is; tiers that are not Onliners count as online. Hints are
+// passed to the tiers that are HintedAnnouncers. It is an Accountant too,
+// whose ledgers add up those of the tiers that are Accountants.
+func Tiered(tiers ...Interface) Interface {
+	return &tiered{group(tiers)}
+}
+
+// Race returns an exchange that asks all of |exchanges| for each block at
+// once. The first to deliver a block wins, and the others' requests for it
+// are cancelled. Otherwise it behaves as Tiered does.
+func Race(exchanges ...Interface) Interface {
+	return &race{group(exchanges)}
+}
+
+var errNoExchanges = errors.New("exchange: no exchanges to fetch from")
+
+// group implements what Tiered and Race have in common.
+type group []Interface
+
+func (g group) HasBlock(ctx context.Context, b *blocks.Block) error {
+	return g.HasBlockWithHints(ctx, b, nil)
+}
+
+func (g group) HasBlockWithHints(ctx context.Context, b *blocks.Block, hints []string) error {
+	return g.each(func(ex Interface) error {
+		if ha, ok := ex.(HintedAnnouncer); ok && hints != nil {
+			return ha.HasBlockWithHints(ctx, b, hints)
+		}
+		return ex.HasBlock(ctx, b)
+	})
+}
+
+func (g group) Cancel(ctx context.Context, ks []key.Key) error {
+	return g.each(func(ex Interface) error { return ex.Cancel(ctx, ks) })
+}
+
+func (g group) Close() error {
+	return g.each(func(ex Interface) error { return ex.Close() })
+}
+
+func (g group) Online() bool {
+	for _, ex := range g {
+		if o, ok := ex.(Onliner); !ok || o.Online() {
+			return true
+		}
+	}
+	return false
+}
+
+func (g group) Ledger(peer string) (Ledger, bool) {
+	sum := Ledger{Peer: peer}
+	found := false
+	for _, ex := range g {
+		if a, ok := ex.(Accountant); ok {
+			if l, ok := a.Ledger(peer); ok {
+				sum = addLedgers(sum, l)
+				found = true
+			}
+		}
+	}
+	return sum, found
+}
+
+func (g group) Ledgers() []Ledger {
+	var peers []string
+	sums := make(map[string]Ledger)
+	for _, ex := range g {
+		a, ok := ex.(Accountant)
+		if !ok {
+			continue
+		}
+		for _, l := range a.Ledgers() {
+			sum, seen := sums[l.Peer]
+			if !seen {
+				peers = append(peers, l.Peer)
+			}
+			sums[l.Peer] = addLedgers(sum, l)
+		}
+	}
+	out := make([]Ledger, len(peers))
+	for i, p := range peers {
+		out[i] = sums[p]
+	}
+	return out
+}
+
+func addLedgers(a, b Ledger) Ledger {
+	return Ledger{
+		Peer:           b.Peer,
+		BytesSent:      a.BytesSent + b.BytesSent,
+		BlocksSent:     a.BlocksSent + b.BlocksSent,
+		BytesReceived:  a.BytesReceived + b.BytesReceived,
+		BlocksReceived: a.BlocksReceived + b.BlocksReceived,
+	}
+}
+
+// each calls |f| with every exchange of |g|, returning the first error.
+func (g group) each(f func(Interface) error) error {
+	var first error
+	for _, ex := range g {
+		if err := f(ex); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+type tiered struct {
+	group
+}
+
+// GetBlock returns the block from the first tier that has it, or the error
+// of the last.
+func (t *tiered) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	err := errNoExchanges
+	for _, ex := range t.group {
+		var b *blocks.Block
+		if b, err = ex.GetBlock(ctx, k); err == nil {
+			return b, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
+func (t *tiered) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		missing := make(map[key.Key]struct{}, len(ks))
+		for _, k := range ks {
+			missing[k] = struct{}{}
+		}
+		rest := ks
+		for _, ex := range t.group {
+			if len(rest) == 0 {
+				return
+			}
+			in, err := ex.GetBlocks(ctx, rest)
+			if err != nil {
+				continue
+			}
+			for b := range in {
+				if _, ok := missing[b.Key()]; !ok {
+					continue
+				}
+				delete(missing, b.Key())
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			// keep the order the keys were asked in.
+			var next []key.Key
+			for _, k := range rest {
+				if _, ok := missing[k]; ok {
+					next = append(next, k)
+				}
+			}
+			rest = next
+		}
+	}()
+	return out, nil
+}
+
+type race struct {
+	group
+}
+
+// GetBlock returns the first block any exchange delivers, or, if they all
+// fail, the error of the first of them.
+func (r *race) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	if len(r.group) == 0 {
+		return nil, errNoExchanges
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i   int
+		b   *blocks.Block
+		err error
+	}
+	results := make(chan result, len(r.group))
+	for i, ex := range r.group {
+		go func(i int, ex Interface) {
+			b, err := ex.GetBlock(ctx, k)
+			results <- result{i, b, err}
+		}(i, ex)
+	}
+	errs := make([]error, len(r.group))
+	for range r.group {
+		res := <-results
+		if res.err == nil {
+			return res.b, nil
+		}
+		errs[res.i] = res.err
+	}
+	return nil, errs[0]
+}
+
+// GetBlocks asks every exchange for |ks|, sending each block the first time
+// it arrives, and cancels the requests once every block has.
+func (r *race) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	merged := make(chan *blocks.Block)
+	var wg sync.WaitGroup
+	for _, ex := range r.group {
+		in, err := ex.GetBlocks(ctx, ks)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(in <-chan *blocks.Block) {
+			defer wg.Done()
+			for b := range in {
+				select {
+				case merged <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(in)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		defer cancel()
+		missing := make(map[key.Key]struct{}, len(ks))
+		for _, k := range ks {
+			missing[k] = struct{}{}
+		}
+		if len(missing) == 0 {
+			return
+		}
+		for b := range merged {
+			if _, ok := missing[b.Key()]; !ok {
+				continue
+			}
+			delete(missing, b.Key())
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+			if len(missing) == 0 {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,240 @@
+package exchange
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var errMissing = errors.New("missing")
+
+// fakeExchange serves |blocks| after |delay|, recording what it is asked.
+type fakeExchange struct {
+	blocks map[key.Key]*blocks.Block
+	delay  time.Duration
+	online bool
+
+	mu        sync.Mutex
+	asked     []key.Key
+	announced int
+	cancelled bool // a request ended by its context
+}
+
+func newFake(delay time.Duration, bs ...*blocks.Block) *fakeExchange {
+	f := &fakeExchange{blocks: make(map[key.Key]*blocks.Block), delay: delay}
+	for _, b := range bs {
+		f.blocks[b.Key()] = b
+	}
+	return f
+}
+
+func (f *fakeExchange) wait(ctx context.Context) bool {
+	select {
+	case <-time.After(f.delay):
+		return true
+	case <-ctx.Done():
+		f.mu.Lock()
+		f.cancelled = true
+		f.mu.Unlock()
+		return false
+	}
+}
+
+func (f *fakeExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	f.mu.Lock()
+	f.asked = append(f.asked, k)
+	f.mu.Unlock()
+	if !f.wait(ctx) {
+		return nil, ctx.Err()
+	}
+	if b, ok := f.blocks[k]; ok {
+		return b, nil
+	}
+	return nil, errMissing
+}
+
+func (f *fakeExchange) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			b, err := f.GetBlock(ctx, k)
+			if err != nil {
+				continue
+			}
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (f *fakeExchange) HasBlock(context.Context, *blocks.Block) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.announced++
+	return nil
+}
+
+func (f *fakeExchange) Cancel(context.Context, []key.Key) error { return nil }
+func (f *fakeExchange) Close() error                            { return nil }
+func (f *fakeExchange) Online() bool                            { return f.online }
+
+func (f *fakeExchange) askedFor() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.asked)
+}
+
+func TestTieredFallsBack(t *testing.T) {
+	ctx := context.Background()
+	a, b := blocks.NewBlock([]byte("lan")), blocks.NewBlock([]byte("wan"))
+	lan, wan := newFake(0, a), newFake(0, a, b)
+	ex := Tiered(lan, wan)
+
+	if _, err := ex.GetBlock(ctx, a.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if wan.askedFor() != 0 {
+		t.Fatal("the second tier was asked for a block the first had")
+	}
+	if _, err := ex.GetBlock(ctx, b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ex.GetBlock(ctx, blocks.NewBlock([]byte("none")).Key()); err != errMissing {
+		t.Fatalf("expected the last tier's error, got %v", err)
+	}
+
+	lan, wan = newFake(0, a), newFake(0, a, b)
+	out, err := Tiered(lan, wan).GetBlocks(ctx, []key.Key{a.Key(), b.Key()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range out {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 blocks, got %d", n)
+	}
+	if n := wan.askedFor(); n != 1 {
+		t.Fatalf("expected the second tier to be asked for 1 block, got %d", n)
+	}
+}
+
+func TestRaceTakesFirst(t *testing.T) {
+	ctx := context.Background()
+	b := blocks.NewBlock([]byte("raced"))
+	slow, fast := newFake(time.Minute, b), newFake(0, b)
+	ex := Race(slow, fast)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ex.GetBlock(ctx, b.Key())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the race waited for the slow exchange")
+	}
+	for i := 0; ; i++ {
+		slow.mu.Lock()
+		cancelled := slow.cancelled
+		slow.mu.Unlock()
+		if cancelled {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("the losing request was not cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := Race(newFake(0), newFake(0)).GetBlock(ctx, b.Key()); err != errMissing {
+		t.Fatalf("expected errMissing, got %v", err)
+	}
+}
+
+func TestRaceGetBlocksDedupes(t *testing.T) {
+	a, b := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("b"))
+	ex := Race(newFake(0, a, b), newFake(0, a, b))
+	out, err := ex.GetBlocks(context.Background(), []key.Key{a.Key(), b.Key()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range out {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("expected each block once, got %d blocks", n)
+	}
+}
+
+func TestGroupAnnouncesAndReportsOnline(t *testing.T) {
+	a, b := newFake(0), newFake(0)
+	ex := Tiered(a, b)
+	if err := ex.HasBlock(context.Background(), blocks.NewBlock([]byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+	if a.announced != 1 || b.announced != 1 {
+		t.Fatal("expected the block announced to every exchange")
+	}
+	if ex.(Onliner).Online() {
+		t.Fatal("expected offline with every exchange offline")
+	}
+	b.online = true
+	if !ex.(Onliner).Online() {
+		t.Fatal("expected online with an exchange online")
+	}
+}
+
+// accountingExchange is a fakeExchange with fixed ledgers.
+type accountingExchange struct {
+	*fakeExchange
+	ledgers []Ledger
+}
+
+func (a *accountingExchange) Ledger(peer string) (Ledger, bool) {
+	for _, l := range a.ledgers {
+		if l.Peer == peer {
+			return l, true
+		}
+	}
+	return Ledger{}, false
+}
+
+func (a *accountingExchange) Ledgers() []Ledger { return a.ledgers }
+
+func TestGroupAddsUpLedgers(t *testing.T) {
+	a := &accountingExchange{newFake(0), []Ledger{{Peer: "p", BytesSent: 10, BlocksSent: 1}, {Peer: "q", BytesReceived: 5, BlocksReceived: 1}}}
+	b := &accountingExchange{newFake(0), []Ledger{{Peer: "p", BytesReceived: 30, BlocksReceived: 2}}}
+	ex := Race(a, newFake(0), b).(Accountant)
+
+	l, ok := ex.Ledger("p")
+	if want := (Ledger{Peer: "p", BytesSent: 10, BlocksSent: 1, BytesReceived: 30, BlocksReceived: 2}); !ok || l != want {
+		t.Fatalf("expected %+v, got %+v, %v", want, l, ok)
+	}
+	if l.Debt() != -20 {
+		t.Fatalf("expected a debt of -20, got %d", l.Debt())
+	}
+	if _, ok := ex.Ledger("r"); ok {
+		t.Fatal("expected no ledger for an unknown peer")
+	}
+	if ls := ex.Ledgers(); len(ls) != 2 || ls[0].Peer != "p" || ls[1] != a.ledgers[1] {
+		t.Fatalf("expected the ledgers of p and q, got %+v", ls)
+	}
+}
@@ -3,14 +3,26 @@
 package exchange
 
 import (
+	"errors"
+	"fmt"
 	"io"
 
 	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
 	key "github.com/ipfs/go-blocks/key"
 
 	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
+var (
+	// ErrClosed is what the errors of closed exchanges wrap, for errors.Is.
+	ErrClosed = errors.New("exchange: closed")
+	// ErrOffline is returned by exchanges asked for blocks while they cannot
+	// reach the network. It wraps blockstore.ErrNotFound, so that callers
+	// take it for the miss it is.
+	ErrOffline = fmt.Errorf("exchange: offline: %w", blockstore.ErrNotFound)
+)
+
 // Any type that implements exchange.Interface may be used as an IPFS block
 // exchange protocol.
 type Interface interface {
@@ -23,5 +35,79 @@ type Interface interface {
 	// available on the network?
 	HasBlock(context.Context, *blocks.Block) error
 
+	// Cancel withdraws outstanding wants for |ks|, made by GetBlock or
+	// GetBlocks, that the caller no longer needs, so that peers can stop
+	// working on them. It is a hint: blocks may still arrive afterwards, and
+	// keys with no outstanding want are ignored. |ctx| bounds the call itself.
+	Cancel(ctx context.Context, ks []key.Key) error
+
 	io.Closer
 }
+
+// PeerTargeted may be implemented by exchanges that can direct a request at a
+// particular peer instead of using their default routing.
+type PeerTargeted interface {
+	// GetBlockFromPeer returns the block associated with a given key, as
+	// served by |peer|.
+	GetBlockFromPeer(ctx context.Context, k key.Key, peer string) (*blocks.Block, error)
+}
+
+// Onliner may be implemented by exchanges that know whether they can
+// currently reach the network.
+type Onliner interface {
+	Online() bool
+}
+
+// Pinger may be implemented by exchanges that can check that they work,
+// such as by reaching a peer or gateway, for health checks.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// HintedAnnouncer may be implemented by exchanges that can use routing hints,
+// such as the peers or regions likely to want a block, when announcing it.
+// The hints are opaque to the blockservice and passed through unchanged.
+type HintedAnnouncer interface {
+	HasBlockWithHints(ctx context.Context, b *blocks.Block, hints []string) error
+}
+
+// Fetcher is the part of an exchange that retrieves blocks.
+type Fetcher interface {
+	GetBlock(context.Context, key.Key) (*blocks.Block, error)
+	GetBlocks(context.Context, []key.Key) (<-chan *blocks.Block, error)
+}
+
+// SessionExchange may be implemented by exchanges that can share state, such
+// as the peers found to have blocks, across a group of related fetches.
+type SessionExchange interface {
+	// NewSession returns a Fetcher whose requests share state with each
+	// other until |ctx| is done.
+	NewSession(ctx context.Context) Fetcher
+}
+
+// Ledger is an exchange's account of what it exchanged with a peer.
+type Ledger struct {
+	Peer string
+	// BytesSent and BlocksSent count the block data served to the peer.
+	BytesSent, BlocksSent uint64
+	// BytesReceived and BlocksReceived count the block data received from
+	// the peer, whether or not the blocks were wanted by then.
+	BytesReceived, BlocksReceived uint64
+}
+
+// Debt is how many more bytes were sent to the peer than received from it.
+// It is negative when the peer is owed.
+func (l Ledger) Debt() int64 {
+	return int64(l.BytesSent) - int64(l.BytesReceived)
+}
+
+// Accountant may be implemented by exchanges that keep a Ledger per peer,
+// for applications to apply fairness policies to or to show transfers.
+type Accountant interface {
+	// Ledger returns the ledger of |peer|, and false if nothing was
+	// exchanged with it.
+	Ledger(peer string) (Ledger, bool)
+	// Ledgers returns the ledger of every peer something was exchanged
+	// with, in no particular order.
+	Ledgers() []Ledger
+}
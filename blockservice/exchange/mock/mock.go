@@ -0,0 +1,257 @@
+// package mock implements a scriptable exchange for tests: it serves the
+// blocks it is given, or whatever a per-key Responder says, after an
+// injected latency, failing a configured share of requests, and records
+// every call.
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrInjected is the error of the requests Config.FailureRate fails.
+var ErrInjected = errors.New("mock: injected failure")
+
+// ErrClosed is returned by the calls made to a closed Exchange. It wraps
+// exchange.ErrClosed, for errors.Is.
+var ErrClosed = fmt.Errorf("mock: %w", exchange.ErrClosed)
+
+// Config sets how an Exchange misbehaves. The zero value serves its blocks
+// at once, every time.
+type Config struct {
+	// Latency delays every fetch, and Jitter adds up to as much again,
+	// picked at random for each.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// FailureRate is the share of fetches, from 0 to 1, that fail with
+	// ErrInjected after their latency, whether the block is there or not.
+	// AnnounceFailureRate is the same for HasBlock.
+	FailureRate         float64
+	AnnounceFailureRate float64
+
+	// Seed seeds the choice of the failures and jitter, so that a test sees
+	// the same run each time.
+	Seed int64
+}
+
+// Responder answers a fetch of one key in place of the blocks added to an
+// Exchange. It is called after the latency, and a failure it returns is
+// not replaced by ErrInjected.
+type Responder func(ctx context.Context) (*blocks.Block, error)
+
+// Exchange is an exchange.Interface for tests. Blocks it doesn't have are
+// reported missing with blockstore.ErrNotFound. GetBlocks leaves out the
+// blocks that fail. It is an exchange.Onliner, online until SetOnline says
+// otherwise, but fetches while offline are served anyway. It is safe for
+// concurrent use.
+type Exchange struct {
+	cfg Config
+
+	mu         sync.Mutex
+	rand       *rand.Rand
+	blocks     map[key.Key]*blocks.Block
+	responders map[key.Key]Responder
+	online     bool
+	closed     bool
+
+	requests  [][]key.Key
+	announced []*blocks.Block
+	cancels   [][]key.Key
+}
+
+var _ exchange.Interface = (*Exchange)(nil)
+var _ exchange.Onliner = (*Exchange)(nil)
+
+// New returns an Exchange serving |bs|, misbehaving as |cfg| says.
+func New(cfg Config, bs ...*blocks.Block) *Exchange {
+	e := &Exchange{
+		cfg:        cfg,
+		rand:       rand.New(rand.NewSource(cfg.Seed)),
+		blocks:     make(map[key.Key]*blocks.Block),
+		responders: make(map[key.Key]Responder),
+		online:     true,
+	}
+	e.Add(bs...)
+	return e
+}
+
+// Add makes |bs| available.
+func (e *Exchange) Add(bs ...*blocks.Block) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, b := range bs {
+		e.blocks[b.Key()] = b
+	}
+}
+
+// Respond makes |r| answer the fetches of |k| from now on, or, if |r| is
+// nil, the blocks added again.
+func (e *Exchange) Respond(k key.Key, r Responder) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if r == nil {
+		delete(e.responders, k)
+		return
+	}
+	e.responders[k] = r
+}
+
+// SetOnline sets what Online reports.
+func (e *Exchange) SetOnline(online bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.online = online
+}
+
+func (e *Exchange) Online() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.online
+}
+
+// Requests returns the keys of every GetBlock and GetBlocks call, in order,
+// one slice per call.
+func (e *Exchange) Requests() [][]key.Key {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([][]key.Key(nil), e.requests...)
+}
+
+// Announced returns the blocks HasBlock accepted, in order.
+func (e *Exchange) Announced() []*blocks.Block {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*blocks.Block(nil), e.announced...)
+}
+
+// Cancels returns the keys of every Cancel call, in order.
+func (e *Exchange) Cancels() [][]key.Key {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([][]key.Key(nil), e.cancels...)
+}
+
+// roll returns the delay of a fetch, and whether it fails at |rate|.
+func (e *Exchange) roll(rate float64) (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	d := e.cfg.Latency
+	if e.cfg.Jitter > 0 {
+		d += time.Duration(e.rand.Int63n(int64(e.cfg.Jitter) + 1))
+	}
+	return d, rate > 0 && e.rand.Float64() < rate
+}
+
+// record notes a request for |ks|, failing if the exchange is closed.
+func (e *Exchange) record(ks []key.Key) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	e.requests = append(e.requests, append([]key.Key(nil), ks...))
+	return nil
+}
+
+func (e *Exchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	if err := e.record([]key.Key{k}); err != nil {
+		return nil, err
+	}
+	return e.fetch(ctx, k)
+}
+
+func (e *Exchange) fetch(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	delay, fail := e.roll(e.cfg.FailureRate)
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	e.mu.Lock()
+	r, scripted := e.responders[k]
+	b, ok := e.blocks[k]
+	e.mu.Unlock()
+	if scripted {
+		return r(ctx)
+	}
+	if fail {
+		return nil, ErrInjected
+	}
+	if !ok {
+		return nil, blockstore.ErrNotFound
+	}
+	return b, nil
+}
+
+// GetBlocks fetches |ks| concurrently, each as GetBlock does.
+func (e *Exchange) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	if err := e.record(ks); err != nil {
+		return nil, err
+	}
+	out := make(chan *blocks.Block)
+	var wg sync.WaitGroup
+	for _, k := range ks {
+		wg.Add(1)
+		go func(k key.Key) {
+			defer wg.Done()
+			b, err := e.fetch(ctx, k)
+			if err != nil {
+				return
+			}
+			select {
+			case out <- b:
+			case <-ctx.Done():
+			}
+		}(k)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out, nil
+}
+
+// HasBlock records |b| as announced, unless AnnounceFailureRate fails it.
+// It does not make |b| available.
+func (e *Exchange) HasBlock(ctx context.Context, b *blocks.Block) error {
+	if _, fail := e.roll(e.cfg.AnnounceFailureRate); fail {
+		return ErrInjected
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	e.announced = append(e.announced, b)
+	return nil
+}
+
+func (e *Exchange) Cancel(_ context.Context, ks []key.Key) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cancels = append(e.cancels, append([]key.Key(nil), ks...))
+	return nil
+}
+
+// Close makes later calls fail with ErrClosed.
+func (e *Exchange) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	return nil
+}
@@ -0,0 +1,117 @@
+package mock
+
+import (
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestServesAndRecords(t *testing.T) {
+	ctx := context.Background()
+	b := blocks.NewBlock([]byte("served"))
+	ex := New(Config{}, b)
+
+	if got, err := ex.GetBlock(ctx, b.Key()); err != nil || got != b {
+		t.Fatalf("expected the block, got %v, %v", got, err)
+	}
+	missing := blocks.NewBlock([]byte("missing")).Key()
+	if _, err := ex.GetBlock(ctx, missing); err != blockstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	out, err := ex.GetBlocks(ctx, []key.Key{b.Key(), missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range out {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 block, got %d", n)
+	}
+	if reqs := ex.Requests(); len(reqs) != 3 || len(reqs[2]) != 2 {
+		t.Fatalf("expected 3 requests, the last for 2 keys, got %v", reqs)
+	}
+
+	if err := ex.HasBlock(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	ex.Cancel(ctx, []key.Key{missing})
+	if len(ex.Announced()) != 1 || len(ex.Cancels()) != 1 {
+		t.Fatal("expected the announcement and cancel recorded")
+	}
+}
+
+func TestRespond(t *testing.T) {
+	ctx := context.Background()
+	b := blocks.NewBlock([]byte("scripted"))
+	ex := New(Config{})
+	calls := 0
+	ex.Respond(b.Key(), func(context.Context) (*blocks.Block, error) {
+		calls++
+		if calls == 1 {
+			return nil, ErrInjected
+		}
+		return b, nil
+	})
+	if _, err := ex.GetBlock(ctx, b.Key()); err != ErrInjected {
+		t.Fatalf("expected ErrInjected, got %v", err)
+	}
+	if _, err := ex.GetBlock(ctx, b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	ex.Respond(b.Key(), nil)
+	if _, err := ex.GetBlock(ctx, b.Key()); err != blockstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound once the responder is gone, got %v", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	b := blocks.NewBlock([]byte("slow"))
+	ex := New(Config{Latency: time.Minute}, b)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := ex.GetBlock(ctx, b.Key()); err != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	b := blocks.NewBlock([]byte("flaky"))
+	count := func(seed int64) int {
+		ex := New(Config{FailureRate: 0.5, Seed: seed}, b)
+		failed := 0
+		for i := 0; i < 200; i++ {
+			if _, err := ex.GetBlock(context.Background(), b.Key()); err == ErrInjected {
+				failed++
+			}
+		}
+		return failed
+	}
+	failed := count(1)
+	if failed < 50 || failed > 150 {
+		t.Fatalf("expected about half of 200 fetches to fail, got %d", failed)
+	}
+	if again := count(1); again != failed {
+		t.Fatalf("expected the same seed to fail the same fetches, got %d and %d", failed, again)
+	}
+	if err := New(Config{FailureRate: 1}).HasBlock(context.Background(), b); err != nil {
+		t.Fatal("FailureRate failed an announcement")
+	}
+	if err := New(Config{AnnounceFailureRate: 1}).HasBlock(context.Background(), b); err != ErrInjected {
+		t.Fatalf("expected ErrInjected, got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ex := New(Config{})
+	ex.Close()
+	if _, err := ex.GetBlock(context.Background(), blocks.NewBlock([]byte("x")).Key()); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
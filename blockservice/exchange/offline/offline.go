@@ -33,6 +33,11 @@ func (e *offlineExchange) HasBlock(_ context.Context, b *blocks.Block) error {
 	return e.bs.Put(b)
 }
 
+// Cancel always returns nil, as no wants are ever outstanding.
+func (_ *offlineExchange) Cancel(context.Context, []key.Key) error {
+	return nil
+}
+
 // Close always returns nil.
 func (_ *offlineExchange) Close() error {
 	// NB: exchange doesn't own the blockstore's underlying datastore, so it is
@@ -67,3 +72,29 @@ func (e *offlineExchange) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *
 	}()
 	return out, nil
 }
+
+// Null returns an exchange that has no blocks and no network: every fetch
+// fails with exchange.ErrOffline, announcements are dropped, and it
+// reports being offline, as an exchange.Onliner. Unlike Exchange, it does
+// not read or write a blockstore.
+func Null() exchange.Interface {
+	return nullExchange{}
+}
+
+type nullExchange struct{}
+
+func (nullExchange) GetBlock(context.Context, key.Key) (*blocks.Block, error) {
+	return nil, exchange.ErrOffline
+}
+
+// GetBlocks returns a closed channel.
+func (nullExchange) GetBlocks(context.Context, []key.Key) (<-chan *blocks.Block, error) {
+	out := make(chan *blocks.Block)
+	close(out)
+	return out, nil
+}
+
+func (nullExchange) HasBlock(context.Context, *blocks.Block) error { return nil }
+func (nullExchange) Cancel(context.Context, []key.Key) error       { return nil }
+func (nullExchange) Close() error                                  { return nil }
+func (nullExchange) Online() bool                                  { return false }
@@ -1,9 +1,11 @@
 package offline
 
 import (
+	"errors"
 	"testing"
 
 	blocks "github.com/ipfs/go-blocks"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
 	"github.com/ipfs/go-blocks/blockstore"
 	"github.com/ipfs/go-blocks/blocksutil"
 	key "github.com/ipfs/go-blocks/key"
@@ -73,6 +75,24 @@ func TestGetBlocks(t *testing.T) {
 	}
 }
 
+func TestNull(t *testing.T) {
+	ex := Null()
+	b := blocks.NewBlock([]byte("data"))
+	if err := ex.HasBlock(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ex.GetBlock(context.Background(), b.Key()); err != exchange.ErrOffline || !errors.Is(err, blockstore.ErrNotFound) {
+		t.Fatalf("expected ErrOffline, got %v", err)
+	}
+	received, err := ex.GetBlocks(context.Background(), []key.Key{b.Key()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _ = range received {
+		t.Fatal("expected no blocks")
+	}
+}
+
 func bstore() blockstore.Blockstore {
 	return blockstore.NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
 }
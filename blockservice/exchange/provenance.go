@@ -0,0 +1,34 @@
+package exchange
+
+import (
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Provenance is where an exchange got a block from, as far as it knows.
+type Provenance struct {
+	// Exchange names the kind of exchange, such as "remote".
+	Exchange string
+	// Peer is the peer, or gateway, that sent the block.
+	Peer string
+}
+
+type provenanceKey struct{}
+
+// WithProvenance returns a context under which exchanges that know where
+// the blocks they return come from tell |record|, calling it with each
+// block's key before returning the block. |record| may be called from
+// several goroutines at once.
+func WithProvenance(ctx context.Context, record func(key.Key, Provenance)) context.Context {
+	return context.WithValue(ctx, provenanceKey{}, record)
+}
+
+// ReportProvenance tells the recorder that WithProvenance set on |ctx|, if
+// any, that the block |k| came from |p|. Exchanges call it for the blocks
+// they are about to return from GetBlock or send on a GetBlocks stream.
+func ReportProvenance(ctx context.Context, k key.Key, p Provenance) {
+	if record, ok := ctx.Value(provenanceKey{}).(func(key.Key, Provenance)); ok {
+		record(k, p)
+	}
+}
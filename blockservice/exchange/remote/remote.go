@@ -0,0 +1,360 @@
+// package remote implements an exchange that fetches blocks from HTTP block
+// gateways, such as those served by package blockservice/http, so that a
+// BlockService can read from the network without a peer-to-peer stack.
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrClosed is returned by the calls made to a closed Exchange. It wraps
+// exchange.ErrClosed, for errors.Is.
+var ErrClosed = fmt.Errorf("remote: %w", exchange.ErrClosed)
+
+// scratch holds the buffers responses are read into: a block is copied out
+// of one only once it is known to be good, and to its exact size.
+var scratch = blocks.NewBufferPool()
+
+// fetchParallelism is how many of the keys of a GetBlocks are fetched at
+// once.
+const fetchParallelism = 8
+
+// New returns an exchange fetching blocks from the gateways at
+// |endpoints|, base URLs under which /block/{key} is served, using |client|,
+// or http.DefaultClient if it is nil.
+//
+// Each block is asked of every gateway at once, and the first response whose
+// data matches the key wins; the other requests are then cancelled. A block
+// is reported missing, with blockstore.ErrNotFound, only if every gateway
+// answers 404. Gateways are never written to: HasBlock does nothing.
+//
+// The exchange is also an exchange.PeerTargeted, whose peers are gateway
+// base URLs, which need not be among |endpoints|, and an
+// exchange.Accountant, whose ledgers count the intact blocks received from
+// each gateway, those of the requests that lost a race included. It reports
+// the gateway each block came from with exchange.ReportProvenance. As an
+// exchange.Pinger, it is healthy while a gateway answers /healthz.
+func New(client *http.Client, endpoints ...string) (exchange.Interface, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("remote: no endpoints")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	e := &remoteExchange{client: client}
+	for _, ep := range endpoints {
+		base, err := baseURL(ep)
+		if err != nil {
+			return nil, err
+		}
+		e.endpoints = append(e.endpoints, base)
+	}
+	return e, nil
+}
+
+func baseURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("remote: endpoint %q: %w", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("remote: endpoint %q is not an http(s) URL", endpoint)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+type remoteExchange struct {
+	client    *http.Client
+	endpoints []string
+
+	mu      sync.Mutex
+	closed  bool
+	ledgers map[string]exchange.Ledger
+}
+
+var _ exchange.Accountant = (*remoteExchange)(nil)
+
+// received accounts for |b|, received from the gateway |ep|.
+func (e *remoteExchange) received(ep string, b *blocks.Block) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ledgers == nil {
+		e.ledgers = make(map[string]exchange.Ledger)
+	}
+	l := e.ledgers[ep]
+	l.Peer = ep
+	l.BytesReceived += uint64(len(b.Data))
+	l.BlocksReceived++
+	e.ledgers[ep] = l
+}
+
+func (e *remoteExchange) Ledger(peer string) (exchange.Ledger, bool) {
+	base, err := baseURL(peer)
+	if err != nil {
+		return exchange.Ledger{}, false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l, ok := e.ledgers[base]
+	return l, ok
+}
+
+func (e *remoteExchange) Ledgers() []exchange.Ledger {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]exchange.Ledger, 0, len(e.ledgers))
+	for _, l := range e.ledgers {
+		out = append(out, l)
+	}
+	return out
+}
+
+var _ exchange.Pinger = (*remoteExchange)(nil)
+
+// Ping checks that a gateway is healthy, asking each for /healthz, and
+// returns the first error if none is.
+func (e *remoteExchange) Ping(ctx context.Context) error {
+	if e.isClosed() {
+		return ErrClosed
+	}
+	var firstErr error
+	for _, ep := range e.endpoints {
+		err := e.ping(ctx, ep)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (e *remoteExchange) ping(ctx context.Context, ep string) error {
+	req, err := http.NewRequest("GET", ep+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remote: %s: %s", ep, resp.Status)
+	}
+	return nil
+}
+
+func (e *remoteExchange) isClosed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closed
+}
+
+func (e *remoteExchange) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	if e.isClosed() {
+		return nil, ErrClosed
+	}
+	return e.race(ctx, k, e.endpoints)
+}
+
+func (e *remoteExchange) GetBlockFromPeer(ctx context.Context, k key.Key, peer string) (*blocks.Block, error) {
+	if e.isClosed() {
+		return nil, ErrClosed
+	}
+	base, err := baseURL(peer)
+	if err != nil {
+		return nil, err
+	}
+	return e.race(ctx, k, []string{base})
+}
+
+// race asks every one of |endpoints| for |k|, returning the first block to
+// arrive intact.
+func (e *remoteExchange) race(ctx context.Context, k key.Key, endpoints []string) (*blocks.Block, error) {
+	c, err := k.Cid()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ep  string
+		b   *blocks.Block
+		err error
+	}
+	results := make(chan result, len(endpoints))
+	for _, ep := range endpoints {
+		go func(ep string) {
+			b, err := e.fetch(ctx, ep+"/block/"+c.String(), k)
+			if err == nil {
+				e.received(ep, b)
+			}
+			results <- result{ep, b, err}
+		}(ep)
+	}
+	var firstErr error
+	for range endpoints {
+		r := <-results
+		if r.err == nil {
+			exchange.ReportProvenance(ctx, k, exchange.Provenance{Exchange: "remote", Peer: r.ep})
+			return r.b, nil
+		}
+		if !errors.Is(r.err, blockstore.ErrNotFound) && firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, blockstore.ErrNotFound
+}
+
+// fetch GETs the block |k| from |u|, checking it against |k|.
+func (e *remoteExchange) fetch(ctx context.Context, u string, k key.Key) (*blocks.Block, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, blockstore.ErrNotFound
+	default:
+		return nil, fmt.Errorf("remote: %s: %s", u, resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	if blocks.MaxBlockSize > 0 {
+		body = io.LimitReader(body, int64(blocks.MaxBlockSize)+1)
+	}
+	buf, err := readBody(body, resp.ContentLength)
+	if err != nil {
+		return nil, err
+	}
+	defer scratch.Put(buf)
+	if blocks.MaxBlockSize > 0 && len(buf) > blocks.MaxBlockSize {
+		return nil, fmt.Errorf("remote: %s: %w", u, blocks.ErrBlockTooLarge)
+	}
+	if err := blockstore.Verify(k, buf); err != nil {
+		return nil, fmt.Errorf("remote: %s: %w", u, err)
+	}
+	return blocks.NewBlockWithKey(append([]byte(nil), buf...), k)
+}
+
+// readBody reads |r| into a buffer from scratch, sized by |length| if it is
+// known, growing it as ioutil.ReadAll would otherwise.
+func readBody(r io.Reader, length int64) ([]byte, error) {
+	size := bytes.MinRead
+	if length >= 0 && (blocks.MaxBlockSize <= 0 || length <= int64(blocks.MaxBlockSize)) {
+		// one byte more, so that the body's end is read without growing.
+		size = int(length) + 1
+	}
+	buf := scratch.Get(size)[:0]
+	for {
+		if len(buf) == cap(buf) {
+			bigger := scratch.Get(2 * cap(buf))[:len(buf)]
+			copy(bigger, buf)
+			scratch.Put(buf)
+			buf = bigger
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			scratch.Put(buf)
+			return nil, err
+		}
+	}
+}
+
+// GetBlocks fetches |ks| a few at a time, each as GetBlock does, sending
+// the blocks in the order they arrive. Blocks that can't be fetched are left
+// out.
+func (e *remoteExchange) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	if e.isClosed() {
+		return nil, ErrClosed
+	}
+	out := make(chan *blocks.Block)
+	todo := make(chan key.Key)
+	var wg sync.WaitGroup
+	workers := fetchParallelism
+	if len(ks) < workers {
+		workers = len(ks)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range todo {
+				b, err := e.race(ctx, k, e.endpoints)
+				if err != nil {
+					continue
+				}
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(out)
+		defer wg.Wait()
+		defer close(todo)
+		for _, k := range ks {
+			select {
+			case todo <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// HasBlock does nothing; gateways are only read from.
+func (_ *remoteExchange) HasBlock(context.Context, *blocks.Block) error {
+	return nil
+}
+
+// Cancel does nothing, as every request ends with its context.
+func (_ *remoteExchange) Cancel(context.Context, []key.Key) error {
+	return nil
+}
+
+// Close makes later requests fail with ErrClosed. Requests in progress run
+// to the end of their context.
+func (e *remoteExchange) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	return nil
+}
@@ -0,0 +1,224 @@
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	offline "github.com/ipfs/go-blocks/blockservice/exchange/offline"
+	gateway "github.com/ipfs/go-blocks/blockservice/http"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// newGateway serves |bs| the way blockservice/http does.
+func newGateway(t *testing.T, bs ...*blocks.Block) *httptest.Server {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	for _, b := range bs {
+		if err := bstore.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := blockservice.New(bstore, offline.Exchange(bstore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(gateway.NewHandler(s))
+}
+
+func newExchange(t *testing.T, servers ...*httptest.Server) *remoteExchange {
+	var urls []string
+	for _, s := range servers {
+		urls = append(urls, s.URL)
+	}
+	ex, err := New(nil, urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ex.(*remoteExchange)
+}
+
+func TestGetBlockFromEitherGateway(t *testing.T) {
+	a, b := blocks.NewBlock([]byte("on a")), blocks.NewBlock([]byte("on b"))
+	ga, gb := newGateway(t, a), newGateway(t, b)
+	defer ga.Close()
+	defer gb.Close()
+	ex := newExchange(t, ga, gb)
+
+	ctx := context.Background()
+	for _, want := range []*blocks.Block{a, b} {
+		got, err := ex.GetBlock(ctx, want.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Data) != string(want.Data) {
+			t.Fatalf("expected %q, got %q", want.Data, got.Data)
+		}
+	}
+	if _, err := ex.GetBlock(ctx, blocks.NewBlock([]byte("nowhere")).Key()); err != blockstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	b := blocks.NewBlock([]byte("on b"))
+	ga, gb := newGateway(t), newGateway(t, b)
+	defer ga.Close()
+	defer gb.Close()
+	bs, err := blockservice.New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), newExchange(t, ga, gb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	m, err := bs.GetBlockWithMeta(context.Background(), b.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Source != blockservice.SourceExchange || m.Provenance.Exchange != "remote" || m.Provenance.Peer != gb.URL {
+		t.Fatalf("expected the block from %s, got %v from %+v", gb.URL, m.Source, m.Provenance)
+	}
+}
+
+func TestLedgers(t *testing.T) {
+	a := blocks.NewBlock([]byte("on a"))
+	ga, gb := newGateway(t, a), newGateway(t)
+	defer ga.Close()
+	defer gb.Close()
+	ex := newExchange(t, ga, gb)
+
+	for i := 0; i < 2; i++ {
+		if _, err := ex.GetBlock(context.Background(), a.Key()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, ok := ex.Ledger(ga.URL + "/")
+	if !ok || l.Peer != ga.URL || l.BlocksReceived != 2 || l.BytesReceived != uint64(2*len(a.Data)) {
+		t.Fatalf("expected two blocks received from a, got %+v, %v", l, ok)
+	}
+	if l.Debt() != -int64(2*len(a.Data)) {
+		t.Fatalf("expected a to be owed what it sent, got %d", l.Debt())
+	}
+	if _, ok := ex.Ledger(gb.URL); ok {
+		t.Fatal("expected no ledger for a gateway that sent nothing")
+	}
+	if ls := ex.Ledgers(); len(ls) != 1 || ls[0] != l {
+		t.Fatalf("expected only a's ledger, got %+v", ls)
+	}
+}
+
+func TestGetBlockRacesGateways(t *testing.T) {
+	b := blocks.NewBlock([]byte("raced"))
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := newGateway(t, b)
+	defer fast.Close()
+
+	ex := newExchange(t, slow, fast)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := ex.GetBlock(ctx, b.Key()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetBlockRejectsBadData(t *testing.T) {
+	b := blocks.NewBlock([]byte("genuine"))
+	liar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("forged"))
+	}))
+	defer liar.Close()
+
+	ex := newExchange(t, liar)
+	if _, err := ex.GetBlock(context.Background(), b.Key()); err == nil {
+		t.Fatal("expected forged data to be rejected")
+	}
+
+	honest := newGateway(t, b)
+	defer honest.Close()
+	ex = newExchange(t, liar, honest)
+	got, err := ex.GetBlock(context.Background(), b.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Data) != "genuine" {
+		t.Fatalf("expected the honest gateway's block, got %q", got.Data)
+	}
+}
+
+func TestGetBlocks(t *testing.T) {
+	var bs []*blocks.Block
+	var ks []key.Key
+	for i := 0; i < 20; i++ {
+		b := blocks.NewBlock([]byte{byte(i)})
+		bs = append(bs, b)
+		ks = append(ks, b.Key())
+	}
+	ga, gb := newGateway(t, bs[:10]...), newGateway(t, bs[10:]...)
+	defer ga.Close()
+	defer gb.Close()
+	ex := newExchange(t, ga, gb)
+
+	missing := blocks.NewBlock([]byte("missing")).Key()
+	out, err := ex.GetBlocks(context.Background(), append(ks, missing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[key.Key]bool)
+	for b := range out {
+		got[b.Key()] = true
+	}
+	if len(got) != len(bs) {
+		t.Fatalf("expected %d blocks, got %d", len(bs), len(got))
+	}
+}
+
+func TestNewValidatesEndpoints(t *testing.T) {
+	if _, err := New(nil); err == nil {
+		t.Fatal("expected an error without endpoints")
+	}
+	if _, err := New(nil, "ftp://example.com"); err == nil {
+		t.Fatal("expected an error for a non-http endpoint")
+	}
+}
+
+func TestClose(t *testing.T) {
+	g := newGateway(t)
+	defer g.Close()
+	ex := newExchange(t, g)
+	ex.Close()
+	if _, err := ex.GetBlock(context.Background(), blocks.NewBlock([]byte("x")).Key()); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	good := newGateway(t)
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	ctx := context.Background()
+	if err := newExchange(t, bad, good).Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := newExchange(t, bad).Ping(ctx); err == nil {
+		t.Fatal("healthy without a healthy gateway")
+	}
+}
@@ -0,0 +1,201 @@
+package blockservice
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// expiresKind is the metadata kind holding the time each expiring block
+// expires at, in Unix nanoseconds stored as by encodeCount.
+const expiresKind = "expires"
+
+// EnableExpiry lets blocks be added with a time to live, after which they
+// are deleted: see AddBlockOptions.TTL and PutWithTTL. Expiry times are kept
+// in the blockstore's metadata, and in memory, where they are loaded from
+// now. Expired blocks are removed every |sweepInterval|, and a block read
+// after it expired is removed then, and treated as missing. It returns
+// ErrNotSupported if the blockstore does not implement
+// blockstore.MetadataStore, and an error if |sweepInterval| is not positive.
+// It must be called before the service is used; calling it again replaces
+// the sweep, with the new interval.
+func (s *BlockService) EnableExpiry(sweepInterval time.Duration) error {
+	if sweepInterval <= 0 {
+		return fmt.Errorf("blockservice: expiry sweep interval must be positive, got %s", sweepInterval)
+	}
+	ms, ok := s.Blockstore.(blockstore.MetadataStore)
+	if !ok {
+		return ErrNotSupported
+	}
+	e, err := newExpirer(ms)
+	if err != nil {
+		return err
+	}
+	if s.expiry != nil {
+		s.expiry.Close()
+	}
+	s.expiry = e
+	e.start(sweepInterval, s.sweepExpired)
+	return nil
+}
+
+// PutWithTTL is AddBlock, but the block expires after |ttl|. It returns
+// ErrNotSupported unless EnableExpiry was called.
+func (s *BlockService) PutWithTTL(b *blocks.Block, ttl time.Duration) (key.Key, error) {
+	return s.AddBlockWith(b, AddBlockOptions{TTL: ttl})
+}
+
+// expired reports whether |k| has expired, removing it if so.
+func (s *BlockService) expired(k key.Key) bool {
+	if s.expiry == nil || !s.expiry.expired(k, time.Now()) {
+		return false
+	}
+	s.expire(k)
+	return true
+}
+
+// sweepExpired removes every block that has expired.
+func (s *BlockService) sweepExpired() {
+	for _, k := range s.expiry.due(time.Now()) {
+		s.expire(k)
+	}
+}
+
+// expire removes the expired block |k|, whatever references it has, unless
+// it was added again since it was found expired. A block that fails to
+// delete is left for the next sweep.
+func (s *BlockService) expire(k key.Key) {
+	if s.readOnly {
+		return
+	}
+	s.expiry.writes.Lock()
+	defer s.expiry.writes.Unlock()
+	if !s.expiry.expired(k, time.Now()) {
+		return
+	}
+	err := s.Blockstore.DeleteBlock(k)
+	if err != nil && !errors.Is(err, blockstore.ErrNotFound) {
+		return
+	}
+	if err == nil {
+		atomic.AddUint64(&s.stats.expired, 1)
+		s.publish(EventEvicted, k)
+	}
+	s.expiry.clear(k)
+	if s.refs != nil {
+		s.refs.mu.Lock()
+		s.refs.forget(k)
+		s.refs.mu.Unlock()
+	}
+}
+
+// expirer tracks the expiry times of blocks, and sweeps the expired ones
+// periodically.
+type expirer struct {
+	store blockstore.MetadataStore
+	// writes is held for reading by the adds that clear expiry times, and
+	// for writing by expire, so that an add is never undone by the removal
+	// of the block it made permanent.
+	writes sync.RWMutex
+
+	mu sync.Mutex
+	at map[key.Key]time.Time
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+// newExpirer returns an expirer with the expiry times stored in |ms|.
+func newExpirer(ms blockstore.MetadataStore) (*expirer, error) {
+	e := &expirer{
+		store:   ms,
+		at:      make(map[key.Key]time.Time),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	err := ms.ForEachMetadata(context.Background(), expiresKind, func(k key.Key, v []byte) bool {
+		e.at[k] = time.Unix(0, int64(decodeCount(v)))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// start calls |sweep| every |interval| until Close.
+func (e *expirer) start(interval time.Duration, sweep func()) {
+	go func() {
+		defer close(e.closed)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				sweep()
+			case <-e.closing:
+				return
+			}
+		}
+	}()
+}
+
+// set makes |k| expire at |at|.
+func (e *expirer) set(k key.Key, at time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.store.PutMetadata(expiresKind, k, encodeCount(uint64(at.UnixNano()))); err != nil {
+		return err
+	}
+	e.at[k] = at
+	return nil
+}
+
+// clear makes |k| not expire.
+func (e *expirer) clear(k key.Key) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.at[k]; !ok {
+		return nil
+	}
+	if err := e.store.DeleteMetadata(expiresKind, k); err != nil {
+		return err
+	}
+	delete(e.at, k)
+	return nil
+}
+
+func (e *expirer) expired(k key.Key, now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	at, ok := e.at[k]
+	return ok && !now.Before(at)
+}
+
+// due returns the keys that have expired by |now|.
+func (e *expirer) due(now time.Time) []key.Key {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var ks []key.Key
+	for k, at := range e.at {
+		if !now.Before(at) {
+			ks = append(ks, k)
+		}
+	}
+	return ks
+}
+
+// Close stops the periodic sweep.
+func (e *expirer) Close() error {
+	close(e.closing)
+	<-e.closed
+	return nil
+}
@@ -0,0 +1,82 @@
+package blockservice
+
+import (
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	worker "github.com/ipfs/go-blocks/blockservice/worker"
+)
+
+// ErrConflictingOptions is returned by GetBlock when given both LocalOnly
+// and RemoteOnly.
+var ErrConflictingOptions = errors.New("blockservice: LocalOnly and RemoteOnly conflict")
+
+// GetOption changes how a single GetBlock looks for its block.
+type GetOption func(*getOptions)
+
+type getOptions struct {
+	localOnly  bool
+	remoteOnly bool
+	allowStale bool
+	maxSize    int
+	priority   worker.Priority
+
+	// meta, if set, is filled in with where the block came from, for
+	// GetBlockWithMeta.
+	meta *BlockWithMeta
+}
+
+// LocalOnly makes GetBlock look in the blockstore only, and fail with
+// ErrNotFound at once if the block is not there, as it does offline.
+func LocalOnly() GetOption {
+	return func(o *getOptions) { o.localOnly = true }
+}
+
+// RemoteOnly makes GetBlock ask the exchange for the block even if it is
+// stored locally. The block fetched is stored, as any other. Offline, it
+// fails with ErrNotFound.
+func RemoteOnly() GetOption {
+	return func(o *getOptions) { o.remoteOnly = true }
+}
+
+// MaxSize makes GetBlock fail with blocks.ErrBlockTooLarge if the block has
+// more than |n| bytes of data. A block fetched that is too large is not
+// stored. Zero, the default, is no limit.
+func MaxSize(n int) GetOption {
+	return func(o *getOptions) { o.maxSize = n }
+}
+
+// AllowStale makes GetBlock return a stored block whose TTL has passed,
+// instead of removing it and fetching it again. See EnableExpiry.
+func AllowStale() GetOption {
+	return func(o *getOptions) { o.allowStale = true }
+}
+
+// Priority orders GetBlock's fetch among the others. A fetch at
+// worker.PriorityHigh takes the first free fetch slot, ahead of those
+// waiting for one, when WithMaxConcurrentFetches caps them. One at
+// worker.PriorityLow is made as a Prefetch is, once no other read is
+// waiting on the exchange, and does not hold prefetches back. The default
+// is worker.PriorityNormal.
+func Priority(p worker.Priority) GetOption {
+	return func(o *getOptions) { o.priority = p }
+}
+
+func newGetOptions(opts []GetOption) (getOptions, error) {
+	var o getOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.localOnly && o.remoteOnly {
+		return o, ErrConflictingOptions
+	}
+	return o, nil
+}
+
+// fits returns blocks.ErrBlockTooLarge if |b| is over MaxSize.
+func (o getOptions) fits(b *blocks.Block) error {
+	if o.maxSize > 0 && len(b.Data) > o.maxSize {
+		return blocks.ErrBlockTooLarge
+	}
+	return nil
+}
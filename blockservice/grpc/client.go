@@ -0,0 +1,196 @@
+//go:build grpc
+// +build grpc
+
+package grpc
+
+import (
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+	grpclib "google.golang.org/grpc"
+)
+
+// ErrUnsupported is returned by the Client's Blockstore methods that the
+// service does not offer, such as listing the blocks.
+var ErrUnsupported = errors.New("grpc: not supported by the remote service")
+
+// Client uses a BlockService served by Register. As a blockstore.Blockstore
+// it reads and writes the blocks the service stores: Get fetches through
+// the service's exchange if needed, and Has only sees blocks stored. As an
+// exchange.Interface it lets another BlockService read through the shared
+// one, HasBlock adding the block to it. Misses are reported with
+// blockstore.ErrNotFound.
+//
+// Blockstore methods without a context run with context.Background(), and
+// ApplyBatch is not atomic: it puts and deletes one block at a time.
+type Client struct {
+	cc grpclib.ClientConnInterface
+}
+
+var (
+	_ blockstore.Blockstore = (*Client)(nil)
+	_ exchange.Interface    = (*Client)(nil)
+)
+
+// NewClient returns a Client calling the service through |cc|, which it
+// does not close.
+func NewClient(cc grpclib.ClientConnInterface) *Client {
+	return &Client{cc: cc}
+}
+
+func (c *Client) invoke(ctx context.Context, method string, req, resp message) error {
+	return fromStatus(c.cc.Invoke(ctx, method, req, resp, grpclib.CallContentSubtype(codecName)))
+}
+
+func (c *Client) GetBlock(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	resp := new(blockMsg)
+	if err := c.invoke(ctx, getMethod, &keyMsg{Key: []byte(k)}, resp); err != nil {
+		return nil, err
+	}
+	if key.Key(resp.Key) != k {
+		return nil, blockstore.ErrHashMismatch
+	}
+	return toBlock(resp)
+}
+
+// GetBlocks streams the blocks of |ks| that the service finds. Blocks whose
+// data does not match their key are left out.
+func (c *Client) GetBlocks(ctx context.Context, ks []key.Key) (<-chan *blocks.Block, error) {
+	stream, err := c.cc.NewStream(ctx, &serviceDesc.Streams[0], getManyMethod, grpclib.CallContentSubtype(codecName))
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	req := &keysMsg{Keys: make([][]byte, len(ks))}
+	for i, k := range ks {
+		req.Keys[i] = []byte(k)
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, fromStatus(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, fromStatus(err)
+	}
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		for {
+			m := new(blockMsg)
+			if err := stream.RecvMsg(m); err != nil {
+				return
+			}
+			b, err := toBlock(m)
+			if err != nil {
+				continue
+			}
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// HasBlock adds |b| to the service, which announces it.
+func (c *Client) HasBlock(ctx context.Context, b *blocks.Block) error {
+	return c.put(ctx, b)
+}
+
+// Cancel does nothing: a read's wants end with its context.
+func (c *Client) Cancel(context.Context, []key.Key) error { return nil }
+
+// Close does nothing; the connection is the caller's to close.
+func (c *Client) Close() error { return nil }
+
+func (c *Client) put(ctx context.Context, b *blocks.Block) error {
+	return c.invoke(ctx, putMethod, &blockMsg{Key: []byte(b.Key()), Data: b.Data}, new(keyMsg))
+}
+
+func (c *Client) Get(k key.Key) (*blocks.Block, error) {
+	return c.GetBlock(context.Background(), k)
+}
+
+func (c *Client) Has(k key.Key) (bool, error) {
+	resp := new(presenceMsg)
+	if err := c.invoke(context.Background(), hasMethod, &keyMsg{Key: []byte(k)}, resp); err != nil {
+		return false, err
+	}
+	return resp.Has, nil
+}
+
+func (c *Client) Put(b *blocks.Block) error {
+	return c.put(context.Background(), b)
+}
+
+func (c *Client) PutMany(bs []*blocks.Block) error {
+	for _, b := range bs {
+		if err := c.Put(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) DeleteBlock(k key.Key) error {
+	return c.invoke(context.Background(), deleteMethod, &keyMsg{Key: []byte(k)}, new(emptyMsg))
+}
+
+func (c *Client) GetChan(ks []key.Key) <-chan *blocks.Block {
+	out, err := c.GetBlocks(context.Background(), ks)
+	if err != nil {
+		ch := make(chan *blocks.Block)
+		close(ch)
+		return ch
+	}
+	return out
+}
+
+func (c *Client) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	for _, b := range puts {
+		if err := c.put(ctx, b); err != nil {
+			return err
+		}
+	}
+	for _, k := range deletes {
+		err := c.invoke(ctx, deleteMethod, &keyMsg{Key: []byte(k)}, new(emptyMsg))
+		if err != nil && !errors.Is(err, blockstore.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) Batch(ctx context.Context) *blockstore.Batch {
+	return blockstore.NewBatch(ctx, c)
+}
+
+func (c *Client) NewTransaction(readOnly bool) *blockstore.Transaction {
+	return blockstore.NewTransaction(c, readOnly)
+}
+
+func (c *Client) AllKeysChan(context.Context) (<-chan key.Key, error) {
+	return nil, ErrUnsupported
+}
+
+func (c *Client) AllKeys(context.Context, dsq.Query) (<-chan key.Key, error) {
+	return nil, ErrUnsupported
+}
+
+func (c *Client) ReplaceAll(context.Context, <-chan *blocks.Block) error {
+	return ErrUnsupported
+}
+
+func (c *Client) FindOrphanedMetadata(context.Context) (<-chan key.Key, error) {
+	return nil, ErrUnsupported
+}
+
+func (c *Client) PurgeOrphanedMetadata(context.Context) (int, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,177 @@
+//go:build grpc
+// +build grpc
+
+package grpc
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// codecName is the content subtype messages are sent with.
+const codecName = "blocks"
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// message is one of the messages of blockservice.proto.
+type message interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+// codec encodes messages in the protobuf wire format, by hand.
+type codec struct{}
+
+func (codec) Name() string { return codecName }
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("grpc: cannot encode %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("grpc: cannot decode %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+type keyMsg struct {
+	Key []byte
+}
+
+func (m *keyMsg) marshal() []byte {
+	return appendBytes(nil, 1, m.Key)
+}
+
+func (m *keyMsg) unmarshal(b []byte) error {
+	return eachField(b, func(num protowire.Number, _ uint64, v []byte) {
+		if num == 1 {
+			m.Key = v
+		}
+	})
+}
+
+type keysMsg struct {
+	Keys [][]byte
+}
+
+func (m *keysMsg) marshal() []byte {
+	var b []byte
+	for _, k := range m.Keys {
+		// unlike a single field, an element can't be left out when empty.
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, k)
+	}
+	return b
+}
+
+func (m *keysMsg) unmarshal(b []byte) error {
+	return eachField(b, func(num protowire.Number, _ uint64, v []byte) {
+		if num == 1 {
+			m.Keys = append(m.Keys, v)
+		}
+	})
+}
+
+type blockMsg struct {
+	Key  []byte
+	Data []byte
+}
+
+func (m *blockMsg) marshal() []byte {
+	return appendBytes(appendBytes(nil, 1, m.Key), 2, m.Data)
+}
+
+func (m *blockMsg) unmarshal(b []byte) error {
+	return eachField(b, func(num protowire.Number, _ uint64, v []byte) {
+		switch num {
+		case 1:
+			m.Key = v
+		case 2:
+			m.Data = v
+		}
+	})
+}
+
+type presenceMsg struct {
+	Has bool
+}
+
+func (m *presenceMsg) marshal() []byte {
+	if !m.Has {
+		return nil
+	}
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(true))
+}
+
+func (m *presenceMsg) unmarshal(b []byte) error {
+	return eachField(b, func(num protowire.Number, x uint64, _ []byte) {
+		if num == 1 {
+			m.Has = protowire.DecodeBool(x)
+		}
+	})
+}
+
+type emptyMsg struct{}
+
+func (*emptyMsg) marshal() []byte { return nil }
+
+func (*emptyMsg) unmarshal(b []byte) error {
+	return eachField(b, func(protowire.Number, uint64, []byte) {})
+}
+
+// appendBytes appends a bytes field to |b|, unless |v| is empty, which
+// proto3 leaves out.
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// eachField calls |f| with each field of the message |b|: varint fields
+// with their value, and bytes fields with a copy of their bytes, as |b| may
+// be reused. Fields of other types are skipped.
+func eachField(b []byte, f func(num protowire.Number, x uint64, v []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			x, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			f(num, x, nil)
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			f(num, 0, append([]byte(nil), v...))
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build grpc
+// +build grpc
+
+package grpc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeysMsgKeepsEmptyKeys(t *testing.T) {
+	in := &keysMsg{Keys: [][]byte{[]byte("a"), nil, []byte("c")}}
+	var out keysMsg
+	if err := out.unmarshal(in.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Keys) != len(in.Keys) {
+		t.Fatalf("expected %d keys, got %d", len(in.Keys), len(out.Keys))
+	}
+	for i, k := range in.Keys {
+		if !bytes.Equal(out.Keys[i], k) {
+			t.Fatalf("key %d: expected %q, got %q", i, k, out.Keys[i])
+		}
+	}
+}
+
+func TestBlockMsgRoundTrip(t *testing.T) {
+	for _, in := range []*blockMsg{
+		{Key: []byte("key"), Data: []byte("data")},
+		{Data: []byte("no key")},
+		{Key: []byte("empty")},
+	} {
+		var out blockMsg
+		if err := out.unmarshal(in.marshal()); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Key, in.Key) || !bytes.Equal(out.Data, in.Data) {
+			t.Fatalf("expected %+v, got %+v", in, out)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// package grpc serves a BlockService over gRPC, so that several local
+// processes can share the blocks of one daemon: Register serves it, with
+// the service defined in blockservice.proto, and a Client is both a
+// blockstore.Blockstore and an exchange.Interface using it.
+//
+// Messages are encoded as blockservice.proto says, under the content
+// subtype "blocks" rather than "proto", so that the package needs no
+// generated code; clients in other languages must ask for that subtype.
+//
+// It depends on google.golang.org/grpc, which go-blocks does not vendor, so
+// its implementation is only built with the "grpc" build tag:
+//
+//	go get google.golang.org/grpc
+//	go build -tags grpc ./...
+package grpc
@@ -0,0 +1,196 @@
+//go:build grpc
+// +build grpc
+
+package grpc
+
+import (
+	"context"
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const serviceName = "goblocks.blockservice.BlockService"
+
+// The full names of the methods, as clients call them.
+const (
+	getMethod     = "/" + serviceName + "/Get"
+	getManyMethod = "/" + serviceName + "/GetMany"
+	putMethod     = "/" + serviceName + "/Put"
+	hasMethod     = "/" + serviceName + "/Has"
+	deleteMethod  = "/" + serviceName + "/Delete"
+)
+
+var serviceDesc = grpclib.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpclib.MethodDesc{
+		{MethodName: "Get", Handler: unary(getMethod, func() message { return new(keyMsg) }, (*server).get)},
+		{MethodName: "Put", Handler: unary(putMethod, func() message { return new(blockMsg) }, (*server).put)},
+		{MethodName: "Has", Handler: unary(hasMethod, func() message { return new(keyMsg) }, (*server).has)},
+		{MethodName: "Delete", Handler: unary(deleteMethod, func() message { return new(keyMsg) }, (*server).delete)},
+	},
+	Streams: []grpclib.StreamDesc{
+		{StreamName: "GetMany", Handler: getMany, ServerStreams: true},
+	},
+	Metadata: "blockservice.proto",
+}
+
+// Register serves |s| on |srv| as the BlockService of blockservice.proto.
+// Reads go through s.GetBlock and s.GetBlocks, and so the exchange; Has
+// only asks the blockstore, as the HEAD of package blockservice/http does.
+func Register(srv *grpclib.Server, s *blockservice.BlockService) {
+	srv.RegisterService(&serviceDesc, &server{s: s})
+}
+
+type server struct {
+	s *blockservice.BlockService
+}
+
+// unary adapts a method of server taking a request made by |newReq| to the
+// grpc handler of |method|, its full name.
+func unary(method string, newReq func() message, call func(*server, context.Context, message) (message, error)) func(interface{}, context.Context, func(interface{}) error, grpclib.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, icpt grpclib.UnaryServerInterceptor) (interface{}, error) {
+		req := newReq()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handle := func(ctx context.Context, req interface{}) (interface{}, error) {
+			resp, err := call(srv.(*server), ctx, req.(message))
+			if err != nil {
+				return nil, toStatus(err)
+			}
+			return resp, nil
+		}
+		if icpt == nil {
+			return handle(ctx, req)
+		}
+		return icpt(ctx, req, &grpclib.UnaryServerInfo{Server: srv, FullMethod: method}, handle)
+	}
+}
+
+func (sv *server) get(ctx context.Context, req message) (message, error) {
+	b, err := sv.s.GetBlock(ctx, key.Key(req.(*keyMsg).Key))
+	if err != nil {
+		return nil, err
+	}
+	return &blockMsg{Key: []byte(b.Key()), Data: b.Data}, nil
+}
+
+func (sv *server) put(ctx context.Context, req message) (message, error) {
+	m := req.(*blockMsg)
+	var b *blocks.Block
+	var err error
+	if len(m.Key) == 0 {
+		b, err = sv.s.NewBlock(m.Data)
+	} else {
+		b, err = toBlock(m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = sv.s.AddBlockCtx(ctx, b)
+	// a block stored but not announced is still stored.
+	var nae *blockservice.NotAnnouncedError
+	if err != nil && !errors.As(err, &nae) {
+		return nil, err
+	}
+	return &keyMsg{Key: []byte(b.Key())}, nil
+}
+
+func (sv *server) has(_ context.Context, req message) (message, error) {
+	has, err := sv.s.Blockstore.Has(key.Key(req.(*keyMsg).Key))
+	if err != nil {
+		return nil, err
+	}
+	return &presenceMsg{Has: has}, nil
+}
+
+func (sv *server) delete(ctx context.Context, req message) (message, error) {
+	if err := sv.s.DeleteBlockCtx(ctx, key.Key(req.(*keyMsg).Key)); err != nil {
+		return nil, err
+	}
+	return &emptyMsg{}, nil
+}
+
+func getMany(srv interface{}, stream grpclib.ServerStream) error {
+	req := new(keysMsg)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	ks := make([]key.Key, len(req.Keys))
+	for i, k := range req.Keys {
+		ks[i] = key.Key(k)
+	}
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	var sendErr error
+	for b := range srv.(*server).s.GetBlocks(ctx, ks) {
+		if sendErr != nil {
+			continue // drain the blocks already on their way.
+		}
+		if sendErr = stream.SendMsg(&blockMsg{Key: []byte(b.Key()), Data: b.Data}); sendErr != nil {
+			cancel()
+		}
+	}
+	return sendErr
+}
+
+// toBlock returns the block of |m|, checking that its data matches its key.
+func toBlock(m *blockMsg) (*blocks.Block, error) {
+	k := key.Key(m.Key)
+	if err := blockstore.Verify(k, m.Data); err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithKey(m.Data, k)
+}
+
+// sentinels are the errors that keep their identity over the wire, with
+// the code they are sent with.
+var sentinels = []struct {
+	err  error
+	code codes.Code
+}{
+	{blockstore.ErrNotFound, codes.NotFound},
+	{blockstore.ErrReadOnly, codes.PermissionDenied},
+	{blockstore.ErrHashMismatch, codes.InvalidArgument},
+	{blocks.ErrBlockTooLarge, codes.InvalidArgument},
+	{blockservice.ErrTimeout, codes.DeadlineExceeded},
+}
+
+// toStatus returns |err| as a grpc status error. Other not found errors are
+// sent as blockstore.ErrNotFound, which exchanges report misses with.
+func toStatus(err error) error {
+	if errors.Is(err, blockstore.ErrNotFound) || errors.Is(err, ds.ErrNotFound) {
+		err = blockstore.ErrNotFound
+	}
+	for _, s := range sentinels {
+		if errors.Is(err, s.err) {
+			return status.Error(s.code, err.Error())
+		}
+	}
+	return status.FromContextError(err).Err()
+}
+
+// fromStatus returns the error a status error sent by toStatus was made
+// from, if it was a sentinel, and |err| otherwise.
+func fromStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, s := range sentinels {
+		if st.Code() == s.code && st.Message() == s.err.Error() {
+			return s.err
+		}
+	}
+	return err
+}
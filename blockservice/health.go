@@ -0,0 +1,42 @@
+package blockservice
+
+import (
+	"fmt"
+
+	blocks "github.com/ipfs/go-blocks"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// HealthCheck checks that the service works, for liveness and readiness
+// probes: that it is open, that the blockstore stores and serves a probe
+// block, as SelfTest does, or, for a read-only service, answers a read, that
+// the announcement worker is running, and that the exchange responds, if
+// the service is online and the exchange is an exchange.Pinger. The
+// returned error names the check that failed.
+func (s *BlockService) HealthCheck(ctx context.Context) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if s.readOnly {
+		probe := blocks.NewBlock([]byte(selfTestPrefix))
+		if _, err := s.Blockstore.Has(probe.Key()); err != nil {
+			return fmt.Errorf("blockservice health check: blockstore: %w", err)
+		}
+	} else if err := s.SelfTest(ctx); err != nil {
+		return err
+	}
+	if err := s.worker.Ping(ctx); err != nil {
+		return fmt.Errorf("blockservice health check: worker: %w", err)
+	}
+	if s.Exchange == nil || !s.Online() {
+		return nil
+	}
+	if p, ok := s.Exchange.(exchange.Pinger); ok {
+		if err := p.Ping(ctx); err != nil {
+			return fmt.Errorf("blockservice health check: exchange: %w", err)
+		}
+	}
+	return nil
+}
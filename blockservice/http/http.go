@@ -0,0 +1,191 @@
+// package http serves the blocks of a BlockService over HTTP, giving
+// programs that can't link it, and people with curl, direct access to the
+// store:
+//
+//	GET  /block/{key}  the block's data, fetched through the exchange if needed
+//	HEAD /block/{key}  whether the block is stored locally
+//	PUT  /block        store the request body as a block, returning its key
+//	GET  /healthz      200 if BlockService.HealthCheck passes, 503 saying why if not
+//
+// Keys are written as key.Cid strings, and may be given in any form
+// key.DecodeCid accepts; keys it rejects are answered with 400 Bad Request,
+// saying why.
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+)
+
+const (
+	blockPath  = "/block"
+	healthPath = "/healthz"
+)
+
+// NewHandler returns a handler serving the blocks of |s| under /block. It
+// replies 404 for blocks the service does not find and 400 for malformed
+// keys. Blocks larger than s.MaxBlockSize are refused with 413, without
+// reading their whole body, and all writes to a read-only service with 403.
+// It also serves /healthz, for liveness and readiness probes.
+func NewHandler(s *blockservice.BlockService) http.Handler {
+	return &handler{s: s}
+}
+
+type handler struct {
+	s *blockservice.BlockService
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == healthPath {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.health(w, r)
+		return
+	}
+	if r.URL.Path == blockPath {
+		if r.Method != "PUT" {
+			w.Header().Set("Allow", "PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.put(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, blockPath+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := key.DecodeCid(strings.TrimPrefix(r.URL.Path, blockPath+"/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		h.get(w, r, c.Key())
+	case "HEAD":
+		h.has(w, c.Key())
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request, k key.Key) {
+	b, err := h.s.GetBlockStream(r.Context(), k)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rc, err := b.Reader()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer rc.Close()
+	// the reader only finds out at its end whether the data matched k, so the
+	// last byte is held back until it has: a client sees a body cut short
+	// rather than a complete one with the wrong data. Data of unknown size
+	// is all read before any is sent.
+	size := b.Size()
+	if size < 0 {
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(size))
+	if size > 0 {
+		if _, err := io.CopyN(w, rc, size-1); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+	rest, err := ioutil.ReadAll(rc)
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	w.Write(rest)
+}
+
+func (h *handler) has(w http.ResponseWriter, k key.Key) {
+	has, err := h.s.Blockstore.Has(k)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !has {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// put stores the body as a block, keyed as s.NewBlock does, and replies 201
+// with its key, which it also sets as the Location.
+func (h *handler) put(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	if max := h.s.MaxBlockSize(); max > 0 {
+		// one byte over is enough to know the block is too large.
+		body = io.LimitReader(body, int64(max)+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := h.s.NewBlock(data)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	_, err = h.s.AddBlockCtx(r.Context(), b)
+	// a block stored but not announced is still stored.
+	var nae *blockservice.NotAnnouncedError
+	if err != nil && !errors.As(err, &nae) {
+		writeError(w, err)
+		return
+	}
+	c := b.Cid().String()
+	w.Header().Set("Location", blockPath+"/"+c)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, c)
+}
+
+func (h *handler) health(w http.ResponseWriter, r *http.Request) {
+	if err := h.s.HealthCheck(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// writeError replies with the status matching |err|.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, blockstore.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, blocks.ErrBlockTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, blockstore.ErrReadOnly):
+		status = http.StatusForbidden
+	}
+	http.Error(w, err.Error(), status)
+}
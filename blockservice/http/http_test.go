@@ -0,0 +1,179 @@
+package http
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	offline "github.com/ipfs/go-blocks/blockservice/exchange/offline"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	flatfs "github.com/ipfs/go-blocks/blockstore/flatfs"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+)
+
+func newServer(t *testing.T, opts ...blockservice.Option) (*blockservice.BlockService, *httptest.Server) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	s, err := blockservice.New(bstore, offline.Exchange(bstore), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, httptest.NewServer(NewHandler(s))
+}
+
+func do(t *testing.T, method, url string, body []byte) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func expectStatus(t *testing.T, resp *http.Response, want int) {
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: expected status %d, got %d", resp.Request.Method, resp.Request.URL.Path, want, resp.StatusCode)
+	}
+}
+
+func TestPutGetHead(t *testing.T) {
+	s, srv := newServer(t)
+	defer srv.Close()
+	data := []byte("block over http")
+	want := blocks.NewBlock(data).Key()
+
+	resp, body := do(t, "PUT", srv.URL+"/block", data)
+	expectStatus(t, resp, http.StatusCreated)
+	k := strings.TrimSpace(body)
+	if k != want.B58String() {
+		t.Fatalf("expected key %s, got %q", want.B58String(), body)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/block/"+k {
+		t.Fatalf("expected Location /block/%s, got %q", k, loc)
+	}
+	if has, _ := s.Blockstore.Has(want); !has {
+		t.Fatal("PUT did not store the block")
+	}
+
+	resp, body = do(t, "GET", srv.URL+"/block/"+k, nil)
+	expectStatus(t, resp, http.StatusOK)
+	if body != string(data) {
+		t.Fatalf("expected %q, got %q", data, body)
+	}
+	resp, _ = do(t, "HEAD", srv.URL+"/block/"+k, nil)
+	expectStatus(t, resp, http.StatusOK)
+}
+
+func TestMissingAndInvalid(t *testing.T) {
+	_, srv := newServer(t)
+	defer srv.Close()
+	missing := blocks.NewBlock([]byte("missing")).Key().B58String()
+
+	resp, _ := do(t, "GET", srv.URL+"/block/"+missing, nil)
+	expectStatus(t, resp, http.StatusNotFound)
+	resp, _ = do(t, "HEAD", srv.URL+"/block/"+missing, nil)
+	expectStatus(t, resp, http.StatusNotFound)
+	resp, _ = do(t, "GET", srv.URL+"/block/not-a-key", nil)
+	expectStatus(t, resp, http.StatusBadRequest)
+	resp, _ = do(t, "DELETE", srv.URL+"/block/"+missing, nil)
+	expectStatus(t, resp, http.StatusMethodNotAllowed)
+	resp, _ = do(t, "GET", srv.URL+"/block", nil)
+	expectStatus(t, resp, http.StatusMethodNotAllowed)
+	resp, _ = do(t, "GET", srv.URL+"/other", nil)
+	expectStatus(t, resp, http.StatusNotFound)
+}
+
+func TestPutRefused(t *testing.T) {
+	_, srv := newServer(t, blockservice.WithMaxBlockSize(4))
+	defer srv.Close()
+	resp, _ := do(t, "PUT", srv.URL+"/block", []byte("too large"))
+	expectStatus(t, resp, http.StatusRequestEntityTooLarge)
+
+	_, ro := newServer(t, blockservice.WithReadOnly())
+	defer ro.Close()
+	resp, _ = do(t, "PUT", ro.URL+"/block", []byte("data"))
+	expectStatus(t, resp, http.StatusForbidden)
+}
+
+func TestHealthz(t *testing.T) {
+	s, srv := newServer(t)
+	defer srv.Close()
+	resp, body := do(t, "GET", srv.URL+"/healthz", nil)
+	expectStatus(t, resp, http.StatusOK)
+	if strings.TrimSpace(body) != "ok" {
+		t.Fatalf("got %q", body)
+	}
+	resp, _ = do(t, "PUT", srv.URL+"/healthz", nil)
+	expectStatus(t, resp, http.StatusMethodNotAllowed)
+
+	s.Close()
+	resp, body = do(t, "GET", srv.URL+"/healthz", nil)
+	expectStatus(t, resp, http.StatusServiceUnavailable)
+	if !strings.Contains(body, blockservice.ErrClosed.Error()) {
+		t.Fatalf("got %q", body)
+	}
+}
+
+func TestGetCutsShortCorruptStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bstore, err := flatfs.NewBlockstore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := blockservice.New(bstore, offline.Exchange(bstore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(s))
+	defer srv.Close()
+	b := blocks.NewBlock([]byte("streamed over http"))
+	if _, err := s.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	url := srv.URL + "/block/" + b.Key().B58String()
+	resp, body := do(t, "GET", url, nil)
+	expectStatus(t, resp, http.StatusOK)
+	if body != string(b.Data) {
+		t.Fatalf("expected %q, got %q", b.Data, body)
+	}
+
+	// corrupt the file, keeping its length.
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		return ioutil.WriteFile(path, []byte("corrupted on disk!"), 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data is refused before its end, when the response may or may not
+	// have begun.
+	resp, err = http.Get(url)
+	if err == nil {
+		defer resp.Body.Close()
+		if data, err := ioutil.ReadAll(resp.Body); err == nil {
+			t.Fatalf("expected the body cut short, got all of %q", data)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package blockservice
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+	worker "github.com/ipfs/go-blocks/blockservice/worker"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// addWait bounds how long GetBlock waits for an in-flight add of the block it
+// missed before falling back to the exchange.
+const addWait = time.Second
+
+// inflightAdds tracks the keys whose blocks are being stored right now.
+type inflightAdds struct {
+	mu   sync.Mutex
+	adds map[key.Key]*inflightAdd
+}
+
+type inflightAdd struct {
+	refs int
+	done chan struct{} // closed when the last add of the key finishes
+}
+
+func newInflightAdds() *inflightAdds {
+	return &inflightAdds{adds: make(map[key.Key]*inflightAdd)}
+}
+
+// begin registers an add of |k|, returning the function that ends it.
+func (f *inflightAdds) begin(k key.Key) func() {
+	f.mu.Lock()
+	a, ok := f.adds[k]
+	if !ok {
+		a = &inflightAdd{done: make(chan struct{})}
+		f.adds[k] = a
+	}
+	a.refs++
+	f.mu.Unlock()
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if a.refs--; a.refs == 0 {
+			close(a.done)
+			delete(f.adds, k)
+		}
+	}
+}
+
+// wait blocks until no add of |k| is in flight, |ctx| is done, or addWait
+// has passed. It reports whether an add was waited on to completion.
+func (f *inflightAdds) wait(ctx context.Context, k key.Key) bool {
+	f.mu.Lock()
+	a, ok := f.adds[k]
+	f.mu.Unlock()
+	if !ok {
+		return false
+	}
+	timeout := time.NewTimer(addWait)
+	defer timeout.Stop()
+	select {
+	case <-a.done:
+		return true
+	case <-timeout.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// flightGroup coalesces concurrent calls for the same key, as singleflight
+// does: the first runs, and those made while it does wait for its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[key.Key]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{} // closed once val and err are set
+	val  interface{}
+	err  error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[key.Key]*flightCall)}
+}
+
+// do returns the result of |fn|, or, if a call for |k| is in progress, that
+// of the call, reporting it as shared. |ctx| only bounds the wait: the call
+// runs on for the others.
+func (g *flightGroup) do(ctx context.Context, k key.Key, fn func() (interface{}, error)) (_ interface{}, shared bool, _ error) {
+	g.mu.Lock()
+	if c, ok := g.calls[k]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.val, true, c.err
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		}
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[k] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	g.mu.Lock()
+	delete(g.calls, k)
+	g.mu.Unlock()
+	close(c.done)
+	return c.val, false, c.err
+}
+
+// fetched is the block a coalesced fetch got, shared by its callers. Each
+// returns its own copy of b if it is pooled, since any may release it.
+type fetched struct {
+	b    *blocks.Block
+	prov exchange.Provenance
+	// repair stores the block once, for whichever caller keeps it first.
+	repair sync.Once
+}
+
+// abandonedFetch is what a coalesced fetch results in, with its error, if the
+// context of the caller that made it was done by the time it failed, so
+// that the callers still waiting know to try again, whatever the error.
+type abandonedFetch struct{}
+
+// fetchShared is fetchBlockAt, verifying the block, coalesced with the
+// concurrent fetches of |k|: only the first asks the exchange, and the
+// others wait for what it gets. Those left waiting when the first gives up
+// with its context try again.
+func (s *BlockService) fetchShared(ctx context.Context, f exchange.Fetcher, k key.Key, prio worker.Priority) (*fetched, error) {
+	for {
+		v, shared, err := s.fetching.do(ctx, k, func() (interface{}, error) {
+			var mu sync.Mutex
+			var prov exchange.Provenance
+			xctx := exchange.WithProvenance(ctx, func(got key.Key, p exchange.Provenance) {
+				if got == k {
+					mu.Lock()
+					prov = p
+					mu.Unlock()
+				}
+			})
+			start := time.Now()
+			b, err := s.fetchBlockAt(xctx, f, k, prio)
+			s.stats.exchangeLatency.observe(time.Since(start))
+			if err == nil {
+				err = s.verifyRemote(k, b)
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return abandonedFetch{}, err
+				}
+				return nil, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			return &fetched{b: b, prov: prov}, nil
+		})
+		// the fetch shared may also have been cut short by the budget of the
+		// context it was started with.
+		_, abandoned := v.(abandonedFetch)
+		if shared && ctx.Err() == nil && (abandoned || errors.Is(err, ErrBudgetExceeded)) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return v.(*fetched), nil
+	}
+}
@@ -0,0 +1,37 @@
+package blockservice
+
+import (
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// inlineBlock returns the block |k| holds, if it is inline, without reading
+// the blockstore or the exchange.
+func inlineBlock(k key.Key) (*blocks.Block, bool) {
+	data, ok := k.InlineData()
+	if !ok {
+		return nil, false
+	}
+	b, err := blocks.NewBlockWithKey(data, k)
+	return b, err == nil
+}
+
+// isInline reports whether |b| is held by its key, and so is never stored.
+func isInline(b *blocks.Block) bool {
+	_, ok := b.Key().InlineData()
+	return ok
+}
+
+// withoutInline returns the blocks of |bs| that are not inline, with their
+// keys.
+func withoutInline(bs []*blocks.Block) ([]*blocks.Block, []key.Key) {
+	out := make([]*blocks.Block, 0, len(bs))
+	ks := make([]key.Key, 0, len(bs))
+	for _, b := range bs {
+		if !isInline(b) {
+			out = append(out, b)
+			ks = append(ks, b.Key())
+		}
+	}
+	return out, ks
+}
@@ -0,0 +1,52 @@
+package blockservice
+
+import (
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// LazyBlock is a reference to a block whose data is not fetched until it is
+// first asked for. It is safe for concurrent use; concurrent callers share a
+// single fetch.
+type LazyBlock struct {
+	k   key.Key
+	ctx context.Context
+	s   *BlockService
+
+	once  sync.Once
+	block *blocks.Block
+	err   error
+}
+
+// LazyBlock returns a reference to the block named by |k|. The first call to
+// Data or Block fetches it with GetBlock, under |ctx|; the outcome, success
+// or failure, is kept for every later call.
+func (s *BlockService) LazyBlock(ctx context.Context, k key.Key) *LazyBlock {
+	return &LazyBlock{k: k, ctx: ctx, s: s}
+}
+
+// Key returns the key of the referenced block, without fetching it.
+func (b *LazyBlock) Key() key.Key {
+	return b.k
+}
+
+// Data returns the data of the referenced block, fetching it if needed.
+func (b *LazyBlock) Data() ([]byte, error) {
+	blk, err := b.Block()
+	if err != nil {
+		return nil, err
+	}
+	return blk.Data, nil
+}
+
+// Block returns the referenced block, fetching it if needed.
+func (b *LazyBlock) Block() (*blocks.Block, error) {
+	b.once.Do(func() {
+		b.block, b.err = b.s.GetBlock(b.ctx, b.k)
+	})
+	return b.block, b.err
+}
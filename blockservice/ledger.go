@@ -0,0 +1,29 @@
+package blockservice
+
+import (
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+)
+
+// Ledger returns the exchange's ledger of |peer|, empty if nothing was
+// exchanged with it, or ErrNotSupported if the exchange does not implement
+// exchange.Accountant.
+func (s *BlockService) Ledger(peer string) (exchange.Ledger, error) {
+	a, ok := s.Exchange.(exchange.Accountant)
+	if !ok {
+		return exchange.Ledger{}, ErrNotSupported
+	}
+	if l, ok := a.Ledger(peer); ok {
+		return l, nil
+	}
+	return exchange.Ledger{Peer: peer}, nil
+}
+
+// Ledgers returns the exchange's ledgers of every peer something was
+// exchanged with, or ErrNotSupported as Ledger does.
+func (s *BlockService) Ledgers() ([]exchange.Ledger, error) {
+	a, ok := s.Exchange.(exchange.Accountant)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return a.Ledgers(), nil
+}
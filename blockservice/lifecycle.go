@@ -0,0 +1,79 @@
+package blockservice
+
+import (
+	"sync/atomic"
+
+	worker "github.com/ipfs/go-blocks/blockservice/worker"
+)
+
+// ErrClosed is returned by the calls made to a BlockService once Close was
+// called. Calls already in progress then either complete or fail with it.
+// It is worker.ErrClosed, so that the errors of the service's workers match
+// it too, and the errors daemon clients return once closed wrap it.
+var ErrClosed = worker.ErrClosed
+
+// State is where a BlockService is in its life.
+type State int32
+
+const (
+	// StateNew is a service not used yet, which the Enable and Set methods
+	// that must come first may still configure.
+	StateNew State = iota
+	// StateRunning is a service a read or write has been made to.
+	StateRunning
+	// StateClosing is a service whose Close is stopping its background
+	// work.
+	StateClosing
+	// StateClosed is a service Close is done with.
+	StateClosed
+)
+
+func (st State) String() string {
+	switch st {
+	case StateNew:
+		return "new"
+	case StateRunning:
+		return "running"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// State returns where the service is in its life.
+func (s *BlockService) State() State {
+	return State(atomic.LoadInt32(&s.state))
+}
+
+// Done returns a channel closed once Close, or CloseWithContext, has
+// stopped the service's background work, for code shutting down with it.
+func (s *BlockService) Done() <-chan struct{} {
+	return s.done
+}
+
+// checkOpen returns ErrClosed once Close was called, and otherwise marks
+// the service running.
+func (s *BlockService) checkOpen() error {
+	if atomic.CompareAndSwapInt32(&s.state, int32(StateNew), int32(StateRunning)) {
+		return nil
+	}
+	if s.State() >= StateClosing {
+		return ErrClosed
+	}
+	return nil
+}
+
+// shutdown runs |stop| the first time it is called, moving the service
+// through StateClosing to StateClosed. Later and concurrent calls wait for
+// the first, and return what it did.
+func (s *BlockService) shutdown(stop func() (int, error)) (int, error) {
+	s.closeOnce.Do(func() {
+		atomic.StoreInt32(&s.state, int32(StateClosing))
+		s.closeDropped, s.closeErr = stop()
+		atomic.StoreInt32(&s.state, int32(StateClosed))
+		close(s.done)
+	})
+	return s.closeDropped, s.closeErr
+}
@@ -0,0 +1,330 @@
+package blockservice
+
+import (
+	"container/list"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+	worker "github.com/ipfs/go-blocks/blockservice/worker"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// WithMaxConcurrentFetches caps the exchange GetBlock calls the service
+// makes at once, for GetBlock and the read strategies. Calls over the cap
+// wait their turn, or until their context is done. The default, zero, is no
+// cap.
+func WithMaxConcurrentFetches(n int) Option {
+	return func(o *options) { o.maxFetches = n }
+}
+
+// WithMaxOutstandingWants caps the keys the service has asked the exchange
+// for and not yet got an answer for, across all reads. Longer GetBlocks
+// requests are sent in batches, each once there is room for it; a batch's
+// keys stay outstanding until the exchange closes its stream. The default,
+// zero, is no cap.
+func WithMaxOutstandingWants(n int) Option {
+	return func(o *options) { o.maxWants = n }
+}
+
+// fetchBlock gets |k| from |f| within the service's limits and fetch
+// timeout, retrying as its RetryPolicy says. No fetch slot is held between
+// attempts. Prefetches wait until it is done.
+func (s *BlockService) fetchBlock(ctx context.Context, f exchange.Fetcher, k key.Key) (*blocks.Block, error) {
+	return s.fetchBlockAt(ctx, f, k, worker.PriorityNormal)
+}
+
+// fetchBlockAt is fetchBlock at |prio|, as the Priority GetOption says: a
+// high priority fetch takes its slots ahead of the waiters, and a low one
+// waits, as prefetches do, until no other fetch is in progress.
+func (s *BlockService) fetchBlockAt(ctx context.Context, f exchange.Fetcher, k key.Key, prio worker.Priority) (*blocks.Block, error) {
+	if prio < worker.PriorityNormal {
+		if err := s.interactive.wait(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		s.interactive.begin()
+		defer s.interactive.end()
+	}
+	bctx, _, stop, err := budgeted(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	fctx, cancel := s.withFetchTimeout(bctx)
+	defer cancel()
+	var b *blocks.Block
+	err = s.retrying(fctx, func(ctx context.Context) (err error) {
+		b, err = s.fetchOnce(ctx, f, k, prio > worker.PriorityNormal)
+		return err
+	})
+	if err = overBudget(ctx, bctx, timedOut(bctx, fctx, err)); err == nil {
+		budgetOf(ctx).spend(b)
+	}
+	return b, err
+}
+
+// fetchOnce makes one attempt of fetchBlock, taking its slots ahead of the
+// waiters if |first|.
+func (s *BlockService) fetchOnce(ctx context.Context, f exchange.Fetcher, k key.Key, first bool) (*blocks.Block, error) {
+	if s.fetches != nil {
+		if err := s.fetches.take(ctx, 1, first); err != nil {
+			return nil, err
+		}
+		defer s.fetches.release(1)
+	}
+	if s.wants != nil {
+		if err := s.wants.take(ctx, 1, first); err != nil {
+			return nil, err
+		}
+		defer s.wants.release(1)
+	}
+	defer s.want(ctx, []key.Key{k}).done()
+	var b *blocks.Block
+	err := s.recovered("exchange GetBlock", func() (err error) {
+		b, err = f.GetBlock(ctx, k)
+		return err
+	})
+	return b, err
+}
+
+// fetchBlocks is requestBlocks for reads. Prefetches wait until its stream
+// is closed.
+func (s *BlockService) fetchBlocks(ctx context.Context, f exchange.Fetcher, ks []key.Key) (<-chan *blocks.Block, error) {
+	out := make(chan *blocks.Block)
+	if err := s.fetchBlocksTo(ctx, f, ks, out, func() { close(out) }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// fetchBlocksTo is fetchBlocks, sending the stream to |out|, shared by
+// several fetches, and calling |done| once it ends. The stream ends at the
+// fetch timeout.
+func (s *BlockService) fetchBlocksTo(ctx context.Context, f exchange.Fetcher, ks []key.Key, out chan<- *blocks.Block, done func()) error {
+	s.interactive.begin()
+	ctx, cancel := s.withFetchTimeout(ctx)
+	w := s.want(ctx, ks)
+	in, err := s.requestBlocks(ctx, f, ks)
+	if err != nil {
+		w.done()
+		cancel()
+		s.interactive.end()
+		return err
+	}
+	go func() {
+		defer done()
+		defer s.interactive.end()
+		defer cancel()
+		defer w.done()
+		for b := range in {
+			w.got(b.Key())
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// requestBlocks gets |ks| from |f| within the service's limits, merging the
+// streams of its batches into one. Only the first batch's error is
+// returned; a later failing batch is left out of the stream.
+func (s *BlockService) requestBlocks(ctx context.Context, f exchange.Fetcher, ks []key.Key) (<-chan *blocks.Block, error) {
+	if budgetOf(ctx) != nil {
+		return s.requestBudgeted(ctx, f, ks)
+	}
+	return s.requestWithin(ctx, f, ks)
+}
+
+// requestBudgeted is requestBlocks within the budget of |ctx|: it asks for
+// as many of |ks| as the budget allows, and ends the stream once it runs
+// out.
+func (s *BlockService) requestBudgeted(ctx context.Context, f exchange.Fetcher, ks []key.Key) (<-chan *blocks.Block, error) {
+	bctx, n, stop, err := budgeted(ctx, len(ks))
+	if err != nil {
+		return nil, err
+	}
+	in, err := s.requestWithin(bctx, f, ks[:n])
+	if err != nil {
+		stop()
+		return nil, overBudget(ctx, bctx, err)
+	}
+	b := budgetOf(ctx)
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		defer stop()
+		defer func() { overBudget(ctx, bctx, bctx.Err()) }()
+		for blk := range in {
+			over := b.spend(blk)
+			select {
+			case out <- blk:
+			case <-bctx.Done():
+				return
+			}
+			if over {
+				b.exceed()
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// getBlocksFrom asks |f| for |ks|, recovering from a panic as the service
+// says.
+func (s *BlockService) getBlocksFrom(ctx context.Context, f exchange.Fetcher, ks []key.Key) (<-chan *blocks.Block, error) {
+	var in <-chan *blocks.Block
+	err := s.recovered("exchange GetBlocks", func() (err error) {
+		in, err = f.GetBlocks(ctx, ks)
+		return err
+	})
+	return in, err
+}
+
+// requestWithin is requestBlocks, leaving the budget aside.
+func (s *BlockService) requestWithin(ctx context.Context, f exchange.Fetcher, ks []key.Key) (<-chan *blocks.Block, error) {
+	if s.wants == nil {
+		return s.getBlocksFrom(ctx, f, ks)
+	}
+	var batches [][]key.Key
+	for len(ks) > 0 {
+		n := s.wants.size
+		if n > len(ks) {
+			n = len(ks)
+		}
+		batches = append(batches, ks[:n])
+		ks = ks[n:]
+	}
+
+	out := make(chan *blocks.Block)
+	var wg sync.WaitGroup
+	// send requests |batch|, and forwards its stream in the background.
+	send := func(batch []key.Key) error {
+		if err := s.wants.acquire(ctx, len(batch)); err != nil {
+			return err
+		}
+		in, err := s.getBlocksFrom(ctx, f, batch)
+		if err != nil {
+			s.wants.release(len(batch))
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.wants.release(len(batch))
+			for b := range in {
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return nil
+	}
+
+	if err := send(batches[0]); err != nil {
+		return nil, err
+	}
+	go func() {
+		for _, batch := range batches[1:] {
+			if send(batch) != nil {
+				break
+			}
+		}
+		wg.Wait()
+		close(out)
+	}()
+	return out, nil
+}
+
+// semaphore is a weighted semaphore of |size| units. Waiters are served in
+// order, so large requests are not starved by small ones.
+type semaphore struct {
+	size int
+
+	mu      sync.Mutex
+	used    int
+	waiters list.List // of *semWaiter
+}
+
+type semWaiter struct {
+	n     int
+	ready chan struct{}
+}
+
+// newSemaphore returns a semaphore of |size| units, or nil, meaning no
+// limit, if |size| is not positive.
+func newSemaphore(size int) *semaphore {
+	if size <= 0 {
+		return nil
+	}
+	return &semaphore{size: size}
+}
+
+// acquire takes |n| units, which must be at most the semaphore's size,
+// waiting for them until |ctx| is done.
+func (s *semaphore) acquire(ctx context.Context, n int) error {
+	return s.take(ctx, n, false)
+}
+
+// take is acquire, but ahead of the waiters already queued if |first|.
+func (s *semaphore) take(ctx context.Context, n int, first bool) error {
+	s.mu.Lock()
+	if (first || s.waiters.Len() == 0) && s.size-s.used >= n {
+		s.used += n
+		s.mu.Unlock()
+		return nil
+	}
+	w := &semWaiter{n: n, ready: make(chan struct{})}
+	var e *list.Element
+	if first {
+		e = s.waiters.PushFront(w)
+	} else {
+		e = s.waiters.PushBack(w)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-w.ready:
+			// granted just now; hand the units back.
+			s.used -= n
+		default:
+			s.waiters.Remove(e)
+		}
+		s.grant()
+		return ctx.Err()
+	}
+}
+
+func (s *semaphore) release(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= n
+	s.grant()
+}
+
+// grant wakes the waiters at the front that now fit. s.mu must be held.
+func (s *semaphore) grant() {
+	for e := s.waiters.Front(); e != nil; e = s.waiters.Front() {
+		w := e.Value.(*semWaiter)
+		if s.size-s.used < w.n {
+			return
+		}
+		s.used += w.n
+		s.waiters.Remove(e)
+		close(w.ready)
+	}
+}
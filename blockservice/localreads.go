@@ -0,0 +1,154 @@
+package blockservice
+
+import (
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// readLocal reads |ks| one at a time for GetBlocks, passing each block found
+// to |found|, which reports whether to go on, and every miss, at the end, to
+// |want|, or each as it is found if |eager|. |fail| is told of the keys whose
+// read failed other than by a miss.
+func (s *BlockService) readLocal(ctx context.Context, ks []key.Key, eager bool, want func([]key.Key), found func(key.Key, *blocks.Block) bool, fail func(key.Key)) {
+	var misses []key.Key
+	for _, k := range ks {
+		hit, err := s.readLocalSpan(ctx, k)
+		if err != nil {
+			if !errors.Is(err, blockstore.ErrNotFound) {
+				fail(k)
+			}
+			if eager {
+				want([]key.Key{k})
+			} else {
+				misses = append(misses, k)
+			}
+			continue
+		}
+		if !found(k, hit) {
+			return
+		}
+	}
+	want(misses)
+}
+
+// readLocalParallel is readLocal with s.localReads reads at once, passing
+// the misses to |want| as they are found: whenever there are some, and no
+// read has just finished, or each at once if |eager|. Once |found| reports
+// not to go on, the reads left are called off.
+func (s *BlockService) readLocalParallel(ctx context.Context, ks []key.Key, eager bool, want func([]key.Key), found func(key.Key, *blocks.Block) bool, fail func(key.Key)) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type read struct {
+		k   key.Key
+		b   *blocks.Block
+		err error
+	}
+	todo := make(chan key.Key)
+	done := make(chan read)
+	var wg sync.WaitGroup
+	for i := 0; i < s.localReads && i < len(ks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range todo {
+				b, err := s.readLocalSpan(ctx, k)
+				select {
+				case done <- read{k, b, err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(todo)
+		for _, k := range ks {
+			select {
+			case todo <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var misses []key.Key
+	for {
+		var r read
+		var ok bool
+		if len(misses) > 0 {
+			select {
+			case r, ok = <-done:
+			default:
+				want(misses)
+				misses = nil
+				continue
+			}
+		} else {
+			r, ok = <-done
+		}
+		if !ok {
+			break
+		}
+		if r.err != nil {
+			if !errors.Is(r.err, blockstore.ErrNotFound) {
+				fail(r.k)
+			}
+			if eager {
+				want([]key.Key{r.k})
+			} else {
+				misses = append(misses, r.k)
+			}
+			continue
+		}
+		if !found(r.k, r.b) {
+			cancel()
+			// let the readers still running finish.
+			for range done {
+			}
+			return
+		}
+	}
+	want(misses)
+}
+
+// readLocalSpan is getLocal, traced as a blockstore read.
+func (s *BlockService) readLocalSpan(ctx context.Context, k key.Key) (*blocks.Block, error) {
+	_, span := s.startSpan(ctx, "blockstore.Get")
+	span.SetTag("key", k.B58String())
+	b, err := s.getLocal(k)
+	finishLocal(span, err)
+	return b, err
+}
+
+// chunker passes keys on to |want| |n| at a time, for MissesChunked. The
+// last keys, fewer than |n|, are passed on by flush.
+type chunker struct {
+	n    int
+	want func([]key.Key)
+	buf  []key.Key
+}
+
+func (c *chunker) add(ks []key.Key) {
+	for _, k := range ks {
+		c.buf = append(c.buf, k)
+		if len(c.buf) >= c.n {
+			c.want(c.buf)
+			c.buf = nil
+		}
+	}
+}
+
+func (c *chunker) flush() {
+	c.want(c.buf)
+	c.buf = nil
+}
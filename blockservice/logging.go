@@ -0,0 +1,109 @@
+package blockservice
+
+import (
+	"time"
+
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// LogLevel is the severity of a message given to a Logger.
+type LogLevel int
+
+const (
+	// LevelDebug is for a message about every operation, to debug fetches
+	// with.
+	LevelDebug LogLevel = iota
+	// LevelInfo is for failures the service recovers from, such as an
+	// announcement to retry.
+	LevelInfo
+	// LevelWarn is for trouble an operator should look into, such as
+	// corrupt blocks from the exchange or a disk breaker opening.
+	LevelWarn
+	// LevelError is for failures that lose data or requests.
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Field is a named value logged with a message.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the service's log messages, for routing into the
+// embedder's logging system. Implementations must be safe for concurrent
+// use, and should return quickly, as they are called inline.
+//
+// Each operation Metrics measures is logged at LevelDebug as "blockservice
+// operation", with the fields "op", "outcome" and "duration", and, as they
+// apply, "key", "size" (in bytes), "source" ("local" or "exchange") and
+// "error".
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...Field)
+}
+
+// WithLogger makes the service log to |l| the messages at |level| or above.
+// By default, or if |l| is nil, nothing is logged.
+func WithLogger(l Logger, level LogLevel) Option {
+	return func(o *options) {
+		if l == nil {
+			return
+		}
+		o.logger = l
+		o.logLevel = level
+		o.worker.OnProvideError = func(k key.Key, err error) {
+			if level <= LevelInfo {
+				l.Log(LevelInfo, "blockservice announcement failed", Field{"key", k}, Field{"error", err})
+			}
+		}
+	}
+}
+
+// logs reports whether messages at |level| are logged.
+func (s *BlockService) logs(level LogLevel) bool {
+	return s.logger != nil && level >= s.logLevel
+}
+
+// log logs |msg| at |level|, if messages at it are logged.
+func (s *BlockService) log(level LogLevel, msg string, fields ...Field) {
+	if s.logs(level) {
+		s.logger.Log(level, msg, fields...)
+	}
+}
+
+// logOp logs the operation |op| that took |d|, as observe describes it.
+func (s *BlockService) logOp(op Operation, outcome Outcome, d time.Duration, k key.Key, size int, err error) {
+	if !s.logs(LevelDebug) {
+		return
+	}
+	fields := []Field{{"op", op}, {"outcome", outcome}, {"duration", d}}
+	if k != "" {
+		fields = append(fields, Field{"key", k})
+	}
+	if size >= 0 {
+		fields = append(fields, Field{"size", size})
+	}
+	switch outcome {
+	case OutcomeLocalHit:
+		fields = append(fields, Field{"source", "local"})
+	case OutcomeExchangeHit:
+		fields = append(fields, Field{"source", "exchange"})
+	}
+	if err != nil {
+		fields = append(fields, Field{"error", err})
+	}
+	s.logger.Log(LevelDebug, "blockservice operation", fields...)
+}
@@ -0,0 +1,74 @@
+package blockservice
+
+import (
+	"time"
+
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// Operation names a BlockService operation reported to Metrics.
+type Operation string
+
+const (
+	OpGetBlock     Operation = "get_block"
+	OpGetBlocks    Operation = "get_blocks"
+	OpAddBlock     Operation = "add_block"
+	OpAddBlocks    Operation = "add_blocks"
+	OpDeleteBlock  Operation = "delete_block"
+	OpDeleteBlocks Operation = "delete_blocks"
+)
+
+// Outcome says how an operation reported to Metrics ended.
+type Outcome string
+
+const (
+	// Reads end with one of these. Errors are blockstore failures, as in
+	// Stats; a block the exchange could not deliver is a miss.
+	OutcomeLocalHit    Outcome = "local_hit"
+	OutcomeExchangeHit Outcome = "exchange_hit"
+	OutcomeMiss        Outcome = "miss"
+	OutcomeError       Outcome = "error"
+
+	// Adds and deletes end with OutcomeOK or OutcomeError, and a delete of
+	// a block that is not stored with OutcomeMiss.
+	OutcomeOK Outcome = "ok"
+)
+
+// Metrics receives a measurement of each BlockService operation as it
+// ends, for export to a monitoring system; see the prometheus package for
+// one. Implementations must be safe for concurrent use, and should return
+// quickly, as they are called inline.
+//
+// GetBlock, AddBlock (and its variants) and DeleteBlock are measured from
+// call to return; an add covers storing the block, not announcing it.
+// GetBlocks reports each distinct key it looks up, with the time from the
+// call until its block was found or given up on. AddBlocks reports the
+// batch as a whole, and DeleteBlocks each of the batches it deletes.
+type Metrics interface {
+	Observe(op Operation, outcome Outcome, d time.Duration)
+}
+
+// SetMetrics makes the service report its operations to |m|. It must be set
+// before the service is used.
+func (s *BlockService) SetMetrics(m Metrics) {
+	s.metrics = m
+}
+
+// observe reports an operation started at |start| to the metrics and the
+// logger, if set. |k| is the block's key, if the operation had one, and
+// |size| its size, or -1 if unknown.
+func (s *BlockService) observe(op Operation, outcome Outcome, start time.Time, k key.Key, size int, err error) {
+	d := time.Since(start)
+	if s.metrics != nil {
+		s.metrics.Observe(op, outcome, d)
+	}
+	s.logOp(op, outcome, d, k, size, err)
+}
+
+// writeOutcome classifies the result of an add or delete.
+func writeOutcome(err error) Outcome {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeOK
+}
@@ -0,0 +1,38 @@
+package blockservice
+
+import (
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Service is the part of a BlockService that Middleware intercepts: its
+// reads, adds and deletes. *BlockService is a Service.
+type Service interface {
+	GetBlock(ctx context.Context, k key.Key, opts ...GetOption) (*blocks.Block, error)
+	GetBlocks(ctx context.Context, ks []key.Key) <-chan *blocks.Block
+	AddBlockCtx(ctx context.Context, b *blocks.Block) (key.Key, error)
+	DeleteBlockCtx(ctx context.Context, k key.Key) error
+}
+
+var _ Service = (*BlockService)(nil)
+
+// Middleware returns a Service doing what |next| does, and more: it may
+// observe the calls, as logging and metrics do, refuse them, as an
+// authorization check does, or answer them itself, as a cache does. A
+// Middleware usually embeds |next| in what it returns, and overrides the
+// calls it is about.
+type Middleware func(next Service) Service
+
+// WrapBlockService returns |s| wrapped in |mws|, the first outermost: a
+// call goes through mws[0], then mws[1], and so on, before it reaches |s|.
+// Only calls made through the Service returned are intercepted; those made
+// on |s| directly, or by its own background work, are not.
+func WrapBlockService(s *BlockService, mws ...Middleware) Service {
+	var svc Service = s
+	for i := len(mws) - 1; i >= 0; i-- {
+		svc = mws[i](svc)
+	}
+	return svc
+}
@@ -0,0 +1,118 @@
+package blockservice
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	lru "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/hashicorp/golang-lru"
+)
+
+// WithNotFoundCache has the service remember, for |ttl|, the keys found
+// neither in the blockstore nor through the exchange, so that reading them
+// again in that time returns ErrNotFound at once, without asking either.
+// This helps with keys looked up often that are genuinely missing, such as
+// optional links. At most |size| keys are remembered, those missed least
+// recently making room for others.
+//
+// GetBlock and GetBlocksWithErrors remember a key when the exchange reports
+// it missing, not when they give up on it for their context, the fetch
+// timeout, an error, or because the exchange is offline. GetBlocks and the
+// others only skip the keys remembered. Adding a block through the service
+// forgets it; blocks stored in the blockstore directly can be forgotten
+// with ForgetNotFound. The default, zero, remembers nothing.
+func WithNotFoundCache(ttl time.Duration, size int) Option {
+	return func(o *options) {
+		o.notFoundTTL = ttl
+		o.notFoundSize = size
+	}
+}
+
+// ForgetNotFound drops |ks| from the keys remembered as missing, for blocks
+// that were stored without going through the service. See
+// WithNotFoundCache.
+func (s *BlockService) ForgetNotFound(ks ...key.Key) {
+	s.notFound.forget(ks)
+}
+
+// reportsMissing reports whether |err| says the exchange found a key
+// missing, for the not-found cache. exchange.ErrOffline is not such an
+// error, though it wraps blockstore.ErrNotFound.
+func reportsMissing(err error) bool {
+	return errors.Is(err, blockstore.ErrNotFound) && !errors.Is(err, exchange.ErrOffline)
+}
+
+// notFoundCache holds the keys found missing, until their expiry.
+type notFoundCache struct {
+	ttl     time.Duration
+	expires *lru.Cache // key.Key -> time.Time
+}
+
+// newNotFoundCache returns nil, which remembers nothing, if |ttl| is zero.
+func newNotFoundCache(ttl time.Duration, size int) *notFoundCache {
+	if ttl <= 0 {
+		return nil
+	}
+	c, err := lru.New(size)
+	if err != nil {
+		panic(err) // size was validated.
+	}
+	return &notFoundCache{ttl: ttl, expires: c}
+}
+
+// has reports whether |k| was found missing less than the TTL ago.
+func (c *notFoundCache) has(k key.Key) bool {
+	if c == nil {
+		return false
+	}
+	v, ok := c.expires.Get(k)
+	if !ok {
+		return false
+	}
+	if time.Now().After(v.(time.Time)) {
+		c.expires.Remove(k)
+		return false
+	}
+	return true
+}
+
+func (c *notFoundCache) add(ks []key.Key) {
+	if c == nil {
+		return
+	}
+	expiry := time.Now().Add(c.ttl)
+	for _, k := range ks {
+		c.expires.Add(k, expiry)
+	}
+}
+
+func (c *notFoundCache) forget(ks []key.Key) {
+	if c == nil {
+		return
+	}
+	for _, k := range ks {
+		c.expires.Remove(k)
+	}
+}
+
+// withoutKnownMissing returns |ks| minus the keys remembered as missing, counting
+// those as misses.
+func (s *BlockService) withoutKnownMissing(ks []key.Key) []key.Key {
+	if s.notFound == nil {
+		return ks
+	}
+	rest := make([]key.Key, 0, len(ks))
+	for _, k := range ks {
+		if s.notFound.has(k) {
+			atomic.AddUint64(&s.stats.misses, 1)
+			atomic.AddUint64(&s.stats.notFoundHits, 1)
+			continue
+		}
+		rest = append(rest, k)
+	}
+	return rest
+}
@@ -0,0 +1,11 @@
+// package opentracing adapts an OpenTracing tracer to blockservice.Tracer,
+// so that BlockService spans join the application's distributed traces.
+// OpenTelemetry users can go through its OpenTracing bridge.
+//
+// It depends on github.com/opentracing/opentracing-go, which go-blocks does
+// not vendor, so its implementation is only built with the "opentracing"
+// build tag:
+//
+//	go get github.com/opentracing/opentracing-go
+//	go build -tags opentracing ./...
+package opentracing
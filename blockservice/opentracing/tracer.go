@@ -0,0 +1,44 @@
+//go:build opentracing
+// +build opentracing
+
+package opentracing
+
+import (
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// NewTracer returns a blockservice.Tracer starting its spans with |t|, as
+// children of the spans OpenTracing keeps in contexts. Give it to
+// blockservice.WithTracer.
+func NewTracer(t ot.Tracer) blockservice.Tracer {
+	return tracer{t: t}
+}
+
+type tracer struct {
+	t ot.Tracer
+}
+
+func (t tracer) StartSpan(ctx context.Context, operation string) (context.Context, blockservice.Span) {
+	sp, ctx := ot.StartSpanFromContextWithTracer(ctx, t.t, operation)
+	return ctx, span{sp}
+}
+
+type span struct {
+	sp ot.Span
+}
+
+func (s span) SetTag(key string, value interface{}) {
+	s.sp.SetTag(key, value)
+}
+
+func (s span) Finish(err error) {
+	if err != nil {
+		// as ext.Error and the standard "error" log field.
+		s.sp.SetTag("error", true)
+		s.sp.LogKV("event", "error", "message", err.Error())
+	}
+	s.sp.Finish()
+}
@@ -0,0 +1,235 @@
+package blockservice
+
+import (
+	"fmt"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	worker "github.com/ipfs/go-blocks/blockservice/worker"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsns "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/namespace"
+)
+
+// Option configures a BlockService in New.
+type Option func(*options)
+
+type options struct {
+	worker       worker.Config
+	tracer       Tracer
+	logger       Logger
+	logLevel     LogLevel
+	readOnly     bool
+	maxBlockSize int
+	hashCode     int
+	hashLength   int
+	inlineSize   int
+	pool         *blocks.BufferPool
+	localReads   int
+	fetchTimeout time.Duration
+	notFoundTTL  time.Duration
+	notFoundSize int
+	maxFetches   int
+	maxWants     int
+	provide      ProvideStrategy
+	retry        RetryPolicy
+	prefetches   ds.Datastore
+	verifyMode   VerifyMode
+	diskBreaker  *DiskBreaker
+	panics       *PanicPolicy
+
+	pipelineBatch    int
+	pipelineInterval time.Duration
+	pipelineBytes    int
+}
+
+// WithNumWorkers sets a fixed number of background workers announcing added
+// blocks to the exchange, at least 1. By default their number adapts to the
+// load; see WithAdaptiveWorkers.
+func WithNumWorkers(n int) Option {
+	return func(o *options) {
+		o.worker.NumWorkers = n
+		o.worker.Adaptive = false
+	}
+}
+
+// WithAdaptiveWorkers sizes the background workers announcing added blocks
+// to the load, between |min| and |max| of them, as worker.Config.Adaptive
+// says. This is the default, with zero bounds, which mean GOMAXPROCS and 64
+// times that.
+func WithAdaptiveWorkers(min, max int) Option {
+	return func(o *options) {
+		o.worker.Adaptive = true
+		o.worker.MinWorkers = min
+		o.worker.MaxWorkers = max
+	}
+}
+
+// WithClientBuffer lets AddBlock queue up to |n| blocks for announcement
+// without waiting on a worker. The default is 0.
+func WithClientBuffer(n int) Option {
+	return func(o *options) { o.worker.ClientBufferSize = n }
+}
+
+// WithWorkerBuffer sets the buffer between the worker's queue and its
+// announcing goroutines. The default is 0.
+func WithWorkerBuffer(n int) Option {
+	return func(o *options) { o.worker.WorkerBufferSize = n }
+}
+
+// WithRetryBackoff sets the delay before re-announcing a block the exchange
+// failed to take, and the cap it doubles up to on each further failure. The
+// defaults are a second and a minute; a zero |initial| disables retries.
+func WithRetryBackoff(initial, max time.Duration) Option {
+	return func(o *options) {
+		o.worker.RetryBackoff = initial
+		o.worker.MaxRetryBackoff = max
+	}
+}
+
+// WithMaxQueuedAnnouncements bounds the added blocks waiting to be announced
+// to |n|, as worker.Config.MaxQueued says, so that a slow exchange holds up
+// adds rather than letting the queue grow without bound. With the queue
+// full, AddBlockCtx and AddBlocks wait for room until their context is
+// done, and the write pipeline of AddBlockAsync waits for it, while AddBlock
+// and AddBlockWith, which have no context, store the block and return a
+// *NotAnnouncedError wrapping worker.ErrQueueFull. The default, 0, sets no
+// bound.
+func WithMaxQueuedAnnouncements(n int) Option {
+	return func(o *options) { o.worker.MaxQueued = n }
+}
+
+// WithAnnounceDedup skips announcing a block added again within |window| of
+// its last announcement, as worker.Config.DedupWindow says, which cuts the
+// chatter with the exchange of imports that rewrite existing content. The
+// default, 0, announces every add.
+func WithAnnounceDedup(window time.Duration) Option {
+	return func(o *options) { o.worker.DedupWindow = window }
+}
+
+// WithReadOnly makes the service read-only, as if given a blockstore made by
+// blockstore.ReadOnly: adds and deletes fail with blockstore.ErrReadOnly
+// without reaching the blockstore or the exchange, and blocks fetched from
+// the exchange are not stored, whatever SetReadRepair says. A service given
+// such a blockstore is read-only without this option.
+func WithReadOnly() Option {
+	return func(o *options) { o.readOnly = true }
+}
+
+// WithMaxBlockSize makes adds of blocks larger than |n| bytes fail with
+// blocks.ErrBlockTooLarge. The default is blocks.MaxBlockSize when New is
+// called; zero or less means no limit.
+func WithMaxBlockSize(n int) Option {
+	return func(o *options) { o.maxBlockSize = n }
+}
+
+// WithHashType makes BlockService.NewBlock key blocks by the multihash
+// function |code|, with digests truncated to |length| bytes, or kept whole
+// if it is -1. The default is the whole mh.SHA2_256 digest, as used by
+// blocks.NewBlock.
+func WithHashType(code, length int) Option {
+	return func(o *options) {
+		o.hashCode = code
+		o.hashLength = length
+	}
+}
+
+// WithInlining makes BlockService.NewBlock create inline blocks, whose keys
+// hold their data (see blocks.NewInlineBlock), for data of up to |n| bytes,
+// at most blocks.MaxInlineSize. The default, 0, inlines nothing.
+func WithInlining(n int) Option {
+	return func(o *options) { o.inlineSize = n }
+}
+
+// WithBufferPool makes the service read stored blocks into buffers from
+// |p|, where the blockstore supports it (see blockstore.GetPooled), for
+// callers to hand back with Block.Release once done with them. Blocks from
+// the exchange are not pooled, but may be released all the same. A block
+// GetBlocks sends more than once, for a key asked for more than once, is
+// one block, to be released once. By default blocks are not pooled.
+func WithBufferPool(p *blocks.BufferPool) Option {
+	return func(o *options) { o.pool = p }
+}
+
+// WithParallelLocalReads makes GetBlocks read up to |n| of its blocks from
+// the blockstore at once, and ask the exchange for the ones missing as they
+// are found, in batches of those found since the last, rather than once
+// every block has been read. By default blocks are read one at a time, and
+// the misses asked for together; 0 keeps that.
+func WithParallelLocalReads(n int) Option {
+	return func(o *options) { o.localReads = n }
+}
+
+// WithWritePipeline configures the background writer of AddBlockAsync: it
+// stores up to |maxBatch| blocks at once, after the first has waited at most
+// |flushInterval|, and AddBlockAsync waits while |maxInFlightBytes| of block
+// data is queued or being written. The defaults are 128 blocks, 10ms and
+// 16MiB. |flushInterval| should stay well under a second, as reads of queued
+// blocks wait on it.
+func WithWritePipeline(maxBatch int, flushInterval time.Duration, maxInFlightBytes int) Option {
+	return func(o *options) {
+		o.pipelineBatch = maxBatch
+		o.pipelineInterval = flushInterval
+		o.pipelineBytes = maxInFlightBytes
+	}
+}
+
+// WithPersistence keeps the service's queues in |d|, so that work a
+// restart interrupts is picked up by the next service given the same
+// datastore: blocks queued for announcement or waiting to be announced
+// again, and keys queued by Prefetch. |d| must not be the datastore of the
+// blockstore, nor that of another running service.
+func WithPersistence(d ds.Datastore) Option {
+	return func(o *options) {
+		o.worker.QueueStore = dsns.Wrap(d, ds.NewKey("announce"))
+		o.worker.RetryStore = dsns.Wrap(d, ds.NewKey("retry"))
+		o.prefetches = dsns.Wrap(d, ds.NewKey("prefetch"))
+	}
+}
+
+func (o *options) validate() error {
+	if err := blocks.CheckHashType(o.hashCode, o.hashLength); err != nil {
+		return err
+	}
+	if err := o.retry.validate(); err != nil {
+		return err
+	}
+	if err := o.verifyMode.validate(); err != nil {
+		return err
+	}
+	if o.diskBreaker != nil {
+		if err := o.diskBreaker.validate(); err != nil {
+			return err
+		}
+	}
+	c := o.worker
+	switch {
+	case !c.Adaptive && c.NumWorkers < 1:
+		return fmt.Errorf("blockservice: NumWorkers must be at least 1, got %d", c.NumWorkers)
+	case c.Adaptive && (c.MinWorkers < 0 || c.MaxWorkers < 0 || c.MaxWorkers > 0 && c.MaxWorkers < c.MinWorkers):
+		return fmt.Errorf("blockservice: adaptive worker bounds must not be negative, nor max below min, got %d and %d", c.MinWorkers, c.MaxWorkers)
+	case c.ClientBufferSize < 0:
+		return fmt.Errorf("blockservice: ClientBufferSize must not be negative, got %d", c.ClientBufferSize)
+	case c.WorkerBufferSize < 0:
+		return fmt.Errorf("blockservice: WorkerBufferSize must not be negative, got %d", c.WorkerBufferSize)
+	case c.RetryBackoff < 0 || c.MaxRetryBackoff < 0:
+		return fmt.Errorf("blockservice: retry backoff must not be negative")
+	case c.MaxQueued < 0:
+		return fmt.Errorf("blockservice: MaxQueued must not be negative, got %d", c.MaxQueued)
+	case c.DedupWindow < 0:
+		return fmt.Errorf("blockservice: announce dedup window must not be negative, got %s", c.DedupWindow)
+	case o.fetchTimeout < 0:
+		return fmt.Errorf("blockservice: fetch timeout must not be negative, got %s", o.fetchTimeout)
+	case o.notFoundTTL < 0 || o.notFoundSize < 0 || o.notFoundTTL > 0 && o.notFoundSize < 1:
+		return fmt.Errorf("blockservice: not-found cache needs a positive size with a positive TTL, got %d and %s", o.notFoundSize, o.notFoundTTL)
+	case o.localReads < 0:
+		return fmt.Errorf("blockservice: parallel local reads must not be negative, got %d", o.localReads)
+	case o.maxFetches < 0 || o.maxWants < 0:
+		return fmt.Errorf("blockservice: fetch limits must not be negative")
+	case o.inlineSize < 0 || o.inlineSize > blocks.MaxInlineSize:
+		return fmt.Errorf("blockservice: inline size must be from 0 to %d, got %d", blocks.MaxInlineSize, o.inlineSize)
+	case o.pipelineBatch < 1 || o.pipelineInterval <= 0 || o.pipelineBytes < 1:
+		return fmt.Errorf("blockservice: write pipeline limits must be positive")
+	}
+	return nil
+}
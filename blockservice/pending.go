@@ -0,0 +1,91 @@
+package blockservice
+
+import (
+	"container/list"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	process "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/goprocess"
+)
+
+// GetBlockAsync returns the block for |k| if it is stored locally. It never
+// consults the exchange: on a miss it returns false and queues |k| on the
+// PendingMisses channel for a background fetcher to deal with. Local reads
+// are those of GetBlock: inline keys are decoded and expired blocks missed.
+// Once the service is closed it returns false and queues nothing.
+func (s *BlockService) GetBlockAsync(k key.Key) (*blocks.Block, bool) {
+	if s.checkOpen() != nil {
+		return nil, false
+	}
+	if b, err := s.getLocal(k); err == nil {
+		return b, true
+	}
+	s.pending.push(k)
+	return nil, false
+}
+
+// PendingMisses returns the channel of keys that GetBlockAsync missed on. A
+// key is emitted at most once while it is waiting to be received, no matter
+// how many times it was missed. The channel is closed when the BlockService
+// is closed.
+func (s *BlockService) PendingMisses() <-chan key.Key {
+	return s.pending.out
+}
+
+// missQueue is an unbounded, de-duplicating FIFO of keys feeding |out|.
+type missQueue struct {
+	in      chan key.Key
+	out     chan key.Key
+	process process.Process
+}
+
+func newMissQueue() *missQueue {
+	q := &missQueue{
+		in:      make(chan key.Key),
+		out:     make(chan key.Key),
+		process: process.WithParent(process.Background()),
+	}
+	q.process.Go(q.run)
+	return q
+}
+
+func (q *missQueue) push(k key.Key) {
+	select {
+	case q.in <- k:
+	case <-q.process.Closing():
+	}
+}
+
+func (q *missQueue) run(proc process.Process) {
+	defer close(q.out)
+
+	var queue list.List
+	queued := make(map[key.Key]struct{})
+	for {
+		// sending on a nil channel blocks, so only offer a key if we have one.
+		var out chan key.Key
+		var next key.Key
+		if front := queue.Front(); front != nil {
+			out = q.out
+			next = front.Value.(key.Key)
+		}
+
+		select {
+		case out <- next:
+			queue.Remove(queue.Front())
+			delete(queued, next)
+		case k := <-q.in:
+			if _, ok := queued[k]; !ok {
+				queued[k] = struct{}{}
+				queue.PushBack(k)
+			}
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+func (q *missQueue) Close() error {
+	return q.process.Close()
+}
@@ -0,0 +1,196 @@
+package blockservice
+
+import (
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// The defaults of WithWritePipeline.
+const (
+	defaultPipelineBatch    = 128
+	defaultPipelineInterval = 10 * time.Millisecond
+	defaultPipelineBytes    = 16 << 20
+)
+
+// AddBlockAsync queues |b| to be added, and returns at once with a channel
+// that receives the error of the add, nil if it succeeded, once the block is
+// stored and queued for announcement. Queued blocks are stored by a
+// background writer, in batches, as AddBlocks does; see WithWritePipeline.
+// While they wait, GetBlock of them waits too, rather than missing.
+//
+// When the blocks queued and being written add up to the pipeline's most
+// in-flight bytes, AddBlockAsync waits for room before queueing |b|. Blocks
+// still queued when the service is closed are written first.
+func (s *BlockService) AddBlockAsync(b *blocks.Block) <-chan error {
+	errc := make(chan error, 1)
+	switch {
+	case s.checkOpen() != nil:
+		errc <- ErrClosed
+	case isInline(b):
+		errc <- nil
+	case s.readOnly:
+		errc <- blockstore.ErrReadOnly
+	default:
+		if err := s.checkSize(b); err != nil {
+			errc <- err
+		} else {
+			s.pipeline.push(b, s.adding.begin(b.Key()), errc)
+		}
+	}
+	return errc
+}
+
+// pipeline queues blocks for write, and writes them in batches of up to
+// |maxBatch| once a batch is full or its first block has waited |interval|.
+// Pushes wait while |maxBytes| of data is queued or being written.
+type pipeline struct {
+	write    func([]*blocks.Block) error
+	maxBatch int
+	interval time.Duration
+	maxBytes int
+
+	mu     sync.Mutex
+	room   *sync.Cond // signalled as writes finish
+	queue  []queuedWrite
+	bytes  int // of the blocks queued or being written
+	closed bool
+
+	wake    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+type queuedWrite struct {
+	b    *blocks.Block
+	done func() // ends the block's inflightAdds entry
+	errc chan error
+}
+
+func newPipeline(write func([]*blocks.Block) error, maxBatch int, interval time.Duration, maxBytes int) *pipeline {
+	p := &pipeline{
+		write:    write,
+		maxBatch: maxBatch,
+		interval: interval,
+		maxBytes: maxBytes,
+		wake:     make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	p.room = sync.NewCond(&p.mu)
+	go p.run()
+	return p
+}
+
+func (p *pipeline) push(b *blocks.Block, done func(), errc chan error) {
+	p.mu.Lock()
+	// a block larger than maxBytes still goes in on its own.
+	for !p.closed && p.bytes > 0 && p.bytes+len(b.Data) > p.maxBytes {
+		p.room.Wait()
+	}
+	if p.closed {
+		p.mu.Unlock()
+		done()
+		errc <- ErrClosed
+		return
+	}
+	p.queue = append(p.queue, queuedWrite{b: b, done: done, errc: errc})
+	p.bytes += len(b.Data)
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// full reports whether a whole batch is queued.
+func (p *pipeline) full() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue) >= p.maxBatch
+}
+
+func (p *pipeline) run() {
+	defer close(p.done)
+	for {
+		select {
+		case <-p.wake:
+		case <-p.closing:
+			p.flush()
+			return
+		}
+		if !p.full() {
+			timer := time.NewTimer(p.interval)
+		wait:
+			for !p.full() {
+				select {
+				case <-p.wake:
+				case <-timer.C:
+					break wait
+				case <-p.closing:
+					break wait
+				}
+			}
+			timer.Stop()
+		}
+		p.flush()
+	}
+}
+
+// flush writes everything queued, a batch at a time.
+func (p *pipeline) flush() {
+	for {
+		p.mu.Lock()
+		n := len(p.queue)
+		if n > p.maxBatch {
+			n = p.maxBatch
+		}
+		batch := p.queue[:n:n]
+		p.queue = p.queue[n:]
+		p.mu.Unlock()
+		if n == 0 {
+			return
+		}
+
+		bs := make([]*blocks.Block, n)
+		bytes := 0
+		for i, w := range batch {
+			bs[i] = w.b
+			bytes += len(w.b.Data)
+		}
+		err := p.write(bs)
+		for _, w := range batch {
+			w.done()
+			w.errc <- err
+		}
+		p.mu.Lock()
+		p.bytes -= bytes
+		p.room.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+// Close writes the blocks still queued, failing later pushes.
+func (p *pipeline) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.done
+		return
+	}
+	p.closed = true
+	p.room.Broadcast()
+	p.mu.Unlock()
+	close(p.closing)
+	<-p.done
+}
+
+// writeBatch is the pipeline's write: AddBlocks, without a deadline.
+func (s *BlockService) writeBatch(bs []*blocks.Block) error {
+	_, err := s.addBlocks(context.Background(), bs)
+	return err
+}
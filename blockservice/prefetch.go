@@ -0,0 +1,269 @@
+package blockservice
+
+import (
+	"sync"
+	"sync/atomic"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	process "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/goprocess"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// prefetchBatch is the most keys a prefetch asks the exchange for at once.
+// Batches are not interrupted by interactive reads, so they are kept small.
+const prefetchBatch = 32
+
+// Prefetch fetches the blocks for |ks| that are not stored locally from the
+// exchange in the background, and stores them, so that later reads of them
+// are local hits. It returns at once. Prefetches only reach the exchange
+// while no GetBlock or other read is waiting on it, a batch at a time, and
+// are abandoned when |ctx| is done. They do nothing while the service is
+// offline or read-only. See WithPersistence for keeping them across a
+// restart.
+func (s *BlockService) Prefetch(ctx context.Context, ks []key.Key) {
+	if len(ks) == 0 || s.readOnly || s.checkOpen() != nil {
+		return
+	}
+	s.prefetch.push(ctx, append([]key.Key(nil), ks...))
+}
+
+// prefetchBlocks fetches those of |ks| not stored locally, and stores them
+// as AddBlock does, without announcing them.
+func (s *BlockService) prefetchBlocks(ctx context.Context, ks []key.Key) {
+	if s.readOnly || !s.exchangeUsable() {
+		return
+	}
+	var misses []key.Key
+	for _, k := range ks {
+		if has, err := s.Blockstore.Has(k); err == nil && !has {
+			misses = append(misses, k)
+		}
+	}
+	if len(misses) == 0 {
+		return
+	}
+	wanted := make(map[key.Key]struct{}, len(misses))
+	for _, k := range misses {
+		wanted[k] = struct{}{}
+	}
+	w := s.want(ctx, misses)
+	defer w.done()
+	rblocks, err := s.requestBlocks(ctx, s.Exchange, misses)
+	if err != nil {
+		return
+	}
+	for b := range rblocks {
+		k := b.Key()
+		w.got(k)
+		if _, ok := wanted[k]; !ok || s.verifyRemote(k, b) != nil {
+			continue
+		}
+		delete(wanted, k)
+		if err := s.put(b); err != nil {
+			atomic.AddUint64(&s.stats.errors, 1)
+			continue
+		}
+		atomic.AddUint64(&s.stats.prefetched, 1)
+	}
+}
+
+// prefetcher runs queued prefetches one batch at a time, each once there are
+// no interactive fetches.
+//
+// If |store| is set, queued keys are kept in it until their batch has run or
+// been abandoned, and those left by an earlier prefetcher are queued again
+// when it is created. Store errors are ignored. Pushes after Close are
+// dropped.
+type prefetcher struct {
+	fetch   func(context.Context, []key.Key)
+	idle    *activity
+	store   ds.Datastore
+	wake    chan struct{}
+	process process.Process
+
+	mu     sync.Mutex
+	queue  []prefetchRequest
+	closed bool
+}
+
+type prefetchRequest struct {
+	ctx context.Context
+	ks  []key.Key
+}
+
+func newPrefetcher(idle *activity, fetch func(context.Context, []key.Key), store ds.Datastore) *prefetcher {
+	p := &prefetcher{
+		fetch:   fetch,
+		idle:    idle,
+		store:   store,
+		wake:    make(chan struct{}, 1),
+		process: process.WithParent(process.Background()),
+	}
+	if ks := p.load(); len(ks) > 0 {
+		p.queue = append(p.queue, prefetchRequest{ctx: context.Background(), ks: ks})
+		p.wake <- struct{}{}
+	}
+	p.process.Go(p.run)
+	return p
+}
+
+func (p *prefetcher) load() []key.Key {
+	if p.store == nil {
+		return nil
+	}
+	res, err := p.store.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil
+	}
+	ks := make([]key.Key, 0, len(entries))
+	for _, e := range entries {
+		ks = append(ks, key.B58KeyDecode(ds.NewKey(e.Key).BaseNamespace()))
+	}
+	return ks
+}
+
+// forget removes |ks| from the store, if there is one.
+func (p *prefetcher) forget(ks []key.Key) {
+	if p.store == nil {
+		return
+	}
+	for _, k := range ks {
+		p.store.Delete(ds.NewKey(k.B58String()))
+	}
+}
+
+func (p *prefetcher) push(ctx context.Context, ks []key.Key) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	if p.store != nil {
+		for _, k := range ks {
+			p.store.Put(ds.NewKey(k.B58String()), []byte{})
+		}
+	}
+	p.queue = append(p.queue, prefetchRequest{ctx: ctx, ks: ks})
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the next batch off the queue, skipping abandoned requests.
+func (p *prefetcher) next() (context.Context, []key.Key, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) > 0 {
+		r := &p.queue[0]
+		if r.ctx.Err() != nil {
+			p.forget(r.ks)
+			p.queue = p.queue[1:]
+			continue
+		}
+		n := prefetchBatch
+		if n > len(r.ks) {
+			n = len(r.ks)
+		}
+		ctx, batch := r.ctx, r.ks[:n]
+		if r.ks = r.ks[n:]; len(r.ks) == 0 {
+			p.queue = p.queue[1:]
+		}
+		return ctx, batch, true
+	}
+	p.queue = nil
+	return nil, nil, false
+}
+
+func (p *prefetcher) run(proc process.Process) {
+	for {
+		select {
+		case <-p.wake:
+		case <-proc.Closing():
+			return
+		}
+		for {
+			ctx, ks, ok := p.next()
+			if !ok {
+				break
+			}
+			// stop with the service as well as with the request.
+			ctx, cancel := context.WithCancel(ctx)
+			go func() {
+				select {
+				case <-proc.Closing():
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			if p.idle.wait(ctx) == nil {
+				p.fetch(ctx, ks)
+			}
+			cancel()
+			select {
+			case <-proc.Closing():
+				// keep the interrupted batch for the next prefetcher.
+				return
+			default:
+				p.forget(ks)
+			}
+		}
+	}
+}
+
+func (p *prefetcher) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	return p.process.Close()
+}
+
+// activity counts operations in progress, for waiting until there are none.
+type activity struct {
+	mu   sync.Mutex
+	n    int
+	none chan struct{} // closed once n drops to zero
+}
+
+func (a *activity) begin() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.n++; a.n == 1 {
+		a.none = make(chan struct{})
+	}
+}
+
+func (a *activity) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.n--; a.n == 0 {
+		close(a.none)
+	}
+}
+
+// wait returns once there are no operations in progress, or with ctx.Err().
+func (a *activity) wait(ctx context.Context) error {
+	for {
+		a.mu.Lock()
+		if a.n == 0 {
+			a.mu.Unlock()
+			return nil
+		}
+		none := a.none
+		a.mu.Unlock()
+		select {
+		case <-none:
+			// another may have begun since; check again.
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
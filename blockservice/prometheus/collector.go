@@ -0,0 +1,177 @@
+//go:build prometheus
+// +build prometheus
+
+package prometheus
+
+import (
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// metric is a value of Stats the collector reports, under |desc| with the
+// label value |label| if |desc| has a label.
+type metric struct {
+	desc  *prom.Desc
+	typ   prom.ValueType
+	label string
+	value func(st blockservice.Stats) float64
+}
+
+// histogram is a Histogram of Stats the collector reports.
+type histogram struct {
+	desc  *prom.Desc
+	value func(st blockservice.Stats) blockservice.Histogram
+}
+
+func desc(name, help string, labels ...string) *prom.Desc {
+	return prom.NewDesc(name, help, labels, nil)
+}
+
+var (
+	blocksDesc = desc("blockservice_get_blocks_total",
+		"Blocks requested from the BlockService, by where they were found.", "source")
+	providesDesc = desc("blockservice_provides_total",
+		"Finished announcements of added blocks to the exchange, retries included, by outcome.", "outcome")
+)
+
+// metrics lists every value of Stats but its histograms, so that a field
+// added to Stats is added here too.
+var metrics = []metric{
+	{blocksDesc, prom.CounterValue, "local", func(st blockservice.Stats) float64 { return float64(st.LocalHits) }},
+	{blocksDesc, prom.CounterValue, "exchange", func(st blockservice.Stats) float64 { return float64(st.ExchangeHits) }},
+	{blocksDesc, prom.CounterValue, "miss", func(st blockservice.Stats) float64 { return float64(st.Misses) }},
+	{blocksDesc, prom.CounterValue, "error", func(st blockservice.Stats) float64 { return float64(st.Errors) }},
+	{desc("blockservice_rejected_blocks_total",
+		"Blocks received from the exchange that failed verification."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Rejected) }},
+	{desc("blockservice_not_found_cache_hits_total",
+		"Misses answered from the keys remembered as missing."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.NotFoundHits) }},
+	{desc("blockservice_added_blocks_total",
+		"Blocks added to the BlockService."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Added) }},
+	{desc("blockservice_deleted_blocks_total",
+		"Blocks deleted from the BlockService."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Deleted) }},
+	{desc("blockservice_prefetched_blocks_total",
+		"Blocks stored by Prefetch."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Prefetched) }},
+	{desc("blockservice_expired_blocks_total",
+		"Blocks removed because their TTL ran out."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Expired) }},
+	{desc("blockservice_repaired_blocks_total",
+		"Corrupt local blocks replaced by the exchange's copy."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Repaired) }},
+	{desc("blockservice_reprovided_blocks_total",
+		"Blocks queued for announcement again by reprovide sweeps."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Reprovided) }},
+	{desc("blockservice_dropped_events_total",
+		"Events not delivered to a subscriber that was behind."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.DroppedEvents) }},
+	{desc("blockservice_undelivered_blocks_total",
+		"Blocks GetBlocksWith gave up on sending to a slow caller."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Undelivered) }},
+	{desc("blockservice_panics_total",
+		"Blockstore and exchange calls that panicked."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Panics) }},
+	{desc("blockservice_disk_breaker_state",
+		"State of the breaker in front of the blockstore: 0 closed, 1 open, 2 half open."),
+		prom.GaugeValue, "", func(st blockservice.Stats) float64 { return float64(st.DiskBreaker) }},
+	{desc("blockservice_disk_breaker_trips_total",
+		"Times the breaker in front of the blockstore opened."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.DiskBreakerTrips) }},
+	{desc("blockservice_oldest_pending_provide_age_seconds",
+		"Age of the oldest block waiting to be provided to the exchange."),
+		prom.GaugeValue, "", func(st blockservice.Stats) float64 { return st.OldestPendingAge.Seconds() }},
+	{desc("blockservice_retry_queue_depth",
+		"Blocks waiting to be offered to the exchange again."),
+		prom.GaugeValue, "", func(st blockservice.Stats) float64 { return float64(st.RetryQueueDepth) }},
+	{desc("blockservice_provide_queue_depth",
+		"Added blocks waiting for a free announcement worker."),
+		prom.GaugeValue, "", func(st blockservice.Stats) float64 { return float64(st.Announcements.QueueDepth) }},
+	{desc("blockservice_provides_in_flight",
+		"Announcements in progress."),
+		prom.GaugeValue, "", func(st blockservice.Stats) float64 { return float64(st.Announcements.InFlight) }},
+	{desc("blockservice_provide_workers",
+		"Announcements that may be in progress at once."),
+		prom.GaugeValue, "", func(st blockservice.Stats) float64 { return float64(st.Announcements.Workers) }},
+	{providesDesc, prom.CounterValue, "provided", func(st blockservice.Stats) float64 { return float64(st.Announcements.Provided) }},
+	{providesDesc, prom.CounterValue, "failed", func(st blockservice.Stats) float64 { return float64(st.Announcements.Failed) }},
+	{desc("blockservice_dropped_provides_total",
+		"Failed announcements that will not be retried."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Announcements.Dropped) }},
+	{desc("blockservice_skipped_provides_total",
+		"Added blocks not announced because they were provided recently."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Announcements.Skipped) }},
+	{desc("blockservice_slow_provides_total",
+		"Announcements that took longer than the worker's SlowThreshold."),
+		prom.CounterValue, "", func(st blockservice.Stats) float64 { return float64(st.Announcements.Slow) }},
+	{desc("blockservice_provide_utilization",
+		"Fraction of the announcement workers' time spent announcing."),
+		prom.GaugeValue, "", func(st blockservice.Stats) float64 { return st.Announcements.Utilization }},
+}
+
+var histograms = []histogram{
+	{desc("blockservice_blockstore_get_duration_seconds",
+		"Latency of local blockstore reads."),
+		func(st blockservice.Stats) blockservice.Histogram { return st.BlockstoreLatency }},
+	{desc("blockservice_blockstore_write_duration_seconds",
+		"Latency of local blockstore writes and deletes."),
+		func(st blockservice.Stats) blockservice.Histogram { return st.BlockstoreWriteLatency }},
+	{desc("blockservice_exchange_get_duration_seconds",
+		"Latency of single-block exchange fetches."),
+		func(st blockservice.Stats) blockservice.Histogram { return st.ExchangeLatency }},
+	{desc("blockservice_provide_duration_seconds",
+		"Time from queueing an added block for announcement to the exchange taking it."),
+		func(st blockservice.Stats) blockservice.Histogram { return st.ProvideLatency }},
+}
+
+// NewPrometheusCollector returns a collector that reports |s|.Stats() each
+// time it is scraped. Register it with prom.MustRegister.
+func NewPrometheusCollector(s *blockservice.BlockService) prom.Collector {
+	return &collector{s: s}
+}
+
+type collector struct {
+	s *blockservice.BlockService
+}
+
+func (c *collector) Describe(ch chan<- *prom.Desc) {
+	seen := make(map[*prom.Desc]bool)
+	for _, m := range metrics {
+		if !seen[m.desc] {
+			seen[m.desc] = true
+			ch <- m.desc
+		}
+	}
+	for _, h := range histograms {
+		ch <- h.desc
+	}
+}
+
+func (c *collector) Collect(ch chan<- prom.Metric) {
+	st := c.s.Stats()
+	for _, m := range metrics {
+		if m.label == "" {
+			ch <- prom.MustNewConstMetric(m.desc, m.typ, m.value(st))
+		} else {
+			ch <- prom.MustNewConstMetric(m.desc, m.typ, m.value(st), m.label)
+		}
+	}
+	for _, h := range histograms {
+		ch <- constHistogram(h.desc, h.value(st))
+	}
+}
+
+// constHistogram converts a Stats histogram, whose buckets are disjoint, into
+// a Prometheus one, whose buckets are cumulative.
+func constHistogram(desc *prom.Desc, h blockservice.Histogram) prom.Metric {
+	buckets := make(map[float64]uint64, len(h.Counts))
+	var cumulative uint64
+	for i, n := range h.Counts {
+		cumulative += n
+		buckets[blockservice.LatencyBuckets[i].Seconds()] = cumulative
+	}
+	return prom.MustNewConstHistogram(desc, h.Count, h.Sum.Seconds(), buckets)
+}
@@ -0,0 +1,11 @@
+// package prometheus exports BlockService statistics as Prometheus metrics:
+// NewPrometheusCollector reports Stats when scraped, and Metrics counts and
+// times each operation as it ends.
+//
+// It depends on github.com/prometheus/client_golang, which go-blocks does not
+// vendor, so its implementation is only built with the "prometheus" build
+// tag:
+//
+//	go get github.com/prometheus/client_golang/prometheus
+//	go build -tags prometheus ./...
+package prometheus
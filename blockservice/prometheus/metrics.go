@@ -0,0 +1,56 @@
+//go:build prometheus
+// +build prometheus
+
+package prometheus
+
+import (
+	"time"
+
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics counts and times BlockService operations by operation and
+// outcome. Give it to BlockService.SetMetrics, and register it with
+// prom.MustRegister.
+type Metrics struct {
+	ops      *prom.CounterVec
+	duration *prom.HistogramVec
+}
+
+// NewMetrics returns a Metrics whose latency buckets are
+// blockservice.LatencyBuckets.
+func NewMetrics() *Metrics {
+	buckets := make([]float64, len(blockservice.LatencyBuckets))
+	for i, b := range blockservice.LatencyBuckets {
+		buckets[i] = b.Seconds()
+	}
+	labels := []string{"op", "outcome"}
+	return &Metrics{
+		ops: prom.NewCounterVec(prom.CounterOpts{
+			Name: "blockservice_operations_total",
+			Help: "BlockService operations, by operation and outcome.",
+		}, labels),
+		duration: prom.NewHistogramVec(prom.HistogramOpts{
+			Name:    "blockservice_operation_duration_seconds",
+			Help:    "Latency of BlockService operations, by operation and outcome.",
+			Buckets: buckets,
+		}, labels),
+	}
+}
+
+func (m *Metrics) Observe(op blockservice.Operation, outcome blockservice.Outcome, d time.Duration) {
+	m.ops.WithLabelValues(string(op), string(outcome)).Inc()
+	m.duration.WithLabelValues(string(op), string(outcome)).Observe(d.Seconds())
+}
+
+func (m *Metrics) Describe(ch chan<- *prom.Desc) {
+	m.ops.Describe(ch)
+	m.duration.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prom.Metric) {
+	m.ops.Collect(ch)
+	m.duration.Collect(ch)
+}
@@ -0,0 +1,93 @@
+package blockservice
+
+import (
+	blocks "github.com/ipfs/go-blocks"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Source is where a block GetBlockWithMeta returns was read from.
+type Source int
+
+const (
+	// SourceInline is a block whose data its key holds.
+	SourceInline Source = iota
+	// SourceLocal is a block read from the blockstore, or its caches.
+	SourceLocal
+	// SourceSession is a block a Session held in memory.
+	SourceSession
+	// SourceExchange is a block fetched from the exchange.
+	SourceExchange
+)
+
+func (src Source) String() string {
+	switch src {
+	case SourceInline:
+		return "inline"
+	case SourceLocal:
+		return "local"
+	case SourceSession:
+		return "session"
+	case SourceExchange:
+		return "exchange"
+	}
+	return "unknown"
+}
+
+// BlockWithMeta is a block with where it came from, for applications that
+// log their data's provenance or measure how much they depend on the
+// exchange.
+type BlockWithMeta struct {
+	*blocks.Block
+	Source Source
+	// Provenance is, for SourceExchange, what the exchange reported with
+	// exchange.ReportProvenance, if anything.
+	Provenance exchange.Provenance
+}
+
+// GetBlockWithMeta is GetBlock, returning where the block came from too.
+func (s *BlockService) GetBlockWithMeta(ctx context.Context, k key.Key, opts ...GetOption) (BlockWithMeta, error) {
+	o, err := newGetOptions(opts)
+	if err != nil {
+		return BlockWithMeta{}, err
+	}
+	var m BlockWithMeta
+	o.meta = &m
+	m.Block, err = s.getBlock(ctx, k, s.Exchange, o)
+	if err != nil {
+		return BlockWithMeta{}, err
+	}
+	return m, nil
+}
+
+// GetBlockWithMeta is BlockService.GetBlockWithMeta within the session.
+func (ss *Session) GetBlockWithMeta(ctx context.Context, k key.Key, opts ...GetOption) (BlockWithMeta, error) {
+	o, err := newGetOptions(opts)
+	if err != nil {
+		return BlockWithMeta{}, err
+	}
+	var m BlockWithMeta
+	o.meta = &m
+	m.Block, err = ss.getBlock(ctx, k, o)
+	if err != nil {
+		return BlockWithMeta{}, err
+	}
+	return m, nil
+}
+
+// setSource notes in the meta of |o|, if it asks for it, that the block came
+// from |src|.
+func (o getOptions) setSource(src Source) {
+	if o.meta != nil {
+		o.meta.Source = src
+	}
+}
+
+// setProvenance notes |p| in the meta of |o|, if it asks for it.
+func (o getOptions) setProvenance(p exchange.Provenance) {
+	if o.meta != nil {
+		o.meta.Provenance = p
+	}
+}
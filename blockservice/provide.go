@@ -0,0 +1,37 @@
+package blockservice
+
+import (
+	blocks "github.com/ipfs/go-blocks"
+)
+
+// ProvideStrategy decides whether a newly added block |b| is announced to
+// the exchange. |root| is AddBlockOptions.Root, and false for the adds that
+// take no options. Strategies are called inline, and must be safe for
+// concurrent use.
+type ProvideStrategy func(b *blocks.Block, root bool) bool
+
+// ProvideAll is the default ProvideStrategy, announcing every block.
+func ProvideAll(*blocks.Block, bool) bool { return true }
+
+// ProvideRoots announces only the blocks added as roots, for importers
+// adding every block of a DAG, whose leaves can be found through the root.
+func ProvideRoots(_ *blocks.Block, root bool) bool { return root }
+
+// ProvideNothing announces no blocks. They are still stored, and served to
+// peers that ask.
+func ProvideNothing(*blocks.Block, bool) bool { return false }
+
+// WithProvideStrategy makes the service announce only the added blocks |ps|
+// accepts. The default is ProvideAll.
+func WithProvideStrategy(ps ProvideStrategy) Option {
+	return func(o *options) { o.provide = ps }
+}
+
+// shouldProvide applies the service's strategy to |b|. Inline blocks are
+// never provided, as their keys are all anyone needs.
+func (s *BlockService) shouldProvide(b *blocks.Block, root bool) bool {
+	if isInline(b) {
+		return false
+	}
+	return s.provide == nil || s.provide(b, root)
+}
@@ -0,0 +1,71 @@
+package blockservice
+
+import (
+	"sync"
+	"time"
+
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// provideWatchers holds the AddBlockOptions.OnProvided callbacks of the
+// blocks being announced, until the exchange takes them.
+type provideWatchers struct {
+	mu sync.Mutex
+	m  map[key.Key][]*provideWatcher
+}
+
+type provideWatcher struct {
+	f func(latency time.Duration)
+}
+
+func newProvideWatchers() *provideWatchers {
+	return &provideWatchers{m: make(map[key.Key][]*provideWatcher)}
+}
+
+// watch registers |f| to be called once |k| is provided.
+func (w *provideWatchers) watch(k key.Key, f func(time.Duration)) *provideWatcher {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pw := &provideWatcher{f}
+	w.m[k] = append(w.m[k], pw)
+	return pw
+}
+
+// take unregisters |pw|, and reports whether it was still registered to |k|,
+// so that the caller calls it instead.
+func (w *provideWatchers) take(k key.Key, pw *provideWatcher) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ws := w.m[k]
+	for i, x := range ws {
+		if x == pw {
+			ws = append(ws[:i], ws[i+1:]...)
+			if len(ws) == 0 {
+				delete(w.m, k)
+			} else {
+				w.m[k] = ws
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// fire calls, and unregisters, the callbacks of |k| with |latency|.
+func (w *provideWatchers) fire(k key.Key, latency time.Duration) {
+	w.mu.Lock()
+	ws := w.m[k]
+	delete(w.m, k)
+	w.mu.Unlock()
+	for _, pw := range ws {
+		pw.f(latency)
+	}
+}
+
+// drop unregisters the callbacks of |k| without calling them, for a block
+// whose announcement was given up.
+func (w *provideWatchers) drop(k key.Key) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.m, k)
+}
@@ -0,0 +1,213 @@
+package blockservice
+
+import (
+	"errors"
+	"io"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// DefaultReadahead is how many blocks a Reader fetches ahead of the one it
+// reads, if ReaderOptions gives no other.
+const DefaultReadahead = 4
+
+var (
+	// ErrBlockSize is returned by a Reader for a block whose data is not the
+	// size ReaderOptions.Sizes gives it.
+	ErrBlockSize = errors.New("blockservice: block size differs from the one given")
+	// ErrSeek is returned by Reader.Seek for a position before the start,
+	// or an unknown whence.
+	ErrSeek = errors.New("blockservice: invalid seek")
+)
+
+// ReaderOptions tune a Reader.
+type ReaderOptions struct {
+	// Readahead is how many blocks past the one being read are fetched
+	// ahead of it, at once: DefaultReadahead if zero, none if negative.
+	Readahead int
+	// Sizes, if set, gives the data size of each block, such as recorded
+	// when chunking, so that seeking need not fetch the blocks it skips.
+	Sizes []int64
+}
+
+// Reader reads the data of a sequence of blocks as a single stream, such as
+// a file chunk.Blocks split, fetching each block with GetBlock as the
+// reading gets to it. It is not safe for concurrent use.
+type Reader struct {
+	s         *BlockService
+	ctx       context.Context
+	cancel    context.CancelFunc
+	ks        []key.Key
+	sizes     []int64
+	readahead int
+
+	fetches map[int]*readFetch
+	pos     int64
+	// cur is the block last read, which starts at |curStart|.
+	cur      int
+	curStart int64
+}
+
+type readFetch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	b      *blocks.Block
+	err    error
+}
+
+// NewReader returns a Reader of the data of the blocks |ks|, in order,
+// fetched under |ctx|. Close it to cancel the fetches still under way.
+func (s *BlockService) NewReader(ctx context.Context, ks []key.Key, opts ReaderOptions) *Reader {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &Reader{
+		s:         s,
+		ctx:       ctx,
+		cancel:    cancel,
+		ks:        ks,
+		sizes:     make([]int64, len(ks)),
+		readahead: opts.Readahead,
+		fetches:   make(map[int]*readFetch),
+	}
+	if r.readahead == 0 {
+		r.readahead = DefaultReadahead
+	}
+	for i := range r.sizes {
+		r.sizes[i] = -1
+		if i < len(opts.Sizes) {
+			r.sizes[i] = opts.Sizes[i]
+		}
+	}
+	return r
+}
+
+// Read reads from the current position, returning io.EOF past the end.
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	i, start, err := r.locate(r.pos)
+	if err != nil {
+		return 0, err
+	}
+	if i == len(r.ks) {
+		return 0, io.EOF
+	}
+	b, err := r.block(i)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, b.Data[r.pos-start:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// Seek sets the position of the next Read, as io.Seeker. Seeking from the
+// end, or past blocks of unknown size, fetches them for their size.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		_, end, err := r.locate(-1)
+		if err != nil {
+			return r.pos, err
+		}
+		offset += end
+	default:
+		return r.pos, ErrSeek
+	}
+	if offset < 0 {
+		return r.pos, ErrSeek
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close cancels the fetches under way. Reads fail after it.
+func (r *Reader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// locate returns the block holding the byte at |pos|, and where it starts,
+// or len(ks) and the end of the data if |pos| is past it, or negative.
+func (r *Reader) locate(pos int64) (int, int64, error) {
+	i, start := r.cur, r.curStart
+	if pos >= 0 && pos < start {
+		i, start = 0, 0
+	}
+	for ; i < len(r.ks); i++ {
+		size, err := r.size(i)
+		if err != nil {
+			return 0, 0, err
+		}
+		if pos >= 0 && pos < start+size {
+			r.cur, r.curStart = i, start
+			return i, start, nil
+		}
+		start += size
+	}
+	return i, start, nil
+}
+
+// size returns the data size of block |i|, fetching it if not known.
+func (r *Reader) size(i int) (int64, error) {
+	if r.sizes[i] >= 0 {
+		return r.sizes[i], nil
+	}
+	b, err := r.block(i)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b.Data)), nil
+}
+
+// block returns block |i|, having started fetching those after it, and given
+// up on those before it.
+func (r *Reader) block(i int) (*blocks.Block, error) {
+	last := i
+	if r.readahead > 0 {
+		last += r.readahead
+	}
+	for j, f := range r.fetches {
+		if j < i || j > last {
+			f.cancel()
+			delete(r.fetches, j)
+		}
+	}
+	for j := i; j <= last && j < len(r.ks); j++ {
+		if _, ok := r.fetches[j]; !ok {
+			r.fetches[j] = r.fetch(r.ks[j])
+		}
+	}
+	f := r.fetches[i]
+	select {
+	case <-f.done:
+	case <-r.ctx.Done():
+		return nil, r.ctx.Err()
+	}
+	if f.err != nil {
+		// not kept, so that reading it again retries.
+		delete(r.fetches, i)
+		return nil, f.err
+	}
+	if r.sizes[i] >= 0 && int64(len(f.b.Data)) != r.sizes[i] {
+		return nil, ErrBlockSize
+	}
+	r.sizes[i] = int64(len(f.b.Data))
+	return f.b, nil
+}
+
+func (r *Reader) fetch(k key.Key) *readFetch {
+	ctx, cancel := context.WithCancel(r.ctx)
+	f := &readFetch{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		f.b, f.err = r.s.GetBlock(ctx, k)
+	}()
+	return f
+}
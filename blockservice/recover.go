@@ -0,0 +1,74 @@
+package blockservice
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// ErrBackendPanic is what a BackendPanicError unwraps to, for errors.Is.
+var ErrBackendPanic = errors.New("blockservice: backend panicked")
+
+// BackendPanicError is returned by the operations whose blockstore or
+// exchange call panicked, when the service recovers from it. See
+// WithPanicRecovery.
+type BackendPanicError struct {
+	// Op is the call that panicked, such as "blockstore read" or
+	// "exchange GetBlock".
+	Op string
+	// Value is what it panicked with, and Stack the stack of the goroutine
+	// at the time.
+	Value interface{}
+	Stack []byte
+}
+
+func (e *BackendPanicError) Error() string {
+	return fmt.Sprintf("blockservice: %s panicked: %v", e.Op, e.Value)
+}
+
+func (e *BackendPanicError) Unwrap() error { return ErrBackendPanic }
+
+// PanicPolicy configures how WithPanicRecovery handles a panic.
+type PanicPolicy struct {
+	// TripBreaker opens the disk breaker at once when the blockstore
+	// panics, instead of counting it as one bad operation. It does nothing
+	// without WithDiskBreaker.
+	TripBreaker bool
+}
+
+// WithPanicRecovery has a panic in the blockstore's reads and writes, or in
+// the exchange's GetBlock, GetBlocks and AddBlockSync's HasBlock, returned
+// as a *BackendPanicError by the operation making the call, instead of
+// taking the process down; GetBlock returns it where other blockstore
+// failures are ErrNotFound, while streams leave the blocks out. Each is
+// logged with its stack, and counted in Stats.Panics. Panics in goroutines
+// the backends start themselves, and in the background announcement of
+// added blocks, cannot be recovered. By default none are.
+func WithPanicRecovery(p PanicPolicy) Option {
+	return func(o *options) { o.panics = &p }
+}
+
+// recovered calls |op|, the backend call |name|, returning a
+// *BackendPanicError if it panics and the service recovers from panics.
+func (s *BlockService) recovered(name string, op func() error) (err error) {
+	if s.panics == nil {
+		return op()
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			pe := &BackendPanicError{Op: name, Value: v, Stack: debug.Stack()}
+			atomic.AddUint64(&s.stats.panics, 1)
+			s.log(LevelError, "blockservice backend panicked",
+				Field{"op", name}, Field{"panic", v}, Field{"stack", string(pe.Stack)})
+			err = pe
+		}
+	}()
+	return op()
+}
+
+// tripsOnPanic reports whether |err| should open the disk breaker at once.
+func (s *BlockService) tripsOnPanic(err error) bool {
+	var pe *BackendPanicError
+	return s.panics != nil && s.panics.TripBreaker && errors.As(err, &pe)
+}
@@ -0,0 +1,74 @@
+package blockservice
+
+import (
+	"errors"
+	"sync"
+
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// refsKind is the metadata kind holding per-block reference counts, stored
+// as by encodeCount.
+const refsKind = "refs"
+
+// EnableRefCounting makes DeleteBlock release a reference rather than remove
+// the block outright. Each add of a block by AddBlock and friends takes a
+// reference, counted in the blockstore's metadata, and the block is only
+// deleted when DeleteBlock releases the last one. A block stored before
+// counting was enabled has no references, and the first DeleteBlock removes
+// it. It returns ErrNotSupported if the blockstore does not implement
+// blockstore.MetadataStore. It must be called before the service is used.
+func (s *BlockService) EnableRefCounting() error {
+	ms, ok := s.Blockstore.(blockstore.MetadataStore)
+	if !ok {
+		return ErrNotSupported
+	}
+	s.refs = &refCounter{store: ms}
+	return nil
+}
+
+// refCounter keeps reference counts in the metadata namespace.
+type refCounter struct {
+	store blockstore.MetadataStore
+
+	// mu is held across storing or deleting a block and updating its count,
+	// so that a concurrent add cannot be lost to a delete of the last
+	// reference.
+	mu sync.Mutex
+}
+
+func (r *refCounter) count(k key.Key) (uint64, error) {
+	v, err := r.store.GetMetadata(refsKind, k)
+	if err != nil && !errors.Is(err, blockstore.ErrNotFound) {
+		return 0, err
+	}
+	return decodeCount(v), nil
+}
+
+// take adds a reference to |k|. r.mu must be held.
+func (r *refCounter) take(k key.Key) error {
+	n, err := r.count(k)
+	if err != nil {
+		return err
+	}
+	return r.store.PutMetadata(refsKind, k, encodeCount(n+1))
+}
+
+// release drops a reference to |k|, and reports whether it was the last
+// one, or |k| had none. r.mu must be held.
+func (r *refCounter) release(k key.Key) (last bool, err error) {
+	n, err := r.count(k)
+	if err != nil {
+		return false, err
+	}
+	if n <= 1 {
+		return true, nil
+	}
+	return false, r.store.PutMetadata(refsKind, k, encodeCount(n-1))
+}
+
+// forget removes the count of the deleted block |k|. r.mu must be held.
+func (r *refCounter) forget(k key.Key) error {
+	return r.store.DeleteMetadata(refsKind, k)
+}
@@ -0,0 +1,317 @@
+// package replication pushes the blocks added to a BlockService to other
+// stores, such as backup BlockServices or HTTP block gateways, so that a
+// store can be mirrored to them.
+//
+// A Replicator watches the blocks added to its source and queues each for
+// every target, retrying those a target fails to take with a backoff.
+// Its queues are kept in memory: blocks still queued when it is closed, or
+// added while it is not running, are only replicated if queued again with
+// Replicator.Replicate.
+package replication
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Config configures a Replicator.
+type Config struct {
+	// RetryBackoff is how long a block a target failed to take waits
+	// before it is tried again, doubling on each further failure up to
+	// MaxRetryBackoff. The defaults are a second and a minute.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// MaxAttempts, if positive, is how many times a block is tried before
+	// it is given up on, and counted in TargetStatus.Failed. By default
+	// blocks are retried until they are replicated.
+	MaxAttempts int
+	// Timeout, if positive, bounds each Target.Replicate call.
+	Timeout time.Duration
+}
+
+// TargetStatus reports how replication to a target is going.
+type TargetStatus struct {
+	Name string
+	// Queued is the number of blocks waiting to be replicated, or being
+	// replicated, and Retrying the number of those that failed before.
+	Queued   int
+	Retrying int
+	// Replicated and Failed count the blocks replicated and given up on.
+	Replicated uint64
+	Failed     uint64
+	// LastError is the error of the last failed attempt, at LastErrorTime,
+	// and LastSuccess the time of the last block replicated.
+	LastError     error
+	LastErrorTime time.Time
+	LastSuccess   time.Time
+}
+
+// Replicator replicates the blocks added to a BlockService to its targets.
+type Replicator struct {
+	src     *blockservice.BlockService
+	cfg     Config
+	targets []*target // by name
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New starts replicating the blocks added to |src| from now on to
+// |targets|, by name, until Close is called.
+func New(src *blockservice.BlockService, targets map[string]Target, cfg Config) (*Replicator, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("replication: no targets")
+	}
+	if cfg.RetryBackoff < 0 || cfg.MaxRetryBackoff < 0 || cfg.MaxAttempts < 0 || cfg.Timeout < 0 {
+		return nil, fmt.Errorf("replication: config must not be negative: %+v", cfg)
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = time.Second
+	}
+	if cfg.MaxRetryBackoff == 0 {
+		cfg.MaxRetryBackoff = time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Replicator{src: src, cfg: cfg, cancel: cancel}
+	for name, t := range targets {
+		r.targets = append(r.targets, &target{
+			r:      r,
+			target: t,
+			wake:   make(chan struct{}, 1),
+			queued: make(map[key.Key]*item),
+			status: TargetStatus{Name: name},
+		})
+	}
+	sort.Sort(byName(r.targets))
+
+	// Watch rather than Subscribe, which drops the events of a burst of
+	// adds it falls behind on; queueing a key does not block.
+	src.Watch(ctx, func(e blockservice.BlockEvent) {
+		r.Replicate(e.Key)
+	}, blockservice.EventAdded)
+	r.wg.Add(len(r.targets))
+	for _, t := range r.targets {
+		go func(t *target) {
+			defer r.wg.Done()
+			t.run(ctx)
+		}(t)
+	}
+	return r, nil
+}
+
+// Replicate queues |ks| for every target, as if they had just been added to
+// the source, e.g. to replicate the blocks it held before the Replicator was
+// started. Keys already queued for a target are not queued again.
+func (r *Replicator) Replicate(ks ...key.Key) {
+	for _, t := range r.targets {
+		t.push(ks)
+	}
+}
+
+// Status reports on each target, in order of name.
+func (r *Replicator) Status() []TargetStatus {
+	out := make([]TargetStatus, len(r.targets))
+	for i, t := range r.targets {
+		out[i] = t.snapshot()
+	}
+	return out
+}
+
+// Close stops replicating, abandoning the blocks still queued, and waits
+// for the attempts in progress to end.
+func (r *Replicator) Close() error {
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+// backoff returns how long a block waits after its |attempts|th failure.
+func (r *Replicator) backoff(attempts int) time.Duration {
+	d := r.cfg.RetryBackoff
+	for i := 1; i < attempts && d < r.cfg.MaxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > r.cfg.MaxRetryBackoff {
+		d = r.cfg.MaxRetryBackoff
+	}
+	return d
+}
+
+type target struct {
+	r      *Replicator
+	target Target
+	wake   chan struct{}
+
+	mu      sync.Mutex
+	queue   []*item   // waiting for a first attempt, in the order queued
+	retries retryHeap // waiting to be tried again, the soonest due first
+	queued  map[key.Key]*item
+	status  TargetStatus
+}
+
+type item struct {
+	k        key.Key
+	attempts int
+	next     time.Time // when it may be tried
+}
+
+// retryHeap is a heap.Interface of items by when they may be tried.
+type retryHeap []*item
+
+func (h retryHeap) Len() int            { return len(h) }
+func (h retryHeap) Less(i, j int) bool  { return h[i].next.Before(h[j].next) }
+func (h retryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *retryHeap) Push(x interface{}) { *h = append(*h, x.(*item)) }
+func (h *retryHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
+
+type byName []*target
+
+func (ts byName) Len() int           { return len(ts) }
+func (ts byName) Less(i, j int) bool { return ts[i].status.Name < ts[j].status.Name }
+func (ts byName) Swap(i, j int)      { ts[i], ts[j] = ts[j], ts[i] }
+
+func (t *target) push(ks []key.Key) {
+	t.mu.Lock()
+	for _, k := range ks {
+		if _, ok := t.queued[k]; ok {
+			continue
+		}
+		it := &item{k: k}
+		t.queued[k] = it
+		t.queue = append(t.queue, it)
+	}
+	t.mu.Unlock()
+	t.signal()
+}
+
+func (t *target) signal() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes an item due at |now| off the queue, a retry that is due before
+// those not yet tried. If there is none, it returns how long until one is
+// due, or 0 if the queue is empty.
+func (t *target) next(now time.Time) (*item, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.retries) > 0 && !t.retries[0].next.After(now) {
+		return heap.Pop(&t.retries).(*item), 0
+	}
+	if len(t.queue) > 0 {
+		it := t.queue[0]
+		t.queue[0] = nil
+		t.queue = t.queue[1:]
+		return it, 0
+	}
+	if len(t.retries) > 0 {
+		return nil, t.retries[0].next.Sub(now)
+	}
+	return nil, 0
+}
+
+func (t *target) run(ctx context.Context) {
+	for {
+		it, wait := t.next(time.Now())
+		if it != nil {
+			t.attempt(ctx, it)
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		var due <-chan time.Time
+		var timer *time.Timer
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		select {
+		case <-t.wake:
+		case <-due:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// attempt replicates |it|, queueing it again if that fails.
+func (t *target) attempt(ctx context.Context, it *item) {
+	b, err := t.r.src.Blockstore.Get(it.k)
+	if errors.Is(err, blockstore.ErrNotFound) {
+		// deleted since it was added; there's nothing to replicate.
+		t.mu.Lock()
+		delete(t.queued, it.k)
+		t.mu.Unlock()
+		return
+	}
+	if err == nil {
+		rctx := ctx
+		if t.r.cfg.Timeout > 0 {
+			var cancel context.CancelFunc
+			rctx, cancel = context.WithTimeout(ctx, t.r.cfg.Timeout)
+			defer cancel()
+		}
+		err = t.target.Replicate(rctx, b)
+	}
+	if ctx.Err() != nil {
+		return // closing; the failure is not the target's.
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		delete(t.queued, it.k)
+		t.status.Replicated++
+		t.status.LastSuccess = now
+		return
+	}
+	it.attempts++
+	t.status.LastError = err
+	t.status.LastErrorTime = now
+	if max := t.r.cfg.MaxAttempts; max > 0 && it.attempts >= max {
+		delete(t.queued, it.k)
+		t.status.Failed++
+		return
+	}
+	it.next = now.Add(t.r.backoff(it.attempts))
+	heap.Push(&t.retries, it)
+}
+
+func (t *target) snapshot() TargetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.status
+	s.Queued = len(t.queued)
+	for _, it := range t.queued {
+		if it.attempts > 0 {
+			s.Retrying++
+		}
+	}
+	return s
+}
@@ -0,0 +1,171 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	offline "github.com/ipfs/go-blocks/blockservice/exchange/offline"
+	gateway "github.com/ipfs/go-blocks/blockservice/http"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func newService(t *testing.T) *blockservice.BlockService {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	s, err := blockservice.New(bstore, offline.Null())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// waitFor polls |cond| for up to a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func has(s *blockservice.BlockService, b *blocks.Block) func() bool {
+	return func() bool {
+		ok, _ := s.Blockstore.Has(b.Key())
+		return ok
+	}
+}
+
+func TestReplicatesAddedBlocks(t *testing.T) {
+	src, backup, gw := newService(t), newService(t), newService(t)
+	defer src.Close()
+	defer backup.Close()
+	defer gw.Close()
+	server := httptest.NewServer(gateway.NewHandler(gw))
+	defer server.Close()
+	gwTarget, err := ToGateway(nil, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(src, map[string]Target{"backup": ToService(backup), "gateway": gwTarget}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	b := blocks.NewBlock([]byte("replicate me"))
+	if _, err := src.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the backup", has(backup, b))
+	waitFor(t, "the gateway", has(gw, b))
+
+	waitFor(t, "the status", func() bool {
+		st := r.Status()
+		return st[0].Replicated == 1 && st[1].Replicated == 1
+	})
+	st := r.Status()
+	if st[0].Name != "backup" || st[1].Name != "gateway" || st[0].Queued != 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestRetriesFailedBlocks(t *testing.T) {
+	src := newService(t)
+	defer src.Close()
+
+	var mu sync.Mutex
+	calls := 0
+	flaky := TargetFunc(func(context.Context, *blocks.Block) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if calls++; calls < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	down := TargetFunc(func(context.Context, *blocks.Block) error {
+		return errors.New("down")
+	})
+	cfg := Config{RetryBackoff: time.Millisecond, MaxRetryBackoff: 2 * time.Millisecond, MaxAttempts: 2}
+	r, err := New(src, map[string]Target{"down": down, "flaky": flaky}, Config{RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	limited, err := New(src, map[string]Target{"down": down}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limited.Close()
+
+	if _, err := src.AddBlock(blocks.NewBlock([]byte("retry me"))); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the flaky target", func() bool { return r.Status()[1].Replicated == 1 })
+	waitFor(t, "the limited target to give up", func() bool { return limited.Status()[0].Failed == 1 })
+
+	waitFor(t, "the down target to fail", func() bool { return r.Status()[0].LastError != nil })
+	st := r.Status()[0]
+	if st.Queued != 1 || st.Retrying != 1 || st.Replicated != 0 {
+		t.Fatalf("expected the block to stay queued for the down target, got %+v", st)
+	}
+	if st := limited.Status()[0]; st.Queued != 0 {
+		t.Fatalf("expected the given up block to leave the queue, got %+v", st)
+	}
+}
+
+func TestReplicatesBursts(t *testing.T) {
+	src, backup := newService(t), newService(t)
+	defer src.Close()
+	defer backup.Close()
+	r, err := New(src, map[string]Target{"backup": ToService(backup)}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// more than a subscriber of the source's events may fall behind by.
+	var bs []*blocks.Block
+	for i := 0; i < 1000; i++ {
+		bs = append(bs, blocks.NewBlock([]byte(fmt.Sprintf("burst %d", i))))
+	}
+	if _, err := src.AddBlocks(context.Background(), bs); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the burst", func() bool { return r.Status()[0].Replicated == uint64(len(bs)) })
+	for _, b := range bs {
+		if !has(backup, b)() {
+			t.Fatalf("expected %s replicated", b.Key())
+		}
+	}
+}
+
+func TestReplicateBackfills(t *testing.T) {
+	src, backup := newService(t), newService(t)
+	defer src.Close()
+	defer backup.Close()
+	old := blocks.NewBlock([]byte("from before"))
+	if _, err := src.AddBlock(old); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(src, map[string]Target{"backup": ToService(backup)}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.Replicate(old.Key())
+	waitFor(t, "the backfill", has(backup, old))
+}
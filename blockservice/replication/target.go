@@ -0,0 +1,91 @@
+package replication
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Target is somewhere blocks are replicated to.
+type Target interface {
+	// Replicate stores |b| at the target, returning once it is stored.
+	Replicate(ctx context.Context, b *blocks.Block) error
+}
+
+// TargetFunc adapts a function to a Target.
+type TargetFunc func(ctx context.Context, b *blocks.Block) error
+
+func (f TargetFunc) Replicate(ctx context.Context, b *blocks.Block) error {
+	return f(ctx, b)
+}
+
+// ToService returns a Target adding blocks to |s|. A block stored but not
+// announced by |s| counts as replicated.
+func ToService(s *blockservice.BlockService) Target {
+	return TargetFunc(func(ctx context.Context, b *blocks.Block) error {
+		_, err := s.AddBlockCtx(ctx, b)
+		var nae *blockservice.NotAnnouncedError
+		if errors.As(err, &nae) {
+			return nil
+		}
+		return err
+	})
+}
+
+// ToGateway returns a Target storing blocks with PUT /block at the gateway
+// whose base URL is |endpoint|, such as one served by package
+// blockservice/http, using |client|, or http.DefaultClient if it is nil.
+// The gateway keys blocks itself, so it must hash them as the source does:
+// a block it keys differently fails to replicate.
+func ToGateway(client *http.Client, endpoint string) (Target, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("replication: endpoint %q: %w", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("replication: endpoint %q is not an http(s) URL", endpoint)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &gatewayTarget{client: client, put: strings.TrimSuffix(u.String(), "/") + "/block"}, nil
+}
+
+type gatewayTarget struct {
+	client *http.Client
+	put    string
+}
+
+func (g *gatewayTarget) Replicate(ctx context.Context, b *blocks.Block) error {
+	req, err := http.NewRequest("PUT", g.put, bytes.NewReader(b.Data))
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// the key, on a line of its own.
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("replication: %s: %s", g.put, resp.Status)
+	}
+	if got, want := strings.TrimSpace(string(body)), b.Cid().String(); got != want {
+		return fmt.Errorf("replication: %s keyed %s as %s", g.put, want, got)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package blockservice
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	worker "github.com/ipfs/go-blocks/blockservice/worker"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	pin "github.com/ipfs/go-blocks/blockstore/pin"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ReprovideStrategy returns the keys a reprovide sweep announces again,
+// from |bs|, the service's blockstore. The channel is drained unless |ctx|
+// is done first.
+type ReprovideStrategy func(ctx context.Context, bs blockstore.Blockstore) (<-chan key.Key, error)
+
+// ReprovideAll announces every stored block.
+func ReprovideAll(ctx context.Context, bs blockstore.Blockstore) (<-chan key.Key, error) {
+	return bs.AllKeysChan(ctx)
+}
+
+// ReprovidePinned announces the blocks |p| pins, however they are pinned.
+func ReprovidePinned(p *pin.Pinner) ReprovideStrategy {
+	return func(ctx context.Context, _ blockstore.Blockstore) (<-chan key.Key, error) {
+		return sendKeys(ctx, p.Set().Keys()), nil
+	}
+}
+
+// ReprovideRoots announces the blocks |p| pins directly or recursively, but
+// not those pinned only through a recursive pin, which can be found through
+// its root.
+func ReprovideRoots(p *pin.Pinner) ReprovideStrategy {
+	return func(ctx context.Context, _ blockstore.Blockstore) (<-chan key.Key, error) {
+		ks := append(p.Keys(pin.Recursive), p.Keys(pin.Direct)...)
+		return sendKeys(ctx, ks), nil
+	}
+}
+
+func sendKeys(ctx context.Context, ks []key.Key) <-chan key.Key {
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			select {
+			case out <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// EnableReprovider makes the service announce the blocks |strategy| returns
+// to the exchange again every |interval|, the first time one interval from
+// now, as the records of an announcement expire. Blocks are queued for the
+// background workers at worker.PriorityLow, behind those being added; blocks
+// missing from the blockstore and inline blocks are skipped. See Reprovide
+// for a sweep on demand. It returns ErrNotSupported if the service has no
+// exchange. It must be called before the service is used.
+func (s *BlockService) EnableReprovider(interval time.Duration, strategy ReprovideStrategy) error {
+	if s.Exchange == nil {
+		return ErrNotSupported
+	}
+	if interval <= 0 || strategy == nil {
+		return errors.New("blockservice: reprovider needs a positive interval and a strategy")
+	}
+	r := &reprovider{
+		strategy: strategy,
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	s.reprovider = r
+	go r.run(interval, func() { s.Reprovide(r.ctx) })
+	return nil
+}
+
+// Reprovide runs a reprovide sweep now, returning how many blocks it queued
+// for announcement. It waits for a sweep in progress to finish first, and
+// returns ErrNotSupported unless EnableReprovider was called.
+func (s *BlockService) Reprovide(ctx context.Context) (int, error) {
+	r := s.reprovider
+	if r == nil {
+		return 0, ErrNotSupported
+	}
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ks, err := r.strategy(ctx, s.Blockstore)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for k := range ks {
+		b, err := s.Blockstore.Get(k)
+		if err != nil || isInline(b) {
+			continue
+		}
+		if err := s.worker.HasBlockPriority(ctx, b, nil, worker.PriorityLow); err != nil {
+			return n, err
+		}
+		n++
+		atomic.AddUint64(&s.stats.reprovided, 1)
+	}
+	return n, ctx.Err()
+}
+
+// reprovider runs the periodic sweeps of EnableReprovider.
+type reprovider struct {
+	strategy ReprovideStrategy
+	// mu keeps sweeps from overlapping.
+	mu sync.Mutex
+
+	// ctx is cancelled by Close, cutting a periodic sweep short.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+// run calls |sweep| every |interval| until Close.
+func (r *reprovider) run(interval time.Duration, sweep func()) {
+	defer close(r.closed)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			sweep()
+		case <-r.closing:
+			return
+		}
+	}
+}
+
+// Close stops the periodic sweeps, waiting for one in progress to give up.
+func (r *reprovider) Close() error {
+	r.cancel()
+	close(r.closing)
+	<-r.closed
+	return nil
+}
@@ -0,0 +1,230 @@
+package blockservice
+
+import (
+	"errors"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// BlockResult is the outcome of looking up one key with GetBlocksWithErrors:
+// the Block, or the Err saying why there is none.
+type BlockResult struct {
+	Key   key.Key
+	Block *blocks.Block
+	Err   error
+}
+
+// GetBlocksWithErrors is like GetBlocks, but sends one result for each key
+// in |ks|, listed once or more, instead of leaving the caller to work out
+// which blocks never came. Keys without a block are reported with:
+//
+//   - ErrNotFound if neither the blockstore nor the exchange had it, or it
+//     is the zero-value key,
+//   - ctx.Err() if |ctx| was done first,
+//   - ErrClosed if the service was closed,
+//   - the exchange's error if it could not take the request,
+//   - the verifier's error if the exchange only sent bad copies, or
+//   - the blockstore's error if reading it failed and the exchange did not
+//     have it either.
+//
+// Once |ctx| is done the results left may not be sent, the channel being
+// closed without them if the caller has stopped receiving.
+func (s *BlockService) GetBlocksWithErrors(ctx context.Context, ks []key.Key) <-chan BlockResult {
+	out := make(chan BlockResult)
+	go func() {
+		defer close(out)
+		send := func(r BlockResult) bool {
+			select {
+			case out <- r:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		seen := make(map[key.Key]struct{}, len(ks))
+		var unique []key.Key
+		for _, k := range ks {
+			if _, dup := seen[k]; !dup {
+				seen[k] = struct{}{}
+				unique = append(unique, k)
+			}
+		}
+		if err := s.checkOpen(); err != nil {
+			for _, k := range unique {
+				if !send(BlockResult{Key: k, Err: err}) {
+					return
+				}
+			}
+			return
+		}
+
+		// failed holds the errors of keys not found yet that are more
+		// specific than the overall reason the exchange gives up.
+		failed := make(map[key.Key]error)
+		var misses []key.Key
+		for _, k := range unique {
+			if k == "" || len(s.withoutKnownMissing([]key.Key{k})) == 0 {
+				if !send(BlockResult{Key: k, Err: ErrNotFound}) {
+					return
+				}
+				continue
+			}
+			b, err := s.getLocal(k)
+			switch {
+			case err == nil:
+				if !send(BlockResult{Key: k, Block: b}) {
+					return
+				}
+				continue
+			case errors.Is(err, blockstore.ErrNotFound):
+			default:
+				failed[k] = err
+			}
+			misses = append(misses, k)
+		}
+		if len(misses) == 0 {
+			return
+		}
+
+		remaining := make(map[key.Key]struct{}, len(misses))
+		for _, k := range misses {
+			remaining[k] = struct{}{}
+		}
+		usable := s.exchangeUsable()
+		giveUp := s.fetchEach(ctx, misses, func(b *blocks.Block) {
+			k := b.Key()
+			if _, ok := remaining[k]; !ok {
+				atomic.AddUint64(&s.stats.rejected, 1)
+				return
+			}
+			if err := s.verifyRemote(k, b); err != nil {
+				failed[k] = err
+				return
+			}
+			delete(remaining, k)
+			atomic.AddUint64(&s.stats.exchangeHits, 1)
+			s.repair(b)
+			send(BlockResult{Key: k, Block: b})
+		})
+
+		var unanswered []key.Key
+		for _, k := range misses {
+			if _, ok := remaining[k]; ok {
+				unanswered = append(unanswered, k)
+			}
+		}
+		atomic.AddUint64(&s.stats.misses, uint64(len(unanswered)))
+		if giveUp == ctx.Err() || errors.Is(giveUp, ErrTimeout) {
+			s.cancelWants(unanswered)
+		}
+		for _, k := range unanswered {
+			err := giveUp
+			if specific, ok := failed[k]; ok && errors.Is(err, ErrNotFound) {
+				err = specific
+			}
+			if reportsMissing(err) && usable {
+				s.notFound.add([]key.Key{k})
+			}
+			if !send(BlockResult{Key: k, Err: err}) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// fetchEach requests |ks| from the exchange and calls |recv| on each block
+// it sends. It returns why the remaining keys were not found: ErrNotFound if
+// the exchange ran out of blocks, ErrTimeout at the fetch timeout, or
+// ctx.Err() or the exchange's error.
+func (s *BlockService) fetchEach(ctx context.Context, ks []key.Key, recv func(*blocks.Block)) error {
+	if !s.exchangeUsable() {
+		return ErrNotFound
+	}
+	fctx, cancel := s.withFetchTimeout(ctx)
+	defer cancel()
+	rblocks, err := s.fetchBlocks(fctx, s.Exchange, ks)
+	if err != nil {
+		return timedOut(ctx, fctx, err)
+	}
+	for {
+		select {
+		case b, ok := <-rblocks:
+			if !ok {
+				if err := fctx.Err(); err != nil {
+					return timedOut(ctx, fctx, err)
+				}
+				if budgetOf(ctx).wasExceeded() {
+					return ErrBudgetExceeded
+				}
+				return ErrNotFound
+			}
+			recv(b)
+		case <-fctx.Done():
+			return timedOut(ctx, fctx, fctx.Err())
+		}
+	}
+}
+
+// GetBlocksWithErrorsOrdered is GetBlocksWithErrors, but sends one result
+// per listing of each key of |ks|, in the order of |ks|. Results that come
+// out of order are held until those before them have been sent. As for
+// GetBlocksWithErrors, the results left once |ctx| is done may not be sent.
+func (s *BlockService) GetBlocksWithErrorsOrdered(ctx context.Context, ks []key.Key) <-chan BlockResult {
+	out := make(chan BlockResult)
+	go func() {
+		defer close(out)
+		results := make(map[key.Key]BlockResult, len(ks))
+		next := 0
+		// flush sends the results of ks[next:] that have come, and reports
+		// whether the caller may still be receiving.
+		flush := func() bool {
+			for ; next < len(ks); next++ {
+				r, ok := results[ks[next]]
+				if !ok {
+					return true
+				}
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return true
+		}
+		for r := range s.GetBlocksWithErrors(ctx, ks) {
+			results[r.Key] = r
+			if !flush() {
+				break
+			}
+		}
+	}()
+	return out
+}
+
+// GetBlocksOrdered returns the blocks of |ks| in the same order, a key
+// listed more than once getting its block each time. If any is missing, it
+// returns the error GetBlocksWithErrors reports for the first of them, or
+// ctx.Err() if the results were cut short, and no blocks.
+func (s *BlockService) GetBlocksOrdered(ctx context.Context, ks []key.Key) ([]*blocks.Block, error) {
+	bs := make([]*blocks.Block, 0, len(ks))
+	var err error
+	for r := range s.GetBlocksWithErrorsOrdered(ctx, ks) {
+		if r.Err != nil && err == nil {
+			err = r.Err
+		}
+		bs = append(bs, r.Block)
+	}
+	if err == nil && len(bs) < len(ks) {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
@@ -0,0 +1,95 @@
+package blockservice
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// RetryPolicy says how GetBlock, and the reads that fetch one block at a
+// time, retry a failed exchange fetch instead of returning its error. The
+// zero RetryPolicy, the default, never retries.
+type RetryPolicy struct {
+	// Attempts is the number of times a fetch is tried, the first
+	// included. Zero or one means no retries.
+	Attempts int
+	// AttemptTimeout, if positive, bounds each attempt, so that a fetch the
+	// exchange is stuck on is tried again rather than waited on until the
+	// caller gives up. A timed out attempt counts as a failure.
+	AttemptTimeout time.Duration
+	// Backoff is the delay before the first retry. It doubles on each
+	// further retry, up to MaxBackoff, which defaults to 64 times Backoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter, between 0 and 1, randomizes each delay by up to that fraction
+	// of it either way, so that callers failing together do not retry
+	// together.
+	Jitter float64
+	// Retryable reports whether a failure is worth retrying. If nil, every
+	// error is. A fetch is never retried once the caller's context is done.
+	Retryable func(error) bool
+}
+
+// WithRetryPolicy makes the service retry failed exchange fetches as |p|
+// says. See RetryPolicy.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(o *options) { o.retry = p }
+}
+
+func (p RetryPolicy) validate() error {
+	switch {
+	case p.Attempts < 0:
+		return fmt.Errorf("blockservice: retry attempts must not be negative, got %d", p.Attempts)
+	case p.AttemptTimeout < 0 || p.Backoff < 0 || p.MaxBackoff < 0:
+		return fmt.Errorf("blockservice: retry timeouts must not be negative")
+	case p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("blockservice: retry jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	return nil
+}
+
+// retrying calls |attempt| until it succeeds, |s.retry| gives up on it, or
+// |ctx| is done, and returns the error of the last attempt.
+func (s *BlockService) retrying(ctx context.Context, attempt func(context.Context) error) error {
+	p := s.retry
+	delay := p.Backoff
+	maxDelay := p.MaxBackoff
+	if maxDelay < delay {
+		maxDelay = 64 * delay
+	}
+	for i := 1; ; i++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if p.AttemptTimeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, p.AttemptTimeout)
+		}
+		err := attempt(actx)
+		cancel()
+		if err == nil || i >= p.Attempts || ctx.Err() != nil {
+			return err
+		}
+		if p.Retryable != nil && !p.Retryable(err) {
+			return err
+		}
+
+		t := time.NewTimer(p.jitter(delay))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+func (p RetryPolicy) jitter(d time.Duration) time.Duration {
+	if p.Jitter == 0 || d <= 0 {
+		return d
+	}
+	spread := float64(d) * p.Jitter
+	return d + time.Duration((rand.Float64()*2-1)*spread)
+}
@@ -0,0 +1,71 @@
+package blockservice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// selfTestPrefix marks the synthetic blocks written by SelfTest.
+const selfTestPrefix = "blockservice self-test "
+
+// SelfTest checks that the blockstore works end to end by putting a small
+// synthetic block, reading it back, verifying its data and hash, and deleting
+// it again. The returned error names the step that failed. The block is
+// removed even when a later step fails, and it is never announced to the
+// exchange.
+//
+// The block carries a random nonce so that it cannot collide with a block
+// already in the store.
+func (s *BlockService) SelfTest(ctx context.Context) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("blockservice self-test: generating block: %w", err)
+	}
+	data := append([]byte(selfTestPrefix), nonce...)
+	b := blocks.NewBlock(data)
+	k := b.Key()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.Blockstore.Put(b); err != nil {
+		return fmt.Errorf("blockservice self-test: put %s: %w", k, err)
+	}
+	deleted := false
+	defer func() {
+		if !deleted {
+			s.Blockstore.DeleteBlock(k)
+		}
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	got, err := s.Blockstore.Get(k)
+	if err != nil {
+		return fmt.Errorf("blockservice self-test: get %s: %w", k, err)
+	}
+	if !bytes.Equal(got.Data, data) {
+		return fmt.Errorf("blockservice self-test: get %s: data does not match what was put", k)
+	}
+	if err := blockstore.Verify(k, got.Data); err != nil {
+		return fmt.Errorf("blockservice self-test: verify %s: %w", k, err)
+	}
+
+	if err := s.Blockstore.DeleteBlock(k); err != nil {
+		return fmt.Errorf("blockservice self-test: delete %s: %w", k, err)
+	}
+	deleted = true
+	if has, err := s.Blockstore.Has(k); err != nil {
+		return fmt.Errorf("blockservice self-test: has %s: %w", k, err)
+	} else if has {
+		return fmt.Errorf("blockservice self-test: delete %s: block still present", k)
+	}
+	return nil
+}
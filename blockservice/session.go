@@ -0,0 +1,125 @@
+package blockservice
+
+import (
+	"container/list"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	exchange "github.com/ipfs/go-blocks/blockservice/exchange"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// sessionCacheSize is the number of blocks a Session keeps in memory.
+const sessionCacheSize = 256
+
+// Session groups related fetches, such as those of one DAG traversal. It
+// keeps the blocks it returned most recently in memory, and if the exchange
+// implements exchange.SessionExchange, its fetches share exchange state.
+// A Session is safe for concurrent use.
+type Session struct {
+	s *BlockService
+	f exchange.Fetcher
+	// wants tracks the keys the session's reads wait on.
+	wants *wantlist
+
+	mu    sync.Mutex
+	order list.List // of *blocks.Block, most recently used first
+	cache map[key.Key]*list.Element
+}
+
+// NewSession starts a session that lasts until |ctx| is done.
+func (s *BlockService) NewSession(ctx context.Context) *Session {
+	var f exchange.Fetcher = s.Exchange
+	if se, ok := s.Exchange.(exchange.SessionExchange); ok {
+		f = se.NewSession(ctx)
+	}
+	return &Session{s: s, f: f, wants: newWantlist(), cache: make(map[key.Key]*list.Element)}
+}
+
+// GetBlock is BlockService.GetBlock within the session. The blocks the
+// session holds count as stored locally.
+func (ss *Session) GetBlock(ctx context.Context, k key.Key, opts ...GetOption) (*blocks.Block, error) {
+	o, err := newGetOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return ss.getBlock(ctx, k, o)
+}
+
+func (ss *Session) getBlock(ctx context.Context, k key.Key, o getOptions) (*blocks.Block, error) {
+	if b, ok := ss.cached(k); ok && !o.remoteOnly {
+		o.setSource(SourceSession)
+		return b, o.fits(b)
+	}
+	b, err := ss.s.getBlock(withWantlist(ctx, ss.wants), k, ss.f, o)
+	if err != nil {
+		return nil, err
+	}
+	ss.remember(b)
+	return b, nil
+}
+
+// GetBlocks is BlockService.GetBlocks within the session.
+func (ss *Session) GetBlocks(ctx context.Context, ks []key.Key) <-chan *blocks.Block {
+	var hits []*blocks.Block
+	var rest []key.Key
+	for _, k := range ks {
+		if b, ok := ss.cached(k); ok {
+			hits = append(hits, b)
+		} else {
+			rest = append(rest, k)
+		}
+	}
+
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		for _, b := range hits {
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(rest) == 0 {
+			return
+		}
+		for b := range ss.s.getBlocks(withWantlist(ctx, ss.wants), rest, GetBlocksOptions{}, ss.f) {
+			ss.remember(b)
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (ss *Session) cached(k key.Key) (*blocks.Block, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	e, ok := ss.cache[k]
+	if !ok {
+		return nil, false
+	}
+	ss.order.MoveToFront(e)
+	return e.Value.(*blocks.Block), true
+}
+
+func (ss *Session) remember(b *blocks.Block) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if e, ok := ss.cache[b.Key()]; ok {
+		ss.order.MoveToFront(e)
+		return
+	}
+	ss.cache[b.Key()] = ss.order.PushFront(b)
+	if ss.order.Len() > sessionCacheSize {
+		oldest := ss.order.Back()
+		ss.order.Remove(oldest)
+		delete(ss.cache, oldest.Value.(*blocks.Block).Key())
+	}
+}
@@ -0,0 +1,119 @@
+package blockservice
+
+import (
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// spillBuffer queues blocks between the exchange and a GetBlocks caller, up
+// to |maxBlocks| blocks or |maxBytes| bytes of block data. A zero limit is not
+// enforced; with neither set the buffer holds a single block.
+type spillBuffer struct {
+	maxBlocks int
+	maxBytes  int
+	// timeout, if positive, is how long the block at the head of the queue
+	// may wait to be sent before it is passed to |drop| instead.
+	timeout time.Duration
+	drop    func(*blocks.Block)
+	// sent, if set, is called on each block sent, with whether it had to
+	// wait for |out| to take it.
+	sent func(b *blocks.Block, waited bool)
+
+	queue []*blocks.Block
+	bytes int
+}
+
+func (sb *spillBuffer) full() bool {
+	if len(sb.queue) == 0 {
+		return false
+	}
+	if sb.maxBlocks <= 0 && sb.maxBytes <= 0 {
+		return true
+	}
+	return (sb.maxBlocks > 0 && len(sb.queue) >= sb.maxBlocks) ||
+		(sb.maxBytes > 0 && sb.bytes >= sb.maxBytes)
+}
+
+// forward moves blocks from |in| to |out| until |in| is closed and drained
+// or |ctx| is done. |accept| is called on every block taken from |in|, and
+// returns how many times to send it to |out|, zero to drop it.
+func (sb *spillBuffer) forward(ctx context.Context, in <-chan *blocks.Block, out chan<- *blocks.Block, accept func(*blocks.Block) int) {
+	// expired fires once the head of the queue has waited |timeout|.
+	var timer *time.Timer
+	var expired <-chan time.Time
+	rearm := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+		if sb.timeout > 0 && len(sb.queue) > 0 {
+			timer = time.NewTimer(sb.timeout)
+			expired = timer.C
+		}
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for in != nil || len(sb.queue) > 0 {
+		// nil channels never proceed, so only enabled cases can fire.
+		var send chan<- *blocks.Block
+		var next *blocks.Block
+		if len(sb.queue) > 0 {
+			send, next = out, sb.queue[0]
+			if sb.sent != nil {
+				// find out whether |out| is ready for it.
+				select {
+				case send <- next:
+					sb.pop()
+					sb.sent(next, false)
+					rearm()
+					continue
+				default:
+				}
+			}
+		}
+		take := in
+		if sb.full() {
+			take = nil
+		}
+
+		select {
+		case b, ok := <-take:
+			if !ok {
+				in = nil
+				continue
+			}
+			empty := len(sb.queue) == 0
+			for n := accept(b); n > 0; n-- {
+				sb.queue = append(sb.queue, b)
+				sb.bytes += len(b.Data)
+			}
+			if empty {
+				rearm()
+			}
+		case send <- next:
+			sb.pop()
+			if sb.sent != nil {
+				sb.sent(next, true)
+			}
+			rearm()
+		case <-expired:
+			sb.pop()
+			sb.drop(next)
+			rearm()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (sb *spillBuffer) pop() {
+	sb.bytes -= len(sb.queue[0].Data)
+	sb.queue[0] = nil
+	sb.queue = sb.queue[1:]
+}
@@ -0,0 +1,219 @@
+package blockservice
+
+import (
+	"sync/atomic"
+	"time"
+
+	worker "github.com/ipfs/go-blocks/blockservice/worker"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of every Histogram in
+// Stats.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// Stats is a point-in-time snapshot of BlockService activity. Counters are
+// cumulative over the life of the service.
+type Stats struct {
+	// Blocks requested through GetBlock and GetBlocks, by where they were
+	// found. Misses were found neither locally nor through the exchange;
+	// Errors are blockstore failures other than a miss.
+	LocalHits    uint64
+	ExchangeHits uint64
+	Misses       uint64
+	Errors       uint64
+	// Rejected counts blocks received from the exchange that failed
+	// verification. See SetBlockVerifier.
+	Rejected uint64
+	// NotFoundHits counts the Misses answered from the keys remembered as
+	// missing, without a lookup. See WithNotFoundCache.
+	NotFoundHits uint64
+
+	// Blocks added and deleted.
+	Added   uint64
+	Deleted uint64
+	// Prefetched counts blocks stored by Prefetch.
+	Prefetched uint64
+	// Expired counts blocks removed because their TTL ran out. See
+	// EnableExpiry.
+	Expired uint64
+	// Repaired counts corrupt local blocks replaced by the exchange's copy.
+	// See SetCorruptionRepair.
+	Repaired uint64
+	// Reprovided counts blocks queued for announcement again by reprovide
+	// sweeps. See EnableReprovider.
+	Reprovided uint64
+	// DroppedEvents counts events not delivered to a subscriber that was
+	// behind. See Subscribe.
+	DroppedEvents uint64
+	// Undelivered counts blocks GetBlocksWith gave up on sending, its caller
+	// not taking them in time. See GetBlocksOptions.SendTimeout.
+	Undelivered uint64
+	// Panics counts the blockstore and exchange calls that panicked. See
+	// WithPanicRecovery.
+	Panics uint64
+
+	// BlockstoreLatency is the distribution of local blockstore reads,
+	// BlockstoreWriteLatency that of its writes and deletes, and
+	// ExchangeLatency that of single-block exchange fetches.
+	BlockstoreLatency      Histogram
+	BlockstoreWriteLatency Histogram
+	ExchangeLatency        Histogram
+	// ProvideLatency is the distribution of the time from a block being
+	// queued for announcement, as AddBlock does once it is stored, to the
+	// exchange taking it, retries included.
+	ProvideLatency Histogram
+
+	// DiskBreaker is the state of the breaker in front of the blockstore,
+	// and DiskBreakerTrips the number of times it opened. See
+	// WithDiskBreaker.
+	DiskBreaker      BreakerState
+	DiskBreakerTrips uint64
+
+	// OldestPendingAge is how long the oldest block added to the service has
+	// been waiting to be provided to the exchange. Zero if none are waiting.
+	OldestPendingAge time.Duration
+	// RetryQueueDepth is the number of blocks waiting to be offered to the
+	// exchange again after it failed to take them.
+	RetryQueueDepth int
+	// Announcements describes the background announcement of added blocks
+	// to the exchange.
+	Announcements worker.Stats
+}
+
+// Histogram is a snapshot of a latency distribution.
+type Histogram struct {
+	// Counts[i] is the number of observations no greater than
+	// LatencyBuckets[i] (and greater than LatencyBuckets[i-1]). Observations
+	// above the last bucket are only reflected in Count and Sum.
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Quantile estimates the latency below which a fraction |q| of the
+// observations fall, such as 0.99 for the 99th percentile, as the upper
+// bound of the bucket it falls in. It is zero without observations, and the
+// last bound if it falls above the last bucket.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 || len(h.Counts) == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.Counts {
+		seen += n
+		if seen >= rank {
+			return LatencyBuckets[i]
+		}
+	}
+	return LatencyBuckets[len(h.Counts)-1]
+}
+
+// Stats returns a snapshot of the service's current activity.
+func (s *BlockService) Stats() Stats {
+	c := s.stats
+	disk, trips := s.disk.State()
+	return Stats{
+		LocalHits:              atomic.LoadUint64(&c.localHits),
+		ExchangeHits:           atomic.LoadUint64(&c.exchangeHits),
+		Misses:                 atomic.LoadUint64(&c.misses),
+		Errors:                 atomic.LoadUint64(&c.errors),
+		Rejected:               atomic.LoadUint64(&c.rejected),
+		NotFoundHits:           atomic.LoadUint64(&c.notFoundHits),
+		Added:                  atomic.LoadUint64(&c.added),
+		Deleted:                atomic.LoadUint64(&c.deleted),
+		Prefetched:             atomic.LoadUint64(&c.prefetched),
+		Expired:                atomic.LoadUint64(&c.expired),
+		Repaired:               atomic.LoadUint64(&c.repaired),
+		Reprovided:             atomic.LoadUint64(&c.reprovided),
+		DroppedEvents:          atomic.LoadUint64(&c.droppedEvents),
+		Undelivered:            atomic.LoadUint64(&c.undelivered),
+		Panics:                 atomic.LoadUint64(&c.panics),
+		BlockstoreLatency:      c.blockstoreLatency.snapshot(),
+		BlockstoreWriteLatency: c.blockstoreWriteLatency.snapshot(),
+		ExchangeLatency:        c.exchangeLatency.snapshot(),
+		ProvideLatency:         c.provideLatency.snapshot(),
+		DiskBreaker:            disk,
+		DiskBreakerTrips:       trips,
+		OldestPendingAge:       s.worker.OldestPendingAge(),
+		RetryQueueDepth:        s.worker.RetryDepth(),
+		Announcements:          s.worker.Stat(),
+	}
+}
+
+// counters backs Stats. It is allocated on its own so that the 64-bit
+// fields are aligned for atomic access on 32-bit platforms.
+type counters struct {
+	localHits     uint64
+	exchangeHits  uint64
+	misses        uint64
+	errors        uint64
+	rejected      uint64
+	notFoundHits  uint64
+	added         uint64
+	deleted       uint64
+	prefetched    uint64
+	expired       uint64
+	repaired      uint64
+	reprovided    uint64
+	droppedEvents uint64
+	undelivered   uint64
+	panics        uint64
+
+	blockstoreLatency      *histogram
+	blockstoreWriteLatency *histogram
+	exchangeLatency        *histogram
+	provideLatency         *histogram
+}
+
+func newCounters() *counters {
+	return &counters{
+		blockstoreLatency:      newHistogram(),
+		blockstoreWriteLatency: newHistogram(),
+		exchangeLatency:        newHistogram(),
+		provideLatency:         newHistogram(),
+	}
+}
+
+type histogram struct {
+	count  uint64
+	sum    uint64 // nanoseconds
+	counts []uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(LatencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+	for i, le := range LatencyBuckets {
+		if d <= le {
+			atomic.AddUint64(&h.counts[i], 1)
+			return
+		}
+	}
+}
+
+func (h *histogram) snapshot() Histogram {
+	out := Histogram{
+		Count:  atomic.LoadUint64(&h.count),
+		Sum:    time.Duration(atomic.LoadUint64(&h.sum)),
+		Counts: make([]uint64, len(h.counts)),
+	}
+	for i := range h.counts {
+		out.Counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return out
+}
@@ -0,0 +1,109 @@
+package blockservice
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ReadStrategy decides, when GetBlock finds a block locally, whether to
+// cross-check it against the exchange. |verifyErr| is the result of
+// verifying the local data against |k|, nil if it matched.
+//
+// A cross-checked block that failed verification is replaced by the
+// exchange's copy, if that one verifies.
+type ReadStrategy interface {
+	CrossCheck(k key.Key, verifyErr error) bool
+}
+
+// ReadStrategyFunc adapts a function to a ReadStrategy.
+type ReadStrategyFunc func(k key.Key, verifyErr error) bool
+
+func (f ReadStrategyFunc) CrossCheck(k key.Key, verifyErr error) bool {
+	return f(k, verifyErr)
+}
+
+var (
+	// LocalFirst trusts local blocks without verifying them. It is the
+	// default strategy.
+	LocalFirst ReadStrategy = localFirst{}
+
+	// AlwaysCrossCheck consults the exchange on every local hit.
+	AlwaysCrossCheck ReadStrategy = ReadStrategyFunc(func(key.Key, error) bool { return true })
+
+	// CrossCheckOnSuspicion consults the exchange only for local blocks
+	// that fail verification.
+	CrossCheckOnSuspicion ReadStrategy = ReadStrategyFunc(func(_ key.Key, verifyErr error) bool {
+		return verifyErr != nil
+	})
+)
+
+type localFirst struct{}
+
+func (localFirst) CrossCheck(key.Key, error) bool { return false }
+
+// SampledCrossCheck returns a strategy that consults the exchange for local
+// blocks that fail verification, and for a random |rate| (between 0 and 1)
+// of the others.
+func SampledCrossCheck(rate float64) ReadStrategy {
+	var mu sync.Mutex
+	rnd := rand.New(rand.NewSource(rand.Int63()))
+	return ReadStrategyFunc(func(_ key.Key, verifyErr error) bool {
+		if verifyErr != nil {
+			return true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return rnd.Float64() < rate
+	})
+}
+
+// SetReadStrategy sets the strategy GetBlock uses on local hits. A nil
+// strategy restores the default, LocalFirst. It must be set before the
+// service is used.
+func (s *BlockService) SetReadStrategy(rs ReadStrategy) {
+	if _, ok := rs.(localFirst); ok {
+		rs = nil // skip verification entirely
+	}
+	s.readStrategy = rs
+}
+
+// checkLocal applies the read strategy to the local block |b|.
+func (s *BlockService) checkLocal(ctx context.Context, b *blocks.Block) (*blocks.Block, error) {
+	k := b.Key()
+	verifyErr := blockstore.Verify(k, b.Data)
+	if !s.readStrategy.CrossCheck(k, verifyErr) || !s.exchangeUsable() {
+		return b, verifyErr
+	}
+
+	remote, err := s.fetchBlock(ctx, s.Exchange, k)
+	if err != nil || blockstore.Verify(k, remote.Data) != nil {
+		// nothing better to offer than the local copy.
+		return b, verifyErr
+	}
+	if verifyErr != nil {
+		s.replaceLocal(remote)
+	}
+	return remote, nil
+}
+
+// replaceLocal swaps the corrupt local copy of |b| for |b|, quarantining the
+// old one if the blockstore supports it. A read-only service keeps it.
+func (s *BlockService) replaceLocal(b *blocks.Block) {
+	if s.readOnly {
+		return
+	}
+	err := s.removeLocal(b.Key())
+	if err == nil {
+		err = s.put(b)
+	}
+	if err != nil {
+		atomic.AddUint64(&s.stats.errors, 1)
+	}
+}
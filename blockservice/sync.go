@@ -0,0 +1,103 @@
+package blockservice
+
+import (
+	"errors"
+	"sync"
+
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// syncConcurrency is the most blocks Sync fetches at once. The fetches still
+// count against WithMaxConcurrentFetches.
+const syncConcurrency = 8
+
+// SyncReport is what Sync did.
+type SyncReport struct {
+	// Present is the number of keys already stored.
+	Present int
+	// Fetched is the number of blocks fetched and stored, and FetchedBytes
+	// their total size.
+	Fetched      int
+	FetchedBytes uint64
+	// Failed holds the keys neither stored nor fetched, with why.
+	Failed map[key.Key]error
+}
+
+// Sync makes sure the blocks for |ks| are stored, fetching only those that
+// are not from the exchange, a few at a time, and storing them. Unlike
+// GetBlocks it does not return the blocks, which suits replication jobs.
+// Fetched blocks are not announced. If |ctx| is done first, the keys not
+// synced yet are reported failed and its error returned.
+func (s *BlockService) Sync(ctx context.Context, ks []key.Key) (SyncReport, error) {
+	rep := SyncReport{Failed: make(map[key.Key]error)}
+	if err := s.checkOpen(); err != nil {
+		return rep, err
+	}
+	if s.readOnly {
+		return rep, blockstore.ErrReadOnly
+	}
+
+	var check []key.Key
+	seen := make(map[key.Key]struct{})
+	for _, k := range withoutEmptyKeys(ks) {
+		if _, dup := seen[k]; dup {
+			continue
+		}
+		seen[k] = struct{}{}
+		if _, ok := inlineBlock(k); ok {
+			rep.Present++
+			continue
+		}
+		check = append(check, k)
+	}
+	// checked at once, for the blockstores that can; see blockstore.HasMany.
+	var has []bool
+	err := s.guardRead(func() (err error) {
+		has, err = blockstore.HasMany(ctx, s.Blockstore, check)
+		return err
+	})
+	var missing []key.Key
+	for i, k := range check {
+		switch {
+		case err != nil && !errors.Is(err, blockstore.ErrNotFound):
+			rep.Failed[k] = err
+		case err == nil && has[i] && !s.expired(k):
+			rep.Present++
+		default:
+			missing = append(missing, k)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	todo := make(chan key.Key)
+	for i := 0; i < syncConcurrency && i < len(missing); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range todo {
+				b, err := s.GetBlock(ctx, k, RemoteOnly())
+				if err == nil {
+					err = s.put(b)
+				}
+				mu.Lock()
+				if err != nil {
+					rep.Failed[k] = err
+				} else {
+					rep.Fetched++
+					rep.FetchedBytes += uint64(len(b.Data))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, k := range missing {
+		todo <- k
+	}
+	close(todo)
+	wg.Wait()
+	return rep, ctx.Err()
+}
@@ -0,0 +1,91 @@
+package bstest
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+
+	blocks "github.com/ipfs/go-blocks"
+)
+
+// SizeDist draws the sizes of the blocks a Generator makes.
+type SizeDist interface {
+	// Size returns a block size, in bytes, drawn with |r|.
+	Size(r *rand.Rand) int
+}
+
+// FixedSize makes every block the same size.
+type FixedSize int
+
+func (n FixedSize) Size(*rand.Rand) int { return int(n) }
+
+// UniformSize draws sizes uniformly between Min and Max, inclusive.
+type UniformSize struct {
+	Min, Max int
+}
+
+func (u UniformSize) Size(r *rand.Rand) int {
+	if u.Max <= u.Min {
+		return u.Min
+	}
+	return u.Min + r.Intn(u.Max-u.Min+1)
+}
+
+// LogNormalSize draws sizes from a log-normal distribution around Median,
+// Sigma wide, capped at Max if it is positive: many small blocks and a few
+// large ones, as file chunks and directories make.
+type LogNormalSize struct {
+	Median int
+	Sigma  float64
+	Max    int
+}
+
+func (l LogNormalSize) Size(r *rand.Rand) int {
+	n := int(float64(l.Median) * math.Exp(l.Sigma*r.NormFloat64()))
+	if l.Max > 0 && n > l.Max {
+		n = l.Max
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Generator makes blocks of random data, sized by a SizeDist. The same seed
+// makes the same blocks, so that runs can be compared; no two blocks of a
+// Generator are the same. It is not safe for concurrent use.
+type Generator struct {
+	sizes SizeDist
+	r     *rand.Rand
+	seq   uint64
+}
+
+// NewGenerator returns a Generator of blocks sized by |sizes|, seeded with
+// |seed|.
+func NewGenerator(sizes SizeDist, seed int64) *Generator {
+	return &Generator{sizes: sizes, r: rand.New(rand.NewSource(seed))}
+}
+
+// Next returns a new block.
+func (g *Generator) Next() *blocks.Block {
+	data := make([]byte, g.sizes.Size(g.r))
+	g.r.Read(data)
+	// the sequence number keeps small blocks apart.
+	var seq [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(seq[:], g.seq)
+	g.seq++
+	if len(data) < n {
+		data = append(data, make([]byte, n-len(data))...)
+	}
+	copy(data, seq[:n])
+	return blocks.NewBlock(data)
+}
+
+// Blocks returns |n| new blocks.
+func (g *Generator) Blocks(n int) []*blocks.Block {
+	bs := make([]*blocks.Block, n)
+	for i := range bs {
+		bs[i] = g.Next()
+	}
+	return bs
+}
@@ -0,0 +1,80 @@
+package bstest
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+)
+
+// Report is how the operations of a Run went.
+type Report struct {
+	Workload string
+	// Duration is how long the operations took, preloading aside.
+	Duration      time.Duration
+	Reads, Writes OpStats
+}
+
+// OpStats sums up the reads or the writes of a Run.
+type OpStats struct {
+	Count  int
+	Errors int
+	// Bytes is the total size of the blocks read or written.
+	Bytes int64
+	// Latency percentiles of the operations, failed ones included.
+	P50, P90, P99, Max time.Duration
+}
+
+// Throughput is the operations the Run made a second.
+func (r *Report) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Reads.Count+r.Writes.Count) / r.Duration.Seconds()
+}
+
+func (r *Report) String() string {
+	s := fmt.Sprintf("%s: %d ops in %s, %.0f ops/s\n", r.Workload, r.Reads.Count+r.Writes.Count, r.Duration, r.Throughput())
+	for _, op := range []struct {
+		name string
+		st   OpStats
+	}{{"reads", r.Reads}, {"writes", r.Writes}} {
+		s += fmt.Sprintf("  %-6s %8d ops %6d errors %10d bytes  p50 %s p90 %s p99 %s max %s\n",
+			op.name, op.st.Count, op.st.Errors, op.st.Bytes, op.st.P50, op.st.P90, op.st.P99, op.st.Max)
+	}
+	return s
+}
+
+// opRecorder collects the latencies of operations of one kind.
+type opRecorder struct {
+	latencies []time.Duration
+	errors    int
+	bytes     int64
+}
+
+func (o *opRecorder) record(d time.Duration, b *blocks.Block, err error) {
+	o.latencies = append(o.latencies, d)
+	if err != nil {
+		o.errors++
+	} else if b != nil {
+		o.bytes += int64(len(b.Data))
+	}
+}
+
+func (o *opRecorder) merge(from *opRecorder) {
+	o.latencies = append(o.latencies, from.latencies...)
+	o.errors += from.errors
+	o.bytes += from.bytes
+}
+
+func (o *opRecorder) stats() OpStats {
+	st := OpStats{Count: len(o.latencies), Errors: o.errors, Bytes: o.bytes}
+	if st.Count == 0 {
+		return st
+	}
+	sort.Slice(o.latencies, func(i, j int) bool { return o.latencies[i] < o.latencies[j] })
+	at := func(p float64) time.Duration { return o.latencies[int(p*float64(st.Count-1))] }
+	st.P50, st.P90, st.P99, st.Max = at(0.5), at(0.9), at(0.99), o.latencies[st.Count-1]
+	return st
+}
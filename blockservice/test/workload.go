@@ -0,0 +1,138 @@
+package bstest
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Workload describes the operations Run makes.
+type Workload struct {
+	// Name labels the Report.
+	Name string
+	// ReadRatio is the share of the operations that are reads, between 0
+	// and 1; the others add new blocks.
+	ReadRatio float64
+	// Zipf, if above 1, makes reads pick the preloaded blocks with a
+	// zipfian popularity of that exponent, a few blocks getting most of
+	// them. Otherwise every block is as likely.
+	Zipf float64
+}
+
+// The usual workloads.
+var (
+	ReadHeavy  = Workload{Name: "read-heavy", ReadRatio: 0.95}
+	WriteHeavy = Workload{Name: "write-heavy", ReadRatio: 0.1}
+	Mixed      = Workload{Name: "mixed", ReadRatio: 0.5}
+	// Zipfian is ReadHeavy with a few hot blocks, as caches see.
+	Zipfian = Workload{Name: "zipfian", ReadRatio: 0.95, Zipf: 1.1}
+)
+
+// Config sizes a Run. The zero Config is a run of 10000 operations on 1000
+// preloaded blocks of 4KiB, one at a time.
+type Config struct {
+	// Preload is the number of blocks added before the run, which reads
+	// pick from.
+	Preload int
+	// Ops is the number of operations run.
+	Ops int
+	// Concurrency is the number of goroutines making them.
+	Concurrency int
+	// Sizes draws the size of the blocks added.
+	Sizes SizeDist
+	// Seed seeds the blocks and operations, so that runs with the same
+	// seed make the same ones, if not in the same order when concurrent.
+	Seed int64
+}
+
+func (c Config) withDefaults() Config {
+	if c.Preload <= 0 {
+		c.Preload = 1000
+	}
+	if c.Ops <= 0 {
+		c.Ops = 10000
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.Sizes == nil {
+		c.Sizes = FixedSize(4096)
+	}
+	return c
+}
+
+// Run adds the preloaded blocks to |s|, then runs the operations of |w| on
+// it as |c| says, and reports how they went. The preloading is not
+// measured. If |ctx| is done first, the report of the operations run so far
+// is returned with its error.
+func Run(ctx context.Context, s blockservice.Service, w Workload, c Config) (*Report, error) {
+	c = c.withDefaults()
+	gen := NewGenerator(c.Sizes, c.Seed)
+	ks := make([]key.Key, c.Preload)
+	for i := range ks {
+		k, err := s.AddBlockCtx(ctx, gen.Next())
+		if err != nil {
+			return nil, err
+		}
+		ks[i] = k
+	}
+
+	var genMu sync.Mutex
+	next := func() *blocks.Block {
+		genMu.Lock()
+		defer genMu.Unlock()
+		return gen.Next()
+	}
+	var issued int64
+	recs := make([]recorder, c.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range recs {
+		wg.Add(1)
+		go func(rec *recorder, seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			pick := func() key.Key { return ks[r.Intn(len(ks))] }
+			if w.Zipf > 1 {
+				z := rand.NewZipf(r, w.Zipf, 1, uint64(len(ks)-1))
+				pick = func() key.Key { return ks[z.Uint64()] }
+			}
+			for atomic.AddInt64(&issued, 1) <= int64(c.Ops) && ctx.Err() == nil {
+				if r.Float64() < w.ReadRatio {
+					k := pick()
+					t := time.Now()
+					b, err := s.GetBlock(ctx, k)
+					rec.reads.record(time.Since(t), b, err)
+				} else {
+					b := next()
+					t := time.Now()
+					_, err := s.AddBlockCtx(ctx, b)
+					rec.writes.record(time.Since(t), b, err)
+				}
+			}
+		}(&recs[i], c.Seed+1+int64(i))
+	}
+	wg.Wait()
+
+	rep := &Report{Workload: w.Name, Duration: time.Since(start)}
+	var reads, writes opRecorder
+	for _, rec := range recs {
+		reads.merge(&rec.reads)
+		writes.merge(&rec.writes)
+	}
+	rep.Reads = reads.stats()
+	rep.Writes = writes.stats()
+	return rep, ctx.Err()
+}
+
+// recorder records the operations of one of Run's goroutines.
+type recorder struct {
+	reads, writes opRecorder
+}
@@ -0,0 +1,73 @@
+package bstest
+
+import (
+	"strings"
+	"testing"
+
+	blockservice "github.com/ipfs/go-blocks/blockservice"
+	offline "github.com/ipfs/go-blocks/blockservice/exchange/offline"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestGeneratorIsReproducible(t *testing.T) {
+	sizes := LogNormalSize{Median: 1024, Sigma: 1, Max: 8192}
+	a := NewGenerator(sizes, 7).Blocks(50)
+	b := NewGenerator(sizes, 7).Blocks(50)
+	seen := make(map[string]bool)
+	for i := range a {
+		if a[i].Key() != b[i].Key() {
+			t.Fatalf("block %d differs between generators of the same seed", i)
+		}
+		if n := len(a[i].Data); n < 1 || n > 8192 {
+			t.Fatalf("block %d of %d bytes out of bounds", i, n)
+		}
+		if seen[string(a[i].Key())] {
+			t.Fatalf("block %d generated twice", i)
+		}
+		seen[string(a[i].Key())] = true
+	}
+	for _, blk := range NewGenerator(FixedSize(1), 1).Blocks(300) {
+		if seen[string(blk.Key())] {
+			t.Fatal("small blocks generated twice")
+		}
+		seen[string(blk.Key())] = true
+	}
+}
+
+func TestRun(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	s, err := blockservice.New(bstore, offline.Exchange(bstore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, w := range []Workload{ReadHeavy, WriteHeavy, Mixed, Zipfian} {
+		rep, err := Run(context.Background(), s, w, Config{Preload: 20, Ops: 200, Concurrency: 4, Sizes: UniformSize{Min: 16, Max: 256}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := rep.Reads.Count + rep.Writes.Count; n != 200 {
+			t.Fatalf("%s: expected 200 operations, got %d", w.Name, n)
+		}
+		if rep.Reads.Errors != 0 || rep.Writes.Errors != 0 {
+			t.Fatalf("%s: unexpected errors: %s", w.Name, rep)
+		}
+		if rep.Reads.Max < rep.Reads.P50 || rep.Throughput() <= 0 {
+			t.Fatalf("%s: inconsistent report: %s", w.Name, rep)
+		}
+		if !strings.HasPrefix(rep.String(), w.Name+":") {
+			t.Fatalf("unexpected report %q", rep)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Run(ctx, s, Mixed, Config{Preload: 1}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
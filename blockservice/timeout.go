@@ -0,0 +1,42 @@
+package blockservice
+
+import (
+	"errors"
+	"time"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrTimeout is returned by reads whose exchange fetch was cut short by the
+// timeout of WithFetchTimeout, rather than found missing.
+var ErrTimeout = errors.New("blockservice: fetch timed out")
+
+// WithFetchTimeout bounds each exchange fetch of a read whose context has no
+// deadline to |d|, so that reads of content no peer has end with ErrTimeout
+// rather than waiting forever. A deadline of the caller's own takes its
+// place, and ends reads with the context's error as before. Retries happen
+// within the timeout. The default, zero, is no timeout.
+func WithFetchTimeout(d time.Duration) Option {
+	return func(o *options) { o.fetchTimeout = d }
+}
+
+// withFetchTimeout returns |ctx| bounded by the fetch timeout, if there is
+// one and |ctx| has no deadline.
+func (s *BlockService) withFetchTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.fetchTimeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.fetchTimeout)
+}
+
+// timedOut returns ErrTimeout in place of |err| if the fetch timeout ended
+// |fctx|, made from |ctx| by withFetchTimeout, and |err| otherwise.
+func timedOut(ctx, fctx context.Context, err error) error {
+	if err != nil && fctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return ErrTimeout
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package blockservice
+
+import (
+	"errors"
+
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Tracer starts the spans of a distributed trace, for export to a tracing
+// system such as OpenTracing; see the opentracing package for an adapter.
+// Implementations must be safe for concurrent use.
+//
+// The service traces each GetBlock and GetBlocks call, with the blockstore
+// reads ("blockstore.Get") and exchange fetches ("exchange.GetBlock",
+// "exchange.GetBlocks") it makes as children, and each announcement the
+// workers make ("exchange.HasBlock"). Spans are children of the span
+// carried by the caller's context; announcements of blocks added without a
+// context, or by several callers at once, start new traces.
+type Tracer interface {
+	// StartSpan starts a span named |operation| as a child of any span in
+	// |ctx|, and returns a context carrying it to the calls it makes.
+	StartSpan(ctx context.Context, operation string) (context.Context, Span)
+}
+
+// Span is a traced operation, as started by Tracer.StartSpan.
+type Span interface {
+	SetTag(key string, value interface{})
+	// Finish ends the span, marking it failed with |err| if it is not nil.
+	Finish(err error)
+}
+
+// WithTracer makes the service trace its reads and announcements with |t|.
+// By default nothing is traced.
+func WithTracer(t Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+		o.worker.StartSpan = func(ctx context.Context, operation string) (context.Context, func(error)) {
+			ctx, span := t.StartSpan(ctx, operation)
+			return ctx, span.Finish
+		}
+	}
+}
+
+// startSpan starts a span with the service's tracer, if it has one.
+func (s *BlockService) startSpan(ctx context.Context, operation string) (context.Context, Span) {
+	if s.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return s.tracer.StartSpan(ctx, operation)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetTag(string, interface{}) {}
+func (noopSpan) Finish(error)               {}
+
+// finishLocal ends a blockstore read span. A miss is tagged, not failed.
+func finishLocal(span Span, err error) {
+	span.SetTag("found", err == nil)
+	if errors.Is(err, blockstore.ErrNotFound) {
+		err = nil
+	}
+	span.Finish(err)
+}
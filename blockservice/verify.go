@@ -0,0 +1,98 @@
+package blockservice
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// BlockVerifier checks a block |b| received from the exchange in answer to
+// a request for |k|. A non-nil error rejects the block: GetBlock returns the
+// error, and GetBlocks drops the block as if the exchange had not found it.
+type BlockVerifier func(k key.Key, b *blocks.Block) error
+
+// VerifyHash is the default BlockVerifier. It rejects blocks whose key is
+// not the one requested, or whose data does not hash to it, with
+// blockstore.ErrHashMismatch.
+func VerifyHash(k key.Key, b *blocks.Block) error {
+	if b.Key() != k {
+		return blockstore.ErrHashMismatch
+	}
+	return blockstore.Verify(k, b.Data)
+}
+
+// VerifyMode says whether the blocks a BlockService reads locally are
+// re-hashed as they are read.
+type VerifyMode int
+
+const (
+	// TrustLocal returns local blocks as stored, trusting the blockstore
+	// to have kept them intact. It is the default, and the fast mode.
+	TrustLocal VerifyMode = iota
+	// VerifyLocal re-hashes every block read locally, and treats one whose
+	// data does not match its key as missing, counting it in
+	// Stats.Rejected: GetBlock and GetBlocks fetch it from the exchange
+	// instead. Blocks from the exchange are hashed too, even with a
+	// BlockVerifier that would trust them. It is the paranoid mode.
+	VerifyLocal
+)
+
+// WithVerifyMode sets whether local reads are verified; see VerifyMode.
+// SetCorruptionRepair verifies them as well, and removes the corrupt ones.
+func WithVerifyMode(m VerifyMode) Option {
+	return func(o *options) { o.verifyMode = m }
+}
+
+func (m VerifyMode) validate() error {
+	if m != TrustLocal && m != VerifyLocal {
+		return fmt.Errorf("blockservice: unknown verify mode %d", m)
+	}
+	return nil
+}
+
+// rejectLocal reports whether |b|, read locally, is to be treated as
+// missing: in VerifyLocal mode, if its data does not match its key.
+func (s *BlockService) rejectLocal(b *blocks.Block) bool {
+	if s.verifyMode != VerifyLocal || !errors.Is(blockstore.Verify(b.Key(), b.Data), blockstore.ErrHashMismatch) {
+		return false
+	}
+	atomic.AddUint64(&s.stats.rejected, 1)
+	return true
+}
+
+// TrustExchange is a BlockVerifier accepting every block, for exchanges
+// that verify blocks themselves.
+func TrustExchange(key.Key, *blocks.Block) error { return nil }
+
+// SetBlockVerifier sets the check applied to blocks received from the
+// exchange. A nil verifier restores the default, VerifyHash. It must be set
+// before the service is used.
+func (s *BlockService) SetBlockVerifier(v BlockVerifier) {
+	if v == nil {
+		v = VerifyHash
+	}
+	s.verify = v
+}
+
+// verifyRemote applies the verifier to |b|, fetched for |k|, counting it in
+// Stats.Rejected if it fails, and publishing EventFetched if it passes.
+func (s *BlockService) verifyRemote(k key.Key, b *blocks.Block) error {
+	var err error
+	if s.verifyMode == VerifyLocal {
+		err = VerifyHash(k, b)
+	}
+	if err == nil {
+		err = s.verify(k, b)
+	}
+	if err != nil {
+		atomic.AddUint64(&s.stats.rejected, 1)
+		s.log(LevelWarn, "blockservice rejected a block from the exchange", Field{"key", k}, Field{"error", err})
+	} else {
+		s.publish(EventFetched, k)
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package blockservice
+
+import (
+	"sort"
+	"sync"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Wantlist returns the keys the service is waiting on from the exchange:
+// those it has asked for, for any read or prefetch, and not received yet.
+// Keys of a GetBlocks request limited by WithMaxOutstandingWants count from
+// the start of the request, batches not yet sent included. The keys are
+// sorted. It is meant for debugging fetches that hang.
+func (s *BlockService) Wantlist() []key.Key {
+	return s.wantlist.keys()
+}
+
+// TrackWants returns a copy of |ctx| whose reads' wants are tracked, so that
+// WantlistForContext can report them. Reads with a context derived from it
+// count too, as do those of the BlockServices it is given to.
+func TrackWants(ctx context.Context) context.Context {
+	return withWantlist(ctx, newWantlist())
+}
+
+// WantlistForContext is Wantlist, restricted to the reads made with |ctx|, or
+// a context derived from it, since it was returned by TrackWants. It is nil
+// for a context TrackWants did not make.
+func (s *BlockService) WantlistForContext(ctx context.Context) []key.Key {
+	sc, _ := ctx.Value(wantScopeKey{}).(*wantScope)
+	if sc == nil {
+		return nil
+	}
+	return sc.w.keys()
+}
+
+// Wantlist is BlockService.Wantlist, restricted to the session's reads.
+func (ss *Session) Wantlist() []key.Key {
+	return ss.wants.keys()
+}
+
+// wantlist counts the keys waited on, as several reads may want one.
+type wantlist struct {
+	mu     sync.Mutex
+	counts map[key.Key]int
+}
+
+func newWantlist() *wantlist {
+	return &wantlist{counts: make(map[key.Key]int)}
+}
+
+func (w *wantlist) add(ks []key.Key) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, k := range ks {
+		w.counts[k]++
+	}
+}
+
+func (w *wantlist) remove(k key.Key, n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.counts[k] -= n; w.counts[k] <= 0 {
+		delete(w.counts, k)
+	}
+}
+
+func (w *wantlist) keys() []key.Key {
+	w.mu.Lock()
+	ks := make(key.KeySlice, 0, len(w.counts))
+	for k := range w.counts {
+		ks = append(ks, k)
+	}
+	w.mu.Unlock()
+	sort.Sort(ks)
+	return ks
+}
+
+// wantScope is a wantlist a context's reads are tracked in, on top of those
+// of its parents.
+type wantScope struct {
+	w      *wantlist
+	parent *wantScope
+}
+
+type wantScopeKey struct{}
+
+func withWantlist(ctx context.Context, w *wantlist) context.Context {
+	parent, _ := ctx.Value(wantScopeKey{}).(*wantScope)
+	return context.WithValue(ctx, wantScopeKey{}, &wantScope{w: w, parent: parent})
+}
+
+// wanting tracks the keys of one exchange request until they are received
+// or the request ends. It is used by one goroutine.
+type wanting struct {
+	lists   []*wantlist
+	pending map[key.Key]int
+}
+
+// want records |ks| as waited on, by the service and by the wantlists of
+// |ctx|.
+func (s *BlockService) want(ctx context.Context, ks []key.Key) *wanting {
+	w := &wanting{lists: []*wantlist{s.wantlist}, pending: make(map[key.Key]int, len(ks))}
+	for sc, _ := ctx.Value(wantScopeKey{}).(*wantScope); sc != nil; sc = sc.parent {
+		w.lists = append(w.lists, sc.w)
+	}
+	for _, l := range w.lists {
+		l.add(ks)
+	}
+	for _, k := range ks {
+		w.pending[k]++
+	}
+	return w
+}
+
+// got records |k| as received.
+func (w *wanting) got(k key.Key) {
+	n, ok := w.pending[k]
+	if !ok {
+		return
+	}
+	delete(w.pending, k)
+	for _, l := range w.lists {
+		l.remove(k, n)
+	}
+}
+
+// done ends the wants of the keys not received.
+func (w *wanting) done() {
+	for k := range w.pending {
+		w.got(k)
+	}
+}
@@ -0,0 +1,36 @@
+package blockservice
+
+import (
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Warmup prepares the blockstore to serve |ks| quickly, as blockstore.Warmup
+// does, for a service starting cold: its caches, if it has any, are filled
+// with them, and the blocks read once otherwise. The keys may come from a
+// manifest saved by the previous run; see blockstore.ReadManifest and
+// WarmupTopReads. It returns how many of |ks| are stored. Nothing is asked
+// of the exchange.
+func (s *BlockService) Warmup(ctx context.Context, ks []key.Key) (int, error) {
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+	return blockstore.Warmup(ctx, s.Blockstore, ks)
+}
+
+// WarmupTopReads is Warmup of the |n| most read blocks, most read last, so
+// that they are the last evicted from the caches. It returns
+// ErrNotSupported unless access counting is enabled; see TopReads.
+func (s *BlockService) WarmupTopReads(ctx context.Context, n int) (int, error) {
+	top, err := s.TopReads(ctx, n)
+	if err != nil {
+		return 0, err
+	}
+	ks := make([]key.Key, len(top))
+	for i, info := range top {
+		ks[len(top)-1-i] = info.Key
+	}
+	return s.Warmup(ctx, ks)
+}
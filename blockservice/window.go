@@ -0,0 +1,161 @@
+package blockservice
+
+import (
+	"sync"
+	"time"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// maxWantWindow bounds the window of MissesAdaptive.
+const maxWantWindow = 1024
+
+// wantWindow passes keys on to |want| as a window of open wants has room
+// for them, for MissesAdaptive. A want is open from when it is passed on
+// until the caller takes its block, or the exchange stream asked for it
+// ends without it. The window grows by one each time the caller takes a
+// block at once, being faster than the exchange, and shrinks, when the
+// caller is slower, to what it takes over the time the exchange takes to
+// send a block.
+type wantWindow struct {
+	want func([]key.Key)
+	// wake is signalled when wants close.
+	wake chan struct{}
+
+	mu    sync.Mutex
+	size  int
+	queue []key.Key
+	open  map[key.Key]*openWant
+	// latency is the running average of the time the exchange takes to send
+	// a block once asked, and pace that of the interval between the blocks
+	// a caller slower than the exchange takes.
+	latency, pace time.Duration
+	lastTaken     time.Time
+}
+
+type openWant struct {
+	asked    time.Time
+	received bool
+}
+
+func newWantWindow(size int, want func([]key.Key)) *wantWindow {
+	if size < 1 {
+		size = 1
+	}
+	return &wantWindow{
+		want: want,
+		wake: make(chan struct{}, 1),
+		size: size,
+		open: make(map[key.Key]*openWant),
+	}
+}
+
+// average folds |sample| into the running average |avg|.
+func average(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return (7*avg + sample) / 8
+}
+
+func (w *wantWindow) add(ks []key.Key) {
+	w.mu.Lock()
+	w.queue = append(w.queue, ks...)
+	w.mu.Unlock()
+	w.release()
+}
+
+// release passes on as many queued keys as the window has room for.
+func (w *wantWindow) release() {
+	w.mu.Lock()
+	n := w.size - len(w.open)
+	if n > len(w.queue) {
+		n = len(w.queue)
+	}
+	if n <= 0 {
+		w.mu.Unlock()
+		return
+	}
+	batch := append([]key.Key(nil), w.queue[:n]...)
+	w.queue = w.queue[n:]
+	now := time.Now()
+	for _, k := range batch {
+		w.open[k] = &openWant{asked: now}
+	}
+	w.mu.Unlock()
+	w.want(batch)
+}
+
+// flush passes on the rest of the queue as the window opens, or until |ctx|
+// is done.
+func (w *wantWindow) flush(ctx context.Context) {
+	for {
+		w.release()
+		w.mu.Lock()
+		left := len(w.queue)
+		w.mu.Unlock()
+		if left == 0 {
+			return
+		}
+		select {
+		case <-w.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *wantWindow) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// received notes that the exchange sent the block |k|.
+func (w *wantWindow) received(k key.Key) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if o, ok := w.open[k]; ok && !o.received {
+		o.received = true
+		w.latency = average(w.latency, time.Since(o.asked))
+	}
+}
+
+// taken notes that the caller took the block |k|, having kept it |waiting|
+// if it was not ready for it.
+func (w *wantWindow) taken(k key.Key, waiting bool) {
+	w.mu.Lock()
+	delete(w.open, k)
+	now := time.Now()
+	if !waiting {
+		if w.size < maxWantWindow {
+			w.size++
+		}
+	} else if !w.lastTaken.IsZero() {
+		w.pace = average(w.pace, now.Sub(w.lastTaken))
+		if w.pace > 0 {
+			if n := int(w.latency/w.pace) + 1; n < w.size {
+				w.size = n
+			}
+		}
+	}
+	w.lastTaken = now
+	w.mu.Unlock()
+	w.signal()
+}
+
+// ended closes the wants for |ks| the exchange did not send, their stream
+// having ended.
+func (w *wantWindow) ended(ks []key.Key) {
+	w.mu.Lock()
+	for _, k := range ks {
+		if o, ok := w.open[k]; ok && !o.received {
+			delete(w.open, k)
+		}
+	}
+	w.mu.Unlock()
+	w.signal()
+}
@@ -0,0 +1,181 @@
+package worker
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	process "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/goprocess"
+)
+
+// The defaults of an Adaptive Config.
+const (
+	DefaultScaleInterval = time.Second
+	DefaultTargetLatency = 100 * time.Millisecond
+	// defaultMaxWorkersPerProc is MaxWorkers by default, per GOMAXPROCS.
+	defaultMaxWorkersPerProc = 64
+)
+
+// adaptiveDefaults fills in the Adaptive settings of |c| left unset, and puts
+// NumWorkers within the bounds.
+func adaptiveDefaults(c *Config) {
+	procs := runtime.GOMAXPROCS(0)
+	if c.MinWorkers < 1 {
+		c.MinWorkers = procs
+	}
+	if c.MaxWorkers < 1 {
+		c.MaxWorkers = defaultMaxWorkersPerProc * procs
+	}
+	if c.MaxWorkers < c.MinWorkers {
+		c.MaxWorkers = c.MinWorkers
+	}
+	if c.ScaleInterval <= 0 {
+		c.ScaleInterval = DefaultScaleInterval
+	}
+	if c.TargetLatency <= 0 {
+		c.TargetLatency = DefaultTargetLatency
+	}
+	if c.NumWorkers < c.MinWorkers {
+		c.NumWorkers = c.MinWorkers
+	}
+	if c.NumWorkers > c.MaxWorkers {
+		c.NumWorkers = c.MaxWorkers
+	}
+}
+
+// slots limits the announcements that run at once to a limit that can
+// change. It is acquired by the one goroutine that starts them. It also
+// accounts for the workers' capacity over time, for Stats.Utilization.
+type slots struct {
+	wake chan struct{} // signalled as slots free up or the limit grows
+
+	mu     sync.Mutex
+	limit  int
+	active int
+	// capacity is the worker time there was up to |since|, in nanoseconds.
+	capacity time.Duration
+	since    time.Time
+}
+
+func newSlots(limit int, now time.Time) *slots {
+	return &slots{wake: make(chan struct{}, 1), limit: limit, since: now}
+}
+
+// acquire takes a slot, waiting for one until |proc| is closing, in which
+// case it returns false.
+func (s *slots) acquire(proc process.Process) bool {
+	for {
+		s.mu.Lock()
+		if s.active < s.limit {
+			s.active++
+			s.mu.Unlock()
+			return true
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.wake:
+		case <-proc.Closing():
+			return false
+		}
+	}
+}
+
+func (s *slots) release() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *slots) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setLimit changes the limit at |now|. Announcements over a lowered limit
+// run to completion; no more start until they fit.
+func (s *slots) setLimit(n int, now time.Time) {
+	s.mu.Lock()
+	s.capacity += time.Duration(s.limit) * now.Sub(s.since)
+	s.since = now
+	s.limit = n
+	s.mu.Unlock()
+	s.signal()
+}
+
+// state returns the limit, the slots in use, and the capacity up to |now|.
+func (s *slots) state(now time.Time) (limit, active int, capacity time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit, s.active, s.capacity + time.Duration(s.limit)*now.Sub(s.since)
+}
+
+// scaler resizes the slots of an Adaptive worker once per interval, from
+// how long the blocks started in it waited for a worker.
+type scaler struct {
+	min, max int
+	target   time.Duration
+	// step is how many workers are added at a time: GOMAXPROCS.
+	step int
+
+	// waited and started are the total wait, in nanoseconds, and number of
+	// the announcements started since the last resize.
+	waited  int64
+	started int64
+}
+
+// observe records an announcement that started after waiting |d| for a
+// worker.
+func (sc *scaler) observe(d time.Duration) {
+	atomic.AddInt64(&sc.waited, int64(d))
+	atomic.AddInt64(&sc.started, 1)
+}
+
+// next returns the worker count to use after an interval at |limit|, with
+// |active| of them busy and |queued| blocks waiting for one: more if the
+// blocks started waited longer than the target on average, or if none
+// started while blocks waited and every worker was busy; fewer, by half
+// those idle, if nothing waits.
+func (sc *scaler) next(limit, active, queued int) int {
+	waited := time.Duration(atomic.SwapInt64(&sc.waited, 0))
+	started := atomic.SwapInt64(&sc.started, 0)
+	n := limit
+	switch {
+	case started > 0 && waited/time.Duration(started) > sc.target,
+		started == 0 && queued > 0 && active >= limit:
+		n += sc.step
+	case queued == 0 && active < limit:
+		idle := limit - active
+		n -= (idle + 1) / 2
+	}
+	if n > sc.max {
+		n = sc.max
+	}
+	if n < sc.min {
+		n = sc.min
+	}
+	return n
+}
+
+// runScaler resizes the worker's slots every |interval| until |proc| closes.
+func (w *Worker) runScaler(proc process.Process, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			limit, _, _ := w.slots.state(now)
+			// not the slots in use: one is held while waiting for a block.
+			active := int(atomic.LoadInt64(&w.stats.inFlight))
+			queued := int(atomic.LoadInt64(&w.stats.queued)) + len(w.added) + len(w.toWorkers)
+			if n := w.scaler.next(limit, active, queued); n != limit {
+				w.slots.setLimit(n, now)
+			}
+		case <-proc.Closing():
+			return
+		}
+	}
+}
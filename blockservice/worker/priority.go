@@ -0,0 +1,86 @@
+package worker
+
+import (
+	blocks "github.com/ipfs/go-blocks"
+)
+
+// Priority orders the announcement of queued blocks: blocks queued with a
+// higher priority are handed to a worker first, and those of a priority in
+// the order they were queued. It only orders the queue, so a block queued
+// at PriorityHigh still waits for a free worker.
+type Priority int
+
+const (
+	// PriorityLow is for bulk work, such as the leaves of a large import.
+	PriorityLow Priority = iota - 1
+	// PriorityNormal is what HasBlock and the others queue blocks with.
+	PriorityNormal
+	// PriorityHigh is for blocks a user waits on, such as the root of a DAG
+	// being published.
+	PriorityHigh
+)
+
+// lane is the index of |p|'s lane in a laneQueue. Priorities outside the
+// defined ones go in the nearest lane.
+func (p Priority) lane() int {
+	switch {
+	case p < PriorityLow:
+		p = PriorityLow
+	case p > PriorityHigh:
+		p = PriorityHigh
+	}
+	return int(p - PriorityLow)
+}
+
+// prioritized is a block on its way to the queue.
+type prioritized struct {
+	b    *blocks.Block
+	prio Priority
+}
+
+// laneQueue is a queue of blocks with a BlockList per priority. A key is
+// queued once, in the highest lane it was pushed to.
+type laneQueue struct {
+	lanes [PriorityHigh - PriorityLow + 1]BlockList
+}
+
+// Push queues |b| at the back of its lane, moving it up from a lower lane
+// it is queued in.
+func (q *laneQueue) Push(b *blocks.Block, p Priority) {
+	l := p.lane()
+	for i := range q.lanes {
+		if !q.lanes[i].Has(b.Key()) {
+			continue
+		}
+		if i >= l {
+			return
+		}
+		q.lanes[i].Remove(b.Key())
+	}
+	q.lanes[l].Push(b)
+}
+
+// PushFront puts back |b|, just popped with priority |p|, at the front of
+// its lane.
+func (q *laneQueue) PushFront(b *blocks.Block, p Priority) {
+	q.lanes[p.lane()].PushFront(b)
+}
+
+// Pop takes the first block of the highest lane with one, returning nil if
+// all are empty.
+func (q *laneQueue) Pop() (*blocks.Block, Priority) {
+	for i := len(q.lanes) - 1; i >= 0; i-- {
+		if b := q.lanes[i].Pop(); b != nil {
+			return b, PriorityLow + Priority(i)
+		}
+	}
+	return nil, PriorityNormal
+}
+
+func (q *laneQueue) Len() int {
+	n := 0
+	for i := range q.lanes {
+		n += q.lanes[i].Len()
+	}
+	return n
+}
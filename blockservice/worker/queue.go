@@ -0,0 +1,58 @@
+package worker
+
+import (
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+)
+
+// queueStore mirrors the blocks accepted by HasBlock and not yet provided
+// into |store|, keyed like the retry queue, so that a worker created with
+// the same store queues them again. It does nothing if |store| is nil.
+// Store errors are ignored, as for the retry queue.
+type queueStore struct {
+	store ds.Datastore
+}
+
+func (q queueStore) Add(b *blocks.Block) {
+	if q.store != nil {
+		q.store.Put(retryKey(b.Key()), b.Data)
+	}
+}
+
+func (q queueStore) Remove(k key.Key) {
+	if q.store != nil {
+		q.store.Delete(retryKey(k))
+	}
+}
+
+// Load returns the blocks left in the store by an earlier worker.
+func (q queueStore) Load() []*blocks.Block {
+	if q.store == nil {
+		return nil
+	}
+	res, err := q.store.Query(dsq.Query{})
+	if err != nil {
+		return nil
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil
+	}
+	var bs []*blocks.Block
+	for _, e := range entries {
+		data, ok := e.Value.([]byte)
+		if !ok {
+			continue
+		}
+		k := key.B58KeyDecode(ds.NewKey(e.Key).BaseNamespace())
+		b, err := blocks.NewBlockWithKey(data, k)
+		if err != nil {
+			continue
+		}
+		bs = append(bs, b)
+	}
+	return bs
+}
@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"sync"
+	"time"
+
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// recentSet remembers the keys provided in the last window, so that blocks
+// announced again soon after, as imports rewriting existing content do, are
+// not announced twice. See Config.DedupWindow.
+type recentSet struct {
+	window time.Duration
+
+	mu sync.Mutex
+	at map[key.Key]time.Time
+	// order holds the keys in the order they were provided, oldest first,
+	// to expire them; a key provided again is in it more than once.
+	order []recentEntry
+}
+
+type recentEntry struct {
+	key key.Key
+	at  time.Time
+}
+
+func newRecentSet(window time.Duration) *recentSet {
+	return &recentSet{window: window, at: make(map[key.Key]time.Time)}
+}
+
+// Add records that |k| was provided at |now|.
+func (r *recentSet) Add(k key.Key, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(now)
+	r.at[k] = now
+	r.order = append(r.order, recentEntry{k, now})
+}
+
+// Seen reports whether |k| was provided within the window before |now|.
+func (r *recentSet) Seen(k key.Key, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(now)
+	_, ok := r.at[k]
+	return ok
+}
+
+// expire forgets the keys provided before the window.
+func (r *recentSet) expire(now time.Time) {
+	cutoff := now.Add(-r.window)
+	n := 0
+	for ; n < len(r.order) && !r.order[n].at.After(cutoff); n++ {
+		e := r.order[n]
+		if r.at[e.key].Equal(e.at) {
+			delete(r.at, e.key)
+		}
+	}
+	r.order = r.order[n:]
+}
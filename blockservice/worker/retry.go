@@ -0,0 +1,210 @@
+package worker
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	blockstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+)
+
+// DefaultMaxRetries and DefaultMaxRetryQueue are the Config.MaxRetries and
+// Config.MaxRetryQueue used when none are set.
+const (
+	DefaultMaxRetries    = 10
+	DefaultMaxRetryQueue = 4096
+)
+
+// retryQueue holds blocks whose provide failed, each with the time of its
+// next attempt. The delay between attempts doubles, from |backoff| up to
+// |maxBackoff|. A block is retried at most |maxRetries| times, and at most
+// |maxLen| blocks are queued.
+//
+// If |store| is set, queued blocks are mirrored into it with their hints,
+// keyed by their b58 encoded key, and the queue is reloaded from it when
+// created, their retries counted anew. Store errors are ignored; the
+// in-memory queue is authoritative while running.
+type retryQueue struct {
+	backoff    time.Duration
+	maxBackoff time.Duration
+	maxRetries int
+	maxLen     int
+	store      ds.Datastore
+
+	mu      sync.Mutex
+	entries map[key.Key]*retryEntry
+}
+
+type retryEntry struct {
+	block *blocks.Block
+	hints []string
+	// accepted is when the worker accepted the block, or reloaded it from
+	// the store.
+	accepted time.Time
+	delay    time.Duration
+	next     time.Time
+	retries  int
+}
+
+func newRetryQueue(backoff, maxBackoff time.Duration, maxRetries, maxLen int, store ds.Datastore) *retryQueue {
+	q := &retryQueue{
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		maxRetries: maxRetries,
+		maxLen:     maxLen,
+		store:      store,
+		entries:    make(map[key.Key]*retryEntry),
+	}
+	q.load(time.Now())
+	return q
+}
+
+func (q *retryQueue) load(now time.Time) {
+	if q.store == nil {
+		return
+	}
+	res, err := q.store.Query(dsq.Query{})
+	if err != nil {
+		return
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if len(q.entries) >= q.maxLen {
+			return
+		}
+		data, ok := e.Value.([]byte)
+		if !ok {
+			continue
+		}
+		k := key.B58KeyDecode(ds.NewKey(e.Key).BaseNamespace())
+		b, hints, err := decodeRetry(k, data)
+		if err != nil {
+			continue
+		}
+		q.entries[k] = &retryEntry{block: b, hints: hints, accepted: now, delay: q.backoff, next: now}
+	}
+}
+
+func retryKey(k key.Key) ds.Key {
+	return ds.NewKey(k.B58String())
+}
+
+var errRetryEncoding = errors.New("worker: malformed retry entry")
+
+// encodeRetry encodes |b| and its |hints| for the store: the number of
+// hints, each hint prefixed with its length, as uvarints, then the data.
+func encodeRetry(b *blocks.Block, hints []string) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(b.Data))
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(hints)))]...)
+	for _, h := range hints {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(h)))]...)
+		buf = append(buf, h...)
+	}
+	return append(buf, b.Data...)
+}
+
+// decodeRetry decodes a block stored as |k| by encodeRetry, failing if its
+// data does not hash to |k|.
+func decodeRetry(k key.Key, v []byte) (*blocks.Block, []string, error) {
+	n, sz := binary.Uvarint(v)
+	if sz <= 0 || n > uint64(len(v)) {
+		return nil, nil, errRetryEncoding
+	}
+	v = v[sz:]
+	var hints []string
+	for i := uint64(0); i < n; i++ {
+		l, sz := binary.Uvarint(v)
+		if sz <= 0 || l > uint64(len(v)-sz) {
+			return nil, nil, errRetryEncoding
+		}
+		hints = append(hints, string(v[sz:sz+int(l)]))
+		v = v[sz+int(l):]
+	}
+	if err := blockstore.Verify(k, v); err != nil {
+		return nil, nil, err
+	}
+	b, err := blocks.NewBlockWithKey(v, k)
+	return b, hints, err
+}
+
+// Add queues |b|, which the worker accepted at |accepted|, for a retry,
+// unless it is queued already. It returns false, leaving |b| out, if the
+// queue is full.
+func (q *retryQueue) Add(b *blocks.Block, hints []string, accepted, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.entries[b.Key()]; ok {
+		return true
+	}
+	if len(q.entries) >= q.maxLen {
+		return false
+	}
+	q.entries[b.Key()] = &retryEntry{block: b, hints: hints, accepted: accepted, delay: q.backoff, next: now.Add(q.backoff)}
+	if q.store != nil {
+		q.store.Put(retryKey(b.Key()), encodeRetry(b, hints))
+	}
+	return true
+}
+
+// RetryDue calls |provide| for each block due for a retry by |now|. Blocks
+// provided successfully leave the queue, as do those out of retries, which
+// it returns the number of; the others are rescheduled.
+func (q *retryQueue) RetryDue(now time.Time, provide func(b *blocks.Block, hints []string, accepted time.Time) error) (dropped int) {
+	q.mu.Lock()
+	var due []*retryEntry
+	for _, e := range q.entries {
+		if !e.next.After(now) {
+			due = append(due, e)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, e := range due {
+		err := provide(e.block, e.hints, e.accepted)
+
+		q.mu.Lock()
+		e.retries++
+		switch {
+		case err == nil || e.retries >= q.maxRetries:
+			if err != nil {
+				dropped++
+			}
+			delete(q.entries, e.block.Key())
+			if q.store != nil {
+				q.store.Delete(retryKey(e.block.Key()))
+			}
+		default:
+			e.delay *= 2
+			if e.delay > q.maxBackoff {
+				e.delay = q.maxBackoff
+			}
+			e.next = now.Add(e.delay)
+		}
+		q.mu.Unlock()
+	}
+	return dropped
+}
+
+// Has reports whether |k| is queued for a retry.
+func (q *retryQueue) Has(k key.Key) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.entries[k]
+	return ok
+}
+
+func (q *retryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
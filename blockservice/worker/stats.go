@@ -0,0 +1,89 @@
+package worker
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSlowThreshold is the Config.SlowThreshold used when none is set.
+const DefaultSlowThreshold = 10 * time.Second
+
+// Stats is a point-in-time snapshot of the worker's announcements. Counters
+// are cumulative over the life of the worker.
+type Stats struct {
+	// QueueDepth is the number of blocks accepted by HasBlock that are
+	// waiting for a free worker.
+	QueueDepth int
+	// InFlight is the number of announcements in progress, and Workers the
+	// number that may be, which changes over time if Config.Adaptive is set.
+	InFlight int
+	Workers  int
+
+	// Provided and Failed count finished announcements, retries included.
+	// Dropped counts the failures that will not be retried, because retrying
+	// is disabled, the retry queue is full, the block is out of retries, or
+	// the announcement was abandoned. Slow counts the announcements,
+	// successful or not, that took longer than Config.SlowThreshold.
+	Provided uint64
+	Failed   uint64
+	Dropped  uint64
+	Slow     uint64
+	// Skipped counts the blocks not announced because they were provided
+	// within Config.DedupWindow.
+	Skipped uint64
+
+	// Utilization is the fraction of the workers' time spent announcing
+	// since the worker started, from 0 to 1, of the workers there were at
+	// each moment.
+	Utilization float64
+}
+
+// counters backs Stats. It is allocated on its own so that the 64-bit
+// fields are aligned for atomic access on 32-bit platforms.
+type counters struct {
+	provided uint64
+	failed   uint64
+	dropped  uint64
+	slow     uint64
+	skipped  uint64
+	busy     uint64 // nanoseconds spent in worker slots
+	queued   int64  // in the client worker's queue
+	inFlight int64
+
+	slowThreshold time.Duration
+}
+
+// Stat returns a snapshot of the worker's activity.
+func (w *Worker) Stat() Stats {
+	c := w.stats
+	workers, _, capacity := w.slots.state(time.Now())
+	st := Stats{
+		QueueDepth: int(atomic.LoadInt64(&c.queued)) + len(w.added) + len(w.toWorkers),
+		InFlight:   int(atomic.LoadInt64(&c.inFlight)),
+		Workers:    workers,
+		Provided:   atomic.LoadUint64(&c.provided),
+		Failed:     atomic.LoadUint64(&c.failed),
+		Dropped:    atomic.LoadUint64(&c.dropped),
+		Slow:       atomic.LoadUint64(&c.slow),
+		Skipped:    atomic.LoadUint64(&c.skipped),
+	}
+	if capacity > 0 {
+		st.Utilization = float64(atomic.LoadUint64(&c.busy)) / float64(capacity)
+		if st.Utilization > 1 {
+			st.Utilization = 1
+		}
+	}
+	return st
+}
+
+// observe records an announcement that took |d| and returned |err|.
+func (c *counters) observe(d time.Duration, err error) {
+	if err == nil {
+		atomic.AddUint64(&c.provided, 1)
+	} else {
+		atomic.AddUint64(&c.failed, 1)
+	}
+	if d > c.slowThreshold {
+		atomic.AddUint64(&c.slow, 1)
+	}
+}
@@ -4,6 +4,9 @@ package worker
 import (
 	"container/list"
 	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	blocks "github.com/ipfs/go-blocks"
@@ -11,10 +14,20 @@ import (
 	key "github.com/ipfs/go-blocks/key"
 	waitable "github.com/ipfs/go-blocks/thirdparty/waitable"
 
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
 	process "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/goprocess"
-	ratelimit "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/goprocess/ratelimit"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
+// ErrQueueFull is returned by TryHasBlock when Config.MaxQueued blocks are
+// waiting to be provided.
+var ErrQueueFull = errors.New("blockservice worker: announcement queue is full")
+
+// ErrClosed is returned for blocks given to a closed worker, and by Ping.
+// It is blockservice.ErrClosed as well, its workers closing with the
+// service.
+var ErrClosed = errors.New("blockservice: closed")
+
 var DefaultConfig = Config{
 	NumWorkers:       1,
 	ClientBufferSize: 0,
@@ -23,9 +36,23 @@ var DefaultConfig = Config{
 
 type Config struct {
 	// NumWorkers sets the number of background workers that provide blocks to
-	// the exchange.
+	// the exchange, or, if Adaptive, the number it starts with.
 	NumWorkers int
 
+	// Adaptive sizes the workers to the load, rather than keeping
+	// NumWorkers of them: every ScaleInterval, their number grows by
+	// GOMAXPROCS if the blocks started in it waited longer than
+	// TargetLatency for a worker on average, or none could start, and
+	// shrinks by half those idle if no blocks are waiting, staying between
+	// MinWorkers and MaxWorkers. The defaults are GOMAXPROCS, 64 times that,
+	// DefaultScaleInterval and DefaultTargetLatency; NumWorkers defaults to
+	// MinWorkers.
+	Adaptive      bool
+	MinWorkers    int
+	MaxWorkers    int
+	ScaleInterval time.Duration
+	TargetLatency time.Duration
+
 	// ClientBufferSize allows clients of HasBlock to send up to
 	// |ClientBufferSize| blocks without blocking.
 	ClientBufferSize int
@@ -33,13 +60,112 @@ type Config struct {
 	// WorkerBufferSize can be used in conjunction with NumWorkers to reduce
 	// communication-coordination within the worker.
 	WorkerBufferSize int
+
+	// StuckThreshold, if positive, is how long a block may wait to be provided
+	// to the exchange before OnStuck is called with its age. The check runs
+	// every StuckThreshold/2.
+	StuckThreshold time.Duration
+	OnStuck        func(age time.Duration)
+
+	// OnProvideError, if set, is called with each block the exchange failed
+	// to be told about, and the error, whether it is retried or not.
+	OnProvideError func(k key.Key, err error)
+
+	// OnProvided, if set, is called with each block the exchange was told
+	// about, and how long after HasBlock accepted it, retries included, so
+	// that callers can tell when their blocks can be found rather than just
+	// queued. It is not called for the blocks skipped within DedupWindow.
+	OnProvided func(k key.Key, latency time.Duration)
+
+	// RetryBackoff, if positive, enables retrying blocks the exchange failed
+	// to be told about. The first retry happens after RetryBackoff, and the
+	// delay doubles on each failure up to MaxRetryBackoff (default 64 times
+	// RetryBackoff).
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// MaxRetries bounds the retries of a block, and MaxRetryQueue the blocks
+	// waiting to be retried, DefaultMaxRetries and DefaultMaxRetryQueue if
+	// not positive. Blocks past either are dropped, and counted in
+	// Stats.Dropped.
+	MaxRetries    int
+	MaxRetryQueue int
+
+	// SlowThreshold is how long an announcement may take before it is
+	// counted in Stats.Slow. The default is DefaultSlowThreshold.
+	SlowThreshold time.Duration
+
+	// StartSpan, if set, starts a tracing span named |operation| for each
+	// announcement, as a child of any span in |ctx|, the context of the
+	// call that queued the block. The exchange is given the returned
+	// context, and the span is ended with finish.
+	StartSpan func(ctx context.Context, operation string) (_ context.Context, finish func(error))
+
+	// RetryStore, if set, persists the retry queue so that it survives a
+	// restart. Queued blocks are stored in it whole, as they are needed to
+	// retry.
+	RetryStore ds.Datastore
+
+	// QueueStore, if set, persists the blocks accepted by HasBlock until
+	// they have been provided, so that those a restart interrupts are queued
+	// again by the next worker given the same store. Failed provides leave
+	// it for the retry queue, which only survives a restart with a
+	// RetryStore. It must not be the RetryStore.
+	QueueStore ds.Datastore
+
+	// MaxQueued, if positive, bounds the blocks accepted by HasBlock that
+	// have not been provided yet, those being provided included. Once that
+	// many are, HasBlockCtx and the calls built on it wait for one to be
+	// provided, or for their context to be done, while TryHasBlock fails
+	// with ErrQueueFull. Blocks restored from the QueueStore are queued
+	// whatever the bound.
+	MaxQueued int
+
+	// DedupWindow, if positive, is how long after a block is provided that
+	// HasBlock skips announcing it again, counting it in Stats.Skipped, so
+	// that imports rewriting existing content do not announce it anew. The
+	// exchange is assumed to still know of blocks announced that recently.
+	DedupWindow time.Duration
 }
 
 // TODO FIXME name me
 type Worker struct {
 	// added accepts blocks from client
-	added    chan *blocks.Block
+	added    chan prioritized
 	exchange exchange.Interface
+	// toWorkers hands queued blocks to the workers.
+	toWorkers chan *blocks.Block
+	// ping is answered by the client worker. See Ping.
+	ping chan chan struct{}
+
+	stats *counters
+	// slots limits the announcements in progress to the number of workers.
+	slots *slots
+	// scaler resizes the slots. It is nil unless Config.Adaptive is set.
+	scaler *scaler
+	// startSpan is Config.StartSpan, or nil.
+	startSpan func(context.Context, string) (context.Context, func(error))
+	// onProvideError is Config.OnProvideError, or nil.
+	onProvideError func(key.Key, error)
+	// onProvided is Config.OnProvided, or nil.
+	onProvided func(key.Key, time.Duration)
+	// maxQueued is Config.MaxQueued.
+	maxQueued int
+
+	// pending tracks blocks accepted by HasBlock that haven't been provided.
+	pending pendingSet
+	// recent holds the blocks provided in the last Config.DedupWindow. It
+	// is nil unless the window is positive.
+	recent *recentSet
+	// retries holds blocks whose provide failed. It is nil unless retrying
+	// is enabled.
+	retries *retryQueue
+	// queued persists pending blocks. See Config.QueueStore.
+	queued queueStore
+
+	// stopping is closed by CloseWithContext to turn away new blocks.
+	stopping chan struct{}
+	stopOnce sync.Once
 
 	// workQueue is owned by the client worker
 	// process manages life-cycle
@@ -47,42 +173,259 @@ type Worker struct {
 }
 
 func NewWorker(e exchange.Interface, c Config) *Worker {
+	if c.Adaptive {
+		adaptiveDefaults(&c)
+	}
 	if c.NumWorkers < 1 {
 		c.NumWorkers = 1 // provide a sane default
 	}
+	if c.SlowThreshold <= 0 {
+		c.SlowThreshold = DefaultSlowThreshold
+	}
+	now := time.Now()
 	w := &Worker{
-		exchange: e,
-		added:    make(chan *blocks.Block, c.ClientBufferSize),
-		process:  process.WithParent(process.Background()), // internal management
+		exchange:       e,
+		added:          make(chan prioritized, c.ClientBufferSize),
+		toWorkers:      make(chan *blocks.Block, c.WorkerBufferSize),
+		ping:           make(chan chan struct{}),
+		stats:          &counters{slowThreshold: c.SlowThreshold},
+		slots:          newSlots(c.NumWorkers, now),
+		startSpan:      c.StartSpan,
+		onProvideError: c.OnProvideError,
+		onProvided:     c.OnProvided,
+		maxQueued:      c.MaxQueued,
+		queued:         queueStore{c.QueueStore},
+		stopping:       make(chan struct{}),
+		process:        process.WithParent(process.Background()), // internal management
+	}
+	if c.RetryBackoff > 0 {
+		if c.MaxRetryBackoff < c.RetryBackoff {
+			c.MaxRetryBackoff = 64 * c.RetryBackoff
+		}
+		if c.MaxRetries <= 0 {
+			c.MaxRetries = DefaultMaxRetries
+		}
+		if c.MaxRetryQueue <= 0 {
+			c.MaxRetryQueue = DefaultMaxRetryQueue
+		}
+		w.retries = newRetryQueue(c.RetryBackoff, c.MaxRetryBackoff, c.MaxRetries, c.MaxRetryQueue, c.RetryStore)
 	}
-	w.start(c)
+	if c.DedupWindow > 0 {
+		w.recent = newRecentSet(c.DedupWindow)
+	}
+	if c.Adaptive {
+		w.scaler = &scaler{
+			min:    c.MinWorkers,
+			max:    c.MaxWorkers,
+			target: c.TargetLatency,
+			step:   runtime.GOMAXPROCS(0),
+		}
+	}
+	restored := w.queued.Load()
+	for _, b := range restored {
+		w.pending.Add(b.Key(), now, nil, nil)
+	}
+	w.start(c, restored)
 	return w
 }
 
 func (w *Worker) HasBlock(b *blocks.Block) error {
+	return w.HasBlockWithHints(b, nil)
+}
+
+// HasBlockWithHints is like HasBlock, but passes routing |hints| to the
+// exchange if it implements exchange.HintedAnnouncer. Hints given for a block
+// that is already queued are added to the ones it has.
+func (w *Worker) HasBlockWithHints(b *blocks.Block, hints []string) error {
+	return w.HasBlockCtx(context.Background(), b, hints)
+}
+
+// HasBlockCtx is like HasBlockWithHints, but the announcement is abandoned
+// if |ctx| is done, whether the block is still queued or being provided, and
+// it returns ctx.Err() if |ctx| is done before the worker accepts the block,
+// such as while it waits for room in the queue; see Config.MaxQueued.
+// A block queued again by another call before it is provided is no longer
+// tied to any one caller's context.
+func (w *Worker) HasBlockCtx(ctx context.Context, b *blocks.Block, hints []string) error {
+	return w.HasBlockPriority(ctx, b, hints, PriorityNormal)
+}
+
+// HasBlockPriority is like HasBlockCtx, but queues |b| with |prio|. A block
+// queued again with a higher priority before a worker takes it moves up to
+// that priority; it never moves down. A block queued again while a worker is
+// providing it is not queued: that announcement stands for both, as does
+// one provided within Config.DedupWindow.
+func (w *Worker) HasBlockPriority(ctx context.Context, b *blocks.Block, hints []string, prio Priority) error {
+	return w.enqueue(ctx, b, hints, prio, true)
+}
+
+// TryHasBlock is like HasBlockPriority, but rather than waiting for room in
+// the queue, it fails with ErrQueueFull if there is none, so that a caller
+// with nothing better to wait on need not block while the exchange is slow.
+// See Config.MaxQueued.
+func (w *Worker) TryHasBlock(b *blocks.Block, hints []string, prio Priority) error {
+	return w.enqueue(context.Background(), b, hints, prio, false)
+}
+
+// enqueue queues |b| for HasBlockPriority, waiting for room in the queue if
+// |wait| is set, and failing with ErrQueueFull otherwise.
+func (w *Worker) enqueue(ctx context.Context, b *blocks.Block, hints []string, prio Priority, wait bool) error {
+	select {
+	case <-w.stopping:
+		return ErrClosed
+	default:
+	}
+	if w.recent != nil && w.recent.Seen(b.Key(), time.Now()) {
+		atomic.AddUint64(&w.stats.skipped, 1)
+		return nil
+	}
+	// record before handing off; the provide may complete before we'd return.
+	var caller *pendingCaller
+	for {
+		var providing bool
+		var room <-chan struct{}
+		providing, room, caller = w.pending.AddWithin(b.Key(), time.Now(), hints, ctx, w.maxQueued, wait)
+		if providing {
+			return nil
+		}
+		if caller != nil {
+			break
+		}
+		if !wait {
+			return ErrQueueFull
+		}
+		select {
+		case <-room:
+		case <-w.stopping:
+			w.pending.StopWaiting(room)
+			return ErrClosed
+		case <-w.process.Closed():
+			w.pending.StopWaiting(room)
+			return ErrClosed
+		case <-ctx.Done():
+			w.pending.StopWaiting(room)
+			return ctx.Err()
+		}
+	}
+	w.queued.Add(b)
 	select {
 	case <-w.process.Closed():
-		return errors.New("blockservice worker is closed")
-	case w.added <- b:
+		w.withdraw(b.Key(), caller)
+		return ErrClosed
+	case <-ctx.Done():
+		w.withdraw(b.Key(), caller)
+		return ctx.Err()
+	case w.added <- prioritized{b, prio}:
 		return nil
 	}
 }
 
+// withdraw takes back the part |caller| had in the pending block |k|,
+// unqueueing it if no other accepted call queued it too.
+func (w *Worker) withdraw(k key.Key, caller *pendingCaller) {
+	if w.pending.Withdraw(k, caller) {
+		w.queued.Remove(k)
+	}
+}
+
+// RetryDepth returns the number of blocks waiting to be retried after a
+// failed provide.
+func (w *Worker) RetryDepth() int {
+	if w.retries == nil {
+		return 0
+	}
+	return w.retries.Len()
+}
+
+// Pending reports whether the block |k| was accepted by HasBlock and has not
+// been provided yet, nor dropped, counting those waiting to be retried.
+func (w *Worker) Pending(k key.Key) bool {
+	if !w.pending.Accepted(k).IsZero() {
+		return true
+	}
+	return w.retries != nil && w.retries.Has(k)
+}
+
+// OldestPendingAge returns how long the oldest block accepted by HasBlock has
+// been waiting to be provided to the exchange, or zero if none are waiting.
+func (w *Worker) OldestPendingAge() time.Duration {
+	return w.pending.OldestAge(time.Now())
+}
+
+// Ping checks that the worker is running, returning once the loop queueing
+// blocks has answered, ErrClosed if the worker is closed, or ctx.Err() if
+// |ctx| is done first.
+func (w *Worker) Ping(ctx context.Context) error {
+	reply := make(chan struct{})
+	select {
+	case w.ping <- reply:
+	case <-w.process.Closing():
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-reply:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (w *Worker) Close() error {
 	// log.Debug("blockservice provide worker is shutting down...")
 	return w.process.Close()
 }
 
-func (w *Worker) start(c Config) {
+// CloseWithContext turns away new blocks, waits until the ones already
+// accepted have been provided or |ctx| is done, and then closes the worker.
+// It returns how many were dropped: unless there is a QueueStore to keep
+// them, those still waiting when |ctx| was done, and, unless there is a
+// RetryStore to keep them, those waiting to be retried, which it does not
+// wait for. Dropped blocks are counted in
+// Stats.Dropped. The error is ctx.Err() if the wait was cut short.
+func (w *Worker) CloseWithContext(ctx context.Context) (int, error) {
+	w.stopOnce.Do(func() { close(w.stopping) })
 
-	workerChan := make(chan *blocks.Block, c.WorkerBufferSize)
+	var waitErr error
+	select {
+	case <-w.pending.Drained():
+	case <-ctx.Done():
+		waitErr = ctx.Err()
+	}
+	// announcements cut short by closing count themselves as dropped, but
+	// blocks still queued once the worker closes were never started.
+	before := atomic.LoadUint64(&w.stats.dropped)
+	closeErr := w.process.Close()
+	unstarted := 0
+	if w.queued.store == nil {
+		unstarted = w.pending.Len()
+	}
+	if w.retries != nil && w.retries.store == nil {
+		unstarted += w.retries.Len()
+	}
+	after := atomic.AddUint64(&w.stats.dropped, uint64(unstarted))
+	dropped := int(after - before)
+	if waitErr != nil {
+		return dropped, waitErr
+	}
+	return dropped, closeErr
+}
+
+// start runs the worker, with |restored| queued first.
+func (w *Worker) start(c Config, restored []*blocks.Block) {
+
+	workerChan := w.toWorkers
 
 	// clientWorker handles incoming blocks from |w.added| and sends to
 	// |workerChan|. This will never block the client.
 	w.process.Go(func(proc process.Process) {
 		defer close(workerChan)
 
-		var workQueue BlockList
+		var workQueue laneQueue
+		for _, b := range restored {
+			workQueue.Push(b, PriorityNormal)
+		}
 		debugInfo := time.NewTicker(5 * time.Second)
 		defer debugInfo.Stop()
 		for {
@@ -90,7 +433,7 @@ func (w *Worker) start(c Config) {
 			// take advantage of the fact that sending on nil channel always
 			// blocks so that a message is only sent if a block exists
 			sendToWorker := workerChan
-			nextBlock := workQueue.Pop()
+			nextBlock, prio := workQueue.Pop()
 			if nextBlock == nil {
 				sendToWorker = nil
 			}
@@ -100,42 +443,417 @@ func (w *Worker) start(c Config) {
 			// if worker is ready and there's a block to process, send the
 			// block
 			case sendToWorker <- nextBlock:
+				w.pending.Start(nextBlock.Key())
 			case <-debugInfo.C:
+				if nextBlock != nil {
+					workQueue.PushFront(nextBlock, prio) // missed the chance to send it
+				}
 				if workQueue.Len() > 0 {
 					// log.Debugf("%d blocks in blockservice provide queue...", workQueue.Len())
 				}
-			case block := <-w.added:
+			case reply := <-w.ping:
 				if nextBlock != nil {
-					workQueue.Push(nextBlock) // missed the chance to send it
+					workQueue.PushFront(nextBlock, prio) // missed the chance to send it
+				}
+				close(reply)
+			case added := <-w.added:
+				if nextBlock != nil {
+					workQueue.PushFront(nextBlock, prio) // missed the chance to send it
+				}
+				// if the client sends another block, add it to the queue,
+				// unless it is being provided.
+				if !w.pending.Providing(added.b.Key()) {
+					workQueue.Push(added.b, added.prio)
 				}
-				// if the client sends another block, add it to the queue.
-				workQueue.Push(block)
 			case <-proc.Closing():
 				return
 			}
+			atomic.StoreInt64(&w.stats.queued, int64(workQueue.Len()))
 		}
 	})
 
 	// reads from |workerChan| until w.process closes
-	limiter := ratelimit.NewRateLimiter(w.process, c.NumWorkers)
-	limiter.Go(func(proc process.Process) {
+	w.process.Go(func(proc process.Process) {
 		ctx := waitable.Context(proc) // shut down in-progress HasBlock when time to die
 		for {
+			// a worker is free before a block is taken, so that blocks wait
+			// in their lanes, where later ones of a higher priority pass.
+			if !w.slots.acquire(proc) {
+				return
+			}
 			select {
 			case <-proc.Closing():
+				w.slots.release()
 				return
 			case block, ok := <-workerChan:
 				if !ok {
+					w.slots.release()
 					return
 				}
-				limiter.LimitedGo(func(proc process.Process) {
-					if err := w.exchange.HasBlock(ctx, block); err != nil {
-						// log.Infof("blockservice worker error: %s", err)
+				proc.Go(func(proc process.Process) {
+					defer w.slots.release()
+					defer w.pending.Remove(block.Key())
+					if w.scaler != nil {
+						w.scaler.observe(w.pending.Age(block.Key(), time.Now()))
+					}
+					atomic.AddInt64(&w.stats.inFlight, 1)
+					defer atomic.AddInt64(&w.stats.inFlight, -1)
+					start := time.Now()
+					defer func() {
+						atomic.AddUint64(&w.stats.busy, uint64(time.Since(start)))
+					}()
+
+					hints, caller := w.pending.Announcement(block.Key())
+					accepted := w.pending.Accepted(block.Key())
+					pctx, cancel := withCaller(ctx, caller)
+					defer cancel()
+					if err := w.provide(pctx, block, hints, accepted); err != nil {
+						if w.onProvideError != nil {
+							w.onProvideError(block.Key(), err)
+						}
+						switch {
+						case w.retries != nil && pctx.Err() == nil && w.retries.Add(block, hints, accepted, time.Now()):
+							// queued for a retry.
+						case ctx.Err() != nil && w.queued.store != nil:
+							// cut short by closing; the QueueStore keeps it.
+						default:
+							atomic.AddUint64(&w.stats.dropped, 1)
+						}
+					}
+					if ctx.Err() == nil {
+						// done with, unless cut short by closing.
+						w.queued.Remove(block.Key())
 					}
 				})
 			}
 		}
 	})
+
+	if w.scaler != nil {
+		w.process.Go(func(proc process.Process) {
+			w.runScaler(proc, c.ScaleInterval)
+		})
+	}
+
+	if w.retries != nil {
+		w.process.Go(func(proc process.Process) {
+			ctx := waitable.Context(proc)
+			check := time.NewTicker(c.RetryBackoff)
+			defer check.Stop()
+			for {
+				select {
+				case <-check.C:
+					dropped := w.retries.RetryDue(time.Now(), func(b *blocks.Block, hints []string, accepted time.Time) error {
+						return w.provide(ctx, b, hints, accepted)
+					})
+					atomic.AddUint64(&w.stats.dropped, uint64(dropped))
+				case <-proc.Closing():
+					return
+				}
+			}
+		})
+	}
+
+	if c.StuckThreshold > 0 && c.OnStuck != nil {
+		w.process.Go(func(proc process.Process) {
+			check := time.NewTicker(c.StuckThreshold / 2)
+			defer check.Stop()
+			for {
+				select {
+				case <-check.C:
+					if age := w.OldestPendingAge(); age >= c.StuckThreshold {
+						c.OnStuck(age)
+					}
+				case <-proc.Closing():
+					return
+				}
+			}
+		})
+	}
+}
+
+// withCaller returns a context done when either the worker's |ctx| or the
+// |caller|'s context is, and carrying the caller's values, such as its
+// tracing span.
+func withCaller(ctx, caller context.Context) (context.Context, context.CancelFunc) {
+	merged, cancel := context.WithCancel(ctx)
+	if caller == nil {
+		return merged, cancel
+	}
+	if caller.Done() != nil {
+		go func() {
+			select {
+			case <-caller.Done():
+				cancel()
+			case <-merged.Done():
+			}
+		}()
+	}
+	return callerValues{merged, caller}, cancel
+}
+
+// callerValues is a worker context that looks values up in the caller's.
+type callerValues struct {
+	context.Context
+	caller context.Context
+}
+
+func (c callerValues) Value(k interface{}) interface{} {
+	return c.caller.Value(k)
+}
+
+// provide announces |b| to the exchange, with the routing |hints| it was
+// queued with when it was |accepted|.
+func (w *Worker) provide(ctx context.Context, b *blocks.Block, hints []string, accepted time.Time) (err error) {
+	if w.startSpan != nil {
+		var finish func(error)
+		ctx, finish = w.startSpan(ctx, "exchange.HasBlock")
+		defer func() { finish(err) }()
+	}
+	start := time.Now()
+	if ha, ok := w.exchange.(exchange.HintedAnnouncer); ok {
+		err = ha.HasBlockWithHints(ctx, b, hints)
+	} else {
+		err = w.exchange.HasBlock(ctx, b)
+	}
+	now := time.Now()
+	if err == nil && w.recent != nil {
+		w.recent.Add(b.Key(), now)
+	}
+	w.stats.observe(now.Sub(start), err)
+	if err == nil && w.onProvided != nil {
+		w.onProvided(b.Key(), now.Sub(accepted))
+	}
+	return err
+}
+
+// pendingSet records, per key, when the worker accepted a block that has not
+// been provided yet. Entries are kept in arrival order so the oldest is at
+// the front.
+//
+// A key accepted again while already pending keeps its original time, and
+// records the call that accepted it, so that a call failing before the
+// block was queued takes back only its own part. The first completed
+// provide for a key clears it, so ages are never overstated.
+type pendingSet struct {
+	mu    sync.Mutex
+	order list.List // of *pendingEntry, oldest first
+	byKey map[key.Key]*list.Element
+	// drained are closed once the set is empty. See Drained.
+	drained []chan struct{}
+	// room are closed once a key is removed. See AddWithin.
+	room []chan struct{}
+}
+
+type pendingEntry struct {
+	key   key.Key
+	added time.Time
+	// callers are the calls that accepted the block.
+	callers []*pendingCaller
+	// providing is set once a worker has taken the block.
+	providing bool
+}
+
+// pendingCaller is a call that accepted a pending block, with its context
+// and routing hints.
+type pendingCaller struct {
+	ctx   context.Context
+	hints []string
+}
+
+// Add records that |k| was accepted at |now|, and reports whether a worker
+// is providing it already, so that it need not be queued again.
+func (p *pendingSet) Add(k key.Key, now time.Time, hints []string, ctx context.Context) (providing bool) {
+	providing, _, _ = p.AddWithin(k, now, hints, ctx, 0, false)
+	return providing
+}
+
+// AddWithin is Add, unless |k| is not pending and |max| keys are, if |max|
+// is positive: then it records nothing, and returns no call and, if |wait|
+// is set, a channel closed once a key is no longer pending, to be given to
+// StopWaiting if the caller stops waiting for it first. Otherwise it
+// returns the call it recorded, for Withdraw.
+func (p *pendingSet) AddWithin(k key.Key, now time.Time, hints []string, ctx context.Context, max int, wait bool) (providing bool, room <-chan struct{}, caller *pendingCaller) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byKey == nil {
+		p.byKey = make(map[key.Key]*list.Element)
+	}
+	e, ok := p.byKey[k]
+	if !ok && max > 0 && len(p.byKey) >= max {
+		if !wait {
+			return false, nil, nil
+		}
+		ch := make(chan struct{})
+		p.room = append(p.room, ch)
+		return false, ch, nil
+	}
+	if !ok {
+		e = p.order.PushBack(&pendingEntry{key: k, added: now})
+		p.byKey[k] = e
+	}
+	entry := e.Value.(*pendingEntry)
+	caller = &pendingCaller{ctx: ctx, hints: hints}
+	entry.callers = append(entry.callers, caller)
+	return entry.providing, nil, caller
+}
+
+// Withdraw forgets |caller|, recorded by AddWithin for |k|, and removes |k|
+// as Remove does if no other call accepted it. It reports whether it did.
+func (p *pendingSet) Withdraw(k key.Key, caller *pendingCaller) bool {
+	p.mu.Lock()
+	e, ok := p.byKey[k]
+	if !ok {
+		p.mu.Unlock()
+		return false
+	}
+	entry := e.Value.(*pendingEntry)
+	for i, c := range entry.callers {
+		if c == caller {
+			entry.callers = append(entry.callers[:i], entry.callers[i+1:]...)
+			break
+		}
+	}
+	last := len(entry.callers) == 0
+	p.mu.Unlock()
+	if last {
+		p.Remove(k)
+	}
+	return last
+}
+
+// StopWaiting drops |room|, returned by AddWithin, for a caller that no
+// longer waits for it to close.
+func (p *pendingSet) StopWaiting(room <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, ch := range p.room {
+		if ch == room {
+			p.room = append(p.room[:i], p.room[i+1:]...)
+			return
+		}
+	}
+}
+
+// Start marks |k| as taken by a worker.
+func (p *pendingSet) Start(k key.Key) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.byKey[k]; ok {
+		e.Value.(*pendingEntry).providing = true
+	}
+}
+
+// Providing reports whether |k| is being provided.
+func (p *pendingSet) Providing(k key.Key) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.byKey[k]
+	return ok && e.Value.(*pendingEntry).providing
+}
+
+// Announcement returns the routing hints recorded for |k|, and the context
+// of the calls that queued it, if they all had the same one.
+func (p *pendingSet) Announcement(k key.Key) ([]string, context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.byKey[k]
+	if !ok {
+		return nil, nil
+	}
+	var hints []string
+	var ctx context.Context
+	for i, c := range e.Value.(*pendingEntry).callers {
+		for _, h := range c.hints {
+			if !containsHint(hints, h) {
+				hints = append(hints, h)
+			}
+		}
+		if i == 0 {
+			ctx = c.ctx
+		} else if c.ctx != ctx {
+			ctx = nil
+		}
+	}
+	return hints, ctx
+}
+
+func containsHint(hints []string, h string) bool {
+	for _, x := range hints {
+		if x == h {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pendingSet) Remove(k key.Key) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.byKey[k]; ok {
+		p.order.Remove(e)
+		delete(p.byKey, k)
+		for _, ch := range p.room {
+			close(ch)
+		}
+		p.room = nil
+	}
+	if len(p.byKey) == 0 {
+		for _, ch := range p.drained {
+			close(ch)
+		}
+		p.drained = nil
+	}
+}
+
+// Drained returns a channel closed once no blocks are pending.
+func (p *pendingSet) Drained() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch := make(chan struct{})
+	if len(p.byKey) == 0 {
+		close(ch)
+	} else {
+		p.drained = append(p.drained, ch)
+	}
+	return ch
+}
+
+func (p *pendingSet) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.byKey)
+}
+
+// Accepted returns when |k| was accepted, or the zero time if it isn't
+// pending.
+func (p *pendingSet) Accepted(k key.Key) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.byKey[k]; ok {
+		return e.Value.(*pendingEntry).added
+	}
+	return time.Time{}
+}
+
+// Age returns how long |k| has been pending at |now|, or zero if it isn't.
+func (p *pendingSet) Age(k key.Key, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.byKey[k]; ok {
+		return now.Sub(e.Value.(*pendingEntry).added)
+	}
+	return 0
+}
+
+func (p *pendingSet) OldestAge(now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	front := p.order.Front()
+	if front == nil {
+		return 0
+	}
+	return now.Sub(front.Value.(*pendingEntry).added)
 }
 
 type BlockList struct {
@@ -165,6 +883,20 @@ func (s *BlockList) Push(b *blocks.Block) {
 	}
 }
 
+// Has reports whether |k| is in the list.
+func (s *BlockList) Has(k key.Key) bool {
+	_, ok := s.uniques[k]
+	return ok
+}
+
+// Remove takes |k| out of the list, if it is in it.
+func (s *BlockList) Remove(k key.Key) {
+	if e, ok := s.uniques[k]; ok {
+		s.list.Remove(e)
+		delete(s.uniques, k)
+	}
+}
+
 func (s *BlockList) Pop() *blocks.Block {
 	if s.list.Len() == 0 {
 		return nil
@@ -1,8 +1,18 @@
 package worker
 
 import (
-	blocks "github.com/ipfs/go-blocks"
+	"errors"
+	"sync"
 	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
 func TestStartClose(t *testing.T) {
@@ -61,3 +71,655 @@ func TestPushPopPushPop(t *testing.T) {
 func blockFromInt(i int) *blocks.Block {
 	return blocks.NewBlock([]byte(string(i)))
 }
+
+// blockingExchange is an exchange whose HasBlock calls wait for |release|.
+type blockingExchange struct {
+	release chan struct{}
+}
+
+func (e *blockingExchange) GetBlock(context.Context, key.Key) (*blocks.Block, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (e *blockingExchange) GetBlocks(context.Context, []key.Key) (<-chan *blocks.Block, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (e *blockingExchange) HasBlock(ctx context.Context, _ *blocks.Block) error {
+	select {
+	case <-e.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *blockingExchange) Cancel(context.Context, []key.Key) error { return nil }
+
+func (e *blockingExchange) Close() error { return nil }
+
+func TestOldestPendingAge(t *testing.T) {
+	ex := &blockingExchange{release: make(chan struct{})}
+	stuck := make(chan time.Duration, 1)
+	w := NewWorker(ex, Config{
+		NumWorkers:     1,
+		StuckThreshold: 20 * time.Millisecond,
+		OnStuck: func(age time.Duration) {
+			select {
+			case stuck <- age:
+			default:
+			}
+		},
+	})
+	defer w.Close()
+
+	if age := w.OldestPendingAge(); age != 0 {
+		t.Fatalf("expected no pending age on an idle worker, got %s", age)
+	}
+	if err := w.HasBlock(blockFromInt(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case age := <-stuck:
+		if age < 20*time.Millisecond {
+			t.Fatalf("OnStuck called too early, at %s", age)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnStuck was never called")
+	}
+	if age := w.OldestPendingAge(); age < 20*time.Millisecond {
+		t.Fatalf("pending age should have grown, got %s", age)
+	}
+
+	close(ex.release)
+	deadline := time.Now().Add(time.Second)
+	for w.OldestPendingAge() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pending age never cleared after the provide completed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// flappingExchange fails the first |failures| HasBlock calls, then reports
+// every later block on |provided|.
+type flappingExchange struct {
+	blockingExchange
+	mu       sync.Mutex
+	failures int
+	provided chan key.Key
+}
+
+func (e *flappingExchange) HasBlock(_ context.Context, b *blocks.Block) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.failures > 0 {
+		e.failures--
+		return errors.New("exchange unavailable")
+	}
+	e.provided <- b.Key()
+	return nil
+}
+
+func TestRetryFailedProvides(t *testing.T) {
+	ex := &flappingExchange{failures: 3, provided: make(chan key.Key, 1)}
+	w := NewWorker(ex, Config{
+		NumWorkers:      1,
+		RetryBackoff:    5 * time.Millisecond,
+		MaxRetryBackoff: 10 * time.Millisecond,
+	})
+	defer w.Close()
+
+	b := blockFromInt(1)
+	if err := w.HasBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for w.RetryDepth() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed provide was never queued for a retry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case k := <-ex.provided:
+		if k != b.Key() {
+			t.Fatalf("unexpected block provided: %s", k)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("block was never provided")
+	}
+	for w.RetryDepth() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("retry queue not drained after a successful provide")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRetryQueueSurvivesRestart(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	down := &flappingExchange{failures: 1 << 30, provided: make(chan key.Key, 1)}
+	w := NewWorker(down, Config{RetryBackoff: time.Hour, RetryStore: store})
+	b := blockFromInt(1)
+	if err := w.HasBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for w.RetryDepth() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed provide was never queued for a retry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w.Close()
+
+	up := &flappingExchange{provided: make(chan key.Key, 1)}
+	w = NewWorker(up, Config{RetryBackoff: 5 * time.Millisecond, RetryStore: store})
+	defer w.Close()
+	if w.RetryDepth() != 1 {
+		t.Fatalf("expected the persisted retry to be loaded, depth %d", w.RetryDepth())
+	}
+	select {
+	case k := <-up.provided:
+		if k != b.Key() {
+			t.Fatalf("unexpected block provided: %s", k)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("persisted retry was never provided")
+	}
+}
+
+func TestRetriesBounded(t *testing.T) {
+	down := &flappingExchange{failures: 1 << 30, provided: make(chan key.Key, 1)}
+	w := NewWorker(down, Config{
+		NumWorkers:      1,
+		RetryBackoff:    time.Millisecond,
+		MaxRetryBackoff: time.Millisecond,
+		MaxRetries:      2,
+		MaxRetryQueue:   1,
+	})
+	defer w.Close()
+	for i := 0; i < 2; i++ {
+		if err := w.HasBlock(blockFromInt(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one block is left out of the full queue, the other out of retries.
+	deadline := time.Now().Add(time.Second)
+	for st := w.Stat(); st.Dropped != 2 || w.RetryDepth() != 0; st = w.Stat() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both blocks dropped, got %d dropped and %d queued", st.Dropped, w.RetryDepth())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if st := w.Stat(); st.Failed != 4 {
+		t.Fatalf("expected 2 failures and 2 failed retries, got %d", st.Failed)
+	}
+}
+
+func TestRetryStoreKeepsHints(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	b, corrupt := blockFromInt(1), blocks.NewBlock([]byte("\x00 parses as no hints"))
+	q := newRetryQueue(time.Hour, time.Hour, 1, 10, store)
+	q.Add(b, []string{"peer-a", "peer-b"}, time.Now(), time.Now())
+	// the data alone, which decodes as no hints and the data less a byte.
+	if err := store.Put(retryKey(corrupt.Key()), corrupt.Data); err != nil {
+		t.Fatal(err)
+	}
+
+	q = newRetryQueue(time.Hour, time.Hour, 1, 10, store)
+	if e := q.entries[b.Key()]; e == nil || len(e.hints) != 2 || e.hints[0] != "peer-a" || e.hints[1] != "peer-b" {
+		t.Fatalf("expected the block reloaded with its hints, got %v", e)
+	}
+	if e := q.entries[corrupt.Key()]; e != nil {
+		t.Fatalf("expected an entry not matching its key dropped, got %v", e)
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	stuck := &blockingExchange{release: make(chan struct{})}
+	w := NewWorker(stuck, Config{NumWorkers: 1, QueueStore: store})
+	b1, b2 := blockFromInt(1), blockFromInt(2)
+	for _, b := range []*blocks.Block{b1, b2} {
+		if err := w.HasBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	up := &flappingExchange{provided: make(chan key.Key, 2)}
+	w = NewWorker(up, Config{QueueStore: store})
+	defer w.Close()
+	got := make(map[key.Key]bool)
+	for len(got) < 2 {
+		select {
+		case k := <-up.provided:
+			got[k] = true
+		case <-time.After(time.Second):
+			t.Fatalf("persisted blocks were not all provided, got %d", len(got))
+		}
+	}
+	if !got[b1.Key()] || !got[b2.Key()] {
+		t.Fatal("unexpected blocks provided")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		res, err := store.Query(dsq.Query{KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		left, _ := res.Rest()
+		if len(left) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d provided blocks left in the queue store", len(left))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHasBlockCtxCancelsAnnouncement(t *testing.T) {
+	ex := &blockingExchange{release: make(chan struct{})}
+	w := NewWorker(ex, Config{NumWorkers: 1})
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := w.HasBlockCtx(ctx, blockFromInt(1), nil); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	// the exchange never releases, so only the cancellation ends the provide.
+	deadline := time.Now().Add(time.Second)
+	for w.OldestPendingAge() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("announcement was not abandoned after cancellation")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPendingWithdrawKeepsOtherCallers(t *testing.T) {
+	var p pendingSet
+	k := blockFromInt(1).Key()
+	now := time.Now()
+	ctx := context.Background()
+	p.AddWithin(k, now, []string{"a"}, ctx, 0, false)
+	_, _, failed := p.AddWithin(k, now, []string{"b"}, context.TODO(), 0, false)
+
+	if p.Withdraw(k, failed) {
+		t.Fatal("expected the key kept for the call that queued it first")
+	}
+	if p.Accepted(k).IsZero() {
+		t.Fatal("expected the key still pending")
+	}
+	hints, hctx := p.Announcement(k)
+	if len(hints) != 1 || hints[0] != "a" || hctx != ctx {
+		t.Fatalf("expected the first call's hints and context, got %v, %v", hints, hctx)
+	}
+}
+
+func TestPendingRoomOnlyForWaiters(t *testing.T) {
+	var p pendingSet
+	now := time.Now()
+	ctx := context.Background()
+	p.AddWithin(blockFromInt(1).Key(), now, nil, ctx, 1, false)
+
+	if _, room, caller := p.AddWithin(blockFromInt(2).Key(), now, nil, ctx, 1, false); room != nil || caller != nil {
+		t.Fatal("expected a full set to refuse without a channel to wait on")
+	}
+	_, room, _ := p.AddWithin(blockFromInt(2).Key(), now, nil, ctx, 1, true)
+	if room == nil || len(p.room) != 1 {
+		t.Fatalf("expected one channel to wait on, got %d", len(p.room))
+	}
+	p.StopWaiting(room)
+	if len(p.room) != 0 {
+		t.Fatalf("expected the given up channel dropped, got %d", len(p.room))
+	}
+}
+
+func TestStat(t *testing.T) {
+	ex := &blockingExchange{release: make(chan struct{})}
+	w := NewWorker(ex, Config{NumWorkers: 1, SlowThreshold: 10 * time.Millisecond})
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := w.HasBlock(blockFromInt(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "one announcement in flight and two queued", func() bool {
+		st := w.Stat()
+		return st.InFlight == 1 && st.QueueDepth == 2
+	})
+
+	time.Sleep(20 * time.Millisecond) // make the first announcement slow.
+	close(ex.release)
+	waitFor(t, "all announcements provided", func() bool {
+		return w.Stat().Provided == 3
+	})
+
+	st := w.Stat()
+	if st.InFlight != 0 || st.QueueDepth != 0 {
+		t.Fatalf("expected an idle worker, got %+v", st)
+	}
+	if st.Slow < 1 || st.Failed != 0 || st.Dropped != 0 {
+		t.Fatalf("unexpected counters %+v", st)
+	}
+	if st.Utilization <= 0 || st.Utilization > 1 {
+		t.Fatalf("utilization out of range: %v", st.Utilization)
+	}
+}
+
+func TestStatCountsDropped(t *testing.T) {
+	ex := &flappingExchange{failures: 1, provided: make(chan key.Key, 1)}
+	w := NewWorker(ex, Config{NumWorkers: 1})
+	defer w.Close()
+
+	if err := w.HasBlock(blockFromInt(1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the failed announcement to be dropped", func() bool {
+		st := w.Stat()
+		return st.Failed == 1 && st.Dropped == 1
+	})
+}
+
+func TestDedupWindow(t *testing.T) {
+	ex := &flappingExchange{provided: make(chan key.Key, 8)}
+	w := NewWorker(ex, Config{NumWorkers: 1, DedupWindow: 50 * time.Millisecond})
+	defer w.Close()
+
+	announce := func(i int, provided uint64) {
+		if err := w.HasBlock(blockFromInt(i)); err != nil {
+			t.Fatal(err)
+		}
+		<-ex.provided
+		waitFor(t, "the announcement to finish", func() bool {
+			return w.Stat().Provided == provided
+		})
+	}
+	announce(1, 1)
+	for i := 0; i < 3; i++ {
+		if err := w.HasBlock(blockFromInt(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := w.Stat(); st.Skipped != 3 || st.Provided != 1 {
+		t.Fatalf("expected 3 skipped and 1 provided, got %+v", st)
+	}
+
+	// a block not yet announced is not skipped, nor one announced before
+	// the window.
+	announce(2, 2)
+	time.Sleep(60 * time.Millisecond)
+	announce(1, 3)
+	if st := w.Stat(); st.Skipped != 3 {
+		t.Fatalf("expected 3 skipped, got %+v", st)
+	}
+}
+
+func TestOnProvided(t *testing.T) {
+	type provided struct {
+		k       key.Key
+		latency time.Duration
+	}
+	got := make(chan provided, 2)
+	ex := &flappingExchange{failures: 2, provided: make(chan key.Key, 2)}
+	w := NewWorker(ex, Config{
+		NumWorkers:   1,
+		RetryBackoff: 20 * time.Millisecond,
+		OnProvided:   func(k key.Key, latency time.Duration) { got <- provided{k, latency} },
+	})
+	defer w.Close()
+
+	b := blockFromInt(1)
+	start := time.Now()
+	if err := w.HasBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Pending(b.Key()) {
+		t.Fatal("accepted block not pending")
+	}
+	// the latency spans the retries, from when the block was accepted.
+	p := <-got
+	if p.k != b.Key() || p.latency < 30*time.Millisecond || p.latency > time.Since(start) {
+		t.Fatalf("expected %s after at least two retries, got %+v", b.Key(), p)
+	}
+	waitFor(t, "the provided block to leave the queue", func() bool {
+		return !w.Pending(b.Key())
+	})
+}
+
+func TestMaxQueued(t *testing.T) {
+	ex := &blockingExchange{release: make(chan struct{})}
+	w := NewWorker(ex, Config{NumWorkers: 1, MaxQueued: 2})
+	defer w.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := w.HasBlock(blockFromInt(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.TryHasBlock(blockFromInt(2), nil, PriorityNormal); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	// a block already queued takes no room.
+	if err := w.TryHasBlock(blockFromInt(1), nil, PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.HasBlockCtx(ctx, blockFromInt(2), nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait for room to time out, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- w.HasBlock(blockFromInt(2)) }()
+	select {
+	case err := <-done:
+		t.Fatalf("HasBlock returned %v with the queue full", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(ex.release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("HasBlock still waiting once the queue drained")
+	}
+	waitFor(t, "all announcements provided", func() bool {
+		return w.Stat().Provided == 3
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCloseWithContextDrains(t *testing.T) {
+	ex := &blockingExchange{release: make(chan struct{})}
+	w := NewWorker(ex, Config{NumWorkers: 1})
+
+	for i := 0; i < 3; i++ {
+		if err := w.HasBlock(blockFromInt(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(ex.release)
+	}()
+	dropped, err := w.CloseWithContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 0 {
+		t.Fatalf("expected every announcement to be made, %d were dropped", dropped)
+	}
+	if st := w.Stat(); st.Provided != 3 {
+		t.Fatalf("expected 3 announcements, got %+v", st)
+	}
+	if err := w.HasBlock(blockFromInt(4)); err == nil {
+		t.Fatal("closed worker accepted a block")
+	}
+}
+
+func TestCloseWithContextDeadline(t *testing.T) {
+	ex := &blockingExchange{release: make(chan struct{})}
+	w := NewWorker(ex, Config{NumWorkers: 1})
+
+	for i := 0; i < 3; i++ {
+		if err := w.HasBlock(blockFromInt(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	dropped, err := w.CloseWithContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline error, got %v", err)
+	}
+	if dropped != 3 {
+		t.Fatalf("expected 3 dropped announcements, got %d", dropped)
+	}
+	if st := w.Stat(); st.Dropped != 3 {
+		t.Fatalf("expected Stats.Dropped to be 3, got %+v", st)
+	}
+}
+
+func TestAdaptiveWorkers(t *testing.T) {
+	ex := &blockingExchange{release: make(chan struct{})}
+	w := NewWorker(ex, Config{
+		Adaptive:      true,
+		MinWorkers:    1,
+		MaxWorkers:    4,
+		ScaleInterval: 5 * time.Millisecond,
+		TargetLatency: time.Millisecond,
+	})
+	defer w.Close()
+	if st := w.Stat(); st.Workers != 1 {
+		t.Fatalf("expected to start at MinWorkers, got %d workers", st.Workers)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := w.HasBlock(blockFromInt(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the workers to grow to the maximum", func() bool {
+		st := w.Stat()
+		return st.Workers == 4 && st.InFlight == 4
+	})
+
+	close(ex.release)
+	waitFor(t, "all announcements provided", func() bool {
+		return w.Stat().Provided == 10
+	})
+	waitFor(t, "the idle workers to shrink to the minimum", func() bool {
+		return w.Stat().Workers == 1
+	})
+}
+
+func TestLaneQueue(t *testing.T) {
+	var q laneQueue
+	low, normal, high := blockFromInt(1), blockFromInt(2), blockFromInt(3)
+	q.Push(low, PriorityLow)
+	q.Push(normal, PriorityNormal)
+	q.Push(high, PriorityHigh)
+	q.Push(low, PriorityHigh) // moves up, behind |high|
+	q.Push(high, PriorityLow) // stays up
+	if q.Len() != 3 {
+		t.Fatalf("expected 3 queued blocks, got %d", q.Len())
+	}
+	for i, want := range []*blocks.Block{high, low, normal} {
+		if b, _ := q.Pop(); b == nil || b.Key() != want.Key() {
+			t.Fatalf("block %d out of order", i)
+		}
+	}
+	if b, _ := q.Pop(); b != nil {
+		t.Fatal("expected an empty queue")
+	}
+}
+
+// orderingExchange records the order of the blocks it is told about, each
+// once |release| lets it through.
+type orderingExchange struct {
+	blockingExchange
+	order chan key.Key
+}
+
+func (e *orderingExchange) HasBlock(ctx context.Context, b *blocks.Block) error {
+	if err := e.blockingExchange.HasBlock(ctx, b); err != nil {
+		return err
+	}
+	e.order <- b.Key()
+	return nil
+}
+
+func TestPriorityLanes(t *testing.T) {
+	ex := &orderingExchange{blockingExchange{release: make(chan struct{})}, make(chan key.Key, 4)}
+	w := NewWorker(ex, Config{NumWorkers: 1})
+	defer w.Close()
+
+	first := blockFromInt(0)
+	if err := w.HasBlock(first); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first announcement", func() bool { return w.Stat().InFlight == 1 })
+	bulk1, bulk2, root := blockFromInt(1), blockFromInt(2), blockFromInt(3)
+	ctx := context.Background()
+	for _, b := range []*blocks.Block{bulk1, bulk2} {
+		if err := w.HasBlockPriority(ctx, b, nil, PriorityLow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.HasBlockPriority(ctx, root, nil, PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the blocks to queue", func() bool { return w.Stat().QueueDepth == 3 })
+
+	close(ex.release)
+	for i, want := range []*blocks.Block{first, root, bulk1, bulk2} {
+		select {
+		case k := <-ex.order:
+			if k != want.Key() {
+				t.Fatalf("announcement %d out of order", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for announcement %d", i)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	ex := &blockingExchange{release: make(chan struct{})}
+	defer close(ex.release)
+	w := NewWorker(ex, Config{NumWorkers: 1})
+	// answered while an announcement is under way.
+	if err := w.HasBlock(blockFromInt(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := w.Ping(context.Background()); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package blockstore
+
+import (
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// BatchingDatastore is implemented by datastores that can commit a group of
+// writes atomically. It mirrors the batching interface of later go-datastore
+// releases, which the vendored one predates.
+type BatchingDatastore interface {
+	ds.Datastore
+	Batch() (DatastoreBatch, error)
+}
+
+// DatastoreBatch accumulates writes that take effect together on Commit, or
+// not at all.
+type DatastoreBatch interface {
+	Put(key ds.Key, value interface{}) error
+	Delete(key ds.Key) error
+	Commit() error
+}
+
+// ApplyBatch stores |puts| and removes |deletes|. Duplicate keys are applied
+// once, and a key that is both put and deleted ends up deleted, as if the
+// puts were applied first. Deleting a key that isn't stored is not an error.
+//
+// If the datastore given to NewBlockstore is a BatchingDatastore, all of it
+// is committed in one batch, so readers of the datastore never observe a
+// partially applied set. Otherwise the operations are applied one at a time,
+// puts first: this is NOT atomic, and an error or cancelled context part way
+// through leaves whatever was applied until then in place.
+//
+// Either way, readers of this blockstore never observe a partial batch while
+// the call is in progress.
+func (bs *blockstore) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	if err := checkPuts(puts); err != nil {
+		return err
+	}
+	ps, dels := dedupeBatch(puts, deletes)
+
+	// exclusive, so the whole batch lands between two reads.
+	bs.swap.Lock()
+	defer bs.swap.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if bd, ok := bs.root.(BatchingDatastore); ok {
+		return applyAtomic(bd, bs.prefix.blocks, ps, dels)
+	}
+
+	for _, b := range ps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := bs.datastore.Put(b.Key().DsKey(), b.Data); err != nil {
+			return err
+		}
+	}
+	for _, k := range dels {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := bs.datastore.Delete(k.DsKey()); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// dedupeBatch returns the writes of an ApplyBatch of |puts| and |deletes|,
+// as it applies them: each key once, and puts of deleted keys left out.
+func dedupeBatch(puts []*blocks.Block, deletes []key.Key) ([]*blocks.Block, []key.Key) {
+	deleted := make(map[key.Key]struct{}, len(deletes))
+	var dels []key.Key
+	for _, k := range deletes {
+		if _, dup := deleted[k]; !dup {
+			deleted[k] = struct{}{}
+			dels = append(dels, k)
+		}
+	}
+	seen := make(map[key.Key]struct{}, len(puts))
+	var ps []*blocks.Block
+	for _, b := range puts {
+		k := b.Key()
+		if _, gone := deleted[k]; gone {
+			continue
+		}
+		if _, dup := seen[k]; !dup {
+			seen[k] = struct{}{}
+			ps = append(ps, b)
+		}
+	}
+	return ps, dels
+}
+
+// applyAtomic commits the writes to |d| directly, so keys must be prefixed
+// by hand, with |prefix|.
+func applyAtomic(d BatchingDatastore, prefix ds.Key, puts []*blocks.Block, deletes []key.Key) error {
+	batch, err := d.Batch()
+	if err != nil {
+		return err
+	}
+	for _, b := range puts {
+		if err := batch.Put(prefix.Child(b.Key().DsKey()), b.Data); err != nil {
+			return err
+		}
+	}
+	for _, k := range deletes {
+		if err := batch.Delete(prefix.Child(k.DsKey())); err != nil {
+			return err
+		}
+	}
+	return batch.Commit()
+}
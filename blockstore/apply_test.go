@@ -0,0 +1,133 @@
+package blockstore
+
+import (
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// batchingDS is a thread-safe datastore with all-or-nothing batches.
+type batchingDS struct {
+	ds.ThreadSafeDatastore
+	commits  int
+	failNext bool
+}
+
+func (d *batchingDS) Batch() (DatastoreBatch, error) {
+	return &testBatch{d: d}, nil
+}
+
+type testBatch struct {
+	d       *batchingDS
+	puts    map[ds.Key]interface{}
+	deletes []ds.Key
+}
+
+func (b *testBatch) Put(k ds.Key, v interface{}) error {
+	if b.puts == nil {
+		b.puts = make(map[ds.Key]interface{})
+	}
+	b.puts[k] = v
+	return nil
+}
+
+func (b *testBatch) Delete(k ds.Key) error {
+	b.deletes = append(b.deletes, k)
+	return nil
+}
+
+func (b *testBatch) Commit() error {
+	if b.d.failNext {
+		b.d.failNext = false
+		return errors.New("commit failed")
+	}
+	for k, v := range b.puts {
+		b.d.Put(k, v)
+	}
+	for _, k := range b.deletes {
+		b.d.Delete(k)
+	}
+	b.d.commits++
+	return nil
+}
+
+func TestApplyBatchAtomic(t *testing.T) {
+	d := &batchingDS{ThreadSafeDatastore: ds_sync.MutexWrap(ds.NewMapDatastore())}
+	bs := NewBlockstore(d)
+
+	old := blocks.NewBlock([]byte("old"))
+	if err := bs.Put(old); err != nil {
+		t.Fatal(err)
+	}
+	added := blocks.NewBlock([]byte("added"))
+	doomed := blocks.NewBlock([]byte("put then deleted"))
+
+	d.failNext = true
+	err := bs.ApplyBatch(context.Background(), []*blocks.Block{added}, []key.Key{old.Key()})
+	if err == nil {
+		t.Fatal("expected the commit error")
+	}
+	if has, _ := bs.Has(added.Key()); has {
+		t.Fatal("failed batch was partially applied")
+	}
+	if has, _ := bs.Has(old.Key()); !has {
+		t.Fatal("failed batch was partially applied")
+	}
+
+	err = bs.ApplyBatch(context.Background(),
+		[]*blocks.Block{added, added, doomed},
+		[]key.Key{old.Key(), doomed.Key(), old.Key()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.commits != 1 {
+		t.Fatalf("expected a single commit, got %d", d.commits)
+	}
+	expectHas(t, bs, added.Key(), true)
+	expectHas(t, bs, old.Key(), false)
+	expectHas(t, bs, doomed.Key(), false)
+}
+
+func TestApplyBatchSequentialFallback(t *testing.T) {
+	cd := &callbackDatastore{f: func() {}, ds: ds.NewMapDatastore()}
+	bs := NewBlockstore(ds_sync.MutexWrap(cd))
+
+	old := blocks.NewBlock([]byte("old"))
+	if err := bs.Put(old); err != nil {
+		t.Fatal(err)
+	}
+	added := blocks.NewBlock([]byte("added"))
+	doomed := blocks.NewBlock([]byte("put then deleted"))
+
+	err := bs.ApplyBatch(context.Background(),
+		[]*blocks.Block{added, doomed},
+		[]key.Key{old.Key(), doomed.Key(), key.Key("never stored")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHas(t, bs, added.Key(), true)
+	expectHas(t, bs, old.Key(), false)
+	expectHas(t, bs, doomed.Key(), false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := bs.ApplyBatch(ctx, []*blocks.Block{old}, nil); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func expectHas(t *testing.T, bs Blockstore, k key.Key, want bool) {
+	has, err := bs.Has(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has != want {
+		t.Fatalf("Has(%s) = %v, want %v", k, has, want)
+	}
+}
@@ -0,0 +1,117 @@
+package blockstore
+
+import (
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// DefaultBatchCount and DefaultBatchBytes are the thresholds at which a
+// Batch made by NewBatch flushes by itself: once it holds that many
+// operations, or that many bytes of block data.
+const (
+	DefaultBatchCount = 1024
+	DefaultBatchBytes = 16 << 20
+)
+
+var ErrBatchCommitted = errors.New("blockstore: batch already committed")
+
+// Batch accumulates Puts and Deletes to a blockstore and writes them with
+// ApplyBatch, mirroring the batches of datastores. Operations apply in the
+// order given: a block Put and then Deleted ends up deleted, and the other
+// way around, stored. The blocks are put in the order they were first Put
+// since they were last Deleted.
+//
+// A Batch flushes by itself once it holds MaxCount operations or MaxBytes of
+// block data, whichever comes first; zero means no limit. Each flush is one
+// ApplyBatch, so is atomic as that is, but the batch as a whole is only
+// atomic if it never flushes before Commit. A failed flush keeps its
+// operations, to be retried by the next. A Batch is safe for concurrent use.
+type Batch struct {
+	// MaxCount and MaxBytes must be set before use.
+	MaxCount int
+	MaxBytes int
+
+	ctx context.Context
+	bs  Blockstore
+
+	mu        sync.Mutex
+	staged    staged
+	committed bool
+}
+
+// NewBatch returns a Batch writing to |bs| with the default thresholds. Its
+// flushes use |ctx|.
+func NewBatch(ctx context.Context, bs Blockstore) *Batch {
+	return &Batch{
+		MaxCount: DefaultBatchCount,
+		MaxBytes: DefaultBatchBytes,
+		ctx:      ctx,
+		bs:       bs,
+		staged:   newStaged(),
+	}
+}
+
+// Put adds storing |blk| to the batch.
+func (b *Batch) Put(blk *blocks.Block) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.committed {
+		return ErrBatchCommitted
+	}
+	b.staged.put(blk)
+	return b.flushIfFullLocked()
+}
+
+// Delete adds removing |k| to the batch. As for ApplyBatch, deleting a key
+// that isn't stored is not an error.
+func (b *Batch) Delete(k key.Key) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.committed {
+		return ErrBatchCommitted
+	}
+	b.staged.del(k)
+	return b.flushIfFullLocked()
+}
+
+// Commit writes whatever the batch still holds. After it succeeds, the batch
+// accepts no more operations.
+func (b *Batch) Commit() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.committed {
+		return ErrBatchCommitted
+	}
+	if err := b.flushLocked(); err != nil {
+		return err
+	}
+	b.committed = true
+	return nil
+}
+
+func (b *Batch) flushIfFullLocked() error {
+	if b.MaxCount > 0 && b.staged.len() >= b.MaxCount {
+		return b.flushLocked()
+	}
+	if b.MaxBytes > 0 && b.staged.bytes >= b.MaxBytes {
+		return b.flushLocked()
+	}
+	return nil
+}
+
+func (b *Batch) flushLocked() error {
+	if b.staged.len() == 0 {
+		return nil
+	}
+	puts, deletes := b.staged.writes()
+	if err := b.bs.ApplyBatch(b.ctx, puts, deletes); err != nil {
+		return err
+	}
+	b.staged = newStaged()
+	return nil
+}
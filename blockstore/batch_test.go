@@ -0,0 +1,139 @@
+package blockstore
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestBatchFlushesOnCount(t *testing.T) {
+	d := &batchingDS{ThreadSafeDatastore: ds_sync.MutexWrap(ds.NewMapDatastore())}
+	bs := NewBlockstore(d)
+	b := NewBatch(context.Background(), bs)
+	b.MaxCount = 3
+
+	blks := []*blocks.Block{
+		blocks.NewBlock([]byte("one")),
+		blocks.NewBlock([]byte("two")),
+		blocks.NewBlock([]byte("three")),
+		blocks.NewBlock([]byte("four")),
+	}
+	for _, blk := range blks[:2] {
+		if err := b.Put(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.commits != 0 {
+		t.Fatal("batch flushed before it filled up")
+	}
+	expectHas(t, bs, blks[0].Key(), false)
+
+	if err := b.Put(blks[2]); err != nil {
+		t.Fatal(err)
+	}
+	if d.commits != 1 {
+		t.Fatalf("expected one flush once full, got %d", d.commits)
+	}
+	for _, blk := range blks[:3] {
+		expectHas(t, bs, blk.Key(), true)
+	}
+
+	if err := b.Put(blks[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(blks[0].Key()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if d.commits != 2 {
+		t.Fatalf("expected Commit to flush the rest, got %d flushes", d.commits)
+	}
+	expectHas(t, bs, blks[0].Key(), false)
+	expectHas(t, bs, blks[3].Key(), true)
+
+	if err := b.Put(blks[0]); err != ErrBatchCommitted {
+		t.Fatalf("expected ErrBatchCommitted, got %v", err)
+	}
+}
+
+func TestBatchFlushesOnBytes(t *testing.T) {
+	d := &batchingDS{ThreadSafeDatastore: ds_sync.MutexWrap(ds.NewMapDatastore())}
+	bs := NewBlockstore(d)
+	b := NewBatch(context.Background(), bs)
+	b.MaxCount = 0
+	b.MaxBytes = 10
+
+	if err := b.Put(blocks.NewBlock([]byte("12345"))); err != nil {
+		t.Fatal(err)
+	}
+	if d.commits != 0 {
+		t.Fatal("batch flushed before it filled up")
+	}
+	if err := b.Put(blocks.NewBlock([]byte("67890"))); err != nil {
+		t.Fatal(err)
+	}
+	if d.commits != 1 {
+		t.Fatalf("expected a flush at 10 bytes, got %d", d.commits)
+	}
+}
+
+func TestBatchOrder(t *testing.T) {
+	bs := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	deleted := blocks.NewBlock([]byte("put, then deleted"))
+	kept := blocks.NewBlock([]byte("deleted, then put"))
+	if err := bs.Put(kept); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBatch(context.Background(), bs)
+	for _, err := range []error{
+		b.Put(deleted),
+		b.Delete(deleted.Key()),
+		b.Delete(kept.Key()),
+		b.Put(kept),
+		b.Commit(),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectHas(t, bs, deleted.Key(), false)
+	expectHas(t, bs, kept.Key(), true)
+}
+
+func TestBatchRetriesFailedFlush(t *testing.T) {
+	d := &batchingDS{ThreadSafeDatastore: ds_sync.MutexWrap(ds.NewMapDatastore())}
+	bs := NewBlockstore(d)
+	b := NewBatch(context.Background(), bs)
+
+	blk := blocks.NewBlock([]byte("retried"))
+	if err := b.Put(blk); err != nil {
+		t.Fatal(err)
+	}
+	d.failNext = true
+	if err := b.Commit(); err == nil {
+		t.Fatal("expected the failed commit to be returned")
+	}
+	expectHas(t, bs, blk.Key(), false)
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expectHas(t, bs, blk.Key(), true)
+}
+
+func TestBatchReadOnly(t *testing.T) {
+	bs := ReadOnly(NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())))
+	b := NewBatch(context.Background(), bs)
+	if err := b.Put(blocks.NewBlock([]byte("nope"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
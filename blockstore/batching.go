@@ -0,0 +1,243 @@
+package blockstore
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var ErrBatchingWriterClosed = errors.New("blockstore: batching writer is closed")
+
+// NewBatchingWriter returns a blockstore that buffers Puts to |bs| and writes
+// them with a single PutMany once |maxBatch| blocks are buffered or the
+// oldest buffered block has waited |maxDelay|, whichever comes first.
+//
+// Reads through the returned blockstore see buffered blocks. A flush that
+// fails leaves its blocks buffered to be retried by the next one, which is
+// scheduled |maxDelay| later unless a Put comes first. Closing the
+// returned io.Closer flushes whatever is still buffered and returns the error
+// from doing so; Puts after Close fail with ErrBatchingWriterClosed.
+func NewBatchingWriter(bs Blockstore, maxBatch int, maxDelay time.Duration) (Blockstore, io.Closer) {
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+	w := &batchingWriter{
+		blockstore: bs,
+		maxBatch:   maxBatch,
+		maxDelay:   maxDelay,
+		buffered:   make(map[key.Key]*blocks.Block),
+	}
+	return w, w
+}
+
+type batchingWriter struct {
+	blockstore Blockstore
+	maxBatch   int
+	maxDelay   time.Duration
+
+	mu       sync.Mutex
+	buffered map[key.Key]*blocks.Block
+	order    []*blocks.Block // buffered blocks in the order they were Put
+	timer    *time.Timer     // non-nil while a timed flush is scheduled
+	closed   bool
+}
+
+func (w *batchingWriter) Put(b *blocks.Block) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.putLocked(b)
+}
+
+func (w *batchingWriter) PutMany(bs []*blocks.Block) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, b := range bs {
+		if err := w.putLocked(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *batchingWriter) putLocked(b *blocks.Block) error {
+	if w.closed {
+		return ErrBatchingWriterClosed
+	}
+	if _, ok := w.buffered[b.Key()]; !ok {
+		w.buffered[b.Key()] = b
+		w.order = append(w.order, b)
+	}
+	if len(w.order) >= w.maxBatch {
+		return w.flushLocked()
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.maxDelay, w.timedFlush)
+	}
+	return nil
+}
+
+func (w *batchingWriter) timedFlush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushLocked()
+}
+
+// flushLocked writes the buffered blocks. If that fails, they stay buffered
+// and another timed flush is scheduled, unless the writer is closed.
+func (w *batchingWriter) flushLocked() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.order) == 0 {
+		return nil
+	}
+	if err := w.blockstore.PutMany(w.order); err != nil {
+		if !w.closed {
+			w.timer = time.AfterFunc(w.maxDelay, w.timedFlush)
+		}
+		return err
+	}
+	w.buffered = make(map[key.Key]*blocks.Block)
+	w.order = nil
+	return nil
+}
+
+// Close flushes any buffered blocks and stops accepting new ones.
+func (w *batchingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return w.flushLocked()
+}
+
+func (w *batchingWriter) Get(k key.Key) (*blocks.Block, error) {
+	w.mu.Lock()
+	b, ok := w.buffered[k]
+	w.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+	return w.blockstore.Get(k)
+}
+
+func (w *batchingWriter) Has(k key.Key) (bool, error) {
+	w.mu.Lock()
+	_, ok := w.buffered[k]
+	w.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return w.blockstore.Has(k)
+}
+
+func (w *batchingWriter) GetChan(ks []key.Key) <-chan *blocks.Block {
+	out := make(chan *blocks.Block, 1)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			b, err := w.Get(k)
+			if err != nil {
+				continue
+			}
+			out <- b
+		}
+	}()
+	return out
+}
+
+func (w *batchingWriter) DeleteBlock(k key.Key) error {
+	w.mu.Lock()
+	_, wasBuffered := w.buffered[k]
+	if wasBuffered {
+		delete(w.buffered, k)
+		for i, b := range w.order {
+			if b.Key() == k {
+				w.order = append(w.order[:i], w.order[i+1:]...)
+				break
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	err := w.blockstore.DeleteBlock(k)
+	if wasBuffered && okOrNotFound(err) {
+		// it was only ever buffered, so there was nothing to delete.
+		return nil
+	}
+	return err
+}
+
+// AllKeysChan flushes buffered blocks first, so that they are listed.
+func (w *batchingWriter) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	w.mu.Lock()
+	err := w.flushLocked()
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return w.blockstore.AllKeysChan(ctx)
+}
+
+// AllKeys flushes buffered blocks first, so that they are listed.
+func (w *batchingWriter) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	w.mu.Lock()
+	err := w.flushLocked()
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return w.blockstore.AllKeys(ctx, q)
+}
+
+func (w *batchingWriter) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// buffered blocks predate the replacement, so they'd be removed by it
+	// anyway; drop them instead of writing them first.
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.buffered = make(map[key.Key]*blocks.Block)
+	w.order = nil
+	return w.blockstore.ReplaceAll(ctx, in)
+}
+
+func (w *batchingWriter) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// buffered blocks were Put first, so they go first.
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	return w.blockstore.ApplyBatch(ctx, puts, deletes)
+}
+
+// FindOrphanedMetadata flushes buffered blocks first, so that their metadata
+// isn't mistaken for orphans.
+func (w *batchingWriter) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	w.mu.Lock()
+	err := w.flushLocked()
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return w.blockstore.FindOrphanedMetadata(ctx)
+}
+
+func (w *batchingWriter) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return 0, err
+	}
+	return w.blockstore.PurgeOrphanedMetadata(ctx)
+}
@@ -0,0 +1,186 @@
+package blockstore
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	syncds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+)
+
+// countingBlockstore counts PutMany calls made to it.
+type countingBlockstore struct {
+	Blockstore
+	putManys chan int
+}
+
+func (c *countingBlockstore) PutMany(bs []*blocks.Block) error {
+	c.putManys <- len(bs)
+	return c.Blockstore.PutMany(bs)
+}
+
+func newCountingBlockstore() *countingBlockstore {
+	return &countingBlockstore{
+		Blockstore: NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore())),
+		putManys:   make(chan int, 10),
+	}
+}
+
+func TestBatchingWriterFlushesOnSize(t *testing.T) {
+	under := newCountingBlockstore()
+	bw, closer := NewBatchingWriter(under, 2, time.Hour)
+	defer closer.Close()
+
+	b1 := blocks.NewBlock([]byte("one"))
+	b2 := blocks.NewBlock([]byte("two"))
+	if err := bw.Put(b1); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := under.Has(b1.Key()); has {
+		t.Fatal("block was written before the batch filled up")
+	}
+	if b, err := bw.Get(b1.Key()); err != nil || b.Key() != b1.Key() {
+		t.Fatal("buffered block should be readable")
+	}
+	if has, _ := bw.Has(b1.Key()); !has {
+		t.Fatal("buffered block should be reported by Has")
+	}
+
+	if err := bw.Put(b2); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-under.putManys; n != 2 {
+		t.Fatalf("expected one PutMany of 2 blocks, got %d", n)
+	}
+	if has, _ := under.Has(b2.Key()); !has {
+		t.Fatal("full batch was not written")
+	}
+}
+
+func TestBatchingWriterFlushesOnDelay(t *testing.T) {
+	under := newCountingBlockstore()
+	bw, closer := NewBatchingWriter(under, 100, 10*time.Millisecond)
+	defer closer.Close()
+
+	if err := bw.Put(blocks.NewBlock([]byte("lonely"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-under.putManys:
+		if n != 1 {
+			t.Fatalf("expected a PutMany of 1 block, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch was never flushed")
+	}
+}
+
+func TestBatchingWriterCloseFlushes(t *testing.T) {
+	under := newCountingBlockstore()
+	bw, closer := NewBatchingWriter(under, 100, time.Hour)
+
+	b := blocks.NewBlock([]byte("pending"))
+	if err := bw.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := under.Has(b.Key()); !has {
+		t.Fatal("Close did not flush the pending batch")
+	}
+	if err := bw.Put(blocks.NewBlock([]byte("late"))); err != ErrBatchingWriterClosed {
+		t.Fatalf("expected ErrBatchingWriterClosed, got %v", err)
+	}
+}
+
+// flakyBlockstore fails its first |failures| PutMany calls, and DeleteBlock
+// with |deleteErr| if set.
+type flakyBlockstore struct {
+	Blockstore
+	mu        sync.Mutex
+	failures  int
+	deleteErr error
+}
+
+func (f *flakyBlockstore) PutMany(bs []*blocks.Block) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("disk busy")
+	}
+	return f.Blockstore.PutMany(bs)
+}
+
+func (f *flakyBlockstore) DeleteBlock(k key.Key) error {
+	if f.deleteErr != nil {
+		return f.deleteErr
+	}
+	return f.Blockstore.DeleteBlock(k)
+}
+
+func TestBatchingWriterRetriesTimedFlush(t *testing.T) {
+	under := &flakyBlockstore{Blockstore: NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore())), failures: 2}
+	bw, closer := NewBatchingWriter(under, 100, 5*time.Millisecond)
+	defer closer.Close()
+
+	b := blocks.NewBlock([]byte("retried"))
+	if err := bw.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if has, _ := under.Has(b.Key()); has {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed timed flush was never retried")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBatchingWriterDeleteBuffered(t *testing.T) {
+	bw, closer := NewBatchingWriter(NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore())), 100, time.Hour)
+	defer closer.Close()
+
+	b := blocks.NewBlock([]byte("never flushed"))
+	if err := bw.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.DeleteBlock(b.Key()); err != nil {
+		t.Fatalf("expected deleting a block only buffered to succeed, got %v", err)
+	}
+	if has, _ := bw.Has(b.Key()); has {
+		t.Fatal("expected the buffered block deleted")
+	}
+}
+
+func TestBatchingWriterDeleteBufferedError(t *testing.T) {
+	errDisk := errors.New("disk on fire")
+	under := &flakyBlockstore{Blockstore: NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore())), deleteErr: ErrNotFound}
+	bw, closer := NewBatchingWriter(under, 100, time.Hour)
+	defer closer.Close()
+
+	b := blocks.NewBlock([]byte("buffered"))
+	if err := bw.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.DeleteBlock(b.Key()); err != nil {
+		t.Fatalf("expected deleting a block only buffered to succeed, got %v", err)
+	}
+
+	under.deleteErr = errDisk
+	if err := bw.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.DeleteBlock(b.Key()); err != errDisk {
+		t.Fatalf("expected the blockstore's error, got %v", err)
+	}
+}
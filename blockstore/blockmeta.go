@@ -0,0 +1,127 @@
+package blockstore
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+)
+
+// ErrNoMetadata is returned by PutWithMeta and GetMeta for a blockstore
+// that is not a MetadataStore.
+var ErrNoMetadata = errors.New("blockstore: metadata not supported")
+
+// metaKind is the metadata kind holding each block's BlockMeta, JSON
+// encoded.
+const metaKind = "meta"
+
+// BlockMeta is what an application knows about a block besides its data,
+// attached to it by PutWithMeta. It is meant to be small: it is read whole
+// by GetMeta, and for every block a MetaFilter is asked about.
+type BlockMeta struct {
+	// Codec is the format of the block's data.
+	Codec key.Codec `json:"codec,omitempty"`
+	// Created is when the block was put.
+	Created time.Time `json:"created"`
+	// Labels are the application's own, uninterpreted.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// PutWithMeta puts |b| in |bs|, then |m| as its metadata, replacing any it
+// had. A zero Codec is taken from the block's key, and a zero Created is
+// now. Deleting the block leaves its metadata, for PurgeOrphanedMetadata,
+// unless DeleteMeta is called too.
+func PutWithMeta(bs Blockstore, b *blocks.Block, m BlockMeta) error {
+	ms, ok := bs.(MetadataStore)
+	if !ok {
+		return ErrNoMetadata
+	}
+	if m.Codec == 0 {
+		if c, err := b.Key().Cid(); err == nil {
+			m.Codec = c.Codec
+		}
+	}
+	if m.Created.IsZero() {
+		m.Created = time.Now()
+	}
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	// the block first, so that a failure leaves no metadata without one.
+	if err := bs.Put(b); err != nil {
+		return err
+	}
+	return ms.PutMetadata(metaKind, b.Key(), v)
+}
+
+// GetMeta returns the metadata PutWithMeta attached to |k|, or ErrNotFound
+// if it has none.
+func GetMeta(bs Blockstore, k key.Key) (BlockMeta, error) {
+	ms, ok := bs.(MetadataStore)
+	if !ok {
+		return BlockMeta{}, ErrNoMetadata
+	}
+	return getMeta(ms, k)
+}
+
+// DeleteMeta removes the metadata PutWithMeta attached to |k|, if any.
+func DeleteMeta(bs Blockstore, k key.Key) error {
+	ms, ok := bs.(MetadataStore)
+	if !ok {
+		return ErrNoMetadata
+	}
+	return ms.DeleteMetadata(metaKind, k)
+}
+
+func getMeta(ms MetadataStore, k key.Key) (BlockMeta, error) {
+	v, err := ms.GetMetadata(metaKind, k)
+	if err != nil {
+		return BlockMeta{}, err
+	}
+	var m BlockMeta
+	if err := json.Unmarshal(v, &m); err != nil {
+		return BlockMeta{}, err
+	}
+	return m, nil
+}
+
+// MetaFilter is a dsq.Filter for AllKeys queries, selecting the blocks
+// whose metadata in Store Match accepts. Blocks without metadata, or whose
+// metadata can't be read, are left out.
+type MetaFilter struct {
+	Store MetadataStore
+	Match func(BlockMeta) bool
+}
+
+func (f MetaFilter) Filter(e dsq.Entry) bool {
+	m, err := getMeta(f.Store, key.KeyFromDsKey(ds.NewKey(e.Key)))
+	return err == nil && f.Match(m)
+}
+
+// HasCodec returns a MetaFilter Match accepting blocks in |codec|.
+func HasCodec(codec key.Codec) func(BlockMeta) bool {
+	return func(m BlockMeta) bool { return m.Codec == codec }
+}
+
+// HasLabel returns a MetaFilter Match accepting blocks labelled |name|
+// with |value|.
+func HasLabel(name, value string) func(BlockMeta) bool {
+	return func(m BlockMeta) bool {
+		v, ok := m.Labels[name]
+		return ok && v == value
+	}
+}
+
+// CreatedBetween returns a MetaFilter Match accepting blocks created from
+// |from| up to, and not including, |to|. A zero bound is unbounded.
+func CreatedBetween(from, to time.Time) func(BlockMeta) bool {
+	return func(m BlockMeta) bool {
+		return !m.Created.Before(from) && (to.IsZero() || m.Created.Before(to))
+	}
+}
@@ -0,0 +1,94 @@
+package blockstore
+
+import (
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestPutWithMeta(t *testing.T) {
+	bs := NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	b := blocks.NewBlock([]byte("labelled"))
+
+	before := time.Now()
+	if err := PutWithMeta(bs, b, BlockMeta{Labels: map[string]string{"app": "notes"}}); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Has(b.Key()); !has {
+		t.Fatal("expected the block stored")
+	}
+	m, err := GetMeta(bs, b.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Codec != key.DagProtobuf {
+		t.Fatalf("expected the codec of the key, got %#x", m.Codec)
+	}
+	if m.Created.Before(before) || m.Created.After(time.Now()) {
+		t.Fatalf("expected the time of the put, got %v", m.Created)
+	}
+	if m.Labels["app"] != "notes" {
+		t.Fatalf("expected the labels kept, got %v", m.Labels)
+	}
+
+	if _, err := GetMeta(bs, blocks.NewBlock([]byte("plain")).Key()); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := DeleteMeta(bs, b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetMeta(bs, b.Key()); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound after DeleteMeta, got %v", err)
+	}
+
+	if err := PutWithMeta(ReadOnly(bs), b, BlockMeta{}); err != ErrNoMetadata {
+		t.Fatalf("expected ErrNoMetadata, got %v", err)
+	}
+}
+
+func TestMetaFilter(t *testing.T) {
+	bs := NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	day := time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)
+	put := func(data string, m BlockMeta) key.Key {
+		b := blocks.NewBlock([]byte(data))
+		if err := PutWithMeta(bs, b, m); err != nil {
+			t.Fatal(err)
+		}
+		return b.Key()
+	}
+	notes := put("a note", BlockMeta{Created: day, Labels: map[string]string{"app": "notes"}})
+	photo := put("a photo", BlockMeta{Codec: key.Raw, Created: day.Add(48 * time.Hour), Labels: map[string]string{"app": "photos"}})
+	if err := bs.Put(blocks.NewBlock([]byte("no metadata"))); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := bs.(MetadataStore)
+	for _, c := range []struct {
+		name  string
+		match func(BlockMeta) bool
+		want  []key.Key
+	}{
+		{"label", HasLabel("app", "notes"), []key.Key{notes}},
+		{"codec", HasCodec(key.Raw), []key.Key{photo}},
+		{"created", CreatedBetween(day.Add(time.Hour), time.Time{}), []key.Key{photo}},
+		{"created before", CreatedBetween(time.Time{}, day.Add(time.Hour)), []key.Key{notes}},
+	} {
+		ch, err := bs.AllKeys(context.Background(), dsq.Query{
+			Filters: []dsq.Filter{MetaFilter{Store: ms, Match: c.match}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := collect(ch)
+		if len(got) != len(c.want) || got[0] != c.want[0] {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
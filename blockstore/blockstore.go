@@ -4,6 +4,8 @@ package blockstore
 
 import (
 	"errors"
+	"strings"
+	"sync"
 
 	blocks "github.com/ipfs/go-blocks"
 	key "github.com/ipfs/go-blocks/key"
@@ -11,13 +13,32 @@ import (
 	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
 	dsns "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/namespace"
 	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
-	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
 	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
 // BlockPrefix namespaces blockstore datastores
 var BlockPrefix = ds.NewKey("blocks")
 
+// StagingPrefix namespaces blocks staged by ReplaceAll. It must not share a
+// string prefix with BlockPrefix, or staged blocks would leak into queries.
+var StagingPrefix = ds.NewKey("staging").Child(BlockPrefix)
+
+// QuarantinePrefix namespaces blocks set aside by Quarantine.
+var QuarantinePrefix = ds.NewKey("quarantine").Child(BlockPrefix)
+
+// MetadataPrefix namespaces per-block metadata kept alongside the blocks.
+// Each kind of metadata has its own child namespace, keyed by the b58 encoded
+// block key: /metadata/blocks/<kind>/<b58 key>.
+var MetadataPrefix = ds.NewKey("metadata").Child(BlockPrefix)
+
+// IndexPrefix namespaces the secondary indexes of an Indexed blockstore. See
+// NewIndexed for their layout.
+var IndexPrefix = ds.NewKey("index").Child(BlockPrefix)
+
+// JournalPrefix namespaces the write-ahead journal of a Journaled
+// blockstore.
+var JournalPrefix = ds.NewKey("journal").Child(BlockPrefix)
+
 var ValueTypeMismatch = errors.New("The retrieved value is not a Block")
 
 var ErrNotFound = errors.New("blockstore: block not found")
@@ -28,27 +49,91 @@ type Blockstore interface {
 	Has(key.Key) (bool, error)
 	Get(key.Key) (*blocks.Block, error)
 	Put(*blocks.Block) error
+	PutMany([]*blocks.Block) error
 
 	GetChan([]key.Key) <-chan *blocks.Block
 	AllKeysChan(ctx context.Context) (<-chan key.Key, error)
+	// AllKeys is AllKeysChan restricted, ordered and paginated by |q|. See
+	// blockstore.AllKeys for how the query applies.
+	AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error)
+
+	// ReplaceAll atomically replaces the contents of the blockstore with the
+	// blocks received from |in|. See blockstore.ReplaceAll for details.
+	ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error
+
+	// ApplyBatch stores |puts| and removes |deletes| as one operation,
+	// atomically if the datastore supports it. See blockstore.ApplyBatch.
+	ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error
+
+	// FindOrphanedMetadata streams the keys that have metadata but no block,
+	// and PurgeOrphanedMetadata removes that metadata. ListOrphanedMetadata
+	// tells a complete scan from one cut short.
+	FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error)
+	PurgeOrphanedMetadata(ctx context.Context) (int, error)
 }
 
 func NewBlockstore(d ds.ThreadSafeDatastore) Blockstore {
-	dd := dsns.Wrap(d, BlockPrefix)
+	return newBlockstore(d, prefixes{
+		blocks:     BlockPrefix,
+		staging:    StagingPrefix,
+		quarantine: QuarantinePrefix,
+		metadata:   MetadataPrefix,
+		index:      IndexPrefix,
+		journal:    JournalPrefix,
+	})
+}
+
+func newBlockstore(d ds.ThreadSafeDatastore, p prefixes) *blockstore {
 	return &blockstore{
-		datastore: dd,
+		root:       d,
+		datastore:  dsns.Wrap(d, p.blocks),
+		staging:    dsns.Wrap(d, p.staging),
+		quarantine: dsns.Wrap(d, p.quarantine),
+		metadata:   dsns.Wrap(d, p.metadata),
+		prefix:     p,
 	}
 }
 
+// prefixes are where a blockstore keeps its namespaces in the datastore:
+// BlockPrefix and the others, or those below a NamespacedBlockstore's
+// prefix.
+type prefixes struct {
+	blocks, staging, quarantine, metadata, index, journal ds.Key
+	// namespaced is set for a NamespacedBlockstore, which does not have the
+	// datastore to itself.
+	namespaced bool
+}
+
 type blockstore struct {
+	// root is the datastore as given, for capabilities (like batching) that
+	// the namespace wrapper hides.
+	root      ds.Datastore
 	datastore ds.Datastore
 	// cant be ThreadSafeDatastore cause namespace.Datastore doesnt support it.
 	// we do check it on `NewBlockstore` though.
+
+	// staging holds the incoming set of an in-progress ReplaceAll.
+	staging ds.Datastore
+	// quarantine holds corrupt blocks removed from the live set.
+	quarantine ds.Datastore
+	// metadata holds per-block metadata, laid out as for MetadataPrefix.
+	metadata ds.Datastore
+	// prefix is where the namespaces above are in root.
+	prefix prefixes
+
+	// swap is held for writing while ReplaceAll switches the live set over,
+	// so that readers observe either the old or the new contents.
+	swap sync.RWMutex
+	// replacing serializes calls to ReplaceAll.
+	replacing sync.Mutex
 }
 
 func (bs *blockstore) Get(k key.Key) (*blocks.Block, error) {
+	bs.swap.RLock()
+	defer bs.swap.RUnlock()
+
 	maybeData, err := bs.datastore.Get(k.DsKey())
-	if err == ds.ErrNotFound {
+	if errors.Is(err, ds.ErrNotFound) {
 		return nil, ErrNotFound
 	}
 	if err != nil {
@@ -59,7 +144,7 @@ func (bs *blockstore) Get(k key.Key) (*blocks.Block, error) {
 		return nil, ValueTypeMismatch
 	}
 
-	return blocks.NewBlockWithHash(bdata, mh.Multihash(k))
+	return blocks.NewBlockWithKey(bdata, k)
 }
 
 func (bs *blockstore) GetChan(ks []key.Key) <-chan *blocks.Block {
@@ -80,6 +165,12 @@ func (bs *blockstore) GetChan(ks []key.Key) <-chan *blocks.Block {
 }
 
 func (bs *blockstore) Put(block *blocks.Block) error {
+	if block.Lazy() {
+		return blocks.ErrLazyBlock
+	}
+	bs.swap.RLock()
+	defer bs.swap.RUnlock()
+
 	k := block.Key().DsKey()
 
 	// Has is cheaper than Put, so see if we already have it
@@ -90,11 +181,50 @@ func (bs *blockstore) Put(block *blocks.Block) error {
 	return bs.datastore.Put(k, block.Data)
 }
 
+// PutMany stores each of |blks|, stopping at the first error. The underlying
+// datastore has no batch writes, but the whole call is ordered with respect
+// to ReplaceAll.
+func (bs *blockstore) PutMany(blks []*blocks.Block) error {
+	if err := checkPuts(blks); err != nil {
+		return err
+	}
+	bs.swap.RLock()
+	defer bs.swap.RUnlock()
+
+	for _, b := range blks {
+		k := b.Key().DsKey()
+		if exists, err := bs.datastore.Has(k); err == nil && exists {
+			continue // already stored.
+		}
+		if err := bs.datastore.Put(k, b.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPuts returns blocks.ErrLazyBlock if any of |blks| has no Data to
+// store.
+func checkPuts(blks []*blocks.Block) error {
+	for _, b := range blks {
+		if b.Lazy() {
+			return blocks.ErrLazyBlock
+		}
+	}
+	return nil
+}
+
 func (bs *blockstore) Has(k key.Key) (bool, error) {
+	bs.swap.RLock()
+	defer bs.swap.RUnlock()
+
 	return bs.datastore.Has(k.DsKey())
 }
 
 func (s *blockstore) DeleteBlock(k key.Key) error {
+	s.swap.RLock()
+	defer s.swap.RUnlock()
+
 	return s.datastore.Delete(k.DsKey())
 }
 
@@ -103,12 +233,22 @@ func (s *blockstore) DeleteBlock(k key.Key) error {
 //
 // AllKeysChan respects context
 func (bs *blockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return bs.AllKeys(ctx, dsq.Query{})
+}
+
+// AllKeys streams the keys of the blockstore selected by |q|. Its Prefix and
+// Filters apply to block keys as given by key.Key.DsKey, without the
+// blockstore's namespace, and Offset and Limit count only valid block keys.
+// q.KeysOnly is implied. Orders are applied in memory, so an ordered query
+// buffers every matching key before sending the first.
+//
+// AllKeys respects context
+func (bs *blockstore) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
 
 	// KeysOnly, because that would be _a lot_ of data.
-	q := dsq.Query{KeysOnly: true}
-	// datastore/namespace does *NOT* fix up Query.Prefix
-	q.Prefix = BlockPrefix.String()
-	res, err := bs.datastore.Query(q)
+	// datastore/namespace does *NOT* fix up Query.Prefix, and applies
+	// nothing else correctly on top of it, so do the rest ourselves.
+	res, err := bs.datastore.Query(dsq.Query{Prefix: bs.prefix.blocks.String(), KeysOnly: true})
 	if err != nil {
 		return nil, err
 	}
@@ -123,18 +263,21 @@ func (bs *blockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
 				return k, false
 			}
 			if e.Error != nil {
+				reportListError(ctx, e.Error)
 				return k, false
 			}
 
 			// need to convert to key.Key using key.KeyFromDsKey.
 			k = key.KeyFromDsKey(ds.NewKey(e.Key))
 
-			// key must be a multihash. else ignore it.
-			_, err := mh.Cast([]byte(k))
-			if err != nil {
+			// key must be a cid (if only a multihash). else ignore it.
+			if _, err := k.Cid(); err != nil {
 				return "", true
 			}
 
+			if !MatchesQuery(q, k) {
+				return "", true
+			}
 			return k, true
 		}
 	}
@@ -146,22 +289,87 @@ func (bs *blockstore) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
 			close(output)
 		}()
 
-		for {
-			k, ok := get()
-			if !ok {
-				return
-			}
-			if k == "" {
-				continue
-			}
+		QueryKeys(ctx, output, q, get)
+	}()
+
+	return output, nil
+}
 
-			select {
-			case <-ctx.Done():
-				return
-			case output <- k:
+// MatchesQuery applies the Prefix and Filters of |q| to |k|.
+func MatchesQuery(q dsq.Query, k key.Key) bool {
+	e := dsq.Entry{Key: k.DsKey().String()}
+	if q.Prefix != "" && !strings.HasPrefix(e.Key, q.Prefix) {
+		return false
+	}
+	for _, f := range q.Filters {
+		if !f.Filter(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryKeys sends to |out| the keys |get| returns, applying the Orders,
+// Offset and Limit of |q|, until it returns false or |ctx| is done. |get|
+// returns "" for a key to skip. Orders are applied in memory, so an ordered
+// query buffers every key before sending the first. |out| is left open.
+func QueryKeys(ctx context.Context, out chan<- key.Key, q dsq.Query, get func() (key.Key, bool)) {
+	next := get
+	if len(q.Orders) > 0 {
+		sorted := sortedKeys(q.Orders, get)
+		next = func() (key.Key, bool) {
+			if len(sorted) == 0 {
+				return "", false
 			}
+			k := sorted[0]
+			sorted = sorted[1:]
+			return k, true
 		}
-	}()
+	}
 
-	return output, nil
+	skipped, sent := 0, 0
+	for {
+		k, ok := next()
+		if !ok {
+			return
+		}
+		if k == "" {
+			continue
+		}
+		if skipped < q.Offset {
+			skipped++
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case out <- k:
+		}
+		if sent++; q.Limit > 0 && sent >= q.Limit {
+			return
+		}
+	}
+}
+
+// sortedKeys drains |get| and sorts the keys by |orders|, applied in turn.
+func sortedKeys(orders []dsq.Order, get func() (key.Key, bool)) []key.Key {
+	var entries []dsq.Entry
+	for {
+		k, ok := get()
+		if !ok {
+			break
+		}
+		if k != "" {
+			entries = append(entries, dsq.Entry{Key: k.DsKey().String()})
+		}
+	}
+	for _, o := range orders {
+		o.Sort(entries)
+	}
+	keys := make([]key.Key, len(entries))
+	for i, e := range entries {
+		keys[i] = key.KeyFromDsKey(ds.NewKey(e.Key))
+	}
+	return keys
 }
@@ -3,6 +3,9 @@ package blockstore
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
 	"testing"
 
 	blocks "github.com/ipfs/go-blocks"
@@ -301,3 +304,87 @@ func (c *queryTestDS) Query(q dsq.Query) (dsq.Results, error) {
 	}
 	return c.ds.Query(q)
 }
+
+// byKey orders query entries by key.
+type byKey struct{}
+
+func (byKey) Sort(es []dsq.Entry) {
+	sort.Sort(entriesByKey(es))
+}
+
+type entriesByKey []dsq.Entry
+
+func (es entriesByKey) Len() int           { return len(es) }
+func (es entriesByKey) Less(i, j int) bool { return es[i].Key < es[j].Key }
+func (es entriesByKey) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
+
+func TestAllKeysQuery(t *testing.T) {
+	bs, keys := newBlockStoreWithKeys(t, nil, 10)
+	sorted := append([]key.Key(nil), keys...)
+	sort.Sort(key.KeySlice(sorted))
+	ctx := context.Background()
+
+	ch, err := bs.AllKeys(ctx, dsq.Query{Orders: []dsq.Order{byKey{}}, Offset: 3, Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := collect(ch)
+	if len(page) != 4 {
+		t.Fatalf("expected a page of 4 keys, got %d", len(page))
+	}
+	for i, k := range page {
+		if k != sorted[3+i] {
+			t.Fatalf("key %d of the page out of order", i)
+		}
+	}
+
+	// every sha256 multihash starts with 0x12 0x20.
+	ch, _ = bs.AllKeys(ctx, dsq.Query{Prefix: "/\x12\x20"})
+	if got := collect(ch); len(got) != 10 {
+		t.Fatalf("expected all 10 keys under the sha256 prefix, got %d", len(got))
+	}
+	ch, _ = bs.AllKeys(ctx, dsq.Query{Prefix: "/\x11"})
+	if got := collect(ch); len(got) != 0 {
+		t.Fatalf("expected no keys under the sha1 prefix, got %d", len(got))
+	}
+
+	ch, _ = bs.AllKeys(ctx, dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.Equal, Key: keys[5].DsKey().String()}}})
+	if got := collect(ch); len(got) != 1 || got[0] != keys[5] {
+		t.Fatalf("filter selected %v", got)
+	}
+}
+
+// expectLazyRefused checks that every write of |bs| refuses a block made by
+// NewLazyBlock, and stores nothing under its key.
+func expectLazyRefused(t *testing.T, bs Blockstore) {
+	data := []byte("streamed, not in memory")
+	k := blocks.NewBlock(data).Key()
+	lazy, err := blocks.NewLazyBlock(k, int64(len(data)), func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan *blocks.Block, 1)
+	in <- lazy
+	close(in)
+	writes := map[string]func() error{
+		"Put":        func() error { return bs.Put(lazy) },
+		"PutMany":    func() error { return bs.PutMany([]*blocks.Block{lazy}) },
+		"ApplyBatch": func() error { return bs.ApplyBatch(context.Background(), []*blocks.Block{lazy}, nil) },
+		"ReplaceAll": func() error { return bs.ReplaceAll(context.Background(), in) },
+	}
+	for name, write := range writes {
+		if err := write(); err != blocks.ErrLazyBlock {
+			t.Fatalf("expected %s to return ErrLazyBlock, got %v", name, err)
+		}
+	}
+	if has, _ := bs.Has(k); has {
+		t.Fatal("expected nothing stored for a lazy block")
+	}
+}
+
+func TestLazyBlocksRefused(t *testing.T) {
+	expectLazyRefused(t, NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())))
+}
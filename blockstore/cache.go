@@ -0,0 +1,364 @@
+package blockstore
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	bloom "github.com/ipfs/go-blocks/bloom"
+	key "github.com/ipfs/go-blocks/key"
+
+	lru "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/hashicorp/golang-lru"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// CacheMode selects when writes through a CachedBlockstore reach the
+// underlying blockstore.
+type CacheMode int
+
+const (
+	// WriteThrough writes every Put to the underlying blockstore before
+	// returning, and caches the block.
+	WriteThrough CacheMode = iota
+	// WriteBack caches the block and defers the write, batching Puts as
+	// NewBatchingWriter does. Writes not yet flushed are lost on a crash.
+	WriteBack
+)
+
+// CacheOpts configures CachedBlockstore.
+type CacheOpts struct {
+	// BlockCacheSize is the number of recently used blocks kept in memory.
+	BlockCacheSize int
+	// HasCacheSize is the number of recent Has results, positive or
+	// negative, kept in memory.
+	HasCacheSize int
+	// HasBloomFilterSize, if positive, is the size in bytes of a bloom filter
+	// over every stored key, which answers Has and Get for keys that are
+	// definitely not stored without reaching the datastore. It is built by
+	// listing the keys in the background, and only used if the listing
+	// completes; see ListKeys.
+	HasBloomFilterSize int
+
+	// SkipExistingWrites makes Put, PutMany and ApplyBatch check Has, and
+	// so the caches above, before writing each block, and leave out those
+	// already stored. The writes left out are counted; see WriteDeduper.
+	SkipExistingWrites bool
+
+	Mode CacheMode
+	// WriteBackBatch and WriteBackDelay bound how long WriteBack mode defers
+	// writes; see NewBatchingWriter.
+	WriteBackBatch int
+	WriteBackDelay time.Duration
+}
+
+// DefaultCacheOpts returns a CacheOpts with reasonable defaults.
+func DefaultCacheOpts() CacheOpts {
+	return CacheOpts{
+		BlockCacheSize:     256,
+		HasCacheSize:       4096,
+		HasBloomFilterSize: 512 << 10,
+		Mode:               WriteThrough,
+		WriteBackBatch:     128,
+		WriteBackDelay:     time.Second,
+	}
+}
+
+var errInvalidCacheSize = errors.New("blockstore: cache sizes must be positive")
+
+// WriteDeduper is implemented by the blockstores CachedBlockstore returns.
+type WriteDeduper interface {
+	// SkippedWrites returns how many block writes were left out because
+	// the block was already stored. See CacheOpts.SkipExistingWrites.
+	SkippedWrites() uint64
+}
+
+// CachedBlockstore returns a blockstore that keeps recently used blocks and
+// Has results of |bs| in memory, so that repeated reads of the same keys do
+// not reach the datastore.
+//
+// In WriteBack mode the returned blockstore also implements io.Closer, and
+// must be closed to flush the writes it still holds.
+func CachedBlockstore(bs Blockstore, opts CacheOpts) (Blockstore, error) {
+	if opts.BlockCacheSize <= 0 || opts.HasCacheSize <= 0 {
+		return nil, errInvalidCacheSize
+	}
+	blockCache, err := lru.New(opts.BlockCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	hasCache, err := lru.New(opts.HasCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	c := &cached{
+		blockstore: bs,
+		blocks:     blockCache,
+		has:        hasCache,
+		dedup:      opts.SkipExistingWrites,
+		bloomDone:  make(chan struct{}),
+	}
+	if opts.Mode == WriteBack {
+		c.blockstore, c.closer = NewBatchingWriter(bs, opts.WriteBackBatch, opts.WriteBackDelay)
+	}
+	if opts.HasBloomFilterSize > 0 {
+		c.bloom = bloom.NewFilter(opts.HasBloomFilterSize)
+		go c.buildBloom(context.Background())
+	} else {
+		close(c.bloomDone)
+	}
+	if c.closer != nil {
+		return &closingCache{c}, nil
+	}
+	return c, nil
+}
+
+type cached struct {
+	blockstore Blockstore
+	// closer flushes deferred writes in WriteBack mode.
+	closer io.Closer
+
+	blocks *lru.Cache // key.Key -> *blocks.Block
+	has    *lru.Cache // key.Key -> bool
+
+	// dedup leaves out writes of stored blocks, counting them in skipped.
+	dedup   bool
+	skipped uint64 // atomic
+
+	// bloom holds every key stored, once bloomReady is set. Keys written
+	// while it is being built are added too, so none are missed.
+	bloomMu    sync.Mutex // bloom.Filter isn't safe for concurrent use
+	bloom      bloom.Filter
+	bloomReady int32         // atomic
+	bloomDone  chan struct{} // closed when the build ends, well or not
+}
+
+func (c *cached) buildBloom(ctx context.Context) {
+	defer close(c.bloomDone)
+	ch, done, err := ListKeys(ctx, c.blockstore, dsq.Query{})
+	if err != nil {
+		return
+	}
+	for k := range ch {
+		c.addToBloom(k)
+	}
+	// a filter missing some stored keys would hide them from Get and Has.
+	if done() == nil {
+		atomic.StoreInt32(&c.bloomReady, 1)
+	}
+}
+
+func (c *cached) addToBloom(k key.Key) {
+	if c.bloom == nil {
+		return
+	}
+	c.bloomMu.Lock()
+	c.bloom.Add([]byte(k))
+	c.bloomMu.Unlock()
+}
+
+// definitelyMissing reports whether the bloom filter rules out |k|.
+func (c *cached) definitelyMissing(k key.Key) bool {
+	if atomic.LoadInt32(&c.bloomReady) == 0 {
+		return false
+	}
+	c.bloomMu.Lock()
+	defer c.bloomMu.Unlock()
+	return !c.bloom.Find([]byte(k))
+}
+
+// closingCache is a cached blockstore that must be closed.
+type closingCache struct {
+	*cached
+}
+
+func (c *closingCache) Close() error {
+	return c.closer.Close()
+}
+
+func (c *cached) forget(k key.Key) {
+	c.blocks.Remove(k)
+	c.has.Remove(k)
+}
+
+func (c *cached) remember(b *blocks.Block) {
+	c.blocks.Add(b.Key(), b)
+	c.has.Add(b.Key(), true)
+	c.addToBloom(b.Key())
+}
+
+func (c *cached) Get(k key.Key) (*blocks.Block, error) {
+	if b, ok := c.blocks.Get(k); ok {
+		return b.(*blocks.Block), nil
+	}
+	if has, ok := c.has.Get(k); ok && !has.(bool) {
+		return nil, ErrNotFound
+	}
+	if c.definitelyMissing(k) {
+		return nil, ErrNotFound
+	}
+	b, err := c.blockstore.Get(k)
+	switch {
+	case err == nil:
+		c.remember(b)
+	case errors.Is(err, ErrNotFound):
+		c.has.Add(k, false)
+	}
+	return b, err
+}
+
+func (c *cached) Has(k key.Key) (bool, error) {
+	if _, ok := c.blocks.Get(k); ok {
+		return true, nil
+	}
+	if has, ok := c.has.Get(k); ok {
+		return has.(bool), nil
+	}
+	if c.definitelyMissing(k) {
+		return false, nil
+	}
+	has, err := c.blockstore.Has(k)
+	if err == nil {
+		c.has.Add(k, has)
+	}
+	return has, err
+}
+
+func (c *cached) GetChan(ks []key.Key) <-chan *blocks.Block {
+	out := make(chan *blocks.Block, 1)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			if b, err := c.Get(k); err == nil {
+				out <- b
+			}
+		}
+	}()
+	return out
+}
+
+func (c *cached) SkippedWrites() uint64 {
+	return atomic.LoadUint64(&c.skipped)
+}
+
+// unstored returns the blocks of |bs| not known to be stored, if c.dedup,
+// counting the others as skipped.
+func (c *cached) unstored(bs []*blocks.Block) []*blocks.Block {
+	if !c.dedup {
+		return bs
+	}
+	out := bs[:0:0]
+	for _, b := range bs {
+		if has, err := c.Has(b.Key()); err == nil && has {
+			atomic.AddUint64(&c.skipped, 1)
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func (c *cached) Put(b *blocks.Block) error {
+	if len(c.unstored([]*blocks.Block{b})) == 0 {
+		return nil
+	}
+	// before the write, so that a racing Has can't be told it's missing.
+	c.addToBloom(b.Key())
+	if err := c.blockstore.Put(b); err != nil {
+		c.forget(b.Key())
+		return err
+	}
+	c.remember(b)
+	return nil
+}
+
+func (c *cached) PutMany(bs []*blocks.Block) error {
+	bs = c.unstored(bs)
+	if len(bs) == 0 {
+		return nil
+	}
+	for _, b := range bs {
+		c.addToBloom(b.Key())
+	}
+	if err := c.blockstore.PutMany(bs); err != nil {
+		// the write may have been partly applied.
+		for _, b := range bs {
+			c.forget(b.Key())
+		}
+		return err
+	}
+	for _, b := range bs {
+		c.remember(b)
+	}
+	return nil
+}
+
+func (c *cached) DeleteBlock(k key.Key) error {
+	c.forget(k)
+	err := c.blockstore.DeleteBlock(k)
+	if err == nil {
+		c.has.Add(k, false)
+	}
+	return err
+}
+
+func (c *cached) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return c.blockstore.AllKeysChan(ctx)
+}
+
+func (c *cached) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	return c.blockstore.AllKeys(ctx, q)
+}
+
+func (c *cached) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	defer func() {
+		c.blocks.Purge()
+		c.has.Purge()
+	}()
+	if c.bloom == nil {
+		return c.blockstore.ReplaceAll(ctx, in)
+	}
+
+	// the bloom filter must learn the new keys before any can be read.
+	tee := make(chan *blocks.Block)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(tee)
+		for b := range in {
+			c.addToBloom(b.Key())
+			select {
+			case tee <- b:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return c.blockstore.ReplaceAll(ctx, tee)
+}
+
+func (c *cached) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	// a stored block left out stays stored, or is deleted, as it would be
+	// if written again.
+	puts = c.unstored(puts)
+	// forget everything touched first; a failed batch may be partly applied.
+	for _, b := range puts {
+		c.forget(b.Key())
+		c.addToBloom(b.Key())
+	}
+	for _, k := range deletes {
+		c.forget(k)
+	}
+	return c.blockstore.ApplyBatch(ctx, puts, deletes)
+}
+
+func (c *cached) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	return c.blockstore.FindOrphanedMetadata(ctx)
+}
+
+func (c *cached) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	return c.blockstore.PurgeOrphanedMetadata(ctx)
+}
@@ -0,0 +1,236 @@
+package blockstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	syncds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestCachedBlockstoreRejectsBadSizes(t *testing.T) {
+	bs := NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore()))
+	if _, err := CachedBlockstore(bs, CacheOpts{}); err == nil {
+		t.Fatal("expected an error for zero cache sizes")
+	}
+}
+
+func TestCachedBlockstoreServesRepeatReads(t *testing.T) {
+	hits := 0
+	cd := &callbackDatastore{f: func() { hits++ }, ds: ds.NewMapDatastore()}
+	cbs, err := CachedBlockstore(NewBlockstore(syncds.MutexWrap(cd)), DefaultCacheOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock([]byte("cached"))
+	missing := blocks.NewBlock([]byte("missing")).Key()
+	if err := cbs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := cbs.Has(missing); has {
+		t.Fatal("unexpected block")
+	}
+
+	hits = 0
+	for i := 0; i < 3; i++ {
+		if got, err := cbs.Get(b.Key()); err != nil || string(got.Data) != "cached" {
+			t.Fatalf("unexpected read %v", err)
+		}
+		if has, _ := cbs.Has(b.Key()); !has {
+			t.Fatal("block missing")
+		}
+		if has, _ := cbs.Has(missing); has {
+			t.Fatal("unexpected block")
+		}
+	}
+	if hits != 0 {
+		t.Fatalf("repeat reads hit the datastore %d times", hits)
+	}
+
+	if err := cbs.DeleteBlock(b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cbs.Get(b.Key()); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestCachedBlockstoreWriteBack(t *testing.T) {
+	d := ds.NewMapDatastore()
+	opts := DefaultCacheOpts()
+	opts.Mode = WriteBack
+	opts.WriteBackDelay = time.Hour
+	cbs, err := CachedBlockstore(NewBlockstore(syncds.MutexWrap(d)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock([]byte("deferred"))
+	if err := cbs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	dsk := BlockPrefix.Child(b.Key().DsKey())
+	if has, _ := d.Has(dsk); has {
+		t.Fatal("write-back Put reached the datastore immediately")
+	}
+	if has, _ := cbs.Has(b.Key()); !has {
+		t.Fatal("deferred block not visible")
+	}
+	if err := cbs.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := d.Has(dsk); !has {
+		t.Fatal("Close did not flush the deferred write")
+	}
+
+	cbs, err = CachedBlockstore(NewBlockstore(syncds.MutexWrap(d)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cbs.(io.Closer).Close()
+	unflushed := blocks.NewBlock([]byte("deleted while deferred"))
+	if err := cbs.Put(unflushed); err != nil {
+		t.Fatal(err)
+	}
+	if err := cbs.DeleteBlock(unflushed.Key()); err != nil {
+		t.Fatalf("expected deleting a deferred write to succeed, got %v", err)
+	}
+}
+
+func TestCachedBlockstoreBloomFilter(t *testing.T) {
+	hits := 0
+	cd := &callbackDatastore{f: func() { hits++ }, ds: ds.NewMapDatastore()}
+	bs, keys := newBlockStoreWithKeys(t, cd, 10)
+	opts := DefaultCacheOpts()
+	opts.HasBloomFilterSize = 1024
+	cbs, err := CachedBlockstore(bs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-cbs.(*cached).bloomDone
+
+	hits = 0
+	for i := 0; i < 100; i++ {
+		k := blocks.NewBlock([]byte(fmt.Sprintf("missing %d", i))).Key()
+		if has, _ := cbs.Has(k); has {
+			t.Fatalf("unexpected block %d", i)
+		}
+	}
+	// a few false positives may go through to the datastore.
+	if hits > 10 {
+		t.Fatalf("bloom filter let %d of 100 missing keys through", hits)
+	}
+	for _, k := range keys {
+		if has, _ := cbs.Has(k); !has {
+			t.Fatalf("stored key %s reported missing", k)
+		}
+	}
+
+	added := blocks.NewBlock([]byte("added after the build"))
+	if err := cbs.Put(added); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := cbs.Has(added.Key()); !has {
+		t.Fatal("block put after the build reported missing")
+	}
+}
+
+func TestCachedBlockstoreBloomFilterFailedScan(t *testing.T) {
+	d := &queryTestDS{ds: ds.NewMapDatastore()}
+	bs, keys := newBlockStoreWithKeys(t, d, 10)
+	errScan := errors.New("scan failed")
+	d.SetFunc(func(q dsq.Query) (dsq.Results, error) {
+		res, err := d.ds.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		ch := make(chan dsq.Result, 2)
+		ch <- <-res.Next()
+		ch <- dsq.Result{Error: errScan}
+		close(ch)
+		return dsq.ResultsWithChan(q, ch), nil
+	})
+
+	ks, done, err := ListKeys(context.Background(), bs, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(collect(ks)); n != 1 || done() != errScan {
+		t.Fatalf("expected 1 key and the scan error, got %d and %v", n, done())
+	}
+
+	opts := DefaultCacheOpts()
+	opts.HasBloomFilterSize = 1024
+	cbs, err := CachedBlockstore(bs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-cbs.(*cached).bloomDone
+	for _, k := range keys {
+		if has, _ := cbs.Has(k); !has {
+			t.Fatalf("stored key %s hidden by an incomplete filter", k)
+		}
+	}
+}
+
+func TestCachedBlockstoreBloomFilterReplaceAll(t *testing.T) {
+	opts := DefaultCacheOpts()
+	opts.HasBloomFilterSize = 1024
+	cbs, err := CachedBlockstore(NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore())), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-cbs.(*cached).bloomDone
+
+	b := blocks.NewBlock([]byte("replacement"))
+	if err := cbs.ReplaceAll(context.Background(), blockChan(b)); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := cbs.Has(b.Key()); !has {
+		t.Fatal("block from ReplaceAll reported missing")
+	}
+}
+
+func TestCachedBlockstoreSkipsExistingWrites(t *testing.T) {
+	hits := 0
+	cd := &callbackDatastore{f: func() { hits++ }, ds: ds.NewMapDatastore()}
+	opts := DefaultCacheOpts()
+	opts.SkipExistingWrites = true
+	cbs, err := CachedBlockstore(NewBlockstore(syncds.MutexWrap(cd)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := blocks.NewBlock([]byte("a"))
+	b := blocks.NewBlock([]byte("b"))
+	if err := cbs.Put(a); err != nil {
+		t.Fatal(err)
+	}
+
+	hits = 0
+	if err := cbs.Put(a); err != nil {
+		t.Fatal(err)
+	}
+	if hits != 0 {
+		t.Fatalf("rewriting a cached block hit the datastore %d times", hits)
+	}
+	if err := cbs.PutMany([]*blocks.Block{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cbs.ApplyBatch(context.Background(), []*blocks.Block{a}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := cbs.(WriteDeduper).SkippedWrites(); n != 3 {
+		t.Fatalf("expected 3 skipped writes, got %d", n)
+	}
+	for _, blk := range []*blocks.Block{a, b} {
+		if has, err := cbs.Has(blk.Key()); err != nil || !has {
+			t.Fatalf("block %s missing: %v", blk.Key(), err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package blockstore
+
+import (
+	"errors"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// CompactingDatastore is implemented by datastores that can give back the
+// space deleted values still take, such as LevelDB or Badger by compacting,
+// or a file-based store by removing the files a crash left behind.
+// Blockstores made by NewBlockstore over one use it for Compact.
+type CompactingDatastore interface {
+	// Compact reclaims what space it can while the datastore stays in use,
+	// and returns how many bytes.
+	Compact(ctx context.Context) (uint64, error)
+}
+
+// Compacter is implemented by blockstores that can compact their storage.
+// Use Compact for the others.
+type Compacter interface {
+	Compact(ctx context.Context) (uint64, error)
+}
+
+// Compact reclaims the space |bs| no longer needs, and returns how many
+// bytes, if it is a Compacter. Other blockstores have nothing to compact.
+func Compact(ctx context.Context, bs Blockstore) (uint64, error) {
+	if c, ok := bs.(Compacter); ok {
+		return c.Compact(ctx)
+	}
+	return 0, nil
+}
+
+// Compact removes the blocks an interrupted ReplaceAll left staged, then
+// compacts the datastore if it is a CompactingDatastore. For a
+// NamespacedBlockstore, that compacts the whole datastore, and counts what
+// the other users of it reclaim too.
+func (bs *blockstore) Compact(ctx context.Context) (uint64, error) {
+	staged, err := bs.clearStaged(ctx)
+	if err != nil {
+		return staged, err
+	}
+	cd, ok := bs.root.(CompactingDatastore)
+	if !ok {
+		return staged, nil
+	}
+	n, err := cd.Compact(ctx)
+	return staged + n, err
+}
+
+// clearStaged deletes the staging namespace, returning the size of the
+// values deleted. It waits for a ReplaceAll in progress, which clears it
+// anyway.
+func (bs *blockstore) clearStaged(ctx context.Context) (uint64, error) {
+	bs.replacing.Lock()
+	defer bs.replacing.Unlock()
+
+	// datastore/namespace does *NOT* fix up Query.Prefix
+	res, err := bs.staging.Query(dsq.Query{Prefix: bs.prefix.staging.String()})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return 0, err
+	}
+	var total uint64
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		err := bs.staging.Delete(ds.NewKey(e.Key))
+		if errors.Is(err, ds.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return total, err
+		}
+		if data, ok := e.Value.([]byte); ok {
+			total += uint64(len(data))
+		}
+	}
+	return total, nil
+}
+
+var _ Compacter = (*mirror)(nil)
+
+// Compact compacts every store, returning the total reclaimed.
+func (m *mirror) Compact(ctx context.Context) (uint64, error) {
+	var total uint64
+	for _, bs := range append([]Blockstore{m.primary}, m.secondaries...) {
+		n, err := Compact(ctx, bs)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
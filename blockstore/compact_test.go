@@ -0,0 +1,59 @@
+package blockstore
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// compactingDatastore reports reclaiming |reclaim| bytes on each Compact.
+type compactingDatastore struct {
+	ds.ThreadSafeDatastore
+	reclaim uint64
+	calls   int
+}
+
+func (d *compactingDatastore) Compact(context.Context) (uint64, error) {
+	d.calls++
+	return d.reclaim, nil
+}
+
+func TestCompact(t *testing.T) {
+	d := &compactingDatastore{ThreadSafeDatastore: ds_sync.MutexWrap(ds.NewMapDatastore()), reclaim: 100}
+	bs := NewBlockstore(d)
+	kept := blocks.NewBlock([]byte("kept"))
+	if err := bs.Put(kept); err != nil {
+		t.Fatal(err)
+	}
+	// as left by a ReplaceAll interrupted by a crash.
+	staged := blocks.NewBlock([]byte("staged"))
+	if err := d.Put(StagingPrefix.Child(staged.Key().DsKey()), staged.Data); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := Compact(context.Background(), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(100 + len(staged.Data)); n != want {
+		t.Fatalf("expected %d bytes reclaimed, got %d", want, n)
+	}
+	if d.calls != 1 {
+		t.Fatalf("expected the datastore compacted once, got %d", d.calls)
+	}
+	if has, _ := d.Has(StagingPrefix.Child(staged.Key().DsKey())); has {
+		t.Fatal("staged block survived compaction")
+	}
+	if has, _ := bs.Has(kept.Key()); !has {
+		t.Fatal("block lost by compaction")
+	}
+
+	// blockstores that aren't Compacters have nothing to compact.
+	if n, err := Compact(context.Background(), ReadOnly(bs)); n != 0 || err != nil {
+		t.Fatalf("expected nothing compacted, got %d, %v", n, err)
+	}
+}
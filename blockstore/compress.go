@@ -0,0 +1,99 @@
+package blockstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// Compressor is a compression format for Compressed blockstores, such as
+// Deflate. Implementations must be safe for concurrent use.
+type Compressor interface {
+	// Code is a nonzero byte identifying the format. It is stored with
+	// each block, so a blockstore written with one Compressor is not
+	// misread with another. Deflate uses 1.
+	Code() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Deflate compresses with compress/flate at its default level.
+var Deflate Compressor = deflate{}
+
+type deflate struct{}
+
+func (deflate) Code() byte { return 1 }
+
+func (deflate) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflate) Decompress(data []byte) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+}
+
+// ErrUnknownCompression is returned by Compressed blockstores for a stored
+// block that was written with another Compressor, or not through one.
+var ErrUnknownCompression = errors.New("blockstore: block compressed in an unknown format")
+
+// Compressed returns a blockstore that stores block data in |bs| compressed
+// with |c|. Blocks keep their keys, the hash of their uncompressed data, so
+// only the stored values change. Blocks that do not shrink are stored as
+// they are. Every block in |bs| must have been written through a Compressed
+// blockstore: each stored value starts with a byte saying how it was
+// compressed, so |bs| must not be verified or read directly, nor be
+// used with hash.Debug set.
+func Compressed(bs Blockstore, c Compressor) Blockstore {
+	z := compressor{c}
+	return &transformed{bs: bs, encode: z.encode, decode: z.decode}
+}
+
+type compressor struct {
+	c Compressor
+}
+
+// uncompressed marks stored values that are the block data as is.
+const uncompressed = 0
+
+func (z compressor) encode(_ key.Key, data []byte) ([]byte, error) {
+	c, err := z.c.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(c) < len(data) {
+		return append([]byte{z.c.Code()}, c...), nil
+	}
+	return append([]byte{uncompressed}, data...), nil
+}
+
+func (z compressor) decode(k key.Key, stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, ErrUnknownCompression
+	}
+	switch stored[0] {
+	case uncompressed:
+		return stored[1:], nil
+	case z.c.Code():
+		data, err := z.c.Decompress(stored[1:])
+		if err != nil {
+			return nil, fmt.Errorf("blockstore: decompressing %s: %w", k, err)
+		}
+		return data, nil
+	}
+	return nil, ErrUnknownCompression
+}
@@ -0,0 +1,93 @@
+package blockstore
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestCompressed(t *testing.T) {
+	under := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	bs := Compressed(under, Deflate)
+
+	text := blocks.NewBlock(bytes.Repeat([]byte("compress me "), 100))
+	tiny := blocks.NewBlock([]byte("x"))
+	for _, b := range []*blocks.Block{text, tiny} {
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		got, err := bs.Get(b.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data, b.Data) || got.Key() != b.Key() {
+			t.Fatalf("%s did not survive compression", b)
+		}
+	}
+
+	stored, err := under.Get(text.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Data) >= len(text.Data)/2 {
+		t.Fatalf("expected repetitive data to shrink, stored %d of %d bytes", len(stored.Data), len(text.Data))
+	}
+	if stored, _ := under.Get(tiny.Key()); len(stored.Data) != len(tiny.Data)+1 {
+		t.Fatalf("incompressible block stored in %d bytes", len(stored.Data))
+	}
+
+	// blocks written around the wrapper are not misread.
+	raw := blocks.NewBlock([]byte("\x07written directly"))
+	if err := under.Put(raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.Get(raw.Key()); err != ErrUnknownCompression {
+		t.Fatalf("expected ErrUnknownCompression, got %v", err)
+	}
+}
+
+type failingCompressor struct{}
+
+func (failingCompressor) Code() byte                        { return 9 }
+func (failingCompressor) Compress([]byte) ([]byte, error)   { return nil, errors.New("no") }
+func (failingCompressor) Decompress([]byte) ([]byte, error) { return nil, errors.New("no") }
+
+func TestCompressedReplaceAll(t *testing.T) {
+	under, ks := newBlockStoreWithKeys(t, nil, 3)
+	bs := Compressed(under, Deflate)
+
+	b := blocks.NewBlock(bytes.Repeat([]byte("new set "), 50))
+	in := make(chan *blocks.Block, 1)
+	in <- b
+	close(in)
+	if err := bs.ReplaceAll(context.Background(), in); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := bs.Get(b.Key()); err != nil || !bytes.Equal(got.Data, b.Data) {
+		t.Fatalf("replaced block not readable: %v", err)
+	}
+	if has, _ := under.Has(ks[0]); has {
+		t.Fatal("old block survived ReplaceAll")
+	}
+
+	failing := Compressed(under, failingCompressor{})
+	in = make(chan *blocks.Block, 1)
+	in <- blocks.NewBlock([]byte("other"))
+	close(in)
+	if err := failing.ReplaceAll(context.Background(), in); err == nil {
+		t.Fatal("expected the compression error")
+	}
+	if has, _ := under.Has(b.Key()); !has {
+		t.Fatal("failed ReplaceAll replaced the blocks")
+	}
+}
+
+func TestCompressedRefusesLazyBlocks(t *testing.T) {
+	expectLazyRefused(t, Compressed(NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())), Deflate))
+}
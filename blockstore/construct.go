@@ -0,0 +1,127 @@
+package blockstore
+
+import (
+	"crypto/cipher"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ktds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/keytransform"
+)
+
+// Option configures the blockstore NewBlockstoreFromDatastore assembles.
+type Option func(*config)
+
+type config struct {
+	transform ktds.KeyTransform
+	namespace string
+	aead      cipher.AEAD
+	compress  Compressor
+	cache     *CacheOpts
+	// bloom, if set, overrides the cache's HasBloomFilterSize.
+	bloom    *int
+	readOnly bool
+}
+
+// WithKeyTransform has the blockstore's datastore keys, its blocks' and the
+// others', go through |t|, such as key.B58KeyConverter for datastores that
+// only take printable keys.
+func WithKeyTransform(t ktds.KeyTransform) Option {
+	return func(c *config) { c.transform = t }
+}
+
+// WithNamespace keeps the blockstore below |prefix| of the datastore, as
+// NamespacedBlockstore does.
+func WithNamespace(prefix string) Option {
+	return func(c *config) { c.namespace = prefix }
+}
+
+// WithEncryption seals blocks with |aead|, as Encrypted does.
+func WithEncryption(aead cipher.AEAD) Option {
+	return func(c *config) { c.aead = aead }
+}
+
+// WithCompression compresses blocks with |comp|, as Compressed does.
+func WithCompression(comp Compressor) Option {
+	return func(c *config) { c.compress = comp }
+}
+
+// WithCache replaces the defaults of the cache in front of the blockstore
+// with |opts|; see CachedBlockstore.
+func WithCache(opts CacheOpts) Option {
+	return func(c *config) { c.cache = &opts }
+}
+
+// WithoutCache leaves out the cache, for datastores that keep their own in
+// memory.
+func WithoutCache() Option {
+	return func(c *config) { c.cache = nil }
+}
+
+// WithBloomFilter sets the size in bytes of the cache's bloom filter, or
+// leaves it out if |size| is 0, whatever the CacheOpts say; see
+// CacheOpts.HasBloomFilterSize. It has no effect without a cache.
+func WithBloomFilter(size int) Option {
+	return func(c *config) { c.bloom = &size }
+}
+
+// WithReadOnly rejects writes, as ReadOnly does.
+func WithReadOnly() Option {
+	return func(c *config) { c.readOnly = true }
+}
+
+// NewBlockstoreFromDatastore returns a blockstore over |d| with the usual
+// wrappers in the order they work in: |d| seen through the key transform,
+// the blocks kept below the namespace, encrypted, and compressed before
+// that, with the cache in front, and read-only on top. By default there is
+// only the cache, with DefaultCacheOpts, bloom filter included, and the
+// others are added by |opts|.
+//
+// A cache in WriteBack mode makes the blockstore an io.Closer, which must
+// be closed to flush the writes it holds; see CachedBlockstore.
+func NewBlockstoreFromDatastore(d ds.ThreadSafeDatastore, opts ...Option) (Blockstore, error) {
+	cacheOpts := DefaultCacheOpts()
+	c := config{cache: &cacheOpts}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	if c.transform != nil {
+		d = threadSafe{ktds.Wrap(d, c.transform)}
+	}
+	var bs Blockstore
+	if c.namespace != "" {
+		var err error
+		if bs, err = NamespacedBlockstore(d, c.namespace); err != nil {
+			return nil, err
+		}
+	} else {
+		bs = NewBlockstore(d)
+	}
+	if c.aead != nil {
+		bs = Encrypted(bs, c.aead)
+	}
+	if c.compress != nil {
+		bs = Compressed(bs, c.compress)
+	}
+	if c.cache != nil {
+		cacheOpts := *c.cache
+		if c.bloom != nil {
+			cacheOpts.HasBloomFilterSize = *c.bloom
+		}
+		var err error
+		if bs, err = CachedBlockstore(bs, cacheOpts); err != nil {
+			return nil, err
+		}
+	}
+	if c.readOnly {
+		bs = ReadOnly(bs)
+	}
+	return bs, nil
+}
+
+// threadSafe marks a wrapper of a ThreadSafeDatastore with no state of its
+// own, such as a key transform, as thread safe too.
+type threadSafe struct {
+	ds.Datastore
+}
+
+func (threadSafe) IsThreadSafe() {}
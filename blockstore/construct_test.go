@@ -0,0 +1,75 @@
+package blockstore
+
+import (
+	"bytes"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+)
+
+func TestNewBlockstoreFromDatastore(t *testing.T) {
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	aead, err := NewAESGCM(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []Option{
+		WithKeyTransform(key.B58KeyConverter),
+		WithNamespace("/app"),
+		WithEncryption(aead),
+		WithCompression(Deflate),
+		WithBloomFilter(0),
+	}
+	bs, err := NewBlockstoreFromDatastore(d, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock(bytes.Repeat([]byte("compressible "), 64))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bs.(WriteDeduper); !ok {
+		t.Fatal("expected a cache by default")
+	}
+
+	// the stored value is sealed and smaller, under a printable key below
+	// the namespace.
+	stored, err := d.Get(ds.NewKey("/app").Child(BlockPrefix).Child(b.Key().DsKey()))
+	if err == nil {
+		t.Fatal("expected the key to be transformed")
+	}
+	conv := key.B58KeyConverter.ConvertKey(ds.NewKey("/app").Child(BlockPrefix).Child(b.Key().DsKey()))
+	if stored, err = d.Get(conv); err != nil {
+		t.Fatal(err)
+	}
+	if v := stored.([]byte); len(v) >= len(b.Data) || bytes.Contains(v, []byte("compressible")) {
+		t.Fatalf("expected compressed, sealed data, got %d bytes", len(v))
+	}
+
+	// another blockstore over the same datastore reads it back.
+	ro, err := NewBlockstoreFromDatastore(d, append(opts, WithoutCache(), WithReadOnly())...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ro.Get(b.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, b.Data) {
+		t.Fatal("read back the wrong data")
+	}
+	if err := ro.Put(blocks.NewBlock([]byte("new"))); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if _, ok := ro.(WriteDeduper); ok {
+		t.Fatal("expected no cache")
+	}
+
+	if _, err := NewBlockstoreFromDatastore(d, WithCache(CacheOpts{})); err != errInvalidCacheSize {
+		t.Fatalf("expected errInvalidCacheSize, got %v", err)
+	}
+}
@@ -0,0 +1,475 @@
+package blockstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	chunk "github.com/ipfs/go-blocks/chunk"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrBadDelta is returned by DeltaCompressed blockstores for a stored value
+// that is not one they wrote.
+var ErrBadDelta = errors.New("blockstore: malformed delta-encoded block")
+
+// DeltaOptions configures a DeltaCompressed blockstore. The zero value uses
+// the defaults.
+type DeltaOptions struct {
+	// MinSize is the size below which blocks are stored as they are, 1KiB
+	// if zero.
+	MinSize int
+	// MaxRatio is the largest size of a delta kept, as a share of the
+	// size of its block, 0.5 if zero.
+	MaxRatio float64
+}
+
+// DeltaCompressed returns a blockstore that stores each block in |bs| as a
+// delta against a similar block stored before it, if there is one, for
+// workloads with many slightly different versions of the same files. Blocks
+// keep their keys, and Get rebuilds them from their base, checking the
+// result against the key.
+//
+// Similar blocks are found by fingerprints of their content-defined chunks,
+// which |index| keeps along with which blocks each base has. Bases are only
+// ever stored in full, so rebuilding a block takes a single extra read. A
+// base that is deleted has the blocks stored against it stored in full
+// first, written over with ApplyBatch, which must replace stored values, as
+// that of NewBlockstore does. |index| must be kept along with |bs|, and
+// every block in |bs| must have been written through a DeltaCompressed
+// blockstore: each stored value starts with a byte saying how it was
+// encoded, so |bs| must not be verified or read directly. Blocks written by
+// ReplaceAll, or by an ApplyBatch that also deletes, are stored in full.
+func DeltaCompressed(bs Blockstore, index ds.Datastore, opts DeltaOptions) Blockstore {
+	if opts.MinSize <= 0 {
+		opts.MinSize = 1 << 10
+	}
+	if opts.MaxRatio <= 0 {
+		opts.MaxRatio = 0.5
+	}
+	d := &deltas{bs: bs, index: index, opts: opts}
+	d.transformed = &transformed{bs: bs, encode: d.encode, decode: d.decode}
+	return d
+}
+
+// deltas is a DeltaCompressed blockstore. Its reads are those of
+// transformed; its writes are made under mu, held for writing by deletes,
+// so that no block is encoded against a base being deleted.
+type deltas struct {
+	*transformed
+	bs    Blockstore
+	index ds.Datastore
+	opts  DeltaOptions
+
+	mu sync.RWMutex
+}
+
+// Stored values start with one of these.
+const (
+	deltaFull  = 0
+	deltaPatch = 1
+)
+
+// Patches are made of copies from the base and inserts of new data.
+const (
+	patchCopy   = 0
+	patchInsert = 1
+)
+
+// deltaFeatures is the number of fingerprints a block is indexed under.
+const deltaFeatures = 8
+
+func featureKey(f uint64) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/features/%016x", f))
+}
+
+func dependentKey(base, dep key.Key) ds.Key {
+	return ds.KeyWithNamespaces([]string{"dependents", base.B58String(), dep.B58String()})
+}
+
+func (d *deltas) Put(b *blocks.Block) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.transformed.Put(b)
+}
+
+func (d *deltas) PutMany(bs []*blocks.Block) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.transformed.PutMany(bs)
+}
+
+func (d *deltas) DeleteBlock(k key.Key) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.release(k); err != nil {
+		return err
+	}
+	return d.bs.DeleteBlock(k)
+}
+
+// ReplaceAll stores the blocks from |in| in full, none of the blocks there
+// before being left to base them on.
+func (d *deltas) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	full := &transformed{bs: d.bs, encode: d.encodeFull, decode: d.decode}
+	if err := full.ReplaceAll(ctx, in); err != nil {
+		return err
+	}
+	// the index describes blocks that are gone.
+	res, err := d.index.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := d.index.Delete(ds.NewKey(e.Key)); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deltas) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	if err := checkPuts(puts); err != nil {
+		return err
+	}
+	if len(deletes) == 0 {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return d.transformed.ApplyBatch(ctx, puts, deletes)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, k := range deletes {
+		if err := d.release(k); err != nil {
+			return err
+		}
+	}
+	full := &transformed{bs: d.bs, encode: d.encodeFull, decode: d.decode}
+	return full.ApplyBatch(ctx, puts, deletes)
+}
+
+// release prepares |k| for deletion: the blocks stored against it are
+// stored in full, becoming bases themselves, and, if it is itself such a
+// block, its base forgets it. d.mu must be held for writing.
+func (d *deltas) release(k key.Key) error {
+	stored, err := d.bs.Get(k)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if base, _, err := parsePatch(stored.Data); err == nil {
+		return d.forget(d.index.Delete(dependentKey(base, k)))
+	}
+
+	prefix := ds.KeyWithNamespaces([]string{"dependents", k.B58String()})
+	res, err := d.index.Query(dsq.Query{Prefix: prefix.String() + "/", KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		dep, err := key.DecodeB58(ds.NewKey(e.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+		b, err := d.transformed.Get(dep)
+		switch {
+		case err == nil:
+			full, err := d.encodeFull(dep, b.Data)
+			if err != nil {
+				return err
+			}
+			// stored again over the delta, which Put would leave.
+			rewrite := []*blocks.Block{{Multihash: b.Multihash, Codec: b.Codec, Data: full}}
+			if err := d.bs.ApplyBatch(context.Background(), rewrite, nil); err != nil {
+				return err
+			}
+			if err := d.indexFeatures(dep, sketch(split(b.Data))); err != nil {
+				return err
+			}
+		case errors.Is(err, ErrNotFound):
+		default:
+			return err
+		}
+		if err := d.forget(d.index.Delete(ds.NewKey(e.Key))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forget returns the error of an index delete, but for that of an entry
+// already gone.
+func (d *deltas) forget(err error) error {
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (d *deltas) encodeFull(_ key.Key, data []byte) ([]byte, error) {
+	return append([]byte{deltaFull}, data...), nil
+}
+
+// encode stores |data| as a patch of the most similar base in the index, if
+// that is small enough, and in full otherwise, making it a base.
+func (d *deltas) encode(k key.Key, data []byte) ([]byte, error) {
+	if len(data) < d.opts.MinSize {
+		return d.encodeFull(k, data)
+	}
+	chunks := split(data)
+	features := sketch(chunks)
+	if base, bdata, ok := d.findBase(k, features); ok {
+		patch := diff(bdata, data, chunks)
+		if float64(len(patch)) <= d.opts.MaxRatio*float64(len(data)) {
+			if err := d.index.Put(dependentKey(base, k), []byte{}); err != nil {
+				return nil, err
+			}
+			out := append([]byte{deltaPatch}, uvarintBytes(uint64(len(base)))...)
+			out = append(out, base...)
+			return append(out, patch...), nil
+		}
+	}
+	if err := d.indexFeatures(k, features); err != nil {
+		return nil, err
+	}
+	return d.encodeFull(k, data)
+}
+
+// indexFeatures makes |k|, stored in full, the base for |features|.
+func (d *deltas) indexFeatures(k key.Key, features []uint64) error {
+	for _, f := range features {
+		if err := d.index.Put(featureKey(f), []byte(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findBase returns the base most of |features| point to, and its data.
+func (d *deltas) findBase(k key.Key, features []uint64) (key.Key, []byte, bool) {
+	votes := make(map[key.Key]int)
+	for _, f := range features {
+		v, err := d.index.Get(featureKey(f))
+		if err != nil {
+			continue
+		}
+		if b, ok := v.([]byte); ok && key.Key(b) != k {
+			votes[key.Key(b)]++
+		}
+	}
+	var best key.Key
+	for b, n := range votes {
+		if n > votes[best] || n == votes[best] && b < best {
+			best = b
+		}
+	}
+	if best == "" {
+		return "", nil, false
+	}
+	stored, err := d.bs.Get(best)
+	if err != nil || len(stored.Data) == 0 || stored.Data[0] != deltaFull {
+		return "", nil, false
+	}
+	return best, stored.Data[1:], true
+}
+
+func (d *deltas) decode(k key.Key, stored []byte) ([]byte, error) {
+	if len(stored) > 0 && stored[0] == deltaFull {
+		return stored[1:], nil
+	}
+	base, patch, err := parsePatch(stored)
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.bs.Get(base)
+	if err != nil {
+		return nil, fmt.Errorf("blockstore: reading the base of %s: %w", k, err)
+	}
+	if len(b.Data) == 0 || b.Data[0] != deltaFull {
+		return nil, ErrBadDelta
+	}
+	data, err := applyPatch(b.Data[1:], patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := Verify(k, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// parsePatch splits a stored patch into its base and its operations.
+func parsePatch(stored []byte) (key.Key, []byte, error) {
+	if len(stored) == 0 || stored[0] != deltaPatch {
+		return "", nil, ErrBadDelta
+	}
+	n, m := binary.Uvarint(stored[1:])
+	if m <= 0 || n == 0 || n > uint64(len(stored)-1-m) {
+		return "", nil, ErrBadDelta
+	}
+	rest := stored[1+m:]
+	return key.Key(rest[:n]), rest[n:], nil
+}
+
+func uvarintBytes(v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return buf[:binary.PutUvarint(buf[:], v)]
+}
+
+// Content-defined chunks are cut by the chunk package's Rabin splitter, so
+// that an edit moves only the cuts near it.
+const (
+	minChunk = 32
+	avgChunk = 128
+	maxChunk = 1024
+)
+
+// span is a chunk of data: its offset, length and hash.
+type span struct {
+	off, n int
+	sum    uint64
+}
+
+func split(data []byte) []span {
+	var spans []span
+	s := chunk.NewRabinMinMax(bytes.NewReader(data), minChunk, avgChunk, maxChunk)
+	off := 0
+	for {
+		// a bytes.Reader fails only at its end.
+		c, err := s.NextBytes()
+		if err != nil {
+			return spans
+		}
+		spans = append(spans, span{off: off, n: len(c), sum: chunkSum(c)})
+		off += len(c)
+	}
+}
+
+func chunkSum(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// sketch returns the smallest chunk hashes, which similar blocks likely
+// share.
+func sketch(spans []span) []uint64 {
+	sums := make([]uint64, 0, len(spans))
+	seen := make(map[uint64]bool)
+	for _, s := range spans {
+		if !seen[s.sum] {
+			seen[s.sum] = true
+			sums = append(sums, s.sum)
+		}
+	}
+	sort.Slice(sums, func(i, j int) bool { return sums[i] < sums[j] })
+	if len(sums) > deltaFeatures {
+		sums = sums[:deltaFeatures]
+	}
+	return sums
+}
+
+// diff returns the operations rebuilding |data|, chunked as |spans|, from
+// |base|: a copy for each chunk also in |base|, and inserts for the rest.
+func diff(base, data []byte, spans []span) []byte {
+	at := make(map[uint64]span)
+	for _, s := range split(base) {
+		if _, ok := at[s.sum]; !ok {
+			at[s.sum] = s
+		}
+	}
+	var out []byte
+	var copyOff, copyN, insertFrom, insertN int
+	flush := func() {
+		if copyN > 0 {
+			out = append(out, patchCopy)
+			out = append(out, uvarintBytes(uint64(copyOff))...)
+			out = append(out, uvarintBytes(uint64(copyN))...)
+			copyN = 0
+		}
+		if insertN > 0 {
+			out = append(out, patchInsert)
+			out = append(out, uvarintBytes(uint64(insertN))...)
+			out = append(out, data[insertFrom:insertFrom+insertN]...)
+			insertN = 0
+		}
+	}
+	for _, s := range spans {
+		b, ok := at[s.sum]
+		if ok && b.n == s.n && string(base[b.off:b.off+b.n]) == string(data[s.off:s.off+s.n]) {
+			if insertN > 0 || copyN > 0 && copyOff+copyN != b.off {
+				flush()
+			}
+			if copyN == 0 {
+				copyOff = b.off
+			}
+			copyN += b.n
+			continue
+		}
+		if copyN > 0 {
+			flush()
+		}
+		if insertN == 0 {
+			insertFrom = s.off
+		}
+		insertN += s.n
+	}
+	flush()
+	return out
+}
+
+func applyPatch(base, patch []byte) ([]byte, error) {
+	var out []byte
+	next := func() (uint64, bool) {
+		v, n := binary.Uvarint(patch)
+		if n <= 0 {
+			return 0, false
+		}
+		patch = patch[n:]
+		return v, true
+	}
+	for len(patch) > 0 {
+		op := patch[0]
+		patch = patch[1:]
+		switch op {
+		case patchCopy:
+			off, ok1 := next()
+			n, ok2 := next()
+			if !ok1 || !ok2 || off > uint64(len(base)) || n > uint64(len(base))-off {
+				return nil, ErrBadDelta
+			}
+			out = append(out, base[off:off+n]...)
+		case patchInsert:
+			n, ok := next()
+			if !ok || n > uint64(len(patch)) {
+				return nil, ErrBadDelta
+			}
+			out = append(out, patch[:n]...)
+			patch = patch[n:]
+		default:
+			return nil, ErrBadDelta
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,103 @@
+package blockstore
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestDeltaCompressed(t *testing.T) {
+	raw := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	bs := DeltaCompressed(raw, ds_sync.MutexWrap(ds.NewMapDatastore()), DeltaOptions{})
+
+	r := rand.New(rand.NewSource(1))
+	v1 := make([]byte, 64<<10)
+	r.Read(v1)
+	// the next version has a few bytes changed, and some inserted.
+	v2 := append([]byte(nil), v1[:20000]...)
+	v2 = append(v2, []byte("an edit in the middle")...)
+	v2 = append(v2, v1[20000:]...)
+	v2[50000] ^= 0xff
+	base, edited := blocks.NewBlock(v1), blocks.NewBlock(v2)
+	small := blocks.NewBlock([]byte("too small to bother"))
+	for _, b := range []*blocks.Block{base, edited, small} {
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored, err := raw.Get(edited.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Data) > len(v2)/10 {
+		t.Fatalf("expected a small delta, stored %d bytes of %d", len(stored.Data), len(v2))
+	}
+	for _, b := range []*blocks.Block{base, edited, small} {
+		got, err := bs.Get(b.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data, b.Data) {
+			t.Fatalf("%s rebuilt wrong", b.Key())
+		}
+	}
+
+	// deleting the base stores the blocks based on it in full.
+	if err := bs.DeleteBlock(base.Key()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bs.Get(edited.Key())
+	if err != nil || !bytes.Equal(got.Data, v2) {
+		t.Fatalf("block lost with its base: %v", err)
+	}
+	if stored, _ := raw.Get(edited.Key()); len(stored.Data) != len(v2)+1 {
+		t.Fatalf("expected the block stored in full, got %d bytes", len(stored.Data))
+	}
+
+	// a corrupt delta is caught.
+	v3 := append([]byte(nil), v2...)
+	v3[100] ^= 0xff
+	third := blocks.NewBlock(v3)
+	if err := bs.Put(third); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ = raw.Get(third.Key())
+	if stored.Data[0] != deltaPatch {
+		t.Fatal("expected a delta against the new base")
+	}
+	corrupt := append([]byte(nil), stored.Data...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := raw.ApplyBatch(context.Background(), []*blocks.Block{{Multihash: third.Multihash, Codec: third.Codec, Data: corrupt}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.Get(third.Key()); err == nil {
+		t.Fatal("expected a corrupt delta to fail")
+	}
+
+	// ReplaceAll stores in full.
+	in := make(chan *blocks.Block, 2)
+	in <- base
+	in <- edited
+	close(in)
+	if err := bs.ReplaceAll(context.Background(), in); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := raw.Get(edited.Key()); stored.Data[0] != deltaFull {
+		t.Fatal("expected ReplaceAll to store in full")
+	}
+	if has, _ := bs.Has(third.Key()); has {
+		t.Fatal("block left after ReplaceAll")
+	}
+}
+
+func TestDeltaCompressedRefusesLazyBlocks(t *testing.T) {
+	raw := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	expectLazyRefused(t, DeltaCompressed(raw, ds_sync.MutexWrap(ds.NewMapDatastore()), DeltaOptions{}))
+}
@@ -0,0 +1,65 @@
+package blockstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// ErrDecrypt is returned by Encrypted blockstores for a stored block that
+// does not decrypt: it was written with another key, not through the
+// blockstore, or tampered with.
+var ErrDecrypt = errors.New("blockstore: block does not decrypt")
+
+// Encrypted returns a blockstore that stores block data in |bs| sealed with
+// |aead|, such as one made by NewAESGCM, or XChaCha20-Poly1305 from
+// golang.org/x/crypto. Each block is sealed with a random nonce, stored in
+// front of it, and bound to its key, so blocks cannot be swapped for one
+// another on disk.
+//
+// Keys are still the hashes of the plaintext, so whoever can list |bs| can
+// tell which known blocks it holds. As with Compressed, every block in |bs|
+// must have been written through an Encrypted blockstore with the same key,
+// and hash.Debug must not be set.
+func Encrypted(bs Blockstore, aead cipher.AEAD) Blockstore {
+	e := sealer{aead}
+	return &transformed{bs: bs, encode: e.seal, decode: e.open}
+}
+
+// NewAESGCM returns an AES-GCM cipher.AEAD for Encrypted with |secret|, which
+// must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewAESGCM(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func (s sealer) seal(k key.Key, data []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	out := make([]byte, n, n+len(data)+s.aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(out, out[:n], data, []byte(k)), nil
+}
+
+func (s sealer) open(k key.Key, stored []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(stored) < n {
+		return nil, ErrDecrypt
+	}
+	data, err := s.aead.Open(nil, stored[:n], stored[n:], []byte(k))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return data, nil
+}
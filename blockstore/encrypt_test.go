@@ -0,0 +1,71 @@
+package blockstore
+
+import (
+	"bytes"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+)
+
+func TestEncrypted(t *testing.T) {
+	aead, err := NewAESGCM(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	under := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	bs := Encrypted(under, aead)
+
+	secret := blocks.NewBlock([]byte("attack at dawn"))
+	other := blocks.NewBlock([]byte("retreat at dusk"))
+	for _, b := range []*blocks.Block{secret, other} {
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := bs.Get(secret.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, secret.Data) || got.Key() != secret.Key() {
+		t.Fatal("block did not survive encryption")
+	}
+
+	stored, err := under.Get(secret.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored.Data, secret.Data) {
+		t.Fatal("plaintext stored on disk")
+	}
+
+	// a block moved under another key does not open.
+	moved := &blocks.Block{Multihash: other.Multihash, Data: stored.Data}
+	if err := under.DeleteBlock(other.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if err := under.Put(moved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.Get(other.Key()); err != ErrDecrypt {
+		t.Fatalf("expected ErrDecrypt for a swapped block, got %v", err)
+	}
+
+	wrong, err := NewAESGCM(bytes.Repeat([]byte{8}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Encrypted(under, wrong).Get(secret.Key()); err != ErrDecrypt {
+		t.Fatalf("expected ErrDecrypt with the wrong key, got %v", err)
+	}
+}
+
+func TestEncryptedRefusesLazyBlocks(t *testing.T) {
+	aead, err := NewAESGCM(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLazyRefused(t, Encrypted(NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())), aead))
+}
@@ -0,0 +1,444 @@
+package blockstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var (
+	// ErrTooFewShards is returned by ErasureCoded blockstores for a block
+	// with shards in fewer stores than it takes to rebuild it.
+	ErrTooFewShards = errors.New("blockstore: too few shards to rebuild block")
+	// ErrBadShard is returned for a stored shard that is not one of an
+	// ErasureCoded blockstore, or not of its layout.
+	ErrBadShard = errors.New("blockstore: malformed block shard")
+)
+
+// ErasureCoded returns a blockstore that splits each block into |data|
+// shards, adds |parity| more computed from them, and stores shard i in
+// stores[i], so that a block survives the loss of any |parity| of the
+// stores, taking (data+parity)/data times its size rather than the
+// parity+1 times mirroring it would. Blocks keep their keys in every store.
+//
+// Get reads the data shards, and rebuilds the block from the parity shards
+// if some are missing or unreadable, checking the result against its key.
+// Puts and deletes apply to every store, and fail if any store does; the
+// shards stored before the failure are left. ReplaceAll replaces every
+// store, each atomically, but not all at once. The stores must only be
+// written through the ErasureCoded blockstore, and never be verified or
+// read directly.
+func ErasureCoded(stores []Blockstore, data, parity int) (Blockstore, error) {
+	switch {
+	case data < 1 || parity < 0:
+		return nil, fmt.Errorf("blockstore: erasure coding needs a data shard and no negative parity, got %d and %d", data, parity)
+	case data+parity > 256:
+		return nil, fmt.Errorf("blockstore: erasure coding takes at most 256 shards, got %d", data+parity)
+	case len(stores) != data+parity:
+		return nil, fmt.Errorf("blockstore: erasure coding %d+%d shards needs as many stores, got %d", data, parity, len(stores))
+	}
+	members := append([]Blockstore(nil), stores...)
+	return &erasure{tiered: &tiered{tiers: members}, code: newErasureCode(data, parity)}, nil
+}
+
+type erasure struct {
+	// tiered lists the blocks of the stores, its tiers.
+	*tiered
+	code *erasureCode
+}
+
+// Shards are stored behind a header: the version, the data and parity
+// shard counts less one, the shard's index, and the block's size.
+const shardVersion = 1
+
+func (e *erasure) shardBlocks(b *blocks.Block) []*blocks.Block {
+	shards := e.code.encode(b.Data)
+	out := make([]*blocks.Block, len(shards))
+	for i, s := range shards {
+		h := []byte{shardVersion, byte(e.code.data - 1), byte(e.code.parity), byte(i)}
+		h = append(h, uvarintBytes(uint64(len(b.Data)))...)
+		out[i] = &blocks.Block{Multihash: b.Multihash, Codec: b.Codec, Data: append(h, s...)}
+	}
+	return out
+}
+
+// parseShard returns the index, block size and data of a stored shard.
+func (e *erasure) parseShard(stored []byte) (int, int, []byte, error) {
+	if len(stored) < 4 || stored[0] != shardVersion ||
+		int(stored[1])+1 != e.code.data || int(stored[2]) != e.code.parity {
+		return 0, 0, nil, ErrBadShard
+	}
+	i := int(stored[3])
+	size, n := binary.Uvarint(stored[4:])
+	if n <= 0 || i >= e.code.data+e.code.parity {
+		return 0, 0, nil, ErrBadShard
+	}
+	s := stored[4+n:]
+	if len(s) != e.code.shardSize(int(size)) {
+		return 0, 0, nil, ErrBadShard
+	}
+	return i, int(size), s, nil
+}
+
+func (e *erasure) Get(k key.Key) (*blocks.Block, error) {
+	shards := make([][]byte, len(e.tiers))
+	size, have := -1, 0
+	var failed error
+	// the data shards first, which need no rebuilding; the parity shards
+	// only as they are needed.
+	for i := 0; i < len(e.tiers) && have < e.code.data; i++ {
+		stored, err := e.tiers[i].Get(k)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err == nil {
+			var j, n int
+			var s []byte
+			if j, n, s, err = e.parseShard(stored.Data); err == nil && j == i && (size < 0 || n == size) {
+				shards[i], size = s, n
+				have++
+				continue
+			}
+			if err == nil {
+				err = ErrBadShard
+			}
+		}
+		if failed == nil {
+			failed = err
+		}
+	}
+	if have < e.code.data {
+		if have == 0 && failed == nil {
+			return nil, ErrNotFound
+		}
+		if failed == nil {
+			failed = ErrTooFewShards
+		}
+		return nil, failed
+	}
+	data := e.code.decode(shards, size)
+	if err := Verify(k, data); err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithKey(data, k)
+}
+
+func (e *erasure) GetChan(ks []key.Key) <-chan *blocks.Block {
+	out := make(chan *blocks.Block, 1)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			if b, err := e.Get(k); err == nil {
+				out <- b
+			}
+		}
+	}()
+	return out
+}
+
+// Has reports whether enough of the stores have a shard of |k| to rebuild
+// it, without reading the shards.
+func (e *erasure) Has(k key.Key) (bool, error) {
+	have := 0
+	var failed error
+	for _, bs := range e.tiers {
+		has, err := bs.Has(k)
+		if err != nil {
+			failed = err
+			continue
+		}
+		if has {
+			if have++; have == e.code.data {
+				return true, nil
+			}
+		}
+	}
+	return false, failed
+}
+
+func (e *erasure) Put(b *blocks.Block) error {
+	if err := checkPuts([]*blocks.Block{b}); err != nil {
+		return err
+	}
+	for i, s := range e.shardBlocks(b) {
+		if err := e.tiers[i].Put(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *erasure) PutMany(bs []*blocks.Block) error {
+	if err := checkPuts(bs); err != nil {
+		return err
+	}
+	return e.each(bs, func(i int, shards []*blocks.Block) error {
+		return e.tiers[i].PutMany(shards)
+	})
+}
+
+// each calls |f| with the index of each store and the shards of |bs| it
+// stores.
+func (e *erasure) each(bs []*blocks.Block, f func(i int, shards []*blocks.Block) error) error {
+	per := make([][]*blocks.Block, len(e.tiers))
+	for _, b := range bs {
+		for i, s := range e.shardBlocks(b) {
+			per[i] = append(per[i], s)
+		}
+	}
+	for i, shards := range per {
+		if err := f(i, shards); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteBlock deletes the shards of |k| from every store. It returns
+// ErrNotFound if none has one.
+func (e *erasure) DeleteBlock(k key.Key) error {
+	deleted := false
+	for _, bs := range e.tiers {
+		switch err := bs.DeleteBlock(k); {
+		case err == nil:
+			deleted = true
+		case errors.Is(err, ErrNotFound), errors.Is(err, ds.ErrNotFound):
+		default:
+			return err
+		}
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (e *erasure) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	if err := checkPuts(puts); err != nil {
+		return err
+	}
+	return e.each(puts, func(i int, shards []*blocks.Block) error {
+		return e.tiers[i].ApplyBatch(ctx, shards, deletes)
+	})
+}
+
+// ReplaceAll replaces the contents of every store with the shards of the
+// blocks from |in|, the stores all at once. If one fails, the others are
+// cancelled, and the first error returned.
+func (e *erasure) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	outs := make([]chan *blocks.Block, len(e.tiers))
+	errs := make([]error, len(e.tiers))
+	var wg sync.WaitGroup
+	for i, bs := range e.tiers {
+		outs[i] = make(chan *blocks.Block)
+		wg.Add(1)
+		go func(i int, bs Blockstore) {
+			defer wg.Done()
+			if errs[i] = bs.ReplaceAll(ctx, outs[i]); errs[i] != nil {
+				cancel()
+			}
+		}(i, bs)
+	}
+	var lazy error
+	func() {
+		// each store's channel is only closed once |in| is, so that a
+		// cancellation is never mistaken for the end of the blocks.
+		for b := range in {
+			if lazy = checkPuts([]*blocks.Block{b}); lazy != nil {
+				cancel()
+				return
+			}
+			for i, s := range e.shardBlocks(b) {
+				select {
+				case outs[i] <- s:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		for _, out := range outs {
+			close(out)
+		}
+	}()
+	wg.Wait()
+	if lazy != nil {
+		return lazy
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// erasureCode is a systematic Reed-Solomon code over GF(2^8): the data
+// shards are the block cut in pieces, and each parity shard a sum of them
+// weighted by a row of a Cauchy matrix, so that any |data| of the shards
+// rebuild the others.
+type erasureCode struct {
+	data, parity int
+	// rows[i] weighs the data shards into shard i: a unit row for the
+	// data shards, a Cauchy row for the parity shards.
+	rows [][]byte
+}
+
+func newErasureCode(data, parity int) *erasureCode {
+	c := &erasureCode{data: data, parity: parity}
+	for i := 0; i < data+parity; i++ {
+		row := make([]byte, data)
+		for j := range row {
+			switch {
+			case i >= data:
+				// 1/(x_i + y_j), for distinct x_i = i and y_j = j.
+				row[j] = gfInv(byte(i) ^ byte(j))
+			case i == j:
+				row[j] = 1
+			}
+		}
+		c.rows = append(c.rows, row)
+	}
+	return c
+}
+
+func (c *erasureCode) shardSize(size int) int {
+	return (size + c.data - 1) / c.data
+}
+
+// encode returns the shards of |data|, the last data shard padded with
+// zeros.
+func (c *erasureCode) encode(data []byte) [][]byte {
+	n := c.shardSize(len(data))
+	shards := make([][]byte, c.data+c.parity)
+	for i := 0; i < c.data; i++ {
+		shards[i] = make([]byte, n)
+		if off := i * n; off < len(data) {
+			copy(shards[i], data[off:])
+		}
+	}
+	for i := c.data; i < len(shards); i++ {
+		shards[i] = make([]byte, n)
+		for j, w := range c.rows[i] {
+			gfMulAdd(shards[i], shards[j], w)
+		}
+	}
+	return shards
+}
+
+// decode returns the |size| bytes of data |shards| hold, rebuilt from
+// the first |c.data| of them that are not nil.
+func (c *erasureCode) decode(shards [][]byte, size int) []byte {
+	var rows [][]byte
+	var have [][]byte
+	complete := true
+	for i, s := range shards {
+		if s == nil {
+			if i < c.data {
+				complete = false
+			}
+			continue
+		}
+		if len(have) < c.data {
+			rows = append(rows, c.rows[i])
+			have = append(have, s)
+		}
+	}
+	n := c.shardSize(size)
+	out := make([]byte, 0, c.data*n)
+	if complete {
+		for _, s := range shards[:c.data] {
+			out = append(out, s...)
+		}
+		return out[:size]
+	}
+	inv := gfInvert(rows)
+	for i := 0; i < c.data; i++ {
+		s := make([]byte, n)
+		for j, w := range inv[i] {
+			gfMulAdd(s, have[j], w)
+		}
+		out = append(out, s...)
+	}
+	return out[:size]
+}
+
+// GF(2^8), modulo x^8 + x^4 + x^3 + x^2 + 1.
+var gfExp, gfLog = func() (exp [512]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(exp); i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds |src| times |w| to |dst|.
+func gfMulAdd(dst, src []byte, w byte) {
+	if w == 0 {
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= gfMul(b, w)
+	}
+}
+
+// gfInvert returns the inverse of the square matrix |m|, by Gauss-Jordan
+// elimination. The rows of an erasureCode are chosen so that any square
+// matrix of them is invertible.
+func gfInvert(m [][]byte) [][]byte {
+	n := len(m)
+	a := make([][]byte, n)
+	inv := make([][]byte, n)
+	for i := range m {
+		a[i] = append([]byte(nil), m[i]...)
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		p := col
+		for a[p][col] == 0 {
+			p++
+		}
+		a[col], a[p] = a[p], a[col]
+		inv[col], inv[p] = inv[p], inv[col]
+		if w := gfInv(a[col][col]); w != 1 {
+			for j := 0; j < n; j++ {
+				a[col][j] = gfMul(a[col][j], w)
+				inv[col][j] = gfMul(inv[col][j], w)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if w := a[r][col]; r != col && w != 0 {
+				gfMulAdd(a[r], a[col], w)
+				gfMulAdd(inv[r], inv[col], w)
+			}
+		}
+	}
+	return inv
+}
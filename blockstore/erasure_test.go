@@ -0,0 +1,114 @@
+package blockstore
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestErasureCoded(t *testing.T) {
+	var stores []Blockstore
+	for i := 0; i < 5; i++ {
+		stores = append(stores, NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())))
+	}
+	bs, err := ErasureCoded(stores, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	var bks []*blocks.Block
+	for _, n := range []int{0, 1, 2, 3, 100, 4096, 10007} {
+		data := make([]byte, n)
+		r.Read(data)
+		bks = append(bks, blocks.NewBlock(data))
+	}
+	if err := bs.PutMany(bks); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := stores[0].Get(bks[len(bks)-1].Key()); len(stored.Data) > 10007/3+16 {
+		t.Fatalf("expected a third of the block in a shard, got %d bytes", len(stored.Data))
+	}
+
+	check := func(msg string) {
+		t.Helper()
+		for _, b := range bks {
+			got, err := bs.Get(b.Key())
+			if err != nil {
+				t.Fatalf("%s: %d bytes: %s", msg, len(b.Data), err)
+			}
+			if !bytes.Equal(got.Data, b.Data) {
+				t.Fatalf("%s: %d bytes rebuilt wrong", msg, len(b.Data))
+			}
+		}
+	}
+	check("all shards")
+
+	// any two stores may be lost.
+	for _, lost := range [][2]int{{0, 1}, {1, 3}, {0, 4}, {3, 4}} {
+		bs, _ := ErasureCoded([]Blockstore{stores[0], stores[1], stores[2], stores[3], stores[4]}, 3, 2)
+		members := bs.(*erasure).tiers
+		empty := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+		members[lost[0]], members[lost[1]] = empty, empty
+		for _, b := range bks {
+			got, err := bs.Get(b.Key())
+			if err != nil || !bytes.Equal(got.Data, b.Data) {
+				t.Fatalf("stores %v lost: %d bytes not rebuilt: %v", lost, len(b.Data), err)
+			}
+			if has, _ := bs.Has(b.Key()); !has {
+				t.Fatalf("stores %v lost: block not found", lost)
+			}
+		}
+	}
+
+	// not three.
+	k := bks[4].Key()
+	for _, i := range []int{0, 2, 4} {
+		if err := stores[i].DeleteBlock(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bs.Get(k); err != ErrTooFewShards {
+		t.Fatalf("expected ErrTooFewShards, got %v", err)
+	}
+	if has, _ := bs.Has(k); has {
+		t.Fatal("block with too few shards reported stored")
+	}
+
+	if err := bs.DeleteBlock(k); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.Get(k); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(ch); len(got) != len(bks)-1 {
+		t.Fatalf("expected %d keys, got %d", len(bks)-1, len(got))
+	}
+
+	for _, c := range [][2]int{{0, 2}, {3, 3}, {3, -1}} {
+		if _, err := ErasureCoded(stores, c[0], c[1]); err == nil {
+			t.Fatalf("expected %d+%d shards over 5 stores to fail", c[0], c[1])
+		}
+	}
+}
+
+func TestErasureCodedRefusesLazyBlocks(t *testing.T) {
+	var stores []Blockstore
+	for i := 0; i < 3; i++ {
+		stores = append(stores, NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())))
+	}
+	bs, err := ErasureCoded(stores, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLazyRefused(t, bs)
+}
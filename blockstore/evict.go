@@ -0,0 +1,325 @@
+package blockstore
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrPinned is returned by blockstores refusing to remove a pinned block,
+// such as those pin.Pinner.Guard makes. Evicting passes over the blocks it
+// fails to evict with it.
+var ErrPinned = errors.New("blockstore: block is pinned")
+
+// EvictionPolicy orders the blocks of an Evicting blockstore for eviction.
+// It is told of every block stored, read and removed, and must be safe for
+// concurrent use.
+type EvictionPolicy interface {
+	Added(k key.Key)
+	Accessed(k key.Key)
+	Removed(k key.Key)
+	// Victims calls |f| with the blocks it was told of, the first to evict
+	// first, until |f| returns false. |f| does not call the policy.
+	Victims(f func(k key.Key) bool)
+}
+
+// Evicting is Quota, but instead of failing a write that does not fit, it
+// first deletes blocks that are not in |pinned|, in the order |policy| gives,
+// until it does. Only if that can't make enough room does the write fail
+// with ErrQuotaExceeded, and then nothing is evicted; if an eviction fails,
+// the write fails with its error, and the blocks evicted for it are stored
+// again. Blocks being written or deleted by the write itself are never
+// evicted for it. |pinned| may be nil, and is read at each eviction, so that
+// a live view such as pin.Pinner.View keeps the blocks pinned since.
+//
+// Every stored block is read when Evicting is called, to tell |policy| of
+// it, in no particular order. The sizes of the blocks are then kept in
+// memory, for choosing how many to evict.
+func Evicting(ctx context.Context, bs Blockstore, maxBytes uint64, policy EvictionPolicy, pinned key.KeySet) (Blockstore, error) {
+	q := &quota{
+		bs:     bs,
+		max:    maxBytes,
+		policy: policy,
+		pinned: pinned,
+		sizes:  make(map[key.Key]int),
+	}
+	if b, ok := bs.(*blockstore); ok {
+		q.disk = b.diskUsage
+	}
+	ks, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for k := range ks {
+		b, err := bs.Get(k)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		q.added(k, len(b.Data))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// makeRoom checks that a write storing |bytes| and freeing |freed| fits,
+// evicting blocks other than those of |busy| to make it, if there is a
+// policy. Blocks that fail to evict with ErrPinned are passed over; if one
+// fails otherwise, or there is not enough room without those, the blocks
+// evicted before are stored again. q.mu must be held.
+func (q *quota) makeRoom(bytes, freed uint64, busy map[key.Key]struct{}) error {
+	if q.fits(bytes, freed) {
+		return nil
+	}
+	if q.policy == nil {
+		return ErrQuotaExceeded
+	}
+	// passed holds the keys evicted, and those refused with ErrPinned.
+	passed := make(map[key.Key]struct{})
+	var evicted []*blocks.Block
+	for {
+		victims, more := q.victims(bytes, freed, busy, passed)
+		if !q.fits(bytes, freed+more) {
+			q.restore(evicted)
+			return ErrQuotaExceeded
+		}
+		refused := false
+		for _, k := range victims {
+			passed[k] = struct{}{}
+			b, err := q.bs.Get(k)
+			if err == nil {
+				err = q.bs.DeleteBlock(k)
+			}
+			if errors.Is(err, ErrPinned) {
+				// choose again, without it.
+				refused = true
+				break
+			}
+			if err != nil {
+				q.restore(evicted)
+				return err
+			}
+			evicted = append(evicted, b)
+			freed += uint64(len(b.Data))
+		}
+		if !refused {
+			break
+		}
+	}
+	for _, b := range evicted {
+		q.removed(b.Key(), len(b.Data))
+	}
+	return nil
+}
+
+// victims returns the blocks to evict, in order, for a write storing |bytes|
+// and freeing |freed| to fit, and the bytes they free, passing over those
+// of |busy|, of |passed| and those pinned. It returns all there are if that
+// is not enough. q.mu must be held.
+func (q *quota) victims(bytes, freed uint64, busy, passed map[key.Key]struct{}) ([]key.Key, uint64) {
+	var victims []key.Key
+	var more uint64
+	q.policy.Victims(func(k key.Key) bool {
+		if _, ok := busy[k]; ok {
+			return true
+		}
+		if _, ok := passed[k]; ok {
+			return true
+		}
+		if q.pinned != nil && q.pinned.Has(k) {
+			return true
+		}
+		size, ok := q.sizes[k]
+		if !ok {
+			return true // not stored; the policy is behind.
+		}
+		victims = append(victims, k)
+		more += uint64(size)
+		return !q.fits(bytes, freed+more)
+	})
+	return victims, more
+}
+
+// restore stores the |evicted| blocks again, after an eviction for a write
+// that then failed. q.mu must be held.
+func (q *quota) restore(evicted []*blocks.Block) {
+	if len(evicted) == 0 {
+		return
+	}
+	if err := q.bs.PutMany(evicted); err != nil {
+		// the blocks are lost; account for them as such.
+		for _, b := range evicted {
+			q.removed(b.Key(), len(b.Data))
+		}
+	}
+}
+
+// keysOf returns the set of the keys of |bs| and |ks|.
+func keysOf(bs []*blocks.Block, ks []key.Key) map[key.Key]struct{} {
+	set := make(map[key.Key]struct{}, len(bs)+len(ks))
+	for _, b := range bs {
+		set[b.Key()] = struct{}{}
+	}
+	for _, k := range ks {
+		set[k] = struct{}{}
+	}
+	return set
+}
+
+// NewLRU returns a policy evicting the least recently stored or read block
+// first.
+func NewLRU() EvictionPolicy {
+	return &recency{touchOnAccess: true, elems: make(map[key.Key]*list.Element)}
+}
+
+// NewFIFO returns a policy evicting the least recently stored block first,
+// however often it is read.
+func NewFIFO() EvictionPolicy {
+	return &recency{elems: make(map[key.Key]*list.Element)}
+}
+
+// recency orders blocks oldest first by when they were stored, and, if
+// |touchOnAccess|, read.
+type recency struct {
+	touchOnAccess bool
+
+	mu    sync.Mutex
+	order list.List // of key.Key, oldest first
+	elems map[key.Key]*list.Element
+}
+
+func (r *recency) Added(k key.Key) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.elems[k]; ok {
+		r.order.MoveToBack(e)
+		return
+	}
+	r.elems[k] = r.order.PushBack(k)
+}
+
+func (r *recency) Accessed(k key.Key) {
+	if !r.touchOnAccess {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.elems[k]; ok {
+		r.order.MoveToBack(e)
+	}
+}
+
+func (r *recency) Removed(k key.Key) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.elems[k]; ok {
+		r.order.Remove(e)
+		delete(r.elems, k)
+	}
+}
+
+func (r *recency) Victims(f func(key.Key) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for e := r.order.Front(); e != nil; e = e.Next() {
+		if !f(e.Value.(key.Key)) {
+			return
+		}
+	}
+}
+
+// NewLFU returns a policy evicting the least often read block first, and of
+// those read as often, the one that reached that count first. Storing a
+// block counts as its first use.
+func NewLFU() EvictionPolicy {
+	return &frequency{entries: make(map[key.Key]*lfuEntry)}
+}
+
+// frequency keeps a bucket per use count, lowest first, each listing its
+// blocks in the order they reached the count, so that every operation takes
+// constant time.
+type frequency struct {
+	mu      sync.Mutex
+	buckets list.List // of *lfuBucket, by increasing count
+	entries map[key.Key]*lfuEntry
+}
+
+type lfuBucket struct {
+	count int
+	keys  list.List // of key.Key
+}
+
+type lfuEntry struct {
+	bucket *list.Element // of frequency.buckets
+	elem   *list.Element // of the bucket's keys
+}
+
+func (f *frequency) Added(k key.Key) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.entries[k]; ok {
+		return
+	}
+	front := f.buckets.Front()
+	if front == nil || front.Value.(*lfuBucket).count != 1 {
+		front = f.buckets.PushFront(&lfuBucket{count: 1})
+	}
+	f.entries[k] = &lfuEntry{bucket: front, elem: front.Value.(*lfuBucket).keys.PushBack(k)}
+}
+
+func (f *frequency) Accessed(k key.Key) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[k]
+	if !ok {
+		return
+	}
+	cur := e.bucket.Value.(*lfuBucket)
+	next := e.bucket.Next()
+	if next == nil || next.Value.(*lfuBucket).count != cur.count+1 {
+		next = f.buckets.InsertAfter(&lfuBucket{count: cur.count + 1}, e.bucket)
+	}
+	f.unlink(e)
+	e.bucket = next
+	e.elem = next.Value.(*lfuBucket).keys.PushBack(k)
+}
+
+func (f *frequency) Removed(k key.Key) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if e, ok := f.entries[k]; ok {
+		f.unlink(e)
+		delete(f.entries, k)
+	}
+}
+
+// unlink takes |e| out of its bucket, dropping the bucket if that empties
+// it. f.mu must be held.
+func (f *frequency) unlink(e *lfuEntry) {
+	b := e.bucket.Value.(*lfuBucket)
+	b.keys.Remove(e.elem)
+	if b.keys.Len() == 0 {
+		f.buckets.Remove(e.bucket)
+	}
+}
+
+func (f *frequency) Victims(fn func(key.Key) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for be := f.buckets.Front(); be != nil; be = be.Next() {
+		for e := be.Value.(*lfuBucket).keys.Front(); e != nil; e = e.Next() {
+			if !fn(e.Value.(key.Key)) {
+				return
+			}
+		}
+	}
+}
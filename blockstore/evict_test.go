@@ -0,0 +1,143 @@
+package blockstore
+
+import (
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// fillEvicting returns a store capped at three 4 byte blocks, holding a, b
+// and c, stored in that order, and then a read.
+func fillEvicting(t *testing.T, policy EvictionPolicy, pinned key.KeySet) (Blockstore, []*blocks.Block) {
+	under := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	bs, err := Evicting(context.Background(), under, 12, policy, pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blks := []*blocks.Block{
+		blocks.NewBlock([]byte("aaaa")),
+		blocks.NewBlock([]byte("bbbb")),
+		blocks.NewBlock([]byte("cccc")),
+		blocks.NewBlock([]byte("dddd")),
+	}
+	for _, b := range blks[:3] {
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bs.Get(blks[0].Key()); err != nil {
+		t.Fatal(err)
+	}
+	return bs, blks
+}
+
+func expectEvicted(t *testing.T, policy EvictionPolicy, pinned key.KeySet, evicted int) {
+	bs, blks := fillEvicting(t, policy, pinned)
+	if err := bs.Put(blks[3]); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range blks {
+		expectHas(t, bs, b.Key(), i != evicted)
+	}
+	expectUsage(t, bs, 3, 12)
+}
+
+func TestEvictingLRU(t *testing.T) {
+	expectEvicted(t, NewLRU(), nil, 1)
+}
+
+func TestEvictingFIFO(t *testing.T) {
+	expectEvicted(t, NewFIFO(), nil, 0)
+}
+
+func TestEvictingLFU(t *testing.T) {
+	bs, blks := fillEvicting(t, NewLFU(), nil)
+	if _, err := bs.Get(blks[1].Key()); err != nil {
+		t.Fatal(err)
+	}
+	// a and b have been read, so c goes first.
+	if err := bs.Put(blks[3]); err != nil {
+		t.Fatal(err)
+	}
+	expectHas(t, bs, blks[2].Key(), false)
+	expectHas(t, bs, blks[0].Key(), true)
+}
+
+func TestEvictingSkipsPinned(t *testing.T) {
+	// b would go first, as for LRU.
+	pinned := key.NewKeySet()
+	pinned.Add(blocks.NewBlock([]byte("bbbb")).Key())
+	expectEvicted(t, NewLRU(), pinned, 2)
+}
+
+func TestEvictingFailsWithoutRoom(t *testing.T) {
+	pinned := key.NewKeySet()
+	bs, blks := fillEvicting(t, NewLRU(), pinned)
+	pinned.Add(blks[0].Key())
+	pinned.Add(blks[1].Key())
+
+	big := blocks.NewBlock([]byte("too big for one slot"))
+	if err := bs.Put(big); err != ErrQuotaExceeded {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	for _, b := range blks[:3] {
+		expectHas(t, bs, b.Key(), true)
+	}
+}
+
+func TestEvictingLearnsExistingBlocks(t *testing.T) {
+	under := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	old := blocks.NewBlock([]byte("old!"))
+	if err := under.Put(old); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := Evicting(context.Background(), under, 4, NewFIFO(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Put(blocks.NewBlock([]byte("new!"))); err != nil {
+		t.Fatal(err)
+	}
+	expectHas(t, bs, old.Key(), false)
+}
+
+// stuckDeletes is a blockstore failing to delete |stuck|.
+type stuckDeletes struct {
+	Blockstore
+	stuck key.Key
+}
+
+func (s stuckDeletes) DeleteBlock(k key.Key) error {
+	if k == s.stuck {
+		return errors.New("delete failed")
+	}
+	return s.Blockstore.DeleteBlock(k)
+}
+
+func TestEvictingRestoresOnFailure(t *testing.T) {
+	a, b := blocks.NewBlock([]byte("aaaa")), blocks.NewBlock([]byte("bbbb"))
+	under := stuckDeletes{NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())), b.Key()}
+	bs, err := Evicting(context.Background(), under, 8, NewFIFO(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blk := range []*blocks.Block{a, b} {
+		if err := bs.Put(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// making room takes evicting both, and b fails.
+	if err := bs.Put(blocks.NewBlock([]byte("eight by"))); err == nil {
+		t.Fatal("expected the failed eviction to fail the put")
+	}
+	expectHas(t, bs, a.Key(), true)
+	expectHas(t, bs, b.Key(), true)
+	expectUsage(t, bs, 2, 8)
+}
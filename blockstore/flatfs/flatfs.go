@@ -0,0 +1,389 @@
+// package flatfs stores blocks as files in a sharded directory layout.
+//
+// Every datastore key becomes one file, named by an encoding of the key safe
+// on every filesystem (see Names) and placed in a shard directory chosen
+// from the key's last component, so that the blocks of a blockstore, and
+// its metadata, spread across many directories instead of filling one.
+package flatfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	bstore "github.com/ipfs/go-blocks/blockstore"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+const (
+	extension  = ".data"
+	tempPrefix = ".put-"
+	// staleTemp is how old a temporary file must be for Compact to take it
+	// for one a crashed Put left behind, rather than one being written.
+	staleTemp = time.Hour
+)
+
+// ShardFunc names the shard directory for a file, given the encoded last
+// component of its key.
+type ShardFunc func(name string) string
+
+// Prefix shards by the first |n| characters of the encoded name. Block keys
+// are multihashes, which start with the same bytes for every block hashed
+// the same way, so |n| must reach past them (four characters for sha256)
+// to spread blocks at all.
+func Prefix(n int) ShardFunc {
+	return func(name string) string {
+		return (name + strings.Repeat("_", n))[:n]
+	}
+}
+
+// Suffix shards by the last |n| characters of the encoded name.
+func Suffix(n int) ShardFunc {
+	return func(name string) string {
+		name = strings.Repeat("_", n) + name
+		return name[len(name)-n:]
+	}
+}
+
+// DefaultShard is the ShardFunc used when none is given: 256 directories,
+// by the last byte of each key.
+var DefaultShard = Suffix(2)
+
+// Datastore is a ds.ThreadSafeDatastore keeping each value in its own file
+// below a root directory. Writes go to a temporary file that is synced and
+// then renamed into place, so a value is either fully written or absent.
+type Datastore struct {
+	path  string
+	shard ShardFunc
+	// names is the Names of the files, or migratingNames. It is accessed
+	// atomically.
+	names int32
+}
+
+var _ ds.ThreadSafeDatastore = (*Datastore)(nil)
+
+// New returns a Datastore rooted at |path|, creating the directory if
+// needed. |shard| lays out the files; nil means DefaultShard. A directory
+// must always be opened with the same ShardFunc. The Names of the files are
+// those the directory uses, Base32Names for a new one.
+func New(path string, shard ShardFunc) (*Datastore, error) {
+	if shard == nil {
+		shard = DefaultShard
+	}
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return nil, err
+	}
+	names, err := detectNames(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Datastore{path: path, shard: shard, names: int32(names)}, nil
+}
+
+// NewBlockstore returns a blockstore kept in a Datastore rooted at |path|.
+func NewBlockstore(path string, shard ShardFunc) (bstore.Blockstore, error) {
+	d, err := New(path, shard)
+	if err != nil {
+		return nil, err
+	}
+	return bstore.NewBlockstore(d), nil
+}
+
+func (fs *Datastore) Put(k ds.Key, value interface{}) error {
+	val, ok := value.([]byte)
+	if !ok {
+		return ds.ErrInvalidType
+	}
+
+	dir, path, old := fs.encode(k)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// dotfiles are skipped by queries, so a stray temporary file is harmless,
+	// until Compact removes it.
+	tmp, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed, which is fine.
+
+	if _, err := tmp.Write(val); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if old != "" {
+		return ignoreNotExist(os.Remove(old))
+	}
+	return nil
+}
+
+func (fs *Datastore) Get(k ds.Key) (interface{}, error) {
+	var data []byte
+	err := fs.lookup(k, func(path string) (err error) {
+		data, err = ioutil.ReadFile(path)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// GetRange reads only the part of the file asked for.
+func (fs *Datastore) GetRange(k ds.Key, offset, length int64) ([]byte, error) {
+	f, err := fs.open(k)
+	if os.IsNotExist(err) {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if rest := fi.Size() - offset; rest < length {
+		length = rest
+	}
+	if length <= 0 {
+		return []byte{}, nil
+	}
+	data := make([]byte, length)
+	n, err := f.ReadAt(data, offset)
+	if err == io.EOF {
+		err = nil // truncated since the Stat.
+	}
+	return data[:n], err
+}
+
+// GetPooled reads the file into a buffer from |p|.
+func (fs *Datastore) GetPooled(k ds.Key, p *blocks.BufferPool) ([]byte, error) {
+	f, err := fs.open(k)
+	if os.IsNotExist(err) {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if int64(int(fi.Size())) != fi.Size() {
+		return nil, syscall.EFBIG
+	}
+	buf := p.Get(int(fi.Size()))
+	n, err := io.ReadFull(f, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil // truncated since the Stat.
+	}
+	if err != nil {
+		p.Put(buf)
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// GetStream opens the file for reading.
+func (fs *Datastore) GetStream(k ds.Key) (io.ReadCloser, int64, error) {
+	f, err := fs.open(k)
+	if os.IsNotExist(err) {
+		return nil, 0, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+func (fs *Datastore) Has(k ds.Key) (bool, error) {
+	err := fs.lookup(k, func(path string) error {
+		_, err := os.Stat(path)
+		return err
+	})
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (fs *Datastore) Delete(k ds.Key) error {
+	_, path, old := fs.encode(k)
+	if old != "" {
+		// the old file first, so that a migration cannot move it back.
+		if err := os.Remove(old); err == nil {
+			return ignoreNotExist(os.Remove(path))
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return ds.ErrNotFound
+	}
+	return err
+}
+
+// open opens the file of |k|.
+func (fs *Datastore) open(k ds.Key) (*os.File, error) {
+	var f *os.File
+	err := fs.lookup(k, func(path string) (err error) {
+		f, err = os.Open(path)
+		return err
+	})
+	return f, err
+}
+
+// Query lists every file below the root, so its cost grows with the whole
+// datastore, whatever the prefix. Values are read only if asked for. While
+// MigrateNames runs, it may miss the keys being moved.
+func (fs *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	shards, err := ioutil.ReadDir(fs.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []dsq.Entry
+	// seen is for a key listed with both names while they are migrated.
+	seen := make(map[string]bool)
+	for _, shard := range shards {
+		if !shard.IsDir() || strings.HasPrefix(shard.Name(), ".") {
+			continue
+		}
+		dir := filepath.Join(fs.path, shard.Name())
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue // emptied by a migration.
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			k, ok := decode(fi.Name())
+			if !ok || seen[k.String()] || !strings.HasPrefix(k.String(), q.Prefix) {
+				continue
+			}
+			e := dsq.Entry{Key: k.String()}
+			if !q.KeysOnly {
+				data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+				if os.IsNotExist(err) {
+					continue // deleted since listed.
+				}
+				if err != nil {
+					return nil, err
+				}
+				e.Value = data
+			}
+			seen[e.Key] = true
+			entries = append(entries, e)
+		}
+	}
+
+	r := dsq.ResultsWithEntries(q, entries)
+	r = dsq.NaiveQueryApply(q, r)
+	return r, nil
+}
+
+func (*Datastore) IsThreadSafe() {}
+
+var _ bstore.RangeDatastore = (*Datastore)(nil)
+
+var _ bstore.DiskUsager = (*Datastore)(nil)
+
+// DiskUsage returns the total size of the files below the root directory,
+// temporary files included.
+func (fs *Datastore) DiskUsage() (uint64, error) {
+	var total uint64
+	err := filepath.Walk(fs.path, func(_ string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil // removed while walking.
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			total += uint64(fi.Size())
+		}
+		return nil
+	})
+	return total, err
+}
+
+var _ bstore.CompactingDatastore = (*Datastore)(nil)
+
+// Compact removes the temporary files older than an hour, returning their
+// total size. Each value being a file of its own, deleting it frees its space
+// at once, so there is nothing else to do.
+func (fs *Datastore) Compact(ctx context.Context) (uint64, error) {
+	shards, err := ioutil.ReadDir(fs.path)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-staleTemp)
+	var total uint64
+	for _, shard := range shards {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		if !shard.IsDir() {
+			continue
+		}
+		dir := filepath.Join(fs.path, shard.Name())
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return total, err
+		}
+		for _, fi := range files {
+			if !strings.HasPrefix(fi.Name(), tempPrefix) || fi.ModTime().After(cutoff) {
+				continue
+			}
+			err := os.Remove(filepath.Join(dir, fi.Name()))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return total, err
+			}
+			total += uint64(fi.Size())
+		}
+	}
+	return total, nil
+}
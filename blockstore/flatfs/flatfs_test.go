@@ -0,0 +1,471 @@
+package flatfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	bstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "flatfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBlockstore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	bs, err := NewBlockstore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ks []key.Key
+	for i := 0; i < 20; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("flatfs block %d", i)))
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Key())
+	}
+	if err := bs.DeleteBlock(ks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// everything survives reopening.
+	bs, err = NewBlockstore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bs.Get(ks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Data, []byte("flatfs block 1")) {
+		t.Fatalf("unexpected block data %q", b.Data)
+	}
+	if has, _ := bs.Has(ks[0]); has {
+		t.Fatal("deleted block still present")
+	}
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _ = range ch {
+		n++
+	}
+	if n != 19 {
+		t.Fatalf("expected 19 keys, got %d", n)
+	}
+}
+
+func TestSharding(t *testing.T) {
+	for _, c := range []struct {
+		shard ShardFunc
+		want  func(name string) string
+	}{
+		{Prefix(4), func(name string) string { return name[:4] }},
+		{Suffix(3), func(name string) string { return name[len(name)-3:] }},
+	} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		d, err := New(dir, c.shard)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b := blocks.NewBlock([]byte("sharded block"))
+		k := b.Key().DsKey()
+		if err := d.Put(k, b.Data); err != nil {
+			t.Fatal(err)
+		}
+		name := b32Names.EncodeToString([]byte(k.Name()))
+		shard := filepath.Join(dir, c.want(name))
+		files, err := ioutil.ReadDir(shard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("expected one file in %s, got %d", shard, len(files))
+		}
+	}
+}
+
+func TestShortNamesArePadded(t *testing.T) {
+	if s := Prefix(4)("ab"); s != "ab__" {
+		t.Fatalf("unexpected prefix shard %q", s)
+	}
+	if s := Suffix(4)("ab"); s != "__ab" {
+		t.Fatalf("unexpected suffix shard %q", s)
+	}
+}
+
+func TestStatReportsDiskUsage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	bs, err := NewBlockstore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size uint64
+	for i := 0; i < 5; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("counted block %d", i)))
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		size += uint64(len(b.Data))
+	}
+	u, err := bstore.Stat(context.Background(), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Blocks != 5 || u.Bytes != size {
+		t.Fatalf("expected 5 blocks of %d bytes, got %+v", size, u)
+	}
+	if u.DiskBytes < size {
+		t.Fatalf("expected at least %d bytes on disk, got %d", size, u.DiskBytes)
+	}
+}
+
+func TestCompactRemovesStaleTemporaryFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	bs, err := NewBlockstore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock([]byte("kept block"))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	shard := filepath.Join(dir, "ab")
+	if err := os.MkdirAll(shard, 0777); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(shard, tempPrefix+"stale")
+	fresh := filepath.Join(shard, tempPrefix+"fresh")
+	for _, p := range []string{stale, fresh} {
+		if err := ioutil.WriteFile(p, []byte("half written"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * staleTemp)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := bstore.Compact(context.Background(), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != uint64(len("half written")) {
+		t.Fatalf("expected %d bytes reclaimed, got %d", len("half written"), n)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatal("stale temporary file not removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatal("temporary file being written removed:", err)
+	}
+	if has, _ := bs.Has(b.Key()); !has {
+		t.Fatal("block lost by compaction")
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	bs, err := NewBlockstore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock([]byte("a file read in part"))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bstore.GetRange(bs, b.Key(), 2, 4)
+	if err != nil || string(got) != "file" {
+		t.Fatalf("range read as %q, %v", got, err)
+	}
+	if got, err := bstore.GetRange(bs, b.Key(), 15, 100); err != nil || string(got) != "part" {
+		t.Fatalf("range past the end read as %q, %v", got, err)
+	}
+	if _, err := bstore.GetRange(bs, blocks.NewBlock([]byte("missing")).Key(), 0, 1); err != bstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestGetStream(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	bs, err := NewBlockstore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock([]byte("a file read as a stream"))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bstore.GetStream(bs, b.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Data != nil || got.Size() != int64(len(b.Data)) || got.Key() != b.Key() {
+		t.Fatalf("expected a lazy block of %d bytes, got %v of %d", len(b.Data), got, got.Size())
+	}
+	for i := 0; i < 2; i++ {
+		r, err := got.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(data, b.Data) {
+			t.Fatalf("read %d streamed %q, %v", i, data, err)
+		}
+	}
+	if err := bs.Put(got); err != blocks.ErrLazyBlock {
+		t.Fatalf("expected ErrLazyBlock storing a streamed block, got %v", err)
+	}
+	if _, err := bstore.GetStream(bs, blocks.NewBlock([]byte("missing")).Key()); err != bstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestGetMapped(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	bs, err := NewBlockstore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock([]byte("a file read through a memory map"))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bstore.GetMapped(bs, b.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the mapping keeps its data once the block is deleted.
+	if err := bs.DeleteBlock(b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, b.Data) || got.Key() != b.Key() {
+		t.Fatalf("mapped %v as %q", got, got.Data)
+	}
+	if err := got.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bstore.GetMapped(bs, b.Key()); err != bstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	first, closer, err := NewLockedBlockstore(ctx, dir, nil, bstore.LockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewLockedBlockstore(ctx, dir, nil, bstore.LockOptions{}); err != bstore.ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	ro, roCloser, err := NewLockedBlockstore(ctx, dir, nil, bstore.LockOptions{ReadOnlyFallback: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roCloser.Close()
+	if !bstore.IsReadOnly(ro) || bstore.IsReadOnly(first) {
+		t.Fatal("expected only the fallback to be read-only")
+	}
+	ch, err := first.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range ch {
+		t.Fatalf("the lock file was listed as block %s", k)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, c, err := NewLockedBlockstore(ctx, dir, nil, bstore.LockOptions{Wait: true, PollInterval: time.Millisecond})
+		if err == nil {
+			err = c.Close()
+		}
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("waiting for the lock: %v", err)
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, held, _ := NewLockedBlockstore(ctx, dir, nil, bstore.LockOptions{})
+	defer held.Close()
+	if _, _, err := NewLockedBlockstore(wctx, dir, nil, bstore.LockOptions{Wait: true}); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+}
+
+func TestMigrateNames(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// a directory made before names were recorded.
+	legacy := bstore.NewBlockstore(&Datastore{path: dir, shard: DefaultShard, names: int32(HexNames)})
+	var ks []key.Key
+	for i := 0; i < 20; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("legacy block %d", i)))
+		if err := legacy.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Key())
+	}
+	d, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := d.Names(); n != HexNames {
+		t.Fatalf("expected hex names detected, got %s", n)
+	}
+
+	n, err := d.MigrateNames(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 {
+		t.Fatalf("expected 20 files moved, got %d", n)
+	}
+	d, err = New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := d.Names(); n != Base32Names {
+		t.Fatalf("expected base32 names recorded, got %s", n)
+	}
+	bs := bstore.NewBlockstore(d)
+	for i, k := range ks {
+		b, err := bs.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("legacy block %d", i); string(b.Data) != want {
+			t.Fatalf("unexpected block data %q", b.Data)
+		}
+	}
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _ = range ch {
+		count++
+	}
+	if count != 20 {
+		t.Fatalf("expected 20 keys, got %d", count)
+	}
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && filepath.Ext(path) == extension {
+			t.Errorf("%s left with its hex name", path)
+		}
+		return nil
+	})
+}
+
+func TestMigratingNamesReadsBoth(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	legacy := &Datastore{path: dir, shard: DefaultShard, names: int32(HexNames)}
+	old, moved := ds.NewKey("/old"), ds.NewKey("/moved")
+	for _, k := range []ds.Key{old, moved} {
+		if err := legacy.Put(k, []byte(k.String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// as a migration cut short leaves it.
+	if err := recordNames(dir, migratingNames); err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hexFile := d.encodeAs(moved, HexNames)
+	if err := d.move(moved, hexFile); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []ds.Key{old, moved} {
+		if v, err := d.Get(k); err != nil || string(v.([]byte)) != k.String() {
+			t.Fatalf("reading %s: %v", k, err)
+		}
+	}
+	if err := d.Delete(old); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := d.Has(old); has {
+		t.Fatal("deleted key still present")
+	}
+	if n, err := d.MigrateNames(context.Background()); err != nil || n != 0 {
+		t.Fatalf("expected nothing left to move, got %d, %v", n, err)
+	}
+}
+
+func TestReservedNamesEscaped(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	d, err := New(dir, Prefix(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// encodes as "conaaaaa", in the shard Windows would take for its console.
+	k := ds.NewKey("/\x13\x9a\x00\x00\x00")
+	if err := d.Put(k, []byte("escaped")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "_con")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decode("_" + "com4" + extensionB32); !ok {
+		t.Fatal("expected an escaped name to decode")
+	}
+	res, err := d.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != k.String() {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
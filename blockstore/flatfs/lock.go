@@ -0,0 +1,33 @@
+package flatfs
+
+import (
+	"io"
+	"path/filepath"
+
+	bstore "github.com/ipfs/go-blocks/blockstore"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// lockFile is the name of the lock file in a Datastore's directory. Its
+// leading dot keeps it out of queries.
+const lockFile = ".lock"
+
+// Lock returns a bstore.Locker for the Datastore rooted at |path|, kept in a
+// file in that directory, which must exist. Where the OS supports it, the
+// lock is an flock, released when its process exits, however it does;
+// elsewhere it is the file's existence, which a process that dies holding
+// it leaves behind, to be removed by hand.
+func Lock(path string) bstore.Locker {
+	return &fileLock{path: filepath.Join(path, lockFile)}
+}
+
+// NewLockedBlockstore is NewBlockstore, holding Lock(|path|) as
+// bstore.Locked does with |opts|, until the io.Closer is closed.
+func NewLockedBlockstore(ctx context.Context, path string, shard ShardFunc, opts bstore.LockOptions) (bstore.Blockstore, io.Closer, error) {
+	bs, err := NewBlockstore(path, shard)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bstore.Locked(ctx, bs, Lock(path), opts)
+}
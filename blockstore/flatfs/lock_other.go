@@ -0,0 +1,46 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package flatfs
+
+import (
+	"os"
+	"sync"
+
+	bstore "github.com/ipfs/go-blocks/blockstore"
+)
+
+type fileLock struct {
+	path string
+
+	mu     sync.Mutex
+	locked bool
+}
+
+func (l *fileLock) TryLock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locked {
+		return bstore.ErrLocked
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return bstore.ErrLocked
+	}
+	if err != nil {
+		return err
+	}
+	f.Close()
+	l.locked = true
+	return nil
+}
+
+func (l *fileLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.locked {
+		return nil
+	}
+	l.locked = false
+	return os.Remove(l.path)
+}
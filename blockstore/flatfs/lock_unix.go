@@ -0,0 +1,56 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package flatfs
+
+import (
+	"os"
+	"sync"
+	"syscall"
+
+	bstore "github.com/ipfs/go-blocks/blockstore"
+)
+
+type fileLock struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File // while locked
+}
+
+func (l *fileLock) TryLock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		return bstore.ErrLocked
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return bstore.ErrLocked
+		}
+		return err
+	}
+	l.f = f
+	return nil
+}
+
+// Unlock leaves the file in place: removing it could let two processes
+// lock different files of the same name.
+func (l *fileLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
@@ -0,0 +1,18 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package flatfs
+
+import (
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+)
+
+// GetMapped reads the file, as Get does, where memory maps are not
+// supported.
+func (fs *Datastore) GetMapped(k ds.Key) ([]byte, func() error, error) {
+	v, err := fs.Get(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v.([]byte), func() error { return nil }, nil
+}
@@ -0,0 +1,43 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package flatfs
+
+import (
+	"os"
+	"syscall"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+)
+
+// GetMapped maps the file read-only. Files are replaced by renaming a new
+// one into place, never written in place, so a mapping keeps the value it
+// was made with whatever later puts and deletes do.
+func (fs *Datastore) GetMapped(k ds.Key) ([]byte, func() error, error) {
+	f, err := fs.open(k)
+	if os.IsNotExist(err) {
+		return nil, nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// the mapping stays valid once the file is closed.
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		// an empty mapping is invalid.
+		return []byte{}, func() error { return nil }, nil
+	}
+	if int64(int(size)) != size {
+		return nil, nil, syscall.EFBIG
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,275 @@
+package flatfs
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Names is how a Datastore names the files of its keys. New detects the
+// one a directory uses; a new directory gets Base32Names.
+type Names int32
+
+const (
+	// HexNames names a file by the hex encoding of its key, with a .data
+	// extension. It is the scheme of the directories made before Names
+	// were recorded, which MigrateNames moves to Base32Names.
+	HexNames Names = iota
+	// Base32Names names a file by the lowercase, unpadded base32 encoding
+	// of its key, with a .b32 extension, which is shorter, so that longer
+	// keys fit in the limits of file names and paths. A name Windows
+	// reserves for a device, such as "con" or "lpt2", gets a leading
+	// underscore, as does a shard directory. Like hex, it never differs
+	// only by case, nor has a character some filesystem forbids, so that
+	// it is safe on case-insensitive ones, such as those of Windows and
+	// macOS.
+	Base32Names
+	// migratingNames is the state of a directory MigrateNames is moving
+	// from HexNames to Base32Names: files are written with Base32Names,
+	// and looked up with both.
+	migratingNames
+)
+
+func (n Names) String() string {
+	switch n {
+	case HexNames:
+		return "hex"
+	case Base32Names:
+		return "base32"
+	case migratingNames:
+		return "hex>base32"
+	}
+	return "unknown"
+}
+
+// namesFile records the Names of a Datastore's directory. Its leading dot
+// keeps it out of queries.
+const namesFile = ".names"
+
+const extensionB32 = ".b32"
+
+var b32Names = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// reservedNames are the names Windows gives to devices, whatever their
+// extension, that base32 can spell.
+var reservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true,
+	"lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true,
+}
+
+// escape prefixes |name| with an underscore if Windows reserves it. Neither
+// encoding has underscores, so unescaping is unambiguous.
+func escape(name string) string {
+	if reservedNames[name] {
+		return "_" + name
+	}
+	return name
+}
+
+// detectNames returns the Names recorded in |path|, or if there is no
+// record, HexNames for a directory holding shards, and Base32Names, which
+// it records, for an empty one.
+func detectNames(path string) (Names, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, namesFile))
+	if err == nil {
+		for _, n := range []Names{HexNames, Base32Names, migratingNames} {
+			if strings.TrimSpace(string(data)) == n.String() {
+				return n, nil
+			}
+		}
+		return 0, fmt.Errorf("flatfs: unknown file names %q in %s", data, path)
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+			return HexNames, nil
+		}
+	}
+	return Base32Names, recordNames(path, Base32Names)
+}
+
+// recordNames records |n| as the Names of |path|.
+func recordNames(path string, n Names) error {
+	tmp, err := ioutil.TempFile(path, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(n.String() + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(path, namesFile))
+}
+
+// Names returns the file names the Datastore uses.
+func (fs *Datastore) Names() Names {
+	if n := Names(atomic.LoadInt32(&fs.names)); n != migratingNames {
+		return n
+	}
+	return Base32Names
+}
+
+// encodeAs returns the shard directory and file of |k| with |n|.
+func (fs *Datastore) encodeAs(k ds.Key, n Names) (dir, file string) {
+	if n == HexNames {
+		name := hex.EncodeToString([]byte(k.Name()))
+		dir = filepath.Join(fs.path, escape(fs.shard(name)))
+		return dir, filepath.Join(dir, hex.EncodeToString(k.Bytes()[1:])+extension)
+	}
+	name := b32Names.EncodeToString([]byte(k.Name()))
+	dir = filepath.Join(fs.path, escape(fs.shard(name)))
+	return dir, filepath.Join(dir, escape(b32Names.EncodeToString(k.Bytes()[1:]))+extensionB32)
+}
+
+// encode returns the shard directory and file |k| is written to, and its
+// file with HexNames if it may still be there, during a migration.
+func (fs *Datastore) encode(k ds.Key) (dir, file, old string) {
+	n := Names(atomic.LoadInt32(&fs.names))
+	if n != migratingNames {
+		dir, file = fs.encodeAs(k, n)
+		return dir, file, ""
+	}
+	dir, file = fs.encodeAs(k, Base32Names)
+	_, old = fs.encodeAs(k, HexNames)
+	return dir, file, old
+}
+
+// lookup calls |op| with the file of |k|, and while names are migrated, if
+// it is not there, with its old file, then with its file again, in case the
+// migration moved it in between. |op| returns the error of the filesystem.
+func (fs *Datastore) lookup(k ds.Key, op func(path string) error) error {
+	_, file, old := fs.encode(k)
+	err := op(file)
+	if old == "" || !os.IsNotExist(err) {
+		return err
+	}
+	if err = op(old); !os.IsNotExist(err) {
+		return err
+	}
+	return op(file)
+}
+
+// decode returns the key of the file named |file|, with either Names.
+func decode(file string) (ds.Key, bool) {
+	var k []byte
+	var err error
+	switch filepath.Ext(file) {
+	case extension:
+		k, err = hex.DecodeString(strings.TrimSuffix(file, extension))
+	case extensionB32:
+		k, err = b32Names.DecodeString(strings.TrimPrefix(strings.TrimSuffix(file, extensionB32), "_"))
+	default:
+		return ds.Key{}, false
+	}
+	if err != nil {
+		return ds.Key{}, false
+	}
+	return ds.NewKey(string(k)), true
+}
+
+// MigrateNames moves the files of a Datastore using HexNames to
+// Base32Names, and returns how many it moved. The Datastore stays usable
+// meanwhile, reading the files with either names, but no other Datastore
+// opened on the directory before it started may write to it. If it fails,
+// or |ctx| is done, the directory is left part way, which New detects, to
+// be finished by calling it again. It does nothing for a Datastore already
+// using Base32Names.
+func (fs *Datastore) MigrateNames(ctx context.Context) (int, error) {
+	if Names(atomic.LoadInt32(&fs.names)) == Base32Names {
+		return 0, nil
+	}
+	if err := recordNames(fs.path, migratingNames); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt32(&fs.names, int32(migratingNames))
+
+	shards, err := ioutil.ReadDir(fs.path)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, shard := range shards {
+		if !shard.IsDir() || strings.HasPrefix(shard.Name(), ".") {
+			continue
+		}
+		dir := filepath.Join(fs.path, shard.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return moved, err
+		}
+		for _, fi := range files {
+			if err := ctx.Err(); err != nil {
+				return moved, err
+			}
+			if filepath.Ext(fi.Name()) != extension {
+				continue
+			}
+			k, ok := decode(fi.Name())
+			if !ok {
+				continue
+			}
+			if err := fs.move(k, filepath.Join(dir, fi.Name())); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+		// the hex shard is empty now, unless also a base32 one.
+		os.Remove(dir)
+	}
+	if err := recordNames(fs.path, Base32Names); err != nil {
+		return moved, err
+	}
+	atomic.StoreInt32(&fs.names, int32(Base32Names))
+	return moved, nil
+}
+
+// move moves the file |old| of |k| to its Base32Names file, unless a put
+// made while migrating already wrote that.
+func (fs *Datastore) move(k ds.Key, old string) error {
+	dir, file := fs.encodeAs(k, Base32Names)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// a link, unlike a rename, never replaces the newer file of a put.
+	switch err := os.Link(old, file); {
+	case err == nil || os.IsExist(err):
+	case os.IsNotExist(err):
+		return nil // deleted meanwhile.
+	default:
+		// the filesystem may not have links.
+		if _, serr := os.Stat(file); os.IsNotExist(serr) {
+			return ignoreNotExist(os.Rename(old, file))
+		}
+	}
+	return ignoreNotExist(os.Remove(old))
+}
+
+func ignoreNotExist(err error) error {
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
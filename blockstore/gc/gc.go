@@ -0,0 +1,140 @@
+// package gc removes the blocks of a blockstore that are not pinned.
+package gc
+
+import (
+	"errors"
+	"fmt"
+
+	blocks "github.com/ipfs/go-blocks"
+	bstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// LinkFunc returns the keys of the blocks |b| links to.
+type LinkFunc func(b *blocks.Block) ([]key.Key, error)
+
+// Pins are the blocks a collection keeps.
+type Pins interface {
+	// Hold returns the keys pinned, and keeps new pins from being made
+	// until |release| is called.
+	Hold() (pinned []key.Key, release func())
+}
+
+// Keys returns the Pins of a fixed set.
+func Keys(pinned key.KeySet) Pins {
+	return keySet{pinned}
+}
+
+type keySet struct {
+	s key.KeySet
+}
+
+func (p keySet) Hold() ([]key.Key, func()) {
+	if p.s == nil {
+		return nil, func() {}
+	}
+	return p.s.Keys(), func() {}
+}
+
+// GC deletes every block of |bs| that is not reachable from |pins| through
+// |links|, streaming the keys it removed. A nil |links| means blocks have
+// none, and nil |pins| that none are pinned. The pins are held from before
+// the blocks they reach are worked out until the channel is closed, so that
+// a block pinned meanwhile is not collected; pin.Pinner is such Pins.
+// Pinned blocks missing from |bs| are skipped, along with what they link
+// to, while a failure to read one or its links fails GC before anything is
+// deleted.
+//
+// The garbage is listed in full before the first block is deleted, so the
+// keys query does not run over a changing store. A block that fails to
+// delete is left in place and not sent; a later GC will try it again. The
+// channel is closed when the collection is done or |ctx| is cancelled.
+func GC(ctx context.Context, bs bstore.Blockstore, pins Pins, links LinkFunc) (<-chan key.Key, error) {
+	release := func() {}
+	var pinned []key.Key
+	if pins != nil {
+		pinned, release = pins.Hold()
+	}
+	keep, err := reachable(ctx, bs, pinned, links)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	all, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		defer release()
+
+		var garbage []key.Key
+		for k := range all {
+			if _, ok := keep[k]; !ok {
+				garbage = append(garbage, k)
+			}
+		}
+		if ctx.Err() != nil {
+			return // the listing may be incomplete, but that's harmless.
+		}
+
+		for _, k := range garbage {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := bs.DeleteBlock(k); err != nil {
+				continue
+			}
+			select {
+			case out <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// reachable returns |roots| and the keys of the blocks of |bs| they reach
+// through |links|.
+func reachable(ctx context.Context, bs bstore.Blockstore, roots []key.Key, links LinkFunc) (map[key.Key]struct{}, error) {
+	seen := make(map[key.Key]struct{}, len(roots))
+	for _, k := range roots {
+		seen[k] = struct{}{}
+	}
+	if links == nil {
+		return seen, nil
+	}
+	queue := append([]key.Key(nil), roots...)
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		k := queue[0]
+		queue = queue[1:]
+		b, err := bs.Get(k)
+		if errors.Is(err, bstore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gc: reading %s: %w", k, err)
+		}
+		ls, err := links(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range ls {
+			if _, ok := seen[l]; !ok {
+				seen[l] = struct{}{}
+				queue = append(queue, l)
+			}
+		}
+	}
+	return seen, nil
+}
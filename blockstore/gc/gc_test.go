@@ -0,0 +1,74 @@
+package gc
+
+import (
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	bstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestGCKeepsPinned(t *testing.T) {
+	bs := bstore.NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	var keys []key.Key
+	for i := 0; i < 10; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("gc block %d", i)))
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, b.Key())
+	}
+
+	pinned := key.NewKeySet()
+	for _, k := range keys[:3] {
+		pinned.Add(k)
+	}
+
+	removed, err := GC(context.Background(), bs, Keys(pinned), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := make(map[key.Key]bool)
+	for k := range removed {
+		gone[k] = true
+	}
+	if len(gone) != 7 {
+		t.Fatalf("expected 7 blocks removed, got %d", len(gone))
+	}
+
+	for i, k := range keys {
+		has, err := bs.Has(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pin := i < 3; has != pin || gone[k] == pin {
+			t.Fatalf("block %d: pinned %v, present %v, reported removed %v", i, pin, has, gone[k])
+		}
+	}
+}
+
+func TestGCNilPinsetRemovesAll(t *testing.T) {
+	bs := bstore.NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	for i := 0; i < 4; i++ {
+		if err := bs.Put(blocks.NewBlock([]byte(fmt.Sprintf("gc block %d", i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := GC(context.Background(), bs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range removed {
+		n++
+	}
+	if n != 4 {
+		t.Fatalf("expected 4 blocks removed, got %d", n)
+	}
+}
@@ -0,0 +1,65 @@
+package blockstore
+
+import (
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// HasManyDatastore is implemented by datastores that can check for many
+// keys at once for less than checking them one by one, such as those over a
+// network. Blockstores made by NewBlockstore over one use it for HasMany.
+type HasManyDatastore interface {
+	// HasMany reports, for each of |ks|, whether it has a value.
+	HasMany(ctx context.Context, ks []ds.Key) ([]bool, error)
+}
+
+// HasManyChecker is implemented by blockstores that can check for many
+// blocks at once. Use HasMany for the others.
+type HasManyChecker interface {
+	HasMany(ctx context.Context, ks []key.Key) ([]bool, error)
+}
+
+// HasMany reports, for each of |ks|, whether |bs| has the block, in one
+// call if |bs| is a HasManyChecker, and with Has for each key otherwise,
+// which stops with ctx.Err() once |ctx| is done.
+func HasMany(ctx context.Context, bs Blockstore, ks []key.Key) ([]bool, error) {
+	if hc, ok := bs.(HasManyChecker); ok {
+		return hc.HasMany(ctx, ks)
+	}
+	return hasEach(ctx, bs, ks)
+}
+
+func hasEach(ctx context.Context, bs Blockstore, ks []key.Key) ([]bool, error) {
+	has := make([]bool, len(ks))
+	for i, k := range ks {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ok, err := bs.Has(k)
+		if err != nil {
+			return nil, err
+		}
+		has[i] = ok
+	}
+	return has, nil
+}
+
+// HasMany asks the datastore for all of |ks| at once if it is a
+// HasManyDatastore, and for each with Has otherwise.
+func (bs *blockstore) HasMany(ctx context.Context, ks []key.Key) ([]bool, error) {
+	hd, ok := bs.root.(HasManyDatastore)
+	if !ok {
+		return hasEach(ctx, bs, ks)
+	}
+
+	bs.swap.RLock()
+	defer bs.swap.RUnlock()
+	// the namespace wrapper hides HasMany, so the keys are prefixed by hand.
+	dks := make([]ds.Key, len(ks))
+	for i, k := range ks {
+		dks[i] = bs.prefix.blocks.Child(k.DsKey())
+	}
+	return hd.HasMany(ctx, dks)
+}
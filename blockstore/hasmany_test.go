@@ -0,0 +1,70 @@
+package blockstore
+
+import (
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// hasManyDatastore is a map datastore that counts the bulk checks made of it.
+type hasManyDatastore struct {
+	ds.ThreadSafeDatastore
+	calls int
+}
+
+func (d *hasManyDatastore) HasMany(ctx context.Context, ks []ds.Key) ([]bool, error) {
+	d.calls++
+	has := make([]bool, len(ks))
+	for i, k := range ks {
+		ok, err := d.Has(k)
+		if err != nil {
+			return nil, err
+		}
+		has[i] = ok
+	}
+	return has, nil
+}
+
+func TestHasMany(t *testing.T) {
+	bulk := &hasManyDatastore{ThreadSafeDatastore: dssync.MutexWrap(ds.NewMapDatastore())}
+	for _, bs := range []Blockstore{
+		NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		NewBlockstore(bulk),
+		ReadOnly(NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))),
+	} {
+		var ks []key.Key
+		for i := 0; i < 6; i++ {
+			b := blocks.NewBlock([]byte(fmt.Sprintf("has many %d", i)))
+			if i%2 == 0 {
+				if err := bs.Put(b); err != nil && err != ErrReadOnly {
+					t.Fatal(err)
+				}
+			}
+			ks = append(ks, b.Key())
+		}
+		has, err := HasMany(context.Background(), bs, ks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, ok := range has {
+			if want := i%2 == 0 && !IsReadOnly(bs); ok != want {
+				t.Fatalf("key %d: expected %v, got %v", i, want, ok)
+			}
+		}
+	}
+	if bulk.calls != 1 {
+		t.Fatalf("expected one bulk check of the datastore, got %d", bulk.calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := HasMany(ctx, ReadOnly(NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))), []key.Key{"a"}); err != context.Canceled {
+		t.Fatalf("expected the check to be cut short, got %v", err)
+	}
+}
@@ -0,0 +1,631 @@
+package blockstore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var (
+	// ErrNoIndex is returned by NewIndexed for a blockstore it can't index,
+	// one not made by NewBlockstore or NamespacedBlockstore.
+	ErrNoIndex = errors.New("blockstore: indexes need a blockstore made by NewBlockstore")
+	// ErrUnknownIndex is returned by the queries of an Indexed blockstore
+	// for an index it does not keep.
+	ErrUnknownIndex = errors.New("blockstore: no such index")
+)
+
+// An Index names the values blocks can be looked up by in an Indexed
+// blockstore, such as their size or the application they belong to.
+type Index interface {
+	// Name names the index. It must not be empty, nor contain a "/".
+	Name() string
+	// Values returns the values |b|, first put at |now|, is indexed under.
+	// Empty values are ignored.
+	Values(b *blocks.Block, now time.Time) []string
+}
+
+// IndexFunc returns an Index named |name| of the values |values| returns.
+func IndexFunc(name string, values func(b *blocks.Block, now time.Time) []string) Index {
+	return indexFunc{name, values}
+}
+
+type indexFunc struct {
+	name   string
+	values func(*blocks.Block, time.Time) []string
+}
+
+func (f indexFunc) Name() string { return f.name }
+
+func (f indexFunc) Values(b *blocks.Block, now time.Time) []string {
+	return f.values(b, now)
+}
+
+// SizeIndex indexes blocks by the bucket of their size; see SizeBucket.
+var SizeIndex = IndexFunc("size", func(b *blocks.Block, _ time.Time) []string {
+	return []string{SizeBucket(len(b.Data))}
+})
+
+// SizeBucket returns the value SizeIndex indexes a block of |n| bytes under:
+// the number of bits of |n|, in two digits so that buckets sort as sizes do.
+// Bucket "00" holds empty blocks, and bucket i the sizes from 2^(i-1) to
+// 2^i-1.
+func SizeBucket(n int) string {
+	bits := 0
+	for ; n > 0; n >>= 1 {
+		bits++
+	}
+	return fmt.Sprintf("%02d", bits)
+}
+
+// CreatedIndex indexes blocks by the time they were first put; see
+// CreatedValue.
+var CreatedIndex = IndexFunc("created", func(_ *blocks.Block, now time.Time) []string {
+	return []string{CreatedValue(now)}
+})
+
+// CreatedValue returns the value CreatedIndex indexes a block first put at
+// |t| under. Values sort as the times do.
+func CreatedValue(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+// TagsIndex names the index of the tags an Indexed blockstore's Tag gives
+// blocks.
+const TagsIndex = "tags"
+
+// IndexEntry is a block and a value an index has it under.
+type IndexEntry struct {
+	Value string
+	Key   key.Key
+}
+
+// Indexed is a blockstore keeping secondary indexes of its blocks, to look
+// them up by other things than their key. Its writes update the indexes
+// with the blocks, in the same datastore batch if the datastore is a
+// BatchingDatastore, and so atomically; otherwise an interrupted write may
+// leave entries of blocks that aren't stored, which Reindex removes.
+//
+// A block is indexed the first time it is put, and its entries are kept
+// until it is deleted, so that putting it again does not change the time
+// CreatedIndex has for it. Blocks stored before an index was added are
+// indexed by Reindex. Indexes live below IndexPrefix, with, for each index,
+// /<name>/values/<hex value>/<b58 key> entries, to look blocks up by, and
+// /<name>/keys/<b58 key> entries, holding the values of each block.
+type Indexed struct {
+	*blockstore
+	indexes map[string]Index
+
+	// mu serializes writes, which read the entries they replace.
+	mu sync.Mutex
+}
+
+// NewIndexed returns |bs|, which must have been made by NewBlockstore or
+// NamespacedBlockstore, keeping |indexes| and TagsIndex. Wrap the Indexed
+// blockstore, not |bs|, with the likes of CachedBlockstore, so that every
+// write goes through it.
+func NewIndexed(bs Blockstore, indexes ...Index) (*Indexed, error) {
+	b, ok := bs.(*blockstore)
+	if !ok {
+		return nil, ErrNoIndex
+	}
+	x := &Indexed{blockstore: b, indexes: make(map[string]Index)}
+	for _, ix := range indexes {
+		name := ix.Name()
+		if _, dup := x.indexes[name]; dup || name == "" || name == TagsIndex || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("blockstore: invalid index name %q", name)
+		}
+		x.indexes[name] = ix
+	}
+	return x, nil
+}
+
+// dsWrite is a write to the root datastore, of a block or an index entry,
+// committed with those of the same operation.
+type dsWrite struct {
+	k     ds.Key
+	v     []byte
+	isDel bool
+}
+
+func (x *Indexed) valuesKey(index, value string, k key.Key) ds.Key {
+	return x.prefix.index.Child(ds.KeyWithNamespaces([]string{index, "values", hex.EncodeToString([]byte(value)), k.B58String()}))
+}
+
+func (x *Indexed) keysKey(index string, k key.Key) ds.Key {
+	return x.prefix.index.Child(ds.KeyWithNamespaces([]string{index, "keys", k.B58String()}))
+}
+
+func (x *Indexed) known(index string) bool {
+	_, ok := x.indexes[index]
+	return ok || index == TagsIndex
+}
+
+// names returns the names of the indexes kept, TagsIndex included.
+func (x *Indexed) names() []string {
+	names := []string{TagsIndex}
+	for name := range x.indexes {
+		names = append(names, name)
+	}
+	return names
+}
+
+// values returns the values |k| is indexed under in |index|, and whether it
+// is indexed there at all.
+func (x *Indexed) values(index string, k key.Key) ([]string, bool, error) {
+	v, err := x.root.Get(x.keysKey(index, k))
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, false, ValueTypeMismatch
+	}
+	var vs []string
+	if err := json.Unmarshal(data, &vs); err != nil {
+		return nil, false, err
+	}
+	return vs, true, nil
+}
+
+// setValues returns the writes replacing the values |k| is indexed under in
+// |index|, |old|, with |values|.
+func (x *Indexed) setValues(index string, k key.Key, old, values []string) ([]dsWrite, error) {
+	values = uniqueValues(values)
+	enc, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool, len(values))
+	for _, v := range values {
+		keep[v] = true
+	}
+	var w []dsWrite
+	for _, v := range old {
+		if !keep[v] {
+			w = append(w, dsWrite{k: x.valuesKey(index, v, k), isDel: true})
+		}
+		delete(keep, v)
+	}
+	for _, v := range values {
+		if keep[v] {
+			w = append(w, dsWrite{k: x.valuesKey(index, v, k), v: []byte{}})
+		}
+	}
+	return append(w, dsWrite{k: x.keysKey(index, k), v: enc}), nil
+}
+
+// uniqueValues returns |values| without duplicates or empty values, sorted.
+func uniqueValues(values []string) []string {
+	out := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// index returns the writes indexing |b|, put at |now|, in the indexes it is
+// not indexed in yet.
+func (x *Indexed) index(b *blocks.Block, now time.Time) ([]dsWrite, error) {
+	var w []dsWrite
+	for _, name := range x.names() {
+		_, indexed, err := x.values(name, b.Key())
+		if err != nil {
+			return nil, err
+		}
+		if indexed {
+			continue
+		}
+		var values []string
+		if ix, ok := x.indexes[name]; ok {
+			values = ix.Values(b, now)
+		}
+		ws, err := x.setValues(name, b.Key(), nil, values)
+		if err != nil {
+			return nil, err
+		}
+		w = append(w, ws...)
+	}
+	return w, nil
+}
+
+// unindex returns the writes removing |k| from every index.
+func (x *Indexed) unindex(k key.Key) ([]dsWrite, error) {
+	var w []dsWrite
+	for _, name := range x.names() {
+		values, indexed, err := x.values(name, k)
+		if err != nil {
+			return nil, err
+		}
+		if !indexed {
+			continue
+		}
+		for _, v := range values {
+			w = append(w, dsWrite{k: x.valuesKey(name, v, k), isDel: true})
+		}
+		w = append(w, dsWrite{k: x.keysKey(name, k), isDel: true})
+	}
+	return w, nil
+}
+
+// commit applies |w|, in one batch if the datastore is a BatchingDatastore,
+// and in order otherwise.
+func (x *Indexed) commit(ctx context.Context, w []dsWrite) error {
+	x.swap.Lock()
+	defer x.swap.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if bd, ok := x.root.(BatchingDatastore); ok {
+		batch, err := bd.Batch()
+		if err != nil {
+			return err
+		}
+		for _, op := range w {
+			if op.isDel {
+				err = batch.Delete(op.k)
+			} else {
+				err = batch.Put(op.k, op.v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return batch.Commit()
+	}
+	for _, op := range w {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if op.isDel {
+			if err := x.root.Delete(op.k); err != nil && !errors.Is(err, ds.ErrNotFound) {
+				return err
+			}
+		} else if err := x.root.Put(op.k, op.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyBatch is blockstore ApplyBatch, indexing the blocks put and removing
+// the entries of those deleted in the same batch.
+func (x *Indexed) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	if err := checkPuts(puts); err != nil {
+		return err
+	}
+	ps, dels := dedupeBatch(puts, deletes)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	// without a batch, entries are written before the blocks they index,
+	// and removed after, so that an interruption never leaves a stored
+	// block unindexed.
+	var w []dsWrite
+	now := time.Now()
+	for _, b := range ps {
+		ws, err := x.index(b, now)
+		if err != nil {
+			return err
+		}
+		w = append(w, ws...)
+		w = append(w, dsWrite{k: x.prefix.blocks.Child(b.Key().DsKey()), v: b.Data})
+	}
+	for _, k := range dels {
+		ws, err := x.unindex(k)
+		if err != nil {
+			return err
+		}
+		w = append(w, dsWrite{k: x.prefix.blocks.Child(k.DsKey()), isDel: true})
+		w = append(w, ws...)
+	}
+	return x.commit(ctx, w)
+}
+
+func (x *Indexed) Put(b *blocks.Block) error {
+	return x.ApplyBatch(context.Background(), []*blocks.Block{b}, nil)
+}
+
+func (x *Indexed) PutMany(bs []*blocks.Block) error {
+	return x.ApplyBatch(context.Background(), bs, nil)
+}
+
+func (x *Indexed) DeleteBlock(k key.Key) error {
+	has, err := x.Has(k)
+	if err != nil {
+		return err
+	}
+	if !has {
+		// as the blockstore reports it.
+		return x.blockstore.DeleteBlock(k)
+	}
+	return x.ApplyBatch(context.Background(), nil, []key.Key{k})
+}
+
+// ReplaceAll is blockstore ReplaceAll, then Reindex: the blocks kept keep
+// their entries, tags included.
+func (x *Indexed) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := x.blockstore.ReplaceAll(ctx, in); err != nil {
+		return err
+	}
+	_, err := x.reindex(ctx)
+	return err
+}
+
+// Quarantine is blockstore Quarantine, removing the block's entries with
+// it, in the same batch if the datastore is a BatchingDatastore.
+func (x *Indexed) Quarantine(k key.Key) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	val, err := x.datastore.Get(k.DsKey())
+	if errors.Is(err, ds.ErrNotFound) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	unindex, err := x.unindex(k)
+	if err != nil {
+		return err
+	}
+	data, ok := val.([]byte)
+	if !ok {
+		// the blockstore's own Quarantine keeps such a value as it is.
+		if err := x.blockstore.Quarantine(k); err != nil {
+			return err
+		}
+		return x.commit(context.Background(), unindex)
+	}
+	w := []dsWrite{{k: x.prefix.quarantine.Child(quarantineKey(k, time.Now())), v: data}}
+	w = append(w, unindex...)
+	w = append(w, dsWrite{k: x.prefix.blocks.Child(k.DsKey()), isDel: true})
+	return x.commit(context.Background(), w)
+}
+
+// Tag adds |tags| to the TagsIndex values of the stored block |k|, or
+// returns ErrNotFound.
+func (x *Indexed) Tag(k key.Key, tags ...string) error {
+	return x.retag(k, func(old []string) []string { return append(old, tags...) })
+}
+
+// Untag removes |tags| from the TagsIndex values of the stored block |k|,
+// or returns ErrNotFound.
+func (x *Indexed) Untag(k key.Key, tags ...string) error {
+	return x.retag(k, func(old []string) []string {
+		drop := make(map[string]bool, len(tags))
+		for _, t := range tags {
+			drop[t] = true
+		}
+		var out []string
+		for _, v := range old {
+			if !drop[v] {
+				out = append(out, v)
+			}
+		}
+		return out
+	})
+}
+
+func (x *Indexed) retag(k key.Key, f func([]string) []string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	has, err := x.Has(k)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return ErrNotFound
+	}
+	old, _, err := x.values(TagsIndex, k)
+	if err != nil {
+		return err
+	}
+	// f may append to old, which setValues still reads.
+	w, err := x.setValues(TagsIndex, k, old, f(append([]string(nil), old...)))
+	if err != nil {
+		return err
+	}
+	return x.commit(context.Background(), w)
+}
+
+// ValuesOf returns the values |k| is indexed under in |index|, sorted, or
+// ErrNotFound if it is not indexed there.
+func (x *Indexed) ValuesOf(index string, k key.Key) ([]string, error) {
+	if !x.known(index) {
+		return nil, ErrUnknownIndex
+	}
+	values, indexed, err := x.values(index, k)
+	if err != nil {
+		return nil, err
+	}
+	if !indexed {
+		return nil, ErrNotFound
+	}
+	return values, nil
+}
+
+// Lookup streams the keys of the blocks indexed under |value| in |index|.
+// The channel is closed when they run out, or |ctx| is done.
+func (x *Indexed) Lookup(ctx context.Context, index, value string) (<-chan key.Key, error) {
+	if !x.known(index) {
+		return nil, ErrUnknownIndex
+	}
+	prefix := x.prefix.index.Child(ds.KeyWithNamespaces([]string{index, "values", hex.EncodeToString([]byte(value))}))
+	entries, err := x.entries(ctx, prefix, func(IndexEntry) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		for e := range entries {
+			select {
+			case out <- e.Key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Range streams, in no particular order, the entries of |index| with values
+// from |from| up to, and not including, |to|, or to the last if |to| is
+// empty. The channel is closed when they run out, or |ctx| is done.
+func (x *Indexed) Range(ctx context.Context, index, from, to string) (<-chan IndexEntry, error) {
+	if !x.known(index) {
+		return nil, ErrUnknownIndex
+	}
+	prefix := x.prefix.index.Child(ds.KeyWithNamespaces([]string{index, "values"}))
+	return x.entries(ctx, prefix, func(e IndexEntry) bool {
+		return e.Value >= from && (to == "" || e.Value < to)
+	})
+}
+
+// entries streams the entries below |prefix|, a values namespace, that
+// |match| accepts.
+func (x *Indexed) entries(ctx context.Context, prefix ds.Key, match func(IndexEntry) bool) (<-chan IndexEntry, error) {
+	res, err := x.root.Query(dsq.Query{Prefix: prefix.String() + "/", KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan IndexEntry)
+	go func() {
+		defer close(out)
+		defer res.Close()
+		for {
+			var r dsq.Result
+			var more bool
+			select {
+			case <-ctx.Done():
+				return
+			case r, more = <-res.Next():
+			}
+			if !more || r.Error != nil {
+				return
+			}
+			e, ok := parseValuesKey(ds.NewKey(r.Key))
+			if !ok || !match(e) {
+				continue
+			}
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// parseValuesKey returns the entry of a key made by valuesKey.
+func parseValuesKey(dsk ds.Key) (IndexEntry, bool) {
+	parts := dsk.Namespaces()
+	if len(parts) < 4 || parts[len(parts)-3] != "values" {
+		return IndexEntry{}, false
+	}
+	v, err := hex.DecodeString(parts[len(parts)-2])
+	k := key.B58KeyDecode(parts[len(parts)-1])
+	if err != nil || k == "" {
+		return IndexEntry{}, false
+	}
+	return IndexEntry{Value: string(v), Key: k}, true
+}
+
+// Reindex brings the indexes up to date with the blocks stored: it removes
+// the entries of blocks that aren't, and indexes the blocks that aren't
+// indexed yet, as first put now. It returns how many blocks it indexed.
+func (x *Indexed) Reindex(ctx context.Context) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.reindex(ctx)
+}
+
+func (x *Indexed) reindex(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the entries of blocks gone.
+	for _, name := range x.names() {
+		prefix := x.prefix.index.Child(ds.KeyWithNamespaces([]string{name, "keys"}))
+		dsks, err := namespaceKeys(x.root, prefix)
+		if err != nil {
+			return 0, err
+		}
+		for _, dsk := range dsks {
+			k := key.B58KeyDecode(dsk.BaseNamespace())
+			if k == "" {
+				continue
+			}
+			has, err := x.Has(k)
+			if err != nil {
+				return 0, err
+			}
+			if has {
+				continue
+			}
+			w, err := x.unindex(k)
+			if err != nil {
+				return 0, err
+			}
+			if err := x.commit(ctx, w); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// the blocks not indexed.
+	ks, err := x.AllKeysChan(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	now := time.Now()
+	for k := range ks {
+		b, err := x.Get(k)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		w, err := x.index(b, now)
+		if err != nil {
+			return n, err
+		}
+		if len(w) == 0 {
+			continue
+		}
+		if err := x.commit(ctx, w); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, ctx.Err()
+}
@@ -0,0 +1,247 @@
+package blockstore
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func newIndexed(t *testing.T, d ds.ThreadSafeDatastore, indexes ...Index) *Indexed {
+	x, err := NewIndexed(NewBlockstore(d), indexes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+func lookup(t *testing.T, x *Indexed, index, value string) []key.Key {
+	ch, err := x.Lookup(context.Background(), index, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := collect(ch)
+	sort.Slice(ks, func(i, j int) bool { return ks[i] < ks[j] })
+	return ks
+}
+
+func TestIndexedPutDelete(t *testing.T) {
+	d := &batchingDS{ThreadSafeDatastore: ds_sync.MutexWrap(ds.NewMapDatastore())}
+	x := newIndexed(t, d, SizeIndex, CreatedIndex)
+	small := blocks.NewBlock([]byte("abc"))
+	large := blocks.NewBlock(make([]byte, 1000))
+
+	before := CreatedValue(time.Now())
+	if err := x.PutMany([]*blocks.Block{small, large}); err != nil {
+		t.Fatal(err)
+	}
+	if d.commits != 1 {
+		t.Fatalf("expected the blocks and entries in one batch, got %d commits", d.commits)
+	}
+	if got := lookup(t, x, "size", SizeBucket(3)); len(got) != 1 || got[0] != small.Key() {
+		t.Fatalf("expected the small block in its bucket, got %v", got)
+	}
+	if got := lookup(t, x, "size", SizeBucket(1000)); len(got) != 1 || got[0] != large.Key() {
+		t.Fatalf("expected the large block in its bucket, got %v", got)
+	}
+	created, err := x.ValuesOf("created", small.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0] < before {
+		t.Fatalf("expected the time of the put, got %v", created)
+	}
+
+	// putting it again keeps the time it was first put.
+	if err := x.Put(small); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := x.ValuesOf("created", small.Key()); again[0] != created[0] {
+		t.Fatalf("expected %s kept, got %s", created[0], again[0])
+	}
+
+	if err := x.DeleteBlock(small.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookup(t, x, "size", SizeBucket(3)); len(got) != 0 {
+		t.Fatalf("expected the deleted block's entries removed, got %v", got)
+	}
+	if _, err := x.ValuesOf("created", small.Key()); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := x.DeleteBlock(small.Key()); err != ds.ErrNotFound {
+		t.Fatalf("expected the blockstore's error deleting a missing block, got %v", err)
+	}
+	if _, err := x.Lookup(context.Background(), "nope", ""); err != ErrUnknownIndex {
+		t.Fatalf("expected ErrUnknownIndex, got %v", err)
+	}
+
+	// a failed batch leaves neither block nor entries.
+	d.failNext = true
+	doomed := blocks.NewBlock([]byte("doomed"))
+	if err := x.Put(doomed); err == nil {
+		t.Fatal("expected the commit error")
+	}
+	if got := lookup(t, x, "size", SizeBucket(len(doomed.Data))); len(got) != 0 {
+		t.Fatalf("expected no entries of a failed put, got %v", got)
+	}
+}
+
+func TestIndexedTagsAndRange(t *testing.T) {
+	x := newIndexed(t, ds_sync.MutexWrap(ds.NewMapDatastore()), SizeIndex)
+	var bs []*blocks.Block
+	for _, n := range []int{1, 10, 100, 1000} {
+		b := blocks.NewBlock(make([]byte, n))
+		if err := x.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		bs = append(bs, b)
+	}
+
+	if err := x.Tag(bs[0].Key(), "keep", "photos"); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Tag(bs[1].Key(), "photos"); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookup(t, x, TagsIndex, "photos"); len(got) != 2 {
+		t.Fatalf("expected two tagged blocks, got %v", got)
+	}
+	if err := x.Untag(bs[0].Key(), "photos"); err != nil {
+		t.Fatal(err)
+	}
+	if tags, _ := x.ValuesOf(TagsIndex, bs[0].Key()); len(tags) != 1 || tags[0] != "keep" {
+		t.Fatalf("expected only the tag left, got %v", tags)
+	}
+	if err := x.Tag(blocks.NewBlock([]byte("missing")).Key(), "x"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound tagging a missing block, got %v", err)
+	}
+
+	// blocks of 10 bytes up to, and not including, 1000.
+	ch, err := x.Range(context.Background(), "size", SizeBucket(10), SizeBucket(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[key.Key]string)
+	for e := range ch {
+		got[e.Key] = e.Value
+	}
+	if len(got) != 2 || got[bs[1].Key()] != SizeBucket(10) || got[bs[2].Key()] != SizeBucket(100) {
+		t.Fatalf("expected the middle two blocks, got %v", got)
+	}
+}
+
+func TestIndexedReindex(t *testing.T) {
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	bs := NewBlockstore(d)
+	old := blocks.NewBlock([]byte("stored before the index"))
+	if err := bs.Put(old); err != nil {
+		t.Fatal(err)
+	}
+
+	x := newIndexed(t, d, SizeIndex)
+	if got := lookup(t, x, "size", SizeBucket(len(old.Data))); len(got) != 0 {
+		t.Fatalf("expected the old block not indexed yet, got %v", got)
+	}
+	n, err := x.Reindex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected one block indexed, got %d", n)
+	}
+	if got := lookup(t, x, "size", SizeBucket(len(old.Data))); len(got) != 1 {
+		t.Fatalf("expected the old block indexed, got %v", got)
+	}
+
+	// a block deleted behind the index's back loses its entries.
+	if err := x.Tag(old.Key(), "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteBlock(old.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x.Reindex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookup(t, x, TagsIndex, "t"); len(got) != 0 {
+		t.Fatalf("expected the entries of the missing block removed, got %v", got)
+	}
+
+	// ReplaceAll keeps the entries of the blocks kept.
+	kept := blocks.NewBlock([]byte("kept"))
+	if err := x.Put(kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Tag(kept.Key(), "t"); err != nil {
+		t.Fatal(err)
+	}
+	incoming := blocks.NewBlock([]byte("incoming"))
+	in := make(chan *blocks.Block, 2)
+	in <- kept
+	in <- incoming
+	close(in)
+	if err := x.ReplaceAll(context.Background(), in); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookup(t, x, TagsIndex, "t"); len(got) != 1 || got[0] != kept.Key() {
+		t.Fatalf("expected the kept block's tag, got %v", got)
+	}
+	if got := lookup(t, x, "size", SizeBucket(len(incoming.Data))); len(got) != 1 {
+		t.Fatalf("expected the incoming block indexed, got %v", got)
+	}
+}
+
+func TestNewIndexedErrors(t *testing.T) {
+	bs := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	if _, err := NewIndexed(ReadOnly(bs)); err != ErrNoIndex {
+		t.Fatalf("expected ErrNoIndex, got %v", err)
+	}
+	noop := func(*blocks.Block, time.Time) []string { return nil }
+	for _, name := range []string{"", TagsIndex, "a/b"} {
+		if _, err := NewIndexed(bs, IndexFunc(name, noop)); err == nil {
+			t.Fatalf("expected index name %q refused", name)
+		}
+	}
+	if _, err := NewIndexed(bs, SizeIndex, SizeIndex); err == nil {
+		t.Fatal("expected a duplicate index refused")
+	}
+}
+
+func TestIndexedQuarantine(t *testing.T) {
+	d := &batchingDS{ThreadSafeDatastore: ds_sync.MutexWrap(ds.NewMapDatastore())}
+	x := newIndexed(t, d, SizeIndex)
+	b := blocks.NewBlock([]byte("suspect"))
+	if err := x.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	commits := d.commits
+	if err := x.Quarantine(b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if d.commits != commits+1 {
+		t.Fatalf("expected the block and its entries moved in one batch, got %d commits", d.commits-commits)
+	}
+	if got := lookup(t, x, "size", SizeBucket(len(b.Data))); len(got) != 0 {
+		t.Fatalf("expected the quarantined block's entries removed, got %v", got)
+	}
+	if has, _ := x.Has(b.Key()); has {
+		t.Fatal("expected the block out of the live set")
+	}
+	if qs, err := x.ListQuarantined(); err != nil || len(qs) != 1 || qs[0].Key != b.Key() || string(qs[0].Data) != "suspect" {
+		t.Fatalf("expected the block quarantined, got %v, %v", qs, err)
+	}
+	if err := x.Quarantine(b.Key()); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestIndexedRefusesLazyBlocks(t *testing.T) {
+	expectLazyRefused(t, newIndexed(t, ds_sync.MutexWrap(ds.NewMapDatastore()), SizeIndex))
+}
@@ -0,0 +1,211 @@
+package blockstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsns "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/namespace"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrNoJournal is returned by NewJournaled for a blockstore it can't
+// journal, one not made by NewBlockstore or NamespacedBlockstore.
+var ErrNoJournal = errors.New("blockstore: journaling needs a blockstore made by NewBlockstore")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Journaled is a blockstore recording each write in a write-ahead journal,
+// below JournalPrefix, before making it, and removing the record once it is
+// made. A record lists the keys put, with a checksum of their data, and the
+// keys deleted. A write a crash interrupted leaves its record behind, and
+// NewJournaled replays it: the blocks put whose data is stored whole are
+// kept, those whose stored value does not match its checksum are removed,
+// and the deletes are made again. So a crash part way through a PutMany or
+// an ApplyBatch leaves no block that Has reports but Get fails to read.
+//
+// Each write costs two more datastore writes, to add and remove its record.
+type Journaled struct {
+	*blockstore
+	journal ds.Datastore
+	seq     uint64
+
+	// recovered are the keys replay removed.
+	recovered []key.Key
+}
+
+// NewJournaled returns |bs|, which must have been made by NewBlockstore or
+// NamespacedBlockstore, journaling its writes, after replaying the records
+// left in its journal. Wrap the Journaled blockstore, not |bs|, with the
+// likes of CachedBlockstore, so that every write goes through it.
+func NewJournaled(bs Blockstore) (*Journaled, error) {
+	b, ok := bs.(*blockstore)
+	if !ok {
+		return nil, ErrNoJournal
+	}
+	j := &Journaled{blockstore: b, journal: dsns.Wrap(b.root, b.prefix.journal)}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Recovered returns the keys of the blocks NewJournaled removed, as the
+// writes that were putting them did not finish.
+func (j *Journaled) Recovered() []key.Key {
+	return j.recovered
+}
+
+// journalRecord is a write in progress, as kept in the journal.
+type journalRecord struct {
+	Puts    []journalPut `json:"puts,omitempty"`
+	Deletes []key.Key    `json:"deletes,omitempty"`
+}
+
+type journalPut struct {
+	Key key.Key `json:"key"`
+	Sum uint32  `json:"sum"`
+}
+
+// encodeRecord returns |r| as kept in the journal: the checksum of its JSON
+// form, then that form, so that a record the crash tore is told apart.
+func encodeRecord(r journalRecord) ([]byte, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(buf, crc32.Checksum(body, castagnoli))
+	return append(buf, body...), nil
+}
+
+// decodeRecord returns the record |v| holds, or false if it was torn.
+func decodeRecord(v interface{}) (journalRecord, bool) {
+	var r journalRecord
+	buf, ok := v.([]byte)
+	if !ok || len(buf) < 4 {
+		return r, false
+	}
+	body := buf[4:]
+	if binary.BigEndian.Uint32(buf) != crc32.Checksum(body, castagnoli) {
+		return r, false
+	}
+	return r, json.Unmarshal(body, &r) == nil
+}
+
+// write records |puts| and |deletes| in the journal, calls |apply|, and
+// removes the record. If |apply| fails, the record is replayed at once, so
+// that the blocks it tore are removed, and its error returned.
+func (j *Journaled) write(puts []*blocks.Block, deletes []key.Key, apply func() error) error {
+	var r journalRecord
+	for _, b := range puts {
+		r.Puts = append(r.Puts, journalPut{Key: b.Key(), Sum: crc32.Checksum(b.Data, castagnoli)})
+	}
+	r.Deletes = deletes
+	v, err := encodeRecord(r)
+	if err != nil {
+		return err
+	}
+	rk := ds.NewKey(fmt.Sprintf("%020d", atomic.AddUint64(&j.seq, 1)))
+	if err := j.journal.Put(rk, v); err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		if _, rerr := j.recover(r); rerr == nil {
+			j.journal.Delete(rk)
+		}
+		return err
+	}
+	return j.journal.Delete(rk)
+}
+
+// recover undoes what a write of |r| left half done, returning the keys it
+// removed.
+func (j *Journaled) recover(r journalRecord) ([]key.Key, error) {
+	var removed []key.Key
+	for _, p := range r.Puts {
+		v, err := j.datastore.Get(p.Key.DsKey())
+		if errors.Is(err, ds.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		if data, ok := v.([]byte); ok && crc32.Checksum(data, castagnoli) == p.Sum {
+			continue
+		}
+		if err := j.datastore.Delete(p.Key.DsKey()); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return removed, err
+		}
+		removed = append(removed, p.Key)
+	}
+	for _, k := range r.Deletes {
+		if err := j.datastore.Delete(k.DsKey()); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// replay recovers the writes of the records left in the journal, oldest
+// first, and removes them.
+func (j *Journaled) replay() error {
+	// datastore/namespace does *NOT* fix up Query.Prefix
+	res, err := j.journal.Query(dsq.Query{Prefix: j.prefix.journal.String()})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Key < entries[b].Key })
+	for _, e := range entries {
+		rk := ds.NewKey(e.Key)
+		// a record torn by the crash was written before its write began.
+		if r, ok := decodeRecord(e.Value); ok {
+			removed, err := j.recover(r)
+			if err != nil {
+				return err
+			}
+			j.recovered = append(j.recovered, removed...)
+		}
+		if err := j.journal.Delete(rk); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put is blockstore Put, journaled.
+func (j *Journaled) Put(b *blocks.Block) error {
+	if has, err := j.blockstore.Has(b.Key()); err == nil && has {
+		return nil // already stored.
+	}
+	return j.write([]*blocks.Block{b}, nil, func() error { return j.blockstore.Put(b) })
+}
+
+// PutMany is blockstore PutMany, journaled as one write.
+func (j *Journaled) PutMany(bs []*blocks.Block) error {
+	return j.write(bs, nil, func() error { return j.blockstore.PutMany(bs) })
+}
+
+// DeleteBlock is blockstore DeleteBlock, journaled.
+func (j *Journaled) DeleteBlock(k key.Key) error {
+	return j.write(nil, []key.Key{k}, func() error { return j.blockstore.DeleteBlock(k) })
+}
+
+// ApplyBatch is blockstore ApplyBatch, journaled as one write.
+func (j *Journaled) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	ps, dels := dedupeBatch(puts, deletes)
+	return j.write(ps, dels, func() error { return j.blockstore.ApplyBatch(ctx, ps, dels) })
+}
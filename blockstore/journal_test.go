@@ -0,0 +1,118 @@
+package blockstore
+
+import (
+	"hash/crc32"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsns "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/namespace"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func newJournaled(t *testing.T, d ds.ThreadSafeDatastore) *Journaled {
+	j, err := NewJournaled(NewBlockstore(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func journalLen(t *testing.T, d ds.Datastore) int {
+	res, err := d.Query(dsq.Query{Prefix: JournalPrefix.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(es)
+}
+
+func TestJournaledWrites(t *testing.T) {
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	j := newJournaled(t, d)
+	a, b := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("b"))
+	if err := j.Put(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.ApplyBatch(context.Background(), []*blocks.Block{b}, []key.Key{a.Key()}); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := j.Has(a.Key()); has {
+		t.Fatal("expected the deleted block gone")
+	}
+	if got, err := j.Get(b.Key()); err != nil || string(got.Data) != "b" {
+		t.Fatalf("expected the put block, got %v, %v", got, err)
+	}
+	if n := journalLen(t, d); n != 0 {
+		t.Fatalf("expected the journal emptied once the writes were made, got %d records", n)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	bs := NewBlockstore(d).(*blockstore)
+	whole := blocks.NewBlock([]byte("written whole"))
+	torn := blocks.NewBlock([]byte("written in part"))
+	gone := blocks.NewBlock([]byte("deleted"))
+	for _, b := range []*blocks.Block{gone, blocks.NewBlock([]byte("untouched"))} {
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a crash part way through an ApplyBatch: its record was written, one
+	// block stored, the next in part, and the delete never made.
+	rec, err := encodeRecord(journalRecord{
+		Puts: []journalPut{
+			{Key: whole.Key(), Sum: crc32.Checksum(whole.Data, castagnoli)},
+			{Key: torn.Key(), Sum: crc32.Checksum(torn.Data, castagnoli)},
+		},
+		Deletes: []key.Key{gone.Key()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := dsns.Wrap(d, JournalPrefix)
+	if err := journal.Put(ds.NewKey("00000000000000000001"), rec); err != nil {
+		t.Fatal(err)
+	}
+	// and one torn itself, before its write began.
+	if err := journal.Put(ds.NewKey("00000000000000000002"), rec[:len(rec)/2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.datastore.Put(whole.Key().DsKey(), whole.Data); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.datastore.Put(torn.Key().DsKey(), torn.Data[:4]); err != nil {
+		t.Fatal(err)
+	}
+
+	j := newJournaled(t, d)
+	if r := j.Recovered(); len(r) != 1 || r[0] != torn.Key() {
+		t.Fatalf("expected the torn block removed, got %v", r)
+	}
+	for b, want := range map[*blocks.Block]bool{whole: true, torn: false, gone: false} {
+		if has, _ := j.Has(b.Key()); has != want {
+			t.Errorf("%q: expected stored %v", b.Data, want)
+		}
+	}
+	if _, err := j.Get(whole.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if n := journalLen(t, d); n != 0 {
+		t.Fatalf("expected the journal emptied by replay, got %d records", n)
+	}
+}
+
+func TestJournalNeedsBlockstore(t *testing.T) {
+	if _, err := NewJournaled(ReadOnly(NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())))); err != ErrNoJournal {
+		t.Fatalf("expected ErrNoJournal, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package blockstore
+
+import (
+	"sync"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+type listErrorKey struct{}
+
+// listError holds the first error that cut short the listings made under a
+// context ListKeys returned.
+type listError struct {
+	mu  sync.Mutex
+	err error
+}
+
+// ListKeys is |bs|.AllKeys, but tells a complete listing from one cut short:
+// once the channel is closed, the function returned gives the error of the
+// query that ended it early, or ctx.Err() if |ctx| did, and nil otherwise.
+// AllKeys closes its channel the same way in all three cases.
+//
+// Blockstores made by NewBlockstore report their query errors to it, and so
+// do those wrapping them that list keys with the context they are given.
+func ListKeys(ctx context.Context, bs Blockstore, q dsq.Query) (<-chan key.Key, func() error, error) {
+	return listChecked(ctx, func(lctx context.Context) (<-chan key.Key, error) {
+		return bs.AllKeys(lctx, q)
+	})
+}
+
+// ListOrphanedMetadata is |bs|.FindOrphanedMetadata, telling a complete scan
+// from one cut short as ListKeys does.
+func ListOrphanedMetadata(ctx context.Context, bs Blockstore) (<-chan key.Key, func() error, error) {
+	return listChecked(ctx, bs.FindOrphanedMetadata)
+}
+
+// listChecked runs |list| under a context its errors are reported to, and
+// returns its channel with the function giving them.
+func listChecked(ctx context.Context, list func(context.Context) (<-chan key.Key, error)) (<-chan key.Key, func() error, error) {
+	le := &listError{}
+	lctx := context.WithValue(ctx, listErrorKey{}, le)
+	ks, err := list(lctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ks, func() error {
+		le.mu.Lock()
+		defer le.mu.Unlock()
+		if le.err != nil {
+			return le.err
+		}
+		return ctx.Err()
+	}, nil
+}
+
+// reportListError records that |err| cut short a listing made under |ctx|,
+// for ListKeys.
+func reportListError(ctx context.Context, err error) {
+	le, ok := ctx.Value(listErrorKey{}).(*listError)
+	if !ok {
+		return
+	}
+	le.mu.Lock()
+	if le.err == nil {
+		le.err = err
+	}
+	le.mu.Unlock()
+}
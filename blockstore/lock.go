@@ -0,0 +1,81 @@
+package blockstore
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrLocked is returned by Locker.TryLock, and Locked, for a lock held by
+// someone else.
+var ErrLocked = errors.New("blockstore: locked by another process")
+
+// defaultLockPoll is how often Locked retries a held lock by default.
+const defaultLockPoll = 100 * time.Millisecond
+
+// Locker is an exclusive lock on the storage of a blockstore, shared by
+// every process that opens it, such as the one flatfs.Lock makes.
+type Locker interface {
+	// TryLock takes the lock, returning ErrLocked without waiting if it is
+	// held, including by this Locker.
+	TryLock() error
+	Unlock() error
+}
+
+// LockOptions configures Locked.
+type LockOptions struct {
+	// Wait makes Locked wait for a held lock, trying it every PollInterval,
+	// 100ms by default, until its context is done.
+	Wait         bool
+	PollInterval time.Duration
+	// ReadOnlyFallback makes Locked return |bs| ReadOnly, rather than
+	// ErrLocked, if the lock is held (after waiting, with Wait), for
+	// processes that can do with reading while another writes.
+	ReadOnlyFallback bool
+}
+
+// Locked takes |l| for |bs|, so that two processes never write to the same
+// storage at once, and returns |bs| and the io.Closer that releases the
+// lock. The lock is advisory: it only keeps out processes that take it too.
+// If the lock is held, Locked fails with ErrLocked, or waits or falls back
+// to reading as |opts| says; read-only, the io.Closer does nothing.
+func Locked(ctx context.Context, bs Blockstore, l Locker, opts LockOptions) (Blockstore, io.Closer, error) {
+	poll := opts.PollInterval
+	if poll <= 0 {
+		poll = defaultLockPoll
+	}
+	err := l.TryLock()
+	for errors.Is(err, ErrLocked) && opts.Wait {
+		select {
+		case <-time.After(poll):
+		case <-ctx.Done():
+			if !opts.ReadOnlyFallback {
+				return nil, nil, ctx.Err()
+			}
+			return ReadOnly(bs), unlocker{}, nil
+		}
+		err = l.TryLock()
+	}
+	switch {
+	case err == nil:
+		return bs, unlocker{l}, nil
+	case errors.Is(err, ErrLocked) && opts.ReadOnlyFallback:
+		return ReadOnly(bs), unlocker{}, nil
+	default:
+		return nil, nil, err
+	}
+}
+
+// unlocker is the io.Closer of Locked; without a Locker it does nothing.
+type unlocker struct {
+	l Locker
+}
+
+func (u unlocker) Close() error {
+	if u.l == nil {
+		return nil
+	}
+	return u.l.Unlock()
+}
@@ -0,0 +1,232 @@
+package blockstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrBadManifest is returned when reading a key manifest that is not one, or
+// is not in order.
+var ErrBadManifest = errors.New("blockstore: malformed key manifest")
+
+// keyManifestMagic starts every key manifest.
+const keyManifestMagic = "bskm\x01"
+
+// KeyManifestEntry is a block listed in a key manifest.
+type KeyManifestEntry struct {
+	Key  key.Key
+	Size uint64
+}
+
+// ExportKeyManifest writes a key manifest of |bs| to |w|: the key and size
+// of every block, sorted by key, each as varint lengths and the key's
+// binary form, so that it takes little more than the keys do. It returns
+// how many blocks it listed. Blockstores made by NewBlockstore are listed
+// from their datastore without reading the blocks; the others are read
+// block by block.
+//
+// Two manifests, such as those of a node and its backup, are compared with
+// DiffKeyManifests.
+func ExportKeyManifest(ctx context.Context, bs Blockstore, w io.Writer) (int, error) {
+	var entries []KeyManifestEntry
+	add := func(e KeyManifestEntry) { entries = append(entries, e) }
+	var err error
+	if l, ok := bs.(interface {
+		listSizes(context.Context, func(KeyManifestEntry)) error
+	}); ok {
+		err = l.listSizes(ctx, add)
+	} else {
+		err = listSizes(ctx, bs, add)
+	}
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(keyManifestMagic); err != nil {
+		return 0, err
+	}
+	var buf [binary.MaxVarintLen64]byte
+	for _, e := range entries {
+		bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(e.Key)))])
+		bw.WriteString(string(e.Key))
+		if _, err := bw.Write(buf[:binary.PutUvarint(buf[:], e.Size)]); err != nil {
+			return 0, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// listSizes calls |f| with every block of |bs|, read to size it.
+func listSizes(ctx context.Context, bs Blockstore, f func(KeyManifestEntry)) error {
+	ks, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+	for k := range ks {
+		b, err := bs.Get(k)
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted since it was listed.
+		}
+		if err != nil {
+			return err
+		}
+		f(KeyManifestEntry{Key: k, Size: uint64(len(b.Data))})
+	}
+	return ctx.Err()
+}
+
+// listSizes sizes the stored values, as Stat does.
+func (bs *blockstore) listSizes(ctx context.Context, f func(KeyManifestEntry)) error {
+	// datastore/namespace does *NOT* fix up Query.Prefix
+	res, err := bs.datastore.Query(dsq.Query{Prefix: bs.prefix.blocks.String()})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, more := <-res.Next():
+			if !more {
+				return nil
+			}
+			if e.Error != nil {
+				return e.Error
+			}
+			k := key.KeyFromDsKey(ds.NewKey(e.Key))
+			if _, err := k.Cid(); err != nil {
+				continue
+			}
+			data, ok := e.Value.([]byte)
+			if !ok {
+				return ValueTypeMismatch
+			}
+			f(KeyManifestEntry{Key: k, Size: uint64(len(data))})
+		}
+	}
+}
+
+// KeyManifestReader reads the entries of a key manifest in order.
+type KeyManifestReader struct {
+	r    *bufio.Reader
+	last key.Key
+	n    int
+}
+
+// NewKeyManifestReader returns a reader of the key manifest |r| holds, as
+// ExportKeyManifest writes it, or ErrBadManifest if it is not one.
+func NewKeyManifestReader(r io.Reader) (*KeyManifestReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(keyManifestMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != keyManifestMagic {
+		return nil, ErrBadManifest
+	}
+	return &KeyManifestReader{r: br}, nil
+}
+
+// Next returns the next entry, io.EOF after the last, or ErrBadManifest for
+// one that is cut short, or out of order.
+func (mr *KeyManifestReader) Next() (KeyManifestEntry, error) {
+	n, err := binary.ReadUvarint(mr.r)
+	if err == io.EOF {
+		return KeyManifestEntry{}, io.EOF
+	}
+	if err != nil || n == 0 || n > key.MaxKeySize {
+		return KeyManifestEntry{}, ErrBadManifest
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(mr.r, buf); err != nil {
+		return KeyManifestEntry{}, ErrBadManifest
+	}
+	size, err := binary.ReadUvarint(mr.r)
+	if err != nil {
+		return KeyManifestEntry{}, ErrBadManifest
+	}
+	k := key.Key(buf)
+	if mr.n > 0 && k <= mr.last {
+		return KeyManifestEntry{}, ErrBadManifest
+	}
+	mr.last = k
+	mr.n++
+	return KeyManifestEntry{Key: k, Size: size}, nil
+}
+
+// KeyManifestDiff is what DiffKeyManifests finds between two manifests.
+type KeyManifestDiff struct {
+	// Missing are the blocks of the first manifest not in the second, and
+	// Extra those of the second not in the first.
+	Missing []KeyManifestEntry
+	Extra   []KeyManifestEntry
+	// Mismatched are the blocks of the first manifest that the second
+	// lists with another size, which one of the copies being corrupt
+	// would explain.
+	Mismatched []KeyManifestEntry
+}
+
+// MissingBytes is the total size of the Missing blocks.
+func (d KeyManifestDiff) MissingBytes() uint64 {
+	var n uint64
+	for _, e := range d.Missing {
+		n += e.Size
+	}
+	return n
+}
+
+// DiffKeyManifests compares the key manifests |a| and |b|, such as those of
+// a node and of its backup, walking both once, in order: the Missing blocks
+// are those a replication or CAR export would have to send.
+func DiffKeyManifests(a, b io.Reader) (KeyManifestDiff, error) {
+	var d KeyManifestDiff
+	ra, err := NewKeyManifestReader(a)
+	if err != nil {
+		return d, err
+	}
+	rb, err := NewKeyManifestReader(b)
+	if err != nil {
+		return d, err
+	}
+	ea, erra := ra.Next()
+	eb, errb := rb.Next()
+	for erra == nil || errb == nil {
+		switch {
+		case erra != nil && erra != io.EOF:
+			return d, erra
+		case errb != nil && errb != io.EOF:
+			return d, errb
+		case errb == io.EOF || erra == nil && ea.Key < eb.Key:
+			d.Missing = append(d.Missing, ea)
+			ea, erra = ra.Next()
+		case erra == io.EOF || eb.Key < ea.Key:
+			d.Extra = append(d.Extra, eb)
+			eb, errb = rb.Next()
+		default:
+			if ea.Size != eb.Size {
+				d.Mismatched = append(d.Mismatched, ea)
+			}
+			ea, erra = ra.Next()
+			eb, errb = rb.Next()
+		}
+	}
+	if erra != io.EOF {
+		return d, erra
+	}
+	if errb != io.EOF {
+		return d, errb
+	}
+	return d, nil
+}
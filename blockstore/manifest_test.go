@@ -0,0 +1,66 @@
+package blockstore
+
+import (
+	"bytes"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	syncds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestDiffKeyManifests(t *testing.T) {
+	a := blocks.NewBlock([]byte("only on the node"))
+	shared := blocks.NewBlock([]byte("on both"))
+	b := blocks.NewBlock([]byte("only on the backup"))
+
+	node := NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore()))
+	backup := NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore()))
+	for _, blk := range []*blocks.Block{a, shared} {
+		if err := node.Put(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, blk := range []*blocks.Block{shared, b} {
+		if err := backup.Put(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var nm, bm bytes.Buffer
+	if n, err := ExportKeyManifest(context.Background(), node, &nm); err != nil || n != 2 {
+		t.Fatalf("expected two blocks listed, got %d, %v", n, err)
+	}
+	// the backup is listed block by block.
+	cbs, err := CachedBlockstore(backup, DefaultCacheOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ExportKeyManifest(context.Background(), cbs, &bm); err != nil || n != 2 {
+		t.Fatalf("expected two blocks listed, got %d, %v", n, err)
+	}
+
+	d, err := DiffKeyManifests(bytes.NewReader(nm.Bytes()), bytes.NewReader(bm.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Missing) != 1 || d.Missing[0] != (KeyManifestEntry{Key: a.Key(), Size: uint64(len(a.Data))}) {
+		t.Fatalf("unexpected missing blocks %v", d.Missing)
+	}
+	if len(d.Extra) != 1 || d.Extra[0].Key != b.Key() || len(d.Mismatched) != 0 {
+		t.Fatalf("unexpected diff %+v", d)
+	}
+	if d.MissingBytes() != uint64(len(a.Data)) {
+		t.Fatalf("expected %d missing bytes, got %d", len(a.Data), d.MissingBytes())
+	}
+
+	if _, err := DiffKeyManifests(bytes.NewReader(nm.Bytes()), bytes.NewReader([]byte("not a manifest"))); err != ErrBadManifest {
+		t.Fatalf("expected ErrBadManifest, got %v", err)
+	}
+	cut := nm.Bytes()[:nm.Len()-3]
+	if _, err := DiffKeyManifests(bytes.NewReader(cut), bytes.NewReader(bm.Bytes())); err != ErrBadManifest {
+		t.Fatalf("expected ErrBadManifest for a cut manifest, got %v", err)
+	}
+}
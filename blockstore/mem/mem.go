@@ -0,0 +1,279 @@
+// package mem implements an in-memory blockstore for tests, which can be
+// made to fail, slow down, count its calls, and go back to an earlier state.
+package mem
+
+import (
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	bstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Op is a kind of blockstore operation hooks can be set for.
+type Op int
+
+const (
+	// OpGet is Get, and each key of GetChan.
+	OpGet Op = iota
+	// OpHas is Has.
+	OpHas
+	// OpPut is Put, and each block of PutMany and of ApplyBatch.
+	OpPut
+	// OpDelete is DeleteBlock, and each deleted key of ApplyBatch.
+	OpDelete
+
+	numOps
+)
+
+// Fault decides whether an operation on |k| fails, and with what error.
+type Fault func(k key.Key) error
+
+// Store is a blockstore keeping its blocks in memory, as NewBlockstore over
+// a map datastore would, whose Get, Has, Put and Delete operations can be
+// failed and delayed. AllKeys, ReplaceAll and the metadata methods are
+// never failed or delayed. It is safe for concurrent use.
+type Store struct {
+	bstore.Blockstore
+	d ds.Datastore
+
+	// state is held for reading by every operation, and for writing by
+	// Snapshot and Restore.
+	state sync.RWMutex
+
+	mu      sync.Mutex
+	faults  [numOps]Fault
+	latency [numOps]time.Duration
+	calls   [numOps]int
+}
+
+// New returns an empty Store, with no faults.
+func New() *Store {
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	return &Store{Blockstore: bstore.NewBlockstore(d), d: d}
+}
+
+// Inject makes |f| decide, before each |op| on a key, whether it fails,
+// replacing any Fault set for |op| before. A failing operation changes
+// nothing. A nil |f| removes the fault.
+func (s *Store) Inject(op Op, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[op] = f
+}
+
+// FailWith makes every |op| fail with |err|, or, if |err| is nil, succeed
+// again.
+func (s *Store) FailWith(op Op, err error) {
+	if err == nil {
+		s.Inject(op, nil)
+		return
+	}
+	s.Inject(op, func(key.Key) error { return err })
+}
+
+// SetLatency delays every call doing |op| by |d|, once per call, however
+// many keys it has.
+func (s *Store) SetLatency(op Op, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency[op] = d
+}
+
+// Calls returns how many times |op| was done, counting each key of a call
+// on several, failed ones included.
+func (s *Store) Calls(op Op) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[op]
+}
+
+// ResetCalls sets every count Calls returns back to zero.
+func (s *Store) ResetCalls() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = [numOps]int{}
+}
+
+// begin counts |n| calls to |op|, waits for its latency, and returns its
+// fault, if any.
+func (s *Store) begin(op Op, n int) Fault {
+	s.mu.Lock()
+	s.calls[op] += n
+	d, f := s.latency[op], s.faults[op]
+	s.mu.Unlock()
+	if d > 0 && n > 0 {
+		time.Sleep(d)
+	}
+	return f
+}
+
+// check returns the first error |f| gives for |ks|.
+func check(f Fault, ks []key.Key) error {
+	if f == nil {
+		return nil
+	}
+	for _, k := range ks {
+		if err := f(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func blockKeys(bs []*blocks.Block) []key.Key {
+	ks := make([]key.Key, len(bs))
+	for i, b := range bs {
+		ks[i] = b.Key()
+	}
+	return ks
+}
+
+func (s *Store) Get(k key.Key) (*blocks.Block, error) {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	if err := check(s.begin(OpGet, 1), []key.Key{k}); err != nil {
+		return nil, err
+	}
+	return s.Blockstore.Get(k)
+}
+
+// GetChan leaves out the blocks whose Get fails. They are all read before
+// the first is sent, so that a caller that stops receiving does not hold up
+// Snapshot and Restore.
+func (s *Store) GetChan(ks []key.Key) <-chan *blocks.Block {
+	out := make(chan *blocks.Block)
+	go func() {
+		defer close(out)
+		for _, b := range s.getAll(ks) {
+			out <- b
+		}
+	}()
+	return out
+}
+
+func (s *Store) getAll(ks []key.Key) []*blocks.Block {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	f := s.begin(OpGet, len(ks))
+	var bs []*blocks.Block
+	for _, k := range ks {
+		if check(f, []key.Key{k}) != nil {
+			continue
+		}
+		if b, err := s.Blockstore.Get(k); err == nil {
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
+
+func (s *Store) Has(k key.Key) (bool, error) {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	if err := check(s.begin(OpHas, 1), []key.Key{k}); err != nil {
+		return false, err
+	}
+	return s.Blockstore.Has(k)
+}
+
+func (s *Store) Put(b *blocks.Block) error {
+	return s.PutMany([]*blocks.Block{b})
+}
+
+// PutMany stores none of |bs| if any of them fails.
+func (s *Store) PutMany(bs []*blocks.Block) error {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	if err := check(s.begin(OpPut, len(bs)), blockKeys(bs)); err != nil {
+		return err
+	}
+	return s.Blockstore.PutMany(bs)
+}
+
+func (s *Store) DeleteBlock(k key.Key) error {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	if err := check(s.begin(OpDelete, 1), []key.Key{k}); err != nil {
+		return err
+	}
+	return s.Blockstore.DeleteBlock(k)
+}
+
+// ApplyBatch applies none of the batch if any of its puts or deletes fails.
+func (s *Store) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	if err := check(s.begin(OpPut, len(puts)), blockKeys(puts)); err != nil {
+		return err
+	}
+	if err := check(s.begin(OpDelete, len(deletes)), deletes); err != nil {
+		return err
+	}
+	return s.Blockstore.ApplyBatch(ctx, puts, deletes)
+}
+
+func (s *Store) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	return s.Blockstore.ReplaceAll(ctx, in)
+}
+
+// Snapshot is the state of a Store at one point, for Restore.
+type Snapshot struct {
+	entries map[ds.Key][]byte
+}
+
+// Snapshot returns the contents of the store, blocks and metadata both. It
+// waits for the operations in progress, leaving the faults, latencies and
+// counts out.
+func (s *Store) Snapshot() (*Snapshot, error) {
+	s.state.Lock()
+	defer s.state.Unlock()
+	entries, err := s.entries()
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{entries: make(map[ds.Key][]byte, len(entries))}
+	for _, e := range entries {
+		data, _ := e.Value.([]byte)
+		snap.entries[ds.NewKey(e.Key)] = append([]byte(nil), data...)
+	}
+	return snap, nil
+}
+
+// Restore puts the store back to the contents of |snap|, which may be
+// restored any number of times.
+func (s *Store) Restore(snap *Snapshot) error {
+	s.state.Lock()
+	defer s.state.Unlock()
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := s.d.Delete(ds.NewKey(e.Key)); err != nil {
+			return err
+		}
+	}
+	for k, data := range snap.entries {
+		if err := s.d.Put(k, append([]byte(nil), data...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) entries() ([]dsq.Entry, error) {
+	res, err := s.d.Query(dsq.Query{})
+	if err != nil {
+		return nil, err
+	}
+	return res.Rest()
+}
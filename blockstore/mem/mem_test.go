@@ -0,0 +1,158 @@
+package mem
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	bstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var errDisk = errors.New("disk on fire")
+
+func expectHas(t *testing.T, s *Store, k key.Key, want bool) {
+	has, err := s.Has(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has != want {
+		t.Fatalf("%s: expected has %v, got %v", k, want, has)
+	}
+}
+
+func TestFailWith(t *testing.T) {
+	s := New()
+	a, b := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("b"))
+
+	s.FailWith(OpPut, errDisk)
+	if err := s.PutMany([]*blocks.Block{a, b}); err != errDisk {
+		t.Fatalf("expected errDisk, got %v", err)
+	}
+	expectHas(t, s, a.Key(), false)
+	s.FailWith(OpPut, nil)
+	if err := s.Put(a); err != nil {
+		t.Fatal(err)
+	}
+
+	s.FailWith(OpGet, errDisk)
+	if _, err := s.Get(a.Key()); err != errDisk {
+		t.Fatalf("expected errDisk, got %v", err)
+	}
+	for range s.GetChan([]key.Key{a.Key()}) {
+		t.Fatal("GetChan sent a block whose Get fails")
+	}
+	s.FailWith(OpGet, nil)
+
+	s.FailWith(OpDelete, errDisk)
+	if err := s.ApplyBatch(context.Background(), []*blocks.Block{b}, []key.Key{a.Key()}); err != errDisk {
+		t.Fatalf("expected errDisk, got %v", err)
+	}
+	expectHas(t, s, a.Key(), true)
+	expectHas(t, s, b.Key(), false)
+}
+
+func TestInjectByKey(t *testing.T) {
+	s := New()
+	bad, good := blocks.NewBlock([]byte("bad")), blocks.NewBlock([]byte("good"))
+	s.Inject(OpPut, func(k key.Key) error {
+		if k == bad.Key() {
+			return errDisk
+		}
+		return nil
+	})
+	if err := s.Put(good); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(bad); err != errDisk {
+		t.Fatalf("expected errDisk, got %v", err)
+	}
+	// a batch with the bad block stores nothing.
+	other := blocks.NewBlock([]byte("other"))
+	b := bstore.NewBatch(context.Background(), s)
+	b.Put(other)
+	b.Put(bad)
+	if err := b.Commit(); err != errDisk {
+		t.Fatalf("expected errDisk, got %v", err)
+	}
+	expectHas(t, s, other.Key(), false)
+}
+
+func TestCallsAndLatency(t *testing.T) {
+	s := New()
+	a, b := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("b"))
+	if err := s.PutMany([]*blocks.Block{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	s.Get(a.Key())
+	for range s.GetChan([]key.Key{a.Key(), b.Key()}) {
+	}
+	if n := s.Calls(OpPut); n != 2 {
+		t.Fatalf("expected 2 puts, got %d", n)
+	}
+	if n := s.Calls(OpGet); n != 3 {
+		t.Fatalf("expected 3 gets, got %d", n)
+	}
+	s.ResetCalls()
+	if n := s.Calls(OpGet); n != 0 {
+		t.Fatalf("expected no gets after ResetCalls, got %d", n)
+	}
+
+	s.SetLatency(OpHas, 20*time.Millisecond)
+	start := time.Now()
+	s.Has(a.Key())
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("expected Has to take 20ms, took %s", d)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	s := New()
+	a, b := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("b"))
+	if err := s.Put(a); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteBlock(a.Key()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Restore(snap); err != nil {
+			t.Fatal(err)
+		}
+		expectHas(t, s, a.Key(), true)
+		expectHas(t, s, b.Key(), false)
+		if err := s.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshotWhileGetChanUnread(t *testing.T) {
+	s := New()
+	a := blocks.NewBlock([]byte("a"))
+	if err := s.Put(a); err != nil {
+		t.Fatal(err)
+	}
+	unread := s.GetChan([]key.Key{a.Key()})
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-unread; b == nil || b.Key() != a.Key() {
+		t.Fatalf("expected %s, got %v", a.Key(), b)
+	}
+}
@@ -0,0 +1,196 @@
+package blockstore
+
+import (
+	"errors"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// MetadataStore is implemented by blockstores that can keep per-block
+// metadata alongside the blocks. Each |kind| of metadata is stored separately,
+// and values are opaque to the blockstore.
+type MetadataStore interface {
+	// GetMetadata returns the |kind| metadata of |k|, or ErrNotFound.
+	GetMetadata(kind string, k key.Key) ([]byte, error)
+	PutMetadata(kind string, k key.Key, value []byte) error
+	// DeleteMetadata removes the |kind| metadata of |k|, if any.
+	DeleteMetadata(kind string, k key.Key) error
+	// ForEachMetadata calls |f| with every |kind| entry until |f| returns
+	// false, the entries run out, or |ctx| is done.
+	ForEachMetadata(ctx context.Context, kind string, f func(k key.Key, value []byte) bool) error
+}
+
+// metadataKey returns the key, relative to MetadataPrefix, of the |kind|
+// metadata of |k|. Block keys are b58 encoded because raw multihashes may
+// contain path separators.
+func metadataKey(kind string, k key.Key) ds.Key {
+	return ds.KeyWithNamespaces([]string{kind, k.B58String()})
+}
+
+// parseMetadataKey is the inverse of metadataKey.
+func parseMetadataKey(dsk ds.Key) (kind string, k key.Key, ok bool) {
+	parts := dsk.Namespaces()
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	k = key.B58KeyDecode(parts[1])
+	if k == "" {
+		return "", "", false
+	}
+	return parts[0], k, true
+}
+
+func (bs *blockstore) GetMetadata(kind string, k key.Key) ([]byte, error) {
+	v, err := bs.metadata.Get(metadataKey(kind, k))
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, ValueTypeMismatch
+	}
+	return b, nil
+}
+
+func (bs *blockstore) PutMetadata(kind string, k key.Key, value []byte) error {
+	return bs.metadata.Put(metadataKey(kind, k), value)
+}
+
+func (bs *blockstore) DeleteMetadata(kind string, k key.Key) error {
+	err := bs.metadata.Delete(metadataKey(kind, k))
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (bs *blockstore) ForEachMetadata(ctx context.Context, kind string, f func(key.Key, []byte) bool) error {
+	// datastore/namespace does *NOT* fix up Query.Prefix
+	prefix := bs.prefix.metadata.Child(ds.NewKey(kind))
+	res, err := bs.metadata.Query(dsq.Query{Prefix: prefix.String()})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	for {
+		var e dsq.Result
+		var more bool
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, more = <-res.Next():
+		}
+		if !more {
+			return nil
+		}
+		if e.Error != nil {
+			return e.Error
+		}
+		ekind, k, ok := parseMetadataKey(ds.NewKey(e.Key))
+		if !ok || ekind != kind {
+			continue
+		}
+		v, ok := e.Value.([]byte)
+		if !ok {
+			return ValueTypeMismatch
+		}
+		if !f(k, v) {
+			return nil
+		}
+	}
+}
+
+// orphanedMetadata calls |f| with every metadata entry whose block is not
+// stored, stopping early if |f| returns false.
+func (bs *blockstore) orphanedMetadata(ctx context.Context, f func(ds.Key, key.Key) bool) error {
+	// datastore/namespace does *NOT* fix up Query.Prefix
+	res, err := bs.metadata.Query(dsq.Query{Prefix: bs.prefix.metadata.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	for {
+		var e dsq.Result
+		var more bool
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, more = <-res.Next():
+		}
+		if !more {
+			return nil
+		}
+		if e.Error != nil {
+			return e.Error
+		}
+		dsk := ds.NewKey(e.Key)
+		_, k, ok := parseMetadataKey(dsk)
+		if !ok {
+			continue
+		}
+		has, err := bs.Has(k)
+		if err != nil {
+			return err
+		}
+		if !has && !f(dsk, k) {
+			return nil
+		}
+	}
+}
+
+// FindOrphanedMetadata streams, once each, the keys that have metadata of any
+// kind but no stored block, as left behind by a crash between deleting a
+// block and its metadata. The channel is closed when the scan is done or
+// |ctx| is cancelled, or when it fails, with the error reported to
+// ListOrphanedMetadata.
+func (bs *blockstore) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		seen := make(map[key.Key]struct{})
+		err := bs.orphanedMetadata(ctx, func(_ ds.Key, k key.Key) bool {
+			if _, dup := seen[k]; dup {
+				return true
+			}
+			seen[k] = struct{}{}
+			select {
+			case out <- k:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			reportListError(ctx, err)
+		}
+	}()
+	return out, nil
+}
+
+// PurgeOrphanedMetadata deletes all metadata of keys with no stored block,
+// returning the number of entries removed.
+func (bs *blockstore) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	var orphans []ds.Key
+	err := bs.orphanedMetadata(ctx, func(dsk ds.Key, _ key.Key) bool {
+		orphans = append(orphans, dsk)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, dsk := range orphans {
+		if err := bs.metadata.Delete(dsk); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return i, err
+		}
+	}
+	return len(orphans), nil
+}
@@ -0,0 +1,117 @@
+package blockstore
+
+import (
+	"errors"
+	"testing"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestFindOrphanedMetadata(t *testing.T) {
+	d := ds.NewMapDatastore()
+	bs, keys := newBlockStoreWithKeys(t, d, 2)
+
+	// metadata for a stored block, and two kinds for one that was deleted.
+	orphan := keys[1]
+	for _, mk := range []ds.Key{
+		MetadataPrefix.Child(metadataKey("created", keys[0])),
+		MetadataPrefix.Child(metadataKey("created", orphan)),
+		MetadataPrefix.Child(metadataKey("tags", orphan)),
+	} {
+		if err := d.Put(mk, []byte("meta")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bs.DeleteBlock(orphan); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := bs.FindOrphanedMetadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := collect(ch)
+	if len(found) != 1 || found[0] != orphan {
+		t.Fatalf("expected exactly the orphaned key, got %v", found)
+	}
+
+	n, err := bs.PurgeOrphanedMetadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 orphaned entries purged, got %d", n)
+	}
+	if has, _ := d.Has(MetadataPrefix.Child(metadataKey("created", keys[0]))); !has {
+		t.Fatal("metadata of a stored block was purged")
+	}
+	ch, _ = bs.FindOrphanedMetadata(context.Background())
+	if left := collect(ch); len(left) != 0 {
+		t.Fatalf("orphans left after purge: %v", left)
+	}
+}
+
+func TestListOrphanedMetadataFailedScan(t *testing.T) {
+	d := &queryTestDS{ds: ds.NewMapDatastore()}
+	bs, _ := newBlockStoreWithKeys(t, d, 1)
+	errScan := errors.New("scan failed")
+	d.SetFunc(func(q dsq.Query) (dsq.Results, error) {
+		ch := make(chan dsq.Result, 1)
+		ch <- dsq.Result{Error: errScan}
+		close(ch)
+		return dsq.ResultsWithChan(q, ch), nil
+	})
+
+	ks, done, err := ListOrphanedMetadata(context.Background(), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(collect(ks)); n != 0 || done() != errScan {
+		t.Fatalf("expected no keys and the scan error, got %d and %v", n, done())
+	}
+}
+
+func TestMetadataStore(t *testing.T) {
+	bs, keys := newBlockStoreWithKeys(t, ds.NewMapDatastore(), 3)
+	ms := bs.(MetadataStore)
+
+	if _, err := ms.GetMetadata("reads", keys[0]); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	for i, k := range keys {
+		if err := ms.PutMetadata("reads", k, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a kind sharing a string prefix must not show up in "reads".
+	if err := ms.PutMetadata("readsx", keys[0], []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := ms.GetMetadata("reads", keys[2])
+	if err != nil || len(v) != 1 || v[0] != 2 {
+		t.Fatalf("unexpected value %v, %v", v, err)
+	}
+
+	if err := ms.DeleteMetadata("reads", keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.DeleteMetadata("reads", keys[1]); err != nil {
+		t.Fatalf("deleting missing metadata: %s", err)
+	}
+
+	seen := make(map[string]byte)
+	err = ms.ForEachMetadata(context.Background(), "reads", func(k key.Key, v []byte) bool {
+		seen[string(k)] = v[0]
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[string(keys[0])] != 0 || seen[string(keys[2])] != 2 {
+		t.Fatalf("unexpected entries %v", seen)
+	}
+}
@@ -0,0 +1,77 @@
+package blockstore
+
+import (
+	"errors"
+
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// ErrNoMigrator is returned by NewMigrator for a blockstore it can't
+// migrate, one not made by NewBlockstore or NamespacedBlockstore.
+var ErrNoMigrator = errors.New("blockstore: migrating needs a blockstore made by NewBlockstore")
+
+// DecodeFunc recovers block data from a value as it is stored in the
+// datastore.
+type DecodeFunc func(stored []byte) ([]byte, error)
+
+// Migrator gives storage format migrations direct access to the values a
+// blockstore keeps in its datastore, without going through Put (which would
+// re-derive the stored form from block data).
+type Migrator struct {
+	blockstore *blockstore
+	decode     DecodeFunc
+}
+
+// NewMigrator returns a Migrator over the blocks of |bs|, which must have
+// been made by NewBlockstore or NamespacedBlockstore. |decode| reads values
+// in the format being migrated to; nil means values are raw block data.
+func NewMigrator(bs Blockstore, decode DecodeFunc) (*Migrator, error) {
+	b, ok := bs.(*blockstore)
+	if !ok {
+		return nil, ErrNoMigrator
+	}
+	if decode == nil {
+		decode = func(stored []byte) ([]byte, error) { return stored, nil }
+	}
+	return &Migrator{blockstore: b, decode: decode}, nil
+}
+
+// RewriteValue replaces the value stored for |k| with |newStored|. It first
+// checks that |newStored| decodes to data that still hashes to |k|, returning
+// ErrHashMismatch otherwise, so a migration can never change what a key
+// addresses.
+func (m *Migrator) RewriteValue(k key.Key, newStored []byte) error {
+	if err := m.check(k, newStored); err != nil {
+		return err
+	}
+	m.blockstore.swap.RLock()
+	defer m.blockstore.swap.RUnlock()
+	return m.blockstore.datastore.Put(k.DsKey(), newStored)
+}
+
+// RewriteValues is RewriteValue for many keys at once. Every value is
+// checked before any is written, so a single bad value aborts the whole
+// batch with nothing rewritten.
+func (m *Migrator) RewriteValues(values map[key.Key][]byte) error {
+	for k, v := range values {
+		if err := m.check(k, v); err != nil {
+			return err
+		}
+	}
+	m.blockstore.swap.RLock()
+	defer m.blockstore.swap.RUnlock()
+	for k, v := range values {
+		if err := m.blockstore.datastore.Put(k.DsKey(), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) check(k key.Key, stored []byte) error {
+	data, err := m.decode(stored)
+	if err != nil {
+		return err
+	}
+	return Verify(k, data)
+}
@@ -0,0 +1,107 @@
+package blockstore
+
+import (
+	"bytes"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+)
+
+// untag reads a toy codec-tagged storage format: a one byte tag before the data.
+func untag(stored []byte) ([]byte, error) {
+	return stored[1:], nil
+}
+
+func TestMigratorRewriteValue(t *testing.T) {
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	bs := NewBlockstore(d)
+	b := blocks.NewBlock([]byte("payload"))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMigrator(bs, untag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged := append([]byte{0x55}, b.Data...)
+	if err := m.RewriteValue(b.Key(), tagged); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := d.Get(BlockPrefix.Child(b.Key().DsKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.([]byte), tagged) {
+		t.Fatal("stored value was not rewritten")
+	}
+}
+
+func TestMigratorRejectsChangedContent(t *testing.T) {
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	bs := NewBlockstore(d)
+	good := blocks.NewBlock([]byte("payload"))
+	if err := bs.Put(good); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMigrator(bs, untag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.RewriteValues(map[key.Key][]byte{
+		good.Key():                             append([]byte{0x55}, good.Data...),
+		blocks.NewBlock([]byte("other")).Key(): []byte{0x55, 'x'},
+	})
+	if err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+	got, err := bs.Get(good.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, good.Data) {
+		t.Fatal("a rejected batch must not rewrite any value")
+	}
+}
+
+func TestMigratorNamespaced(t *testing.T) {
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	bs, err := NamespacedBlockstore(d, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock([]byte("payload"))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMigrator(bs, untag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged := append([]byte{0x55}, b.Data...)
+	if err := m.RewriteValue(b.Key(), tagged); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := d.Get(ds.NewKey("app").Child(BlockPrefix).Child(b.Key().DsKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.([]byte), tagged) {
+		t.Fatal("stored value was not rewritten in the blockstore's namespace")
+	}
+	if has, _ := d.Has(BlockPrefix.Child(b.Key().DsKey())); has {
+		t.Fatal("migration wrote outside the blockstore's namespace")
+	}
+}
+
+func TestMigratorNeedsBlockstore(t *testing.T) {
+	if _, err := NewMigrator(ReadOnly(NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))), nil); err != ErrNoMigrator {
+		t.Fatalf("expected ErrNoMigrator, got %v", err)
+	}
+}
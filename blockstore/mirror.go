@@ -0,0 +1,382 @@
+package blockstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// DefaultMirrorRetry is how often an AsyncMirror retries the writes it
+// failed to mirror, if MirroredAsync is given no interval.
+const DefaultMirrorRetry = 10 * time.Second
+
+// Mirrored returns a blockstore making every write to |primary| also to each
+// of |secondaries|, so that they keep copies of its blocks, such as on
+// another disk, while reads go to |primary| alone. A write is made on
+// |primary| first, then on the secondaries in order, and returns the first
+// error, without undoing the write where it succeeded. Deleting a block a
+// secondary lacks is not an error. ReplaceAll replaces the contents of every
+// store at once, and PurgeOrphanedMetadata purges each of them.
+//
+// Writes wait for every secondary; MirroredAsync mirrors them in the
+// background instead.
+func Mirrored(primary Blockstore, secondaries ...Blockstore) Blockstore {
+	return &mirror{primary: primary, secondaries: secondaries}
+}
+
+type mirror struct {
+	primary     Blockstore
+	secondaries []Blockstore
+
+	// journal records the writes not mirrored yet if mirroring in the
+	// background, and is nil otherwise. See MirroredAsync.
+	journal ds.Datastore
+	// mu is held shared by writes from journaling them until they are made
+	// on the primary, and exclusively to read the journal with every write
+	// it records made.
+	mu  sync.RWMutex
+	seq uint64
+	// kick wakes the background mirroring after a write.
+	kick chan struct{}
+}
+
+// write makes the write of |ks| that |op| makes to a store.
+func (m *mirror) write(ks []key.Key, op func(Blockstore) error) error {
+	if m.journal != nil {
+		return m.journaled(ks, op)
+	}
+	if err := op(m.primary); err != nil {
+		return err
+	}
+	var first error
+	for _, bs := range m.secondaries {
+		if err := op(bs); !okOrNotFound(err) && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// journaled records the write of |ks| for each secondary, then makes it on
+// the primary, leaving the rest to the background mirroring.
+func (m *mirror) journaled(ks []key.Key, op func(Blockstore) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, atomic.AddUint64(&m.seq, 1))
+	for _, k := range ks {
+		for i := range m.secondaries {
+			if err := m.journal.Put(mirrorKey(i, k), seq); err != nil {
+				return err
+			}
+		}
+	}
+	if err := op(m.primary); err != nil {
+		return err
+	}
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// okOrNotFound reports whether |err| is nil, or says a block was not found, as
+// blockstores made by NewBlockstore do with ds.ErrNotFound.
+func okOrNotFound(err error) bool {
+	return err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ds.ErrNotFound)
+}
+
+func mirrorKey(secondary int, k key.Key) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/%d/%s", secondary, k.B58String()))
+}
+
+func (m *mirror) Has(k key.Key) (bool, error)          { return m.primary.Has(k) }
+func (m *mirror) Get(k key.Key) (*blocks.Block, error) { return m.primary.Get(k) }
+func (m *mirror) GetChan(ks []key.Key) <-chan *blocks.Block {
+	return m.primary.GetChan(ks)
+}
+
+func (m *mirror) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return m.primary.AllKeysChan(ctx)
+}
+
+func (m *mirror) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	return m.primary.AllKeys(ctx, q)
+}
+
+func (m *mirror) Put(b *blocks.Block) error {
+	return m.write([]key.Key{b.Key()}, func(bs Blockstore) error { return bs.Put(b) })
+}
+
+func (m *mirror) PutMany(blks []*blocks.Block) error {
+	return m.write(blockKeys(blks), func(bs Blockstore) error { return bs.PutMany(blks) })
+}
+
+func (m *mirror) DeleteBlock(k key.Key) error {
+	return m.write([]key.Key{k}, func(bs Blockstore) error { return bs.DeleteBlock(k) })
+}
+
+func (m *mirror) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	ks := append(blockKeys(puts), deletes...)
+	return m.write(ks, func(bs Blockstore) error { return bs.ApplyBatch(ctx, puts, deletes) })
+}
+
+func blockKeys(blks []*blocks.Block) []key.Key {
+	ks := make([]key.Key, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Key()
+	}
+	return ks
+}
+
+func (m *mirror) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	stores := append([]Blockstore{m.primary}, m.secondaries...)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	outs := make([]chan *blocks.Block, len(stores))
+	errs := make([]error, len(stores))
+	var wg sync.WaitGroup
+	for i, bs := range stores {
+		outs[i] = make(chan *blocks.Block)
+		wg.Add(1)
+		go func(i int, bs Blockstore) {
+			defer wg.Done()
+			if errs[i] = bs.ReplaceAll(ctx, outs[i]); errs[i] != nil {
+				cancel()
+			}
+		}(i, bs)
+	}
+	func() {
+		// as for ErasureCoded, the channels are only closed once |in| is.
+		for b := range in {
+			for _, out := range outs {
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		for _, out := range outs {
+			close(out)
+		}
+	}()
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (m *mirror) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	return m.primary.FindOrphanedMetadata(ctx)
+}
+
+func (m *mirror) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	total := 0
+	for _, bs := range append([]Blockstore{m.primary}, m.secondaries...) {
+		n, err := bs.PurgeOrphanedMetadata(ctx)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// AsyncMirror is a blockstore mirroring its writes in the background. See
+// MirroredAsync.
+type AsyncMirror struct {
+	*mirror
+	retry time.Duration
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// MirroredAsync is Mirrored, but writes return once made on |primary|, and
+// are mirrored to the secondaries in the background. Each write is first
+// recorded in |journal|, for each secondary, and the record removed once the
+// secondary is up to date with it, so that the writes a secondary failed, or
+// that a restart interrupted, are retried: on the next write, and every
+// |retry|, DefaultMirrorRetry if zero. For that, |journal| must keep its
+// contents across restarts, and be given again with the same secondaries in
+// the same order.
+//
+// Bringing a secondary up to date with a write makes it hold the blocks
+// written if the primary holds them at the time, and not otherwise, so that
+// retries made out of order cannot undo later writes.
+func MirroredAsync(primary Blockstore, secondaries []Blockstore, journal ds.Datastore, retry time.Duration) *AsyncMirror {
+	if retry <= 0 {
+		retry = DefaultMirrorRetry
+	}
+	m := &AsyncMirror{
+		mirror: &mirror{
+			primary:     primary,
+			secondaries: secondaries,
+			journal:     journal,
+			// unique across restarts, so that a record left by one is never
+			// taken for one of the next.
+			seq:  uint64(time.Now().UnixNano()),
+			kick: make(chan struct{}, 1),
+		},
+		retry: retry,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *AsyncMirror) run() {
+	defer close(m.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.stop
+		cancel()
+	}()
+	retry := time.NewTicker(m.retry)
+	defer retry.Stop()
+	for {
+		m.Sync(ctx)
+		select {
+		case <-m.kick:
+		case <-retry.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// mirrorRecord is a write recorded in the journal, for one secondary.
+type mirrorRecord struct {
+	dsKey     ds.Key
+	seq       []byte
+	secondary int
+	key       key.Key
+}
+
+// records returns the records in the journal, every write they record made
+// on the primary.
+func (m *AsyncMirror) records() ([]mirrorRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res, err := m.journal.Query(dsq.Query{})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	var recs []mirrorRecord
+	for _, e := range entries {
+		dk := ds.NewKey(e.Key)
+		ns := dk.Namespaces()
+		if len(ns) != 2 {
+			continue
+		}
+		i, err := strconv.Atoi(ns[0])
+		if err != nil || i < 0 || i >= len(m.secondaries) {
+			continue
+		}
+		k, err := key.DecodeB58(ns[1])
+		seq, ok := e.Value.([]byte)
+		if err != nil || !ok {
+			continue
+		}
+		recs = append(recs, mirrorRecord{dsKey: dk, seq: seq, secondary: i, key: k})
+	}
+	return recs, nil
+}
+
+// Pending returns the number of writes yet to be mirrored, counting a write
+// once for each secondary.
+func (m *AsyncMirror) Pending() (int, error) {
+	recs, err := m.records()
+	return len(recs), err
+}
+
+// Sync brings the secondaries up to date with every write made so far, and
+// returns the first error doing so. The writes it fails to mirror are
+// retried later.
+func (m *AsyncMirror) Sync(ctx context.Context) error {
+	recs, err := m.records()
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, r := range recs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := m.update(m.secondaries[r.secondary], r.key)
+		if err == nil {
+			err = m.forget(r)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// update makes |secondary| hold the block |k| if the primary does, and not
+// otherwise.
+func (m *AsyncMirror) update(secondary Blockstore, k key.Key) error {
+	b, err := m.primary.Get(k)
+	switch {
+	case err == nil:
+		return secondary.Put(b)
+	case errors.Is(err, ErrNotFound):
+		if err := secondary.DeleteBlock(k); !okOrNotFound(err) {
+			return err
+		}
+		return nil
+	default:
+		return err
+	}
+}
+
+// forget removes |r| from the journal, unless a later write of its key
+// recorded itself since.
+func (m *AsyncMirror) forget(r mirrorRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, err := m.journal.Get(r.dsKey)
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if seq, ok := v.([]byte); !ok || !bytes.Equal(seq, r.seq) {
+		return nil
+	}
+	return m.journal.Delete(r.dsKey)
+}
+
+// Close stops mirroring in the background, leaving the writes not mirrored
+// yet in the journal.
+func (m *AsyncMirror) Close() error {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+	return nil
+}
@@ -0,0 +1,157 @@
+package blockstore
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// flakyStore is a store whose writes fail while |down| is set.
+type flakyStore struct {
+	Blockstore
+	mu   sync.Mutex
+	down bool
+}
+
+var errStoreDown = errors.New("store down")
+
+func (f *flakyStore) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *flakyStore) fail() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errStoreDown
+	}
+	return nil
+}
+
+func (f *flakyStore) Put(b *blocks.Block) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.Blockstore.Put(b)
+}
+
+func (f *flakyStore) DeleteBlock(k key.Key) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.Blockstore.DeleteBlock(k)
+}
+
+func newMapBlockstore() Blockstore {
+	return NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+}
+
+func TestMirrored(t *testing.T) {
+	primary, a, b := newMapBlockstore(), newMapBlockstore(), newMapBlockstore()
+	bs := Mirrored(primary, a, b)
+
+	kept := blocks.NewBlock([]byte("mirrored"))
+	gone := blocks.NewBlock([]byte("mirrored, then deleted"))
+	if err := bs.PutMany([]*blocks.Block{kept, gone}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteBlock(gone.Key()); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Blockstore{primary, a, b} {
+		expectHas(t, s, kept.Key(), true)
+		expectHas(t, s, gone.Key(), false)
+	}
+
+	// reads go to the primary alone.
+	other := blocks.NewBlock([]byte("only in a secondary"))
+	if err := a.Put(other); err != nil {
+		t.Fatal(err)
+	}
+	expectHas(t, bs, other.Key(), false)
+	// and a delete of a block a secondary lacks succeeds.
+	if err := primary.Put(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteBlock(other.Key()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bs.ReplaceAll(context.Background(), blockChan(gone)); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Blockstore{primary, a, b} {
+		expectHas(t, s, kept.Key(), false)
+		expectHas(t, s, gone.Key(), true)
+	}
+}
+
+func TestMirroredAsync(t *testing.T) {
+	primary := newMapBlockstore()
+	up := newMapBlockstore()
+	down := &flakyStore{Blockstore: newMapBlockstore(), down: true}
+	journal := ds_sync.MutexWrap(ds.NewMapDatastore())
+	m := MirroredAsync(primary, []Blockstore{up, down}, journal, time.Hour)
+
+	kept := blocks.NewBlock([]byte("mirrored later"))
+	gone := blocks.NewBlock([]byte("mirrored later, then deleted"))
+	if err := m.Put(kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Put(gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteBlock(gone.Key()); err != nil {
+		t.Fatal(err)
+	}
+	expectHas(t, primary, kept.Key(), true)
+	if err := m.Sync(context.Background()); err != errStoreDown {
+		t.Fatalf("expected the down secondary to fail, got %v", err)
+	}
+	expectHas(t, up, kept.Key(), true)
+	expectHas(t, up, gone.Key(), false)
+	if n, err := m.Pending(); err != nil || n != 2 {
+		t.Fatalf("expected 2 writes pending for the down secondary, got %d, %v", n, err)
+	}
+	m.Close()
+
+	// the journal outlives the mirror, and the writes are retried by the
+	// next one.
+	down.setDown(false)
+	m = MirroredAsync(primary, []Blockstore{up, down}, journal, time.Hour)
+	defer m.Close()
+	if err := m.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectHas(t, down, kept.Key(), true)
+	expectHas(t, down, gone.Key(), false)
+	if n, _ := m.Pending(); n != 0 {
+		t.Fatalf("expected nothing pending, got %d", n)
+	}
+
+	// writes are mirrored without being asked to.
+	later := blocks.NewBlock([]byte("mirrored in the background"))
+	if err := m.Put(later); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if has, _ := down.Has(later.Key()); has {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("write was not mirrored in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,87 @@
+package blockstore
+
+import (
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+)
+
+// MappedDatastore is implemented by datastores that can return a value
+// backed by a memory map, rather than copied into the heap. Blockstores made
+// by NewBlockstore over one use it for GetMapped.
+type MappedDatastore interface {
+	// GetMapped returns the value of |k|, to be read only, and a func
+	// that unmaps it, or ds.ErrNotFound.
+	GetMapped(k ds.Key) (value []byte, release func() error, err error)
+}
+
+// MappedBlock is a block whose Data may be backed by a memory map. The Data
+// must not be written, and must not be used, nor kept in a slice, after
+// Release: reading unmapped memory crashes the program.
+type MappedBlock struct {
+	*blocks.Block
+	release func() error
+}
+
+// Release unmaps the block's data, if it was mapped. It must be called
+// once the data is no longer used, and only once.
+func (b *MappedBlock) Release() error {
+	if b.release == nil {
+		return nil
+	}
+	return b.release()
+}
+
+// Mapper is implemented by blockstores that can return blocks backed by a
+// memory map. Use GetMapped for the others.
+type Mapper interface {
+	GetMapped(k key.Key) (*MappedBlock, error)
+}
+
+// GetMapped returns the block |k|, backed by a memory map if |bs| is a
+// Mapper able to map it, and read with Get otherwise. Either way, it must
+// be released. Like Get, it does not verify the data against |k|.
+func GetMapped(bs Blockstore, k key.Key) (*MappedBlock, error) {
+	if m, ok := bs.(Mapper); ok {
+		return m.GetMapped(k)
+	}
+	b, err := bs.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedBlock{Block: b}, nil
+}
+
+// GetMapped maps the block from the datastore if it is a MappedDatastore,
+// and reads it with Get otherwise. A mapped block outlives a ReplaceAll, or
+// a delete, of its key: it keeps the data it was mapped with.
+func (bs *blockstore) GetMapped(k key.Key) (*MappedBlock, error) {
+	md, ok := bs.root.(MappedDatastore)
+	if !ok {
+		b, err := bs.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		return &MappedBlock{Block: b}, nil
+	}
+
+	bs.swap.RLock()
+	defer bs.swap.RUnlock()
+	// the namespace wrapper hides GetMapped, so the key is prefixed by hand.
+	data, release, err := md.GetMapped(bs.prefix.blocks.Child(k.DsKey()))
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := blocks.NewBlockWithKey(data, k)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &MappedBlock{Block: b, release: release}, nil
+}
@@ -0,0 +1,32 @@
+package blockstore
+
+import (
+	"fmt"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+)
+
+// NamespacedBlockstore returns a blockstore keeping its blocks, and
+// everything else NewBlockstore keeps, below |prefix| in |d|, so that
+// several applications can share one datastore, each with a blockstore of
+// its own: AllKeys lists only its blocks, ReplaceAll replaces only them, and
+// gc.GC and Quota applied to it see only them. DiskBytes is not reported,
+// as the datastore holds the others too.
+//
+// Every blockstore sharing |d| must be namespaced, with a prefix that is
+// not an ancestor of another's, nor the same.
+func NamespacedBlockstore(d ds.ThreadSafeDatastore, prefix string) (Blockstore, error) {
+	ns := ds.NewKey(prefix)
+	if ns.String() == "/" {
+		return nil, fmt.Errorf("blockstore: invalid namespace %q", prefix)
+	}
+	return newBlockstore(d, prefixes{
+		blocks:     ns.Child(BlockPrefix),
+		staging:    ns.Child(StagingPrefix),
+		quarantine: ns.Child(QuarantinePrefix),
+		metadata:   ns.Child(MetadataPrefix),
+		index:      ns.Child(IndexPrefix),
+		journal:    ns.Child(JournalPrefix),
+		namespaced: true,
+	}), nil
+}
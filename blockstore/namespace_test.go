@@ -0,0 +1,74 @@
+package blockstore
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func allKeys(t *testing.T, bs Blockstore) map[key.Key]bool {
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[key.Key]bool)
+	for k := range ch {
+		out[k] = true
+	}
+	return out
+}
+
+func TestNamespacedBlockstore(t *testing.T) {
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	a, err := NamespacedBlockstore(d, "/apps/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NamespacedBlockstore(d, "/apps/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := blocks.NewBlock([]byte("in both"))
+	onlyA := blocks.NewBlock([]byte("only in a"))
+	onlyB := blocks.NewBlock([]byte("only in b"))
+	for _, put := range []struct {
+		bs Blockstore
+		b  *blocks.Block
+	}{{a, shared}, {a, onlyA}, {b, shared}, {b, onlyB}} {
+		if err := put.bs.Put(put.b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ks := allKeys(t, a); len(ks) != 2 || !ks[shared.Key()] || !ks[onlyA.Key()] {
+		t.Fatalf("a listed %v", ks)
+	}
+	if has, _ := a.Has(onlyB.Key()); has {
+		t.Fatal("a sees b's block")
+	}
+	if err := a.DeleteBlock(shared.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := b.Has(shared.Key()); !has {
+		t.Fatal("deleting from a deleted from b")
+	}
+	expectUsage(t, b, 2, uint64(len(shared.Data)+len(onlyB.Data)))
+
+	in := make(chan *blocks.Block)
+	close(in)
+	if err := a.ReplaceAll(context.Background(), in); err != nil {
+		t.Fatal(err)
+	}
+	if ks := allKeys(t, b); len(ks) != 2 {
+		t.Fatalf("replacing a's blocks changed b's: %v", ks)
+	}
+
+	if _, err := NamespacedBlockstore(d, "/"); err == nil {
+		t.Fatal("expected the root namespace to be rejected")
+	}
+}
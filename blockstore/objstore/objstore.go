@@ -0,0 +1,397 @@
+// package objstore keeps blocks in an S3-compatible object store.
+//
+// The package does not speak any storage protocol itself. Callers adapt
+// their object storage client (an S3 SDK, or a client for a compatible
+// service) to the small Client interface, and get a datastore, or a
+// blockstore, with a key prefix, bounded concurrency and retries on top.
+package objstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	bstore "github.com/ipfs/go-blocks/blockstore"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrNotExist is returned by a Client for a missing object.
+var ErrNotExist = errors.New("objstore: object does not exist")
+
+// Client is the part of an S3-compatible object storage API the datastore
+// uses. Implementations must be safe for concurrent use.
+type Client interface {
+	// GetObject returns the contents of object |key| in |bucket|, or
+	// ErrNotExist.
+	GetObject(bucket, key string) ([]byte, error)
+	// PutObject creates or replaces object |key|. The object must be
+	// written whole or not at all, as S3 does.
+	PutObject(bucket, key string, data []byte) error
+	// HeadObject returns nil if object |key| exists, or ErrNotExist.
+	HeadObject(bucket, key string) error
+	// DeleteObject removes object |key|. Deleting a missing object is not
+	// an error.
+	DeleteObject(bucket, key string) error
+	// ListObjects returns, in lexical order, a page of the keys starting
+	// with |prefix| that sort after |after|, and whether more follow.
+	ListObjects(bucket, prefix, after string) (keys []string, more bool, err error)
+}
+
+// RangeClient is implemented by Clients that can read part of an object, as
+// S3 does for requests with a Range header. The Datastore's GetRange uses it
+// if the Client has it.
+type RangeClient interface {
+	// GetObjectRange returns up to |length| bytes of object |key| from
+	// |offset|, fewer if the object ends first, or ErrNotExist.
+	GetObjectRange(bucket, key string, offset, length int64) ([]byte, error)
+}
+
+// RetryPolicy says how failed requests are retried.
+type RetryPolicy struct {
+	// Attempts is the number of times a request is tried in all. Values
+	// below 1 mean 1.
+	Attempts int
+	// Backoff is the delay before the first retry. It doubles on each
+	// retry, up to MaxBackoff if that is set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retryable, if set, says whether a failure is worth retrying. By
+	// default every error but ErrNotExist is.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy is used when Options.Retry is left zero.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    100 * time.Millisecond,
+	MaxBackoff: 5 * time.Second,
+}
+
+// DefaultConcurrency is used when Options.Concurrency is left zero.
+const DefaultConcurrency = 16
+
+// Options configure a Datastore.
+type Options struct {
+	// Bucket is passed to every Client call.
+	Bucket string
+	// Prefix is prepended to every object key, so that several datastores
+	// may share a bucket. It is typically a path ending in "/".
+	Prefix string
+	// Concurrency bounds the requests in progress at once. The default is
+	// DefaultConcurrency.
+	Concurrency int
+	// Retry is the policy for failed requests. The default is
+	// DefaultRetryPolicy.
+	Retry RetryPolicy
+}
+
+// Datastore is a ds.ThreadSafeDatastore keeping each value in an object.
+// Object keys are Options.Prefix followed by the hex encoded datastore key,
+// which keeps the keys printable while preserving their order and the
+// prefixes queries select by.
+type Datastore struct {
+	client Client
+	bucket string
+	prefix string
+	retry  RetryPolicy
+
+	// slots holds a token for each request in progress.
+	slots chan struct{}
+}
+
+var (
+	_ ds.ThreadSafeDatastore  = (*Datastore)(nil)
+	_ bstore.RangeDatastore   = (*Datastore)(nil)
+	_ bstore.HasManyDatastore = (*Datastore)(nil)
+)
+
+// New returns a Datastore storing its values through |c|.
+func New(c Client, opts Options) (*Datastore, error) {
+	if c == nil {
+		return nil, errors.New("objstore: a client is required")
+	}
+	if opts.Bucket == "" {
+		return nil, errors.New("objstore: a bucket is required")
+	}
+	if opts.Concurrency < 0 {
+		return nil, errors.New("objstore: Concurrency must not be negative")
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if r := opts.Retry; r.Attempts == 0 && r.Backoff == 0 && r.MaxBackoff == 0 && r.Retryable == nil {
+		opts.Retry = DefaultRetryPolicy
+	}
+	return &Datastore{
+		client: c,
+		bucket: opts.Bucket,
+		prefix: opts.Prefix,
+		retry:  opts.Retry,
+		slots:  make(chan struct{}, opts.Concurrency),
+	}, nil
+}
+
+// NewBlockstore returns a blockstore kept in a Datastore on |c|.
+func NewBlockstore(c Client, opts Options) (bstore.Blockstore, error) {
+	d, err := New(c, opts)
+	if err != nil {
+		return nil, err
+	}
+	return bstore.NewBlockstore(d), nil
+}
+
+func (d *Datastore) objectKey(k string) string {
+	return d.prefix + hex.EncodeToString([]byte(strings.TrimPrefix(k, "/")))
+}
+
+func (d *Datastore) dsKey(object string) (ds.Key, bool) {
+	k, err := hex.DecodeString(strings.TrimPrefix(object, d.prefix))
+	if err != nil {
+		return ds.Key{}, false
+	}
+	return ds.NewKey(string(k)), true
+}
+
+// do runs |req| in a concurrency slot, retrying it as the policy says.
+func (d *Datastore) do(req func() error) error {
+	d.slots <- struct{}{}
+	defer func() { <-d.slots }()
+
+	delay := d.retry.Backoff
+	var err error
+	for i := 0; ; i++ {
+		if err = req(); err == nil || !d.retryable(err) || i+1 >= d.retry.Attempts {
+			return err
+		}
+		time.Sleep(delay)
+		if delay *= 2; d.retry.MaxBackoff > 0 && delay > d.retry.MaxBackoff {
+			delay = d.retry.MaxBackoff
+		}
+	}
+}
+
+func (d *Datastore) retryable(err error) bool {
+	if errors.Is(err, ErrNotExist) {
+		return false
+	}
+	return d.retry.Retryable == nil || d.retry.Retryable(err)
+}
+
+func (d *Datastore) Put(k ds.Key, value interface{}) error {
+	val, ok := value.([]byte)
+	if !ok {
+		return ds.ErrInvalidType
+	}
+	object := d.objectKey(k.String())
+	return d.do(func() error {
+		return d.client.PutObject(d.bucket, object, val)
+	})
+}
+
+func (d *Datastore) Get(k ds.Key) (interface{}, error) {
+	object := d.objectKey(k.String())
+	var data []byte
+	err := d.do(func() error {
+		var err error
+		data, err = d.client.GetObject(d.bucket, object)
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// GetRange asks for only the range if the Client is a RangeClient, and for
+// the whole object otherwise.
+func (d *Datastore) GetRange(k ds.Key, offset, length int64) ([]byte, error) {
+	rc, ok := d.client.(RangeClient)
+	if !ok {
+		v, err := d.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		data := v.([]byte)
+		if offset >= int64(len(data)) {
+			return []byte{}, nil
+		}
+		data = data[offset:]
+		if length < int64(len(data)) {
+			data = data[:length]
+		}
+		return data, nil
+	}
+	object := d.objectKey(k.String())
+	var data []byte
+	err := d.do(func() error {
+		var err error
+		data, err = rc.GetObjectRange(d.bucket, object, offset, length)
+		return err
+	})
+	if errors.Is(err, ErrNotExist) {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (d *Datastore) Has(k ds.Key) (bool, error) {
+	object := d.objectKey(k.String())
+	err := d.do(func() error {
+		return d.client.HeadObject(d.bucket, object)
+	})
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// HasMany checks for the objects of |ks| in parallel, up to the concurrency
+// limit, as a HEAD request each: object stores have no bulk existence check.
+// No requests are started once |ctx| is done.
+func (d *Datastore) HasMany(ctx context.Context, ks []ds.Key) ([]bool, error) {
+	var wg sync.WaitGroup
+	has := make([]bool, len(ks))
+	errs := make([]error, len(ks))
+	todo := make(chan int)
+	for n := 0; n < cap(d.slots); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				has[i], errs[i] = d.Has(ks[i])
+			}
+		}()
+	}
+	var cut error
+feed:
+	for i := range ks {
+		select {
+		case todo <- i:
+		case <-ctx.Done():
+			cut = ctx.Err()
+			break feed
+		}
+	}
+	close(todo)
+	wg.Wait()
+
+	if cut != nil {
+		return nil, cut
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return has, nil
+}
+
+// Delete removes the object for |k|. Object stores don't say whether a
+// deleted object existed, so it is checked for first, to return
+// ds.ErrNotFound as datastores do.
+func (d *Datastore) Delete(k ds.Key) error {
+	has, err := d.Has(k)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return ds.ErrNotFound
+	}
+	object := d.objectKey(k.String())
+	return d.do(func() error {
+		return d.client.DeleteObject(d.bucket, object)
+	})
+}
+
+// Query lists the objects under q.Prefix, page by page. Unless q.KeysOnly
+// is set, the values are then fetched in parallel, up to the concurrency
+// limit.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	listPrefix := d.objectKey(q.Prefix)
+	var entries []dsq.Entry
+	after := ""
+	for {
+		var keys []string
+		var more bool
+		err := d.do(func() error {
+			var err error
+			keys, more, err = d.client.ListObjects(d.bucket, listPrefix, after)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range keys {
+			if k, ok := d.dsKey(object); ok {
+				entries = append(entries, dsq.Entry{Key: k.String()})
+			}
+		}
+		if !more || len(keys) == 0 {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+
+	if !q.KeysOnly {
+		var err error
+		if entries, err = d.fetchValues(entries); err != nil {
+			return nil, err
+		}
+	}
+
+	r := dsq.ResultsWithEntries(q, entries)
+	r = dsq.NaiveQueryApply(q, r)
+	return r, nil
+}
+
+// fetchValues fills in the values of |entries|, dropping the ones deleted
+// since they were listed.
+func (d *Datastore) fetchValues(entries []dsq.Entry) ([]dsq.Entry, error) {
+	var wg sync.WaitGroup
+	errs := make([]error, len(entries))
+	todo := make(chan int)
+	for n := 0; n < cap(d.slots); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				v, err := d.Get(ds.NewKey(entries[i].Key))
+				entries[i].Value, errs[i] = v, err
+			}
+		}()
+	}
+	for i := range entries {
+		todo <- i
+	}
+	close(todo)
+	wg.Wait()
+
+	found := entries[:0]
+	for i, e := range entries {
+		switch {
+		case errs[i] == nil:
+			found = append(found, e)
+		case errors.Is(errs[i], ds.ErrNotFound):
+		default:
+			return nil, errs[i]
+		}
+	}
+	return found, nil
+}
+
+func (*Datastore) IsThreadSafe() {}
@@ -0,0 +1,284 @@
+package objstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	bstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// memClient is an in-memory object store. It fails the next |failures|
+// requests, and pages listings three keys at a time.
+type memClient struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	failures int32
+
+	active, maxActive int32
+	delay             time.Duration
+}
+
+func newMemClient() *memClient {
+	return &memClient{objects: make(map[string][]byte)}
+}
+
+var errUnavailable = errors.New("service unavailable")
+
+func (c *memClient) request(bucket string) error {
+	if bucket != "test-bucket" {
+		return errors.New("no such bucket")
+	}
+	if n := atomic.AddInt32(&c.active, 1); n > atomic.LoadInt32(&c.maxActive) {
+		atomic.StoreInt32(&c.maxActive, n)
+	}
+	time.Sleep(c.delay)
+	atomic.AddInt32(&c.active, -1)
+	if atomic.AddInt32(&c.failures, -1) >= 0 {
+		return errUnavailable
+	}
+	return nil
+}
+
+func (c *memClient) GetObject(bucket, key string) ([]byte, error) {
+	if err := c.request(bucket); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.objects[key]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return data, nil
+}
+
+func (c *memClient) PutObject(bucket, key string, data []byte) error {
+	if err := c.request(bucket); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.objects[key] = data
+	return nil
+}
+
+func (c *memClient) HeadObject(bucket, key string) error {
+	_, err := c.GetObject(bucket, key)
+	return err
+}
+
+func (c *memClient) DeleteObject(bucket, key string) error {
+	if err := c.request(bucket); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.objects, key)
+	return nil
+}
+
+func (c *memClient) ListObjects(bucket, prefix, after string) ([]string, bool, error) {
+	if err := c.request(bucket); err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for k := range c.objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > 3 {
+		return keys[:3], true, nil
+	}
+	return keys, false, nil
+}
+
+func TestBlockstore(t *testing.T) {
+	c := newMemClient()
+	bs, err := NewBlockstore(c, Options{Bucket: "test-bucket", Prefix: "archive/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blks []*blocks.Block
+	for i := 0; i < 10; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("object block %d", i)))
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		blks = append(blks, b)
+	}
+	for k := range c.objects {
+		if !strings.HasPrefix(k, "archive/") {
+			t.Fatalf("object %q stored outside the prefix", k)
+		}
+	}
+
+	got, err := bs.Get(blks[3].Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Data) != "object block 3" {
+		t.Fatalf("unexpected block data %q", got.Data)
+	}
+	if err := bs.DeleteBlock(blks[0].Key()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Has(blks[0].Key()); has {
+		t.Fatal("deleted block still present")
+	}
+
+	// the listing spans several pages.
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _ = range ch {
+		n++
+	}
+	if n != 9 {
+		t.Fatalf("expected 9 keys, got %d", n)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	c := newMemClient()
+	d, err := New(c, Options{Bucket: "test-bucket", Retry: RetryPolicy{Attempts: 3, Backoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.failures = 2
+	if err := d.Put(ds.NewKey("foo"), []byte("bar")); err != nil {
+		t.Fatalf("expected the put to succeed on the third attempt, got %v", err)
+	}
+	c.failures = 3
+	if _, err := d.Get(ds.NewKey("foo")); err != errUnavailable {
+		t.Fatalf("expected the error once attempts ran out, got %v", err)
+	}
+
+	// missing objects are not retried.
+	c.failures = 0
+	if _, err := d.Get(ds.NewKey("missing")); err != ds.ErrNotFound {
+		t.Fatalf("expected ds.ErrNotFound, got %v", err)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	c := newMemClient()
+	c.delay = 5 * time.Millisecond
+	d, err := New(c, Options{Bucket: "test-bucket", Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		c.objects[d.objectKey(fmt.Sprintf("/k%d", i))] = []byte("v")
+	}
+
+	res, err := d.Query(dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 8 {
+		t.Fatalf("expected 8 entries, got %d", len(entries))
+	}
+	if m := atomic.LoadInt32(&c.maxActive); m != 2 {
+		t.Fatalf("expected at most 2 requests at once, got %d", m)
+	}
+}
+
+func TestNewValidatesOptions(t *testing.T) {
+	if _, err := New(newMemClient(), Options{}); err == nil {
+		t.Fatal("expected an error without a bucket")
+	}
+	if _, err := New(newMemClient(), Options{Bucket: "test-bucket", Concurrency: -1}); err == nil {
+		t.Fatal("expected an error for negative concurrency")
+	}
+}
+
+// rangeClient is a memClient that can read ranges, counting them.
+type rangeClient struct {
+	*memClient
+	ranges int32
+}
+
+func (c *rangeClient) GetObjectRange(bucket, key string, offset, length int64) ([]byte, error) {
+	atomic.AddInt32(&c.ranges, 1)
+	data, err := c.GetObject(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= int64(len(data)) {
+		return []byte{}, nil
+	}
+	data = data[offset:]
+	if length < int64(len(data)) {
+		data = data[:length]
+	}
+	return data, nil
+}
+
+func TestGetRange(t *testing.T) {
+	for _, c := range []Client{newMemClient(), &rangeClient{memClient: newMemClient()}} {
+		bs, err := NewBlockstore(c, Options{Bucket: "test-bucket"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := blocks.NewBlock([]byte("an object read in part"))
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		got, err := bstore.GetRange(bs, b.Key(), 3, 6)
+		if err != nil || string(got) != "object" {
+			t.Fatalf("range read as %q, %v", got, err)
+		}
+		if rc, ok := c.(*rangeClient); ok && atomic.LoadInt32(&rc.ranges) != 1 {
+			t.Fatal("expected the range to be asked of the client")
+		}
+	}
+}
+
+func TestHasMany(t *testing.T) {
+	bs, err := NewBlockstore(newMemClient(), Options{Bucket: "test-bucket", Concurrency: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ks []key.Key
+	for i := 0; i < 10; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("object block %d", i)))
+		if i%3 == 0 {
+			if err := bs.Put(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ks = append(ks, b.Key())
+	}
+	has, err := bstore.HasMany(context.Background(), bs, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ok := range has {
+		if ok != (i%3 == 0) {
+			t.Fatalf("key %d: expected %v, got %v", i, i%3 == 0, ok)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package blockstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ktds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/keytransform"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// FormatKey is where Open records the Format of a store, below its
+// namespace, if it has one.
+var FormatKey = ds.NewKey("format")
+
+var (
+	// ErrFormatTooNew is returned by Open for a store written with a later
+	// format version than it was given.
+	ErrFormatTooNew = errors.New("blockstore: store format is newer than supported")
+	// ErrNeedsMigration is returned by Open for a store opened read-only
+	// that needs migrating.
+	ErrNeedsMigration = errors.New("blockstore: store format needs migrating")
+	// ErrNoMigration is the reason in a MigrationError for a version no
+	// migration applies to.
+	ErrNoMigration = errors.New("blockstore: no migration from version")
+)
+
+// Format is the record of how a store is laid out: a version, and the
+// settings of the wrappers it was written with that later opens must know,
+// such as the key format, shard scheme or cache settings, as the
+// application names them.
+type Format struct {
+	Version  int               `json:"version"`
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// Migration upgrades a store from one format version to the next.
+type Migration struct {
+	// From is the version it upgrades from, to From+1.
+	From int
+	Name string
+	// Apply migrates the datastore, as given to Open, and updates the
+	// settings of |f| to match. It may have been interrupted before, so
+	// must cope with a store it partly migrated.
+	Apply func(ctx context.Context, d ds.ThreadSafeDatastore, f *Format) error
+}
+
+// MigrationError is returned by Open for a migration that failed, or was
+// missing.
+type MigrationError struct {
+	From int
+	Name string
+	Err  error
+}
+
+func (e *MigrationError) Error() string {
+	if errors.Is(e.Err, ErrNoMigration) {
+		return fmt.Sprintf("%s %d", ErrNoMigration, e.From)
+	}
+	return fmt.Sprintf("blockstore: migration %q from version %d: %s", e.Name, e.From, e.Err)
+}
+
+// Unwrap returns the reason.
+func (e *MigrationError) Unwrap() error { return e.Err }
+
+// OpenOptions configures Open.
+type OpenOptions struct {
+	// Version is the format version the application writes.
+	Version int
+	// Settings are recorded in the Format, replacing those recorded.
+	Settings map[string]string
+	// Migrations upgrade older formats, in any order.
+	Migrations []Migration
+	// Options assemble the blockstore, as for NewBlockstoreFromDatastore.
+	Options []Option
+}
+
+// Open returns the blockstore NewBlockstoreFromDatastore assembles over
+// |d| with opts.Options, having checked the format of the store, and the
+// io.Closer to close it with, which flushes a WriteBack cache.
+//
+// An empty store is given opts.Version. A store without a Format, from
+// before there was one, has version 0. A store of an earlier version is
+// migrated first, one version at a time, and the version recorded after
+// each, so that a migration interrupted is resumed on the next open. Opens
+// must be kept from running at once, with Locked or otherwise, while
+// migrations may run. A store of a later version fails with
+// ErrFormatTooNew.
+func Open(ctx context.Context, d ds.ThreadSafeDatastore, opts OpenOptions) (Blockstore, io.Closer, error) {
+	var c config
+	for _, opt := range opts.Options {
+		opt(&c)
+	}
+	view := d
+	if c.transform != nil {
+		view = threadSafe{ktds.Wrap(d, c.transform)}
+	}
+	root := ds.NewKey("/")
+	if c.namespace != "" {
+		root = ds.NewKey(c.namespace)
+	}
+	fk := root.Child(FormatKey)
+
+	f, recorded, err := readFormat(view, fk)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !recorded {
+		empty, err := isEmpty(view, root, fk)
+		if err != nil {
+			return nil, nil, err
+		}
+		if empty {
+			f.Version = opts.Version
+		}
+	}
+	if f.Version > opts.Version {
+		return nil, nil, ErrFormatTooNew
+	}
+	if f.Version < opts.Version && c.readOnly {
+		return nil, nil, ErrNeedsMigration
+	}
+	for f.Version < opts.Version {
+		m, ok := migrationFrom(opts.Migrations, f.Version)
+		if !ok {
+			return nil, nil, &MigrationError{From: f.Version, Err: ErrNoMigration}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if err := m.Apply(ctx, d, &f); err != nil {
+			return nil, nil, &MigrationError{From: m.From, Name: m.Name, Err: err}
+		}
+		f.Version = m.From + 1
+		if err := writeFormat(view, fk, f); err != nil {
+			return nil, nil, err
+		}
+		recorded = true
+	}
+	changed := !recorded
+	for k, v := range opts.Settings {
+		if old, ok := f.Settings[k]; !ok || old != v {
+			if f.Settings == nil {
+				f.Settings = make(map[string]string)
+			}
+			f.Settings[k] = v
+			changed = true
+		}
+	}
+	if changed && !c.readOnly {
+		if err := writeFormat(view, fk, f); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	bs, err := NewBlockstoreFromDatastore(d, opts.Options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cl, ok := bs.(io.Closer); ok {
+		return bs, cl, nil
+	}
+	// nothing to close: an unlocker without a Locker does nothing.
+	return bs, unlocker{}, nil
+}
+
+func migrationFrom(ms []Migration, version int) (Migration, bool) {
+	for _, m := range ms {
+		if m.From == version {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+func readFormat(d ds.Datastore, fk ds.Key) (Format, bool, error) {
+	var f Format
+	v, err := d.Get(fk)
+	if errors.Is(err, ds.ErrNotFound) {
+		return f, false, nil
+	}
+	if err != nil {
+		return f, false, err
+	}
+	data, ok := v.([]byte)
+	if !ok {
+		return f, false, ValueTypeMismatch
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, false, fmt.Errorf("blockstore: invalid format record: %w", err)
+	}
+	return f, true, nil
+}
+
+func writeFormat(d ds.Datastore, fk ds.Key, f Format) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return d.Put(fk, data)
+}
+
+// isEmpty reports whether |d| holds nothing below |root| but |fk|.
+func isEmpty(d ds.Datastore, root, fk ds.Key) (bool, error) {
+	q := dsq.Query{KeysOnly: true}
+	if root.String() != "/" {
+		q.Prefix = root.String()
+	}
+	res, err := d.Query(q)
+	if err != nil {
+		return false, err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return false, r.Error
+		}
+		if k := ds.NewKey(r.Key); k != fk && (k == root || root.IsAncestorOf(k)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,139 @@
+package blockstore
+
+import (
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// b58Keys migrates a store written with raw keys to key.B58KeyConverter.
+var b58Keys = Migration{
+	From: 0,
+	Name: "base58 keys",
+	Apply: func(ctx context.Context, d ds.ThreadSafeDatastore, f *Format) error {
+		res, err := d.Query(dsq.Query{})
+		if err != nil {
+			return err
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			k := ds.NewKey(e.Key)
+			if err := d.Put(key.B58KeyConverter.ConvertKey(k), e.Value); err != nil {
+				return err
+			}
+			if err := d.Delete(k); err != nil {
+				return err
+			}
+		}
+		f.Settings = map[string]string{"keys": "base58"}
+		return nil
+	},
+}
+
+func TestOpenMigratesLegacyStore(t *testing.T) {
+	ctx := context.Background()
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	b := blocks.NewBlock([]byte("written before formats"))
+	if err := NewBlockstore(d).Put(b); err != nil {
+		t.Fatal(err)
+	}
+
+	var ran []string
+	opts := OpenOptions{
+		Version: 2,
+		Migrations: []Migration{
+			{From: 1, Name: "noop", Apply: func(context.Context, ds.ThreadSafeDatastore, *Format) error {
+				ran = append(ran, "noop")
+				return nil
+			}},
+			b58Keys,
+		},
+		Options: []Option{WithKeyTransform(key.B58KeyConverter), WithoutCache()},
+	}
+	bs, closer, err := Open(ctx, d, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	if got, err := bs.Get(b.Key()); err != nil || string(got.Data) != string(b.Data) {
+		t.Fatalf("block lost in migration: %v", err)
+	}
+	if len(ran) != 1 {
+		t.Fatalf("expected the second migration to run once, ran %v", ran)
+	}
+	f, ok, err := readFormat(threadSafe{ds.Datastore(d)}, key.B58KeyConverter.ConvertKey(FormatKey))
+	if err != nil || !ok || f.Version != 2 || f.Settings["keys"] != "base58" {
+		t.Fatalf("recorded %+v, %v, %v", f, ok, err)
+	}
+
+	// the next open has nothing left to migrate.
+	if _, _, err := Open(ctx, d, opts); err != nil || len(ran) != 1 {
+		t.Fatalf("reopening: %v, ran %v", err, ran)
+	}
+}
+
+func TestOpenResumesFailedMigration(t *testing.T) {
+	ctx := context.Background()
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	if err := NewBlockstore(d).Put(blocks.NewBlock([]byte("legacy"))); err != nil {
+		t.Fatal(err)
+	}
+	fail := errors.New("disk full")
+	var ran []int
+	step := func(from int) Migration {
+		return Migration{From: from, Name: "step", Apply: func(context.Context, ds.ThreadSafeDatastore, *Format) error {
+			ran = append(ran, from)
+			return fail
+		}}
+	}
+	ok := func(from int) Migration {
+		return Migration{From: from, Apply: func(context.Context, ds.ThreadSafeDatastore, *Format) error {
+			ran = append(ran, from)
+			return nil
+		}}
+	}
+	_, _, err := Open(ctx, d, OpenOptions{Version: 2, Migrations: []Migration{ok(0), step(1)}})
+	if me, isME := err.(*MigrationError); !isME || me.From != 1 || me.Err != fail {
+		t.Fatalf("expected the second migration to fail, got %v", err)
+	}
+	ran = nil
+	if _, _, err := Open(ctx, d, OpenOptions{Version: 2, Migrations: []Migration{ok(0), ok(1)}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 1 || ran[0] != 1 {
+		t.Fatalf("expected only the failed migration to run again, ran %v", ran)
+	}
+}
+
+func TestOpenChecksVersion(t *testing.T) {
+	ctx := context.Background()
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	// an empty store is given the version, without migrating.
+	if _, _, err := Open(ctx, d, OpenOptions{Version: 3, Settings: map[string]string{"shards": "next-to-last/2"}}); err != nil {
+		t.Fatal(err)
+	}
+	f, ok, err := readFormat(d, FormatKey)
+	if err != nil || !ok || f.Version != 3 || f.Settings["shards"] != "next-to-last/2" {
+		t.Fatalf("recorded %+v, %v, %v", f, ok, err)
+	}
+	if _, _, err := Open(ctx, d, OpenOptions{Version: 2}); err != ErrFormatTooNew {
+		t.Fatalf("expected ErrFormatTooNew, got %v", err)
+	}
+	_, _, err = Open(ctx, d, OpenOptions{Version: 4})
+	if me, ok := err.(*MigrationError); !ok || me.Err != ErrNoMigration {
+		t.Fatalf("expected ErrNoMigration, got %v", err)
+	}
+	if _, _, err := Open(ctx, d, OpenOptions{Version: 4, Options: []Option{WithReadOnly()}}); err != ErrNeedsMigration {
+		t.Fatalf("expected ErrNeedsMigration, got %v", err)
+	}
+}
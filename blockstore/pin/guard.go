@@ -0,0 +1,85 @@
+package pin
+
+import (
+	blocks "github.com/ipfs/go-blocks"
+	bstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Guard returns a blockstore that writes to |bs|, but refuses with ErrPinned
+// to remove the blocks |p| pins, however they are pinned. A gc.GC of it
+// skips them even if they are left out of its pinned set. Like
+// bstore.ReadOnly, it hides the optional interfaces of |bs|.
+//
+// A pin made while a write is in progress may not stop it.
+func (p *Pinner) Guard(bs bstore.Blockstore) bstore.Blockstore {
+	return &guarded{Blockstore: bs, p: p}
+}
+
+type guarded struct {
+	bstore.Blockstore
+	p *Pinner
+}
+
+func (g *guarded) pinned(k key.Key) bool {
+	_, ok := g.p.IsPinned(k)
+	return ok
+}
+
+func (g *guarded) DeleteBlock(k key.Key) error {
+	if g.pinned(k) {
+		return ErrPinned
+	}
+	return g.Blockstore.DeleteBlock(k)
+}
+
+// ApplyBatch refuses the whole batch if it deletes a pinned block.
+func (g *guarded) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	for _, k := range deletes {
+		if g.pinned(k) {
+			return ErrPinned
+		}
+	}
+	return g.Blockstore.ApplyBatch(ctx, puts, deletes)
+}
+
+// ReplaceAll aborts the replacement, leaving the store as it was, unless
+// the blocks from |in| include every pinned block.
+func (g *guarded) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	missing := make(map[key.Key]struct{})
+	for _, k := range g.p.Set().Keys() {
+		missing[k] = struct{}{}
+	}
+	checked := make(chan *blocks.Block)
+	errs := make(chan error, 1)
+	go func() {
+		for b := range in {
+			delete(missing, b.Key())
+			select {
+			case checked <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+		// |checked| is only closed with every pinned block in, so that a
+		// missing one is never taken for the end of the blocks.
+		if len(missing) > 0 {
+			errs <- ErrPinned
+			cancel()
+			return
+		}
+		close(checked)
+	}()
+	err := g.Blockstore.ReplaceAll(ctx, checked)
+	select {
+	case perr := <-errs:
+		return perr
+	default:
+		return err
+	}
+}
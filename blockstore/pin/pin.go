@@ -0,0 +1,367 @@
+// package pin keeps track of the blocks of a blockstore that must not be
+// removed, and guards them from DeleteBlock and GC.
+//
+// A block is pinned directly, on its own, or recursively, together with the
+// blocks its links lead to, which are then pinned indirectly. Blocks don't
+// know their links; a LinkFunc, given to New, reads them.
+package pin
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	bstore "github.com/ipfs/go-blocks/blockstore"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Mode is the way a block is pinned.
+type Mode int
+
+const (
+	Direct Mode = iota
+	Recursive
+	Indirect
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Direct:
+		return "direct"
+	case Recursive:
+		return "recursive"
+	case Indirect:
+		return "indirect"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+var ErrNotPinned = errors.New("pin: not pinned")
+
+// ErrPinned is returned by the blockstores made by Pinner.Guard for writes
+// that would remove a pinned block. It is bstore.ErrPinned, so that a
+// bstore.Evicting over them passes over the pinned blocks.
+var ErrPinned = bstore.ErrPinned
+
+// LinkFunc returns the keys of the blocks |b| links to.
+type LinkFunc func(b *blocks.Block) ([]key.Key, error)
+
+// Pinner tracks the pins of a blockstore, keeping direct and recursive pins
+// in a datastore. Indirect pins are worked out from the recursive ones, in
+// memory. It is safe for concurrent use.
+type Pinner struct {
+	store ds.Datastore
+	bs    bstore.Blockstore
+	links LinkFunc
+
+	// held is held for writing by a gc.GC holding the pins, and for
+	// reading by Pin.
+	held sync.RWMutex
+
+	mu        sync.RWMutex
+	direct    map[key.Key]struct{}
+	recursive map[key.Key][]key.Key // each root's descendants
+	indirect  map[key.Key]int       // how many roots reach each descendant
+}
+
+var (
+	directPrefix    = ds.NewKey("direct")
+	recursivePrefix = ds.NewKey("recursive")
+)
+
+// New returns a Pinner for the blocks of |bs|, keeping its pins in |d|,
+// which must not be used for anything else, and loads the pins kept there
+// already. |links| reads the links of blocks pinned recursively; nil means
+// blocks have none. Descendants of recursive pins missing from |bs| while
+// loading are skipped, along with what they link to.
+func New(ctx context.Context, d ds.Datastore, bs bstore.Blockstore, links LinkFunc) (*Pinner, error) {
+	p := &Pinner{
+		store:     d,
+		bs:        bs,
+		links:     links,
+		direct:    make(map[key.Key]struct{}),
+		recursive: make(map[key.Key][]key.Key),
+		indirect:  make(map[key.Key]int),
+	}
+	direct, recursive, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range direct {
+		p.direct[k] = struct{}{}
+	}
+	for _, k := range recursive {
+		desc, err := p.descendants(ctx, k, false)
+		if err != nil {
+			return nil, err
+		}
+		p.addRecursive(k, desc)
+	}
+	return p, nil
+}
+
+// load returns the pins kept in the datastore. It lists the whole
+// datastore, which is only used for pins, as namespace wrappers do not apply
+// query prefixes.
+func (p *Pinner) load() (direct, recursive []key.Key, err error) {
+	res, err := p.store.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		dk := ds.NewKey(e.Key)
+		k := key.B58KeyDecode(dk.BaseNamespace())
+		if k == "" {
+			continue
+		}
+		switch dk.Parent().BaseNamespace() {
+		case directPrefix.BaseNamespace():
+			direct = append(direct, k)
+		case recursivePrefix.BaseNamespace():
+			recursive = append(recursive, k)
+		}
+	}
+	return direct, recursive, nil
+}
+
+func pinKey(prefix ds.Key, k key.Key) ds.Key {
+	return prefix.ChildString(k.B58String())
+}
+
+// descendants returns the keys of the blocks reachable from |root| through
+// links, each once, without |root| itself. Missing blocks fail it with
+// bstore.ErrNotFound if |strict|, or are skipped.
+func (p *Pinner) descendants(ctx context.Context, root key.Key, strict bool) ([]key.Key, error) {
+	if p.links == nil {
+		return nil, nil
+	}
+	seen := map[key.Key]struct{}{root: {}}
+	var out []key.Key
+	queue := []key.Key{root}
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		k := queue[0]
+		queue = queue[1:]
+		b, err := p.bs.Get(k)
+		if errors.Is(err, bstore.ErrNotFound) && !strict {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("pin: reading %s: %w", k, err)
+		}
+		links, err := p.links(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range links {
+			if _, ok := seen[l]; ok {
+				continue
+			}
+			seen[l] = struct{}{}
+			out = append(out, l)
+			queue = append(queue, l)
+		}
+	}
+	return out, nil
+}
+
+// addRecursive records |root| as pinned recursively, with |desc|. p.mu must
+// be held, or p not yet shared.
+func (p *Pinner) addRecursive(root key.Key, desc []key.Key) {
+	p.recursive[root] = desc
+	for _, k := range desc {
+		p.indirect[k]++
+	}
+}
+
+// Pin pins |k|, and, if |recursive|, every block reachable from it, all of
+// which must be in the blockstore. Pinning a block already pinned the same
+// way does nothing; a direct pin is replaced by a recursive one, while a
+// block pinned recursively stays so. Pin waits for a gc.GC holding the pins
+// to be done.
+func (p *Pinner) Pin(ctx context.Context, k key.Key, recursive bool) error {
+	p.held.RLock()
+	defer p.held.RUnlock()
+	if has, err := p.bs.Has(k); err != nil {
+		return err
+	} else if !has {
+		return bstore.ErrNotFound
+	}
+	var desc []key.Key
+	if recursive {
+		var err error
+		// walked before locking; the blocks are only read.
+		if desc, err = p.descendants(ctx, k, true); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.recursive[k]; ok {
+		return nil
+	}
+	if !recursive {
+		if err := p.store.Put(pinKey(directPrefix, k), []byte{}); err != nil {
+			return err
+		}
+		p.direct[k] = struct{}{}
+		return nil
+	}
+	if err := p.store.Put(pinKey(recursivePrefix, k), []byte{}); err != nil {
+		return err
+	}
+	if _, ok := p.direct[k]; ok {
+		if err := p.store.Delete(pinKey(directPrefix, k)); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return err
+		}
+		delete(p.direct, k)
+	}
+	p.addRecursive(k, desc)
+	return nil
+}
+
+// Unpin removes the direct or recursive pin of |k|, and with a recursive
+// one, the indirect pins it made. It returns ErrNotPinned if |k| is only
+// pinned indirectly, or not at all.
+func (p *Pinner) Unpin(k key.Key) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if desc, ok := p.recursive[k]; ok {
+		if err := p.store.Delete(pinKey(recursivePrefix, k)); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return err
+		}
+		delete(p.recursive, k)
+		for _, d := range desc {
+			if p.indirect[d]--; p.indirect[d] == 0 {
+				delete(p.indirect, d)
+			}
+		}
+		return nil
+	}
+	if _, ok := p.direct[k]; ok {
+		if err := p.store.Delete(pinKey(directPrefix, k)); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return err
+		}
+		delete(p.direct, k)
+		return nil
+	}
+	return ErrNotPinned
+}
+
+// IsPinned reports whether |k| is pinned, and how. A block pinned in
+// several ways reports the first of Recursive, Direct and Indirect.
+func (p *Pinner) IsPinned(k key.Key) (Mode, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.modeLocked(k)
+}
+
+func (p *Pinner) modeLocked(k key.Key) (Mode, bool) {
+	if _, ok := p.recursive[k]; ok {
+		return Recursive, true
+	}
+	if _, ok := p.direct[k]; ok {
+		return Direct, true
+	}
+	if p.indirect[k] > 0 {
+		return Indirect, true
+	}
+	return 0, false
+}
+
+// Keys returns the keys pinned with |mode|.
+func (p *Pinner) Keys(mode Mode) []key.Key {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var ks []key.Key
+	switch mode {
+	case Direct:
+		for k := range p.direct {
+			ks = append(ks, k)
+		}
+	case Recursive:
+		for k := range p.recursive {
+			ks = append(ks, k)
+		}
+	case Indirect:
+		for k := range p.indirect {
+			ks = append(ks, k)
+		}
+	}
+	return ks
+}
+
+// Hold returns the keys pinned, however they are pinned, for gc.GC, and
+// keeps Pin waiting until |release| is called. The blocks recursive pins
+// reach are among them, so GC keeps them without links of its own.
+func (p *Pinner) Hold() (pinned []key.Key, release func()) {
+	p.held.Lock()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for k := range p.direct {
+		pinned = append(pinned, k)
+	}
+	for k := range p.recursive {
+		pinned = append(pinned, k)
+	}
+	for k := range p.indirect {
+		pinned = append(pinned, k)
+	}
+	return pinned, p.held.Unlock
+}
+
+// Set returns a snapshot of every pinned key, however it is pinned. See View
+// for one that follows the pins.
+func (p *Pinner) Set() key.KeySet {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	s := key.NewKeySet()
+	for k := range p.direct {
+		s.Add(k)
+	}
+	for k := range p.recursive {
+		s.Add(k)
+	}
+	for k := range p.indirect {
+		s.Add(k)
+	}
+	return s
+}
+
+// View returns a key.KeySet of the keys pinned, however they are pinned,
+// that follows the pins as they change, for bstore.Evicting. It is read
+// only: its Add and Remove panic.
+func (p *Pinner) View() key.KeySet {
+	return view{p}
+}
+
+type view struct {
+	p *Pinner
+}
+
+func (v view) Add(key.Key)    { panic("pin: View is read only") }
+func (v view) Remove(key.Key) { panic("pin: View is read only") }
+
+func (v view) Has(k key.Key) bool {
+	_, ok := v.p.IsPinned(k)
+	return ok
+}
+
+func (v view) Len() int        { return v.p.Set().Len() }
+func (v view) Keys() []key.Key { return v.p.Set().Keys() }
+
+func (v view) ForEach(f func(key.Key) bool) {
+	v.p.Set().ForEach(f)
+}
@@ -0,0 +1,317 @@
+package pin
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	bstore "github.com/ipfs/go-blocks/blockstore"
+	"github.com/ipfs/go-blocks/blockstore/gc"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// tree stores root -> {mid -> leaf, other}, plus a loose block, and links
+// them through a map.
+type tree struct {
+	bs                          bstore.Blockstore
+	root, mid, leaf, other, own *blocks.Block
+	links                       map[key.Key][]key.Key
+}
+
+func newTree(t *testing.T) *tree {
+	tr := &tree{
+		bs:    bstore.NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())),
+		root:  blocks.NewBlock([]byte("root")),
+		mid:   blocks.NewBlock([]byte("mid")),
+		leaf:  blocks.NewBlock([]byte("leaf")),
+		other: blocks.NewBlock([]byte("other")),
+		own:   blocks.NewBlock([]byte("own")),
+	}
+	tr.links = map[key.Key][]key.Key{
+		tr.root.Key(): {tr.mid.Key(), tr.other.Key()},
+		tr.mid.Key():  {tr.leaf.Key()},
+	}
+	for _, b := range []*blocks.Block{tr.root, tr.mid, tr.leaf, tr.other, tr.own} {
+		if err := tr.bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tr
+}
+
+func (tr *tree) linkFunc(b *blocks.Block) ([]key.Key, error) {
+	return tr.links[b.Key()], nil
+}
+
+func (tr *tree) pinner(t *testing.T, d ds.Datastore) *Pinner {
+	p, err := New(context.Background(), d, tr.bs, tr.linkFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func expectMode(t *testing.T, p *Pinner, b *blocks.Block, want Mode, pinned bool) {
+	mode, ok := p.IsPinned(b.Key())
+	if ok != pinned || (pinned && mode != want) {
+		t.Fatalf("%s: expected pinned %v (%s), got %v (%s)", b.Data, pinned, want, ok, mode)
+	}
+}
+
+func TestPinModes(t *testing.T) {
+	ctx := context.Background()
+	tr := newTree(t)
+	p := tr.pinner(t, ds.NewMapDatastore())
+
+	if err := p.Pin(ctx, tr.root.Key(), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Pin(ctx, tr.own.Key(), false); err != nil {
+		t.Fatal(err)
+	}
+	expectMode(t, p, tr.root, Recursive, true)
+	expectMode(t, p, tr.mid, Indirect, true)
+	expectMode(t, p, tr.leaf, Indirect, true)
+	expectMode(t, p, tr.other, Indirect, true)
+	expectMode(t, p, tr.own, Direct, true)
+	if n := len(p.Set().Keys()); n != 5 {
+		t.Fatalf("expected 5 pinned keys, got %d", n)
+	}
+
+	if err := p.Unpin(tr.mid.Key()); err != ErrNotPinned {
+		t.Fatalf("expected ErrNotPinned unpinning an indirect pin, got %v", err)
+	}
+	if err := p.Unpin(tr.root.Key()); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*blocks.Block{tr.root, tr.mid, tr.leaf, tr.other} {
+		expectMode(t, p, b, 0, false)
+	}
+	expectMode(t, p, tr.own, Direct, true)
+}
+
+func TestPinIndirectSharedByRoots(t *testing.T) {
+	ctx := context.Background()
+	tr := newTree(t)
+	p := tr.pinner(t, ds.NewMapDatastore())
+
+	for _, b := range []*blocks.Block{tr.root, tr.mid} {
+		if err := p.Pin(ctx, b.Key(), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Unpin(tr.root.Key()); err != nil {
+		t.Fatal(err)
+	}
+	// leaf is still reached from mid.
+	expectMode(t, p, tr.leaf, Indirect, true)
+	expectMode(t, p, tr.other, 0, false)
+}
+
+func TestPinMissing(t *testing.T) {
+	ctx := context.Background()
+	tr := newTree(t)
+	if err := tr.bs.DeleteBlock(tr.leaf.Key()); err != nil {
+		t.Fatal(err)
+	}
+	p := tr.pinner(t, ds.NewMapDatastore())
+
+	missing := blocks.NewBlock([]byte("missing"))
+	if err := p.Pin(ctx, missing.Key(), false); err != bstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := p.Pin(ctx, tr.root.Key(), true); err == nil {
+		t.Fatal("expected pinning with a missing descendant to fail")
+	}
+	expectMode(t, p, tr.root, 0, false)
+}
+
+func TestPinsPersist(t *testing.T) {
+	ctx := context.Background()
+	tr := newTree(t)
+	d := ds.NewMapDatastore()
+	p := tr.pinner(t, d)
+	if err := p.Pin(ctx, tr.mid.Key(), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Pin(ctx, tr.own.Key(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	p = tr.pinner(t, d)
+	expectMode(t, p, tr.mid, Recursive, true)
+	expectMode(t, p, tr.leaf, Indirect, true)
+	expectMode(t, p, tr.own, Direct, true)
+	expectMode(t, p, tr.root, 0, false)
+}
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	tr := newTree(t)
+	p := tr.pinner(t, ds.NewMapDatastore())
+	if err := p.Pin(ctx, tr.mid.Key(), true); err != nil {
+		t.Fatal(err)
+	}
+	bs := p.Guard(tr.bs)
+
+	if err := bs.DeleteBlock(tr.leaf.Key()); err != ErrPinned {
+		t.Fatalf("expected ErrPinned, got %v", err)
+	}
+	if err := bs.ApplyBatch(ctx, nil, []key.Key{tr.own.Key(), tr.mid.Key()}); err != ErrPinned {
+		t.Fatalf("expected ErrPinned, got %v", err)
+	}
+	if has, _ := bs.Has(tr.own.Key()); !has {
+		t.Fatal("a refused batch deleted a block")
+	}
+	if err := bs.DeleteBlock(tr.own.Key()); err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan *blocks.Block, 1)
+	in <- tr.mid
+	close(in)
+	if err := bs.ReplaceAll(ctx, in); err != ErrPinned {
+		t.Fatalf("expected ErrPinned replacing without leaf, got %v", err)
+	}
+	if has, _ := bs.Has(tr.leaf.Key()); !has {
+		t.Fatal("a refused replacement removed a pinned block")
+	}
+
+	in = make(chan *blocks.Block, 2)
+	in <- tr.mid
+	in <- tr.leaf
+	close(in)
+	if err := bs.ReplaceAll(ctx, in); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Has(tr.root.Key()); has {
+		t.Fatal("expected the replacement to drop the unpinned blocks")
+	}
+}
+
+func TestGCWithPins(t *testing.T) {
+	ctx := context.Background()
+	tr := newTree(t)
+	p := tr.pinner(t, ds.NewMapDatastore())
+	if err := p.Pin(ctx, tr.mid.Key(), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Pin(ctx, tr.own.Key(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// even with no pinned set, a guarded store keeps its pins.
+	removed, err := gc.GC(ctx, p.Guard(tr.bs), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range removed {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("expected root and other removed, got %d blocks", n)
+	}
+	for _, b := range []*blocks.Block{tr.mid, tr.leaf, tr.own} {
+		if has, _ := tr.bs.Has(b.Key()); !has {
+			t.Fatalf("%s: pinned block removed", b.Data)
+		}
+	}
+}
+
+func TestGCKeepsRecursivePinsWithoutLinks(t *testing.T) {
+	ctx := context.Background()
+	tr := newTree(t)
+	p := tr.pinner(t, ds.NewMapDatastore())
+	if err := p.Pin(ctx, tr.mid.Key(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pinner knows what its recursive pins reach; GC needn't.
+	removed, err := gc.GC(ctx, tr.bs, p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range removed {
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("expected root, other and own removed, got %d blocks", n)
+	}
+	for _, b := range []*blocks.Block{tr.mid, tr.leaf} {
+		if has, _ := tr.bs.Has(b.Key()); !has {
+			t.Fatalf("%s: pinned block removed", b.Data)
+		}
+	}
+}
+
+func TestGCHoldsPins(t *testing.T) {
+	ctx := context.Background()
+	tr := newTree(t)
+	p := tr.pinner(t, ds.NewMapDatastore())
+	if err := p.Pin(ctx, tr.mid.Key(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a direct pin keeps what it links to only through the links GC walks.
+	removed, err := gc.GC(ctx, tr.bs, p, tr.linkFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := make(chan error, 1)
+	go func() { pinned <- p.Pin(ctx, tr.own.Key(), false) }()
+	select {
+	case err := <-pinned:
+		t.Fatalf("expected Pin to wait for the collection, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	n := 0
+	for range removed {
+		n++
+	}
+	if err := <-pinned; err != bstore.ErrNotFound {
+		t.Fatalf("expected the block collected before it was pinned, got %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("expected root, other and own removed, got %d blocks", n)
+	}
+	if has, _ := tr.bs.Has(tr.leaf.Key()); !has {
+		t.Fatal("expected the block linked from a pin kept")
+	}
+}
+
+func TestEvictingKeepsPins(t *testing.T) {
+	ctx := context.Background()
+	for i, guard := range []bool{false, true} {
+		tr := newTree(t)
+		p := tr.pinner(t, ds.NewMapDatastore())
+		// a live view, or no pinned set over a guarded store; room for the new
+		// block leaves only the pinned one.
+		var ev bstore.Blockstore
+		var err error
+		if guard {
+			ev, err = bstore.Evicting(ctx, p.Guard(tr.bs), 9, bstore.NewFIFO(), nil)
+		} else {
+			ev, err = bstore.Evicting(ctx, tr.bs, 9, bstore.NewFIFO(), p.View())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Pin(ctx, tr.root.Key(), false); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ev.Put(blocks.NewBlock([]byte(fmt.Sprintf("new %d", i)))); err != nil {
+			t.Fatal(err)
+		}
+		if has, _ := tr.bs.Has(tr.root.Key()); !has {
+			t.Fatalf("guarded %v: expected a block pinned since kept", guard)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package blockstore
+
+import (
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+)
+
+// PooledDatastore is implemented by datastores that can read a value into a
+// buffer from a blocks.BufferPool. Blockstores made by NewBlockstore over
+// one use it for GetPooled.
+type PooledDatastore interface {
+	// GetPooled returns the value of |k| in a buffer from |p|.Get, or
+	// ds.ErrNotFound.
+	GetPooled(k ds.Key, p *blocks.BufferPool) ([]byte, error)
+}
+
+// PooledGetter is implemented by blockstores that can read blocks into
+// buffers from a blocks.BufferPool. Use GetPooled for the others.
+type PooledGetter interface {
+	GetPooled(k key.Key, p *blocks.BufferPool) (*blocks.Block, error)
+}
+
+// GetPooled returns the block |k|, with its data in a buffer from |p| if
+// |bs| is a PooledGetter, and read with Get otherwise. Either way the block
+// may be released with Block.Release once it is no longer used.
+func GetPooled(bs Blockstore, k key.Key, p *blocks.BufferPool) (*blocks.Block, error) {
+	if pg, ok := bs.(PooledGetter); ok {
+		return pg.GetPooled(k, p)
+	}
+	return bs.Get(k)
+}
+
+// GetPooled reads the block from the datastore into a buffer from |p| if it
+// is a PooledDatastore, and with Get otherwise.
+func (bs *blockstore) GetPooled(k key.Key, p *blocks.BufferPool) (*blocks.Block, error) {
+	pd, ok := bs.root.(PooledDatastore)
+	if !ok {
+		return bs.Get(k)
+	}
+
+	bs.swap.RLock()
+	defer bs.swap.RUnlock()
+	// the namespace wrapper hides GetPooled, so the key is prefixed by hand.
+	data, err := pd.GetPooled(bs.prefix.blocks.Child(k.DsKey()), p)
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := blocks.NewPooledBlock(data, k, p)
+	if err != nil {
+		p.Put(data)
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,131 @@
+package blockstore
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+)
+
+// Quarantiner is implemented by blockstores that can set corrupt blocks aside
+// for inspection instead of deleting them outright.
+type Quarantiner interface {
+	// Quarantine moves the stored value for a key out of the live set.
+	Quarantine(key.Key) error
+	// ListQuarantined returns every quarantined value.
+	ListQuarantined() ([]QuarantinedBlock, error)
+	// PurgeQuarantine permanently discards values quarantined before a
+	// given time, returning how many were removed.
+	PurgeQuarantine(before time.Time) (int, error)
+}
+
+// QuarantinedBlock is a value that was removed from the live set.
+type QuarantinedBlock struct {
+	// Key is the key the value was stored (and requested) under. The value
+	// is presumed not to hash to it.
+	Key key.Key
+	// Time is when the value was quarantined.
+	Time time.Time
+	// Data is the value as it was stored.
+	Data []byte
+}
+
+var _ Quarantiner = &blockstore{}
+
+// Quarantine moves the value stored under |k| to QuarantinePrefix, keyed by
+// |k| and the current time, and removes it from the live set. Quarantined
+// values are invisible to Get, Has and AllKeysChan.
+func (bs *blockstore) Quarantine(k key.Key) error {
+	bs.swap.RLock()
+	defer bs.swap.RUnlock()
+
+	val, err := bs.datastore.Get(k.DsKey())
+	if errors.Is(err, ds.ErrNotFound) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	// the raw value is kept as-is, even if it isn't a []byte; that may well
+	// be the corruption under investigation.
+	if err := bs.quarantine.Put(quarantineKey(k, time.Now()), val); err != nil {
+		return err
+	}
+	return bs.datastore.Delete(k.DsKey())
+}
+
+func (bs *blockstore) ListQuarantined() ([]QuarantinedBlock, error) {
+	var out []QuarantinedBlock
+	err := bs.eachQuarantined(false, func(dsk ds.Key, qb QuarantinedBlock) error {
+		out = append(out, qb)
+		return nil
+	})
+	return out, err
+}
+
+func (bs *blockstore) PurgeQuarantine(before time.Time) (int, error) {
+	// collect first; deleting while a query is running isn't safe on every
+	// datastore.
+	var purge []ds.Key
+	err := bs.eachQuarantined(true, func(dsk ds.Key, qb QuarantinedBlock) error {
+		if qb.Time.Before(before) {
+			purge = append(purge, dsk)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, dsk := range purge {
+		if err := bs.quarantine.Delete(dsk); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return i, err
+		}
+	}
+	return len(purge), nil
+}
+
+// quarantineKey returns the key, relative to QuarantinePrefix, under which
+// |k| is quarantined at |t|. Keys are b58 encoded because raw multihashes may
+// contain path separators.
+func quarantineKey(k key.Key, t time.Time) ds.Key {
+	return ds.KeyWithNamespaces([]string{k.B58String(), strconv.FormatInt(t.UnixNano(), 10)})
+}
+
+func (bs *blockstore) eachQuarantined(keysOnly bool, f func(ds.Key, QuarantinedBlock) error) error {
+	// datastore/namespace does *NOT* fix up Query.Prefix
+	res, err := bs.quarantine.Query(dsq.Query{Prefix: bs.prefix.quarantine.String(), KeysOnly: keysOnly})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	for e := range res.Next() {
+		if e.Error != nil {
+			return e.Error
+		}
+		dsk := ds.NewKey(e.Key)
+		parts := dsk.Namespaces()
+		if len(parts) != 2 {
+			continue // not one of ours.
+		}
+		nanos, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		qb := QuarantinedBlock{
+			Key:  key.B58KeyDecode(parts[0]),
+			Time: time.Unix(0, nanos),
+		}
+		if data, ok := e.Value.([]byte); ok {
+			qb.Data = data
+		}
+		if err := f(dsk, qb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package blockstore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestQuarantine(t *testing.T) {
+	d := ds.NewMapDatastore()
+	bs, keys := newBlockStoreWithKeys(t, d, 3)
+
+	// corrupt one of the blocks behind the blockstore's back.
+	bad := keys[0]
+	if err := d.Put(BlockPrefix.Child(bad.DsKey()), []byte("rotten")); err != nil {
+		t.Fatal(err)
+	}
+
+	q := bs.(Quarantiner)
+	if err := q.Quarantine(bad); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Has(bad); has {
+		t.Fatal("quarantined block is still live")
+	}
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, keys[1:], collect(ch))
+
+	list, err := q.ListQuarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Key != bad || !bytes.Equal(list[0].Data, []byte("rotten")) {
+		t.Fatalf("unexpected quarantine contents: %v", list)
+	}
+
+	if n, err := q.PurgeQuarantine(list[0].Time); err != nil || n != 0 {
+		t.Fatalf("purged entries that weren't old enough: %d, %v", n, err)
+	}
+	if n, err := q.PurgeQuarantine(time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Fatalf("expected one entry purged, got %d, %v", n, err)
+	}
+	if list, _ := q.ListQuarantined(); len(list) != 0 {
+		t.Fatal("quarantine not empty after purge")
+	}
+}
+
+func TestQuarantineMissingBlock(t *testing.T) {
+	bs := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	err := bs.(Quarantiner).Quarantine(blocks.NewBlock([]byte("absent")).Key())
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,328 @@
+package blockstore
+
+import (
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrQuotaExceeded is returned by the writes of a blockstore made by Quota
+// that would take it over its size.
+var ErrQuotaExceeded = errors.New("blockstore: quota exceeded")
+
+// Quota returns a blockstore that keeps the block data stored in |bs| to at
+// most |maxBytes|: a write that would take it over fails with
+// ErrQuotaExceeded, writing nothing. Writes that free space are always
+// allowed, so a store already over its quota can be brought back under it.
+//
+// The usage of |bs| is measured once, with Stat, and after that counted as
+// blocks are written and deleted through the returned blockstore, whose Stat
+// reports the count without reading the store. |bs| must not be written to
+// other than through it. Like ReadOnly, it hides the optional interfaces of
+// |bs|.
+func Quota(ctx context.Context, bs Blockstore, maxBytes uint64) (Blockstore, error) {
+	u, err := Stat(ctx, bs)
+	if err != nil {
+		return nil, err
+	}
+	q := &quota{bs: bs, max: maxBytes, usage: u}
+	if b, ok := bs.(*blockstore); ok {
+		q.disk = b.diskUsage
+	}
+	return q, nil
+}
+
+type quota struct {
+	bs  Blockstore
+	max uint64
+	// disk measures DiskBytes, or is nil.
+	disk func() (uint64, error)
+
+	// mu serializes writes, so that each is checked against the usage
+	// left by the one before.
+	mu    sync.Mutex
+	usage Usage
+
+	// policy, if set, picks blocks to evict when a write does not fit, and
+	// sizes has the size of every stored block for it. See Evicting.
+	policy EvictionPolicy
+	pinned key.KeySet
+	sizes  map[key.Key]int
+}
+
+func (q *quota) Stat(context.Context) (Usage, error) {
+	q.mu.Lock()
+	u := q.usage
+	q.mu.Unlock()
+	if q.disk != nil {
+		disk, err := q.disk()
+		if err != nil {
+			return Usage{}, err
+		}
+		u.DiskBytes = disk
+	}
+	return u, nil
+}
+
+// fits reports whether a write storing |bytes| and freeing |freed| is
+// allowed. q.mu must be held.
+func (q *quota) fits(bytes, freed uint64) bool {
+	return bytes <= freed || q.usage.Bytes+bytes-freed <= q.max
+}
+
+// added accounts for the block |k| of |size| having been stored, and
+// removed for it having been deleted. q.mu must be held.
+func (q *quota) added(k key.Key, size int) {
+	q.usage.Blocks++
+	q.usage.Bytes += uint64(size)
+	if q.policy != nil {
+		q.sizes[k] = size
+		q.policy.Added(k)
+	}
+}
+
+func (q *quota) removed(k key.Key, size int) {
+	q.usage.Blocks--
+	q.usage.Bytes -= uint64(size)
+	if q.policy != nil {
+		delete(q.sizes, k)
+		q.policy.Removed(k)
+	}
+}
+
+// settle accounts for the blocks of |puts| that are now stored and those of
+// |deletes|, with their sizes, that are now gone, after a write that failed
+// part way. q.mu must be held.
+func (q *quota) settle(puts []*blocks.Block, deletes map[key.Key]int) {
+	for _, b := range puts {
+		if has, err := q.bs.Has(b.Key()); err == nil && has {
+			q.added(b.Key(), len(b.Data))
+		}
+	}
+	for k, size := range deletes {
+		if has, err := q.bs.Has(k); err == nil && !has {
+			q.removed(k, size)
+		}
+	}
+}
+
+// unstored returns the blocks of |bs| that are not stored, once each.
+func (q *quota) unstored(bs []*blocks.Block) ([]*blocks.Block, uint64) {
+	seen := make(map[key.Key]struct{}, len(bs))
+	var out []*blocks.Block
+	var bytes uint64
+	for _, b := range bs {
+		k := b.Key()
+		if _, dup := seen[k]; dup {
+			continue
+		}
+		seen[k] = struct{}{}
+		if has, err := q.bs.Has(k); err == nil && has {
+			continue
+		}
+		out = append(out, b)
+		bytes += uint64(len(b.Data))
+	}
+	return out, bytes
+}
+
+// stored returns the sizes of the blocks of |ks| that are stored.
+func (q *quota) stored(ks []key.Key) (map[key.Key]int, uint64, error) {
+	sizes := make(map[key.Key]int, len(ks))
+	var bytes uint64
+	for _, k := range ks {
+		if _, dup := sizes[k]; dup {
+			continue
+		}
+		b, err := q.bs.Get(k)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		sizes[k] = len(b.Data)
+		bytes += uint64(len(b.Data))
+	}
+	return sizes, bytes, nil
+}
+
+func (q *quota) Put(b *blocks.Block) error {
+	return q.PutMany([]*blocks.Block{b})
+}
+
+func (q *quota) PutMany(bs []*blocks.Block) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	puts, bytes := q.unstored(bs)
+	if len(puts) == 0 {
+		return nil
+	}
+	if err := q.makeRoom(bytes, 0, keysOf(bs, nil)); err != nil {
+		return err
+	}
+	if err := q.bs.PutMany(puts); err != nil {
+		q.settle(puts, nil)
+		return err
+	}
+	for _, b := range puts {
+		q.added(b.Key(), len(b.Data))
+	}
+	return nil
+}
+
+func (q *quota) DeleteBlock(k key.Key) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	sizes, _, err := q.stored([]key.Key{k})
+	if err != nil {
+		return err
+	}
+	if err := q.bs.DeleteBlock(k); err != nil {
+		return err
+	}
+	if size, ok := sizes[k]; ok {
+		q.removed(k, size)
+	}
+	return nil
+}
+
+// ApplyBatch checks the space the batch takes against the space it frees.
+func (q *quota) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	gone, freed, err := q.stored(deletes)
+	if err != nil {
+		return err
+	}
+	deleted := make(map[key.Key]struct{}, len(deletes))
+	for _, k := range deletes {
+		deleted[k] = struct{}{}
+	}
+	var kept []*blocks.Block
+	for _, b := range puts {
+		// a block both put and deleted ends up deleted.
+		if _, ok := deleted[b.Key()]; !ok {
+			kept = append(kept, b)
+		}
+	}
+	news, bytes := q.unstored(kept)
+	if err := q.makeRoom(bytes, freed, keysOf(puts, deletes)); err != nil {
+		return err
+	}
+	if err := q.bs.ApplyBatch(ctx, puts, deletes); err != nil {
+		q.settle(news, gone)
+		return err
+	}
+	for _, b := range news {
+		q.added(b.Key(), len(b.Data))
+	}
+	for k, size := range gone {
+		q.removed(k, size)
+	}
+	return nil
+}
+
+// ReplaceAll aborts the replacement, leaving the store as it was, if the
+// blocks from |in| add up to more than the quota.
+func (q *quota) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	counted := make(chan *blocks.Block)
+	errs := make(chan error, 1)
+	var u Usage
+	seen := make(map[key.Key]int)
+	go func() {
+		// |counted| is only closed once |in| is, so that a failure is never
+		// mistaken for the end of the blocks.
+		for b := range in {
+			if _, dup := seen[b.Key()]; !dup {
+				seen[b.Key()] = len(b.Data)
+				u.Blocks++
+				u.Bytes += uint64(len(b.Data))
+				if u.Bytes > q.max {
+					errs <- ErrQuotaExceeded
+					cancel()
+					return
+				}
+			}
+			select {
+			case counted <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+		close(counted)
+	}()
+	err := q.bs.ReplaceAll(ctx, counted)
+	select {
+	case cerr := <-errs:
+		return cerr
+	default:
+	}
+	if err != nil {
+		return err
+	}
+	// |counted| was closed, so the goroutine is done with |u| and |seen|.
+	q.usage = u
+	if q.policy != nil {
+		for k := range q.sizes {
+			q.policy.Removed(k)
+		}
+		q.sizes = seen
+		for k := range seen {
+			q.policy.Added(k)
+		}
+	}
+	return nil
+}
+
+func (q *quota) Has(k key.Key) (bool, error) { return q.bs.Has(k) }
+
+func (q *quota) Get(k key.Key) (*blocks.Block, error) {
+	b, err := q.bs.Get(k)
+	if err == nil && q.policy != nil {
+		q.policy.Accessed(k)
+	}
+	return b, err
+}
+
+func (q *quota) GetChan(ks []key.Key) <-chan *blocks.Block {
+	in := q.bs.GetChan(ks)
+	if q.policy == nil {
+		return in
+	}
+	out := make(chan *blocks.Block, 1)
+	go func() {
+		defer close(out)
+		for b := range in {
+			q.policy.Accessed(b.Key())
+			out <- b
+		}
+	}()
+	return out
+}
+
+func (q *quota) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return q.bs.AllKeysChan(ctx)
+}
+
+func (q *quota) AllKeys(ctx context.Context, query dsq.Query) (<-chan key.Key, error) {
+	return q.bs.AllKeys(ctx, query)
+}
+
+func (q *quota) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	return q.bs.FindOrphanedMetadata(ctx)
+}
+
+func (q *quota) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	return q.bs.PurgeOrphanedMetadata(ctx)
+}
@@ -0,0 +1,97 @@
+package blockstore
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func expectUsage(t *testing.T, bs Blockstore, n, bytes uint64) {
+	u, err := Stat(context.Background(), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Blocks != n || u.Bytes != bytes {
+		t.Fatalf("expected %d blocks of %d bytes, got %+v", n, bytes, u)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	under := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	existing := blocks.NewBlock([]byte("12345"))
+	if err := under.Put(existing); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := Quota(context.Background(), under, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUsage(t, bs, 1, 5)
+
+	fits := blocks.NewBlock([]byte("abcd"))
+	if err := bs.Put(fits); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Put(fits); err != nil {
+		t.Fatal("storing a block again should cost nothing")
+	}
+	expectUsage(t, bs, 2, 9)
+
+	tooBig := blocks.NewBlock([]byte("xy"))
+	if err := bs.Put(tooBig); err != ErrQuotaExceeded {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	expectHas(t, under, tooBig.Key(), false)
+	if err := bs.PutMany([]*blocks.Block{blocks.NewBlock([]byte("z")), tooBig}); err != ErrQuotaExceeded {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	expectUsage(t, bs, 2, 9)
+
+	// freeing space in the same batch makes room.
+	if err := bs.ApplyBatch(context.Background(), []*blocks.Block{tooBig}, []key.Key{existing.Key()}); err != nil {
+		t.Fatal(err)
+	}
+	expectUsage(t, bs, 2, 6)
+
+	if err := bs.DeleteBlock(fits.Key()); err != nil {
+		t.Fatal(err)
+	}
+	expectUsage(t, bs, 1, 2)
+}
+
+func TestQuotaReplaceAll(t *testing.T) {
+	under := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	bs, err := Quota(context.Background(), under, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := blocks.NewBlock([]byte("kept"))
+	if err := bs.Put(kept); err != nil {
+		t.Fatal(err)
+	}
+
+	replace := func(data ...string) error {
+		in := make(chan *blocks.Block, len(data))
+		for _, d := range data {
+			in <- blocks.NewBlock([]byte(d))
+		}
+		close(in)
+		return bs.ReplaceAll(context.Background(), in)
+	}
+	if err := replace("12345", "6789"); err != ErrQuotaExceeded {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	expectHas(t, under, kept.Key(), true)
+	expectUsage(t, bs, 1, 4)
+
+	if err := replace("123", "45678"); err != nil {
+		t.Fatal(err)
+	}
+	expectHas(t, under, kept.Key(), false)
+	expectUsage(t, bs, 2, 8)
+}
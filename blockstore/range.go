@@ -0,0 +1,83 @@
+package blockstore
+
+import (
+	"errors"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+)
+
+// ErrInvalidRange is returned by GetRange for a negative offset or length.
+var ErrInvalidRange = errors.New("blockstore: invalid byte range")
+
+// RangeDatastore is implemented by datastores that can read part of a value
+// without reading all of it. Blockstores made by NewBlockstore over one use
+// it for GetRange.
+type RangeDatastore interface {
+	// GetRange returns up to |length| bytes of the value of |k| from
+	// |offset|, fewer if the value ends first, or ds.ErrNotFound.
+	GetRange(k ds.Key, offset, length int64) ([]byte, error)
+}
+
+// RangeGetter is implemented by blockstores that can read part of a block
+// without reading it whole. Use GetRange for the others.
+type RangeGetter interface {
+	GetRange(k key.Key, offset, length int64) ([]byte, error)
+}
+
+// GetRange returns up to |length| bytes of the data of the block |k| from
+// |offset|, fewer if the block ends first, and none if it ends before
+// |offset|. It asks |bs| if it is a RangeGetter, and otherwise reads the
+// whole block. The data read is not verified against |k|, which needs all
+// of it.
+func GetRange(bs Blockstore, k key.Key, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, ErrInvalidRange
+	}
+	if rg, ok := bs.(RangeGetter); ok {
+		return rg.GetRange(k, offset, length)
+	}
+	b, err := bs.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return sliceRange(b.Data, offset, length), nil
+}
+
+// sliceRange returns the part of |data| GetRange asks for.
+func sliceRange(data []byte, offset, length int64) []byte {
+	if offset >= int64(len(data)) {
+		return []byte{}
+	}
+	data = data[offset:]
+	if length < int64(len(data)) {
+		data = data[:length]
+	}
+	return data
+}
+
+// GetRange reads the range from the datastore if it is a RangeDatastore,
+// and the whole block otherwise.
+func (bs *blockstore) GetRange(k key.Key, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, ErrInvalidRange
+	}
+	rd, ok := bs.root.(RangeDatastore)
+	if !ok {
+		b, err := bs.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		return sliceRange(b.Data, offset, length), nil
+	}
+
+	bs.swap.RLock()
+	defer bs.swap.RUnlock()
+	// the namespace wrapper hides GetRange, so the key is prefixed by hand.
+	data, err := rd.GetRange(bs.prefix.blocks.Child(k.DsKey()), offset, length)
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
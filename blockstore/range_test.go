@@ -0,0 +1,62 @@
+package blockstore
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+)
+
+// rangeDatastore is a map datastore that records the ranges read from it.
+type rangeDatastore struct {
+	ds.ThreadSafeDatastore
+	ranges [][2]int64
+}
+
+func (d *rangeDatastore) GetRange(k ds.Key, offset, length int64) ([]byte, error) {
+	d.ranges = append(d.ranges, [2]int64{offset, length})
+	v, err := d.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return sliceRange(v.([]byte), offset, length), nil
+}
+
+func TestGetRange(t *testing.T) {
+	b := blocks.NewBlock([]byte("0123456789"))
+	for _, d := range []ds.ThreadSafeDatastore{
+		dssync.MutexWrap(ds.NewMapDatastore()),
+		&rangeDatastore{ThreadSafeDatastore: dssync.MutexWrap(ds.NewMapDatastore())},
+	} {
+		bs := NewBlockstore(d)
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			offset, length int64
+			want           string
+		}{
+			{2, 3, "234"},
+			{7, 10, "789"},
+			{10, 1, ""},
+			{0, 0, ""},
+		} {
+			got, err := GetRange(bs, b.Key(), c.offset, c.length)
+			if err != nil || string(got) != c.want {
+				t.Fatalf("range %d+%d read as %q, %v", c.offset, c.length, got, err)
+			}
+		}
+		if _, err := GetRange(bs, b.Key(), -1, 2); err != ErrInvalidRange {
+			t.Fatalf("expected ErrInvalidRange, got %v", err)
+		}
+		missing := blocks.NewBlock([]byte("missing")).Key()
+		if _, err := GetRange(bs, missing, 0, 1); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+		if rd, ok := d.(*rangeDatastore); ok && len(rd.ranges) != 5 {
+			t.Fatalf("expected the ranges to reach the datastore, got %v", rd.ranges)
+		}
+	}
+}
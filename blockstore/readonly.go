@@ -0,0 +1,70 @@
+package blockstore
+
+import (
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrReadOnly is returned by the writes of a blockstore made by ReadOnly.
+var ErrReadOnly = errors.New("blockstore: read-only")
+
+// ReadOnly returns a blockstore that reads from |bs| and rejects every write
+// with ErrReadOnly, for serving a snapshot, or a store another process
+// writes to. It hides the optional interfaces of |bs|, such as
+// MetadataStore, as they can all write.
+func ReadOnly(bs Blockstore) Blockstore {
+	if IsReadOnly(bs) {
+		return bs
+	}
+	return readOnly{bs: bs}
+}
+
+// IsReadOnly reports whether |bs| was made by ReadOnly.
+func IsReadOnly(bs Blockstore) bool {
+	_, ok := bs.(readOnly)
+	return ok
+}
+
+type readOnly struct {
+	bs Blockstore
+}
+
+func (r readOnly) Has(k key.Key) (bool, error)          { return r.bs.Has(k) }
+func (r readOnly) Get(k key.Key) (*blocks.Block, error) { return r.bs.Get(k) }
+
+func (r readOnly) GetChan(ks []key.Key) <-chan *blocks.Block {
+	return r.bs.GetChan(ks)
+}
+
+func (r readOnly) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return r.bs.AllKeysChan(ctx)
+}
+
+func (r readOnly) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	return r.bs.AllKeys(ctx, q)
+}
+
+func (r readOnly) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	return r.bs.FindOrphanedMetadata(ctx)
+}
+
+func (readOnly) DeleteBlock(key.Key) error     { return ErrReadOnly }
+func (readOnly) Put(*blocks.Block) error       { return ErrReadOnly }
+func (readOnly) PutMany([]*blocks.Block) error { return ErrReadOnly }
+
+func (readOnly) ReplaceAll(context.Context, <-chan *blocks.Block) error {
+	return ErrReadOnly
+}
+
+func (readOnly) ApplyBatch(context.Context, []*blocks.Block, []key.Key) error {
+	return ErrReadOnly
+}
+
+func (readOnly) PurgeOrphanedMetadata(context.Context) (int, error) {
+	return 0, ErrReadOnly
+}
@@ -0,0 +1,58 @@
+package blockstore
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestReadOnly(t *testing.T) {
+	under, ks := newBlockStoreWithKeys(t, nil, 3)
+	bs := ReadOnly(under)
+	if !IsReadOnly(bs) || IsReadOnly(under) {
+		t.Fatal("IsReadOnly does not tell the wrapper apart")
+	}
+	if ReadOnly(bs) != bs {
+		t.Fatal("wrapping twice should return the same blockstore")
+	}
+	if _, ok := bs.(MetadataStore); ok {
+		t.Fatal("read-only blockstore exposes metadata writes")
+	}
+
+	if _, err := bs.Get(ks[0]); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(ch); len(got) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(got))
+	}
+
+	b := blocks.NewBlock([]byte("new"))
+	in := make(chan *blocks.Block)
+	close(in)
+	for name, err := range map[string]error{
+		"Put":         bs.Put(b),
+		"PutMany":     bs.PutMany([]*blocks.Block{b}),
+		"DeleteBlock": bs.DeleteBlock(ks[0]),
+		"ReplaceAll":  bs.ReplaceAll(context.Background(), in),
+		"ApplyBatch":  bs.ApplyBatch(context.Background(), nil, []key.Key{ks[1]}),
+	} {
+		if err != ErrReadOnly {
+			t.Errorf("%s: expected ErrReadOnly, got %v", name, err)
+		}
+	}
+	for _, k := range ks {
+		if has, _ := under.Has(k); !has {
+			t.Fatalf("block %s was removed through the read-only wrapper", k)
+		}
+	}
+	if has, _ := under.Has(b.Key()); has {
+		t.Fatal("block was written through the read-only wrapper")
+	}
+}
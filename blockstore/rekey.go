@@ -0,0 +1,175 @@
+package blockstore
+
+import (
+	"errors"
+	"fmt"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// RekeyFunc returns the key a block stored under |k| with |data| is to be
+// stored under instead, which may be |k| itself to leave it where it is. It
+// must return |k| for keys it already returned, so that a Rekey can be run
+// again.
+type RekeyFunc func(k key.Key, data []byte) (key.Key, error)
+
+// ToCidV1 re-keys version 0 keys, bare multihashes, to version 1 Cids of
+// the same multihash, for data in |codec|. Version 1 keys are left alone.
+func ToCidV1(codec key.Codec) RekeyFunc {
+	return func(k key.Key, _ []byte) (key.Key, error) {
+		c, err := k.Cid()
+		if err != nil {
+			return "", err
+		}
+		if c.Version != 0 {
+			return k, nil
+		}
+		return key.NewCidV1(codec, c.Hash).Key(), nil
+	}
+}
+
+// Rehash re-keys blocks to the multihash of their data with the hash
+// function |code|, truncated to |length| bytes, or whole if it is -1, as
+// blocks.NewBlockWithHashType does. The version and codec of keys are kept.
+// Inline keys, whose identity multihash holds the data, are left alone.
+func Rehash(code, length int) RekeyFunc {
+	return func(k key.Key, data []byte) (key.Key, error) {
+		if _, ok := k.InlineData(); ok {
+			return k, nil
+		}
+		c, err := k.Cid()
+		if err != nil {
+			return "", err
+		}
+		h, err := mh.Sum(data, code, length)
+		if err != nil {
+			return "", err
+		}
+		c.Hash = h
+		return c.Key(), nil
+	}
+}
+
+// RekeyProgress is how far a Rekey has got.
+type RekeyProgress struct {
+	Blocks     uint64 // blocks scanned
+	Rekeyed    uint64 // blocks moved to their new key
+	Mismatches uint64 // blocks left in place as they fail verification
+	Done       bool   // set on the last report of a Rekey
+}
+
+// RekeyOptions configures Rekey.
+type RekeyOptions struct {
+	// Progress and ProgressEvery report the progress of the Rekey, as for
+	// VerifyOptions.
+	Progress      func(RekeyProgress)
+	ProgressEvery int
+	// BatchSize is how many blocks are moved by each ApplyBatch (default
+	// 100).
+	BatchSize int
+}
+
+// Rekey moves every block of |bs| to the key |f| returns for it, such as to
+// upgrade a store to another hash function with Rehash, or to version 1
+// Cids with ToCidV1, without exporting and importing its blocks. The new
+// key must verify against the block's data, or the Rekey fails with
+// ErrHashMismatch; blocks whose data does not match their current key are
+// left in place, and counted as Mismatches, rather than given a key that
+// would hide the corruption.
+//
+// Blocks are moved in batches, each writing the blocks under their new keys
+// and deleting the old ones with one ApplyBatch, so that even a blockstore
+// whose batches are not atomic never loses a block. A Rekey stopped by
+// |ctx| or an error can be resumed by running it again: the blocks already
+// moved are skipped, as |f| leaves them where they are. It returns the final
+// progress, which is also reported to opts.Progress.
+func Rekey(ctx context.Context, bs Blockstore, f RekeyFunc, opts RekeyOptions) (p RekeyProgress, err error) {
+	if opts.ProgressEvery <= 0 {
+		opts.ProgressEvery = 1000
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	kctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	keys, err := bs.AllKeysChan(kctx)
+	if err != nil {
+		return p, err
+	}
+
+	var rep *progressReporter
+	if opts.Progress != nil {
+		rep = newProgressReporter(func(p interface{}) { opts.Progress(p.(RekeyProgress)) })
+	}
+	defer func() {
+		if err == nil {
+			p.Done = true
+		}
+		if rep != nil {
+			rep.finish(p)
+		}
+	}()
+
+	var puts []*blocks.Block
+	var dels []key.Key
+	flush := func() error {
+		if len(dels) == 0 {
+			return nil
+		}
+		if err := bs.ApplyBatch(ctx, puts, dels); err != nil {
+			return err
+		}
+		p.Rekeyed += uint64(len(dels))
+		puts, dels = nil, nil
+		return nil
+	}
+	for k := range keys {
+		b, err := bs.Get(k)
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted since it was listed.
+		}
+		if err != nil {
+			return p, err
+		}
+		p.Blocks++
+		if rep != nil && p.Blocks%uint64(opts.ProgressEvery) == 0 {
+			rep.report(p)
+		}
+		if Verify(k, b.Data) != nil {
+			p.Mismatches++
+			continue
+		}
+		nk, err := f(k, b.Data)
+		if err != nil {
+			return p, fmt.Errorf("blockstore: rekeying %s: %w", k, err)
+		}
+		if nk == k {
+			continue
+		}
+		if err := Verify(nk, b.Data); err != nil {
+			return p, err
+		}
+		nb, err := blocks.NewBlockWithKey(b.Data, nk)
+		if err != nil {
+			return p, err
+		}
+		if nb.Key() != nk {
+			return p, fmt.Errorf("blockstore: cannot store a block under %s", nk)
+		}
+		puts = append(puts, nb)
+		dels = append(dels, k)
+		if len(dels) >= opts.BatchSize {
+			if err := flush(); err != nil {
+				return p, err
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return p, err
+	}
+	return p, flush()
+}
@@ -0,0 +1,136 @@
+package blockstore
+
+import (
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestRekeyToCidV1(t *testing.T) {
+	bs := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	var olds []*blocks.Block
+	for i := 0; i < 25; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		olds = append(olds, b)
+	}
+
+	var reports []RekeyProgress
+	p, err := Rekey(context.Background(), bs, ToCidV1(key.Raw), RekeyOptions{
+		Progress:      func(p RekeyProgress) { reports = append(reports, p) },
+		ProgressEvery: 10,
+		BatchSize:     7,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Rekeyed != 25 || !p.Done {
+		t.Fatalf("expected all 25 blocks rekeyed, got %+v", p)
+	}
+	if len(reports) == 0 || reports[len(reports)-1] != p {
+		t.Fatalf("expected the final progress to be reported last, got %+v", reports)
+	}
+	for _, b := range olds {
+		if has, _ := bs.Has(b.Key()); has {
+			t.Fatalf("old key %s is still stored", b.Key())
+		}
+		nk := key.NewCidV1(key.Raw, b.Multihash).Key()
+		got, err := bs.Get(nk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Data) != string(b.Data) {
+			t.Fatalf("block %s has the wrong data", nk)
+		}
+	}
+
+	// running it again finds nothing left to do.
+	p, err = Rekey(context.Background(), bs, ToCidV1(key.Raw), RekeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Rekeyed != 0 || p.Blocks != 25 {
+		t.Fatalf("expected a no-op, got %+v", p)
+	}
+}
+
+func TestRekeyResumes(t *testing.T) {
+	bs := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	var ks []key.Key
+	for i := 0; i < 10; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Key())
+	}
+
+	// fail partway through.
+	n := 0
+	failing := func(k key.Key, data []byte) (key.Key, error) {
+		if n++; n > 4 {
+			return "", fmt.Errorf("interrupted")
+		}
+		return Rehash(mh.SHA2_512, -1)(k, data)
+	}
+	p, err := Rekey(context.Background(), bs, failing, RekeyOptions{BatchSize: 2})
+	if err == nil || p.Done {
+		t.Fatalf("expected the rekey to fail, got %+v", p)
+	}
+	if p.Rekeyed != 4 {
+		t.Fatalf("expected the first two batches written, got %+v", p)
+	}
+
+	p, err = Rekey(context.Background(), bs, Rehash(mh.SHA2_512, -1), RekeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Rekeyed != 6 {
+		t.Fatalf("expected the rest rekeyed, got %+v", p)
+	}
+	keys, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []key.Key
+	for k := range keys {
+		all = append(all, k)
+	}
+	if len(all) != len(ks) {
+		t.Fatalf("expected %d blocks, got %d", len(ks), len(all))
+	}
+	for _, k := range all {
+		h, _ := k.Hash()
+		if dec, err := mh.Decode(h); err != nil || dec.Code != mh.SHA2_512 {
+			t.Fatalf("block %s was not rehashed", k)
+		}
+	}
+}
+
+func TestRekeyLeavesCorruptBlocks(t *testing.T) {
+	d := ds_sync.MutexWrap(ds.NewMapDatastore())
+	bs := NewBlockstore(d)
+	b := blocks.NewBlock([]byte("intact"))
+	if err := d.Put(BlockPrefix.Child(b.Key().DsKey()), []byte("rotten")); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Rekey(context.Background(), bs, Rehash(mh.SHA2_512, -1), RekeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mismatches != 1 || p.Rekeyed != 0 {
+		t.Fatalf("expected the corrupt block left in place, got %+v", p)
+	}
+	if has, _ := bs.Has(b.Key()); !has {
+		t.Fatal("corrupt block was moved")
+	}
+}
@@ -0,0 +1,166 @@
+package blockstore
+
+import (
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ReplaceAll replaces the contents of the blockstore with the blocks read from
+// |in|, which the caller closes to signal the end of the new set.
+//
+// Incoming blocks are first written to a staging namespace (StagingPrefix).
+// Only once |in| has been drained without error are they switched into the
+// live set, and only then are old blocks absent from the new set deleted. If
+// the context is cancelled, or any read or write fails, the live contents are
+// left as they were: each old block is copied to staging before it is
+// deleted, to be put back if the switch-over fails.
+//
+// The switch-over holds an exclusive lock, so readers of this blockstore
+// observe either the old or the new contents, never a mix. AllKeysChan
+// streams do not take that lock. The underlying datastore has no
+// transactions, so a crash during the switch-over may leave the union of
+// both sets; blocks already present are never rewritten, so no block is
+// ever left partially written.
+//
+// Staging costs up to one full extra copy of the new set on disk for the
+// duration of the call: peak usage is roughly twice the old set plus twice
+// the new set, until the staging namespace is cleared.
+func (bs *blockstore) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	bs.replacing.Lock()
+	defer bs.replacing.Unlock()
+
+	// discard anything left behind by an earlier, interrupted call.
+	if err := clearNamespace(bs.staging, bs.prefix.staging); err != nil {
+		return err
+	}
+	defer clearNamespace(bs.staging, bs.prefix.staging)
+
+	incoming := make(map[key.Key]struct{})
+	for {
+		var b *blocks.Block
+		var more bool
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case b, more = <-in:
+		}
+		if !more {
+			break
+		}
+		if b.Lazy() {
+			return blocks.ErrLazyBlock
+		}
+		if err := bs.staging.Put(b.Key().DsKey(), b.Data); err != nil {
+			return err
+		}
+		incoming[b.Key()] = struct{}{}
+	}
+
+	bs.swap.Lock()
+	defer bs.swap.Unlock()
+
+	// the old set is listed before anything changes, so that failing to
+	// list it leaves nothing to undo.
+	old, err := namespaceKeys(bs.datastore, bs.prefix.blocks)
+	if err != nil {
+		return err
+	}
+
+	// copy over the blocks we don't already have, and remember them and the
+	// old blocks deleted, so the switch can be undone if a write fails.
+	var added, removed []ds.Key
+	rollback := func() {
+		for _, dsk := range removed {
+			if data, err := bs.staging.Get(dsk); err == nil {
+				bs.datastore.Put(dsk, data)
+			}
+		}
+		for _, dsk := range added {
+			bs.datastore.Delete(dsk)
+		}
+	}
+	for k := range incoming {
+		dsk := k.DsKey()
+		exists, err := bs.datastore.Has(dsk)
+		if err != nil {
+			rollback()
+			return err
+		}
+		if exists {
+			continue
+		}
+		data, err := bs.staging.Get(dsk)
+		if err != nil {
+			rollback()
+			return err
+		}
+		if err := bs.datastore.Put(dsk, data); err != nil {
+			rollback()
+			return err
+		}
+		added = append(added, dsk)
+	}
+
+	// the new set is now complete; drop whatever isn't part of it, keeping a
+	// copy in staging, where the new set's keys don't clash with it.
+	for _, dsk := range old {
+		if _, keep := incoming[key.KeyFromDsKey(dsk)]; keep {
+			continue
+		}
+		data, err := bs.datastore.Get(dsk)
+		if errors.Is(err, ds.ErrNotFound) {
+			continue
+		}
+		if err == nil {
+			err = bs.staging.Put(dsk, data)
+		}
+		if err == nil {
+			removed = append(removed, dsk)
+			err = bs.datastore.Delete(dsk)
+		}
+		if err != nil && !errors.Is(err, ds.ErrNotFound) {
+			rollback()
+			return err
+		}
+	}
+	return nil
+}
+
+// namespaceKeys lists the keys of |d|, a datastore wrapped in |prefix|.
+func namespaceKeys(d ds.Datastore, prefix ds.Key) ([]ds.Key, error) {
+	// datastore/namespace does *NOT* fix up Query.Prefix
+	res, err := d.Query(dsq.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var out []ds.Key
+	for e := range res.Next() {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		out = append(out, ds.NewKey(e.Key))
+	}
+	return out, nil
+}
+
+// clearNamespace deletes every key of |d|, a datastore wrapped in |prefix|.
+func clearNamespace(d ds.Datastore, prefix ds.Key) error {
+	keys, err := namespaceKeys(d, prefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := d.Delete(k); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
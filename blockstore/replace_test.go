@@ -0,0 +1,173 @@
+package blockstore
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func blockChan(bs ...*blocks.Block) <-chan *blocks.Block {
+	out := make(chan *blocks.Block, len(bs))
+	for _, b := range bs {
+		out <- b
+	}
+	close(out)
+	return out
+}
+
+func TestReplaceAll(t *testing.T) {
+	d := ds.NewMapDatastore()
+	bs, old := newBlockStoreWithKeys(t, d, 10)
+
+	kept := blocks.NewBlock([]byte("some data 3")) // already in the store
+	added := blocks.NewBlock([]byte("brand new"))
+	if err := bs.ReplaceAll(context.Background(), blockChan(kept, added)); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []key.Key{kept.Key(), added.Key()}, collect(ch))
+
+	if has, _ := bs.Has(old[0]); has {
+		t.Fatal("old block survived the replace")
+	}
+	expectStagingEmpty(t, d)
+}
+
+func TestReplaceAllCancelledLeavesOldContents(t *testing.T) {
+	d := ds.NewMapDatastore()
+	bs, old := newBlockStoreWithKeys(t, d, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan *blocks.Block, 1)
+	in <- blocks.NewBlock([]byte("brand new"))
+	cancel() // |in| is never closed, so the new set is never complete.
+
+	if err := bs.ReplaceAll(ctx, in); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, old, collect(ch))
+	expectStagingEmpty(t, d)
+}
+
+// faultyDatastore fails the calls |fail| picks out, by operation and key.
+type faultyDatastore struct {
+	ds.Datastore
+	mu   sync.Mutex
+	fail func(op string, k ds.Key) bool
+}
+
+var errFault = errors.New("injected fault")
+
+func (f *faultyDatastore) faulty(op string, k ds.Key) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fail != nil && f.fail(op, k)
+}
+
+func (f *faultyDatastore) Get(k ds.Key) (interface{}, error) {
+	if f.faulty("get", k) {
+		return nil, errFault
+	}
+	return f.Datastore.Get(k)
+}
+
+func (f *faultyDatastore) Put(k ds.Key, v interface{}) error {
+	if f.faulty("put", k) {
+		return errFault
+	}
+	return f.Datastore.Put(k, v)
+}
+
+func (f *faultyDatastore) Delete(k ds.Key) error {
+	if f.faulty("delete", k) {
+		return errFault
+	}
+	return f.Datastore.Delete(k)
+}
+
+func (f *faultyDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	if f.faulty("query", ds.NewKey(q.Prefix)) {
+		return nil, errFault
+	}
+	return f.Datastore.Query(q)
+}
+
+func TestReplaceAllFailureLeavesOldContents(t *testing.T) {
+	live := func(k ds.Key) bool { return strings.HasPrefix(k.String(), BlockPrefix.String()) }
+	faults := map[string]func(op string, k ds.Key) bool{
+		"listing the old set": func(op string, k ds.Key) bool {
+			return op == "query" && live(k)
+		},
+		"copying a new block": func(op string, k ds.Key) bool {
+			return op == "put" && live(k)
+		},
+		"deleting an old block": func() func(op string, k ds.Key) bool {
+			deletes := 0
+			return func(op string, k ds.Key) bool {
+				if op != "delete" || !live(k) {
+					return false
+				}
+				deletes++
+				return deletes == 2 // once an old block is gone.
+			}
+		}(),
+	}
+	for name, fail := range faults {
+		d := &faultyDatastore{Datastore: ds.NewMapDatastore()}
+		bs, old := newBlockStoreWithKeys(t, d, 10)
+		added := blocks.NewBlock([]byte("brand new"))
+
+		d.mu.Lock()
+		d.fail = fail
+		d.mu.Unlock()
+		if err := bs.ReplaceAll(context.Background(), blockChan(added)); err != errFault {
+			t.Fatalf("%s: expected the fault, got %v", name, err)
+		}
+		d.mu.Lock()
+		d.fail = nil
+		d.mu.Unlock()
+
+		ch, err := bs.AllKeysChan(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectMatches(t, old, collect(ch))
+		for _, k := range old {
+			if _, err := bs.Get(k); err != nil {
+				t.Fatalf("%s: expected %s restored, got %v", name, k, err)
+			}
+		}
+		expectStagingEmpty(t, d)
+	}
+}
+
+func expectStagingEmpty(t *testing.T, d ds.Datastore) {
+	res, err := d.Query(dsq.Query{Prefix: StagingPrefix.String(), KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("staging namespace not cleared: %d entries left", len(entries))
+	}
+}
@@ -0,0 +1,83 @@
+package blockstore
+
+import (
+	"errors"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrNoQuarantine is returned by Scrub when asked to quarantine blocks in a
+// blockstore that is not a Quarantiner.
+var ErrNoQuarantine = errors.New("blockstore: quarantine not supported")
+
+// ScrubAction is what Scrub does with the corrupt blocks it finds.
+type ScrubAction int
+
+const (
+	// ScrubReport only reports corrupt blocks.
+	ScrubReport ScrubAction = iota
+	// ScrubDelete deletes them.
+	ScrubDelete
+	// ScrubQuarantine sets them aside with Quarantiner.Quarantine.
+	ScrubQuarantine
+)
+
+// ScrubOptions configures Scrub.
+type ScrubOptions struct {
+	VerifyOptions
+	Action ScrubAction
+}
+
+// ScrubResult reports a block that failed verification, as VerifyResult
+// does, and what was done about it. Only blocks whose data does not match
+// their key, with Err ErrHashMismatch, are acted on; Action is ScrubReport
+// for the others, and ActionErr the error deleting or quarantining the
+// block, if that failed.
+type ScrubResult struct {
+	Key       key.Key
+	Err       error
+	Action    ScrubAction
+	ActionErr error
+}
+
+// Scrub rehashes every block in |bs|, as VerifyBlockstore does, streaming the
+// ones that fail verification after applying opts.Action to those whose data
+// no longer matches their key, such as after bit rot or a truncated write.
+// It fails with ErrNoQuarantine if opts.Action is ScrubQuarantine and |bs|
+// is not a Quarantiner. The function returned tells a complete scrub from
+// one cut short, as for VerifyBlockstore.
+func Scrub(ctx context.Context, bs Blockstore, opts ScrubOptions) (<-chan ScrubResult, func() error, error) {
+	q, canQuarantine := bs.(Quarantiner)
+	if opts.Action == ScrubQuarantine && !canQuarantine {
+		return nil, nil, ErrNoQuarantine
+	}
+	res, done, err := VerifyBlockstore(ctx, bs, opts.VerifyOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := make(chan ScrubResult)
+	go func() {
+		defer close(out)
+		for r := range res {
+			sr := ScrubResult{Key: r.Key, Err: r.Err}
+			if errors.Is(r.Err, ErrHashMismatch) {
+				sr.Action = opts.Action
+				switch opts.Action {
+				case ScrubDelete:
+					sr.ActionErr = bs.DeleteBlock(r.Key)
+				case ScrubQuarantine:
+					sr.ActionErr = q.Quarantine(r.Key)
+				}
+			}
+			select {
+			case out <- sr:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, done, nil
+}
@@ -0,0 +1,92 @@
+package blockstore
+
+import (
+	"testing"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// corruptStore returns a blockstore of six blocks, two of which hold
+// garbage, and the keys of those.
+func corruptStore(t *testing.T) (Blockstore, map[key.Key]bool) {
+	d := ds.NewMapDatastore()
+	bs, keys := newBlockStoreWithKeys(t, d, 6)
+	corrupt := map[key.Key]bool{keys[1]: true, keys[4]: true}
+	for k := range corrupt {
+		if err := d.Put(BlockPrefix.Child(k.DsKey()), []byte("garbage")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bs, corrupt
+}
+
+func scrub(t *testing.T, bs Blockstore, action ScrubAction) []ScrubResult {
+	res, done, err := Scrub(context.Background(), bs, ScrubOptions{Action: action})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []ScrubResult
+	for r := range res {
+		out = append(out, r)
+	}
+	if err := done(); err != nil {
+		t.Fatalf("scrub cut short: %s", err)
+	}
+	return out
+}
+
+func TestScrubReports(t *testing.T) {
+	bs, corrupt := corruptStore(t)
+	res := scrub(t, bs, ScrubReport)
+	if len(res) != len(corrupt) {
+		t.Fatalf("expected %d corrupt blocks, got %d", len(corrupt), len(res))
+	}
+	for _, r := range res {
+		if !corrupt[r.Key] || r.Err != ErrHashMismatch || r.Action != ScrubReport {
+			t.Fatalf("unexpected result %+v", r)
+		}
+		if has, _ := bs.Has(r.Key); !has {
+			t.Fatal("reporting removed a block")
+		}
+	}
+}
+
+func TestScrubDeletes(t *testing.T) {
+	bs, corrupt := corruptStore(t)
+	for _, r := range scrub(t, bs, ScrubDelete) {
+		if r.Action != ScrubDelete || r.ActionErr != nil {
+			t.Fatalf("unexpected result %+v", r)
+		}
+	}
+	for k := range corrupt {
+		if has, _ := bs.Has(k); has {
+			t.Fatalf("corrupt block %s was not deleted", k)
+		}
+	}
+	if res := scrub(t, bs, ScrubReport); len(res) != 0 {
+		t.Fatalf("expected a clean store, got %v", res)
+	}
+}
+
+func TestScrubQuarantines(t *testing.T) {
+	bs, corrupt := corruptStore(t)
+	for _, r := range scrub(t, bs, ScrubQuarantine) {
+		if r.Action != ScrubQuarantine || r.ActionErr != nil {
+			t.Fatalf("unexpected result %+v", r)
+		}
+	}
+	qs, err := bs.(Quarantiner).ListQuarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qs) != len(corrupt) {
+		t.Fatalf("expected %d quarantined blocks, got %d", len(corrupt), len(qs))
+	}
+
+	if _, _, err := Scrub(context.Background(), ReadOnly(bs), ScrubOptions{Action: ScrubQuarantine}); err != ErrNoQuarantine {
+		t.Fatalf("expected ErrNoQuarantine, got %v", err)
+	}
+}
@@ -0,0 +1,412 @@
+package blockstore
+
+import (
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var (
+	// ErrSnapshotReleased is returned by the reads of a released Snapshot.
+	ErrSnapshotReleased = errors.New("blockstore: snapshot released")
+	// ErrSnapshotsOpen is returned by the ReplaceAll of a blockstore made by
+	// Snapshotting while it has deletes held back for snapshots.
+	ErrSnapshotsOpen = errors.New("blockstore: snapshots are open")
+)
+
+// Snapshotter is implemented by blockstores that can take snapshots, such as
+// those made by Snapshotting.
+type Snapshotter interface {
+	// Snapshot returns a read-only view of the blockstore as it is now,
+	// which must be released.
+	Snapshot() (*Snapshot, error)
+}
+
+// Snapshot is a read-only view of a blockstore frozen at the keys it held
+// when the snapshot was taken: blocks put since are hidden, and blocks
+// deleted since still read, until Release. Its writes fail with
+// ErrReadOnly.
+type Snapshot struct {
+	Blockstore
+	view *snapshotView
+}
+
+// Release ends the snapshot, letting the deletes it held back go through
+// once no other snapshot needs them, and returns the error of those. It may
+// be called more than once.
+func (s *Snapshot) Release() error {
+	return s.view.s.release(s.view)
+}
+
+// Snapshotting returns a blockstore over |bs| that can take Snapshots, for
+// backups or GC that run while it is written to. Snapshots cost nothing to
+// take beyond a copy of the deletes still held back; instead, while any is
+// open, the blockstore journals the keys put to each, and holds deletes
+// back, hiding the blocks rather than removing them, so disk space is only
+// freed once the last snapshot is released. Writes through it are then
+// serialized. Writes made to |bs| directly are not seen by the journal.
+func Snapshotting(bs Blockstore) Blockstore {
+	return &snapshotting{
+		bs:      bs,
+		views:   make(map[*snapshotView]struct{}),
+		deleted: make(map[key.Key]struct{}),
+	}
+}
+
+type snapshotting struct {
+	bs Blockstore
+
+	// mu is held to read, and to write while there is nothing to journal;
+	// otherwise writes hold it exclusively, so each lands between two
+	// reads of a snapshot.
+	mu    sync.RWMutex
+	views map[*snapshotView]struct{}
+	// deleted holds the keys deleted while snapshots were open, still in
+	// bs but hidden from reads through the blockstore.
+	deleted map[key.Key]struct{}
+}
+
+type snapshotView struct {
+	readOnly
+	s *snapshotting
+	// hidden holds the keys in bs that the snapshot does not have: those
+	// deleted when it was taken, and those put since. Guarded by s.mu.
+	hidden   map[key.Key]struct{}
+	released bool
+}
+
+func (s *snapshotting) Snapshot() (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := &snapshotView{
+		readOnly: readOnly{bs: s.bs},
+		s:        s,
+		hidden:   make(map[key.Key]struct{}, len(s.deleted)),
+	}
+	for k := range s.deleted {
+		v.hidden[k] = struct{}{}
+	}
+	s.views[v] = struct{}{}
+	return &Snapshot{Blockstore: v, view: v}, nil
+}
+
+func (s *snapshotting) release(v *snapshotView) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v.released {
+		return nil
+	}
+	v.released = true
+	delete(s.views, v)
+	return s.purgeLocked()
+}
+
+// purgeLocked removes the deleted blocks once no snapshot is open. If that
+// fails, they stay hidden until the next snapshot is released. s.mu must be
+// held exclusively.
+func (s *snapshotting) purgeLocked() error {
+	if len(s.views) > 0 || len(s.deleted) == 0 {
+		return nil
+	}
+	ks := make([]key.Key, 0, len(s.deleted))
+	for k := range s.deleted {
+		ks = append(ks, k)
+	}
+	if err := s.bs.ApplyBatch(context.Background(), nil, ks); err != nil {
+		return err
+	}
+	s.deleted = make(map[key.Key]struct{})
+	return nil
+}
+
+// write runs |direct| if there is nothing to journal, and |journaled|, with
+// s.mu held exclusively, otherwise.
+func (s *snapshotting) write(direct, journaled func() error) error {
+	s.mu.RLock()
+	if len(s.views) == 0 && len(s.deleted) == 0 {
+		defer s.mu.RUnlock()
+		return direct()
+	}
+	s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return journaled()
+}
+
+// putLocked journals |ks| and runs |put|, which stores them: snapshots that
+// don't have them hide them, and once |put| succeeds they are no longer
+// deleted. If it fails, those deleted stay so.
+func (s *snapshotting) putLocked(ks []key.Key, put func() error) error {
+	if len(s.views) > 0 {
+		for _, k := range ks {
+			has, err := s.bs.Has(k)
+			if err != nil {
+				return err
+			}
+			if !has {
+				for v := range s.views {
+					v.hidden[k] = struct{}{}
+				}
+			}
+		}
+	}
+	if err := put(); err != nil {
+		return err
+	}
+	for _, k := range ks {
+		delete(s.deleted, k)
+	}
+	return nil
+}
+
+// deleteLocked holds back the deletes of |ks|, and returns ErrNotFound, as
+// for DeleteBlock, if any isn't stored.
+func (s *snapshotting) deleteLocked(ks []key.Key) error {
+	var err error
+	for _, k := range ks {
+		if _, gone := s.deleted[k]; gone {
+			err = ErrNotFound
+			continue
+		}
+		has, herr := s.bs.Has(k)
+		if herr != nil {
+			return herr
+		}
+		if !has {
+			err = ErrNotFound
+			continue
+		}
+		s.deleted[k] = struct{}{}
+	}
+	// the last snapshot may have been released with nothing to purge yet.
+	if perr := s.purgeLocked(); perr != nil {
+		return perr
+	}
+	return err
+}
+
+func (s *snapshotting) isDeleted(k key.Key) bool {
+	_, ok := s.deleted[k]
+	return ok
+}
+
+func (s *snapshotting) Has(k key.Key) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isDeleted(k) {
+		return false, nil
+	}
+	return s.bs.Has(k)
+}
+
+func (s *snapshotting) Get(k key.Key) (*blocks.Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.isDeleted(k) {
+		return nil, ErrNotFound
+	}
+	return s.bs.Get(k)
+}
+
+func (s *snapshotting) GetChan(ks []key.Key) <-chan *blocks.Block {
+	return getChan(s, ks)
+}
+
+func (s *snapshotting) Put(b *blocks.Block) error {
+	return s.write(func() error {
+		return s.bs.Put(b)
+	}, func() error {
+		return s.putLocked([]key.Key{b.Key()}, func() error {
+			return s.bs.Put(b)
+		})
+	})
+}
+
+func (s *snapshotting) PutMany(bs []*blocks.Block) error {
+	return s.write(func() error {
+		return s.bs.PutMany(bs)
+	}, func() error {
+		ks := make([]key.Key, len(bs))
+		for i, b := range bs {
+			ks[i] = b.Key()
+		}
+		return s.putLocked(ks, func() error {
+			return s.bs.PutMany(bs)
+		})
+	})
+}
+
+func (s *snapshotting) DeleteBlock(k key.Key) error {
+	return s.write(func() error {
+		return s.bs.DeleteBlock(k)
+	}, func() error {
+		return s.deleteLocked([]key.Key{k})
+	})
+}
+
+func (s *snapshotting) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	return s.write(func() error {
+		return s.bs.ApplyBatch(ctx, puts, deletes)
+	}, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		deleted := make(map[key.Key]struct{}, len(deletes))
+		for _, k := range deletes {
+			deleted[k] = struct{}{}
+		}
+		var ps []*blocks.Block
+		var ks []key.Key
+		for _, b := range puts {
+			if _, gone := deleted[b.Key()]; !gone {
+				ps = append(ps, b)
+				ks = append(ks, b.Key())
+			}
+		}
+		if err := s.putLocked(ks, func() error {
+			return s.bs.ApplyBatch(ctx, ps, nil)
+		}); err != nil {
+			return err
+		}
+		if err := s.deleteLocked(deletes); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *snapshotting) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return s.AllKeys(ctx, dsq.Query{})
+}
+
+func (s *snapshotting) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	return filteredKeys(ctx, s.bs, q, func(k key.Key) (bool, error) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return !s.isDeleted(k), nil
+	})
+}
+
+// ReplaceAll fails with ErrSnapshotsOpen while snapshots are open, or their
+// deletes held back, as it would remove the blocks they read.
+func (s *snapshotting) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	return s.write(func() error {
+		return s.bs.ReplaceAll(ctx, in)
+	}, func() error {
+		return ErrSnapshotsOpen
+	})
+}
+
+func (s *snapshotting) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	return s.bs.FindOrphanedMetadata(ctx)
+}
+
+func (s *snapshotting) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	return s.bs.PurgeOrphanedMetadata(ctx)
+}
+
+func (v *snapshotView) Has(k key.Key) (bool, error) {
+	v.s.mu.RLock()
+	defer v.s.mu.RUnlock()
+	if v.released {
+		return false, ErrSnapshotReleased
+	}
+	if _, ok := v.hidden[k]; ok {
+		return false, nil
+	}
+	return v.s.bs.Has(k)
+}
+
+func (v *snapshotView) Get(k key.Key) (*blocks.Block, error) {
+	v.s.mu.RLock()
+	defer v.s.mu.RUnlock()
+	if v.released {
+		return nil, ErrSnapshotReleased
+	}
+	if _, ok := v.hidden[k]; ok {
+		return nil, ErrNotFound
+	}
+	return v.s.bs.Get(k)
+}
+
+func (v *snapshotView) GetChan(ks []key.Key) <-chan *blocks.Block {
+	return getChan(v, ks)
+}
+
+func (v *snapshotView) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return v.AllKeys(ctx, dsq.Query{})
+}
+
+// AllKeys lists the keys of the snapshot, stopping early if it is released,
+// with ErrSnapshotReleased for ListKeys.
+func (v *snapshotView) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	v.s.mu.RLock()
+	released := v.released
+	v.s.mu.RUnlock()
+	if released {
+		return nil, ErrSnapshotReleased
+	}
+	return filteredKeys(ctx, v.s.bs, q, func(k key.Key) (bool, error) {
+		v.s.mu.RLock()
+		defer v.s.mu.RUnlock()
+		if v.released {
+			return false, ErrSnapshotReleased
+		}
+		_, hidden := v.hidden[k]
+		return !hidden, nil
+	})
+}
+
+// getChan is GetChan by Get, skipping the blocks that fail.
+func getChan(bs Blockstore, ks []key.Key) <-chan *blocks.Block {
+	out := make(chan *blocks.Block, 1)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			if b, err := bs.Get(k); err == nil {
+				out <- b
+			}
+		}
+	}()
+	return out
+}
+
+// filteredKeys streams the keys of |bs| selected by |q| that |keep|. The
+// query's Offset and Limit are applied after |keep|, so they count only the
+// keys it keeps. An error from |keep| ends the listing, and is reported to
+// ListKeys.
+func filteredKeys(ctx context.Context, bs Blockstore, q dsq.Query, keep func(key.Key) (bool, error)) (<-chan key.Key, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	in, err := bs.AllKeys(ctx, dsq.Query{Prefix: q.Prefix, Filters: q.Filters, Orders: q.Orders})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	get := func() (key.Key, bool) {
+		k, ok := <-in
+		if !ok {
+			return "", false
+		}
+		kept, err := keep(k)
+		if err != nil {
+			reportListError(ctx, err)
+			return "", false
+		}
+		if !kept {
+			return "", true
+		}
+		return k, true
+	}
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		defer cancel() // ends the query if we stop first.
+		QueryKeys(ctx, out, dsq.Query{Offset: q.Offset, Limit: q.Limit}, get)
+	}()
+	return out, nil
+}
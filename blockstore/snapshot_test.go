@@ -0,0 +1,167 @@
+package blockstore
+
+import (
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	syncds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func snapshotKeys(t *testing.T, bs Blockstore) map[key.Key]bool {
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := make(map[key.Key]bool)
+	for k := range ch {
+		ks[k] = true
+	}
+	return ks
+}
+
+func TestSnapshot(t *testing.T) {
+	under := NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore()))
+	bs := Snapshotting(under)
+	old := blocks.NewBlock([]byte("old"))
+	kept := blocks.NewBlock([]byte("kept"))
+	if err := bs.PutMany([]*blocks.Block{old, kept}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := bs.(Snapshotter).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := blocks.NewBlock([]byte("added"))
+	if err := bs.Put(added); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteBlock(old.Key()); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := bs.Has(old.Key()); has {
+		t.Fatal("expected the delete to be seen through the blockstore")
+	}
+	if got, err := snap.Get(old.Key()); err != nil || string(got.Data) != "old" {
+		t.Fatalf("expected the snapshot to keep the deleted block, got %v", err)
+	}
+	if has, _ := snap.Has(added.Key()); has {
+		t.Fatal("expected the snapshot to hide the block put since")
+	}
+	if ks := snapshotKeys(t, snap); len(ks) != 2 || !ks[old.Key()] || !ks[kept.Key()] {
+		t.Fatalf("unexpected snapshot keys %v", ks)
+	}
+	if ks := snapshotKeys(t, bs); len(ks) != 2 || !ks[added.Key()] || !ks[kept.Key()] {
+		t.Fatalf("unexpected live keys %v", ks)
+	}
+	if err := snap.Put(blocks.NewBlock([]byte("x"))); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err := bs.ReplaceAll(context.Background(), nil); err != ErrSnapshotsOpen {
+		t.Fatalf("expected ErrSnapshotsOpen, got %v", err)
+	}
+
+	if err := snap.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := under.Has(old.Key()); has {
+		t.Fatal("expected the held back delete to go through on release")
+	}
+	if _, err := snap.Get(kept.Key()); err != ErrSnapshotReleased {
+		t.Fatalf("expected ErrSnapshotReleased, got %v", err)
+	}
+}
+
+func TestSnapshotsTakenApart(t *testing.T) {
+	bs := Snapshotting(NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore())))
+	b := blocks.NewBlock([]byte("block"))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	first, err := bs.(Snapshotter).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Release()
+	if err := bs.DeleteBlock(b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	second, err := bs.(Snapshotter).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Release()
+
+	if has, _ := first.Has(b.Key()); !has {
+		t.Fatal("expected the first snapshot to have the block")
+	}
+	if has, _ := second.Has(b.Key()); has {
+		t.Fatal("expected the second snapshot not to have the block deleted before it")
+	}
+	if ks := snapshotKeys(t, second); len(ks) != 0 {
+		t.Fatalf("unexpected keys %v", ks)
+	}
+}
+
+// failingPuts is a blockstore whose Puts fail.
+type failingPuts struct {
+	Blockstore
+}
+
+func (failingPuts) Put(*blocks.Block) error { return errors.New("disk full") }
+
+func TestSnapshotFailedPutStaysDeleted(t *testing.T) {
+	under := NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore()))
+	bs := Snapshotting(failingPuts{under})
+	b := blocks.NewBlock([]byte("block"))
+	if err := under.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := bs.(Snapshotter).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+	if err := bs.DeleteBlock(b.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Put(b); err == nil {
+		t.Fatal("expected the put to fail")
+	}
+	if has, _ := bs.Has(b.Key()); has {
+		t.Fatal("expected the block to stay deleted after a failed put")
+	}
+}
+
+func TestSnapshotListingCutShortByRelease(t *testing.T) {
+	bs := Snapshotting(NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore())))
+	for _, s := range []string{"a", "b", "c"} {
+		if err := bs.Put(blocks.NewBlock([]byte(s))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := bs.(Snapshotter).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, listed, err := ListKeys(context.Background(), snap, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ks
+	if err := snap.Release(); err != nil {
+		t.Fatal(err)
+	}
+	for range ks {
+	}
+	if err := listed(); err != ErrSnapshotReleased {
+		t.Fatalf("expected ErrSnapshotReleased, got %v", err)
+	}
+}
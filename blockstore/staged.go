@@ -0,0 +1,75 @@
+package blockstore
+
+import (
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// staged holds the writes a Batch or a Transaction has yet to apply: the
+// blocks put, in the order given, and the keys deleted. A key deleted after
+// it was put is no longer put, and one put after it was deleted no longer
+// deleted, so that the writes apply as if made in order.
+type staged struct {
+	order   []*blocks.Block // nil where the block was since deleted
+	puts    map[key.Key]int // the index in order of each block put
+	deletes map[key.Key]struct{}
+	bytes   int // of the data of the blocks put
+}
+
+func newStaged() staged {
+	return staged{
+		puts:    make(map[key.Key]int),
+		deletes: make(map[key.Key]struct{}),
+	}
+}
+
+// put stages storing |b|. A block already put keeps its place.
+func (s *staged) put(b *blocks.Block) {
+	k := b.Key()
+	delete(s.deletes, k)
+	if _, dup := s.puts[k]; dup {
+		return
+	}
+	s.puts[k] = len(s.order)
+	s.order = append(s.order, b)
+	s.bytes += len(b.Data)
+}
+
+// del stages removing |k|, taking back a put of it.
+func (s *staged) del(k key.Key) {
+	if i, ok := s.puts[k]; ok {
+		s.bytes -= len(s.order[i].Data)
+		s.order[i] = nil
+		delete(s.puts, k)
+	}
+	s.deletes[k] = struct{}{}
+}
+
+// get returns the block put as |k|, if any, and whether |k| was deleted.
+func (s *staged) get(k key.Key) (b *blocks.Block, deleted bool) {
+	if i, ok := s.puts[k]; ok {
+		return s.order[i], false
+	}
+	_, deleted = s.deletes[k]
+	return nil, deleted
+}
+
+// len is how many writes are staged.
+func (s *staged) len() int {
+	return len(s.puts) + len(s.deletes)
+}
+
+// writes returns the staged writes, as ApplyBatch takes them.
+func (s *staged) writes() ([]*blocks.Block, []key.Key) {
+	puts := make([]*blocks.Block, 0, len(s.puts))
+	for _, b := range s.order {
+		if b != nil {
+			puts = append(puts, b)
+		}
+	}
+	deletes := make([]key.Key, 0, len(s.deletes))
+	for k := range s.deletes {
+		deletes = append(deletes, k)
+	}
+	return puts, deletes
+}
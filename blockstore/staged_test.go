@@ -0,0 +1,39 @@
+package blockstore
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+)
+
+func TestStagedOrder(t *testing.T) {
+	a, b := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("b"))
+	s := newStaged()
+	s.put(a)
+	s.put(b)
+	s.put(a)
+	s.del(a.Key())
+	s.put(a)
+
+	puts, deletes := s.writes()
+	if len(puts) != 2 || puts[0] != b || puts[1] != a {
+		t.Fatalf("expected b, then a put again after its delete, got %v", puts)
+	}
+	if len(deletes) != 0 {
+		t.Fatalf("expected the delete taken back, got %v", deletes)
+	}
+	if s.bytes != len(a.Data)+len(b.Data) {
+		t.Fatalf("expected %d bytes staged, got %d", len(a.Data)+len(b.Data), s.bytes)
+	}
+
+	s.del(b.Key())
+	if got, deleted := s.get(b.Key()); got != nil || !deleted {
+		t.Fatal("expected b deleted")
+	}
+	if got, _ := s.get(a.Key()); got != a {
+		t.Fatal("expected a put")
+	}
+	if n := s.len(); n != 2 {
+		t.Fatalf("expected 2 writes staged, got %d", n)
+	}
+}
@@ -0,0 +1,70 @@
+package blockstore
+
+import (
+	"errors"
+	"io"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+)
+
+// StreamDatastore is implemented by datastores that can read a value as a
+// stream, without holding all of it in memory. Blockstores made by
+// NewBlockstore over one use it for GetStream.
+type StreamDatastore interface {
+	// GetStream returns a reader of the value of |k|, and its length, or
+	// -1 if that is not known, or ds.ErrNotFound.
+	GetStream(k ds.Key) (io.ReadCloser, int64, error)
+}
+
+// Streamer is implemented by blockstores that can return blocks whose data
+// is read lazily, as made by blocks.NewLazyBlock. Use GetStream for the
+// others.
+type Streamer interface {
+	GetStream(k key.Key) (*blocks.Block, error)
+}
+
+// GetStream returns the block |k|, whose data is to be read with
+// Block.Reader. It asks |bs| if it is a Streamer, and otherwise reads the
+// whole block with Get. Either way the data is not verified against |k|
+// as it is streamed.
+func GetStream(bs Blockstore, k key.Key) (*blocks.Block, error) {
+	if s, ok := bs.(Streamer); ok {
+		return s.GetStream(k)
+	}
+	return bs.Get(k)
+}
+
+// GetStream returns a lazy block if the datastore is a StreamDatastore, and
+// reads the whole block otherwise. The stream opened to find the block's
+// size is closed, and each Reader opens its own, so a block dropped unread
+// holds nothing open; one deleted in between is then missing.
+func (bs *blockstore) GetStream(k key.Key) (*blocks.Block, error) {
+	sd, ok := bs.root.(StreamDatastore)
+	if !ok {
+		return bs.Get(k)
+	}
+	// the namespace wrapper hides GetStream, so the key is prefixed by hand.
+	dk := bs.prefix.blocks.Child(k.DsKey())
+	open := func() (io.ReadCloser, int64, error) {
+		bs.swap.RLock()
+		defer bs.swap.RUnlock()
+		rc, size, err := sd.GetStream(dk)
+		if errors.Is(err, ds.ErrNotFound) {
+			err = ErrNotFound
+		}
+		return rc, size, err
+	}
+
+	rc, size, err := open()
+	if err != nil {
+		return nil, err
+	}
+	rc.Close()
+	return blocks.NewLazyBlock(k, size, func() (io.ReadCloser, error) {
+		rc, _, err := open()
+		return rc, err
+	})
+}
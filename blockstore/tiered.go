@@ -0,0 +1,224 @@
+package blockstore
+
+import (
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Tiered returns a blockstore made of |tiers|, fastest first. Reads try each
+// tier in turn, and new blocks are written to the first tier only; a block
+// already stored in any tier is not written again. Deletes apply to every
+// tier. Blocks are never moved between tiers.
+func Tiered(tiers []Blockstore) (Blockstore, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("blockstore: Tiered needs at least one tier")
+	}
+	return &tiered{tiers: append([]Blockstore(nil), tiers...)}, nil
+}
+
+type tiered struct {
+	tiers []Blockstore
+}
+
+// DeleteBlock deletes |k| from every tier holding it. It returns ErrNotFound
+// if none does.
+func (t *tiered) DeleteBlock(k key.Key) error {
+	deleted := false
+	for _, bs := range t.tiers {
+		switch err := bs.DeleteBlock(k); {
+		case err == nil:
+			deleted = true
+		case errors.Is(err, ErrNotFound), errors.Is(err, ds.ErrNotFound):
+		default:
+			return err
+		}
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (t *tiered) Has(k key.Key) (bool, error) {
+	for _, bs := range t.tiers {
+		has, err := bs.Has(k)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+func (t *tiered) Get(k key.Key) (*blocks.Block, error) {
+	for _, bs := range t.tiers {
+		b, err := bs.Get(k)
+		if !errors.Is(err, ErrNotFound) {
+			return b, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (t *tiered) GetChan(ks []key.Key) <-chan *blocks.Block {
+	out := make(chan *blocks.Block, 1)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			b, err := t.Get(k)
+			if err != nil {
+				continue
+			}
+			out <- b
+		}
+	}()
+	return out
+}
+
+func (t *tiered) Put(b *blocks.Block) error {
+	has, err := t.Has(b.Key())
+	if err == nil && has {
+		return nil // already stored.
+	}
+	return t.tiers[0].Put(b)
+}
+
+func (t *tiered) PutMany(bs []*blocks.Block) error {
+	var toPut []*blocks.Block
+	for _, b := range bs {
+		if has, err := t.Has(b.Key()); err == nil && has {
+			continue // already stored.
+		}
+		toPut = append(toPut, b)
+	}
+	return t.tiers[0].PutMany(toPut)
+}
+
+func (t *tiered) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return t.AllKeys(ctx, dsq.Query{})
+}
+
+// AllKeys applies |q| to the union of the tiers' keys, each key counted
+// once however many tiers hold it. Telling the copies apart takes a set of
+// every key sent, kept until the query is done.
+func (t *tiered) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	// the tiers filter; offsets, limits and orders only make sense over the
+	// union. The tiers are stopped when we are.
+	tctx, cancel := context.WithCancel(ctx)
+	tq := dsq.Query{Prefix: q.Prefix, Filters: q.Filters}
+	var ins []<-chan key.Key
+	for _, bs := range t.tiers {
+		in, err := bs.AllKeys(tctx, tq)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		ins = append(ins, in)
+	}
+
+	seen := make(map[key.Key]struct{})
+	get := func() (key.Key, bool) {
+		for len(ins) > 0 {
+			k, ok := <-ins[0]
+			if !ok {
+				ins = ins[1:]
+				continue
+			}
+			if _, dup := seen[k]; dup {
+				return "", true
+			}
+			seen[k] = struct{}{}
+			return k, true
+		}
+		return "", false
+	}
+
+	output := make(chan key.Key)
+	go func() {
+		defer close(output)
+		defer cancel()
+
+		QueryKeys(ctx, output, q, get)
+	}()
+	return output, nil
+}
+
+// ReplaceAll replaces the contents of the first tier with the blocks from
+// |in|, then empties the others. Each tier is replaced atomically, but not
+// all of them at once: until the others are emptied, their blocks remain
+// visible alongside the new ones.
+func (t *tiered) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	if err := t.tiers[0].ReplaceAll(ctx, in); err != nil {
+		return err
+	}
+	empty := make(chan *blocks.Block)
+	close(empty)
+	for _, bs := range t.tiers[1:] {
+		if err := bs.ReplaceAll(ctx, empty); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyBatch stores |puts| in the first tier and removes |deletes| from it
+// as one operation, then removes |deletes| from the other tiers.
+func (t *tiered) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	if err := t.tiers[0].ApplyBatch(ctx, puts, deletes); err != nil {
+		return err
+	}
+	if len(deletes) == 0 {
+		return nil
+	}
+	for _, bs := range t.tiers[1:] {
+		if err := bs.ApplyBatch(ctx, nil, deletes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindOrphanedMetadata streams the orphaned metadata of each tier in turn.
+// A key may be sent once per tier.
+func (t *tiered) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	var ins []<-chan key.Key
+	for _, bs := range t.tiers {
+		in, err := bs.FindOrphanedMetadata(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ins = append(ins, in)
+	}
+	out := make(chan key.Key)
+	go func() {
+		defer close(out)
+		for _, in := range ins {
+			for k := range in {
+				select {
+				case out <- k:
+				case <-ctx.Done():
+					// the tiers stop sending with |ctx|.
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (t *tiered) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	total := 0
+	for _, bs := range t.tiers {
+		n, err := bs.PurgeOrphanedMetadata(ctx)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,77 @@
+package blockstore
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestTiered(t *testing.T) {
+	hot := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	cold, coldKeys := newBlockStoreWithKeys(t, nil, 5)
+	bs, err := Tiered([]Blockstore{hot, cold})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reads fall back to the cold tier.
+	if _, err := bs.Get(coldKeys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.Get(blocks.NewBlock([]byte("nowhere")).Key()); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// new blocks go to the hot tier, and cold blocks stay put.
+	b := blocks.NewBlock([]byte("new block"))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := hot.Has(b.Key()); !has {
+		t.Fatal("new block not written to the first tier")
+	}
+	coldBlock, _ := cold.Get(coldKeys[1])
+	if err := bs.Put(coldBlock); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := hot.Has(coldKeys[1]); has {
+		t.Fatal("block already in a lower tier was copied to the first")
+	}
+
+	// a block in both tiers is listed once, and deleted from both.
+	if err := hot.Put(coldBlock); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(ch); len(got) != 6 {
+		t.Fatalf("expected 6 distinct keys, got %d", len(got))
+	}
+	ch, _ = bs.AllKeys(context.Background(), dsq.Query{Offset: 1, Limit: 3})
+	if got := collect(ch); len(got) != 3 {
+		t.Fatalf("expected a page of 3 keys, got %d", len(got))
+	}
+
+	if err := bs.DeleteBlock(coldKeys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Has(coldKeys[1]); has {
+		t.Fatal("block left in a tier after delete")
+	}
+	if err := bs.DeleteBlock(coldKeys[1]); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound deleting a missing block, got %v", err)
+	}
+}
+
+func TestTieredNeedsATier(t *testing.T) {
+	if _, err := Tiered(nil); err == nil {
+		t.Fatal("expected an error without tiers")
+	}
+}
@@ -0,0 +1,138 @@
+package blockstore
+
+import (
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var ErrTransactionDone = errors.New("blockstore: transaction already committed or discarded")
+
+// Transaction is a view of a blockstore in which Puts and Deletes are staged,
+// and seen by the transaction's own reads, until Commit writes them all with
+// one ApplyBatch, or Discard drops them. A DAG import that fails part way
+// then leaves nothing behind, where the blockstore's ApplyBatch is atomic.
+//
+// Only the transaction's writes are isolated: its reads of what it has not
+// written see the blockstore as it is, writes by others included, and
+// Commit does not check for conflicting ones. A read-only transaction
+// rejects writes with ErrReadOnly. A Transaction is safe for concurrent use.
+type Transaction struct {
+	bs       Blockstore
+	readOnly bool
+
+	mu     sync.Mutex
+	staged staged
+	done   bool
+}
+
+// NewTransaction returns a Transaction over |bs|, writing nothing if
+// |readOnly| or if |bs| was made by ReadOnly.
+func NewTransaction(bs Blockstore, readOnly bool) *Transaction {
+	return &Transaction{
+		bs:       bs,
+		readOnly: readOnly || IsReadOnly(bs),
+		staged:   newStaged(),
+	}
+}
+
+// Get returns the block |k| as Put in the transaction, ErrNotFound if it was
+// Deleted in it, and otherwise as stored.
+func (t *Transaction) Get(k key.Key) (*blocks.Block, error) {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return nil, ErrTransactionDone
+	}
+	b, deleted := t.staged.get(k)
+	t.mu.Unlock()
+	switch {
+	case b != nil:
+		return b, nil
+	case deleted:
+		return nil, ErrNotFound
+	}
+	return t.bs.Get(k)
+}
+
+// Has is Get, without the block.
+func (t *Transaction) Has(k key.Key) (bool, error) {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return false, ErrTransactionDone
+	}
+	b, deleted := t.staged.get(k)
+	t.mu.Unlock()
+	switch {
+	case b != nil:
+		return true, nil
+	case deleted:
+		return false, nil
+	}
+	return t.bs.Has(k)
+}
+
+// Put stages storing |b|.
+func (t *Transaction) Put(b *blocks.Block) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.writableLocked(); err != nil {
+		return err
+	}
+	t.staged.put(b)
+	return nil
+}
+
+// Delete stages removing |k|. As for ApplyBatch, deleting a key that isn't
+// stored is not an error.
+func (t *Transaction) Delete(k key.Key) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.writableLocked(); err != nil {
+		return err
+	}
+	t.staged.del(k)
+	return nil
+}
+
+func (t *Transaction) writableLocked() error {
+	if t.done {
+		return ErrTransactionDone
+	}
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Commit writes the staged Puts, in the order they were first Put since they
+// were last Deleted, and Deletes with one
+// ApplyBatch. Whether or not it succeeds, the transaction is then done; a
+// failed Commit leaves the blockstore as ApplyBatch does.
+func (t *Transaction) Commit(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTransactionDone
+	}
+	t.done = true
+	if t.staged.len() == 0 {
+		return nil
+	}
+	puts, deletes := t.staged.writes()
+	return t.bs.ApplyBatch(ctx, puts, deletes)
+}
+
+// Discard drops the staged writes. Discarding a transaction already done
+// does nothing, so it may be deferred.
+func (t *Transaction) Discard() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done = true
+	t.staged = staged{}
+}
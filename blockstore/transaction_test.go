@@ -0,0 +1,88 @@
+package blockstore
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	syncds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestTransactionCommit(t *testing.T) {
+	bs := NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore()))
+	old := blocks.NewBlock([]byte("old"))
+	if err := bs.Put(old); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := NewTransaction(bs, false)
+	b := blocks.NewBlock([]byte("new"))
+	if err := txn.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete(old.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := txn.Has(b.Key()); !has {
+		t.Fatal("expected the transaction to see its put")
+	}
+	if _, err := txn.Get(old.Key()); err != ErrNotFound {
+		t.Fatalf("expected the transaction to see its delete, got %v", err)
+	}
+	if has, _ := bs.Has(b.Key()); has {
+		t.Fatal("expected the put to stay staged until commit")
+	}
+	if has, _ := bs.Has(old.Key()); !has {
+		t.Fatal("expected the delete to stay staged until commit")
+	}
+
+	if err := txn.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Has(b.Key()); !has {
+		t.Fatal("expected the put to be committed")
+	}
+	if has, _ := bs.Has(old.Key()); has {
+		t.Fatal("expected the delete to be committed")
+	}
+	if err := txn.Put(b); err != ErrTransactionDone {
+		t.Fatalf("expected ErrTransactionDone, got %v", err)
+	}
+}
+
+func TestTransactionDiscard(t *testing.T) {
+	bs := NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore()))
+	txn := NewTransaction(bs, false)
+	b := blocks.NewBlock([]byte("discarded"))
+	if err := txn.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	txn.Discard()
+	if err := txn.Commit(context.Background()); err != ErrTransactionDone {
+		t.Fatalf("expected ErrTransactionDone, got %v", err)
+	}
+	if has, _ := bs.Has(b.Key()); has {
+		t.Fatal("expected a discarded put not to be stored")
+	}
+}
+
+func TestTransactionReadOnly(t *testing.T) {
+	bs := NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore()))
+	b := blocks.NewBlock([]byte("stored"))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, txn := range []*Transaction{NewTransaction(bs, true), NewTransaction(ReadOnly(bs), false)} {
+		if got, err := txn.Get(b.Key()); err != nil || string(got.Data) != "stored" {
+			t.Fatalf("expected to read the stored block, got %v", err)
+		}
+		if err := txn.Put(blocks.NewBlock([]byte("x"))); err != ErrReadOnly {
+			t.Fatalf("expected ErrReadOnly, got %v", err)
+		}
+		if err := txn.Delete(b.Key()); err != ErrReadOnly {
+			t.Fatalf("expected ErrReadOnly, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package blockstore
+
+import (
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// transformed is a blockstore storing encoded block data in another, as the
+// Compressed and Encrypted blockstores do. Keys are left as they are.
+type transformed struct {
+	bs Blockstore
+	// encode returns the value to store for the data of the block |k|, and
+	// decode turns it back.
+	encode func(k key.Key, data []byte) ([]byte, error)
+	decode func(k key.Key, stored []byte) ([]byte, error)
+}
+
+func (t *transformed) encodeBlock(b *blocks.Block) (*blocks.Block, error) {
+	stored, err := t.encode(b.Key(), b.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &blocks.Block{Multihash: b.Multihash, Codec: b.Codec, Data: stored}, nil
+}
+
+func (t *transformed) decodeBlock(k key.Key, stored []byte) (*blocks.Block, error) {
+	data, err := t.decode(k, stored)
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithKey(data, k)
+}
+
+func (t *transformed) encodeAll(bs []*blocks.Block) ([]*blocks.Block, error) {
+	out := make([]*blocks.Block, len(bs))
+	for i, b := range bs {
+		e, err := t.encodeBlock(b)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = e
+	}
+	return out, nil
+}
+
+func (t *transformed) Get(k key.Key) (*blocks.Block, error) {
+	b, err := t.bs.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return t.decodeBlock(k, b.Data)
+}
+
+func (t *transformed) GetChan(ks []key.Key) <-chan *blocks.Block {
+	out := make(chan *blocks.Block, 1)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			b, err := t.Get(k)
+			if err != nil {
+				continue
+			}
+			out <- b
+		}
+	}()
+	return out
+}
+
+func (t *transformed) Has(k key.Key) (bool, error) {
+	return t.bs.Has(k)
+}
+
+func (t *transformed) Put(b *blocks.Block) error {
+	if err := checkPuts([]*blocks.Block{b}); err != nil {
+		return err
+	}
+	if has, err := t.bs.Has(b.Key()); err == nil && has {
+		return nil // already stored; don't encode it again.
+	}
+	e, err := t.encodeBlock(b)
+	if err != nil {
+		return err
+	}
+	return t.bs.Put(e)
+}
+
+func (t *transformed) PutMany(bs []*blocks.Block) error {
+	if err := checkPuts(bs); err != nil {
+		return err
+	}
+	es, err := t.encodeAll(bs)
+	if err != nil {
+		return err
+	}
+	return t.bs.PutMany(es)
+}
+
+func (t *transformed) DeleteBlock(k key.Key) error {
+	return t.bs.DeleteBlock(k)
+}
+
+func (t *transformed) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return t.bs.AllKeysChan(ctx)
+}
+
+func (t *transformed) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	return t.bs.AllKeys(ctx, q)
+}
+
+// ReplaceAll encodes the blocks from |in| on their way to the underlying
+// blockstore's ReplaceAll. A block failing to encode aborts the replacement.
+func (t *transformed) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	encoded := make(chan *blocks.Block)
+	errs := make(chan error, 1)
+	go func() {
+		// |encoded| is only closed once |in| is, so that a failure is never
+		// mistaken for the end of the blocks.
+		for b := range in {
+			err := checkPuts([]*blocks.Block{b})
+			var e *blocks.Block
+			if err == nil {
+				e, err = t.encodeBlock(b)
+			}
+			if err != nil {
+				errs <- err
+				cancel()
+				return
+			}
+			select {
+			case encoded <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		close(encoded)
+	}()
+	err := t.bs.ReplaceAll(ctx, encoded)
+	select {
+	case cerr := <-errs:
+		return cerr
+	default:
+		return err
+	}
+}
+
+func (t *transformed) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	if err := checkPuts(puts); err != nil {
+		return err
+	}
+	es, err := t.encodeAll(puts)
+	if err != nil {
+		return err
+	}
+	return t.bs.ApplyBatch(ctx, es, deletes)
+}
+
+func (t *transformed) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	return t.bs.FindOrphanedMetadata(ctx)
+}
+
+func (t *transformed) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	return t.bs.PurgeOrphanedMetadata(ctx)
+}
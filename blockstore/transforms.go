@@ -0,0 +1,210 @@
+package blockstore
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// Transform is a reversible encoding of block data, such as compression or
+// encryption, for Transformed blockstores. Implementations must be safe for
+// concurrent use.
+type Transform interface {
+	// Encode returns the value to store for the data of the block |k|.
+	Encode(k key.Key, data []byte) ([]byte, error)
+	// Decode turns a value Encode returned back into the data of |k|.
+	Decode(k key.Key, stored []byte) ([]byte, error)
+}
+
+// CompressTransform returns a Transform compressing with |c|, as Compressed
+// blockstores do.
+func CompressTransform(c Compressor) Transform {
+	z := compressor{c}
+	return funcTransform{z.encode, z.decode}
+}
+
+// EncryptTransform returns a Transform sealing with |aead|, as Encrypted
+// blockstores do.
+func EncryptTransform(aead cipher.AEAD) Transform {
+	s := sealer{aead}
+	return funcTransform{s.seal, s.open}
+}
+
+type funcTransform struct {
+	encode, decode func(key.Key, []byte) ([]byte, error)
+}
+
+func (f funcTransform) Encode(k key.Key, data []byte) ([]byte, error)   { return f.encode(k, data) }
+func (f funcTransform) Decode(k key.Key, stored []byte) ([]byte, error) { return f.decode(k, stored) }
+
+var (
+	// ErrTransformRegistered is returned by TransformRegistry.Register for a
+	// name already taken.
+	ErrTransformRegistered = errors.New("blockstore: transform already registered")
+	// ErrTransformName is returned by TransformRegistry.Register for an empty
+	// name, or one containing a comma.
+	ErrTransformName = errors.New("blockstore: invalid transform name")
+)
+
+// UnknownTransformError is returned by Transformed blockstores for a block
+// written with a transform their registry does not have, and by Transformed
+// for a name it does not have.
+type UnknownTransformError struct {
+	Name string
+}
+
+func (e *UnknownTransformError) Error() string {
+	return fmt.Sprintf("blockstore: unknown transform %q", e.Name)
+}
+
+// TransformRegistry names Transforms, so that the blocks of a store can
+// record the ones they were written with. A name must keep meaning the same
+// Transform, one with the same key for encryption, for as long as blocks
+// written with it are stored.
+type TransformRegistry struct {
+	mu     sync.RWMutex
+	byName map[string]Transform
+}
+
+// NewTransformRegistry returns an empty TransformRegistry.
+func NewTransformRegistry() *TransformRegistry {
+	return &TransformRegistry{byName: make(map[string]Transform)}
+}
+
+// Register adds |t| under |name|, which must not contain a comma.
+func (r *TransformRegistry) Register(name string, t Transform) error {
+	if name == "" || strings.Contains(name, ",") {
+		return ErrTransformName
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byName[name]; ok {
+		return ErrTransformRegistered
+	}
+	r.byName[name] = t
+	return nil
+}
+
+// Lookup returns the Transform registered under |name|, if any.
+func (r *TransformRegistry) Lookup(name string) (Transform, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.byName[name]
+	return t, ok
+}
+
+// chain returns the Transforms named by |names|, in order.
+func (r *TransformRegistry) chain(names []string) ([]Transform, error) {
+	ts := make([]Transform, len(names))
+	for i, name := range names {
+		t, ok := r.Lookup(name)
+		if !ok {
+			return nil, &UnknownTransformError{Name: name}
+		}
+		ts[i] = t
+	}
+	return ts, nil
+}
+
+// transformsKind is the metadata kind recording the names of the transforms
+// a block was written with, comma separated, in the order applied.
+const transformsKind = "transforms"
+
+// Transformed returns a blockstore that stores block data in |bs| encoded
+// with the transforms |names| of |reg|, applied in order, such as
+// compressing then encrypting. |bs| must be a MetadataStore: the names are
+// recorded as metadata of each block, and the transforms recorded for a
+// block are undone in reverse order to read it, so that a store written
+// with different transforms over time, or with none before, still serves
+// every block. A block without a record is stored as is.
+//
+// A block already stored keeps the transforms it was written with, even if
+// put again. Deleting a block leaves its record, for PurgeOrphanedMetadata.
+// As with Compressed, |bs| must not be verified or read directly.
+func Transformed(bs Blockstore, reg *TransformRegistry, names ...string) (Blockstore, error) {
+	ms, ok := bs.(MetadataStore)
+	if !ok {
+		return nil, ErrNoMetadata
+	}
+	chain, err := reg.chain(names)
+	if err != nil {
+		return nil, err
+	}
+	p := &pipeline{bs: bs, ms: ms, reg: reg, names: strings.Join(names, ","), chain: chain}
+	return &transformed{bs: bs, encode: p.encode, decode: p.decode}, nil
+}
+
+type pipeline struct {
+	bs  Blockstore
+	ms  MetadataStore
+	reg *TransformRegistry
+	// names is the record of |chain|, the transforms new blocks are
+	// written with.
+	names string
+	chain []Transform
+}
+
+// recorded returns the transforms recorded for |k|, and whether there is a
+// record.
+func (p *pipeline) recorded(k key.Key) ([]Transform, bool, error) {
+	v, err := p.ms.GetMetadata(transformsKind, k)
+	if errors.Is(err, ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(v) == 0 {
+		return nil, true, nil
+	}
+	chain, err := p.reg.chain(strings.Split(string(v), ","))
+	return chain, true, err
+}
+
+func (p *pipeline) encode(k key.Key, data []byte) ([]byte, error) {
+	chain, ok, err := p.recorded(k)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// a block stored without a record is kept as is, and a put of it
+		// is skipped, so it must be encoded as it is stored.
+		has, err := p.bs.Has(k)
+		if err != nil {
+			return nil, err
+		}
+		chain = p.chain
+		if has {
+			chain = nil
+		} else if len(chain) > 0 {
+			// the record first, so that no block is stored without one.
+			if err := p.ms.PutMetadata(transformsKind, k, []byte(p.names)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, t := range chain {
+		if data, err = t.Encode(k, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (p *pipeline) decode(k key.Key, stored []byte) ([]byte, error) {
+	chain, _, err := p.recorded(k)
+	if err != nil {
+		return nil, err
+	}
+	data := stored
+	for i := len(chain) - 1; i >= 0; i-- {
+		if data, err = chain[i].Decode(k, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
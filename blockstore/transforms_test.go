@@ -0,0 +1,108 @@
+package blockstore
+
+import (
+	"bytes"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+)
+
+func TestTransformed(t *testing.T) {
+	aead, err := NewAESGCM(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := NewTransformRegistry()
+	if err := reg.Register("deflate", CompressTransform(Deflate)); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Register("aes", EncryptTransform(aead)); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Register("deflate", CompressTransform(Deflate)); err != ErrTransformRegistered {
+		t.Fatalf("expected ErrTransformRegistered, got %v", err)
+	}
+	if err := reg.Register("a,b", CompressTransform(Deflate)); err != ErrTransformName {
+		t.Fatalf("expected ErrTransformName, got %v", err)
+	}
+
+	under := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	plain := blocks.NewBlock(bytes.Repeat([]byte("written before transforms "), 10))
+	if err := under.Put(plain); err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := Transformed(under, reg, "deflate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := blocks.NewBlock(bytes.Repeat([]byte("compressed only "), 10))
+	if err := compressed.Put(small); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := Transformed(under, reg, "deflate", "aes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := blocks.NewBlock([]byte("compressed and encrypted"))
+	// putting a stored block again leaves it as it was written.
+	if err := sealed.PutMany([]*blocks.Block{secret, plain, small}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range []*blocks.Block{plain, small, secret} {
+		got, err := sealed.Get(b.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data, b.Data) {
+			t.Fatalf("block %s did not survive its transforms", b.Key())
+		}
+	}
+	stored, err := under.Get(secret.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored.Data, secret.Data) {
+		t.Fatal("block stored in the clear")
+	}
+	if stored, _ := under.Get(plain.Key()); !bytes.Equal(stored.Data, plain.Data) {
+		t.Fatal("block without transforms rewritten")
+	}
+
+	// a registry without the transforms a block was written with can't
+	// read it.
+	other := NewTransformRegistry()
+	if err := other.Register("deflate", CompressTransform(Deflate)); err != nil {
+		t.Fatal(err)
+	}
+	partial, err := Transformed(under, other, "deflate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := partial.Get(secret.Key()); err == nil {
+		t.Fatal("read a block written with an unknown transform")
+	} else if ue, ok := err.(*UnknownTransformError); !ok || ue.Name != "aes" {
+		t.Fatalf("expected an UnknownTransformError for aes, got %v", err)
+	}
+	if _, err := Transformed(under, other, "zstd"); err == nil {
+		t.Fatal("Transformed accepted an unknown transform")
+	}
+	if _, err := Transformed(ReadOnly(under), reg, "deflate"); err != ErrNoMetadata {
+		t.Fatalf("expected ErrNoMetadata, got %v", err)
+	}
+}
+
+func TestTransformedRefusesLazyBlocks(t *testing.T) {
+	reg := NewTransformRegistry()
+	if err := reg.Register("deflate", CompressTransform(Deflate)); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := Transformed(NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())), reg, "deflate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLazyRefused(t, bs)
+}
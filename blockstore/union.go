@@ -0,0 +1,94 @@
+package blockstore
+
+import (
+	"errors"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Union returns a blockstore reading from |write| and every store of
+// |read|, such as mounted archives or remote stores, and writing to |write|
+// only. Reads try |write| first, then |read| in order; a member that fails
+// is passed over, its error returned only if no other member has the block.
+// Unlike Tiered, a block stored in a read member is still written to
+// |write|, as read members may be unmounted, and deletes, ReplaceAll and the
+// metadata methods apply to |write| alone, so a block deleted from the union
+// stays visible while a read member holds it.
+func Union(read []Blockstore, write Blockstore) (Blockstore, error) {
+	if write == nil {
+		return nil, errors.New("blockstore: Union needs a store to write to")
+	}
+	members := append([]Blockstore{write}, read...)
+	return &union{tiered: &tiered{tiers: members}, write: write}, nil
+}
+
+type union struct {
+	// tiered lists the union's keys; its tiers are the members, |write|
+	// first.
+	*tiered
+	write Blockstore
+}
+
+func (u *union) Has(k key.Key) (bool, error) {
+	var first error
+	for _, bs := range u.tiers {
+		has, err := bs.Has(k)
+		if err == nil && has {
+			return true, nil
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return false, first
+}
+
+func (u *union) Get(k key.Key) (*blocks.Block, error) {
+	first := ErrNotFound
+	for _, bs := range u.tiers {
+		b, err := bs.Get(k)
+		if err == nil {
+			return b, nil
+		}
+		if !errors.Is(err, ErrNotFound) && errors.Is(first, ErrNotFound) {
+			first = err
+		}
+	}
+	return nil, first
+}
+
+func (u *union) GetChan(ks []key.Key) <-chan *blocks.Block {
+	out := make(chan *blocks.Block, 1)
+	go func() {
+		defer close(out)
+		for _, k := range ks {
+			if b, err := u.Get(k); err == nil {
+				out <- b
+			}
+		}
+	}()
+	return out
+}
+
+func (u *union) Put(b *blocks.Block) error        { return u.write.Put(b) }
+func (u *union) PutMany(bs []*blocks.Block) error { return u.write.PutMany(bs) }
+func (u *union) DeleteBlock(k key.Key) error      { return u.write.DeleteBlock(k) }
+
+func (u *union) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	return u.write.ReplaceAll(ctx, in)
+}
+
+func (u *union) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	return u.write.ApplyBatch(ctx, puts, deletes)
+}
+
+func (u *union) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	return u.write.FindOrphanedMetadata(ctx)
+}
+
+func (u *union) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	return u.write.PurgeOrphanedMetadata(ctx)
+}
@@ -0,0 +1,80 @@
+package blockstore
+
+import (
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// unreachable is a member whose reads fail, as a remote store's might.
+type unreachable struct {
+	Blockstore
+	err error
+}
+
+func (u unreachable) Has(key.Key) (bool, error)          { return false, u.err }
+func (u unreachable) Get(key.Key) (*blocks.Block, error) { return nil, u.err }
+
+func TestUnion(t *testing.T) {
+	local := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	mounted, mountedKeys := newBlockStoreWithKeys(t, nil, 3)
+	down := unreachable{Blockstore: NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore())), err: errors.New("unreachable")}
+	bs, err := Union([]Blockstore{down, mounted}, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reads pass over the failing member.
+	if _, err := bs.Get(mountedKeys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := bs.Has(mountedKeys[1]); !has || err != nil {
+		t.Fatalf("expected the mounted block, got %v, %v", has, err)
+	}
+	missing := blocks.NewBlock([]byte("nowhere")).Key()
+	if _, err := bs.Get(missing); err != down.err {
+		t.Fatalf("expected the failing member's error, got %v", err)
+	}
+
+	// writes go to the write store only, even of mounted blocks.
+	b := blocks.NewBlock([]byte("new block"))
+	if err := bs.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	mb, _ := mounted.Get(mountedKeys[2])
+	if err := bs.Put(mb); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []key.Key{b.Key(), mountedKeys[2]} {
+		if has, _ := local.Has(k); !has {
+			t.Fatalf("%s not written to the write store", k)
+		}
+	}
+	if has, _ := mounted.Has(b.Key()); has {
+		t.Fatal("new block written to a read member")
+	}
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(ch); len(got) != 4 {
+		t.Fatalf("expected 4 distinct keys, got %d", len(got))
+	}
+
+	// deletes leave the read members alone.
+	if err := bs.DeleteBlock(mountedKeys[2]); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := mounted.Has(mountedKeys[2]); !has {
+		t.Fatal("delete reached a read member")
+	}
+	if _, err := Union(nil, nil); err == nil {
+		t.Fatal("expected an error without a write store")
+	}
+}
@@ -0,0 +1,115 @@
+package blockstore
+
+import (
+	"errors"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Usage is how much a blockstore holds.
+type Usage struct {
+	Blocks uint64
+	// Bytes is the total size of the block data.
+	Bytes uint64
+	// DiskBytes is the space the datastore takes on disk, metadata and
+	// bookkeeping included, or zero if it can't tell. See DiskUsager.
+	DiskBytes uint64
+}
+
+// Statter is implemented by blockstores that can report their Usage. Use
+// Stat for the others.
+type Statter interface {
+	Stat(ctx context.Context) (Usage, error)
+}
+
+// DiskUsager is implemented by datastores that can tell how much space they
+// take on disk. Blockstores made by NewBlockstore over one report it in
+// Usage.DiskBytes.
+type DiskUsager interface {
+	DiskUsage() (uint64, error)
+}
+
+// Stat returns the Usage of |bs|, asking it if it is a Statter, and
+// otherwise reading every block, in which case DiskBytes is zero.
+func Stat(ctx context.Context, bs Blockstore) (Usage, error) {
+	if s, ok := bs.(Statter); ok {
+		return s.Stat(ctx)
+	}
+	ks, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return Usage{}, err
+	}
+	var u Usage
+	for k := range ks {
+		b, err := bs.Get(k)
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted since it was listed.
+		}
+		if err != nil {
+			return Usage{}, err
+		}
+		u.Blocks++
+		u.Bytes += uint64(len(b.Data))
+	}
+	if err := ctx.Err(); err != nil {
+		return Usage{}, err
+	}
+	return u, nil
+}
+
+// Stat reads the size of every stored value, which takes as long as listing
+// the blockstore does, and asks the datastore for DiskBytes if it is a
+// DiskUsager.
+func (bs *blockstore) Stat(ctx context.Context) (Usage, error) {
+	// datastore/namespace does *NOT* fix up Query.Prefix
+	res, err := bs.datastore.Query(dsq.Query{Prefix: bs.prefix.blocks.String()})
+	if err != nil {
+		return Usage{}, err
+	}
+	defer res.Close()
+
+	var u Usage
+	for {
+		select {
+		case <-ctx.Done():
+			return Usage{}, ctx.Err()
+		case e, more := <-res.Next():
+			if !more {
+				disk, err := bs.diskUsage()
+				if err != nil {
+					return Usage{}, err
+				}
+				u.DiskBytes = disk
+				return u, nil
+			}
+			if e.Error != nil {
+				return Usage{}, e.Error
+			}
+			// only count what AllKeys would list.
+			k := key.KeyFromDsKey(ds.NewKey(e.Key))
+			if _, err := k.Cid(); err != nil {
+				continue
+			}
+			data, ok := e.Value.([]byte)
+			if !ok {
+				return Usage{}, ValueTypeMismatch
+			}
+			u.Blocks++
+			u.Bytes += uint64(len(data))
+		}
+	}
+}
+
+// diskUsage returns the DiskUsage of the datastore, or zero if it can't
+// tell, as for a NamespacedBlockstore, whose datastore holds more.
+func (bs *blockstore) diskUsage() (uint64, error) {
+	du, ok := bs.root.(DiskUsager)
+	if !ok || bs.prefix.namespaced {
+		return 0, nil
+	}
+	return du.DiskUsage()
+}
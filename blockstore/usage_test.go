@@ -0,0 +1,45 @@
+package blockstore
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	ds_sync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestStat(t *testing.T) {
+	bs := NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	var size uint64
+	for _, data := range []string{"one", "two", "three"} {
+		b := blocks.NewBlock([]byte(data))
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		size += uint64(len(data))
+	}
+	// metadata is not block data.
+	if err := bs.(MetadataStore).PutMetadata("pins", blocks.NewBlock([]byte("one")).Key(), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Usage{Blocks: 3, Bytes: size}
+	u, err := Stat(context.Background(), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != want {
+		t.Fatalf("expected %+v, got %+v", want, u)
+	}
+
+	// blockstores that aren't Statters are read block by block.
+	u, err = Stat(context.Background(), ReadOnly(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != want {
+		t.Fatalf("expected %+v through a wrapper, got %+v", want, u)
+	}
+}
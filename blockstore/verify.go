@@ -0,0 +1,184 @@
+package blockstore
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// ErrHashMismatch is returned for block data that does not match its key. It
+// wraps blocks.ErrHashMismatch, for errors.Is.
+var ErrHashMismatch = fmt.Errorf("blockstore: block data does not match its key: %w", blocks.ErrHashMismatch)
+
+// Verify checks that |data| hashes to the multihash of |k|, using the hash
+// function and digest length it names; an identity multihash must hold
+// |data| itself. It returns ErrHashMismatch if it doesn't, or the parse
+// error if |k| is not a valid key.Cid.
+func Verify(k key.Key, data []byte) error {
+	h, err := k.Hash()
+	if err != nil {
+		return err
+	}
+	dec, err := mh.Decode(h)
+	if err != nil {
+		return err
+	}
+	if dec.Code == key.Identity {
+		if !bytes.Equal(dec.Digest, data) {
+			return ErrHashMismatch
+		}
+		return nil
+	}
+	sum, err := mh.Sum(data, dec.Code, dec.Length)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h) {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// VerifyResult reports a block that failed verification: Err is
+// ErrHashMismatch, or the error reading it.
+type VerifyResult struct {
+	Key key.Key
+	Err error
+}
+
+// VerifyProgress is how far a VerifyBlockstore scan has got.
+type VerifyProgress struct {
+	Blocks     uint64 // blocks scanned
+	Bytes      uint64 // bytes of block data scanned
+	Mismatches uint64 // blocks whose data does not match their key
+	ReadErrors uint64 // blocks that could not be read
+	Done       bool   // set on the last report of a scan of every block
+}
+
+// VerifyOptions configures VerifyBlockstore.
+type VerifyOptions struct {
+	// Progress, if set, is called with the scan's progress every
+	// ProgressEvery blocks (default 1000), and once more when it ends,
+	// whether or not it was cut short. It
+	// runs on its own goroutine so a slow callback never holds up the scan;
+	// reports that would pile up behind it are dropped in favour of the
+	// latest one.
+	Progress      func(VerifyProgress)
+	ProgressEvery int
+}
+
+// VerifyBlockstore checks every block in |bs| against its key, streaming the
+// ones that fail. The channel is closed when the scan ends, after the final
+// progress report, or when |ctx| is done. Once it is, the function returned
+// tells a complete scan from one cut short, as for ListKeys.
+func VerifyBlockstore(ctx context.Context, bs Blockstore, opts VerifyOptions) (<-chan VerifyResult, func() error, error) {
+	keys, listed, err := ListKeys(ctx, bs, dsq.Query{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.ProgressEvery <= 0 {
+		opts.ProgressEvery = 1000
+	}
+
+	out := make(chan VerifyResult)
+	go func() {
+		defer close(out)
+		var rep *progressReporter
+		if opts.Progress != nil {
+			rep = newProgressReporter(func(p interface{}) { opts.Progress(p.(VerifyProgress)) })
+		}
+
+		var p VerifyProgress
+		complete := false
+		defer func() {
+			if rep != nil {
+				p.Done = complete
+				rep.finish(p)
+			}
+		}()
+		for k := range keys {
+			b, err := bs.Get(k)
+			if err != nil {
+				p.ReadErrors++
+			} else {
+				p.Bytes += uint64(len(b.Data))
+				if err = Verify(k, b.Data); err != nil {
+					p.Mismatches++
+				}
+			}
+			p.Blocks++
+			if err != nil {
+				select {
+				case out <- VerifyResult{Key: k, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if rep != nil && p.Blocks%uint64(opts.ProgressEvery) == 0 {
+				rep.report(p)
+			}
+		}
+		complete = listed() == nil
+	}()
+	return out, listed, nil
+}
+
+// progressReporter hands progress reports to a callback on its own
+// goroutine, keeping only the latest report while the callback is busy.
+type progressReporter struct {
+	mu     sync.Mutex
+	latest interface{}
+	last   bool // latest is the final report
+	notify chan struct{}
+	done   chan struct{}
+}
+
+func newProgressReporter(f func(interface{})) *progressReporter {
+	r := &progressReporter{
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		for range r.notify {
+			r.mu.Lock()
+			p, last := r.latest, r.last
+			r.mu.Unlock()
+			f(p)
+			if last {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+func (r *progressReporter) report(p interface{}) {
+	r.mu.Lock()
+	r.latest = p
+	r.mu.Unlock()
+	r.signal()
+}
+
+func (r *progressReporter) signal() {
+	select {
+	case r.notify <- struct{}{}:
+	default: // already signalled; the callback will see the latest report.
+	}
+}
+
+// finish delivers the final report |p| and waits for the callback to see it.
+func (r *progressReporter) finish(p interface{}) {
+	r.mu.Lock()
+	r.latest, r.last = p, true
+	r.mu.Unlock()
+	r.signal()
+	<-r.done
+}
@@ -0,0 +1,139 @@
+package blockstore
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestVerifyBlockstoreProgress(t *testing.T) {
+	d := ds.NewMapDatastore()
+	bs, keys := newBlockStoreWithKeys(t, d, 12)
+	corrupt := map[key.Key]bool{keys[3]: true, keys[7]: true}
+	for k := range corrupt {
+		if err := d.Put(BlockPrefix.Child(k.DsKey()), []byte("garbage")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	var reports []VerifyProgress
+	res, done, err := VerifyBlockstore(context.Background(), bs, VerifyOptions{
+		ProgressEvery: 3,
+		Progress: func(p VerifyProgress) {
+			time.Sleep(5 * time.Millisecond) // slower than the scan
+			mu.Lock()
+			reports = append(reports, p)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := 0
+	for r := range res {
+		if !corrupt[r.Key] || r.Err != ErrHashMismatch {
+			t.Fatalf("unexpected result %v", r)
+		}
+		found++
+	}
+	if found != len(corrupt) {
+		t.Fatalf("expected %d mismatches, got %d", len(corrupt), found)
+	}
+	if err := done(); err != nil {
+		t.Fatalf("scan cut short: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) == 0 || len(reports) > 12/3+1 {
+		t.Fatalf("unexpected number of progress reports: %d", len(reports))
+	}
+	last := reports[len(reports)-1]
+	if !last.Done || last.Blocks != 12 || last.Mismatches != 2 || last.ReadErrors != 0 || last.Bytes == 0 {
+		t.Fatalf("unexpected final progress %+v", last)
+	}
+	for _, p := range reports[:len(reports)-1] {
+		if p.Done {
+			t.Fatalf("intermediate report marked done: %+v", p)
+		}
+	}
+}
+
+// verifyAll runs VerifyBlockstore over |bs|, returning its results, its
+// final progress report and the error that cut it short.
+func verifyAll(t *testing.T, bs Blockstore) ([]VerifyResult, VerifyProgress, error) {
+	var last VerifyProgress
+	res, done, err := VerifyBlockstore(context.Background(), bs, VerifyOptions{
+		Progress: func(p VerifyProgress) { last = p },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []VerifyResult
+	for r := range res {
+		out = append(out, r)
+	}
+	return out, last, done()
+}
+
+func TestVerifyBlockstoreListingCutShort(t *testing.T) {
+	d := &queryTestDS{ds: ds.NewMapDatastore()}
+	bs, keys := newBlockStoreWithKeys(t, d, 3)
+	errScan := errors.New("scan failed")
+	d.SetFunc(func(q dsq.Query) (dsq.Results, error) {
+		ch := make(chan dsq.Result, 2)
+		ch <- dsq.Result{Entry: dsq.Entry{Key: BlockPrefix.Child(keys[0].DsKey()).String()}}
+		ch <- dsq.Result{Error: errScan}
+		close(ch)
+		return dsq.ResultsWithChan(q, ch), nil
+	})
+
+	res, last, err := verifyAll(t, bs)
+	if err != errScan {
+		t.Fatalf("expected the scan error, got %v", err)
+	}
+	if len(res) != 0 || last.Done || last.Blocks != 1 {
+		t.Fatalf("unexpected results %v and final progress %+v", res, last)
+	}
+}
+
+func TestVerifyBlockstoreReadErrors(t *testing.T) {
+	d := &faultyDatastore{Datastore: ds.NewMapDatastore()}
+	bs, keys := newBlockStoreWithKeys(t, d, 3)
+	unreadable := BlockPrefix.Child(keys[1].DsKey())
+	d.fail = func(op string, k ds.Key) bool { return op == "get" && k == unreadable }
+
+	res, last, err := verifyAll(t, bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Key != keys[1] || res[0].Err != errFault {
+		t.Fatalf("unexpected results %v", res)
+	}
+	if !last.Done || last.Blocks != 3 || last.ReadErrors != 1 || last.Mismatches != 0 {
+		t.Fatalf("unexpected final progress %+v", last)
+	}
+}
+
+func TestVerifyInline(t *testing.T) {
+	b, err := blocks.NewInlineBlock([]byte("inline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(b.Key(), b.Data); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(b.Key(), []byte("other!")); err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,477 @@
+package blockstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+var (
+	// ErrVersionPurged is returned for a version Purge removed.
+	ErrVersionPurged = errors.New("blockstore: version purged")
+	// ErrUnknownVersion is returned for a version not written yet.
+	ErrUnknownVersion = errors.New("blockstore: unknown version")
+	// ErrAppendOnly is returned by the ReplaceAll of a Versioned
+	// blockstore, which would rewrite its history.
+	ErrAppendOnly = errors.New("blockstore: versioned blockstore is append-only")
+)
+
+// Versioned is a blockstore keeping the history of its blocks, so that it
+// can be read as it was at any version since the last Purge, for audits or
+// reproducible builds. Each write that changes the blocks stored is a new
+// version, numbered from 1. Deletes are tombstones: the block stays in the
+// blockstore below, hidden from the reads of later versions, until Purge
+// removes the history that reads it.
+//
+// The history is kept in a datastore of its own, with one record for each
+// key listing the versions it was put and deleted in, and the time of each
+// version. A crash part way through a write may leave it partly recorded.
+type Versioned struct {
+	bs      Blockstore
+	history ds.Datastore
+
+	// mu is held to read, and exclusively to write.
+	mu   sync.RWMutex
+	head versionHead
+}
+
+// versionHead is the latest version, and the first still readable.
+type versionHead struct {
+	Seq    uint64    `json:"seq"`
+	Purged uint64    `json:"purged,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// versionEvent is a put of a key, or if Deleted, its tombstone.
+type versionEvent struct {
+	Seq     uint64 `json:"seq"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+var versionHeadKey = ds.NewKey("/head")
+
+func versionKeyKey(k key.Key) ds.Key { return ds.NewKey("/keys/" + k.B58String()) }
+func versionSeqKey(seq uint64) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/seqs/%020d", seq))
+}
+
+// NewVersioned returns |bs| keeping its history in |history|, on which it
+// resumes where it left off. Both must be given again together: writes made
+// to |bs| directly are not in the history, and deletes there lose what the
+// history reads.
+func NewVersioned(bs Blockstore, history ds.Datastore) (*Versioned, error) {
+	v := &Versioned{bs: bs, history: history}
+	if err := getJSON(history, versionHeadKey, &v.head); err != nil && !errors.Is(err, ds.ErrNotFound) {
+		return nil, err
+	}
+	return v, nil
+}
+
+func getJSON(d ds.Datastore, k ds.Key, v interface{}) error {
+	val, err := d.Get(k)
+	if err != nil {
+		return err
+	}
+	data, ok := val.([]byte)
+	if !ok {
+		return ValueTypeMismatch
+	}
+	return json.Unmarshal(data, v)
+}
+
+func putJSON(d ds.Datastore, k ds.Key, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return d.Put(k, data)
+}
+
+// Version returns the latest version.
+func (v *Versioned) Version() uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.head.Seq
+}
+
+// events returns the history of |k|, oldest first.
+func (v *Versioned) events(k key.Key) ([]versionEvent, error) {
+	var evs []versionEvent
+	err := getJSON(v.history, versionKeyKey(k), &evs)
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, nil
+	}
+	return evs, err
+}
+
+// liveAt reports whether |evs| has their key stored at version |seq|.
+func liveAt(evs []versionEvent, seq uint64) bool {
+	live := false
+	for _, e := range evs {
+		if e.Seq > seq {
+			break
+		}
+		live = !e.Deleted
+	}
+	return live
+}
+
+func (v *Versioned) has(k key.Key, seq uint64) (bool, error) {
+	evs, err := v.events(k)
+	if err != nil {
+		return false, err
+	}
+	return liveAt(evs, seq), nil
+}
+
+func (v *Versioned) get(k key.Key, seq uint64) (*blocks.Block, error) {
+	has, err := v.has(k, seq)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, ErrNotFound
+	}
+	return v.bs.Get(k)
+}
+
+func (v *Versioned) Has(k key.Key) (bool, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.has(k, v.head.Seq)
+}
+
+func (v *Versioned) Get(k key.Key) (*blocks.Block, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.get(k, v.head.Seq)
+}
+
+func (v *Versioned) GetChan(ks []key.Key) <-chan *blocks.Block {
+	return getChan(v, ks)
+}
+
+func (v *Versioned) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return v.AllKeys(ctx, dsq.Query{})
+}
+
+func (v *Versioned) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	return filteredKeys(ctx, v.bs, q, func(k key.Key) (bool, error) {
+		return v.Has(k)
+	})
+}
+
+func (v *Versioned) Put(b *blocks.Block) error {
+	return v.ApplyBatch(context.Background(), []*blocks.Block{b}, nil)
+}
+
+func (v *Versioned) PutMany(bs []*blocks.Block) error {
+	return v.ApplyBatch(context.Background(), bs, nil)
+}
+
+// DeleteBlock tombstones |k|, returning ErrNotFound if it is not stored.
+func (v *Versioned) DeleteBlock(k key.Key) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	evs, err := v.events(k)
+	if err != nil {
+		return err
+	}
+	if !liveAt(evs, v.head.Seq) {
+		return ErrNotFound
+	}
+	return v.record(map[key.Key][]versionEvent{k: evs}, nil, []key.Key{k})
+}
+
+// ApplyBatch writes |puts| and tombstones |deletes| as one version, if that
+// changes anything. As for blockstore.ApplyBatch, a key both put and
+// deleted ends up deleted.
+func (v *Versioned) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	ps, dels := dedupeBatch(puts, deletes)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	hist := make(map[key.Key][]versionEvent)
+	var put []*blocks.Block
+	var putKeys, deleted []key.Key
+	for _, b := range ps {
+		evs, err := v.events(b.Key())
+		if err != nil {
+			return err
+		}
+		if !liveAt(evs, v.head.Seq) {
+			hist[b.Key()] = evs
+			put = append(put, b)
+			putKeys = append(putKeys, b.Key())
+		}
+	}
+	for _, k := range dels {
+		evs, err := v.events(k)
+		if err != nil {
+			return err
+		}
+		if liveAt(evs, v.head.Seq) {
+			hist[k] = evs
+			deleted = append(deleted, k)
+		}
+	}
+	if len(put) > 0 {
+		// the blocks first, so that the history never reads a missing one.
+		if err := v.bs.PutMany(put); err != nil {
+			return err
+		}
+	}
+	return v.record(hist, putKeys, deleted)
+}
+
+// record writes a new version putting |puts| and tombstoning |deletes|,
+// whose histories are in |hist|, if there are any. v.mu must be held
+// exclusively.
+func (v *Versioned) record(hist map[key.Key][]versionEvent, puts, deletes []key.Key) error {
+	if len(puts) == 0 && len(deletes) == 0 {
+		return nil
+	}
+	head := v.head
+	head.Seq++
+	// versions are ordered in time, for AsOfTime, whatever the clock does.
+	if now := time.Now(); now.After(head.Time) {
+		head.Time = now
+	}
+	if err := putJSON(v.history, versionHeadKey, head); err != nil {
+		return err
+	}
+	if err := putJSON(v.history, versionSeqKey(head.Seq), head.Time); err != nil {
+		return err
+	}
+	v.head = head
+	for _, k := range puts {
+		if err := putJSON(v.history, versionKeyKey(k), append(hist[k], versionEvent{Seq: head.Seq})); err != nil {
+			return err
+		}
+	}
+	for _, k := range deletes {
+		if err := putJSON(v.history, versionKeyKey(k), append(hist[k], versionEvent{Seq: head.Seq, Deleted: true})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplaceAll fails with ErrAppendOnly.
+func (v *Versioned) ReplaceAll(context.Context, <-chan *blocks.Block) error {
+	return ErrAppendOnly
+}
+
+func (v *Versioned) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	return v.bs.FindOrphanedMetadata(ctx)
+}
+
+func (v *Versioned) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	return v.bs.PurgeOrphanedMetadata(ctx)
+}
+
+// AsOf returns a read-only view of the blockstore as it was at version
+// |seq|, zero being before the first write. It fails with ErrVersionPurged
+// for a version Purge removed, and ErrUnknownVersion for one not written
+// yet. Reads through it after a Purge of its version fail with
+// ErrVersionPurged.
+func (v *Versioned) AsOf(seq uint64) (Blockstore, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if err := v.readable(seq); err != nil {
+		return nil, err
+	}
+	return &versionView{readOnly: readOnly{bs: v.bs}, v: v, seq: seq}, nil
+}
+
+// AsOfTime is AsOf for the latest version written at or before |t|.
+func (v *Versioned) AsOfTime(t time.Time) (Blockstore, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	// versions are ordered in time: find the last one not after |t|.
+	lo, hi := v.head.Purged, v.head.Seq
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		var at time.Time
+		if err := getJSON(v.history, versionSeqKey(mid), &at); err != nil {
+			return nil, err
+		}
+		if at.After(t) {
+			hi = mid - 1
+		} else {
+			lo = mid
+		}
+	}
+	if lo == v.head.Purged && lo > 0 {
+		var at time.Time
+		if err := getJSON(v.history, versionSeqKey(lo), &at); err != nil {
+			return nil, err
+		}
+		if at.After(t) {
+			return nil, ErrVersionPurged
+		}
+	}
+	return &versionView{readOnly: readOnly{bs: v.bs}, v: v, seq: lo}, nil
+}
+
+// readable returns the error of reading version |seq|. v.mu must be held.
+func (v *Versioned) readable(seq uint64) error {
+	switch {
+	case seq < v.head.Purged:
+		return ErrVersionPurged
+	case seq > v.head.Seq:
+		return ErrUnknownVersion
+	}
+	return nil
+}
+
+// Purge removes the history of the versions before |before|, which can no
+// longer be read, and the blocks only they read, returning how many blocks
+// it removed. The version |before| itself stays readable.
+func (v *Versioned) Purge(ctx context.Context, before uint64) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if before > v.head.Seq {
+		return 0, ErrUnknownVersion
+	}
+	if before <= v.head.Purged {
+		return 0, nil
+	}
+	res, err := v.history.Query(dsq.Query{})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		name := ds.NewKey(e.Key).String()
+		if !strings.HasPrefix(name, "/keys/") {
+			continue
+		}
+		k, err := key.DecodeB58(strings.TrimPrefix(name, "/keys/"))
+		if err != nil {
+			continue
+		}
+		var evs []versionEvent
+		if data, ok := e.Value.([]byte); !ok || json.Unmarshal(data, &evs) != nil {
+			continue
+		}
+		kept := prunedEvents(evs, before)
+		if len(kept) == len(evs) {
+			continue
+		}
+		if len(kept) == 0 || !anyPut(kept) {
+			if err := v.bs.DeleteBlock(k); err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ds.ErrNotFound) {
+				return removed, err
+			}
+			if err := v.history.Delete(versionKeyKey(k)); err != nil && !errors.Is(err, ds.ErrNotFound) {
+				return removed, err
+			}
+			removed++
+			continue
+		}
+		if err := putJSON(v.history, versionKeyKey(k), kept); err != nil {
+			return removed, err
+		}
+	}
+	head := v.head
+	head.Purged = before
+	if err := putJSON(v.history, versionHeadKey, head); err != nil {
+		return removed, err
+	}
+	for seq := v.head.Purged; seq < before; seq++ {
+		if err := v.history.Delete(versionSeqKey(seq)); err != nil && !errors.Is(err, ds.ErrNotFound) {
+			return removed, err
+		}
+	}
+	v.head = head
+	return removed, nil
+}
+
+// prunedEvents returns the events of |evs| readable from version |before|:
+// those from it on, after the put it starts with, if any.
+func prunedEvents(evs []versionEvent, before uint64) []versionEvent {
+	var kept []versionEvent
+	for i, e := range evs {
+		if e.Seq >= before {
+			return append(kept, evs[i:]...)
+		}
+		kept = nil
+		if !e.Deleted {
+			kept = []versionEvent{e}
+		}
+	}
+	return kept
+}
+
+func anyPut(evs []versionEvent) bool {
+	for _, e := range evs {
+		if !e.Deleted {
+			return true
+		}
+	}
+	return false
+}
+
+// versionView is the blockstore read by AsOf.
+type versionView struct {
+	readOnly
+	v   *Versioned
+	seq uint64
+}
+
+func (w *versionView) Has(k key.Key) (bool, error) {
+	w.v.mu.RLock()
+	defer w.v.mu.RUnlock()
+	if err := w.v.readable(w.seq); err != nil {
+		return false, err
+	}
+	return w.v.has(k, w.seq)
+}
+
+func (w *versionView) Get(k key.Key) (*blocks.Block, error) {
+	w.v.mu.RLock()
+	defer w.v.mu.RUnlock()
+	if err := w.v.readable(w.seq); err != nil {
+		return nil, err
+	}
+	return w.v.get(k, w.seq)
+}
+
+func (w *versionView) GetChan(ks []key.Key) <-chan *blocks.Block {
+	return getChan(w, ks)
+}
+
+func (w *versionView) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
+	return w.AllKeys(ctx, dsq.Query{})
+}
+
+func (w *versionView) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	w.v.mu.RLock()
+	err := w.v.readable(w.seq)
+	w.v.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return filteredKeys(ctx, w.v.bs, q, func(k key.Key) (bool, error) {
+		return w.Has(k)
+	})
+}
@@ -0,0 +1,176 @@
+package blockstore
+
+import (
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	syncds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestVersioned(t *testing.T) {
+	under := NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore()))
+	history := syncds.MutexWrap(ds.NewMapDatastore())
+	v, err := NewVersioned(under, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("b"))
+	if err := v.PutMany([]*blocks.Block{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	// putting a stored block again is no new version.
+	if err := v.Put(a); err != nil || v.Version() != 1 {
+		t.Fatalf("expected version 1, got %d, %v", v.Version(), err)
+	}
+	if err := v.DeleteBlock(a.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.DeleteBlock(a.Key()); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound deleting a tombstone, got %v", err)
+	}
+	c := blocks.NewBlock([]byte("c"))
+	if err := v.Put(c); err != nil {
+		t.Fatal(err)
+	}
+	if v.Version() != 3 {
+		t.Fatalf("expected version 3, got %d", v.Version())
+	}
+
+	if has, _ := v.Has(a.Key()); has {
+		t.Fatal("expected the deleted block hidden")
+	}
+	if has, _ := under.Has(a.Key()); !has {
+		t.Fatal("expected the deleted block kept below")
+	}
+	if ks := snapshotKeys(t, v); len(ks) != 2 || !ks[b.Key()] || !ks[c.Key()] {
+		t.Fatalf("unexpected live keys %v", ks)
+	}
+
+	// each version reads as it was, even once reopened.
+	v, err = NewVersioned(under, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq, want := range []map[string]bool{{}, {"a": true, "b": true}, {"b": true}, {"b": true, "c": true}} {
+		view, err := v.AsOf(uint64(seq))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ks := snapshotKeys(t, view)
+		for _, blk := range []*blocks.Block{a, b, c} {
+			if ks[blk.Key()] != want[string(blk.Data)] {
+				t.Fatalf("version %d: expected %s stored %v", seq, blk.Data, want[string(blk.Data)])
+			}
+			if _, err := view.Get(blk.Key()); (err == nil) != want[string(blk.Data)] {
+				t.Fatalf("version %d: reading %s: %v", seq, blk.Data, err)
+			}
+		}
+		if err := view.Put(c); err != ErrReadOnly {
+			t.Fatalf("expected ErrReadOnly writing a version, got %v", err)
+		}
+	}
+	if _, err := v.AsOf(4); err != ErrUnknownVersion {
+		t.Fatalf("expected ErrUnknownVersion, got %v", err)
+	}
+	if err := v.ReplaceAll(context.Background(), nil); err != ErrAppendOnly {
+		t.Fatalf("expected ErrAppendOnly, got %v", err)
+	}
+}
+
+func TestVersionedPurge(t *testing.T) {
+	under := NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore()))
+	v, err := NewVersioned(under, syncds.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, kept, back := blocks.NewBlock([]byte("gone")), blocks.NewBlock([]byte("kept")), blocks.NewBlock([]byte("back"))
+	steps := []func() error{
+		func() error { return v.PutMany([]*blocks.Block{gone, kept, back}) }, // 1
+		func() error { return v.DeleteBlock(gone.Key()) },                    // 2
+		func() error { return v.DeleteBlock(back.Key()) },                    // 3
+		func() error { return v.Put(back) },                                  // 4
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, err := v.AsOf(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := v.Purge(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 block removed, got %d", n)
+	}
+	if has, _ := under.Has(gone.Key()); has {
+		t.Fatal("expected the block only purged versions read removed")
+	}
+	if _, err := old.Get(kept.Key()); err != ErrVersionPurged {
+		t.Fatalf("expected ErrVersionPurged reading a purged version, got %v", err)
+	}
+	if _, err := v.AsOf(2); err != ErrVersionPurged {
+		t.Fatalf("expected ErrVersionPurged, got %v", err)
+	}
+	at3, err := v.AsOf(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks := snapshotKeys(t, at3); len(ks) != 1 || !ks[kept.Key()] {
+		t.Fatalf("unexpected keys of version 3 %v", ks)
+	}
+	if ks := snapshotKeys(t, v); len(ks) != 2 || !ks[kept.Key()] || !ks[back.Key()] {
+		t.Fatalf("unexpected live keys %v", ks)
+	}
+}
+
+func TestVersionedAsOfTime(t *testing.T) {
+	v, err := NewVersioned(NewBlockstore(syncds.MutexWrap(ds.NewMapDatastore())), syncds.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	var times []time.Time
+	for i := 0; i < 5; i++ {
+		time.Sleep(2 * time.Millisecond)
+		if err := v.Put(blocks.NewBlock([]byte{byte(i)})); err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, time.Now())
+	}
+
+	view, err := v.AsOfTime(start.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks := snapshotKeys(t, view); len(ks) != 0 {
+		t.Fatalf("expected nothing before the first write, got %v", ks)
+	}
+	for i, at := range times {
+		view, err := v.AsOfTime(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ks := snapshotKeys(t, view); len(ks) != i+1 {
+			t.Fatalf("expected %d keys at write %d, got %d", i+1, i, len(ks))
+		}
+	}
+
+	if _, err := v.Purge(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.AsOfTime(times[0]); err != ErrVersionPurged {
+		t.Fatalf("expected ErrVersionPurged, got %v", err)
+	}
+	if _, err := v.AsOfTime(times[2]); err != nil {
+		t.Fatal(err)
+	}
+}
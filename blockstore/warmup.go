@@ -0,0 +1,96 @@
+package blockstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	key "github.com/ipfs/go-blocks/key"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Warmer is implemented by blockstores with caches worth filling before
+// they are read, such as those CachedBlockstore returns. Use Warmup for the
+// others.
+type Warmer interface {
+	// Warmup loads the blocks |ks| into the caches, and returns how many
+	// of them are stored. See Warmup.
+	Warmup(ctx context.Context, ks []key.Key) (int, error)
+}
+
+// Warmup prepares |bs| to serve the blocks |ks| quickly, for a service
+// starting up cold: it asks |bs| if it is a Warmer, and otherwise reads each
+// block once, so that the datastore and the operating system cache them if
+// they can. It returns how many of |ks| are stored, and ctx.Err() if |ctx|
+// is done first. Blocks that fail to read are skipped.
+func Warmup(ctx context.Context, bs Blockstore, ks []key.Key) (int, error) {
+	if w, ok := bs.(Warmer); ok {
+		return w.Warmup(ctx, ks)
+	}
+	n := 0
+	for _, k := range ks {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if _, err := bs.Get(k); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Warmup loads |ks| into the block cache, as many as it holds, the last of
+// |ks| being the most recently used, and remembers those missing as
+// such. It first waits for the bloom filter, if there is one, to be built,
+// so that the misses of the first reads are answered from memory too.
+func (c *cached) Warmup(ctx context.Context, ks []key.Key) (int, error) {
+	select {
+	case <-c.bloomDone:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	n := 0
+	for _, k := range ks {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if _, err := c.Get(k); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// WriteManifest writes |ks| to |w| as a warmup manifest, one b58 encoded key
+// a line, for ReadManifest to read back at the next start.
+func WriteManifest(w io.Writer, ks []key.Key) error {
+	bw := bufio.NewWriter(w)
+	for _, k := range ks {
+		if _, err := fmt.Fprintln(bw, k.B58String()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadManifest reads the keys of a manifest written by WriteManifest. Blank
+// lines, and those starting with #, are skipped; any other line must be a
+// key, as key.DecodeB58 reads them, or its *key.DecodeError is returned.
+func ReadManifest(r io.Reader) ([]key.Key, error) {
+	var ks []key.Key
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, err := key.DecodeB58(line)
+		if err != nil {
+			return nil, err
+		}
+		ks = append(ks, k)
+	}
+	return ks, sc.Err()
+}
@@ -0,0 +1,74 @@
+package blockstore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+	key "github.com/ipfs/go-blocks/key"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	syncds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func TestWarmupFillsCache(t *testing.T) {
+	hits := 0
+	cd := &callbackDatastore{f: func() { hits++ }, ds: ds.NewMapDatastore()}
+	bs := NewBlockstore(syncds.MutexWrap(cd))
+	stored := blocks.NewBlock([]byte("hot"))
+	missing := blocks.NewBlock([]byte("gone")).Key()
+	if err := bs.Put(stored); err != nil {
+		t.Fatal(err)
+	}
+	cbs, err := CachedBlockstore(bs, DefaultCacheOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := Warmup(context.Background(), cbs, []key.Key{stored.Key(), missing})
+	if err != nil || n != 1 {
+		t.Fatalf("expected one block warmed, got %d, %v", n, err)
+	}
+
+	hits = 0
+	if _, err := cbs.Get(stored.Key()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := cbs.Has(missing); has {
+		t.Fatal("unexpected block")
+	}
+	if hits != 0 {
+		t.Fatalf("reads after warmup hit the datastore %d times", hits)
+	}
+
+	// without caches, the blocks are read once.
+	if n, err := Warmup(context.Background(), bs, []key.Key{stored.Key(), missing}); err != nil || n != 1 {
+		t.Fatalf("expected one block read, got %d, %v", n, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Warmup(ctx, bs, []key.Key{stored.Key()}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	ks := []key.Key{blocks.NewBlock([]byte("a")).Key(), blocks.NewBlock([]byte("b")).Key()}
+	var buf bytes.Buffer
+	if err := WriteManifest(&buf, ks); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("\n# saved at shutdown\n")
+	got, err := ReadManifest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(ks) || got[0] != ks[0] || got[1] != ks[1] {
+		t.Fatalf("expected %v back, got %v", ks, got)
+	}
+	_, err = ReadManifest(strings.NewReader("not-a-key\n"))
+	if _, ok := err.(*key.DecodeError); !ok {
+		t.Fatalf("expected a *key.DecodeError, got %v", err)
+	}
+}
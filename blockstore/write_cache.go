@@ -5,6 +5,7 @@ import (
 	key "github.com/ipfs/go-blocks/key"
 
 	lru "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/hashicorp/golang-lru"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
 	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
@@ -50,6 +51,51 @@ func (w *writecache) Put(b *blocks.Block) error {
 	return w.blockstore.Put(b)
 }
 
+func (w *writecache) PutMany(bs []*blocks.Block) error {
+	var toPut []*blocks.Block
+	for _, b := range bs {
+		if _, ok := w.cache.Get(b.Key()); !ok {
+			toPut = append(toPut, b)
+		}
+	}
+	if err := w.blockstore.PutMany(toPut); err != nil {
+		return err
+	}
+	for _, b := range toPut {
+		w.cache.Add(b.Key(), struct{}{})
+	}
+	return nil
+}
+
 func (w *writecache) AllKeysChan(ctx context.Context) (<-chan key.Key, error) {
 	return w.blockstore.AllKeysChan(ctx)
 }
+
+func (w *writecache) AllKeys(ctx context.Context, q dsq.Query) (<-chan key.Key, error) {
+	return w.blockstore.AllKeys(ctx, q)
+}
+
+func (w *writecache) ReplaceAll(ctx context.Context, in <-chan *blocks.Block) error {
+	// the cache may now hold keys that are no longer in the store.
+	defer w.cache.Purge()
+	return w.blockstore.ReplaceAll(ctx, in)
+}
+
+func (w *writecache) ApplyBatch(ctx context.Context, puts []*blocks.Block, deletes []key.Key) error {
+	// forget everything touched first; a failed batch may be partly applied.
+	for _, b := range puts {
+		w.cache.Remove(b.Key())
+	}
+	for _, k := range deletes {
+		w.cache.Remove(k)
+	}
+	return w.blockstore.ApplyBatch(ctx, puts, deletes)
+}
+
+func (w *writecache) FindOrphanedMetadata(ctx context.Context) (<-chan key.Key, error) {
+	return w.blockstore.FindOrphanedMetadata(ctx)
+}
+
+func (w *writecache) PurgeOrphanedMetadata(ctx context.Context) (int, error) {
+	return w.blockstore.PurgeOrphanedMetadata(ctx)
+}
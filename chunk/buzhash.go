@@ -0,0 +1,67 @@
+package chunk
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	buzWindow = 32
+	buzMin    = 128 << 10
+	buzAvg    = buzMin + 128<<10
+	buzMax    = 512 << 10
+)
+
+// NewBuzhash returns a Splitter cutting |r| with a cyclic polynomial rolling
+// hash, which is cheaper than a Rabin fingerprint, into chunks of 256KiB on
+// average, at least 128KiB and at most 512KiB.
+func NewBuzhash(r io.Reader) Splitter {
+	buzOnce.Do(fillBuzTable)
+	return newCDC(r, &buzhash{}, buzMin, buzAvg, buzMax)
+}
+
+var (
+	buzOnce sync.Once
+	// buzTable maps bytes to random values, drawn from a fixed seed, so
+	// that cuts are the same everywhere. Changing it moves every cut.
+	buzTable [256]uint32
+)
+
+func fillBuzTable() {
+	// splitmix64.
+	x := uint64(0x62757a68617368)
+	for i := range buzTable {
+		x += 0x9E3779B97F4A7C15
+		z := x
+		z = (z ^ z>>30) * 0xBF58476D1CE4E5B9
+		z = (z ^ z>>27) * 0x94D049BB133111EB
+		buzTable[i] = uint32(z ^ z>>31)
+	}
+}
+
+type buzhash struct {
+	win   [buzWindow]byte
+	pos   int
+	n     int
+	state uint32
+}
+
+func (h *buzhash) window() int { return buzWindow }
+
+func (h *buzhash) reset() {
+	*h = buzhash{}
+}
+
+func (h *buzhash) roll(b byte) uint64 {
+	h.state = h.state<<1 | h.state>>31
+	if h.n < buzWindow {
+		h.n++
+	} else {
+		// rotated once per byte since it came in, a full turn.
+		h.state ^= buzTable[h.win[h.pos]]
+	}
+	h.state ^= buzTable[b]
+	h.win[h.pos] = b
+	h.pos = (h.pos + 1) % buzWindow
+	return uint64(h.state)
+}
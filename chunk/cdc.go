@@ -0,0 +1,87 @@
+package chunk
+
+import (
+	"io"
+)
+
+// roller is a rolling hash of the last bytes of a stream.
+type roller interface {
+	// window is how many bytes the hash covers.
+	window() int
+	reset()
+	// roll adds |b| to the hash, dropping the byte a window before, and
+	// returns the hash.
+	roll(b byte) uint64
+}
+
+// cdc is a content-defined Splitter: it ends a chunk after the first byte
+// at which the rolling hash has the bits of |mask| all zero, so that the
+// same content is cut in the same places wherever it is in the stream.
+// Chunks are at least |min| bytes long, but for the last, and at most
+// |max|.
+type cdc struct {
+	r        io.Reader
+	min, max int
+	mask     uint64
+	h        roller
+
+	// buf holds the data read and not returned yet.
+	buf []byte
+	err error
+}
+
+func newCDC(r io.Reader, h roller, min, avg, max int) *cdc {
+	if min < 1 {
+		min = 1
+	}
+	if avg < min {
+		avg = min
+	}
+	if max < avg {
+		max = avg
+	}
+	// the hash cuts one chunk in 2^bits bytes past the minimum on average.
+	var mask uint64
+	for n := avg - min; n > 1; n >>= 1 {
+		mask = mask<<1 | 1
+	}
+	return &cdc{r: r, min: min, max: max, mask: mask, h: h, buf: make([]byte, 0, max)}
+}
+
+func (c *cdc) NextBytes() ([]byte, error) {
+	for len(c.buf) < c.max && c.err == nil {
+		n, err := c.r.Read(c.buf[len(c.buf):c.max])
+		c.buf = c.buf[:len(c.buf)+n]
+		c.err = err
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf)
+	chunk := append([]byte(nil), c.buf[:n]...)
+	c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+	return chunk, nil
+}
+
+// cut returns the length of the chunk at the start of |data|, which holds
+// |max| bytes unless it is the end of the stream.
+func (c *cdc) cut(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+	// only the window before the minimum matters to the first cut.
+	start := c.min - c.h.window()
+	if start < 0 {
+		start = 0
+	}
+	c.h.reset()
+	for i := start; i < len(data); i++ {
+		if c.h.roll(data[i])&c.mask == 0 && i+1 >= c.min {
+			return i + 1
+		}
+	}
+	return len(data)
+}
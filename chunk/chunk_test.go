@@ -0,0 +1,151 @@
+package chunk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func chunks(t *testing.T, s Splitter) [][]byte {
+	var out [][]byte
+	for {
+		c, err := s.NextBytes()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c) == 0 {
+			t.Fatal("empty chunk")
+		}
+		out = append(out, c)
+	}
+}
+
+func TestSizeSplitter(t *testing.T) {
+	data := randomData(1, 1000)
+	cs := chunks(t, NewSizeSplitter(bytes.NewReader(data), 300))
+	if len(cs) != 4 || len(cs[3]) != 100 {
+		t.Fatalf("got %d chunks", len(cs))
+	}
+	if !bytes.Equal(bytes.Join(cs, nil), data) {
+		t.Fatal("chunks don't add up to the data")
+	}
+	if cs := chunks(t, NewSizeSplitter(bytes.NewReader(nil), 300)); len(cs) != 0 {
+		t.Fatal("chunks of no data")
+	}
+}
+
+func TestContentDefinedBounds(t *testing.T) {
+	data := randomData(2, 1<<20)
+	for name, s := range map[string]Splitter{
+		"rabin":   NewRabinMinMax(bytes.NewReader(data), 2<<10, 8<<10, 16<<10),
+		"buzhash": NewBuzhash(bytes.NewReader(data)),
+	} {
+		cs := chunks(t, s)
+		if !bytes.Equal(bytes.Join(cs, nil), data) {
+			t.Fatalf("%s: chunks don't add up to the data", name)
+		}
+		min, max := 2<<10, 16<<10
+		if name == "buzhash" {
+			min, max = buzMin, buzMax
+		}
+		for i, c := range cs {
+			if len(c) > max || len(c) < min && i != len(cs)-1 {
+				t.Fatalf("%s: chunk %d is %d bytes", name, i, len(c))
+			}
+		}
+		if len(cs) < 3 {
+			t.Fatalf("%s: only %d chunks", name, len(cs))
+		}
+	}
+}
+
+func TestContentDefinedInsertion(t *testing.T) {
+	data := randomData(3, 1<<20)
+	edited := append(append(append([]byte(nil), data[:1000]...), "inserted"...), data[1000:]...)
+	for name, split := range map[string]func(io.Reader) Splitter{
+		"rabin":   func(r io.Reader) Splitter { return NewRabin(r, 8<<10) },
+		"buzhash": NewBuzhash,
+	} {
+		before := make(map[string]bool)
+		cs := chunks(t, split(bytes.NewReader(data)))
+		for _, c := range cs {
+			before[string(c)] = true
+		}
+		after := chunks(t, split(bytes.NewReader(edited)))
+		changed := 0
+		for _, c := range after {
+			if !before[string(c)] {
+				changed++
+			}
+		}
+		if changed > 2 {
+			t.Fatalf("%s: %d of %d chunks changed", name, changed, len(after))
+		}
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	data := randomData(4, 1000)
+	out, errc := Blocks(context.Background(), NewSizeSplitter(bytes.NewReader(data), 300))
+	var got []byte
+	for b := range out {
+		got = append(got, b.Data...)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("blocks don't add up to the data")
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("broken") }
+
+func TestBlocksError(t *testing.T) {
+	out, errc := Blocks(context.Background(), NewSizeSplitter(failingReader{}, 300))
+	for range out {
+		t.Fatal("block from a failing reader")
+	}
+	if err := <-errc; err == nil || err.Error() != "broken" {
+		t.Fatalf("got %v", err)
+	}
+
+	defer func(old int) { blocks.MaxBlockSize = old }(blocks.MaxBlockSize)
+	blocks.MaxBlockSize = 100
+	out, errc = Blocks(context.Background(), NewSizeSplitter(bytes.NewReader(randomData(5, 300)), 200))
+	for range out {
+	}
+	if err := <-errc; err != blocks.ErrBlockTooLarge {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestFromString(t *testing.T) {
+	for _, spec := range []string{"", "size-100", "rabin", "rabin-1000", "rabin-10-100-1000", "buzhash"} {
+		if _, err := FromString(bytes.NewReader(nil), spec); err != nil {
+			t.Errorf("%q: %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"size", "size-0", "size-x", "rabin-1-2", "rabin-100-10-1000", "buzhash-1", "fixed-100"} {
+		if _, err := FromString(bytes.NewReader(nil), spec); err != ErrBadSpec {
+			t.Errorf("%q: got %v", spec, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package chunk
+
+import (
+	"io"
+	"sync"
+)
+
+// rabinPoly is the irreducible polynomial over GF(2), of degree 53, that
+// Rabin fingerprints are taken modulo. Changing it moves every cut.
+const rabinPoly = 0x3DA3358B4DC173
+
+const (
+	rabinWindow = 64
+	rabinShift  = 53 - 8
+)
+
+// NewRabin returns a Splitter cutting |r| with Rabin fingerprints, into
+// chunks of |avg| bytes on average, at least a third of that and at most
+// half again as much.
+func NewRabin(r io.Reader, avg int) Splitter {
+	return NewRabinMinMax(r, avg/3, avg, avg+avg/2)
+}
+
+// NewRabinMinMax is NewRabin, with chunks of |avg| bytes on average, at
+// least |min| and at most |max|.
+func NewRabinMinMax(r io.Reader, min, avg, max int) Splitter {
+	rabinOnce.Do(fillRabinTables)
+	return newCDC(r, &rabin{}, min, avg, max)
+}
+
+var (
+	rabinOnce sync.Once
+	// rabinOut[b] is the fingerprint of b followed by a window less one
+	// zeros, to drop b from the window; rabinMod[b] reduces a fingerprint
+	// whose top byte, once shifted, is b.
+	rabinOut, rabinMod [256]uint64
+)
+
+func fillRabinTables() {
+	for b := 0; b < 256; b++ {
+		h := appendByte(0, byte(b))
+		for i := 0; i < rabinWindow-1; i++ {
+			h = appendByte(h, 0)
+		}
+		rabinOut[b] = h
+	}
+	for b := 0; b < 256; b++ {
+		rabinMod[b] = polyMod(uint64(b)<<53) | uint64(b)<<53
+	}
+}
+
+func appendByte(h uint64, b byte) uint64 {
+	return polyMod(h<<8 | uint64(b))
+}
+
+func degree(x uint64) int {
+	d := -1
+	for ; x != 0; x >>= 1 {
+		d++
+	}
+	return d
+}
+
+// polyMod returns |x| modulo rabinPoly.
+func polyMod(x uint64) uint64 {
+	for d := degree(x); d >= 53; d = degree(x) {
+		x ^= rabinPoly << uint(d-53)
+	}
+	return x
+}
+
+type rabin struct {
+	win    [rabinWindow]byte
+	pos    int
+	digest uint64
+}
+
+func (h *rabin) window() int { return rabinWindow }
+
+func (h *rabin) reset() {
+	*h = rabin{}
+}
+
+func (h *rabin) roll(b byte) uint64 {
+	h.digest ^= rabinOut[h.win[h.pos]]
+	h.win[h.pos] = b
+	h.pos = (h.pos + 1) % rabinWindow
+	top := h.digest >> rabinShift
+	h.digest = (h.digest<<8 | uint64(b)) ^ rabinMod[top]
+	return h.digest
+}
@@ -0,0 +1,131 @@
+// package chunk splits data into blocks, in chunks of a fixed size or at
+// boundaries chosen by the content, so that an insertion or deletion only
+// changes the chunks around it and the rest are stored once.
+package chunk
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	blocks "github.com/ipfs/go-blocks"
+
+	context "github.com/ipfs/go-blocks/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// DefaultBlockSize is the chunk size of the splitters given none.
+const DefaultBlockSize = 256 << 10
+
+// Splitter cuts a stream into chunks.
+type Splitter interface {
+	// NextBytes returns the next chunk, never empty, or io.EOF once there
+	// are none left.
+	NextBytes() ([]byte, error)
+}
+
+// NewSizeSplitter returns a Splitter cutting |r| into chunks of |size|
+// bytes, DefaultBlockSize if not positive, the last one shorter.
+func NewSizeSplitter(r io.Reader, size int) Splitter {
+	if size <= 0 {
+		size = DefaultBlockSize
+	}
+	return &sizeSplitter{r: r, size: size}
+}
+
+type sizeSplitter struct {
+	r    io.Reader
+	size int
+	err  error
+}
+
+func (s *sizeSplitter) NextBytes() ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	buf := make([]byte, s.size)
+	n, err := io.ReadFull(s.r, buf)
+	switch err {
+	case nil:
+		return buf, nil
+	case io.ErrUnexpectedEOF:
+		s.err = io.EOF
+		return buf[:n], nil
+	default:
+		s.err = err
+		return nil, err
+	}
+}
+
+// Blocks sends a block for each chunk of |s|, in order, and closes the
+// channel after the last, or once |ctx| is done. The error channel then
+// gets the error that ended the stream, if it was not the end of the data,
+// and is closed. A chunk larger than blocks.MaxBlockSize ends it with
+// blocks.ErrBlockTooLarge.
+func Blocks(ctx context.Context, s Splitter) (<-chan *blocks.Block, <-chan error) {
+	out := make(chan *blocks.Block)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(out)
+		for {
+			data, err := s.NextBytes()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+			b, err := blocks.NewSizedBlock(data)
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return out, errc
+}
+
+// ErrBadSpec is returned by FromString for a description it can't parse.
+var ErrBadSpec = errors.New("chunk: invalid splitter description")
+
+// FromString returns the Splitter of |r| that |spec| describes, as a
+// configuration file might: "size-<size>", "rabin", "rabin-<avg>",
+// "rabin-<min>-<avg>-<max>" or "buzhash", sizes in bytes. An empty |spec|
+// is "size-" DefaultBlockSize.
+func FromString(r io.Reader, spec string) (Splitter, error) {
+	parts := strings.Split(spec, "-")
+	sizes := make([]int, len(parts)-1)
+	for i, p := range parts[1:] {
+		n, err := strconv.Atoi(p)
+		if err != nil || n <= 0 {
+			return nil, ErrBadSpec
+		}
+		sizes[i] = n
+	}
+	switch {
+	case spec == "":
+		return NewSizeSplitter(r, DefaultBlockSize), nil
+	case parts[0] == "size" && len(sizes) == 1:
+		return NewSizeSplitter(r, sizes[0]), nil
+	case parts[0] == "rabin" && len(sizes) == 0:
+		return NewRabin(r, DefaultBlockSize), nil
+	case parts[0] == "rabin" && len(sizes) == 1:
+		return NewRabin(r, sizes[0]), nil
+	case parts[0] == "rabin" && len(sizes) == 3:
+		if sizes[0] > sizes[1] || sizes[1] > sizes[2] {
+			return nil, ErrBadSpec
+		}
+		return NewRabinMinMax(r, sizes[0], sizes[1], sizes[2]), nil
+	case parts[0] == "buzhash" && len(sizes) == 0:
+		return NewBuzhash(r), nil
+	}
+	return nil, ErrBadSpec
+}
@@ -0,0 +1,207 @@
+package key
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	b58 "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-base58"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+)
+
+// Codec is a multicodec code, naming the format of a block's data.
+type Codec uint64
+
+const (
+	Raw         Codec = 0x55
+	DagProtobuf Codec = 0x70
+	DagCBOR     Codec = 0x71
+)
+
+// Base is a multibase encoding of a Cid string, named by the prefix it puts
+// in front of the encoded bytes.
+type Base byte
+
+const (
+	Base16 Base = 'f' // lowercase hex
+	Base32 Base = 'b' // lowercase RFC 4648, unpadded
+	Base58 Base = 'z' // bitcoin alphabet, as used by B58String
+)
+
+var base32Encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+var ErrInvalidCid = errors.New("key: invalid cid")
+
+// Cid is a self-describing content identifier: a multihash, and the codec of
+// the data it hashes.
+//
+// Version 0 identifiers are bare multihashes, the keys this package has
+// always used; their codec is implicitly DagProtobuf. Unlike CIDv0 proper,
+// any hash function is allowed, so that every existing Key is one. Version 1
+// identifiers carry their codec, and their Key is their binary form:
+// <varint version><varint codec><multihash>.
+type Cid struct {
+	Version int
+	Codec   Codec
+	Hash    mh.Multihash
+}
+
+// NewCidV0 returns the version 0 Cid of |h|, whose Key is Key(h).
+func NewCidV0(h mh.Multihash) Cid {
+	return Cid{Version: 0, Codec: DagProtobuf, Hash: h}
+}
+
+// NewCidV1 returns the version 1 Cid of data in |codec| hashing to |h|.
+func NewCidV1(codec Codec, h mh.Multihash) Cid {
+	return Cid{Version: 1, Codec: codec, Hash: h}
+}
+
+// Bytes returns the binary form of |c|.
+func (c Cid) Bytes() []byte {
+	if c.Version == 0 {
+		return []byte(c.Hash)
+	}
+	buf := make([]byte, 2*binary.MaxVarintLen64+len(c.Hash))
+	n := binary.PutUvarint(buf, uint64(c.Version))
+	n += binary.PutUvarint(buf[n:], uint64(c.Codec))
+	n += copy(buf[n:], c.Hash)
+	return buf[:n]
+}
+
+// Key returns the Key blocks identified by |c| are stored under.
+func (c Cid) Key() Key {
+	return Key(c.Bytes())
+}
+
+// String returns |c| in its usual encoding: base58 without a prefix for
+// version 0, as B58String does, and base32 for version 1.
+func (c Cid) String() string {
+	if c.Version == 0 {
+		return b58.Encode(c.Bytes())
+	}
+	s, _ := c.Encode(Base32)
+	return s
+}
+
+// Encode returns |c| as a multibase string in |base|. Version 0 Cids have
+// no multibase prefix, so can only be encoded as base58.
+func (c Cid) Encode(base Base) (string, error) {
+	data := c.Bytes()
+	if c.Version == 0 {
+		if base != Base58 {
+			return "", fmt.Errorf("key: version 0 cids are only encoded in base58")
+		}
+		return b58.Encode(data), nil
+	}
+	switch base {
+	case Base16:
+		return string(base) + hex.EncodeToString(data), nil
+	case Base32:
+		return string(base) + base32Encoding.EncodeToString(data), nil
+	case Base58:
+		return string(base) + b58.Encode(data), nil
+	}
+	return "", fmt.Errorf("key: unknown multibase %q", byte(base))
+}
+
+// ParseCid parses a Cid encoded by Cid.Encode, or a base58 encoded Key.
+func ParseCid(s string) (Cid, error) {
+	if len(s) < 2 {
+		return Cid{}, ErrInvalidCid
+	}
+	var data []byte
+	var err error
+	switch s[0] {
+	case 'f', 'F':
+		data, err = hex.DecodeString(strings.ToLower(s[1:]))
+	case 'b', 'B':
+		data, err = base32Encoding.DecodeString(strings.ToLower(s[1:]))
+	case 'z':
+		data = b58.Decode(s[1:])
+	default:
+		// a version 0 Cid, or any other base58 encoded Key.
+		data = b58.Decode(s)
+		c, err := CidFromBytes(data)
+		if err != nil || c.Version != 0 {
+			return Cid{}, ErrInvalidCid
+		}
+		return c, nil
+	}
+	if err != nil || len(data) == 0 {
+		return Cid{}, ErrInvalidCid
+	}
+	c, err := CidFromBytes(data)
+	if err != nil || c.Version == 0 {
+		// version 0 Cids have no multibase form.
+		return Cid{}, ErrInvalidCid
+	}
+	return c, nil
+}
+
+// CidFromBytes parses the binary form of a Cid. Data that parses as both a
+// version 1 Cid and a multihash in the application-specific range (whose
+// first byte is also 0x01) is taken to be a Cid.
+func CidFromBytes(data []byte) (Cid, error) {
+	if len(data) > 0 && data[0] == 1 {
+		if c, ok := parseCidV1(data); ok {
+			return c, nil
+		}
+	}
+	h, err := mh.Cast(data)
+	if err != nil {
+		return Cid{}, ErrInvalidCid
+	}
+	return NewCidV0(h), nil
+}
+
+func parseCidV1(data []byte) (Cid, bool) {
+	version, n := binary.Uvarint(data)
+	if n <= 0 || version != 1 {
+		return Cid{}, false
+	}
+	data = data[n:]
+	codec, n := binary.Uvarint(data)
+	if n <= 0 {
+		return Cid{}, false
+	}
+	h, err := mh.Cast(data[n:])
+	if err != nil {
+		return Cid{}, false
+	}
+	return NewCidV1(Codec(codec), h), true
+}
+
+// Cid parses |k| as the binary form of a Cid. Every multihash is a valid,
+// version 0, Key.
+func (k Key) Cid() (Cid, error) {
+	return CidFromBytes([]byte(k))
+}
+
+// Identity is the multihash code of the identity function, whose digest is
+// the data itself: a Key with an identity multihash holds its block.
+const Identity = 0x00
+
+// InlineData returns the data of the block |k| holds, if it has an identity
+// multihash.
+func (k Key) InlineData() ([]byte, bool) {
+	h, err := k.Hash()
+	if err != nil {
+		return nil, false
+	}
+	if dec, err := mh.Decode(h); err == nil && dec.Code == Identity {
+		return dec.Digest, true
+	}
+	return nil, false
+}
+
+// Hash returns the multihash |k| identifies its block by, or ErrInvalidCid.
+func (k Key) Hash() (mh.Multihash, error) {
+	c, err := k.Cid()
+	if err != nil {
+		return nil, err
+	}
+	return c.Hash, nil
+}
@@ -0,0 +1,78 @@
+package key
+
+import (
+	"testing"
+
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+)
+
+func TestCidRoundTrip(t *testing.T) {
+	h, err := mh.Sum([]byte("beep boop"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := NewCidV1(DagCBOR, h)
+	for _, base := range []Base{Base16, Base32, Base58} {
+		s, err := v1.Encode(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s[0] != byte(base) {
+			t.Fatalf("%q lacks its multibase prefix %q", s, byte(base))
+		}
+		got, err := ParseCid(s)
+		if err != nil {
+			t.Fatalf("parsing %q: %s", s, err)
+		}
+		if got.Key() != v1.Key() || got.Codec != DagCBOR || got.Version != 1 {
+			t.Fatalf("%q parsed as %+v", s, got)
+		}
+	}
+
+	got, err := v1.Key().Cid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 1 || got.Codec != DagCBOR || string(got.Hash) != string(h) {
+		t.Fatalf("key parsed as %+v", got)
+	}
+	if kh, err := v1.Key().Hash(); err != nil || string(kh) != string(h) {
+		t.Fatalf("expected the multihash back, got %v, %v", kh, err)
+	}
+}
+
+func TestCidV0IsMultihashKey(t *testing.T) {
+	h, err := mh.Sum([]byte("beep boop"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key(h)
+	c, err := k.Cid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != 0 || c.Key() != k {
+		t.Fatalf("raw multihash key parsed as %+v", c)
+	}
+	if c.String() != k.B58String() {
+		t.Fatalf("expected %s, got %s", k.B58String(), c.String())
+	}
+	parsed, err := ParseCid(k.B58String())
+	if err != nil || parsed.Key() != k {
+		t.Fatalf("b58 key parsed as %+v, %v", parsed, err)
+	}
+	if _, err := c.Encode(Base32); err == nil {
+		t.Fatal("expected version 0 cids to have no base32 form")
+	}
+}
+
+func TestParseCidInvalid(t *testing.T) {
+	for _, s := range []string{"", "b", "bnotbase32!", "f0", "zzz", "Qm"} {
+		if _, err := ParseCid(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+	if _, err := Key("not a multihash").Cid(); err != ErrInvalidCid {
+		t.Fatalf("expected ErrInvalidCid, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package key
+
+import (
+	"encoding/base32"
+	"strings"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+)
+
+// The conversions below are exact, unlike B58KeyDecode, which drops what it
+// can't decode, and DsKey, which cleans the key as a path, so that a Key
+// holding a '/' byte does not survive it. Each decoding accepts only the
+// well formed Keys, as FromBytes does, in the one form its encoding gives
+// them, so that for every well formed Key k, and every s decoded without
+// error:
+//
+//	DecodeB58(k.B58String()) == k    DecodeB58(s).B58String() == s
+//	DecodeB32(k.B32String()) == k    DecodeB32(s).B32String() == s
+//	FromDsKeyB32(k.DsKeyB32()) == k  FromDsKeyB32(s).DsKeyB32() == s
+//	FromBytes([]byte(k)) == k        FromMultihash(h) == Key(h)
+
+// b32Encoding is the unpadded, upper case, RFC 4648 base32 that datastore
+// keys are commonly given in, as file names that case-insensitive file
+// systems keep apart.
+var b32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// B32String returns |k| in unpadded upper case base32, without a multibase
+// prefix.
+func (k Key) B32String() string {
+	return b32Encoding.EncodeToString([]byte(k))
+}
+
+// DecodeB32 is the inverse of B32String, for the Keys FromBytes accepts.
+func DecodeB32(s string) (Key, error) {
+	switch {
+	case s == "":
+		return "", decodeError(s, ErrEmpty)
+	case len(s) > maxEncodedSize:
+		return "", decodeError(s, ErrTooLong)
+	}
+	// the decoder takes lower case, and ignores line breaks.
+	if s != strings.ToUpper(s) || strings.ContainsAny(s, "\r\n") {
+		return "", decodeError(s, ErrInvalidEncoding)
+	}
+	data, err := b32Encoding.DecodeString(s)
+	if err != nil || b32Encoding.EncodeToString(data) != s {
+		return "", decodeError(s, ErrInvalidEncoding)
+	}
+	if _, err := decodeCid(data); err != nil {
+		return "", decodeError(s, err)
+	}
+	return Key(data), nil
+}
+
+// DsKeyB32 returns the datastore key of |k| with the Key as its one
+// namespace, in base32, as B32String gives it. Unlike DsKey, it holds any
+// Key intact, but it is not the key blockstores store blocks under.
+func (k Key) DsKeyB32() ds.Key {
+	return ds.NewKey("/" + k.B32String())
+}
+
+// FromDsKeyB32 is the inverse of DsKeyB32.
+func FromDsKeyB32(dk ds.Key) (Key, error) {
+	s := dk.String()
+	if strings.Count(s, "/") != 1 {
+		return "", decodeError(s, ErrInvalidEncoding)
+	}
+	return DecodeB32(s[1:])
+}
+
+// FromMultihash returns the version 0 Key of |h|, if it is a well formed
+// multihash, as DecodeMultihash checks it.
+func FromMultihash(h mh.Multihash) (Key, error) {
+	if _, err := DecodeMultihash(h); err != nil {
+		return "", err
+	}
+	return Key(h), nil
+}
@@ -0,0 +1,105 @@
+package key
+
+import (
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+)
+
+// slashKey returns a well formed Key holding "//" and a trailing '/', which
+// DsKey changes.
+func slashKey(t testing.TB) Key {
+	h, err := mh.Encode([]byte("a//b/"), mh.SHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Key(h)
+}
+
+func TestConversionsKeepKeysIntact(t *testing.T) {
+	h, err := mh.Sum([]byte("beep boop"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := slashKey(t)
+	if KeyFromDsKey(k.DsKey()) == k {
+		t.Fatal("expected DsKey to change the key")
+	}
+	for _, k := range []Key{Key(h), NewCidV1(Raw, h).Key(), k} {
+		if got, err := DecodeB58(k.B58String()); err != nil || got != k {
+			t.Fatalf("base58: got %q, %v", got, err)
+		}
+		if got, err := DecodeB32(k.B32String()); err != nil || got != k {
+			t.Fatalf("base32: got %q, %v", got, err)
+		}
+		if got, err := FromDsKeyB32(k.DsKeyB32()); err != nil || got != k {
+			t.Fatalf("datastore key: got %q, %v", got, err)
+		}
+	}
+	if got, err := FromMultihash(h); err != nil || got != Key(h) {
+		t.Fatalf("multihash: got %q, %v", got, err)
+	}
+}
+
+func TestConversionsAreStrict(t *testing.T) {
+	k := slashKey(t)
+	b32 := k.B32String()
+	for _, s := range []string{"", strings.ToLower(b32), b32 + "A", b32[:len(b32)-1] + "\n" + b32[len(b32)-1:], "AAAA", "1"} {
+		if _, err := DecodeB32(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+	for _, dk := range []ds.Key{ds.NewKey("/"), ds.NewKey("/a/" + b32), ds.NewKey("/" + strings.ToLower(b32))} {
+		if _, err := FromDsKeyB32(dk); err == nil {
+			t.Errorf("%s: expected an error", dk)
+		}
+	}
+	if _, err := FromMultihash(mh.Multihash{0x12, 0x01}); err == nil {
+		t.Error("expected an error for a truncated multihash")
+	}
+}
+
+func FuzzBinaryKey(f *testing.F) {
+	h, _ := mh.Sum([]byte("seed"), mh.SHA2_256, -1)
+	f.Add([]byte(h))
+	f.Add(NewCidV1(Raw, h).Bytes())
+	f.Add([]byte(slashKey(f)))
+	f.Add([]byte{0xff, 0xfe, '/', 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		k, err := FromBytes(data)
+		if err != nil {
+			return
+		}
+		if got, err := DecodeB58(k.B58String()); err != nil || got != k {
+			t.Fatalf("base58: got %q, %v", got, err)
+		}
+		if got, err := DecodeB32(k.B32String()); err != nil || got != k {
+			t.Fatalf("base32: got %q, %v", got, err)
+		}
+		if got, err := FromDsKeyB32(k.DsKeyB32()); err != nil || got != k {
+			t.Fatalf("datastore key: got %q, %v", got, err)
+		}
+	})
+}
+
+func FuzzTextKey(f *testing.F) {
+	k := slashKey(f)
+	f.Add(k.B58String())
+	f.Add(k.B32String())
+	f.Add("AAAAAAAA")
+	f.Add("Qm")
+	f.Fuzz(func(t *testing.T, s string) {
+		if k, err := DecodeB58(s); err == nil && k.B58String() != s {
+			t.Fatalf("base58 %q came back as %q", s, k.B58String())
+		}
+		if k, err := DecodeB32(s); err == nil && k.B32String() != s {
+			t.Fatalf("base32 %q came back as %q", s, k.B32String())
+		}
+		dk := ds.NewKey(s)
+		if k, err := FromDsKeyB32(dk); err == nil && !k.DsKeyB32().Equal(dk) {
+			t.Fatalf("datastore key %s came back as %s", dk, k.DsKeyB32())
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package key
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	b58 "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-base58"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+)
+
+// The reasons Decode and its variants reject their input for, which the
+// *DecodeError they return wraps.
+var (
+	ErrEmpty = errors.New("key: empty input")
+	// ErrTooLong is for input longer than MaxKeySize bytes, or its
+	// encoding.
+	ErrTooLong = errors.New("key: input too long")
+	// ErrUnknownBase is for a multibase prefix other than those of Base.
+	ErrUnknownBase = errors.New("key: unknown multibase")
+	// ErrInvalidEncoding is for characters outside the alphabet of the
+	// base, or an encoding that is not the one the decoded bytes have.
+	ErrInvalidEncoding = errors.New("key: invalid encoding")
+	// ErrInvalidVersion is for a Cid version other than 1 in a multibase
+	// string, or one not minimally varint encoded.
+	ErrInvalidVersion = errors.New("key: invalid cid version")
+	// ErrInvalidMultihash is for a multihash too short to hold its
+	// function and length, or whose length is not that of its digest.
+	ErrInvalidMultihash = errors.New("key: invalid multihash")
+	// ErrUnknownHash is for a multihash function mh.ValidCode rejects.
+	ErrUnknownHash = errors.New("key: unknown multihash function")
+	// ErrDigestLength is for a digest longer than its function makes.
+	ErrDigestLength = errors.New("key: digest longer than its hash function makes")
+)
+
+// MaxKeySize is the largest binary Key Decode accepts: a version 1 Cid
+// with the longest multihash.
+const MaxKeySize = 2*binary.MaxVarintLen64 + 129
+
+// maxEncodedSize bounds the strings Decode reads, base16 being the longest.
+const maxEncodedSize = 1 + 2*MaxKeySize
+
+// DecodeError is returned by Decode and its variants for input they reject,
+// with one of the errors above as the reason.
+type DecodeError struct {
+	// Input is the rejected input, truncated to 64 bytes.
+	Input string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: %q", e.Err, e.Input)
+}
+
+// Unwrap returns the reason.
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+func decodeError(input string, err error) error {
+	if len(input) > 64 {
+		input = input[:64]
+	}
+	return &DecodeError{Input: input, Err: err}
+}
+
+// Decode parses |s| as ParseCid does, returning the Key of the Cid: a base58
+// Key, or a version 1 Cid encoded by Cid.Encode. Unlike ParseCid, and
+// B58KeyDecode, it is strict, for keys from untrusted sources: |s| must be
+// the exact encoding of a well formed Cid, and the error says what is wrong
+// with it.
+func Decode(s string) (Key, error) {
+	c, err := DecodeCid(s)
+	if err != nil {
+		return "", err
+	}
+	return c.Key(), nil
+}
+
+// DecodeCid is Decode, returning the Cid.
+func DecodeCid(s string) (Cid, error) {
+	switch {
+	case s == "":
+		return Cid{}, decodeError(s, ErrEmpty)
+	case len(s) > maxEncodedSize:
+		return Cid{}, decodeError(s, ErrTooLong)
+	}
+	var data []byte
+	switch s[0] {
+	case 'f', 'F':
+		digits := s[1:]
+		if s[0] == 'f' && digits != strings.ToLower(digits) || s[0] == 'F' && digits != strings.ToUpper(digits) {
+			return Cid{}, decodeError(s, ErrInvalidEncoding)
+		}
+		var err error
+		if data, err = hex.DecodeString(strings.ToLower(digits)); err != nil {
+			return Cid{}, decodeError(s, ErrInvalidEncoding)
+		}
+	case 'b', 'B':
+		digits := s[1:]
+		if s[0] == 'b' && digits != strings.ToLower(digits) || s[0] == 'B' && digits != strings.ToUpper(digits) {
+			return Cid{}, decodeError(s, ErrInvalidEncoding)
+		}
+		var err error
+		if data, err = base32Encoding.DecodeString(strings.ToLower(digits)); err != nil {
+			return Cid{}, decodeError(s, ErrInvalidEncoding)
+		}
+	case 'z':
+		var err error
+		if data, err = decodeB58(s[1:]); err != nil {
+			return Cid{}, decodeError(s, err)
+		}
+	default:
+		if !isB58(s[:1]) {
+			return Cid{}, decodeError(s, ErrUnknownBase)
+		}
+		// a version 0 Cid, or any other base58 encoded Key.
+		data, err := decodeB58(s)
+		if err != nil {
+			return Cid{}, decodeError(s, err)
+		}
+		c, err := decodeCid(data)
+		if err != nil {
+			return Cid{}, decodeError(s, err)
+		}
+		if c.Version != 0 {
+			// version 1 Cids have a multibase prefix.
+			return Cid{}, decodeError(s, ErrUnknownBase)
+		}
+		return c, nil
+	}
+	if len(data) == 0 {
+		return Cid{}, decodeError(s, ErrEmpty)
+	}
+	c, err := decodeCid(data)
+	if err != nil {
+		return Cid{}, decodeError(s, err)
+	}
+	if c.Version == 0 {
+		// version 0 Cids have no multibase form.
+		return Cid{}, decodeError(s, ErrInvalidVersion)
+	}
+	return c, nil
+}
+
+// DecodeB58 is B58KeyDecode, but strict, as Decode is: |s| must be the
+// base58 encoding of a Key that is a well formed Cid, of either version.
+func DecodeB58(s string) (Key, error) {
+	switch {
+	case s == "":
+		return "", decodeError(s, ErrEmpty)
+	case len(s) > maxEncodedSize:
+		return "", decodeError(s, ErrTooLong)
+	}
+	data, err := decodeB58(s)
+	if err != nil {
+		return "", decodeError(s, err)
+	}
+	if _, err := decodeCid(data); err != nil {
+		return "", decodeError(s, err)
+	}
+	return Key(data), nil
+}
+
+// FromBytes returns |data| as a Key, if it is the binary form of a well
+// formed Cid, as CidFromBytes parses it.
+func FromBytes(data []byte) (Key, error) {
+	s := string(data)
+	switch {
+	case len(data) == 0:
+		return "", decodeError(s, ErrEmpty)
+	case len(data) > MaxKeySize:
+		return "", decodeError(s, ErrTooLong)
+	}
+	if _, err := decodeCid(data); err != nil {
+		return "", decodeError(s, err)
+	}
+	return Key(data), nil
+}
+
+// DecodeMultihash returns |data| as a multihash, if it is a well formed one
+// with a digest no longer than its function makes.
+func DecodeMultihash(data []byte) (mh.Multihash, error) {
+	h, err := decodeMultihash(data)
+	if err != nil {
+		return nil, decodeError(string(data), err)
+	}
+	return h, nil
+}
+
+// Validate reports what is wrong with |k|, as FromBytes does, or nil if it
+// is a well formed Cid.
+func (k Key) Validate() error {
+	_, err := FromBytes([]byte(k))
+	return err
+}
+
+func isB58(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(b58.BTCAlphabet, s[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeB58 decodes |s|, which must encode its bytes the one way base58
+// does.
+func decodeB58(s string) ([]byte, error) {
+	if !isB58(s) {
+		return nil, ErrInvalidEncoding
+	}
+	data := b58.Decode(s)
+	if b58.Encode(data) != s {
+		return nil, ErrInvalidEncoding
+	}
+	if len(data) == 0 {
+		return nil, ErrEmpty
+	}
+	return data, nil
+}
+
+// decodeCid is CidFromBytes, but strict, and saying why it fails: data
+// that is not a version 1 Cid is parsed as a multihash, and the multihash's
+// error returned.
+func decodeCid(data []byte) (Cid, error) {
+	if len(data) > MaxKeySize {
+		return Cid{}, ErrTooLong
+	}
+	if len(data) > 0 && data[0] == 1 {
+		if c, err := decodeCidV1(data); err == nil {
+			return c, nil
+		}
+	}
+	h, err := decodeMultihash(data)
+	if err != nil {
+		return Cid{}, err
+	}
+	return NewCidV0(h), nil
+}
+
+func decodeCidV1(data []byte) (Cid, error) {
+	version, n := readUvarint(data)
+	if n <= 0 || version != 1 {
+		return Cid{}, ErrInvalidVersion
+	}
+	data = data[n:]
+	codec, n := readUvarint(data)
+	if n <= 0 {
+		return Cid{}, ErrInvalidEncoding
+	}
+	h, err := decodeMultihash(data[n:])
+	if err != nil {
+		return Cid{}, err
+	}
+	return NewCidV1(Codec(codec), h), nil
+}
+
+// readUvarint is binary.Uvarint, but refuses varints not minimally encoded,
+// so that a Cid has one binary form.
+func readUvarint(data []byte) (uint64, int) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, n
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if binary.PutUvarint(buf[:], v) != n {
+		return 0, -1
+	}
+	return v, n
+}
+
+// decodeMultihash is mh.Cast, saying why it fails, and refusing digests
+// longer than their function makes.
+func decodeMultihash(data []byte) (mh.Multihash, error) {
+	if len(data) < 2 {
+		return nil, ErrInvalidMultihash
+	}
+	code, length := int(data[0]), int(data[1])
+	if !mh.ValidCode(code) {
+		return nil, ErrUnknownHash
+	}
+	if len(data)-2 != length {
+		return nil, ErrInvalidMultihash
+	}
+	if max, ok := mh.DefaultLengths[code]; ok && code != Identity && length > max {
+		return nil, ErrDigestLength
+	}
+	h, err := mh.Cast(data)
+	if err != nil {
+		return nil, ErrInvalidMultihash
+	}
+	return h, nil
+}
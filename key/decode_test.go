@@ -0,0 +1,106 @@
+package key
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	b58 "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-base58"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+)
+
+func TestDecode(t *testing.T) {
+	h, err := mh.Sum([]byte("beep boop"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v0, v1 := NewCidV0(h), NewCidV1(Raw, h)
+	inputs := map[string]Key{v0.String(): v0.Key()}
+	for _, base := range []Base{Base16, Base32, Base58} {
+		s, err := v1.Encode(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs[s] = v1.Key()
+	}
+	b32, _ := v1.Encode(Base32)
+	inputs["B"+strings.ToUpper(b32[1:])] = v1.Key()
+	for s, want := range inputs {
+		if k, err := Decode(s); err != nil || k != want {
+			t.Fatalf("%q decoded as %q, %v", s, k, err)
+		}
+	}
+	if k, err := DecodeB58(v1.Key().B58String()); err != nil || k != v1.Key() {
+		t.Fatalf("expected the base58 key back, got %q, %v", k, err)
+	}
+	if k, err := FromBytes([]byte(v0.Key())); err != nil || k != v0.Key() {
+		t.Fatalf("expected the binary key back, got %q, %v", k, err)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	h, _ := mh.Sum([]byte("beep boop"), mh.SHA2_256, -1)
+	b32, _ := NewCidV1(Raw, h).Encode(Base32)
+	short := append([]byte{mh.SHA2_256, 32}, h[2:20]...)
+	long := append([]byte{mh.SHA2_256, 40}, make([]byte, 40)...)
+	unknown := append([]byte{0x42, 2}, 1, 2)
+
+	cases := []struct {
+		in   string
+		want error
+	}{
+		{"", ErrEmpty},
+		{strings.Repeat("Q", maxEncodedSize+1), ErrTooLong},
+		{"!abc", ErrUnknownBase},
+		{"b" + strings.ToUpper(b32[1:]), ErrInvalidEncoding},
+		{"bnotbase32!", ErrInvalidEncoding},
+		{"f0", ErrInvalidEncoding},
+		{"Qm0OIl", ErrInvalidEncoding},
+		{"1" + h.B58String(), ErrInvalidMultihash},
+		{"z" + b58.Encode(short), ErrInvalidMultihash},
+		{"z" + b58.Encode(long), ErrDigestLength},
+		{"z" + b58.Encode(unknown), ErrUnknownHash},
+		{"z" + h.B58String(), ErrInvalidVersion},
+	}
+	for _, c := range cases {
+		_, err := Decode(c.in)
+		de, ok := err.(*DecodeError)
+		if !ok || de.Err != c.want {
+			t.Errorf("%.20q: expected %v, got %v", c.in, c.want, err)
+		}
+	}
+	if _, err := FromBytes([]byte("not a multihash")); err == nil {
+		t.Fatal("expected a bad binary key to be rejected")
+	}
+	if err := Key(short).Validate(); err == nil {
+		t.Fatal("expected a truncated digest to be rejected")
+	}
+}
+
+func TestDecodeRandomInput(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		buf := make([]byte, r.Intn(64))
+		r.Read(buf)
+		if k, err := FromBytes(buf); err == nil {
+			if _, err := k.Cid(); err != nil {
+				t.Fatalf("accepted %x, which does not parse: %s", buf, err)
+			}
+		}
+		s := string(buf)
+		if len(buf) > 0 {
+			s = b58.Encode(buf)
+		}
+		if k, err := Decode(s); err == nil {
+			if c, err := DecodeCid(encoded(k)); err != nil || c.Key() != k {
+				t.Fatalf("accepted %q, which does not round trip: %v", s, err)
+			}
+		}
+	}
+}
+
+// encoded returns the string Decode reads |k| back from.
+func encoded(k Key) string {
+	c, _ := k.Cid()
+	return c.String()
+}
@@ -42,7 +42,8 @@ func B58KeyEncode(k Key) string {
 	return b58.Encode([]byte(k))
 }
 
-// DsKey returns a Datastore key
+// DsKey returns a Datastore key. It is cleaned as a path, which changes a
+// Key holding a '/' byte; DsKeyB32 holds every Key intact.
 func (k Key) DsKey() ds.Key {
 	return ds.NewKey(string(k))
 }
@@ -1,46 +1,218 @@
 package key
 
 import (
+	"errors"
 	"sync"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dsq "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/query"
 )
 
+// KeySet is a set of keys, safe for concurrent use.
 type KeySet interface {
 	Add(Key)
 	Remove(Key)
+	Has(Key) bool
+	Len() int
+	// Keys returns the keys of the set, in no particular order.
 	Keys() []Key
+	// ForEach calls |f| with each key of the set, in no particular order,
+	// until it returns false.
+	ForEach(f func(Key) bool)
 }
 
-type ks struct {
+// MapKeySet is a KeySet held in memory. The zero value is an empty set.
+type MapKeySet struct {
 	lock sync.RWMutex
 	data map[Key]struct{}
 }
 
+// NewKeySet returns an empty MapKeySet.
 func NewKeySet() KeySet {
-	return &ks{
-		data: make(map[Key]struct{}),
-	}
+	return &MapKeySet{}
 }
 
-func (wl *ks) Add(k Key) {
+func (wl *MapKeySet) Add(k Key) {
 	wl.lock.Lock()
 	defer wl.lock.Unlock()
 
+	if wl.data == nil {
+		wl.data = make(map[Key]struct{})
+	}
 	wl.data[k] = struct{}{}
 }
 
-func (wl *ks) Remove(k Key) {
+func (wl *MapKeySet) Remove(k Key) {
 	wl.lock.Lock()
 	defer wl.lock.Unlock()
 
 	delete(wl.data, k)
 }
 
-func (wl *ks) Keys() []Key {
+func (wl *MapKeySet) Has(k Key) bool {
+	wl.lock.RLock()
+	defer wl.lock.RUnlock()
+	_, ok := wl.data[k]
+	return ok
+}
+
+func (wl *MapKeySet) Len() int {
 	wl.lock.RLock()
 	defer wl.lock.RUnlock()
-	keys := make([]Key, 0)
+	return len(wl.data)
+}
+
+func (wl *MapKeySet) Keys() []Key {
+	wl.lock.RLock()
+	defer wl.lock.RUnlock()
+	keys := make([]Key, 0, len(wl.data))
 	for k := range wl.data {
 		keys = append(keys, k)
 	}
 	return keys
 }
+
+// ForEach calls |f| with the keys the set has when it is called, so that |f|
+// may change the set.
+func (wl *MapKeySet) ForEach(f func(Key) bool) {
+	for _, k := range wl.Keys() {
+		if !f(k) {
+			return
+		}
+	}
+}
+
+// DatastoreKeySet is a KeySet kept in a datastore, for sets too large to hold
+// in memory, or that must outlive the process: each key is an entry of the
+// datastore, named by its base58 form, with an empty value. Two sets must not
+// share a datastore, though a namespace of one will do.
+//
+// As a KeySet cannot fail, a datastore error is kept, and returned by Err;
+// the operation that hit it acts as if on an empty set.
+type DatastoreKeySet struct {
+	d ds.Datastore
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewDatastoreKeySet returns the set kept in |d|.
+func NewDatastoreKeySet(d ds.Datastore) *DatastoreKeySet {
+	return &DatastoreKeySet{d: d}
+}
+
+// Err returns the first datastore error the set hit, if any.
+func (s *DatastoreKeySet) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *DatastoreKeySet) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *DatastoreKeySet) dsKey(k Key) ds.Key {
+	return ds.NewKey(k.B58String())
+}
+
+func (s *DatastoreKeySet) Add(k Key) {
+	if err := s.d.Put(s.dsKey(k), []byte{}); err != nil {
+		s.fail(err)
+	}
+}
+
+func (s *DatastoreKeySet) Remove(k Key) {
+	if err := s.d.Delete(s.dsKey(k)); err != nil && !errors.Is(err, ds.ErrNotFound) {
+		s.fail(err)
+	}
+}
+
+func (s *DatastoreKeySet) Has(k Key) bool {
+	ok, err := s.d.Has(s.dsKey(k))
+	if err != nil {
+		s.fail(err)
+	}
+	return ok
+}
+
+// Len counts the keys, which takes listing them.
+func (s *DatastoreKeySet) Len() int {
+	n := 0
+	s.ForEach(func(Key) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func (s *DatastoreKeySet) Keys() []Key {
+	var keys []Key
+	s.ForEach(func(k Key) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+// ForEach lists the keys from the datastore as it goes, so |f| must not
+// change the set. Entries not named like the keys of a set are skipped.
+func (s *DatastoreKeySet) ForEach(f func(Key) bool) {
+	res, err := s.d.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	defer res.Close()
+	for e := range res.Next() {
+		if e.Error != nil {
+			s.fail(e.Error)
+			return
+		}
+		k, err := DecodeB58(ds.NewKey(e.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+		if !f(k) {
+			return
+		}
+	}
+}
+
+// Union adds the keys of every one of |sets| to |dst|.
+func Union(dst KeySet, sets ...KeySet) {
+	for _, s := range sets {
+		if s == dst {
+			continue
+		}
+		s.ForEach(func(k Key) bool {
+			dst.Add(k)
+			return true
+		})
+	}
+}
+
+// Intersect adds the keys of |a| that are also in |b| to |dst|. Iterating
+// the smaller of the two as |a| is faster.
+func Intersect(dst, a, b KeySet) {
+	a.ForEach(func(k Key) bool {
+		if b.Has(k) {
+			dst.Add(k)
+		}
+		return true
+	})
+}
+
+// Difference adds the keys of |a| that are not in |b| to |dst|.
+func Difference(dst, a, b KeySet) {
+	a.ForEach(func(k Key) bool {
+		if !b.Has(k) {
+			dst.Add(k)
+		}
+		return true
+	})
+}
@@ -0,0 +1,89 @@
+package key
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	ds "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore"
+	dssync "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-datastore/sync"
+	mh "github.com/ipfs/go-blocks/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+)
+
+func testKey(t *testing.T, i int) Key {
+	h, err := mh.Sum([]byte(fmt.Sprintf("key %d", i)), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Key(h)
+}
+
+func sortedKeys(s KeySet) []Key {
+	ks := s.Keys()
+	sort.Sort(KeySlice(ks))
+	return ks
+}
+
+func TestKeySets(t *testing.T) {
+	for name, newSet := range map[string]func() KeySet{
+		"map":       NewKeySet,
+		"datastore": func() KeySet { return NewDatastoreKeySet(dssync.MutexWrap(ds.NewMapDatastore())) },
+	} {
+		s := newSet()
+		for i := 0; i < 5; i++ {
+			s.Add(testKey(t, i))
+		}
+		s.Add(testKey(t, 0))
+		s.Remove(testKey(t, 4))
+		s.Remove(testKey(t, 9))
+		if s.Len() != 4 {
+			t.Fatalf("%s: expected 4 keys, got %d", name, s.Len())
+		}
+		if !s.Has(testKey(t, 3)) || s.Has(testKey(t, 4)) {
+			t.Fatalf("%s: wrong membership", name)
+		}
+		n := 0
+		s.ForEach(func(Key) bool {
+			n++
+			return n < 2
+		})
+		if n != 2 {
+			t.Fatalf("%s: ForEach did not stop, called %d times", name, n)
+		}
+		if d, ok := s.(*DatastoreKeySet); ok && d.Err() != nil {
+			t.Fatal(d.Err())
+		}
+	}
+}
+
+func TestKeySetArithmetic(t *testing.T) {
+	a, b := NewKeySet(), NewDatastoreKeySet(dssync.MutexWrap(ds.NewMapDatastore()))
+	for i := 0; i < 4; i++ {
+		a.Add(testKey(t, i))
+		b.Add(testKey(t, i+2))
+	}
+	expect := func(what string, s KeySet, is ...int) {
+		var want []Key
+		for _, i := range is {
+			want = append(want, testKey(t, i))
+		}
+		sort.Sort(KeySlice(want))
+		got := sortedKeys(s)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: expected %v, got %v", what, want, got)
+		}
+	}
+
+	u := NewKeySet()
+	Union(u, a, b)
+	expect("union", u, 0, 1, 2, 3, 4, 5)
+	i := NewDatastoreKeySet(dssync.MutexWrap(ds.NewMapDatastore()))
+	Intersect(i, b, a)
+	expect("intersection", i, 2, 3)
+	d := NewKeySet()
+	Difference(d, a, b)
+	expect("difference", d, 0, 1)
+	if b.Err() != nil || i.Err() != nil {
+		t.Fatal(b.Err(), i.Err())
+	}
+}
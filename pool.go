@@ -0,0 +1,96 @@
+package blocks
+
+import (
+	"sync"
+
+	key "github.com/ipfs/go-blocks/key"
+)
+
+// The sizes of the buffers a BufferPool keeps: powers of two from 4KiB to
+// 16MiB. Larger buffers are allocated, and dropped, as needed.
+const (
+	minPoolShift = 12
+	maxPoolShift = 24
+)
+
+// BufferPool recycles the buffers holding block data, so that services
+// reading many blocks don't leave each one's data for the garbage collector.
+// Buffers are kept by size, in powers of two. It is safe for concurrent use.
+type BufferPool struct {
+	classes [maxPoolShift - minPoolShift + 1]sync.Pool
+}
+
+// NewBufferPool returns an empty BufferPool.
+func NewBufferPool() *BufferPool {
+	return &BufferPool{}
+}
+
+// class returns the index of the smallest class holding |n| bytes, or -1 if
+// none does.
+func class(n int) int {
+	for c := 0; c <= maxPoolShift-minPoolShift; c++ {
+		if n <= 1<<uint(minPoolShift+c) {
+			return c
+		}
+	}
+	return -1
+}
+
+// Get returns a buffer of |n| bytes, whose contents are undefined.
+func (p *BufferPool) Get(n int) []byte {
+	c := class(n)
+	if c < 0 {
+		return make([]byte, n)
+	}
+	if buf, ok := p.classes[c].Get().(*[]byte); ok {
+		return (*buf)[:n]
+	}
+	return make([]byte, n, 1<<uint(minPoolShift+c))
+}
+
+// Put returns |buf|, which must have come from Get and must no longer be
+// used, to the pool.
+func (p *BufferPool) Put(buf []byte) {
+	c := class(cap(buf))
+	if c < 0 || cap(buf) != 1<<uint(minPoolShift+c) {
+		return // not one of ours.
+	}
+	buf = buf[:0]
+	p.classes[c].Put(&buf)
+}
+
+// NewPooledBlock is NewBlockWithKey for |data| from |p|.Get, which becomes
+// the block's: Release returns it to |p|.
+func NewPooledBlock(data []byte, k key.Key, p *BufferPool) (*Block, error) {
+	b, err := NewBlockWithKey(data, k)
+	if err != nil {
+		return nil, err
+	}
+	b.pool = p
+	return b, nil
+}
+
+// Release returns the data of a block made by NewPooledBlock to its pool,
+// and sets Data to nil. The data must no longer be used, by anyone given the
+// block. Releasing any other block, or one already released, does nothing,
+// so releasing every block read from a service with a pool is safe.
+func (b *Block) Release() {
+	if b.pool == nil {
+		return
+	}
+	b.pool.Put(b.Data)
+	b.pool, b.Data = nil, nil
+}
+
+// Unpooled returns |b| if Release does nothing to it, and otherwise a copy
+// holding a copy of its data, so that the block can be handed to several
+// users, each free to release what it gets.
+func (b *Block) Unpooled() *Block {
+	if b.pool == nil {
+		return b
+	}
+	cp := *b
+	cp.Data = append([]byte(nil), b.Data...)
+	cp.pool = nil
+	return &cp
+}
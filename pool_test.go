@@ -0,0 +1,45 @@
+package blocks
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := NewBufferPool()
+	buf := p.Get(5000)
+	if len(buf) != 5000 || cap(buf) != 8192 {
+		t.Fatalf("expected 5000 bytes in an 8KiB buffer, got %d of %d", len(buf), cap(buf))
+	}
+	if big := p.Get(32 << 20); len(big) != 32<<20 {
+		t.Fatalf("expected a buffer past the largest class, got %d bytes", len(big))
+	}
+
+	data := []byte("pooled block")
+	buf = append(p.Get(len(data))[:0], data...)
+	b, err := NewPooledBlock(buf, NewBlock(data).Key(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Data, data) || b.Key() != NewBlock(data).Key() {
+		t.Fatalf("pooled block made as %v, %q", b, b.Data)
+	}
+	cp := b.Unpooled()
+	b.Release()
+	if cp.Release(); !bytes.Equal(cp.Data, data) {
+		t.Fatalf("expected the unpooled copy to keep its data, got %q", cp.Data)
+	}
+	if b.Data != nil {
+		t.Fatal("released block kept its data")
+	}
+	b.Release() // a second release does nothing.
+
+	plain := NewBlock(data)
+	if plain.Unpooled() != plain {
+		t.Fatal("expected an unpooled block returned as is")
+	}
+	plain.Release()
+	if plain.Data == nil {
+		t.Fatal("releasing an unpooled block dropped its data")
+	}
+}